@@ -0,0 +1,112 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdCache() *cli.Command {
+	return &cli.Command{
+		Name:      "cache",
+		Action:    updateCache,
+		Category:  "TOOL",
+		Usage:     "Change the cache directories or size of a mount point without remounting",
+		ArgsUsage: "MOUNTPOINT",
+		Description: `
+The cached blocks in the removed directories are moved to others, and the staging blocks in them are
+uploaded, then the directories are not used any more. The cached blocks are rebalanced in background
+after the directories are changed. It only changes the running client, please update the options of
+mount command as well to keep them after remounted.
+
+Examples:
+# Add a cache directory
+$ juicefs cache /mnt/jfs --cache-dir /var/jfsCache:/data/jfsCache
+
+# Change the size of cache
+$ juicefs cache /mnt/jfs --cache-size 204800`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "cache-dir",
+				Usage: "new directory paths of local cache, use colon to separate multiple paths",
+			},
+			&cli.Int64Flag{
+				Name:  "cache-size",
+				Usage: "new size of cached object for read in MiB",
+			},
+		},
+	}
+}
+
+func updateCache(ctx *cli.Context) error {
+	setup(ctx, 1)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	dirs, size := ctx.String("cache-dir"), ctx.Int64("cache-size")
+	if dirs == "" && size == 0 {
+		logger.Fatalf("Nothing to change, please specify --cache-dir or --cache-size")
+	}
+	if size < 0 {
+		logger.Fatalf("Invalid cache size: %d", size)
+	}
+	if dirs != "" && dirs != "memory" {
+		var abs []string
+		for _, d := range utils.SplitDir(dirs) {
+			p, err := filepath.Abs(d)
+			if err != nil {
+				logger.Fatalf("abs of %s: %s", d, err)
+			}
+			abs = append(abs, p)
+		}
+		dirs = strings.Join(abs, string(os.PathListSeparator))
+	}
+	mp := ctx.Args().Get(0)
+	f, err := openController(mp)
+	if err != nil {
+		logger.Fatalf("open controller: %s", err)
+	}
+	defer f.Close()
+	wb := utils.NewBuffer(8 + 4 + uint32(len(dirs)) + 8)
+	wb.Put32(meta.UpdateCache)
+	wb.Put32(4 + uint32(len(dirs)) + 8)
+	wb.Put32(uint32(len(dirs)))
+	wb.Put([]byte(dirs))
+	wb.Put64(uint64(size))
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	var resp = make([]byte, 1)
+	readControl(f, resp)
+	switch errno := syscall.Errno(resp[0]); errno {
+	case 0:
+		logger.Infof("Cache of %s is updated", mp)
+	case syscall.EINVAL:
+		logger.Fatalf("Failed to update cache, please check the log of mount point (or it is not supported, please upgrade and mount again)")
+	default:
+		logger.Fatalf("Update cache: %s", errno)
+	}
+	return nil
+}
@@ -62,7 +62,16 @@ func clone(ctx *cli.Context) error {
 		logger.Infof("Windows is not supported")
 		return nil
 	}
-	srcPath := ctx.Args().Get(0)
+	var cmode uint8
+	if ctx.Bool("preserve") {
+		cmode |= meta.CLONE_MODE_PRESERVE_ATTR
+	}
+	return doClone(ctx.Args().Get(0), ctx.Args().Get(1), cmode)
+}
+
+// doClone clones srcPath into dst through the control file of the mount point,
+// dst is treated as a directory if it ends with "/".
+func doClone(srcPath, dst string, cmode uint8) error {
 	srcAbsPath, err := filepath.Abs(srcPath)
 	if err != nil {
 		return fmt.Errorf("abs of %s: %s", srcPath, err)
@@ -71,7 +80,6 @@ func clone(ctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("lookup inode for %s: %s", srcPath, err)
 	}
-	dst := ctx.Args().Get(1)
 	if strings.HasSuffix(dst, "/") {
 		dst = filepath.Join(dst, filepath.Base(srcPath))
 	}
@@ -106,11 +114,7 @@ func clone(ctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("lookup inode for %s: %s", dstParent, err)
 	}
-	var cmode uint8
 	umask := utils.GetUmask()
-	if ctx.Bool("preserve") {
-		cmode |= meta.CLONE_MODE_PRESERVE_ATTR
-	}
 	headerSize := 4 + 4
 	contentSize := 8 + 8 + 1 + uint32(len(dstName)) + 2 + 1
 	wb := utils.NewBuffer(uint32(headerSize) + contentSize)
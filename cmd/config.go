@@ -21,8 +21,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/juicedata/juicefs/pkg/compress"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/version"
 	"github.com/pkg/errors"
@@ -49,8 +51,14 @@ $ juicefs config redis://localhost --inode 10000000 --capacity 1048576
 # Change maximum days before files in trash are deleted
 $ juicefs config redis://localhost --trash-days 7
 
+# Keep the files removed from /tmp in trash for 1 day and disable trash for /scratch
+$ juicefs config redis://localhost --trash-policy /tmp:1 --trash-policy /scratch:0
+
 # Limit client version that is allowed to connect
-$ juicefs config redis://localhost --min-client-version 1.0.0 --max-client-version 1.1.0`,
+$ juicefs config redis://localhost --min-client-version 1.0.0 --max-client-version 1.1.0
+
+# Limit the client of session 3 to 1000 metadata ops/s and 100 Mbps for both upload and download
+$ juicefs config redis://localhost --client-limit 3:1000:100:100`,
 		Flags: expandFlags(
 			formatStorageFlags(),
 			addCategories("DATA STORAGE", []cli.Flag{
@@ -62,6 +70,22 @@ $ juicefs config redis://localhost --min-client-version 1.0.0 --max-client-versi
 					Name:  "download-limit",
 					Usage: "default bandwidth limit of the volume for download in Mbps",
 				},
+				&cli.IntFlag{
+					Name:  "compress-level",
+					Usage: "compression level of zstd for new blocks (1-22, 0 means the default level 1)",
+				},
+				&cli.IntFlag{
+					Name:  "inline-size",
+					Usage: "size of new blocks in KiB which are kept in metadata engine instead of object storage (0 to stop inlining, up to 32)",
+				},
+				&cli.BoolFlag{
+					Name:  "dedupe",
+					Usage: "share the new blocks with identical content across files, it can't be disabled once enabled",
+				},
+				&cli.IntFlag{
+					Name:  "pack-size",
+					Usage: "size of new blocks in KiB which are packed into larger objects to save requests (0 to stop packing, up to 1024)",
+				},
 			}),
 			formatManagementFlags(),
 			configManagementFlags(),
@@ -87,6 +111,18 @@ func configManagementFlags() []cli.Flag {
 			Name:  "dir-stats",
 			Usage: "enable dir stats, which is necessary for fast summary and dir quota",
 		},
+		&cli.BoolFlag{
+			Name:  "changelog",
+			Usage: "log the changed inodes, which is necessary for incremental backup of metadata",
+		},
+		&cli.StringSliceFlag{
+			Name:  "client-limit",
+			Usage: "limits of a client (CLIENT:META-OPS:UPLOAD:DOWNLOAD), CLIENT is a session ID, hostname or * for all, META-OPS in ops/s, UPLOAD and DOWNLOAD in Mbps, 0 means unlimited and all 0 to remove the limits",
+		},
+		&cli.StringSliceFlag{
+			Name:  "trash-policy",
+			Usage: "days to keep the files removed from a directory in trash (PATH:DAYS, 0 to disable trash and -1 to remove the policy)",
+		},
 	})
 }
 
@@ -123,6 +159,24 @@ func userConfirmed() bool {
 	return false
 }
 
+// lookupDir returns the inode of a directory in the volume.
+func lookupDir(m meta.Meta, dpath string) (meta.Ino, error) {
+	inode := meta.RootInode
+	var attr meta.Attr
+	for _, name := range strings.Split(dpath, "/") {
+		if name == "" {
+			continue
+		}
+		if st := m.Lookup(meta.Background, inode, name, &inode, &attr, false); st != 0 {
+			return 0, fmt.Errorf("lookup %s: %s", dpath, st)
+		}
+		if attr.Typ != meta.TypeDirectory {
+			return 0, fmt.Errorf("%s is not a directory", dpath)
+		}
+	}
+	return inode, nil
+}
+
 func config(ctx *cli.Context) error {
 	setup(ctx, 1)
 	removePassword(ctx.Args().Get(0))
@@ -194,6 +248,48 @@ func config(ctx *cli.Context) error {
 			}
 			format.SessionToken = ctx.String(flag)
 			storage = true
+		case "mirror-storage":
+			if new := ctx.String(flag); new != format.MirrorStorage {
+				msg.WriteString(fmt.Sprintf("%10s: %s -> %s\n", flag, format.MirrorStorage, new))
+				format.MirrorStorage = new
+				storage = true
+			}
+		case "mirror-bucket":
+			if new := ctx.String(flag); new != format.MirrorBucket {
+				msg.WriteString(fmt.Sprintf("%10s: %s -> %s\n", flag, format.MirrorBucket, new))
+				format.MirrorBucket = new
+				storage = true
+			}
+		case "mirror-access-key":
+			if new := ctx.String(flag); new != format.MirrorAccessKey {
+				msg.WriteString(fmt.Sprintf("%10s: %s -> %s\n", flag, format.MirrorAccessKey, new))
+				format.MirrorAccessKey = new
+				storage = true
+			}
+		case "mirror-secret-key": // always update
+			msg.WriteString(fmt.Sprintf("%10s: updated\n", flag))
+			if err := format.Decrypt(); err != nil && strings.Contains(err.Error(), "secret was removed") {
+				logger.Warnf("decrypt secrets: %s", err)
+			}
+			format.MirrorSecretKey = ctx.String(flag)
+			storage = true
+		case "mirror-async":
+			if new := ctx.Bool(flag); new != format.MirrorAsync {
+				msg.WriteString(fmt.Sprintf("%10s: %t -> %t\n", flag, format.MirrorAsync, new))
+				format.MirrorAsync = new
+			}
+		case "fallback-buckets":
+			if new := ctx.String(flag); new != format.FallbackBuckets {
+				msg.WriteString(fmt.Sprintf("%10s: %s -> %s\n", flag, format.FallbackBuckets, new))
+				format.FallbackBuckets = new
+				storage = true
+			}
+		case "replica-read":
+			if new := ctx.String(flag); new != format.ReplicaRead {
+				msg.WriteString(fmt.Sprintf("%10s: %s -> %s\n", flag, format.ReplicaRead, new))
+				format.ReplicaRead = new
+				storage = true
+			}
 		case "storage-class": // always update
 			if new := ctx.String(flag); new != format.StorageClass {
 				msg.WriteString(fmt.Sprintf("%10s: %s -> %s\n", flag, format.StorageClass, new))
@@ -210,6 +306,44 @@ func config(ctx *cli.Context) error {
 				msg.WriteString(fmt.Sprintf("%10s: %d -> %d\n", flag, format.DownloadLimit, new))
 				format.DownloadLimit = new
 			}
+		case "compress-level":
+			if new := ctx.Int(flag); new != format.CompressLevel {
+				if _, err := compress.NewZStandard(new, nil); err != nil {
+					return err
+				}
+				msg.WriteString(fmt.Sprintf("%10s: %d -> %d\n", flag, format.CompressLevel, new))
+				format.CompressLevel = new
+			}
+		case "inline-size":
+			if new := ctx.Int(flag) << 10; new != format.InlineSize {
+				if new < 0 || new > meta.MaxInlineSize {
+					return fmt.Errorf("invalid inline size: %d KiB", ctx.Int(flag))
+				}
+				if new > 0 && (format.EncryptKey != "" || format.EncryptMasterKey != "") {
+					return fmt.Errorf("blocks can not be inlined into metadata engine for encrypted volume")
+				}
+				msg.WriteString(fmt.Sprintf("%10s: %d -> %d\n", flag, format.InlineSize, new))
+				format.InlineSize = new
+			}
+		case "dedupe":
+			if new := ctx.Bool(flag); new != format.Dedupe {
+				if !new { // the deduplicated blocks can only be found with it
+					return fmt.Errorf("dedupe can not be disabled once enabled")
+				}
+				msg.WriteString(fmt.Sprintf("%10s: %t -> %t\n", flag, format.Dedupe, new))
+				format.Dedupe = new
+			}
+		case "pack-size":
+			if new := ctx.Int(flag) << 10; new != format.PackSize {
+				if new < 0 || new > meta.MaxPackSize {
+					return fmt.Errorf("invalid pack size: %d KiB", ctx.Int(flag))
+				}
+				if new > 0 && (format.EncryptKey != "" || format.EncryptMasterKey != "") {
+					return fmt.Errorf("blocks can not be packed for encrypted volume")
+				}
+				msg.WriteString(fmt.Sprintf("%10s: %d -> %d\n", flag, format.PackSize, new))
+				format.PackSize = new
+			}
 		case "trash-days":
 			if new := ctx.Int(flag); new != format.TrashDays {
 				if new < 0 {
@@ -219,11 +353,84 @@ func config(ctx *cli.Context) error {
 				format.TrashDays = new
 				trash = true
 			}
+		case "client-limit":
+			for _, l := range ctx.StringSlice(flag) {
+				ps := strings.Split(l, ":")
+				if len(ps) != 4 || ps[0] == "" {
+					return fmt.Errorf("Invalid client limit: %s", l)
+				}
+				var vs [3]int64
+				for i, p := range ps[1:] {
+					if vs[i], err = strconv.ParseInt(p, 10, 64); err != nil || vs[i] < 0 {
+						return fmt.Errorf("Invalid client limit: %s", l)
+					}
+				}
+				old := format.ClientLimits[ps[0]]
+				new := &meta.ClientLimit{MetaOps: vs[0], UploadLimit: vs[1], DownloadLimit: vs[2]}
+				if *new == (meta.ClientLimit{}) {
+					if old != nil {
+						msg.WriteString(fmt.Sprintf("%10s: %s: %+v -> removed\n", flag, ps[0], *old))
+						delete(format.ClientLimits, ps[0])
+					}
+				} else if old == nil || *old != *new {
+					if format.ClientLimits == nil {
+						format.ClientLimits = make(map[string]*meta.ClientLimit)
+					}
+					if old != nil {
+						msg.WriteString(fmt.Sprintf("%10s: %s: %+v -> %+v\n", flag, ps[0], *old, *new))
+					} else {
+						msg.WriteString(fmt.Sprintf("%10s: %s: %+v\n", flag, ps[0], *new))
+					}
+					format.ClientLimits[ps[0]] = new
+				}
+			}
+		case "trash-policy":
+			for _, p := range ctx.StringSlice(flag) {
+				i := strings.LastIndex(p, ":")
+				if i < 0 {
+					return fmt.Errorf("Invalid trash policy: %s", p)
+				}
+				days, err := strconv.Atoi(p[i+1:])
+				if err != nil || days < -1 {
+					return fmt.Errorf("Invalid trash days in policy: %s", p)
+				}
+				inode, err := lookupDir(m, p[:i])
+				if err != nil {
+					return err
+				}
+				old, ok := format.TrashPolicies[inode]
+				if days < 0 {
+					if ok {
+						msg.WriteString(fmt.Sprintf("%10s: %s: %d -> removed\n", flag, p[:i], old))
+						delete(format.TrashPolicies, inode)
+					}
+				} else if !ok || old != days {
+					if format.TrashPolicies == nil {
+						format.TrashPolicies = make(map[meta.Ino]int)
+					}
+					if ok {
+						msg.WriteString(fmt.Sprintf("%10s: %s: %d -> %d\n", flag, p[:i], old, days))
+					} else {
+						msg.WriteString(fmt.Sprintf("%10s: %s: %d\n", flag, p[:i], days))
+					}
+					format.TrashPolicies[inode] = days
+				}
+			}
+		case "verify-checksum":
+			if new := ctx.Bool(flag); new != format.VerifyChecksum {
+				msg.WriteString(fmt.Sprintf("%10s: %t -> %t\n", flag, format.VerifyChecksum, new))
+				format.VerifyChecksum = new
+			}
 		case "dir-stats":
 			if new := ctx.Bool(flag); new != format.DirStats {
 				msg.WriteString(fmt.Sprintf("%10s: %t -> %t\n", flag, format.DirStats, new))
 				format.DirStats = new
 			}
+		case "changelog":
+			if new := ctx.Bool(flag); new != format.Changelog {
+				msg.WriteString(fmt.Sprintf("%10s: %t -> %t\n", flag, format.Changelog, new))
+				format.Changelog = new
+			}
 		case "min-client-version":
 			if new := ctx.String(flag); new != format.MinClientVersion {
 				if version.Parse(new) == nil {
@@ -288,9 +495,13 @@ func config(ctx *cli.Context) error {
 			if len(qs) != 0 {
 				paths := make([]string, 0, len(qs))
 				for path := range qs {
-					paths = append(paths, path)
+					if !strings.HasPrefix(path, "uid:") && !strings.HasPrefix(path, "gid:") {
+						paths = append(paths, path)
+					}
+				}
+				if len(paths) > 0 {
+					return fmt.Errorf("cannot disable dir stats when there are still %d dir quotas: %v", len(paths), paths)
 				}
-				return fmt.Errorf("cannot disable dir stats when there are still %d dir quotas: %v", len(qs), paths)
 			}
 		}
 		if clientVer && format.CheckVersion() != nil {
@@ -24,7 +24,7 @@ import (
 	"sync"
 
 	"github.com/juicedata/juicefs/pkg/meta"
-	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/urfave/cli/v2"
 )
@@ -158,7 +158,7 @@ func destroy(ctx *cli.Context) error {
 		}
 	}
 
-	objs, err := osync.ListAll(blob, "", "", "")
+	objs, err := object.ListAllParallel(blob, "", "", 8)
 	if err != nil {
 		logger.Fatalf("list all objects: %s", err)
 	}
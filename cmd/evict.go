@@ -0,0 +1,61 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdEvict() *cli.Command {
+	return &cli.Command{
+		Name:      "evict",
+		Action:    evict,
+		Category:  "ADMIN",
+		Usage:     "Evict client sessions",
+		ArgsUsage: "META-URL SID [SID ...]",
+		Description: `
+Evict the sessions of stuck clients, their locks are released and sustained inodes are cleaned up,
+then the clients can't make any changes to the volume (read-only) until they are remounted.
+The session IDs (sid) can be found by "juicefs status".
+
+Examples:
+$ juicefs evict redis://localhost 3`,
+	}
+}
+
+func evict(ctx *cli.Context) error {
+	setup(ctx, 2)
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), nil)
+	if _, err := m.Load(true); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	for _, arg := range ctx.Args().Slice()[1:] {
+		sid, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			logger.Fatalf("invalid session ID %s: %s", arg, err)
+		}
+		if err = m.EvictSession(meta.Background, sid); err != nil {
+			logger.Fatalf("evict session %d: %s", sid, err)
+		}
+		logger.Infof("Session %d is evicted", sid)
+	}
+	return nil
+}
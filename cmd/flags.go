@@ -124,6 +124,11 @@ func storageFlags() []cli.Flag {
 			Value: 20,
 			Usage: "number of connections to upload",
 		},
+		&cli.IntFlag{
+			Name:  "max-downloads",
+			Value: 200,
+			Usage: "number of connections to download, 0 means unlimited",
+		},
 		&cli.IntFlag{
 			Name:  "max-deletes",
 			Value: 10,
@@ -137,6 +142,22 @@ func storageFlags() []cli.Flag {
 			Name:  "download-limit",
 			Usage: "bandwidth limit for download in Mbps",
 		},
+		&cli.StringFlag{
+			Name:  "upload-limit-schedule",
+			Usage: "daily windows overriding upload-limit in local time, e.g. 09:00-18:00=50,18:00-09:00=0 (Mbps, 0 means unlimited)",
+		},
+		&cli.StringFlag{
+			Name:  "download-limit-schedule",
+			Usage: "daily windows overriding download-limit in local time, e.g. 09:00-18:00=100 (Mbps, 0 means unlimited)",
+		},
+		&cli.BoolFlag{
+			Name:  "object-tags",
+			Usage: "attach tags (volume UUID, chunk id and creation time) to uploaded blocks",
+		},
+		&cli.StringFlag{
+			Name:  "data-key-dir",
+			Usage: "directory of the data keys which can be bound to directories by xattr user.juicefs.key",
+		},
 	})
 }
 
@@ -202,6 +223,18 @@ func dataCacheFlags() []cli.Flag {
 			Name:  "cache-partial-only",
 			Usage: "cache only random/small read",
 		},
+		&cli.BoolFlag{
+			Name:  "cache-ranges",
+			Usage: "cache only the ranges read by small random reads instead of whole blocks",
+		},
+		&cli.BoolFlag{
+			Name:  "cache-io-uring",
+			Usage: "read and write the cache files through io_uring (experimental, Linux only)",
+		},
+		&cli.BoolFlag{
+			Name:  "encrypt-cache",
+			Usage: "encrypt the cached and staging blocks with a key derived from the encryption key of volume",
+		},
 		&cli.StringFlag{
 			Name:  "verify-cache-checksum",
 			Value: "full",
@@ -217,6 +250,24 @@ func dataCacheFlags() []cli.Flag {
 			Value: "3600",
 			Usage: "interval (in seconds) to scan cache-dir to rebuild in-memory index",
 		},
+		&cli.IntFlag{
+			Name:  "memory-cache-size",
+			Usage: "size of the memory cache tier in front of cache-dir in MiB (0 means disabled)",
+		},
+		&cli.StringFlag{
+			Name:  "cold-cache-dir",
+			Usage: "directory paths of the cold cache tier behind cache-dir (e.g. HDD), use colon to separate multiple paths",
+		},
+		&cli.IntFlag{
+			Name:  "cold-cache-size",
+			Value: 1 << 20,
+			Usage: "size of the cold cache tier in MiB",
+		},
+		&cli.IntFlag{
+			Name:  "cache-promote-hits",
+			Value: 2,
+			Usage: "promote a cached block into the hotter tier after it's hit so many times in the colder one",
+		},
 	})
 }
 
@@ -226,6 +277,10 @@ func metaFlags() []cli.Flag {
 			Name:  "subdir",
 			Usage: "mount a sub-directory as root",
 		},
+		&cli.StringFlag{
+			Name:  "snapshot",
+			Usage: "mount a snapshot of the volume (read-only), the subdir is relative to the snapshot",
+		},
 		&cli.StringFlag{
 			Name:  "backup-meta",
 			Value: "3600",
@@ -254,6 +309,11 @@ func metaFlags() []cli.Flag {
 			Value: 20,
 			Usage: "number of retries after which the update of directory nlink will be skipped (used for tkv only, 0 means never)",
 		},
+		&cli.StringFlag{
+			Name:  "slow-txn",
+			Value: "0",
+			Usage: "log the meta transactions slower than it (in seconds) with the keys or inodes they work on (0 means disabled)",
+		},
 	})
 }
 
@@ -285,6 +345,30 @@ func shareInfoFlags() []cli.Flag {
 	})
 }
 
+func accessLogFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "access-log",
+			Usage: "path for JuiceFS access log",
+		},
+		&cli.StringFlag{
+			Name:  "access-log-format",
+			Value: "text",
+			Usage: "format of access log (text or json)",
+		},
+		&cli.Float64Flag{
+			Name:  "access-log-sample",
+			Value: 1,
+			Usage: "ratio of the successful operations to be logged, failed ones are always logged",
+		},
+		&cli.Int64Flag{
+			Name:  "access-log-rotate",
+			Value: 300,
+			Usage: "rotate the access log when its size exceeds this (in MiB), up to 7 rotated files are kept",
+		},
+	}
+}
+
 func metaCacheFlags(defaultEntryCache float64) []cli.Flag {
 	return addCategories("META CACHE", []cli.Flag{
 		&cli.Float64Flag{
@@ -312,6 +396,10 @@ func metaCacheFlags(defaultEntryCache float64) []cli.Flag {
 			Value: 10000,
 			Usage: "max number of open files to cache (soft limit, 0 means unlimited)",
 		},
+		&cli.BoolFlag{
+			Name:  "invalidate-cache",
+			Usage: "publish the changed inodes to invalidate the caches of other clients, so longer attr-cache and open-cache can be used",
+		},
 	})
 }
 
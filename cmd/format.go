@@ -18,6 +18,7 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -138,6 +139,34 @@ func formatStorageFlags() []cli.Flag {
 			Name:  "storage-class",
 			Usage: "the default storage class",
 		},
+		&cli.StringFlag{
+			Name:  "mirror-storage",
+			Usage: "object storage type of the mirror, same as --storage by default",
+		},
+		&cli.StringFlag{
+			Name:  "mirror-bucket",
+			Usage: "the bucket URL of object storage to replicate all the data",
+		},
+		&cli.StringFlag{
+			Name:  "mirror-access-key",
+			Usage: "access key for the mirror",
+		},
+		&cli.StringFlag{
+			Name:  "mirror-secret-key",
+			Usage: "secret key for the mirror",
+		},
+		&cli.BoolFlag{
+			Name:  "mirror-async",
+			Usage: "replicate the data to the mirror in background by a persistent queue",
+		},
+		&cli.StringFlag{
+			Name:  "fallback-buckets",
+			Usage: "buckets replicated from --bucket (separated by comma) to read from when the object is missing or the primary is unavailable",
+		},
+		&cli.StringFlag{
+			Name:  "replica-read",
+			Usage: "how to read from the bucket and its mirror or fallback buckets: primary, fastest (race the reads) or balance (by latency)",
+		},
 	})
 }
 
@@ -153,6 +182,26 @@ func formatFlags() []cli.Flag {
 			Value: "none",
 			Usage: "compression algorithm (lz4, zstd, none)",
 		},
+		&cli.IntFlag{
+			Name:  "compress-level",
+			Usage: "compression level of zstd (1-22, 0 means the default level 1)",
+		},
+		&cli.StringFlag{
+			Name:  "compress-dict",
+			Usage: "path to a zstd dictionary (trained by 'zstd --train') shared by all the blocks, it can't be changed once set",
+		},
+		&cli.IntFlag{
+			Name:  "inline-size",
+			Usage: "size of blocks in KiB which are kept in metadata engine instead of object storage (0 means disabled, up to 32)",
+		},
+		&cli.BoolFlag{
+			Name:  "dedupe",
+			Usage: "share the blocks with identical content across files, it can't be disabled once enabled",
+		},
+		&cli.IntFlag{
+			Name:  "pack-size",
+			Usage: "size of blocks in KiB which are packed into larger objects to save requests (0 means disabled, up to 1024)",
+		},
 		&cli.StringFlag{
 			Name:  "encrypt-rsa-key",
 			Usage: "a path to RSA private key (PEM)",
@@ -162,14 +211,22 @@ func formatFlags() []cli.Flag {
 			Usage: "encrypt algorithm (aes256gcm-rsa, chacha20-rsa)",
 			Value: object.AES256GCM_RSA,
 		},
+		&cli.StringFlag{
+			Name:  "encrypt-master-key",
+			Usage: "master key to wrap the data keys instead of RSA key (awskms://<key-id>, file://<path>)",
+		},
 		&cli.BoolFlag{
 			Name:  "hash-prefix",
 			Usage: "add a hash prefix to name of objects",
 		},
+		&cli.BoolFlag{
+			Name:  "verify-checksum",
+			Usage: "verify the data against the checksum calculated by object storage on upload and download",
+		},
 		&cli.IntFlag{
 			Name:  "shards",
 			Value: 0,
-			Usage: "store the blocks into N buckets by hash of key",
+			Usage: "store the blocks into N buckets by hash of key, implied by the range in bucket (e.g. jfs-{0..15})",
 		},
 	})
 }
@@ -191,6 +248,14 @@ func formatManagementFlags() []cli.Flag {
 			Value: 1,
 			Usage: "number of days after which removed files will be permanently deleted",
 		},
+		&cli.BoolFlag{
+			Name:  "case-insensitive",
+			Usage: "look up the names case-insensitively (the case is preserved), which can not be changed later",
+		},
+		&cli.BoolFlag{
+			Name:  "enable-acl",
+			Usage: "enable POSIX ACL, which can not be disabled later (all the clients should be upgraded)",
+		},
 	})
 }
 
@@ -219,6 +284,9 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 	object.UserAgent = "JuiceFS-" + version.Version()
 	var blob object.ObjectStorage
 	var err error
+	var opLimits map[string]object.OpLimit
+	var retryPolicy *object.RetryPolicy
+	var breakerPolicy *object.BreakerPolicy
 	if u, err := url.Parse(format.Bucket); err == nil {
 		values := u.Query()
 		if values.Get("tls-insecure-skip-verify") != "" {
@@ -231,6 +299,19 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 			u.RawQuery = values.Encode()
 			format.Bucket = u.String()
 		}
+		if opLimits, err = object.ParseOpLimits(values); err != nil {
+			return nil, err
+		}
+		if retryPolicy, err = object.ParseRetryPolicy(values); err != nil {
+			return nil, err
+		}
+		if breakerPolicy, err = object.ParseBreakerPolicy(values); err != nil {
+			return nil, err
+		}
+		if len(opLimits) > 0 || retryPolicy != nil || breakerPolicy != nil {
+			u.RawQuery = values.Encode()
+			format.Bucket = u.String()
+		}
 	}
 
 	if format.Shards > 1 {
@@ -241,12 +322,60 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 	if err != nil {
 		return nil, err
 	}
+	if format.VerifyChecksum {
+		if cs, ok := blob.(object.SupportChecksum); ok {
+			cs.SetVerifyChecksum(true)
+		} else {
+			logger.Warnf("Verifying checksum is not supported by %s", blob)
+		}
+	}
+	if retryPolicy != nil {
+		object.DisableRetries(blob)
+	}
+	if breakerPolicy != nil {
+		blob = object.NewBreaker(blob, breakerPolicy)
+	}
+	if format.FallbackBuckets != "" {
+		if blob, err = createFallback(blob, format); err != nil {
+			return nil, err
+		}
+	}
+	if format.MirrorBucket != "" {
+		if blob, err = createMirror(blob, format); err != nil {
+			return nil, err
+		}
+	}
+	if retryPolicy != nil {
+		object.DisableRetries(blob) // the fallback and mirror buckets
+	}
+	if rs, ok := blob.(object.SupportReplicas); ok && format.ReplicaRead != "" {
+		if blob, err = object.NewReplicaReader(blob, rs.Replicas(), format.ReplicaRead); err != nil {
+			return nil, err
+		}
+	}
+	if len(opLimits) > 0 {
+		blob = object.NewLimited(blob, opLimits)
+	}
+	if retryPolicy != nil {
+		blob = object.NewRetried(blob, retryPolicy)
+	}
 	blob = object.WithPrefix(blob, format.Name+"/")
 	if format.StorageClass != "" {
 		if os, ok := blob.(object.SupportStorageClass); ok {
 			os.SetStorageClass(format.StorageClass)
 		}
 	}
+	encryptor, err := newEncryptor(format)
+	if err != nil {
+		return nil, err
+	} else if encryptor != nil {
+		blob = object.NewEncrypted(blob, encryptor)
+	}
+	return blob, nil
+}
+
+// newEncryptor returns the encryptor of data for encrypted volume, or nil if it's not encrypted.
+func newEncryptor(format meta.Format) (object.Encryptor, error) {
 	if format.EncryptKey != "" {
 		passphrase := os.Getenv("JFS_RSA_PASSPHRASE")
 		if passphrase == "" {
@@ -261,13 +390,75 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 		if err != nil {
 			return nil, fmt.Errorf("parse rsa: %s", err)
 		}
-		encryptor, err := object.NewDataEncryptor(object.NewRSAEncryptor(privKey), format.EncryptAlgo)
+		return object.NewDataEncryptor(object.NewRSAEncryptor(privKey), format.EncryptAlgo)
+	} else if format.EncryptMasterKey != "" {
+		keyEncryptor, err := object.NewMasterKeyEncryptor(format.EncryptMasterKey)
 		if err != nil {
 			return nil, err
 		}
-		blob = object.NewEncrypted(blob, encryptor)
+		return object.NewDataEncryptor(keyEncryptor, format.EncryptAlgo)
 	}
-	return blob, nil
+	return nil, nil
+}
+
+// createFallback returns the storage that reads from the replicas of primary when it fails,
+// the replicas are accessed with the same type and credentials as the primary.
+func createFallback(primary object.ObjectStorage, format meta.Format) (object.ObjectStorage, error) {
+	var replicas []object.ObjectStorage
+	for _, bucket := range strings.Split(format.FallbackBuckets, ",") {
+		bucket = strings.TrimSpace(bucket)
+		if bucket == "" {
+			continue
+		}
+		var replica object.ObjectStorage
+		var err error
+		if format.Shards > 1 {
+			replica, err = object.NewSharded(strings.ToLower(format.Storage), bucket, format.AccessKey, format.SecretKey, format.SessionToken, format.Shards)
+		} else {
+			replica, err = object.CreateStorage(strings.ToLower(format.Storage), bucket, format.AccessKey, format.SecretKey, format.SessionToken)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fallback bucket %s: %s", bucket, err)
+		}
+		if cs, ok := replica.(object.SupportChecksum); ok && format.VerifyChecksum {
+			cs.SetVerifyChecksum(true)
+		}
+		replicas = append(replicas, replica)
+	}
+	logger.Infof("Read from %d fallback buckets if %s failed", len(replicas), primary)
+	return object.NewFallback(primary, replicas...), nil
+}
+
+// createMirror returns the storage that replicates the data of primary to the mirror bucket.
+func createMirror(primary object.ObjectStorage, format meta.Format) (object.ObjectStorage, error) {
+	storage := format.MirrorStorage
+	if storage == "" {
+		storage = format.Storage
+	}
+	mirror, err := object.CreateStorage(strings.ToLower(storage), format.MirrorBucket, format.MirrorAccessKey, format.MirrorSecretKey, "")
+	if err != nil {
+		return nil, fmt.Errorf("mirror: %s", err)
+	}
+	var queueDir string
+	if format.MirrorAsync {
+		queueDir = mirrorQueueDir(format.UUID)
+	}
+	logger.Infof("Replicate data to mirror %s (async: %t)", mirror, format.MirrorAsync)
+	return object.NewReplicated(primary, mirror, queueDir)
+}
+
+// mirrorQueueDir is where the objects to be replicated asynchronously are persisted,
+// which could be changed by the environment variable JFS_MIRROR_QUEUE_DIR.
+func mirrorQueueDir(uuid string) string {
+	dir := os.Getenv("JFS_MIRROR_QUEUE_DIR")
+	if dir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			homeDir = os.TempDir()
+		}
+		dir = path.Join(homeDir, ".juicefs", "mirror")
+	}
+	return path.Join(dir, uuid)
 }
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -349,6 +540,25 @@ func loadEncrypt(keyPath string) string {
 	return string(pem)
 }
 
+// putCompressDict uploads the zstd dictionary into object storage and returns its key.
+func putCompressDict(blob object.ObjectStorage, format *meta.Format, path string) (string, error) {
+	if strings.ToLower(format.Compression) != "zstd" {
+		return "", fmt.Errorf("dictionary is only supported by zstd, but the compression is %q", format.Compression)
+	}
+	dict, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err = compress.NewZStandard(format.CompressLevel, dict); err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("dict/zstd-%x", sha256.Sum256(dict))
+	if key == format.CompressDict {
+		return key, nil
+	}
+	return key, blob.Put(key, bytes.NewReader(dict))
+}
+
 func format(c *cli.Context) error {
 	setup(c, 2)
 	removePassword(c.Args().Get(0))
@@ -361,12 +571,24 @@ func format(c *cli.Context) error {
 	if v := c.String("compress"); compress.NewCompressor(v) == nil {
 		logger.Fatalf("Unsupported compress algorithm: %s", v)
 	}
+	if _, err := compress.NewZStandard(c.Int("compress-level"), nil); err != nil {
+		logger.Fatalf("Invalid compress level: %s", err)
+	}
 	if v := c.Int("trash-days"); v < 0 {
 		logger.Fatalf("Invalid trash days: %d", v)
 	}
+	if v := c.Int("inline-size"); v < 0 || v<<10 > meta.MaxInlineSize {
+		logger.Fatalf("Invalid inline size: %d, it should be between 0 and %d", v, meta.MaxInlineSize>>10)
+	}
+	if v := c.Int("pack-size"); v < 0 || v<<10 > meta.MaxPackSize {
+		logger.Fatalf("Invalid pack size: %d, it should be between 0 and %d", v, meta.MaxPackSize>>10)
+	}
 	if v := c.Int("shards"); v > 256 {
 		logger.Fatalf("too many shards: %d", v)
 	}
+	if c.IsSet("encrypt-rsa-key") && c.IsSet("encrypt-master-key") {
+		logger.Fatalf("encrypt-rsa-key and encrypt-master-key cannot be used together")
+	}
 
 	var create, encrypted bool
 	format, err := m.Load(false)
@@ -397,44 +619,91 @@ func format(c *cli.Context) error {
 					logger.Warnf("decrypt secrets: %s", err)
 				}
 				format.SessionToken = c.String(flag)
+			case "mirror-storage":
+				format.MirrorStorage = c.String(flag)
+			case "mirror-bucket":
+				format.MirrorBucket = c.String(flag)
+			case "mirror-access-key":
+				format.MirrorAccessKey = c.String(flag)
+			case "mirror-secret-key":
+				encrypted = format.KeyEncrypted
+				if err := format.Decrypt(); err != nil && strings.Contains(err.Error(), "secret was removed") {
+					logger.Warnf("decrypt secrets: %s", err)
+				}
+				format.MirrorSecretKey = c.String(flag)
+			case "mirror-async":
+				format.MirrorAsync = c.Bool(flag)
+			case "fallback-buckets":
+				format.FallbackBuckets = c.String(flag)
+			case "replica-read":
+				format.ReplicaRead = c.String(flag)
 			case "trash-days":
 				format.TrashDays = c.Int(flag)
 			case "block-size":
 				format.BlockSize = fixObjectSize(c.Int(flag))
 			case "compress":
 				format.Compression = c.String(flag)
+			case "compress-level":
+				format.CompressLevel = c.Int(flag)
+			case "inline-size":
+				format.InlineSize = c.Int(flag) << 10
+			case "dedupe":
+				format.Dedupe = c.Bool(flag)
+			case "pack-size":
+				format.PackSize = c.Int(flag) << 10
 			case "shards":
 				format.Shards = c.Int(flag)
 			case "hash-prefix":
 				format.HashPrefix = c.Bool(flag)
+			case "verify-checksum":
+				format.VerifyChecksum = c.Bool(flag)
 			case "storage":
 				format.Storage = c.String(flag)
-			case "encrypt-rsa-key", "encrypt-algo":
+			case "enable-acl":
+				format.EnableACL = c.Bool(flag)
+			case "encrypt-rsa-key", "encrypt-algo", "encrypt-master-key", "case-insensitive":
 				logger.Warnf("Flag %s is ignored since it cannot be updated", flag)
 			}
 		}
 	} else if strings.HasPrefix(err.Error(), "database is not formatted") {
 		create = true
 		format = &meta.Format{
-			Name:         name,
-			UUID:         uuid.New().String(),
-			Storage:      c.String("storage"),
-			StorageClass: c.String("storage-class"),
-			Bucket:       c.String("bucket"),
-			AccessKey:    c.String("access-key"),
-			SecretKey:    c.String("secret-key"),
-			SessionToken: c.String("session-token"),
-			EncryptKey:   loadEncrypt(c.String("encrypt-rsa-key")),
-			EncryptAlgo:  c.String("encrypt-algo"),
-			Shards:       c.Int("shards"),
-			HashPrefix:   c.Bool("hash-prefix"),
-			Capacity:     c.Uint64("capacity") << 30,
-			Inodes:       c.Uint64("inodes"),
-			BlockSize:    fixObjectSize(c.Int("block-size")),
-			Compression:  c.String("compress"),
-			TrashDays:    c.Int("trash-days"),
-			DirStats:     true,
-			MetaVersion:  meta.MaxVersion,
+			Name:             name,
+			UUID:             uuid.New().String(),
+			Storage:          c.String("storage"),
+			StorageClass:     c.String("storage-class"),
+			Bucket:           c.String("bucket"),
+			AccessKey:        c.String("access-key"),
+			SecretKey:        c.String("secret-key"),
+			SessionToken:     c.String("session-token"),
+			MirrorStorage:    c.String("mirror-storage"),
+			MirrorBucket:     c.String("mirror-bucket"),
+			MirrorAccessKey:  c.String("mirror-access-key"),
+			MirrorSecretKey:  c.String("mirror-secret-key"),
+			MirrorAsync:      c.Bool("mirror-async"),
+			FallbackBuckets:  c.String("fallback-buckets"),
+			ReplicaRead:      c.String("replica-read"),
+			EncryptKey:       loadEncrypt(c.String("encrypt-rsa-key")),
+			EncryptAlgo:      c.String("encrypt-algo"),
+			EncryptMasterKey: c.String("encrypt-master-key"),
+			Shards:           c.Int("shards"),
+			HashPrefix:       c.Bool("hash-prefix"),
+			VerifyChecksum:   c.Bool("verify-checksum"),
+			Capacity:         c.Uint64("capacity") << 30,
+			Inodes:           c.Uint64("inodes"),
+			BlockSize:        fixObjectSize(c.Int("block-size")),
+			Compression:      c.String("compress"),
+			CompressLevel:    c.Int("compress-level"),
+			InlineSize:       c.Int("inline-size") << 10,
+			Inlined:          c.Int("inline-size") > 0,
+			Dedupe:           c.Bool("dedupe"),
+			PackSize:         c.Int("pack-size") << 10,
+			Packed:           c.Int("pack-size") > 0,
+			TrashDays:        c.Int("trash-days"),
+			CaseInsensitive:  c.Bool("case-insensitive"),
+			EnableACL:        c.Bool("enable-acl"),
+			DirStats:         true,
+			MetaVersion:      meta.MaxVersion,
 		}
 		if format.AccessKey == "" && os.Getenv("ACCESS_KEY") != "" {
 			format.AccessKey = os.Getenv("ACCESS_KEY")
@@ -448,9 +717,25 @@ func format(c *cli.Context) error {
 			format.SessionToken = os.Getenv("SESSION_TOKEN")
 			_ = os.Unsetenv("SESSION_TOKEN")
 		}
+		if format.Shards == 0 {
+			// the number of shards is implied by the range in bucket, e.g. "jfs-{0..15}"
+			if eps, err := object.ShardEndpoints(format.Bucket, 0); err != nil {
+				logger.Fatalf("Invalid bucket %s: %s", format.Bucket, err)
+			} else if len(eps) > 256 {
+				logger.Fatalf("too many shards: %d", len(eps))
+			} else if len(eps) > 1 {
+				format.Shards = len(eps)
+			}
+		}
 	} else {
 		logger.Fatalf("Load metadata: %s", err)
 	}
+	if format.InlineSize > 0 && (format.EncryptKey != "" || format.EncryptMasterKey != "") {
+		logger.Fatalf("Blocks can not be inlined into metadata engine for encrypted volume")
+	}
+	if format.PackSize > 0 && (format.EncryptKey != "" || format.EncryptMasterKey != "") {
+		logger.Fatalf("Blocks can not be packed for encrypted volume")
+	}
 	if format.Storage == "file" || format.Storage == "sqlite3" {
 		p, err := filepath.Abs(format.Bucket)
 		if err == nil {
@@ -493,6 +778,12 @@ func format(c *cli.Context) error {
 		}
 	}
 
+	if p := c.String("compress-dict"); p != "" {
+		if format.CompressDict, err = putCompressDict(blob, format, p); err != nil {
+			logger.Fatalf("Put compression dictionary: %s", err)
+		}
+	}
+
 	if create || encrypted {
 		if err = format.Encrypt(); err != nil {
 			logger.Fatalf("Format encrypt: %s", err)
@@ -49,7 +49,10 @@ $ juicefs fsck redis://localhost
 $ juicefs fsck redis://localhost --path /d1/d2 --repair
 
 # recursively check
-$ juicefs fsck redis://localhost --path /d1/d2 --recursive`,
+$ juicefs fsck redis://localhost --path /d1/d2 --recursive
+
+# Recover lost objects from their previous versions (versioning should be enabled in the bucket)
+$ juicefs fsck redis://localhost --recover-versions`,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "path",
@@ -68,6 +71,10 @@ $ juicefs fsck redis://localhost --path /d1/d2 --recursive`,
 				Name:  "sync-dir-stat",
 				Usage: "sync stat of all directories, even if they are existed and not broken (NOTE: it may take a long time for huge trees)",
 			},
+			&cli.BoolFlag{
+				Name:  "recover-versions",
+				Usage: "recover lost objects from their noncurrent versions if versioning is enabled in the bucket (S3, GCS and Azure)",
+			},
 		},
 	}
 }
@@ -92,13 +99,15 @@ func fsck(ctx *cli.Context) error {
 	}
 
 	chunkConf := chunk.Config{
-		BlockSize:  format.BlockSize * 1024,
-		Compress:   format.Compression,
-		GetTimeout: time.Second * 60,
-		PutTimeout: time.Second * 60,
-		MaxUpload:  20,
-		BufferSize: 300 << 20,
-		CacheDir:   "memory",
+		BlockSize:     format.BlockSize * 1024,
+		Compress:      format.Compression,
+		CompressLevel: format.CompressLevel,
+		CompressDict:  format.CompressDict,
+		GetTimeout:    time.Second * 60,
+		PutTimeout:    time.Second * 60,
+		MaxUpload:     20,
+		BufferSize:    300 << 20,
+		CacheDir:      "memory",
 	}
 
 	blob, err := createStorage(*format)
@@ -106,6 +115,7 @@ func fsck(ctx *cli.Context) error {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	wrapped := wrapStorage(blob, m, format)
 	blob = object.WithPrefix(blob, "chunks/")
 	objs, err := osync.ListAll(blob, "", "", "")
 	if err != nil {
@@ -152,6 +162,8 @@ func fsck(ctx *cli.Context) error {
 	sliceCBar := progress.AddCountBar("Scanned slices", sliceCSpin.Current())
 	sliceBSpin := progress.AddByteSpinner("Scanned slices")
 	lostDSpin := progress.AddDoubleSpinner("Lost blocks")
+	recoverVersions := ctx.Bool("recover-versions")
+	recoveredDSpin := progress.AddDoubleSpinner("Recovered blocks")
 	brokens := make(map[meta.Ino]string)
 	for inode, ss := range slices {
 		for _, s := range ss {
@@ -169,7 +181,20 @@ func fsck(ctx *cli.Context) error {
 					} else {
 						objKey = fmt.Sprintf("%v/%v/%s", s.Id/1000/1000, s.Id/1000, key)
 					}
+					if format.InlineSize > 0 || format.Dedupe || format.PackSize > 0 { // kept in meta engine, deduplicated or packed
+						if _, err := wrapped.Head("chunks/" + objKey); err == nil {
+							continue
+						}
+					}
 					if _, err := blob.Head(objKey); err != nil {
+						if recoverVersions {
+							_, rerr := object.RecoverVersion(blob, objKey)
+							if rerr == nil {
+								recoveredDSpin.IncrInt64(int64(sz))
+								continue
+							}
+							logger.Warnf("recover block %s from versions: %s", objKey, rerr)
+						}
 						if _, ok := brokens[inode]; !ok {
 							if ps := m.GetPaths(meta.Background, inode); len(ps) > 0 {
 								brokens[inode] = ps[0]
@@ -190,6 +215,9 @@ func fsck(ctx *cli.Context) error {
 	if progress.Quiet {
 		logger.Infof("Used by %d slices (%d bytes)", sliceCBar.Current(), sliceBSpin.Current())
 	}
+	if rc, rb := recoveredDSpin.Current(); rc > 0 {
+		logger.Infof("Recovered %d objects (%d bytes) from their previous versions", rc, rb)
+	}
 	if lc, lb := lostDSpin.Current(); lc > 0 {
 		msg := fmt.Sprintf("%d objects are lost (%d bytes), %d broken files:\n", lc, lb, len(brokens))
 		msg += fmt.Sprintf("%13s: PATH\n", "INODE")
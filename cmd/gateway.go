@@ -20,6 +20,7 @@
 package cmd
 
 import (
+	"net"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
@@ -42,10 +43,6 @@ import (
 
 func cmdGateway() *cli.Command {
 	selfFlags := []cli.Flag{
-		&cli.StringFlag{
-			Name:  "access-log",
-			Usage: "path for JuiceFS access log",
-		},
 		&cli.BoolFlag{
 			Name:  "no-banner",
 			Usage: "disable MinIO startup information",
@@ -58,6 +55,10 @@ func cmdGateway() *cli.Command {
 			Name:  "keep-etag",
 			Usage: "keep the ETag for uploaded objects",
 		},
+		&cli.BoolFlag{
+			Name:  "iam",
+			Usage: "enable multiple users with policies, which are managed by the admin API",
+		},
 		&cli.StringFlag{
 			Name:  "umask",
 			Value: "022",
@@ -81,8 +82,13 @@ $ export MINIO_ROOT_USER=admin
 $ export MINIO_ROOT_PASSWORD=12345678
 $ juicefs gateway redis://localhost localhost:9000
 
+# Enable multiple users, which are managed by the admin API with root credential
+$ juicefs gateway redis://localhost localhost:9000 --iam
+$ curl --aws-sigv4 aws:amz:us-east-1:s3 -u admin:12345678 -X PUT http://localhost:9000/.juicefs/admin/users/alice \
+    -d '{"policy":{"prefixes":["myjfs/alice/"],"quota":10737418240}}'
+
 Details: https://juicefs.com/docs/community/s3_gateway`,
-		Flags: expandFlags(selfFlags, clientFlags(0), shareInfoFlags()),
+		Flags: expandFlags(selfFlags, accessLogFlags(), clientFlags(0), shareInfoFlags()),
 	}
 }
 
@@ -104,7 +110,17 @@ func gateway(c *cli.Context) error {
 	}
 
 	address := c.Args().Get(1)
-	gw = &GateWay{c}
+	gw = &GateWay{ctx: c}
+	if c.Bool("iam") {
+		// MinIO listens on loopback, the clients are served by the proxy of IAM
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			logger.Fatalf("listen on loopback: %s", err)
+		}
+		gw.address, gw.backend = address, l.Addr().String()
+		_ = l.Close()
+		address = gw.backend
+	}
 
 	args := []string{"gateway", "--address", address, "--anonymous"}
 	if c.Bool("no-banner") {
@@ -143,7 +159,9 @@ func gateway2(ctx *mcli.Context) error {
 }
 
 type GateWay struct {
-	ctx *cli.Context
+	ctx     *cli.Context
+	address string // for clients with IAM enabled
+	backend string // the address of MinIO with IAM enabled
 }
 
 func (g *GateWay) Name() string {
@@ -164,16 +182,24 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		logger.Fatalf("invalid umask %s: %s", c.String("umask"), err)
 	}
 
-	return jfsgateway.NewJFSGateway(
-		jfs,
-		conf,
-		&jfsgateway.Config{
-			MultiBucket: c.Bool("multi-buckets"),
-			KeepEtag:    c.Bool("keep-etag"),
-			Mode:        uint16(0666 &^ umask),
-			DirMode:     uint16(0777 &^ umask),
-		},
-	)
+	gConf := &jfsgateway.Config{
+		MultiBucket: c.Bool("multi-buckets"),
+		KeepEtag:    c.Bool("keep-etag"),
+		Mode:        uint16(0666 &^ umask),
+		DirMode:     uint16(0777 &^ umask),
+	}
+	layer, err := jfsgateway.NewJFSGateway(jfs, conf, gConf)
+	if err != nil || g.backend == "" {
+		return layer, err
+	}
+	iam, err := jfsgateway.NewIAM(jfs, conf, gConf, creds.AccessKey, creds.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		logger.Fatalf("serve S3 clients on %s: %s", g.address, iam.Serve(g.address, g.backend))
+	}()
+	return layer, nil
 }
 
 func initForSvc(c *cli.Context, mp string, metaUrl string) (*vfs.Config, *fs.FileSystem) {
@@ -196,16 +222,17 @@ func initForSvc(c *cli.Context, mp string, metaUrl string) (*vfs.Config, *fs.Fil
 	logger.Infof("Data use %s", blob)
 
 	chunkConf := getChunkConf(c, format)
-	store := chunk.NewCachedStore(blob, *chunkConf, registerer)
+	store := chunk.NewCachedStore(wrapStorage(blob, metaCli, format), *chunkConf, registerer)
 	registerMetaMsg(metaCli, store, chunkConf)
 
 	err = metaCli.NewSession()
 	if err != nil {
 		logger.Fatalf("new session: %s", err)
 	}
+	updateStoreLimit(store, metaCli, format)
 	metaCli.OnReload(func(fmt *meta.Format) {
 		updateFormat(c)(fmt)
-		store.UpdateLimit(fmt.UploadLimit, fmt.DownloadLimit)
+		updateStoreLimit(store, metaCli, fmt)
 	})
 
 	// Go will catch all the signals
@@ -222,6 +249,15 @@ func initForSvc(c *cli.Context, mp string, metaUrl string) (*vfs.Config, *fs.Fil
 	}()
 	vfsConf := getVfsConf(c, metaConf, format, chunkConf)
 	vfsConf.AccessLog = c.String("access-log")
+	vfsConf.AccessLogFormat = c.String("access-log-format")
+	if vfsConf.AccessLogFormat != "text" && vfsConf.AccessLogFormat != "json" {
+		logger.Fatalf("invalid access log format: %s", vfsConf.AccessLogFormat)
+	}
+	vfsConf.AccessLogSample = c.Float64("access-log-sample")
+	if vfsConf.AccessLogSample <= 0 || vfsConf.AccessLogSample > 1 {
+		logger.Fatalf("invalid sample ratio of access log: %f", vfsConf.AccessLogSample)
+	}
+	vfsConf.AccessLogRotate = c.Int64("access-log-rotate")
 	vfsConf.AttrTimeout = time.Millisecond * time.Duration(c.Float64("attr-cache")*1000)
 	vfsConf.EntryTimeout = time.Millisecond * time.Duration(c.Float64("entry-cache")*1000)
 	vfsConf.DirEntryTimeout = time.Millisecond * time.Duration(c.Float64("dir-entry-cache")*1000)
@@ -26,7 +26,6 @@ import (
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
-	osync "github.com/juicedata/juicefs/pkg/sync"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/vfs"
 
@@ -67,7 +66,11 @@ $ juicefs gc redis://localhost --delete`,
 				Name:    "threads",
 				Aliases: []string{"p"},
 				Value:   10,
-				Usage:   "number threads to delete leaked objects",
+				Usage:   "number threads to list and delete leaked objects",
+			},
+			&cli.StringFlag{
+				Name:  "data-key-dir",
+				Usage: "directory of the data keys to compact the files encrypted by them",
 			},
 		},
 	}
@@ -85,13 +88,16 @@ func gc(ctx *cli.Context) error {
 	}
 
 	chunkConf := chunk.Config{
-		BlockSize:  format.BlockSize * 1024,
-		Compress:   format.Compression,
-		GetTimeout: time.Second * 60,
-		PutTimeout: time.Second * 60,
-		MaxUpload:  20,
-		BufferSize: 300 << 20,
-		CacheDir:   "memory",
+		BlockSize:     format.BlockSize * 1024,
+		Compress:      format.Compression,
+		CompressLevel: format.CompressLevel,
+		CompressDict:  format.CompressDict,
+		GetTimeout:    time.Second * 60,
+		PutTimeout:    time.Second * 60,
+		MaxUpload:     20,
+		BufferSize:    300 << 20,
+		CacheDir:      "memory",
+		DataKeyDir:    ctx.String("data-key-dir"),
 	}
 
 	blob, err := createStorage(*format)
@@ -99,7 +105,7 @@ func gc(ctx *cli.Context) error {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
-	store := chunk.NewCachedStore(blob, chunkConf, nil)
+	store := chunk.NewCachedStore(wrapStorage(blob, m, format), chunkConf, nil)
 
 	// Scan all chunks first and do compaction if necessary
 	progress := utils.NewProgress(false)
@@ -173,7 +179,7 @@ func gc(ctx *cli.Context) error {
 		spin := progress.AddDoubleSpinner("Compacted slices")
 		m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
 			slices := args[0].([]meta.Slice)
-			err := vfs.Compact(chunkConf, store, slices, args[1].(uint64))
+			err := vfs.CompactFile(chunkConf, store, m, args[2].(meta.Ino), slices, args[1].(uint64))
 			for _, s := range slices {
 				spin.IncrInt64(int64(s.Len))
 			}
@@ -231,8 +237,9 @@ func gc(ctx *cli.Context) error {
 	cleanedSliceSpin.Done()
 
 	// Scan all objects to find leaked ones
+	raw := blob
 	blob = object.WithPrefix(blob, "chunks/")
-	objs, err := osync.ListAll(blob, "", "", "")
+	objs, err := object.ListAllParallel(blob, "", "", threads)
 	if err != nil {
 		logger.Fatalf("list all blocks: %s", err)
 	}
@@ -279,18 +286,18 @@ func gc(ctx *cli.Context) error {
 		go func() {
 			defer wg.Done()
 			for key := range leakedObj {
-				if err := blob.Delete(key); err != nil {
+				if err := raw.Delete(key); err != nil {
 					logger.Warnf("delete %s: %s", key, err)
 				}
 			}
 		}()
 	}
 
-	foundLeaked := func(obj object.Object) {
+	foundLeaked := func(prefix string, obj object.Object) {
 		bar.IncrTotal(1)
 		leaked.IncrInt64(obj.Size())
 		if delete {
-			leakedObj <- obj.Key()
+			leakedObj <- prefix + obj.Key()
 		}
 	}
 
@@ -328,7 +335,7 @@ func gc(ctx *cli.Context) error {
 		}
 		if size == 0 {
 			logger.Debugf("find leaked object: %s, size: %d", obj.Key(), obj.Size())
-			foundLeaked(obj)
+			foundLeaked("chunks/", obj)
 			continue
 		}
 		indx, _ := strconv.Atoi(parts[1])
@@ -336,7 +343,7 @@ func gc(ctx *cli.Context) error {
 		if csize == chunkConf.BlockSize {
 			if (indx+1)*csize > int(size) {
 				logger.Warnf("size of slice %d is larger than expected: %d > %d", cid, indx*chunkConf.BlockSize+csize, size)
-				foundLeaked(obj)
+				foundLeaked("chunks/", obj)
 			} else if cobj {
 				compacted.IncrInt64(obj.Size())
 			} else {
@@ -345,7 +352,7 @@ func gc(ctx *cli.Context) error {
 		} else {
 			if indx*chunkConf.BlockSize+csize != int(size) {
 				logger.Warnf("size of slice %d is %d, but expect %d", cid, indx*chunkConf.BlockSize+csize, size)
-				foundLeaked(obj)
+				foundLeaked("chunks/", obj)
 			} else if cobj {
 				compacted.IncrInt64(obj.Size())
 			} else {
@@ -353,6 +360,38 @@ func gc(ctx *cli.Context) error {
 			}
 		}
 	}
+	// The packs are leaked if the client failed to record or delete them, or they are not referenced
+	// by any packed block (the blocks were deleted by a client without packing enabled).
+	if format.Packed || format.PackSize > 0 {
+		refs, err := m.ListPacks()
+		if err != nil {
+			logger.Fatalf("list packs in metadata engine: %s", err)
+		}
+		packs, err := object.ListAllParallel(raw, "packs/", "", threads)
+		if err != nil {
+			logger.Fatalf("list all packs: %s", err)
+		}
+		for obj := range packs {
+			if obj == nil {
+				break // failed listing
+			}
+			if obj.IsDir() {
+				continue
+			}
+			bar.Increment()
+			if obj.Mtime().After(maxMtime) || obj.Mtime().Unix() == 0 {
+				logger.Debugf("ignore new pack: %s %s", obj.Key(), obj.Mtime())
+				bar.IncrTotal(1)
+				skipped.IncrInt64(obj.Size())
+			} else if refs[obj.Key()] > 0 {
+				bar.IncrTotal(1)
+				valid.IncrInt64(obj.Size())
+			} else {
+				logger.Debugf("find leaked pack: %s, size: %d", obj.Key(), obj.Size())
+				foundLeaked("", obj)
+			}
+		}
+	}
 	m.OnMsg(meta.DeleteSlice, func(args ...interface{}) error {
 		return nil
 	})
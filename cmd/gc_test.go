@@ -106,3 +106,38 @@ func TestGc(t *testing.T) {
 		t.Fatalf("gc failed: %s", err)
 	}
 }
+
+func TestGcPacks(t *testing.T) {
+	var bucket string
+	mountTemp(t, &bucket, []string{"--trash-days=0", "--pack-size=64"}, nil)
+	defer umountTemp(t)
+
+	for i := 0; i < 10; i++ {
+		filename := fmt.Sprintf("%s/f%d.txt", testMountPoint, i)
+		if err := os.WriteFile(filename, []byte("test"), 0644); err != nil {
+			t.Fatalf("write file failed: %s", err)
+		}
+	}
+	packDir := filepath.Join(bucket, testVolume, "packs")
+	if getFileCount(packDir) == 0 {
+		t.Fatalf("small blocks should be packed")
+	}
+	leaked := filepath.Join(packDir, "00000000-0000-0000-0000-000000000000")
+	if err := os.WriteFile(leaked, []byte("leaked"), 0644); err != nil {
+		t.Fatalf("write leaked pack: %s", err)
+	}
+	time.Sleep(time.Second * 3)
+
+	if err := Main([]string{"", "gc", "--delete", testMeta}); err != nil {
+		t.Fatalf("gc delete failed: %s", err)
+	}
+	if _, err := os.Stat(leaked); err == nil {
+		t.Fatalf("gc delete didn't delete the leaked pack")
+	}
+	for i := 0; i < 10; i++ {
+		filename := fmt.Sprintf("%s/f%d.txt", testMountPoint, i)
+		if d, err := os.ReadFile(filename); err != nil || string(d) != "test" {
+			t.Fatalf("read %s after gc: %q %v", filename, d, err)
+		}
+	}
+}
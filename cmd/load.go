@@ -50,16 +50,22 @@ func cmdLoad() *cli.Command {
 			},
 		},
 		Usage:     "Load metadata from a previously dumped JSON file",
-		ArgsUsage: "META-URL [FILE]",
+		ArgsUsage: "META-URL [FILE [INCREMENTAL ...]]",
 		Description: `
 Load metadata into an empty metadata engine.
 
+The incremental dumps (created by dump with --since or the automatic backup with changelog enabled)
+are applied on the full dump in the order of time, and they should cover the time since the full dump.
+
 WARNING: Do NOT use new engine and the old one at the same time, otherwise it will probably break
 consistency of the volume.
 
 Examples:
 $ juicefs load redis://localhost/1 meta-dump.json.gz
 
+# Restore the metadata with incremental backups
+$ juicefs load redis://localhost/1 dump-2023-06-01-000000.json.gz inc-2023-06-01-010000.json.gz inc-2023-06-01-020000.json.gz
+
 Details: https://juicefs.com/docs/community/metadata_dump_load`,
 	}
 }
@@ -74,63 +80,30 @@ func load(ctx *cli.Context) error {
 		r = os.Stdin
 		src = "STDIN"
 	} else {
-		var ioErr error
-		var fp io.ReadCloser
-		if ctx.String("encrypt-rsa-key") != "" {
-			passphrase := os.Getenv("JFS_RSA_PASSPHRASE")
-			encryptKey := loadEncrypt(ctx.String("encrypt-rsa-key"))
-			if passphrase == "" {
-				block, _ := pem.Decode([]byte(encryptKey))
-				// nolint:staticcheck
-				if block != nil && strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") && x509.IsEncryptedPEMBlock(block) {
-					return fmt.Errorf("passphrase is required to private key, please try again after setting the 'JFS_RSA_PASSPHRASE' environment variable")
-				}
-			}
-			privKey, err := object.ParseRsaPrivateKeyFromPem([]byte(encryptKey), []byte(passphrase))
-			if err != nil {
-				return fmt.Errorf("parse rsa: %s", err)
-			}
-			encryptor, err := object.NewDataEncryptor(object.NewRSAEncryptor(privKey), ctx.String("encrypt-algo"))
-			if err != nil {
-				return err
-			}
-			if _, err := os.Stat(src); err != nil {
-				return fmt.Errorf("failed to stat %s: %s", src, err)
-			}
-			var srcAbsPath string
-			srcAbsPath, err = filepath.Abs(src)
-			if err != nil {
-				return fmt.Errorf("failed to get absolute path of %s: %s", src, err)
-			}
-			fileBlob, err := object.CreateStorage("file", strings.TrimRight(src, filepath.Base(srcAbsPath)), "", "", "")
-			if err != nil {
-				return err
-			}
-			blob := object.NewEncrypted(fileBlob, encryptor)
-			fp, ioErr = blob.Get(filepath.Base(srcAbsPath), 0, -1)
-		} else {
-			fp, ioErr = os.Open(src)
+		var err error
+		if r, err = openDump(ctx, src); err != nil {
+			return err
 		}
-		if ioErr != nil {
-			return ioErr
-		}
-		defer fp.Close()
-		if strings.HasSuffix(src, ".gz") {
-			var err error
-			r, err = gzip.NewReader(fp)
-			if err != nil {
-				return err
-			}
-			defer r.Close()
-		} else {
-			r = fp
+		defer r.Close()
+	}
+	var incs []io.Reader
+	for i := 2; i < ctx.Args().Len(); i++ {
+		inc, err := openDump(ctx, ctx.Args().Get(i))
+		if err != nil {
+			return err
 		}
+		defer inc.Close()
+		incs = append(incs, inc)
 	}
 	m := meta.NewClient(metaUri, nil)
 	if format, err := m.Load(false); err == nil {
 		return fmt.Errorf("Database %s is used by volume %s", utils.RemovePassword(metaUri), format.Name)
 	}
-	if err := m.LoadMeta(r); err != nil {
+	if len(incs) > 0 {
+		if err := meta.LoadMetaWithChanges(m, r, incs, ""); err != nil {
+			return err
+		}
+	} else if err := m.LoadMeta(r); err != nil {
 		return err
 	}
 	if format, err := m.Load(true); err == nil {
@@ -143,3 +116,71 @@ func load(ctx *cli.Context) error {
 	logger.Infof("Load metadata from %s succeed", src)
 	return nil
 }
+
+type dumpReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *dumpReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if e := r.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// openDump opens a dumped file, which may be encrypted or compressed.
+func openDump(ctx *cli.Context, src string) (io.ReadCloser, error) {
+	var ioErr error
+	var fp io.ReadCloser
+	if ctx.String("encrypt-rsa-key") != "" {
+		passphrase := os.Getenv("JFS_RSA_PASSPHRASE")
+		encryptKey := loadEncrypt(ctx.String("encrypt-rsa-key"))
+		if passphrase == "" {
+			block, _ := pem.Decode([]byte(encryptKey))
+			// nolint:staticcheck
+			if block != nil && strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") && x509.IsEncryptedPEMBlock(block) {
+				return nil, fmt.Errorf("passphrase is required to private key, please try again after setting the 'JFS_RSA_PASSPHRASE' environment variable")
+			}
+		}
+		privKey, err := object.ParseRsaPrivateKeyFromPem([]byte(encryptKey), []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("parse rsa: %s", err)
+		}
+		encryptor, err := object.NewDataEncryptor(object.NewRSAEncryptor(privKey), ctx.String("encrypt-algo"))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(src); err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %s", src, err)
+		}
+		var srcAbsPath string
+		srcAbsPath, err = filepath.Abs(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path of %s: %s", src, err)
+		}
+		fileBlob, err := object.CreateStorage("file", strings.TrimRight(src, filepath.Base(srcAbsPath)), "", "", "")
+		if err != nil {
+			return nil, err
+		}
+		blob := object.NewEncrypted(fileBlob, encryptor)
+		fp, ioErr = blob.Get(filepath.Base(srcAbsPath), 0, -1)
+	} else {
+		fp, ioErr = os.Open(src)
+	}
+	if ioErr != nil {
+		return nil, ioErr
+	}
+	if strings.HasSuffix(src, ".gz") {
+		zr, err := gzip.NewReader(fp)
+		if err != nil {
+			_ = fp.Close()
+			return nil, err
+		}
+		return &dumpReader{zr, []io.Closer{fp, zr}}, nil
+	}
+	return fp, nil
+}
@@ -59,11 +59,13 @@ func Main(args []string) error {
 			cmdConfig(),
 			cmdQuota(),
 			cmdDestroy(),
+			cmdEvict(),
 			cmdGC(),
 			cmdFsck(),
 			cmdRestore(),
 			cmdDump(),
 			cmdLoad(),
+			cmdMigrateMeta(),
 			cmdVersion(),
 			cmdStatus(),
 			cmdStats(),
@@ -71,17 +73,21 @@ func Main(args []string) error {
 			cmdInfo(),
 			cmdMount(),
 			cmdUmount(),
+			cmdService(),
 			cmdGateway(),
 			cmdWebDav(),
 			cmdBench(),
 			cmdObjbench(),
 			cmdMdtest(),
 			cmdWarmup(),
+			cmdCache(),
 			cmdRmr(),
 			cmdSync(),
 			cmdDebug(),
 			cmdClone(),
+			cmdSnapshot(),
 			cmdSummary(),
+			cmdWatch(),
 		},
 	}
 
@@ -214,8 +220,8 @@ func reorderOptions(app *cli.App, args []string) []string {
 			cmd = c
 		}
 	}
-	if cmd == nil {
-		// can't recognize the command, skip it
+	if cmd == nil || cmd.SkipFlagParsing {
+		// can't recognize the command, or it parses the flags by itself
 		return append(newArgs, others...)
 	}
 
@@ -207,7 +207,7 @@ func initForMdtest(c *cli.Context, mp string, metaUrl string) *fs.FileSystem {
 	logger.Infof("Data use %s", blob)
 
 	chunkConf := getChunkConf(c, format)
-	store := chunk.NewCachedStore(blob, *chunkConf, registerer)
+	store := chunk.NewCachedStore(wrapStorage(blob, m, format), *chunkConf, registerer)
 	registerMetaMsg(m, store, chunkConf)
 
 	err = m.NewSession()
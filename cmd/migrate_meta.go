@@ -0,0 +1,169 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdMigrateMeta() *cli.Command {
+	return &cli.Command{
+		Name:      "migrate-meta",
+		Action:    migrateMeta,
+		Category:  "ADMIN",
+		Usage:     "Migrate metadata into another engine while the volume is in use",
+		ArgsUsage: "SRC-META-URL DST-META-URL",
+		Description: `
+Migrate metadata of a volume into an empty metadata engine without stopping the clients.
+
+The metadata is dumped and loaded into the new engine first, then the changes made during the copy
+are synchronized in several passes. At last, the volume is switched into read-only mode for a short
+while, the remaining changes are synchronized, and all the clients should be remounted with the new
+META-URL. Only transactional key-value engines (TiKV, etcd, FoundationDB, etc.) are supported as the
+destination, and the trash of the volume must be enabled during migration.
+
+Examples:
+$ juicefs migrate-meta redis://localhost/1 tikv://localhost:2379/jfs
+
+Details: https://juicefs.com/docs/community/metadata_dump_load#migrate-online`,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of threads to walk the directories",
+			},
+			&cli.IntFlag{
+				Name:  "max-passes",
+				Value: 5,
+				Usage: "maximum number of passes to synchronize the changes before cutover",
+			},
+			&cli.IntFlag{
+				Name:  "cutover-inodes",
+				Value: 1000,
+				Usage: "start cutover when the number of changed inodes in a pass is less than this",
+			},
+			&cli.StringFlag{
+				Name:  "cutover-wait",
+				Value: "30s",
+				Usage: "time to wait for clients to become read-only before the final pass (should be larger than their heartbeat)",
+			},
+			&cli.BoolFlag{
+				Name:  "yes",
+				Usage: "skip the confirmation before cutover",
+			},
+		},
+	}
+}
+
+func migrateMeta(ctx *cli.Context) error {
+	setup(ctx, 2)
+	srcUri, dstUri := ctx.Args().Get(0), ctx.Args().Get(1)
+	removePassword(srcUri)
+	removePassword(dstUri)
+
+	conf := meta.DefaultConf()
+	conf.ReadOnly = true
+	conf.NoBGJob = true
+	src := meta.NewClient(srcUri, conf)
+	format, err := src.Load(true)
+	if err != nil {
+		return err
+	}
+	if format.MigratedTo != "" {
+		return fmt.Errorf("metadata of volume %s has been migrated to %s", format.Name, format.MigratedTo)
+	}
+	if format.TrashDays == 0 {
+		return fmt.Errorf("trash of volume %s is disabled, please enable it with `juicefs config --trash-days` before migration", format.Name)
+	}
+	dst := meta.NewClient(dstUri, nil)
+	if f, err := dst.Load(false); err == nil {
+		return fmt.Errorf("Database %s is used by volume %s", utils.RemovePassword(dstUri), f.Name)
+	}
+	if err = meta.CheckSyncTarget(dst); err != nil {
+		return err
+	}
+
+	threads := ctx.Int("threads")
+	start := time.Now()
+	logger.Infof("Copy metadata from %s into %s", utils.RemovePassword(srcUri), utils.RemovePassword(dstUri))
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(src.DumpMeta(w, meta.RootInode, true))
+	}()
+	if err = dst.LoadMeta(r); err != nil {
+		_ = r.CloseWithError(err)
+		return fmt.Errorf("load metadata: %s", err)
+	}
+	logger.Infof("Copied metadata in %s", time.Since(start))
+
+	since := start
+	for i := 1; i <= ctx.Int("max-passes"); i++ {
+		pass := time.Now()
+		n, err := meta.SyncMeta(src, dst, since, threads, false)
+		if err != nil {
+			return fmt.Errorf("pass %d: %s", i, err)
+		}
+		logger.Infof("Pass %d: synchronized %d inodes in %s", i, n, time.Since(pass))
+		since = pass
+		if n < int64(ctx.Int("cutover-inodes")) {
+			break
+		}
+	}
+
+	if !ctx.Bool("yes") {
+		fmt.Printf("Volume %s will be read-only until all the clients are remounted with %s.\n", format.Name, utils.RemovePassword(dstUri))
+		if !userConfirmed() {
+			return fmt.Errorf("Aborted.")
+		}
+	}
+	srcw := meta.NewClient(srcUri, nil)
+	if format, err = srcw.Load(false); err != nil {
+		return err
+	}
+	format.MigratedTo = utils.RemovePassword(dstUri)
+	if err = srcw.Init(format, false); err != nil {
+		return fmt.Errorf("freeze volume: %s", err)
+	}
+	defer func() {
+		if err != nil {
+			format.MigratedTo = ""
+			if e := srcw.Init(format, false); e != nil {
+				logger.Errorf("Unfreeze volume %s: %s", format.Name, e)
+			} else {
+				logger.Infof("Migration is aborted, volume %s is writable again", format.Name)
+			}
+		}
+	}()
+	wait := duration(ctx.String("cutover-wait"))
+	logger.Infof("Wait %s for clients to become read-only", wait)
+	time.Sleep(wait)
+
+	pass := time.Now()
+	n, err := meta.SyncMeta(src, dst, since, threads, true)
+	if err != nil {
+		return fmt.Errorf("final pass: %s", err)
+	}
+	logger.Infof("Final pass: synchronized %d inodes in %s", n, time.Since(pass))
+	logger.Infof("Metadata of volume %s is migrated to %s, please remount all the clients with it", format.Name, utils.RemovePassword(dstUri))
+	return nil
+}
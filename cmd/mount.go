@@ -20,13 +20,16 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
@@ -78,6 +81,9 @@ $ juicefs mount redis://localhost /mnt/jfs -d --writeback
 # Enable "read-only" mode
 $ juicefs mount redis://localhost /mnt/jfs -d --read-only
 
+# Mount a snapshot of the volume
+$ juicefs mount redis://localhost /mnt/snap -d --snapshot daily-20230801
+
 # Disable metadata backup
 $ juicefs mount redis://localhost /mnt/jfs --backup-meta 0`,
 		Flags: expandFlags(mount_flags(), clientFlags(1.0), shareInfoFlags()),
@@ -113,6 +119,7 @@ func exposeMetrics(c *cli.Context, m meta.Meta, registerer prometheus.Registerer
 
 	m.InitMetrics(registerer)
 	vfs.InitMetrics(registerer)
+	object.InitMetrics(registerer)
 	go metric.UpdateMetrics(m, registerer)
 	http.Handle("/metrics", promhttp.HandlerFor(
 		registry,
@@ -252,13 +259,15 @@ func expandPathForEmbedded(addr string) string {
 
 func getVfsConf(c *cli.Context, metaConf *meta.Config, format *meta.Format, chunkConf *chunk.Config) *vfs.Config {
 	cfg := &vfs.Config{
-		Meta:           metaConf,
-		Format:         *format,
-		Version:        version.Version(),
-		Chunk:          chunkConf,
-		BackupMeta:     duration(c.String("backup-meta")),
-		Port:           &vfs.Port{DebugAgent: debugAgent, PyroscopeAddr: c.String("pyroscope")},
-		PrefixInternal: c.Bool("prefix-internal"),
+		Meta:             metaConf,
+		Format:           *format,
+		Version:          version.Version(),
+		Chunk:            chunkConf,
+		BackupMeta:       duration(c.String("backup-meta")),
+		Port:             &vfs.Port{DebugAgent: debugAgent, PyroscopeAddr: c.String("pyroscope")},
+		PrefixInternal:   c.Bool("prefix-internal"),
+		ReadOnlyPrefixes: c.String("read-only-prefixes"),
+		StrictXattrs:     c.Bool("strict-xattrs"),
 	}
 	if cfg.BackupMeta > 0 && cfg.BackupMeta < time.Minute*5 {
 		logger.Fatalf("backup-meta should not be less than 5 minutes: %s", cfg.BackupMeta)
@@ -271,7 +280,7 @@ func registerMetaMsg(m meta.Meta, store chunk.ChunkStore, chunkConf *chunk.Confi
 		return store.Remove(args[0].(uint64), int(args[1].(uint32)))
 	})
 	m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
-		return vfs.Compact(*chunkConf, store, args[0].([]meta.Slice), args[1].(uint64))
+		return vfs.CompactFile(*chunkConf, store, m, args[2].(meta.Ino), args[0].([]meta.Slice), args[1].(uint64))
 	})
 }
 
@@ -283,21 +292,8 @@ func configEqual(a, b *vfs.Config) bool {
 	ac, bc := *a, *b
 	ac.Meta, ac.Chunk, ac.Port, ac.Format.SecretKey, ac.AttrTimeout, ac.DirEntryTimeout, ac.EntryTimeout = nil, nil, nil, "", 0, 0, 0
 	bc.Meta, bc.Chunk, bc.Port, bc.Format.SecretKey, bc.AttrTimeout, bc.DirEntryTimeout, bc.EntryTimeout = nil, nil, nil, "", 0, 0, 0
-	eq := ac == bc
-
-	if a.Meta == nil || b.Meta == nil {
-		eq = eq && a.Meta == b.Meta
-	} else {
-		eq = eq && *a.Meta == *b.Meta
-	}
-
-	if a.Chunk == nil || b.Chunk == nil {
-		eq = eq && a.Chunk == b.Chunk
-	} else {
-		eq = eq && *a.Chunk == *b.Chunk
-	}
-
-	return eq
+	// the configs contain maps and slices (e.g. TrashPolicies, ObjectTags and CacheKey)
+	return reflect.DeepEqual(ac, bc) && reflect.DeepEqual(a.Meta, b.Meta) && reflect.DeepEqual(a.Chunk, b.Chunk)
 }
 
 func readConfig(mp string) ([]byte, error) {
@@ -358,18 +354,39 @@ func prepareMp(newCfg *vfs.Config, mp string) (ignore bool) {
 	return true
 }
 
+// updateStoreLimit applies the bandwidth limits of the volume, or the ones defined for this client
+// if they are stricter.
+func updateStoreLimit(store chunk.ChunkStore, m meta.Meta, format *meta.Format) {
+	upload, download := format.UploadLimit, format.DownloadLimit
+	if l := m.ClientLimit(); l != nil {
+		if l.UploadLimit > 0 && (upload == 0 || l.UploadLimit < upload) {
+			upload = l.UploadLimit
+		}
+		if l.DownloadLimit > 0 && (download == 0 || l.DownloadLimit < download) {
+			download = l.DownloadLimit
+		}
+	}
+	store.UpdateLimit(upload, download)
+}
+
 func getMetaConf(c *cli.Context, mp string, readOnly bool) *meta.Config {
 	conf := meta.DefaultConf()
 	conf.Retries = c.Int("io-retries")
 	conf.MaxDeletes = c.Int("max-deletes")
 	conf.SkipDirNlink = c.Int("skip-dir-nlink")
+	conf.SlowTxn = duration(c.String("slow-txn"))
 	conf.ReadOnly = readOnly
 	conf.NoBGJob = c.Bool("no-bgjob")
 	conf.OpenCache = time.Duration(c.Float64("open-cache") * 1e9)
 	conf.OpenCacheLimit = c.Uint64("open-cache-limit")
+	conf.CacheInvalidation = c.Bool("invalidate-cache")
 	conf.Heartbeat = duration(c.String("heartbeat"))
 	conf.MountPoint = mp
 	conf.Subdir = c.String("subdir")
+	if name := c.String("snapshot"); name != "" {
+		conf.ReadOnly = true
+		conf.Subdir = path.Join("/", meta.SnapshotDir, name, conf.Subdir)
+	}
 
 	atimeMode := c.String("atime-mode")
 	if atimeMode != meta.RelAtime && atimeMode != meta.StrictAtime && atimeMode != meta.NoAtime {
@@ -387,29 +404,41 @@ func getChunkConf(c *cli.Context, format *meta.Format) *chunk.Config {
 		cm = 0600
 	}
 	chunkConf := &chunk.Config{
-		BlockSize:  format.BlockSize * 1024,
-		Compress:   format.Compression,
-		HashPrefix: format.HashPrefix,
-
-		GetTimeout:    time.Second * time.Duration(c.Int("get-timeout")),
-		PutTimeout:    time.Second * time.Duration(c.Int("put-timeout")),
-		MaxUpload:     c.Int("max-uploads"),
-		MaxRetries:    c.Int("io-retries"),
-		Writeback:     c.Bool("writeback"),
-		Prefetch:      c.Int("prefetch"),
-		BufferSize:    c.Int("buffer-size") << 20,
-		UploadLimit:   c.Int64("upload-limit") * 1e6 / 8,
-		DownloadLimit: c.Int64("download-limit") * 1e6 / 8,
-		UploadDelay:   duration(c.String("upload-delay")),
+		BlockSize:     format.BlockSize * 1024,
+		Compress:      format.Compression,
+		CompressLevel: format.CompressLevel,
+		CompressDict:  format.CompressDict,
+		HashPrefix:    format.HashPrefix,
+
+		GetTimeout:       time.Second * time.Duration(c.Int("get-timeout")),
+		PutTimeout:       time.Second * time.Duration(c.Int("put-timeout")),
+		MaxUpload:        c.Int("max-uploads"),
+		MaxDownload:      c.Int("max-downloads"),
+		MaxRetries:       c.Int("io-retries"),
+		Writeback:        c.Bool("writeback"),
+		Prefetch:         c.Int("prefetch"),
+		BufferSize:       c.Int("buffer-size") << 20,
+		UploadLimit:      c.Int64("upload-limit") * 1e6 / 8,
+		DownloadLimit:    c.Int64("download-limit") * 1e6 / 8,
+		UploadSchedule:   c.String("upload-limit-schedule"),
+		DownloadSchedule: c.String("download-limit-schedule"),
+		UploadDelay:      duration(c.String("upload-delay")),
+		DataKeyDir:       c.String("data-key-dir"),
 
 		CacheDir:          c.String("cache-dir"),
 		CacheSize:         int64(c.Int("cache-size")),
 		FreeSpace:         float32(c.Float64("free-space-ratio")),
 		CacheMode:         os.FileMode(cm),
 		CacheFullBlock:    !c.Bool("cache-partial-only"),
+		CacheRanges:       c.Bool("cache-ranges"),
+		CacheIOUring:      c.Bool("cache-io-uring"),
 		CacheChecksum:     c.String("verify-cache-checksum"),
 		CacheEviction:     c.String("cache-eviction"),
 		CacheScanInterval: duration(c.String("cache-scan-interval")),
+		MemCacheSize:      int64(c.Int("memory-cache-size")),
+		ColdCacheDir:      c.String("cold-cache-dir"),
+		ColdCacheSize:     int64(c.Int("cold-cache-size")),
+		CachePromoteHits:  c.Int("cache-promote-hits"),
 		AutoCreate:        true,
 	}
 	if chunkConf.UploadLimit == 0 {
@@ -418,6 +447,14 @@ func getChunkConf(c *cli.Context, format *meta.Format) *chunk.Config {
 	if chunkConf.DownloadLimit == 0 {
 		chunkConf.DownloadLimit = format.DownloadLimit * 1e6 / 8
 	}
+	if c.Bool("object-tags") {
+		chunkConf.ObjectTags = map[string]string{"juicefs-volume": format.UUID}
+	}
+	if c.Bool("encrypt-cache") {
+		if chunkConf.CacheKey, err = NewCacheKey(format); err != nil {
+			logger.Fatalf("encrypt cache: %s", err)
+		}
+	}
 	chunkConf.SelfCheck(format.UUID)
 	return chunkConf
 }
@@ -442,6 +479,80 @@ type storageHolder struct {
 	fmt meta.Format
 }
 
+func (h *storageHolder) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	return object.PutWithTags(h.ObjectStorage, key, in, tags)
+}
+
+func (h *storageHolder) SetTags(key string, tags map[string]string) error {
+	if o, ok := h.ObjectStorage.(object.SupportTagging); ok {
+		return o.SetTags(key, tags)
+	}
+	return utils.ENOTSUP
+}
+
+func (h *storageHolder) GetTags(key string) (map[string]string, error) {
+	if o, ok := h.ObjectStorage.(object.SupportTagging); ok {
+		return o.GetTags(key)
+	}
+	return nil, utils.ENOTSUP
+}
+
+func (h *storageHolder) Restore(key string, days int, tier string) error {
+	if o, ok := h.ObjectStorage.(object.SupportRestore); ok {
+		return o.Restore(key, days, tier)
+	}
+	return utils.ENOTSUP
+}
+
+func (h *storageHolder) ListVersions(key string) ([]*object.ObjectVersion, error) {
+	if o, ok := h.ObjectStorage.(object.SupportVersioning); ok {
+		return o.ListVersions(key)
+	}
+	return nil, utils.ENOTSUP
+}
+
+func (h *storageHolder) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	if o, ok := h.ObjectStorage.(object.SupportVersioning); ok {
+		return o.GetVersion(key, versionID, off, limit)
+	}
+	return nil, utils.ENOTSUP
+}
+
+func (h *storageHolder) PutIfNotExists(key string, in io.Reader) error {
+	return object.PutIfNotExists(h.ObjectStorage, key, in)
+}
+
+// wrapStorage keeps the small blocks, the location of packed blocks and the hash of deduplicated
+// blocks in meta engine if they are enabled for the volume.
+func wrapStorage(blob object.ObjectStorage, m meta.Meta, format *meta.Format) object.ObjectStorage {
+	if format.PackSize > 0 || format.Packed { // keep reading and deleting the packed blocks after disabled
+		blob = chunk.NewPackStorage(blob, m, format.PackSize)
+	}
+	if format.Dedupe {
+		blob = chunk.NewDedupeStorage(blob, m)
+	}
+	if format.InlineSize > 0 || format.Inlined { // keep reading and deleting the inlined blocks after disabled
+		blob = chunk.NewInlineStorage(blob, m, format.InlineSize)
+	}
+	return blob
+}
+
+// NewCacheKey derives the key to encrypt local cache from the encryption key of the volume.
+func NewCacheKey(format *meta.Format) ([]byte, error) {
+	f := *format
+	if err := f.Decrypt(); err != nil {
+		return nil, fmt.Errorf("format decrypt: %s", err)
+	}
+	encryptor, err := newEncryptor(f)
+	if err != nil {
+		return nil, err
+	}
+	if encryptor == nil {
+		return nil, fmt.Errorf("volume %s is not encrypted", format.Name)
+	}
+	return object.DeriveKey(encryptor, "juicefs-cache:"+format.UUID)
+}
+
 func NewReloadableStorage(format *meta.Format, cli meta.Meta, patch func(*meta.Format)) (object.ObjectStorage, error) {
 	if patch != nil {
 		patch(format)
@@ -459,7 +570,9 @@ func NewReloadableStorage(format *meta.Format, cli meta.Meta, patch func(*meta.F
 			patch(new)
 		}
 		old := &holder.fmt
-		if new.Storage != old.Storage || new.Bucket != old.Bucket || new.AccessKey != old.AccessKey || new.SecretKey != old.SecretKey || new.SessionToken != old.SessionToken || new.StorageClass != old.StorageClass {
+		if new.Storage != old.Storage || new.Bucket != old.Bucket || new.AccessKey != old.AccessKey || new.SecretKey != old.SecretKey || new.SessionToken != old.SessionToken || new.StorageClass != old.StorageClass || new.VerifyChecksum != old.VerifyChecksum ||
+			new.MirrorStorage != old.MirrorStorage || new.MirrorBucket != old.MirrorBucket || new.MirrorAccessKey != old.MirrorAccessKey || new.MirrorSecretKey != old.MirrorSecretKey || new.MirrorAsync != old.MirrorAsync ||
+			new.FallbackBuckets != old.FallbackBuckets || new.ReplicaRead != old.ReplicaRead {
 			logger.Infof("found new configuration: storage=%s bucket=%s ak=%s storageClass=%s", new.Storage, new.Bucket, new.AccessKey, new.StorageClass)
 
 			newBlob, err := createStorage(*new)
@@ -617,7 +730,7 @@ func mount(c *cli.Context) error {
 	}
 
 	chunkConf := getChunkConf(c, format)
-	store := chunk.NewCachedStore(blob, *chunkConf, registerer)
+	store := chunk.NewCachedStore(wrapStorage(blob, metaCli, format), *chunkConf, registerer)
 	registerMetaMsg(metaCli, store, chunkConf)
 
 	vfsConf := getVfsConf(c, metaConf, format, chunkConf)
@@ -640,10 +753,11 @@ func mount(c *cli.Context) error {
 	if err != nil {
 		logger.Fatalf("new session: %s", err)
 	}
+	updateStoreLimit(store, metaCli, format)
 
 	metaCli.OnReload(func(fmt *meta.Format) {
 		updateFormat(c)(fmt)
-		store.UpdateLimit(fmt.UploadLimit, fmt.DownloadLimit)
+		updateStoreLimit(store, metaCli, fmt)
 	})
 	installHandler(mp)
 	v := vfs.NewVFS(vfsConf, metaCli, store, registerer, registry)
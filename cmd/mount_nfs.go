@@ -0,0 +1,94 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/nfs"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+// nfsMountArgs returns the command to mount the NFS server listening on the port of localhost. The
+// kernel connects from a privileged port, which is required by the server.
+func nfsMountArgs(goos string, port int, mp string, conf *vfs.Config) []string {
+	attr, dir := int(conf.AttrTimeout.Seconds()), int(conf.DirEntryTimeout.Seconds())
+	vers := "vers=4.0"
+	if goos == "darwin" {
+		vers = "vers=4"
+	}
+	opts := []string{
+		vers, "tcp", fmt.Sprintf("port=%d", port),
+		fmt.Sprintf("acregmin=%d", attr), fmt.Sprintf("acregmax=%d", attr),
+		fmt.Sprintf("acdirmin=%d", dir), fmt.Sprintf("acdirmax=%d", dir),
+		"rsize=1048576", "wsize=1048576",
+	}
+	if attr == 0 && dir == 0 {
+		opts = append(opts, "noac")
+	}
+	if goos == "darwin" {
+		// byte-range locks are kept in kernel, since the server doesn't support LOCK
+		opts = append(opts, "locallocks", "nobrowse", "resvport")
+		return []string{"mount_nfs", "-o", strings.Join(opts, ","), "127.0.0.1:/", mp}
+	}
+	return []string{"mount", "-t", "nfs", "-o", strings.Join(opts, ","), "127.0.0.1:/", mp}
+}
+
+// nfsLoopback serves the volume by a built-in NFS server on localhost and mounts it by the NFS client
+// of the kernel, for the machines where FUSE can't be installed (e.g. macFUSE on macOS). It returns
+// after the mount point is unmounted.
+func nfsLoopback(v *vfs.VFS, goos string) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- nfs.Serve(v, l) }()
+
+	mp := v.Conf.Meta.MountPoint
+	args := nfsMountArgs(goos, l.Addr().(*net.TCPAddr).Port, mp, v.Conf)
+	logger.Debugf("Mount NFS: %s", strings.Join(args, " "))
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		_ = l.Close()
+		return fmt.Errorf("%s: %s, %s", args[0], err, out)
+	}
+	// the server is stopped when the mount point is gone (by `juicefs umount` or signals)
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			if ino, err := utils.GetFileInode(mp); err != nil || ino != uint64(meta.RootInode) {
+				logger.Infof("%s is unmounted, stop the NFS server", mp)
+				_ = l.Close()
+				return
+			}
+		}
+	}()
+	err = <-done
+	if _, ok := err.(*net.OpError); ok {
+		err = nil // closed
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func TestNFSMountArgs(t *testing.T) {
+	conf := &vfs.Config{AttrTimeout: time.Second, DirEntryTimeout: time.Second * 2}
+	args := nfsMountArgs("darwin", 12345, "/Volumes/jfs", conf)
+	expected := []string{"mount_nfs", "-o", "vers=4,tcp,port=12345,acregmin=1,acregmax=1,acdirmin=2,acdirmax=2," +
+		"rsize=1048576,wsize=1048576,locallocks,nobrowse,resvport", "127.0.0.1:/", "/Volumes/jfs"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expect %v, got %v", expected, args)
+	}
+	args = nfsMountArgs("linux", 12345, "/jfs", &vfs.Config{})
+	expected = []string{"mount", "-t", "nfs", "-o", "vers=4.0,tcp,port=12345,acregmin=0,acregmax=0,acdirmin=0,acdirmax=0," +
+		"rsize=1048576,wsize=1048576,noac", "127.0.0.1:/", "/jfs"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expect %v, got %v", expected, args)
+	}
+}
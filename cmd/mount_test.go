@@ -18,6 +18,8 @@ package cmd
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"fmt"
 	"io"
 	"net/http"
@@ -30,7 +32,9 @@ import (
 	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
+	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/vfs"
 	"github.com/redis/go-redis/v9"
@@ -216,6 +220,17 @@ func Test_configEqual(t *testing.T) {
 		{
 			a: &vfs.Config{Port: &vfs.Port{}}, b: &vfs.Config{}, equal: true,
 		},
+		{
+			a: &vfs.Config{Chunk: &chunk.Config{ObjectTags: map[string]string{"a": "1"}}},
+			b: &vfs.Config{Chunk: &chunk.Config{ObjectTags: map[string]string{"a": "1"}}}, equal: true,
+		},
+		{
+			a: &vfs.Config{Chunk: &chunk.Config{CacheKey: []byte("1")}},
+			b: &vfs.Config{Chunk: &chunk.Config{CacheKey: []byte("2")}}, equal: false,
+		},
+		{
+			a: &vfs.Config{Format: meta.Format{TrashPolicies: map[meta.Ino]int{2: 1}}}, b: &vfs.Config{}, equal: false,
+		},
 	}
 
 	for _, c := range cases {
@@ -224,3 +239,63 @@ func Test_configEqual(t *testing.T) {
 		}
 	}
 }
+
+type conditionalStore struct {
+	object.ObjectStorage
+	calls int
+}
+
+func (s *conditionalStore) PutIfNotExists(key string, in io.Reader) error {
+	s.calls++
+	return object.PutIfNotExists(s.ObjectStorage, key, in)
+}
+
+func TestStorageHolderPutIfNotExists(t *testing.T) {
+	blob, _ := object.CreateStorage("mem", "", "", "", "")
+	store := &conditionalStore{ObjectStorage: blob}
+	var holder object.ObjectStorage = &storageHolder{ObjectStorage: store}
+	if _, ok := holder.(object.SupportConditionalPut); !ok {
+		t.Fatalf("storageHolder should support conditional put")
+	}
+	if err := object.PutIfNotExists(holder, "meta/dump", strings.NewReader("a")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if err := object.PutIfNotExists(holder, "meta/dump", strings.NewReader("b")); !os.IsExist(err) {
+		t.Fatalf("put existing key should fail with ErrExist, but got %v", err)
+	}
+	if store.calls != 2 {
+		t.Fatalf("conditional put should be forwarded to the storage, called %d times", store.calls)
+	}
+}
+
+func TestNewCacheKey(t *testing.T) {
+	privKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	format := meta.Format{
+		Name:        "test",
+		UUID:        "a6a8b8a4-1b9e-4c0d-a6c2-6d3c5e8e2f10",
+		SecretKey:   "secret",
+		EncryptKey:  object.ExportRsaPrivateKeyToPem(privKey, ""),
+		EncryptAlgo: object.AES256GCM_RSA,
+	}
+	key, err := NewCacheKey(&format)
+	if err != nil {
+		t.Fatalf("cache key: %s", err)
+	}
+	encrypted := format
+	if err = encrypted.Encrypt(); err != nil {
+		t.Fatalf("encrypt format: %s", err)
+	}
+	key2, err := NewCacheKey(&encrypted)
+	if err != nil {
+		t.Fatalf("cache key with encrypted secrets: %s", err)
+	}
+	if string(key) != string(key2) {
+		t.Fatalf("cache key should not depend on the encryption of secrets")
+	}
+	if !encrypted.KeyEncrypted || encrypted.EncryptKey == format.EncryptKey {
+		t.Fatalf("the format should not be decrypted in place")
+	}
+	if _, err = NewCacheKey(&meta.Format{Name: "plain", UUID: format.UUID}); err == nil {
+		t.Fatalf("cache key of an unencrypted volume should fail")
+	}
+}
@@ -106,10 +106,18 @@ func fuseFlags() []cli.Flag {
 			Name:  "enable-xattr",
 			Usage: "enable extended attributes (xattr)",
 		},
+		&cli.BoolFlag{
+			Name:  "strict-xattrs",
+			Usage: "reject setting the extended attributes out of the namespaces supported by Linux (the existing ones can still be read and removed)",
+		},
 		&cli.BoolFlag{
 			Name:  "enable-ioctl",
 			Usage: "enable ioctl (support GETFLAGS/SETFLAGS only)",
 		},
+		&cli.BoolFlag{
+			Name:  "writeback-cache",
+			Usage: "enable writeback_cache mode of FUSE to merge small writes in kernel (Linux 3.15+)",
+		},
 		&cli.StringFlag{
 			Name:  "root-squash",
 			Usage: "mapping local root user (uid = 0) to another one specified as <uid>:<gid>",
@@ -118,6 +126,10 @@ func fuseFlags() []cli.Flag {
 			Name:  "prefix-internal",
 			Usage: "add '.jfs' prefix to all internal files",
 		},
+		&cli.StringFlag{
+			Name:  "read-only-prefixes",
+			Usage: "comma separated paths (relative to the mount point) which are read-only in this mount, e.g. /reference,/datasets",
+		},
 		&cli.BoolFlag{
 			Name:   "non-default-permission",
 			Usage:  "disable `default_permissions` option, only for testing",
@@ -165,6 +177,10 @@ func mount_flags() []cli.Flag {
 			Name:  "force",
 			Usage: "force to mount even if the mount point is already mounted by the same filesystem",
 		},
+		&cli.BoolFlag{
+			Name:  "nfs-loopback",
+			Usage: "serve the volume by a built-in NFS server on localhost and mount it by the NFS client instead of FUSE (for macOS without macFUSE)",
+		},
 		&cli.BoolFlag{
 			Name:  "update-fstab",
 			Usage: "add / update entry in /etc/fstab, will create a symlink at /sbin/mount.juicefs if not existing",
@@ -229,6 +245,7 @@ func mount_main(v *vfs.VFS, c *cli.Context) {
 	conf.EntryTimeout = time.Millisecond * time.Duration(c.Float64("entry-cache")*1000)
 	conf.DirEntryTimeout = time.Millisecond * time.Duration(c.Float64("dir-entry-cache")*1000)
 	conf.NonDefaultPermission = c.Bool("non-default-permission")
+	conf.WritebackCache = c.Bool("writeback-cache")
 	rootSquash := c.String("root-squash")
 	if rootSquash != "" {
 		var uid, gid uint32 = 65534, 65534
@@ -265,6 +282,12 @@ func mount_main(v *vfs.VFS, c *cli.Context) {
 		conf.RootSquash = &vfs.RootSquash{Uid: uid, Gid: gid}
 	}
 	logger.Infof("Mounting volume %s at %s ...", conf.Format.Name, conf.Meta.MountPoint)
+	if c.Bool("nfs-loopback") {
+		if err := nfsLoopback(v, runtime.GOOS); err != nil {
+			logger.Fatalf("nfs: %s", err)
+		}
+		return
+	}
 	err := fuse.Serve(v, c.String("o"), c.Bool("enable-xattr"), c.Bool("enable-ioctl"))
 	if err != nil {
 		logger.Fatalf("fuse: %s", err)
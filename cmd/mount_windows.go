@@ -17,6 +17,8 @@
 package cmd
 
 import (
+	"strings"
+
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/vfs"
 	"github.com/juicedata/juicefs/pkg/winfsp"
@@ -42,6 +44,16 @@ func mount_flags() []cli.Flag {
 			Name:  "delay-close",
 			Usage: "delay file closing in seconds.",
 		},
+		&cli.StringFlag{
+			Name:  "share-deny",
+			Value: "none",
+			Usage: "share modes denied by the files opened for writing, across all clients: none, write or read-write",
+		},
+		&cli.StringFlag{
+			Name:  "case-sensitivity",
+			Value: "auto",
+			Usage: "case sensitivity of names: sensitive, insensitive or auto (insensitive for drive letters)",
+		},
 	}
 }
 
@@ -51,7 +63,26 @@ func makeDaemon(c *cli.Context, name, mp string, m meta.Meta) error {
 }
 
 func mount_main(v *vfs.VFS, c *cli.Context) {
-	winfsp.Serve(v, c.String("o"), c.Float64("file-cache-to"), c.Bool("as-root"), c.Int("delay-close"))
+	switch c.String("case-sensitivity") {
+	case "sensitive":
+	case "insensitive":
+		v.Conf.CaseInsensitive = true
+	case "auto":
+		v.Conf.CaseInsensitive = strings.HasSuffix(v.Conf.Meta.MountPoint, ":")
+	default:
+		logger.Fatalf("invalid case sensitivity: %s", c.String("case-sensitivity"))
+	}
+	var shareDeny uint8
+	switch c.String("share-deny") {
+	case "none":
+	case "write":
+		shareDeny = vfs.ShareWrite
+	case "read-write":
+		shareDeny = vfs.ShareRead | vfs.ShareWrite
+	default:
+		logger.Fatalf("invalid share deny: %s", c.String("share-deny"))
+	}
+	winfsp.Serve(v, c.String("o"), c.Float64("file-cache-to"), c.Bool("as-root"), c.Int("delay-close"), shareDeny)
 }
 
 func checkMountpoint(name, mp, logPath string, background bool) {
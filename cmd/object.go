@@ -19,6 +19,7 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math/rand"
 	"os"
@@ -200,9 +201,12 @@ func (j *juiceFS) Head(key string) (object.Object, error) {
 	return &jObj{key, fi}, nil
 }
 
-func (j *juiceFS) List(prefix, marker, delimiter string, limit int64) ([]object.Object, error) {
+func (j *juiceFS) List(prefix, marker, token, delimiter string, limit int64) ([]object.Object, bool, string, error) {
 	if delimiter != "/" {
-		return nil, utils.ENOTSUP
+		return nil, false, "", utils.ENOTSUP
+	}
+	if token != "" {
+		marker = token
 	}
 	dir := j.path(prefix)
 	var objs []object.Object
@@ -212,18 +216,18 @@ func (j *juiceFS) List(prefix, marker, delimiter string, limit int64) ([]object.
 		obj, err := j.Head(prefix)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return nil, nil
+				return nil, false, "", nil
 			}
-			return nil, err
+			return nil, false, "", err
 		}
 		objs = append(objs, obj)
 	}
 	entries, err := j.readDirSorted(dir)
 	if err != 0 {
 		if err == syscall.ENOENT {
-			return nil, nil
+			return nil, false, "", nil
 		}
-		return nil, err
+		return nil, false, "", err
 	}
 	for _, e := range entries {
 		key := dir[1:] + e.name
@@ -233,10 +237,10 @@ func (j *juiceFS) List(prefix, marker, delimiter string, limit int64) ([]object.
 		f := &jObj{key, e.fi}
 		objs = append(objs, f)
 		if len(objs) == int(limit) {
-			break
+			return objs, true, key, nil
 		}
 	}
-	return objs, nil
+	return objs, false, "", nil
 }
 
 // walk recursively descends path, calling w.
@@ -415,6 +419,63 @@ func (j *juiceFS) Chown(key string, owner, group string) error {
 	return toError(f.Chown(ctx, uint32(uid), uint32(gid)))
 }
 
+var aclXattrs = map[string]uint8{
+	"system.posix_acl_access":  meta.ACLTypeAccess,
+	"system.posix_acl_default": meta.ACLTypeDefault,
+}
+
+func (j *juiceFS) GetXattrs(key string) (map[string][]byte, error) {
+	p := j.path(key)
+	names, eno := j.jfs.ListXattr(ctx, p)
+	if eno != 0 {
+		return nil, eno
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" || name == syncXattr {
+			continue
+		}
+		v, eno := j.jfs.GetXattr(ctx, p, name)
+		if eno == meta.ENOATTR {
+			continue
+		} else if eno != 0 {
+			return nil, eno
+		}
+		xattrs[name] = v
+	}
+	for name, aclType := range aclXattrs {
+		var rule meta.ACLRule
+		eno := j.jfs.GetFacl(ctx, p, aclType, &rule)
+		if eno == 0 {
+			xattrs[name] = rule.EncodeXattr()
+		} else if eno != meta.ENOATTR && eno != syscall.ENOTSUP {
+			return nil, eno
+		}
+	}
+	return xattrs, nil
+}
+
+func (j *juiceFS) SetXattrs(key string, xattrs map[string][]byte) error {
+	p := j.path(key)
+	var lastErr error
+	for name, value := range xattrs {
+		var eno syscall.Errno
+		if aclType, ok := aclXattrs[name]; ok {
+			var rule *meta.ACLRule
+			if rule, eno = meta.DecodeXattr(value); eno == 0 {
+				eno = j.jfs.SetFacl(ctx, p, aclType, rule)
+			}
+		} else {
+			eno = j.jfs.SetXattr(ctx, p, name, value, 0)
+		}
+		if eno != 0 {
+			lastErr = eno
+			logger.Debugf("Set xattr %s of %s: %s", name, p, eno)
+		}
+	}
+	return lastErr
+}
+
 func (d *juiceFS) Symlink(oldName, newName string) error {
 	p := d.path(newName)
 	err := d.jfs.Symlink(ctx, oldName, p)
@@ -430,16 +491,152 @@ func (j *juiceFS) Readlink(name string) (string, error) {
 	return string(target), toError(err)
 }
 
+// syncXattr keeps the fingerprints of the source and the file itself when it's synced.
+const syncXattr = "user.juicefs.sync"
+
+type syncFingerprints struct {
+	Src []string `json:"src"`
+	Dst []string `json:"dst"`
+}
+
+func (j *juiceFS) fingerprints(p string) ([]string, error) {
+	fi, eno := j.jfs.Lstat(ctx, p)
+	if eno != 0 {
+		return nil, eno
+	}
+	if fi.IsDir() || fi.IsSymlink() {
+		return nil, syscall.EINVAL
+	}
+	m := j.jfs.Meta()
+	uuid := m.GetFormat().UUID
+	fps := make([]string, (fi.Size()+meta.ChunkSize-1)/meta.ChunkSize)
+	var slices []meta.Slice
+	for i := range fps {
+		if eno = m.Read(ctx, fi.Inode(), uint32(i), &slices); eno != 0 {
+			return nil, eno
+		}
+		// slices are never changed once written, so they tell the content of a chunk
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(uuid))
+		for _, s := range slices {
+			_, _ = fmt.Fprintf(h, ",%d:%d:%d:%d", s.Id, s.Size, s.Off, s.Len)
+		}
+		fps[i] = strconv.FormatUint(h.Sum64(), 16)
+	}
+	return fps, nil
+}
+
+func (j *juiceFS) Fingerprints(key string) (int64, []string, error) {
+	fps, err := j.fingerprints(j.path(key))
+	return meta.ChunkSize, fps, err
+}
+
+func (j *juiceFS) SourceFingerprints(key string) ([]string, error) {
+	p := j.path(key)
+	v, eno := j.jfs.GetXattr(ctx, p, syncXattr)
+	if eno == meta.ENOATTR || eno == syscall.ENOENT {
+		return nil, nil
+	} else if eno != 0 {
+		return nil, eno
+	}
+	var saved syncFingerprints
+	if err := json.Unmarshal(v, &saved); err != nil {
+		return nil, nil
+	}
+	current, err := j.fingerprints(p)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Join(current, ",") != strings.Join(saved.Dst, ",") {
+		return nil, nil // changed after synced
+	}
+	return saved.Src, nil
+}
+
+func (j *juiceFS) SetSourceFingerprints(key string, fps []string) error {
+	p := j.path(key)
+	current, err := j.fingerprints(p)
+	if err != nil {
+		return err
+	}
+	v, _ := json.Marshal(syncFingerprints{fps, current})
+	return toError(j.jfs.SetXattr(ctx, p, syncXattr, v, 0))
+}
+
+func (j *juiceFS) WriteAt(key string, in io.Reader, off int64) error {
+	f, eno := j.jfs.Open(ctx, j.path(key), vfs.MODE_MASK_W)
+	if eno != 0 {
+		return eno
+	}
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	for {
+		n, err := io.ReadFull(in, *buf)
+		if n > 0 {
+			if _, eno = f.Pwrite(ctx, (*buf)[:n], off); eno != 0 {
+				_ = f.Close(ctx)
+				return eno
+			}
+			off += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			_ = f.Close(ctx)
+			return err
+		}
+	}
+	return toError(f.Close(ctx))
+}
+
+func (j *juiceFS) Truncate(key string, size int64) error {
+	return toError(j.jfs.Truncate(ctx, j.path(key), uint64(size)))
+}
+
+func (j *juiceFS) Locate(key string) (string, string, error) {
+	return j.jfs.Meta().GetFormat().UUID, j.path(key), nil
+}
+
+func (j *juiceFS) CloneFrom(src, key string) error {
+	fi, eno := j.jfs.Lstat(ctx, src)
+	if eno != 0 {
+		return eno
+	}
+	p := j.path(key)
+	dir := filepath.Dir(p)
+	parent, eno := j.jfs.Stat(ctx, dir)
+	if eno == syscall.ENOENT {
+		if eno = j.jfs.MkdirAll(ctx, dir, 0755); eno == 0 {
+			parent, eno = j.jfs.Stat(ctx, dir)
+		}
+	}
+	if eno != 0 {
+		return eno
+	}
+	tmp := "." + filepath.Base(p) + ".tmp" + strconv.Itoa(rand.Int())
+	var count, total uint64
+	if eno = j.jfs.Meta().Clone(ctx, fi.Inode(), parent.Inode(), tmp, meta.CLONE_MODE_PRESERVE_ATTR, 022, &count, &total); eno != 0 {
+		return eno
+	}
+	if eno = j.jfs.Rename(ctx, filepath.Join(dir, tmp), p, 0); eno != 0 {
+		_ = j.jfs.Delete(ctx, filepath.Join(dir, tmp))
+		return eno
+	}
+	return nil
+}
+
 func getDefaultChunkConf(format *meta.Format) *chunk.Config {
 	chunkConf := &chunk.Config{
-		BlockSize:  format.BlockSize * 1024,
-		Compress:   format.Compression,
-		HashPrefix: format.HashPrefix,
-		GetTimeout: time.Minute,
-		PutTimeout: time.Minute,
-		MaxUpload:  50,
-		MaxRetries: 10,
-		BufferSize: 300 << 20,
+		BlockSize:     format.BlockSize * 1024,
+		Compress:      format.Compression,
+		CompressLevel: format.CompressLevel,
+		CompressDict:  format.CompressDict,
+		HashPrefix:    format.HashPrefix,
+		GetTimeout:    time.Minute,
+		PutTimeout:    time.Minute,
+		MaxUpload:     50,
+		MaxRetries:    10,
+		BufferSize:    300 << 20,
 	}
 	chunkConf.SelfCheck(format.UUID)
 	return chunkConf
@@ -463,7 +660,7 @@ func newJFS(endpoint, accessKey, secretKey, token string) (object.ObjectStorage,
 		return nil, fmt.Errorf("object storage: %s", err)
 	}
 	chunkConf := getDefaultChunkConf(format)
-	store := chunk.NewCachedStore(blob, *chunkConf, nil)
+	store := chunk.NewCachedStore(wrapStorage(blob, metaCli, format), *chunkConf, nil)
 	registerMetaMsg(metaCli, store, chunkConf)
 	err = metaCli.NewSession()
 	if err != nil {
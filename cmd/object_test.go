@@ -18,6 +18,7 @@ package cmd
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 	"time"
@@ -142,7 +143,7 @@ func testFileSystem(t *testing.T, s object.ObjectStorage) {
 	}
 }
 
-func TestJFS(t *testing.T) {
+func newTestJFS(t *testing.T) *juiceFS {
 	m := meta.NewClient("memkv://", nil)
 	format := &meta.Format{
 		Name:      "test",
@@ -169,8 +170,72 @@ func TestJFS(t *testing.T) {
 	if err != nil {
 		t.Fatalf("initialize  failed: %s", err)
 	}
+	return &juiceFS{object.DefaultObjectStorage{}, "test", jfs}
+}
 
-	jstore := &juiceFS{object.DefaultObjectStorage{}, "test", jfs}
+func TestJFS(t *testing.T) {
+	jstore := newTestJFS(t)
 	testFileSystem(t, jstore)
 	testFileSystem(t, object.WithPrefix(jstore, "unittest/"))
 }
+
+func TestJFSFingerprints(t *testing.T) {
+	jstore := newTestJFS(t)
+	var s object.ObjectStorage = object.WithPrefix(jstore, "fp/")
+	read := func(key string) string {
+		in, err := s.Get(key, 0, -1)
+		if err != nil {
+			t.Fatalf("get %s: %s", key, err)
+		}
+		defer in.Close()
+		d, _ := io.ReadAll(in)
+		return string(d)
+	}
+	_ = s.Put("a", bytes.NewReader([]byte("hello")))
+	_ = s.Put("b", bytes.NewReader([]byte("hello")))
+	fp := s.(object.SupportFingerprint)
+	size, fps, err := fp.Fingerprints("a")
+	if err != nil || size != meta.ChunkSize || len(fps) != 1 {
+		t.Fatalf("fingerprints: %d %v %s", size, fps, err)
+	}
+	if _, fps2, _ := fp.Fingerprints("b"); fps2[0] == fps[0] {
+		t.Fatalf("different files should have different fingerprints")
+	}
+	if old, err := fp.SourceFingerprints("b"); err != nil || old != nil {
+		t.Fatalf("no saved fingerprints: %v %s", old, err)
+	}
+	if err = fp.SetSourceFingerprints("b", fps); err != nil {
+		t.Fatalf("save fingerprints: %s", err)
+	}
+	if old, _ := fp.SourceFingerprints("b"); len(old) != 1 || old[0] != fps[0] {
+		t.Fatalf("saved fingerprints: %v", old)
+	}
+	if xattrs, _ := s.(object.SupportXattr).GetXattrs("b"); xattrs[syncXattr] != nil {
+		t.Fatalf("fingerprints should not be copied as xattrs")
+	}
+	if err = fp.WriteAt("b", strings.NewReader("J"), 0); err != nil {
+		t.Fatalf("write at: %s", err)
+	}
+	if old, _ := fp.SourceFingerprints("b"); old != nil {
+		t.Fatalf("the fingerprints should be invalid after changed: %v", old)
+	}
+	if err = fp.Truncate("b", 3); err != nil || read("b") != "Jel" {
+		t.Fatalf("truncate: %s %q", err, read("b"))
+	}
+
+	c := s.(object.SupportClone)
+	vol, p, err := c.Locate("a")
+	if err != nil || p != "/fp/a" {
+		t.Fatalf("locate: %s %s %s", vol, p, err)
+	}
+	if err = c.CloneFrom(p, "b"); err != nil || read("b") != "hello" {
+		t.Fatalf("clone: %s %q", err, read("b"))
+	}
+	if err = c.CloneFrom(p, "d/c"); err != nil || read("d/c") != "hello" {
+		t.Fatalf("clone into new dir: %s %q", err, read("d/c"))
+	}
+	// a cloned file shares the slices of source
+	if _, fps2, _ := fp.Fingerprints("d/c"); len(fps2) != 1 || fps2[0] != fps[0] {
+		t.Fatalf("cloned file should have the same fingerprints: %v %v", fps2, fps)
+	}
+}
@@ -29,7 +29,7 @@ func cmdQuota() *cli.Command {
 	return &cli.Command{
 		Name:            "quota",
 		Category:        "ADMIN",
-		Usage:           "Manage directory quotas",
+		Usage:           "Manage directory, user and group quotas",
 		ArgsUsage:       "META-URL",
 		HideHelpCommand: true,
 		Description: `
@@ -37,37 +37,39 @@ Examples:
 $ juicefs quota set redis://localhost --path /dir1 --capacity 1 --inodes 100
 $ juicefs quota get redis://localhost --path /dir1
 $ juicefs quota list redis://localhost
-$ juicefs quota delete redis://localhost --path /dir1`,
+$ juicefs quota delete redis://localhost --path /dir1
+$ juicefs quota set redis://localhost --uid 1000 --capacity 100
+$ juicefs quota get redis://localhost --gid 100`,
 		Subcommands: []*cli.Command{
 			{
 				Name:      "set",
-				Usage:     "Set quota to a directory",
+				Usage:     "Set quota to a directory, user or group",
 				ArgsUsage: "META-URL",
 				Action:    quota,
 			},
 			{
 				Name:      "get",
-				Usage:     "Get quota of a directory",
+				Usage:     "Get quota of a directory, user or group",
 				ArgsUsage: "META-URL",
 				Action:    quota,
 			},
 			{
 				Name:      "delete",
 				Aliases:   []string{"del"},
-				Usage:     "Delete quota of a directory",
+				Usage:     "Delete quota of a directory, user or group",
 				ArgsUsage: "META-URL",
 				Action:    quota,
 			},
 			{
 				Name:      "list",
 				Aliases:   []string{"ls"},
-				Usage:     "List all directory quotas",
+				Usage:     "List all quotas",
 				ArgsUsage: "META-URL",
 				Action:    quota,
 			},
 			{
 				Name:      "check",
-				Usage:     "Check quota consistency of a directory",
+				Usage:     "Check quota consistency of a directory, user or group",
 				ArgsUsage: "META-URL",
 				Action:    quota,
 			},
@@ -77,13 +79,21 @@ $ juicefs quota delete redis://localhost --path /dir1`,
 				Name:  "path",
 				Usage: "full path of the directory within the volume",
 			},
+			&cli.Uint64Flag{
+				Name:  "uid",
+				Usage: "uid of the user (instead of --path)",
+			},
+			&cli.Uint64Flag{
+				Name:  "gid",
+				Usage: "gid of the group (instead of --path)",
+			},
 			&cli.Uint64Flag{
 				Name:  "capacity",
-				Usage: "hard quota of the directory limiting its usage of space in GiB",
+				Usage: "hard quota of the directory, user or group limiting its usage of space in GiB",
 			},
 			&cli.Uint64Flag{
 				Name:  "inodes",
-				Usage: "hard quota of the directory limiting its number of inodes",
+				Usage: "hard quota of the directory, user or group limiting its number of inodes",
 			},
 			&cli.BoolFlag{
 				Name:  "repair",
@@ -115,8 +125,13 @@ func quota(c *cli.Context) error {
 		logger.Fatalf("Invalid quota command: %s", c.Command.Name)
 	}
 	dpath := c.String("path")
+	if c.IsSet("uid") {
+		dpath = fmt.Sprintf("uid:%d", c.Uint64("uid"))
+	} else if c.IsSet("gid") {
+		dpath = fmt.Sprintf("gid:%d", c.Uint64("gid"))
+	}
 	if dpath == "" && cmd != meta.QuotaList {
-		logger.Fatalf("Please specify the directory with `--path <dir>` option")
+		logger.Fatalf("Please specify the directory with `--path <dir>` option, or the user or group with `--uid` or `--gid`")
 	}
 	removePassword(c.Args().Get(0))
 
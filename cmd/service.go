@@ -0,0 +1,50 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"runtime"
+
+	"github.com/urfave/cli/v2"
+)
+
+// secrets kept in the credential store for services, which are passed to the mount as environment variables
+var serviceSecrets = []string{"META_PASSWORD", "JFS_RSA_PASSPHRASE"}
+
+func cmdService() *cli.Command {
+	return &cli.Command{
+		Name:            "service",
+		Action:          service,
+		Category:        "SERVICE",
+		Usage:           "Manage mounts running as Windows services",
+		ArgsUsage:       "install|uninstall|start|stop NAME [META-URL MOUNTPOINT [MOUNT OPTIONS]]",
+		Hidden:          runtime.GOOS != "windows",
+		SkipFlagParsing: true,
+		Description: `
+Run a mount as a Windows service, which is started automatically on boot, and restarted if it fails.
+The secrets in environment variables (META_PASSWORD and JFS_RSA_PASSPHRASE) are stored in the Windows
+Credential Manager of the service account (LocalSystem), instead of the command line of the service.
+Logs of the mount are written into "%ProgramData%\juicefs\NAME.log". It requires administrator privileges.
+
+Examples:
+$ set META_PASSWORD=mypassword
+$ juicefs service install myjfs redis://localhost Z: --cache-size 10240
+$ juicefs service stop myjfs
+$ juicefs service start myjfs
+$ juicefs service uninstall myjfs`,
+	}
+}
@@ -0,0 +1,398 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func service(c *cli.Context) error {
+	setup(c, 2)
+	action, name := c.Args().Get(0), c.Args().Get(1)
+	args := c.Args().Slice()[2:]
+	switch action {
+	case "install":
+		return installService(name, serviceRunArgs(c, name, args))
+	case "uninstall":
+		return uninstallService(name)
+	case "start", "stop":
+		return controlService(name, action)
+	case "run": // called by the service control manager
+		return svc.Run(serviceName(name), &mountService{name: name, args: mountArgs(c, args), store: credManager{}})
+	default:
+		return fmt.Errorf("unknown action of service: %s", action)
+	}
+}
+
+func serviceName(name string) string {
+	return "juicefs-" + name
+}
+
+func secretTarget(name, key string) string {
+	return "juicefs/" + name + "/" + key
+}
+
+// mountArgs returns the arguments of the mount, with the global options (which are taken out of the
+// arguments by reorderOptions).
+func mountArgs(c *cli.Context, args []string) []string {
+	args = append([]string{}, args...)
+	for _, f := range c.App.Flags {
+		name := f.Names()[0]
+		if !c.IsSet(name) {
+			continue
+		}
+		if _, ok := f.(*cli.BoolFlag); ok {
+			if c.Bool(name) {
+				args = append(args, "--"+name)
+			}
+		} else {
+			args = append(args, "--"+name+"="+c.String(name))
+		}
+	}
+	return args
+}
+
+// serviceRunArgs returns the command line of the service, which runs the mount with the same arguments.
+func serviceRunArgs(c *cli.Context, name string, args []string) []string {
+	return append([]string{"service", "run", name}, mountArgs(c, args)...)
+}
+
+func installService(name string, runArgs []string) error {
+	args := runArgs[3:]
+	if len(args) < 2 {
+		return fmt.Errorf("META-URL and MOUNTPOINT are required")
+	}
+	if utils.RemovePassword(args[0]) != args[0] {
+		return fmt.Errorf("the password should be set by META_PASSWORD rather than in META-URL")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to service manager: %s", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName(name)); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName(name))
+	}
+	s, err := m.CreateService(serviceName(name), exe, mgr.Config{
+		DisplayName: "JuiceFS " + name,
+		Description: fmt.Sprintf("Mount %s at %s", args[0], args[1]),
+		StartType:   mgr.StartAutomatic,
+	}, runArgs...)
+	if err != nil {
+		return fmt.Errorf("create service %s: %s", serviceName(name), err)
+	}
+	defer s.Close()
+	if err = s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: time.Second * 10}}, 86400); err != nil {
+		logger.Warnf("Set recovery actions of service %s: %s", serviceName(name), err)
+	} else {
+		// restart it also when the mount exits with error (SERVICE_FAILURE_ACTIONS_FLAG)
+		flag := struct{ FailureActionsOnNonCrashFailures int32 }{1}
+		if err = windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_FAILURE_ACTIONS_FLAG, (*byte)(unsafe.Pointer(&flag))); err != nil {
+			logger.Warnf("Set recovery actions of service %s: %s", serviceName(name), err)
+		}
+	}
+
+	// The secrets are stored by the service itself, since the credentials are bound to the account.
+	secrets := collectSecrets(os.Getenv)
+	if err = s.Start(secrets...); err != nil {
+		return fmt.Errorf("start service %s: %s", serviceName(name), err)
+	}
+	logger.Infof("Service %s is installed and started, %d secrets are stored", serviceName(name), len(secrets))
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to service manager: %s", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName(name))
+	if err != nil {
+		return fmt.Errorf("open service %s: %s", serviceName(name), err)
+	}
+	defer s.Close()
+	if st, err := s.Query(); err == nil && st.State != svc.Stopped {
+		if err = stopService(s); err != nil {
+			return err
+		}
+	}
+	// the secrets can only be removed by the service itself
+	if err = s.Start(forgetSecrets); err != nil {
+		logger.Warnf("Remove secrets of service %s: %s", serviceName(name), err)
+	} else if err = waitStopped(s); err != nil {
+		logger.Warnf("Remove secrets of service %s: %s", serviceName(name), err)
+	}
+	if err = s.Delete(); err != nil {
+		return fmt.Errorf("delete service %s: %s", serviceName(name), err)
+	}
+	logger.Infof("Service %s is uninstalled", serviceName(name))
+	return nil
+}
+
+func controlService(name, action string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to service manager: %s", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName(name))
+	if err != nil {
+		return fmt.Errorf("open service %s: %s", serviceName(name), err)
+	}
+	defer s.Close()
+	if action == "start" {
+		return s.Start()
+	}
+	return stopService(s)
+}
+
+func stopService(s *mgr.Service) error {
+	if _, err := s.Control(svc.Stop); err != nil {
+		return fmt.Errorf("stop service %s: %s", s.Name, err)
+	}
+	return waitStopped(s)
+}
+
+func waitStopped(s *mgr.Service) error {
+	st, err := s.Query()
+	if err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(time.Minute); st.State != svc.Stopped; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout to stop service %s", s.Name)
+		}
+		time.Sleep(time.Millisecond * 300)
+		if st, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetSecrets is passed to the service to remove its secrets before uninstalled
+const forgetSecrets = "--forget-secrets"
+
+// secretStore keeps the secrets of services.
+type secretStore interface {
+	write(target, secret string) error
+	read(target string) (string, error)
+	delete(target string) error
+}
+
+// collectSecrets returns the secrets in environment variables as KEY=VALUE, which are passed to the service.
+func collectSecrets(getenv func(string) string) []string {
+	var secrets []string
+	for _, key := range serviceSecrets {
+		if value := getenv(key); value != "" {
+			secrets = append(secrets, key+"="+value)
+		}
+	}
+	return secrets
+}
+
+// saveSecrets stores the secrets (KEY=VALUE) in the arguments of service start.
+func saveSecrets(store secretStore, name string, args []string) {
+	for _, arg := range args {
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 && utils.StringContains(serviceSecrets, kv[0]) {
+			if err := store.write(secretTarget(name, kv[0]), kv[1]); err != nil {
+				logger.Errorf("Store secret %s: %s", kv[0], err)
+			}
+		}
+	}
+}
+
+// loadSecrets returns the environment variables with the stored secrets.
+func loadSecrets(store secretStore, name string, env []string) []string {
+	for _, key := range serviceSecrets {
+		if value, err := store.read(secretTarget(name, key)); err == nil {
+			env = append(env, key+"="+value)
+		}
+	}
+	return env
+}
+
+func removeSecrets(store secretStore, name string) {
+	for _, key := range serviceSecrets {
+		_ = store.delete(secretTarget(name, key))
+	}
+}
+
+type mountService struct {
+	name  string
+	args  []string
+	store secretStore
+}
+
+// Execute runs the mount in a child process, and umounts it when the service is stopped.
+func (ms *mountService) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	if len(args) > 1 && args[1] == forgetSecrets {
+		removeSecrets(ms.store, ms.name)
+		return false, 0
+	}
+	saveSecrets(ms.store, ms.name, args[1:]) // secrets passed by install
+
+	exe, _ := os.Executable()
+	cmd := exec.Command(exe, append([]string{"mount"}, ms.args...)...)
+	cmd.Env = loadSecrets(ms.store, ms.name, os.Environ())
+	logDir := filepath.Join(os.Getenv("ProgramData"), "juicefs")
+	_ = os.MkdirAll(logDir, 0755)
+	if f, err := os.OpenFile(filepath.Join(logDir, ms.name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+		defer f.Close()
+		cmd.Stdout, cmd.Stderr = f, f
+	}
+	mp := ms.args[1]
+	return superviseMount(cmd, func() error { return doUmount(mp, false) }, r, status, time.Second*30)
+}
+
+// superviseMount starts the mount process and waits for it. When the service is stopped, the mount
+// point is umounted, and the process is killed if it does not exit within the timeout. The mount
+// exiting by itself is a failure of the service, which is restarted by the recovery actions.
+func superviseMount(cmd *exec.Cmd, umount func() error, r <-chan svc.ChangeRequest, status chan<- svc.Status, timeout time.Duration) (bool, uint32) {
+	if err := cmd.Start(); err != nil {
+		logger.Errorf("Start mount: %s", err)
+		return true, 1
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			logger.Errorf("Mount exited: %v", err)
+			return true, 1
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				if err := umount(); err != nil {
+					logger.Warnf("Umount: %s", err)
+				}
+				select {
+				case <-done:
+				case <-time.After(timeout):
+					_ = cmd.Process.Kill()
+					<-done
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// Windows Credential Manager, see wincred.h
+var (
+	advapi32        = windows.NewLazySystemDLL("advapi32.dll")
+	procCredWriteW  = advapi32.NewProc("CredWriteW")
+	procCredReadW   = advapi32.NewProc("CredReadW")
+	procCredDeleteW = advapi32.NewProc("CredDeleteW")
+	procCredFree    = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+// credManager keeps the secrets in the Credential Manager of the current account.
+type credManager struct{}
+
+func (credManager) write(target, secret string) error  { return credWrite(target, secret) }
+func (credManager) read(target string) (string, error) { return credRead(target) }
+func (credManager) delete(target string) error         { return credDelete(target) }
+
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+func credWrite(target, secret string) error {
+	t, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return err
+	}
+	blob := []byte(secret)
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         t,
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            credPersistLocalMachine,
+	}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+	if r, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func credRead(target string) (string, error) {
+	t, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	if r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(t)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred))); r == 0 {
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	return string(unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)), nil
+}
+
+func credDelete(target string) error {
+	t, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return err
+	}
+	if r, _, err := procCredDeleteW.Call(uintptr(unsafe.Pointer(t)), credTypeGeneric, 0); r == 0 {
+		return err
+	}
+	return nil
+}
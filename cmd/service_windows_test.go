@@ -0,0 +1,206 @@
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/windows/svc"
+)
+
+func TestCredManager(t *testing.T) {
+	target := secretTarget(fmt.Sprintf("test-%d", os.Getpid()), "META_PASSWORD")
+	var store secretStore = credManager{}
+	if err := store.write(target, "p@ss word"); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if v, err := store.read(target); err != nil || v != "p@ss word" {
+		t.Fatalf("read: %q %v", v, err)
+	}
+	if err := store.write(target, ""); err != nil {
+		t.Fatalf("write empty: %s", err)
+	}
+	if v, err := store.read(target); err != nil || v != "" {
+		t.Fatalf("read empty: %q %v", v, err)
+	}
+	if err := store.delete(target); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := store.read(target); err == nil {
+		t.Fatalf("read deleted secret should fail")
+	}
+	if err := store.delete(target); err == nil {
+		t.Fatalf("delete twice should fail")
+	}
+}
+
+type memSecrets map[string]string
+
+func (m memSecrets) write(target, secret string) error {
+	m[target] = secret
+	return nil
+}
+
+func (m memSecrets) read(target string) (string, error) {
+	if v, ok := m[target]; ok {
+		return v, nil
+	}
+	return "", syscall.ENOENT
+}
+
+func (m memSecrets) delete(target string) error {
+	delete(m, target)
+	return nil
+}
+
+func TestServiceSecrets(t *testing.T) {
+	env := map[string]string{"META_PASSWORD": "a=b", "OTHER": "x"}
+	secrets := collectSecrets(func(key string) string { return env[key] })
+	if !reflect.DeepEqual(secrets, []string{"META_PASSWORD=a=b"}) {
+		t.Fatalf("secrets: %v", secrets)
+	}
+
+	store := memSecrets{}
+	saveSecrets(store, "myjfs", append(secrets, "OTHER=x", "JFS_RSA_PASSPHRASE"))
+	if len(store) != 1 || store["juicefs/myjfs/META_PASSWORD"] != "a=b" {
+		t.Fatalf("stored secrets: %v", store)
+	}
+	if env := loadSecrets(store, "myjfs", []string{"PATH=C:\\"}); !reflect.DeepEqual(env, []string{"PATH=C:\\", "META_PASSWORD=a=b"}) {
+		t.Fatalf("env: %v", env)
+	}
+	if env := loadSecrets(store, "other", nil); len(env) != 0 {
+		t.Fatalf("env of other service: %v", env)
+	}
+	removeSecrets(store, "myjfs")
+	if len(store) != 0 {
+		t.Fatalf("secrets should be removed: %v", store)
+	}
+}
+
+// runServiceCmd runs the command line as Main does, and returns the arguments of the mount.
+func runServiceCmd(t *testing.T, args []string) (name string, runArgs, mArgs []string) {
+	app := &cli.App{
+		Name:  "juicefs",
+		Flags: globalFlags(),
+		Commands: []*cli.Command{{
+			Name:            "service",
+			SkipFlagParsing: true,
+			Action: func(c *cli.Context) error {
+				name = c.Args().Get(1)
+				rest := c.Args().Slice()[2:]
+				runArgs, mArgs = serviceRunArgs(c, name, rest), mountArgs(c, rest)
+				return nil
+			},
+		}},
+	}
+	if err := app.Run(reorderOptions(app, args)); err != nil {
+		t.Fatalf("run %v: %s", args, err)
+	}
+	return
+}
+
+func TestServiceArgs(t *testing.T) {
+	install := []string{"juicefs", "--verbose", "service", "install", "myjfs", "redis://localhost", "Z:",
+		"--cache-size", "10240", "--log-level", "debug", "--no-agent", "--subdir=/a b"}
+	name, runArgs, _ := runServiceCmd(t, install)
+	if name != "myjfs" {
+		t.Fatalf("name: %s", name)
+	}
+	// the command line of the service is parsed in the same way
+	_, _, mArgs := runServiceCmd(t, append([]string{"juicefs"}, runArgs...))
+	expected := []string{"redis://localhost", "Z:", "--cache-size", "10240", "--subdir=/a b", "--verbose", "--log-level=debug", "--no-agent"}
+	sort.Strings(expected[4:])
+	sort.Strings(mArgs[4:])
+	if !reflect.DeepEqual(mArgs, expected) {
+		t.Fatalf("expect mount args %v, got %v", expected, mArgs)
+	}
+}
+
+// TestServiceHelperProcess is run as the mount process by TestSuperviseMount.
+func TestServiceHelperProcess(t *testing.T) {
+	switch os.Getenv("JFS_SERVICE_HELPER") {
+	case "exit":
+		os.Exit(3)
+	case "sleep":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+func helperCmd(mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=TestServiceHelperProcess")
+	cmd.Env = append(os.Environ(), "JFS_SERVICE_HELPER="+mode)
+	return cmd
+}
+
+func TestSuperviseMount(t *testing.T) {
+	noUmount := func() error { return nil }
+	// the mount exits by itself
+	status := make(chan svc.Status, 10)
+	if restart, code := superviseMount(helperCmd("exit"), noUmount, nil, status, time.Second); !restart || code != 1 {
+		t.Fatalf("mount exited: %v %d", restart, code)
+	}
+	if st := <-status; st.State != svc.Running || st.Accepts&svc.AcceptStop == 0 {
+		t.Fatalf("status should be running: %+v", st)
+	}
+	// failed to start
+	if restart, code := superviseMount(exec.Command("not-exists-juicefs"), noUmount, nil, status, time.Second); !restart || code != 1 {
+		t.Fatalf("start failed: %v %d", restart, code)
+	}
+
+	// stopped by the service manager, and the mount exits after umounted
+	r := make(chan svc.ChangeRequest, 10)
+	cmd := helperCmd("sleep")
+	var umounted bool
+	umount := func() error {
+		umounted = true
+		return cmd.Process.Kill()
+	}
+	current := svc.Status{State: svc.Running}
+	r <- svc.ChangeRequest{Cmd: svc.Interrogate, CurrentStatus: current}
+	r <- svc.ChangeRequest{Cmd: svc.Stop}
+	start := time.Now()
+	if restart, code := superviseMount(cmd, umount, r, status, time.Minute); restart || code != 0 {
+		t.Fatalf("stopped: %v %d", restart, code)
+	}
+	if !umounted || time.Since(start) > time.Second*30 {
+		t.Fatalf("mount should be umounted: %v %s", umounted, time.Since(start))
+	}
+	for _, expected := range []svc.State{svc.Running, svc.Running, svc.StopPending} {
+		if st := <-status; st.State != expected {
+			t.Fatalf("expect state %d, got %+v", expected, st)
+		}
+	}
+
+	// killed if the umount does not work
+	r <- svc.ChangeRequest{Cmd: svc.Shutdown}
+	start = time.Now()
+	if restart, code := superviseMount(helperCmd("sleep"), noUmount, r, status, time.Millisecond*100); restart || code != 0 {
+		t.Fatalf("shutdown: %v %d", restart, code)
+	}
+	if time.Since(start) > time.Second*30 {
+		t.Fatalf("mount should be killed after timeout: %s", time.Since(start))
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdSnapshot() *cli.Command {
+	return &cli.Command{
+		Name:            "snapshot",
+		Category:        "TOOL",
+		Usage:           "Manage snapshots of the volume or a directory",
+		HideHelpCommand: true,
+		Description: `
+A snapshot of the volume is a point-in-time copy of the whole volume, which is cloned by metadata and shares
+the data with the origin files (copy-on-write), so it's cheap to create and can be used to recover from
+logical corruption. The writes of all the clients are paused until they agree on the point of snapshot (or the
+timeout is reached), so it contains the same changes as if all the clients crashed at the same moment. Then it's
+filled while the volume is writable, the entries are copied into it before they are changed. Snapshots are kept
+in the "/.snapshots" directory of the volume, they are immutable and can only be removed by "juicefs snapshot
+delete". A snapshot can be mounted read-only by "juicefs mount --snapshot NAME".
+
+It can also snapshot a directory in a mounted volume into another one ("juicefs snapshot dir"), the owners,
+modes and times are preserved, and the usage of the new tree is accounted in the dir stats and quotas of its
+ancestors, as well as the quotas of each user and group owning the entries. It's not point-in-time.
+
+Examples:
+$ juicefs snapshot create redis://localhost daily-20230801
+$ juicefs snapshot list redis://localhost
+$ juicefs mount redis://localhost /mnt/snap --snapshot daily-20230801
+$ juicefs snapshot delete redis://localhost daily-20230801
+$ juicefs snapshot dir /mnt/jfs/dataset /mnt/jfs/versions/dataset-v1`,
+		Subcommands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     "Create a snapshot of the volume",
+				ArgsUsage: "META-URL NAME",
+				Action:    snapshot,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "timeout",
+						Value: "120",
+						Usage: "give up if the clients do not pause the writes in time (in seconds), the writes are paused until then at most",
+					},
+				},
+			},
+			{
+				Name:      "list",
+				Aliases:   []string{"ls"},
+				Usage:     "List all snapshots of the volume",
+				ArgsUsage: "META-URL",
+				Action:    snapshot,
+			},
+			{
+				Name:      "delete",
+				Aliases:   []string{"del"},
+				Usage:     "Delete a snapshot of the volume permanently",
+				ArgsUsage: "META-URL NAME",
+				Action:    snapshot,
+			},
+			{
+				Name:      "dir",
+				Usage:     "Snapshot a directory into another path",
+				ArgsUsage: "SRC-DIR DST-DIR",
+				Action:    snapshotDir,
+			},
+		},
+	}
+}
+
+func snapshot(c *cli.Context) error {
+	if c.Command.Name == "list" {
+		setup(c, 1)
+	} else {
+		setup(c, 2)
+	}
+	removePassword(c.Args().Get(0))
+	m := meta.NewClient(c.Args().Get(0), nil)
+	if _, err := m.Load(true); err != nil {
+		return err
+	}
+	ctx := meta.Background
+	name := c.Args().Get(1)
+	switch c.Command.Name {
+	case "create":
+		progress := utils.NewProgress(false)
+		bar := progress.AddCountSpinner("Cloned entries")
+		var count uint64
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond * 300):
+					bar.SetCurrent(int64(atomic.LoadUint64(&count)))
+				}
+			}
+		}()
+		st := m.CreateSnapshot(ctx, name, duration(c.String("timeout")), &count)
+		close(done)
+		bar.SetCurrent(int64(count))
+		progress.Done()
+		if st != 0 {
+			return fmt.Errorf("create snapshot %s: %s", name, st)
+		}
+		logger.Infof("Snapshot %s is created with %d entries", name, count)
+	case "list":
+		entries, st := m.ListSnapshots(ctx)
+		if st != 0 {
+			return fmt.Errorf("list snapshots: %s", st)
+		}
+		for _, e := range entries {
+			fmt.Printf("%s\t%s\n", e.Name, time.Unix(e.Attr.Ctime, 0).Format("2006-01-02 15:04:05"))
+		}
+	case "delete":
+		var count uint64
+		if st := m.DeleteSnapshot(ctx, name, &count); st != 0 {
+			return fmt.Errorf("delete snapshot %s: %s", name, st)
+		}
+		logger.Infof("Snapshot %s is deleted with %d entries", name, count)
+	default:
+		logger.Fatalf("Invalid snapshot command: %s", c.Command.Name)
+	}
+	return nil
+}
+
+func snapshotDir(c *cli.Context) error {
+	setup(c, 2)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	src := c.Args().Get(0)
+	if fi, err := os.Stat(src); err != nil {
+		return fmt.Errorf("stat %s: %s", src, err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", src)
+	}
+	return doClone(src, c.Args().Get(1), meta.CLONE_MODE_PRESERVE_ATTR)
+}
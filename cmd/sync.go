@@ -70,6 +70,24 @@ $ juicefs sync --include='a1/b1' --exclude='a[1-9]/b*' s3://mybucket.s3.us-east-
 # SRC: a1/b1,a2/b2,aaa/b1,b1,b2  DST: empty   sync result: a1/b1,b2
 $ juicefs sync --include='a1/b1' --exclude='a*' --include='b2' --exclude='b?' s3://mybucket.s3.us-east-2.amazonaws.com/ /mnt/jfs/
 
+# Sync a point-in-time copy of the bucket listed by S3 Inventory
+$ juicefs sync --inventory=s3://inventory-bucket.s3.us-east-2.amazonaws.com/mybucket/all/2023-06-01T01-00Z/manifest.json s3://mybucket.s3.us-east-2.amazonaws.com/ /mnt/jfs/
+
+# Review what will be changed by a migration before running it
+$ juicefs sync --dry-report=plan.json --delete-dst s3://mybucket.s3.us-east-2.amazonaws.com/ /mnt/jfs/
+
+# Keep syncing the changed objects according to the notifications of the bucket in SQS
+$ juicefs sync --events=sqs://sqs.us-east-2.amazonaws.com/123456789012/mybucket-events s3://mybucket.s3.us-east-2.amazonaws.com/ /mnt/jfs/
+
+# Verify the CRC32C checksums of all the files after synced, and write the result into a report
+$ juicefs sync --checksum-algo=crc32c --verify-report=report.csv gs://mybucket/ s3://mybucket.s3.us-east-2.amazonaws.com/
+
+# Limit the bandwidth to 100 Mbps during business hours, and unlimited overnight
+$ juicefs sync --bwlimit="08:00-20:00=100M,20:00-08:00=0" s3://mybucket.s3.us-east-2.amazonaws.com/ /mnt/jfs/
+
+# Sync the files larger than 100MB and not modified in the last 90 days, except the logs
+$ juicefs sync --min-size=100M --modified-before=90d --exclude-regex='\.log$' s3://mybucket.s3.us-east-2.amazonaws.com/ /mnt/jfs/
+
 Details: https://juicefs.com/docs/community/administration/sync
 Supported storage systems: https://juicefs.com/docs/community/how_to_setup_object_storage#supported-object-storage`,
 
@@ -110,6 +128,38 @@ func selectionFlags() []cli.Flag {
 			Name:  "include",
 			Usage: "don't exclude Key matching PATTERN, need to be used with \"--exclude\" option",
 		},
+		&cli.StringSliceFlag{
+			Name:  "exclude-regex",
+			Usage: "exclude Key matching the regular expression `REGEX`",
+		},
+		&cli.StringSliceFlag{
+			Name:  "include-regex",
+			Usage: "don't exclude Key matching the regular expression `REGEX`, need to be used with \"--exclude\" or \"--exclude-regex\" option",
+		},
+		&cli.StringFlag{
+			Name:  "min-size",
+			Usage: "skip files smaller than `SIZE` (e.g. 100M, 1GiB)",
+		},
+		&cli.StringFlag{
+			Name:  "max-size",
+			Usage: "skip files larger than `SIZE` (e.g. 100M, 1GiB)",
+		},
+		&cli.StringFlag{
+			Name:  "modified-after",
+			Usage: "skip files modified before `TIME` (\"2006-01-02 15:04:05\", 2006-01-02, or an age like 90d or 12h)",
+		},
+		&cli.StringFlag{
+			Name:  "modified-before",
+			Usage: "skip files modified after `TIME` (\"2006-01-02 15:04:05\", 2006-01-02, or an age like 90d or 12h)",
+		},
+		&cli.StringFlag{
+			Name:  "inventory",
+			Usage: "list the source from the `MANIFEST` of S3 Inventory (CSV format) instead of LIST calls",
+		},
+		&cli.StringFlag{
+			Name:  "events",
+			Usage: "keep running and apply the changed keys from bucket notifications at `URI` (sqs://, kafka:// or http://)",
+		},
 		&cli.Int64Flag{
 			Name:  "limit",
 			Usage: "limit the number of objects that will be processed (-1 is unlimited, 0 is to process nothing)",
@@ -147,6 +197,10 @@ func syncActionFlags() []cli.Flag {
 			Name:  "perms",
 			Usage: "preserve permissions",
 		},
+		&cli.BoolFlag{
+			Name:  "xattrs",
+			Usage: "preserve extended attributes and POSIX ACLs (between local file system and JuiceFS)",
+		},
 		&cli.BoolFlag{
 			Name:    "links",
 			Aliases: []string{"l"},
@@ -170,10 +224,34 @@ func syncActionFlags() []cli.Flag {
 			Name:  "check-new",
 			Usage: "verify integrity of newly copied files",
 		},
+		&cli.StringFlag{
+			Name:  "checksum-algo",
+			Usage: "compare the checksums in `ALGO` (md5, crc32c or xxh64) instead of bytes when verifying integrity, the checksums of object storage are used if available",
+		},
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "verify the checksums of all the files after synced",
+		},
+		&cli.StringFlag{
+			Name:  "verify-report",
+			Usage: "write the result of verification of every file into `FILE` (CSV), implies --verify",
+		},
 		&cli.BoolFlag{
 			Name:  "dry",
 			Usage: "don't copy file",
 		},
+		&cli.BoolFlag{
+			Name:  "clone",
+			Usage: "clone files by metadata if SRC and DST are in the same JuiceFS volume",
+		},
+		&cli.StringFlag{
+			Name:  "dry-report",
+			Usage: "write the objects to add, update or delete into `FILE` (CSV if it ends with .csv, otherwise JSON), implies --dry",
+		},
+		&cli.StringFlag{
+			Name:  "checkpoint",
+			Usage: "save the progress into `FILE` periodically, and resume from it when it exists",
+		},
 	})
 }
 
@@ -203,9 +281,9 @@ func syncStorageFlags() []cli.Flag {
 			Name:  "storage-class",
 			Usage: "the storage class for destination",
 		},
-		&cli.IntFlag{
+		&cli.StringFlag{
 			Name:  "bwlimit",
-			Usage: "limit bandwidth in Mbps (0 means unlimited)",
+			Usage: "limit bandwidth in Mbps (0 means unlimited), or in time windows like \"08:00-20:00=100M,20:00-08:00=0\"",
 		},
 	})
 }
@@ -216,6 +294,10 @@ func clusterFlags() []cli.Flag {
 			Name:  "manager",
 			Usage: "manager address",
 		},
+		&cli.StringFlag{
+			Name:  "manager-addr",
+			Usage: "listen at `ADDRESS` (like 0.0.0.0:8233) as the manager, so workers can join at any time with --manager",
+		},
 		&cli.StringSliceFlag{
 			Name:  "worker",
 			Usage: "hosts (separated by comma) to launch worker",
@@ -325,12 +407,16 @@ func createSyncStorage(uri string, conf *sync.Config) (object.ObjectStorage, err
 		endpoint = "http://" + u.Host
 	}
 
-	isS3PathTypeUrl := isS3PathType(u.Host)
-	if name == "minio" || name == "s3" && isS3PathTypeUrl {
+	if name == "minio" || name == "s3" && isS3PathType(u.Host) {
 		// bucket name is part of path
 		endpoint += u.Path
 	}
 
+	if proxy := u.Query().Get("proxy"); proxy != "" {
+		if err = object.SetProxy(endpoint, proxy); err != nil {
+			return nil, err
+		}
+	}
 	store, err := object.CreateStorage(name, endpoint, accessKey, secretKey, token)
 	if err != nil {
 		return nil, fmt.Errorf("create %s %s: %s", name, endpoint, err)
@@ -341,25 +427,64 @@ func createSyncStorage(uri string, conf *sync.Config) (object.ObjectStorage, err
 			conf.Perms = false
 		}
 	}
+	if prefix := keyPrefix(name, u); prefix != "" {
+		store = object.WithPrefix(store, prefix)
+	}
+	return store, nil
+}
+
+// keyPrefix returns the prefix of keys in the bucket, which is the path of uri without bucket name.
+func keyPrefix(name string, u *url.URL) string {
 	switch name {
 	case "file":
 	case "minio":
 		if strings.Count(u.Path, "/") > 1 {
 			// skip bucket name
-			store = object.WithPrefix(store, strings.SplitN(u.Path[1:], "/", 2)[1])
+			return strings.SplitN(u.Path[1:], "/", 2)[1]
 		}
 	case "s3":
-		if isS3PathTypeUrl && strings.Count(u.Path, "/") > 1 {
-			store = object.WithPrefix(store, strings.SplitN(u.Path[1:], "/", 2)[1])
+		if isS3PathType(u.Host) && strings.Count(u.Path, "/") > 1 {
+			return strings.SplitN(u.Path[1:], "/", 2)[1]
 		} else if len(u.Path) > 1 {
-			store = object.WithPrefix(store, u.Path[1:])
+			return u.Path[1:]
 		}
 	default:
 		if len(u.Path) > 1 {
-			store = object.WithPrefix(store, u.Path[1:])
+			return u.Path[1:]
 		}
 	}
-	return store, nil
+	return ""
+}
+
+// createInventory opens the manifest of S3 Inventory (or the directory of it) for the source.
+func createInventory(uri, srcURL string, conf *sync.Config) (*sync.Inventory, error) {
+	uri, token := extractToken(uri)
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", uri, err)
+	}
+	key := keyPrefix(strings.ToLower(u.Scheme), u)
+	root := *u
+	root.Path = u.Path[:len(u.Path)-len(key)] // the bucket
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += "manifest.json"
+	}
+	rootURI := root.String()
+	if token != "" {
+		rootURI = strings.Replace(rootURI, "@", ":"+token+"@", 1)
+	}
+	c := *conf
+	c.Links, c.Perms = false, false
+	store, err := createSyncStorage(rootURI, &c)
+	if err != nil {
+		return nil, err
+	}
+	inv := &sync.Inventory{Store: store, Manifest: key}
+	srcURL, _ = extractToken(srcURL)
+	if su, err := url.Parse(srcURL); err == nil {
+		inv.Prefix = keyPrefix(strings.ToLower(su.Scheme), su)
+	}
+	return inv, nil
 }
 
 func isS3PathType(endpoint string) bool {
@@ -370,7 +495,7 @@ func isS3PathType(endpoint string) bool {
 
 func doSync(c *cli.Context) error {
 	setup(c, 2)
-	if c.IsSet("include") && !c.IsSet("exclude") {
+	if (c.IsSet("include") || c.IsSet("include-regex")) && !c.IsSet("exclude") && !c.IsSet("exclude-regex") {
 		logger.Warnf("The include option needs to be used with the exclude option, otherwise the result of the current sync may not match your expectations")
 	}
 	config := sync.NewConfigFromCli(c)
@@ -400,6 +525,17 @@ func doSync(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if c.IsSet("inventory") {
+		if config.Inventory, err = createInventory(c.String("inventory"), srcURL, config); err != nil {
+			return err
+		}
+	}
+	if config.Events != "" {
+		uri, _ := extractToken(srcURL)
+		if su, err := url.Parse(uri); err == nil {
+			config.EventPrefix = keyPrefix(strings.ToLower(su.Scheme), su)
+		}
+	}
 	if config.StorageClass != "" {
 		if os, ok := dst.(object.SupportStorageClass); ok {
 			os.SetStorageClass(config.StorageClass)
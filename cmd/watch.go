@@ -0,0 +1,144 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdWatch() *cli.Command {
+	return &cli.Command{
+		Name:      "watch",
+		Action:    watch,
+		Category:  "INSPECTOR",
+		Usage:     "Watch the changes of a directory",
+		ArgsUsage: "PATH",
+		Description: `
+It prints the create/delete/rename/attr events of the files and directories under PATH (recursively),
+which are made through the same mount point. The changes made by other clients are printed as "change"
+events (with the changed file, or directory for the changed entries of it), which are received from the
+clients mounted with --invalidate-cache. An "overflow" event means some events are dropped because they
+are not consumed in time, so the directory should be rescanned.
+
+Examples:
+$ juicefs watch /mnt/jfs/foo
+
+# Print the events in JSON
+$ juicefs watch --json /mnt/jfs/foo`,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the events in JSON (one per line)",
+			},
+		},
+	}
+}
+
+func watch(ctx *cli.Context) error {
+	setup(ctx, 1)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	path := ctx.Args().Get(0)
+	dpath, err := filepath.Abs(path)
+	if err != nil {
+		logger.Fatalf("abs of %s: %s", path, err)
+	}
+	inode, err := utils.GetFileInode(dpath)
+	if err != nil {
+		logger.Fatalf("lookup inode for %s: %s", path, err)
+	}
+	f, err := openController(dpath)
+	if err != nil {
+		logger.Fatalf("open controller: %s", err)
+	}
+	defer f.Close()
+	wb := utils.NewBuffer(8 + 8)
+	wb.Put32(meta.OpWatch)
+	wb.Put32(8)
+	wb.Put64(inode)
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		_ = f.Close() // stop the watcher in the mount point
+		os.Exit(0)
+	}()
+
+	asJson := ctx.Bool("json")
+	var pending []byte
+	var resp = make([]byte, 2<<16)
+	for {
+		n := readControl(f, resp)
+		pending = append(pending, resp[:n]...)
+		for len(pending) > 0 {
+			if pending[0] != meta.CDATA {
+				if len(pending) == 1 {
+					if errno := syscall.Errno(pending[0]); errno == syscall.EINVAL {
+						logger.Fatalf("watch is not supported, please upgrade and mount again")
+					} else if errno != 0 {
+						logger.Fatalf("watch %s: %s", path, errno)
+					}
+					return nil
+				}
+				logger.Fatalf("Bad response: %v", pending)
+			}
+			if len(pending) < 5 {
+				break
+			}
+			size := int(binary.BigEndian.Uint32(pending[1:5]))
+			if len(pending) < 5+size {
+				break
+			}
+			data := pending[5 : 5+size]
+			if asJson {
+				fmt.Println(string(data))
+			} else {
+				var e vfs.WatchEvent
+				if err = json.Unmarshal(data, &e); err != nil {
+					logger.Fatalf("unmarshal event %s: %s", data, err)
+				}
+				line := time.Unix(0, e.Time).Format("2006-01-02 15:04:05.000000") + " " + e.Type
+				if e.Path != "" {
+					line += " " + e.Path
+				}
+				if e.NewPath != "" {
+					line += " -> " + e.NewPath
+				}
+				fmt.Println(line)
+			}
+			pending = pending[5+size:]
+		}
+	}
+}
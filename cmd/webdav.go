@@ -45,10 +45,6 @@ func cmdWebDav() *cli.Command {
 			Name:  "disallowList",
 			Usage: "disallow list a directory",
 		},
-		&cli.StringFlag{
-			Name:  "access-log",
-			Usage: "path for JuiceFS access log",
-		},
 	}
 
 	return &cli.Command{
@@ -62,7 +58,7 @@ Examples:
 $ export WEBDAV_USER=root
 $ export WEBDAV_PASSWORD=1234
 $ juicefs webdav redis://localhost localhost:9007`,
-		Flags: expandFlags(selfFlags, clientFlags(0), shareInfoFlags()),
+		Flags: expandFlags(selfFlags, accessLogFlags(), clientFlags(0), shareInfoFlags()),
 	}
 }
 
@@ -0,0 +1,119 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const cipherCheckName = "cache.kcv"
+
+// cacheCipher encrypts the cached blocks with AES-256-CTR, so any range of them can be
+// read without decrypting the whole file and the size of them is not changed. The IV is
+// derived from the key of a block, which is safe as blocks are never changed once written.
+type cacheCipher struct {
+	block cipher.Block
+	check string // to find out the cache encrypted by another key
+}
+
+func newCacheCipher(key []byte) (*cacheCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid length of cache key: %d, should be 32 bytes", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("juicefs cache key check"))
+	return &cacheCipher{block, hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// xorAt encrypts or decrypts buf in place, which is at off of the file of block key.
+func (c *cacheCipher) xorAt(key string, buf []byte, off int64) {
+	if c == nil || len(buf) == 0 {
+		return
+	}
+	sum := sha256.Sum256([]byte(key))
+	iv := sum[:aes.BlockSize]
+	// add the number of skipped blocks to the counter
+	for i, n := aes.BlockSize-1, uint64(off/aes.BlockSize); i >= 0 && n > 0; i-- {
+		n += uint64(iv[i])
+		iv[i] = byte(n)
+		n >>= 8
+	}
+	stream := cipher.NewCTR(c.block, iv)
+	if skip := off % aes.BlockSize; skip > 0 {
+		var pad [aes.BlockSize]byte
+		stream.XORKeyStream(pad[:skip], pad[:skip])
+	}
+	stream.XORKeyStream(buf, buf)
+}
+
+var errFound = errors.New("found")
+
+func hasFiles(dir string) bool {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && !strings.HasSuffix(path, ".tmp") {
+			return errFound
+		}
+		return nil
+	})
+	return err == errFound
+}
+
+// checkCipher makes sure that all the existing blocks in the cache dir are encrypted
+// by the current key (or not encrypted), or the read cache is dropped. Staging blocks
+// can't be dropped, so they should be uploaded before changing the encryption.
+func (cache *cacheStore) checkCipher() {
+	path := filepath.Join(cache.dir, cipherCheckName)
+	var expect string
+	if cache.cipher != nil {
+		expect = cache.cipher.check
+	}
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Fatalf("Read %s: %s", path, err)
+	}
+	if string(old) == expect {
+		return
+	}
+	if hasFiles(filepath.Join(cache.dir, stagingDir)) {
+		logger.Fatalf("Encryption of cache dir %s is changed, but there are staging blocks in it, please upload them before changing it", cache.dir)
+	}
+	logger.Warnf("Encryption of cache dir %s is changed, drop the cached blocks in it", cache.dir)
+	_ = os.RemoveAll(filepath.Join(cache.dir, cacheDir))
+	_ = os.RemoveAll(filepath.Join(cache.dir, rangeDir))
+	if expect == "" {
+		err = os.Remove(path)
+	} else {
+		err = os.WriteFile(path, []byte(expect), cache.mode)
+	}
+	if err != nil {
+		logger.Fatalf("Update %s: %s", path, err)
+	}
+}
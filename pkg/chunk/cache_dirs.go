@@ -0,0 +1,204 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// resize changes the capacity of cache dir, and evicts blocks if it's shrunk.
+func (cache *cacheStore) resize(capacity int64) {
+	cache.Lock()
+	defer cache.Unlock()
+	if capacity != cache.capacity {
+		logger.Infof("Disk cache (%s): capacity %d MB -> %d MB", cache.dir, cache.capacity>>20, capacity>>20)
+	}
+	cache.capacity = capacity
+	if cache.used > cache.capacity && cache.eviction != "none" {
+		cache.cleanup()
+	}
+}
+
+// blocks returns the keys of cached and staging blocks.
+func (cache *cacheStore) blocks() (cached []string, staging []string) {
+	cache.Lock()
+	defer cache.Unlock()
+	for k, it := range cache.keys {
+		if it.size > 0 {
+			cached = append(cached, cache.getPathFromKey(k))
+		} else if it.size < 0 {
+			staging = append(staging, cache.getPathFromKey(k))
+		}
+	}
+	return
+}
+
+// drained tells whether all the blocks are moved or uploaded.
+func (cache *cacheStore) drained() bool {
+	cache.Lock()
+	defer cache.Unlock()
+	return (cache.scanned || cache.scanInterval < 0) && len(cache.keys) == 0 && len(cache.pages) == 0
+}
+
+func (cache *cacheStore) close() {
+	close(cache.closed)
+}
+
+// update changes the cache dirs and the total size of cache (in MiB) at runtime. The blocks in the
+// dirs not listed any more are moved to others (or uploaded if they are staging), then the dirs are
+// closed, and the cached blocks are rebalanced to the dirs they belong to in background.
+func (m *cacheManager) update(cacheDir string, cacheSize int64) error {
+	dirs := cacheDirs(m.config, cacheDir)
+	if len(dirs) == 0 {
+		return fmt.Errorf("no cache dir existed in %s", cacheDir)
+	}
+	if cacheSize <= 0 {
+		return errors.New("cache size should be positive")
+	}
+	dirCacheSize := (cacheSize << 20) / int64(len(dirs))
+	m.Lock()
+	current := make(map[string]*cacheStore)
+	for _, s := range m.stores {
+		current[s.dir] = s
+	}
+	var stores, draining []*cacheStore
+	for _, d := range dirs {
+		if s, ok := current[d]; ok {
+			stores = append(stores, s)
+			delete(current, d)
+			continue
+		}
+		var s *cacheStore
+		for _, ds := range m.draining {
+			if ds.dir == d {
+				s = ds // still running, use it again
+			}
+		}
+		if s == nil {
+			s = newCacheStore(m.metrics, d, dirCacheSize, m.pendingPages(len(dirs)), m.config, m.uploader)
+		} else {
+			logger.Infof("Stop draining cache dir %s", d)
+		}
+		stores = append(stores, s)
+	}
+	for _, s := range m.draining {
+		if _, ok := current[s.dir]; !ok && !contains(stores, s) {
+			draining = append(draining, s)
+		}
+	}
+	for _, s := range current {
+		logger.Infof("Drain cache dir %s", s.dir)
+		draining = append(draining, s)
+	}
+	changed := len(stores) != len(m.stores)
+	for i := 0; !changed && i < len(stores); i++ {
+		changed = stores[i] != m.stores[i]
+	}
+	m.stores, m.draining = stores, draining
+	m.changed = m.changed || changed
+	m.config.CacheDir, m.config.CacheSize = cacheDir, cacheSize
+	for _, s := range stores {
+		s.resize(dirCacheSize)
+	}
+	m.Unlock()
+	if changed {
+		go m.rebalance()
+	}
+	return nil
+}
+
+func contains(stores []*cacheStore, s *cacheStore) bool {
+	for _, o := range stores {
+		if o == s {
+			return true
+		}
+	}
+	return false
+}
+
+// move copies a cached block into the store it belongs to, and removes it from the old one.
+func (m *cacheManager) move(key string, from *cacheStore) bool {
+	defer from.remove(key)
+	r, err := from.load(key)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	p := NewOffPage(parseObjOrigSize(key))
+	defer p.Release()
+	if n, _ := r.ReadAt(p.Data, 0); n != len(p.Data) {
+		return false
+	}
+	m.getStore(key).cache(key, p, true)
+	return true
+}
+
+// rebalance moves the cached blocks to the stores they belong to, and closes the draining stores
+// after all the blocks in them are moved or uploaded.
+func (m *cacheManager) rebalance() {
+	m.balancer.Lock()
+	defer m.balancer.Unlock()
+	var moved, dropped int
+	for _, s := range m.all() {
+		cached, _ := s.blocks()
+		for _, key := range cached {
+			if m.getStore(key) == s {
+				continue
+			}
+			if m.move(key, s) {
+				moved++
+			} else {
+				dropped++
+			}
+		}
+	}
+	logger.Infof("Rebalanced cache blocks: %d moved, %d dropped", moved, dropped)
+
+	for {
+		m.RLock()
+		draining := append([]*cacheStore(nil), m.draining...)
+		m.RUnlock()
+		if len(draining) == 0 {
+			return
+		}
+		for _, s := range draining {
+			cached, staging := s.blocks()
+			for _, key := range cached {
+				m.move(key, s)
+			}
+			for _, key := range staging {
+				if s.uploader != nil {
+					s.uploader(key, s.stagePath(key), true)
+				}
+			}
+		}
+		time.Sleep(time.Second)
+		m.Lock()
+		var left []*cacheStore
+		for _, s := range m.draining {
+			if s.drained() {
+				logger.Infof("Cache dir %s is drained", s.dir)
+				s.close()
+			} else {
+				left = append(left, s)
+			}
+		}
+		m.draining = left
+		m.Unlock()
+	}
+}
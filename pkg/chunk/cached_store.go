@@ -127,6 +127,8 @@ func (s *rSlice) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 	}
 
 	key := s.key(indx)
+	policy := cachePolicyOf(ctx)
+	class := ioClassOf(ctx)
 	if s.store.conf.CacheSize > 0 {
 		start := time.Now()
 		r, err := s.store.bcache.load(key)
@@ -134,6 +136,9 @@ func (s *rSlice) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 			n, err = r.ReadAt(p, int64(boff))
 			_ = r.Close()
 			if err == nil {
+				if policy == CachePin {
+					s.store.bcache.pin(key)
+				}
 				s.store.cacheHits.Add(1)
 				s.store.cacheHitBytes.Add(float64(n))
 				s.store.cacheReadHist.Observe(time.Since(start).Seconds())
@@ -144,16 +149,26 @@ func (s *rSlice) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 				_ = os.Remove(f.Name())
 			}
 		}
+		if rc, ok := s.store.bcache.(rangeCache); ok && s.store.conf.CacheRanges {
+			if n, err = rc.loadRange(key, p, boff); err == nil {
+				s.store.cacheHits.Add(1)
+				s.store.cacheHitBytes.Add(float64(n))
+				s.store.cacheReadHist.Observe(time.Since(start).Seconds())
+				return n, nil
+			}
+		}
 	}
 
 	s.store.cacheMiss.Add(1)
 	s.store.cacheMissBytes.Add(float64(len(p)))
 
-	if s.store.seekable && boff > 0 && len(p) <= blockSize/4 {
+	// blocks encrypted by data key can only be read as a whole
+	if s.store.seekable && (boff > 0 || s.store.conf.CacheRanges) && len(p) <= blockSize/4 && dataKeyOf(ctx) == "" {
 		if s.store.downLimit != nil {
 			s.store.downLimit.Wait(int64(len(p)))
 		}
 		// partial read
+		s.store.downloads.acquire(class)
 		st := time.Now()
 		in, err := s.store.storage.Get(key, int64(boff), int64(len(p)))
 		if err == nil {
@@ -161,15 +176,24 @@ func (s *rSlice) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 			_ = in.Close()
 		}
 		used := time.Since(st)
+		s.store.downloads.release()
 		logger.Debugf("GET %s RANGE(%d,%d) (%s, %.3fs)", key, boff, len(p), err, used.Seconds())
 		if used > SlowRequest {
 			logger.Infof("slow request: GET %s (%v, %.3fs)", key, err, used.Seconds())
 		}
 		s.store.objectDataBytes.WithLabelValues("GET").Add(float64(n))
 		s.store.objectReqsHistogram.WithLabelValues("GET").Observe(used.Seconds())
-		s.store.fetcher.fetch(key)
+		if s.store.conf.CacheRanges && policy.cacheable() {
+			if err == nil {
+				s.store.cacheRange(key, boff, p[:n])
+			}
+		} else if prefetchEnabled(ctx) && policy.cacheable() {
+			s.store.fetcher.fetch(key)
+		}
 		if err == nil {
 			return n, nil
+		} else if errors.Is(err, object.ErrRestoring) {
+			return 0, err
 		} else {
 			s.store.objectReqErrors.Add(1)
 		}
@@ -185,7 +209,14 @@ func (s *rSlice) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 		tmp.Acquire()
 		err := utils.WithTimeout(func() error {
 			defer tmp.Release()
-			return s.store.load(key, tmp, s.store.shouldCache(blockSize), false)
+			cache := s.store.shouldCache(blockSize) && policy.cacheable()
+			if err := s.store.load(key, tmp, cache, false, class); err != nil || !cache {
+				return err
+			}
+			if policy == CachePin {
+				s.store.bcache.pin(key)
+			}
+			return nil
 		}, s.store.conf.GetTimeout)
 		return tmp, err
 	})
@@ -278,6 +309,9 @@ type wSlice struct {
 	errors      chan error
 	uploadError error
 	pendings    int
+	policy      CachePolicy
+	class       IOClass
+	dataKey     string
 }
 
 func sliceForWrite(id uint64, store *cachedStore) *wSlice {
@@ -345,7 +379,12 @@ func (store *cachedStore) put(key string, p *Page) error {
 	return utils.WithTimeout(func() error {
 		defer p.Release()
 		st := time.Now()
-		err := store.storage.Put(key, bytes.NewReader(p.Data))
+		var err error
+		if store.conf.ObjectTags != nil {
+			err = object.PutWithTags(store.storage, key, bytes.NewReader(p.Data), store.tags(key))
+		} else {
+			err = store.storage.Put(key, bytes.NewReader(p.Data))
+		}
 		used := time.Since(st)
 		logger.Debugf("PUT %s (%s, %.3fs)", key, err, used.Seconds())
 		if used > SlowRequest {
@@ -360,6 +399,20 @@ func (store *cachedStore) put(key string, p *Page) error {
 	}, store.conf.PutTimeout)
 }
 
+// tags returns the tags of volume, chunk id and creation time, which are uploaded with the block.
+func (store *cachedStore) tags(key string) map[string]string {
+	tags := make(map[string]string, len(store.conf.ObjectTags)+2)
+	for k, v := range store.conf.ObjectTags {
+		tags[k] = v
+	}
+	name := key[strings.LastIndexByte(key, '/')+1:]
+	if i := strings.IndexByte(name, '_'); i > 0 {
+		tags["juicefs-chunk"] = name[:i]
+	}
+	tags["juicefs-created"] = time.Now().UTC().Format(time.RFC3339)
+	return tags
+}
+
 func (store *cachedStore) upload(key string, block *Page, s *wSlice) error {
 	sync := s != nil
 	blen := len(block.Data)
@@ -372,9 +425,12 @@ func (store *cachedStore) upload(key string, block *Page, s *wSlice) error {
 		buf.Acquire()
 	}
 	defer buf.Release()
-	if sync && blen < store.conf.BlockSize {
+	if sync && blen < store.conf.BlockSize && s.policy.cacheable() {
 		// block will be freed after written into disk
 		store.bcache.cache(key, block, false)
+		if s.policy == CachePin {
+			store.bcache.pin(key)
+		}
 	}
 	n, err := store.compressor.Compress(buf.Data, block.Data)
 	block.Release()
@@ -382,6 +438,13 @@ func (store *cachedStore) upload(key string, block *Page, s *wSlice) error {
 		return fmt.Errorf("Compress block key %s: %s", key, err)
 	}
 	buf.Data = buf.Data[:n]
+	if s != nil && s.dataKey != "" {
+		sealed, err := store.keys.seal(s.dataKey, key, buf.Data)
+		if err != nil {
+			return fmt.Errorf("encrypt block %s: %s", key, err)
+		}
+		buf = NewPage(sealed) // the original one is released by defer
+	}
 
 	try, max := 0, 3
 	if sync {
@@ -397,6 +460,9 @@ func (store *cachedStore) upload(key string, block *Page, s *wSlice) error {
 			break
 		}
 		logger.Warnf("Upload %s: %s (try %d)", key, err, try+1)
+		if object.IsRetried(err) {
+			return fmt.Errorf("upload block %s: %s (retried by object storage)", key, err)
+		}
 	}
 	if err != nil && try >= max {
 		err = fmt.Errorf("(max tries) upload block %s: %s (after %d tries)", key, err, try)
@@ -427,16 +493,19 @@ func (s *wSlice) upload(indx int) {
 		if off != blen {
 			panic(fmt.Sprintf("block length does not match: %v != %v", off, blen))
 		}
-		if s.store.conf.Writeback {
-			stagingPath, err := s.store.bcache.stage(key, block.Data, s.store.shouldCache(blen))
+		// staging blocks are uploaded without the slice, so the encrypted ones are uploaded directly
+		if s.store.conf.Writeback && s.dataKey == "" {
+			stagingPath, err := s.store.bcache.stage(key, block.Data, s.store.shouldCache(blen) && s.policy.cacheable())
+			if s.policy == CachePin {
+				s.store.bcache.pin(key)
+			}
 			if err != nil {
 				logger.Warnf("write %s to disk: %s, upload it directly", stagingPath, err)
 			} else {
 				s.errors <- nil
 				if s.store.conf.UploadDelay == 0 {
-					select {
-					case s.store.currentUpload <- true:
-						defer func() { <-s.store.currentUpload }()
+					if s.store.uploads.tryAcquire() {
+						defer s.store.uploads.release()
 						if err = s.store.upload(key, block, nil); err == nil {
 							s.store.bcache.uploaded(key, blen)
 							if err := s.store.bcache.removeStage(key); err != nil {
@@ -446,7 +515,6 @@ func (s *wSlice) upload(indx int) {
 							s.store.addDelayedStaging(key, stagingPath, time.Now(), false)
 						}
 						return
-					default:
 					}
 				}
 				block.Release()
@@ -454,12 +522,27 @@ func (s *wSlice) upload(indx int) {
 				return
 			}
 		}
-		s.store.currentUpload <- true
-		defer func() { <-s.store.currentUpload }()
+		s.store.uploads.acquire(s.class)
+		defer s.store.uploads.release()
 		s.errors <- s.store.upload(key, block, s)
 	}()
 }
 
+// SetCachePolicy sets the policy to cache the blocks written.
+func (s *wSlice) SetCachePolicy(policy CachePolicy) {
+	s.policy = policy
+}
+
+// SetIOClass sets the priority class to upload the blocks.
+func (s *wSlice) SetIOClass(class IOClass) {
+	s.class = class
+}
+
+// SetDataKey sets the id of data key to encrypt the blocks, empty means no encryption.
+func (s *wSlice) SetDataKey(id string) {
+	s.dataKey = id
+}
+
 func (s *wSlice) ID() uint64 {
 	return s.id
 }
@@ -524,13 +607,22 @@ type Config struct {
 	CacheChecksum     string
 	CacheEviction     string
 	CacheScanInterval time.Duration
+	MemCacheSize      int64  // MiB, size of the memory tier in front of CacheDir
+	ColdCacheDir      string // dirs of the cold tier (e.g. HDD) behind CacheDir
+	ColdCacheSize     int64  // MiB
+	CachePromoteHits  int    // promote a block into the hotter tier after it is hit so many times
 	FreeSpace         float32
 	AutoCreate        bool
 	Compress          string
+	CompressLevel     int    // level of zstd, 0 means the default one
+	CompressDict      string // key of the zstd dictionary in object storage
 	MaxUpload         int
+	MaxDownload       int // 0 means unlimited
 	MaxRetries        int
-	UploadLimit       int64 // bytes per second
-	DownloadLimit     int64 // bytes per second
+	UploadLimit       int64  // bytes per second
+	DownloadLimit     int64  // bytes per second
+	UploadSchedule    string // daily windows overriding UploadLimit, e.g. "09:00-18:00=50" (Mbps)
+	DownloadSchedule  string // daily windows overriding DownloadLimit
 	Writeback         bool
 	UploadDelay       time.Duration
 	HashPrefix        bool
@@ -538,9 +630,14 @@ type Config struct {
 	GetTimeout        time.Duration
 	PutTimeout        time.Duration
 	CacheFullBlock    bool
+	CacheRanges       bool   // cache only the ranges read by small random reads instead of whole blocks
+	CacheIOUring      bool   // read and write the cache files through io_uring (Linux only)
+	CacheKey          []byte // key to encrypt the cached and staging blocks, nil to disable
+	DataKeyDir        string // dir of the data keys bound to directories, empty to disable
 	BufferSize        int
 	Readahead         int
 	Prefetch          int
+	ObjectTags        map[string]string // tags attached to uploaded blocks, nil to disable
 }
 
 func (c *Config) SelfCheck(uuid string) {
@@ -570,11 +667,22 @@ func (c *Config) SelfCheck(uuid string) {
 			ds[i] = filepath.Join(ds[i], uuid)
 		}
 		c.CacheDir = strings.Join(ds, string(os.PathListSeparator))
+		if c.ColdCacheDir != "" {
+			ds = utils.SplitDir(c.ColdCacheDir)
+			for i := range ds {
+				ds[i] = filepath.Join(ds[i], uuid)
+			}
+			c.ColdCacheDir = strings.Join(ds, string(os.PathListSeparator))
+		}
 		if cs := []string{CsNone, CsFull, CsShrink, CsExtend}; !utils.StringContains(cs, c.CacheChecksum) {
 			logger.Warnf("verify-cache-checksum should be one of %v", cs)
 			c.CacheChecksum = CsFull
 		}
 	}
+	if c.CacheRanges && (c.CacheDir == "memory" || c.Compress != "" && strings.ToLower(c.Compress) != "none") {
+		logger.Warnf("cache-ranges only works with disk cache and without compression, disable it")
+		c.CacheRanges = false
+	}
 	if c.CacheEviction == "" {
 		c.CacheEviction = "2-random"
 	} else if c.CacheEviction != "2-random" && c.CacheEviction != "none" {
@@ -584,19 +692,27 @@ func (c *Config) SelfCheck(uuid string) {
 }
 
 type cachedStore struct {
-	storage       object.ObjectStorage
-	bcache        CacheManager
-	fetcher       *prefetcher
-	conf          Config
-	group         *Controller
-	currentUpload chan bool
-	pendingCh     chan *pendingItem
-	pendingKeys   map[string]*pendingItem
-	pendingMutex  sync.Mutex
-	compressor    compress.Compressor
-	seekable      bool
-	upLimit       *ratelimit.Bucket
-	downLimit     *ratelimit.Bucket
+	storage      object.ObjectStorage
+	bcache       CacheManager
+	fetcher      *prefetcher
+	conf         Config
+	group        *Controller
+	uploads      *ioScheduler
+	downloads    *ioScheduler
+	pendingCh    chan *pendingItem
+	pendingKeys  map[string]*pendingItem
+	pendingMutex sync.Mutex
+	compressor   compress.Compressor
+	seekable     bool
+	keys         *keyring
+	cipher       *cacheCipher // to read encrypted staging blocks
+	upLimit      *ratelimit.Bucket
+	downLimit    *ratelimit.Bucket
+	limitMu      sync.Mutex
+	baseUpload   int64 // limits out of any scheduled window
+	baseDownload int64
+	upSchedule   LimitSchedule
+	downSchedule LimitSchedule
 
 	cacheHits           prometheus.Counter
 	cacheMiss           prometheus.Counter
@@ -609,17 +725,23 @@ type cachedStore struct {
 	stageBlockDelay     prometheus.Counter
 }
 
-func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bool) (err error) {
+func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bool, class IOClass) (err error) {
 	defer func() {
 		e := recover()
 		if e != nil {
 			err = fmt.Errorf("recovered from %s", e)
 		}
 	}()
+	store.downloads.acquire(class)
+	defer store.downloads.release()
 	needed := store.compressor.CompressBound(len(page.Data))
 	compressed := needed > len(page.Data)
-	// we don't know the actual size for compressed block
-	if store.downLimit != nil && !compressed {
+	if store.keys != nil {
+		needed += dataKeyOverhead
+	}
+	buffered := needed > len(page.Data)
+	// we don't know the actual size for compressed or encrypted block
+	if store.downLimit != nil && !buffered {
 		store.downLimit.Wait(int64(len(page.Data)))
 	}
 	err = errors.New("Not downloaded")
@@ -636,11 +758,18 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 		}
 		in, err = store.storage.Get(key, 0, -1)
 		tried++
+		if errors.Is(err, object.ErrRestoring) {
+			// archived block, no need to retry until it's restored
+			break
+		}
+		if object.IsRetried(err) {
+			break
+		}
 	}
 	var n int
 	var buf []byte
 	if err == nil {
-		if compressed {
+		if buffered {
 			c := NewOffPage(needed)
 			defer c.Release()
 			buf = c.Data
@@ -650,7 +779,7 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 		n, err = io.ReadFull(in, buf)
 		_ = in.Close()
 	}
-	if compressed && err == io.ErrUnexpectedEOF {
+	if buffered && err == io.ErrUnexpectedEOF {
 		err = nil
 	}
 	used := time.Since(start)
@@ -658,7 +787,7 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 	if used > SlowRequest {
 		logger.Infof("slow request: GET %s (%v, %.3fs)", key, err, used.Seconds())
 	}
-	if store.downLimit != nil && compressed {
+	if store.downLimit != nil && buffered {
 		store.downLimit.Wait(int64(n))
 	}
 	store.objectDataBytes.WithLabelValues("GET").Add(float64(n))
@@ -667,8 +796,19 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 		store.objectReqErrors.Add(1)
 		return fmt.Errorf("get %s: %s", key, err)
 	}
+	data := buf[:n]
+	if isSealed(data) {
+		if store.keys == nil {
+			return fmt.Errorf("get %s: %w", key, ErrNoDataKey)
+		}
+		if data, err = store.keys.open(key, data); err != nil {
+			return err
+		}
+	}
 	if compressed {
-		n, err = store.compressor.Decompress(page.Data, buf[:n])
+		n, err = store.compressor.Decompress(page.Data, data)
+	} else if buffered {
+		n = copy(page.Data, data)
 	}
 	if err != nil || n < len(page.Data) {
 		return fmt.Errorf("read %s fully: %s (%d < %d) after %s (tried %d)", key, err, n, len(page.Data),
@@ -686,6 +826,18 @@ func NewCachedStore(storage object.ObjectStorage, config Config, reg prometheus.
 	if compressor == nil {
 		logger.Fatalf("unknown compress algorithm: %s", config.Compress)
 	}
+	if strings.ToLower(config.Compress) == "zstd" && (config.CompressLevel != 0 || config.CompressDict != "") {
+		var dict []byte
+		var err error
+		if config.CompressDict != "" {
+			if dict, err = loadCompressDict(storage, config.CompressDict); err != nil {
+				logger.Fatalf("load zstd dictionary %s: %s", config.CompressDict, err)
+			}
+		}
+		if compressor, err = compress.NewZStandard(config.CompressLevel, dict); err != nil {
+			logger.Fatalf("create zstd compressor: %s", err)
+		}
+	}
 	if config.MaxRetries == 0 {
 		config.MaxRetries = 10
 	}
@@ -696,21 +848,36 @@ func NewCachedStore(storage object.ObjectStorage, config Config, reg prometheus.
 		config.PutTimeout = time.Second * 60
 	}
 	store := &cachedStore{
-		storage:       storage,
-		conf:          config,
-		currentUpload: make(chan bool, config.MaxUpload),
-		compressor:    compressor,
-		seekable:      compressor.CompressBound(0) == 0,
-		pendingCh:     make(chan *pendingItem, 100*config.MaxUpload),
-		pendingKeys:   make(map[string]*pendingItem),
-		group:         &Controller{},
-	}
-	if config.UploadLimit > 0 {
-		// there are overheads coming from HTTP/TCP/IP
-		store.upLimit = ratelimit.NewBucketWithRate(float64(config.UploadLimit)*0.85, config.UploadLimit)
-	}
-	if config.DownloadLimit > 0 {
-		store.downLimit = ratelimit.NewBucketWithRate(float64(config.DownloadLimit)*0.85, config.DownloadLimit)
+		storage:     storage,
+		conf:        config,
+		uploads:     newIOScheduler(config.MaxUpload),
+		downloads:   newIOScheduler(config.MaxDownload),
+		compressor:  compressor,
+		seekable:    compressor.CompressBound(0) == 0,
+		keys:        newKeyring(config.DataKeyDir),
+		pendingCh:   make(chan *pendingItem, 100*config.MaxUpload),
+		pendingKeys: make(map[string]*pendingItem),
+		group:       &Controller{},
+	}
+	if len(config.CacheKey) > 0 {
+		var err error
+		if store.cipher, err = newCacheCipher(config.CacheKey); err != nil {
+			logger.Fatalf("create cache cipher: %s", err)
+		}
+	}
+	store.upLimit = newLimitBucket(config.UploadLimit)
+	store.downLimit = newLimitBucket(config.DownloadLimit)
+	store.baseUpload, store.baseDownload = config.UploadLimit, config.DownloadLimit
+	var err error
+	if store.upSchedule, err = ParseLimitSchedule(config.UploadSchedule); err != nil {
+		logger.Fatalf("upload limit schedule %q: %s", config.UploadSchedule, err)
+	}
+	if store.downSchedule, err = ParseLimitSchedule(config.DownloadSchedule); err != nil {
+		logger.Fatalf("download limit schedule %q: %s", config.DownloadSchedule, err)
+	}
+	if len(store.upSchedule) > 0 || len(store.downSchedule) > 0 {
+		store.applyLimits(time.Now())
+		go store.scheduleLimits()
 	}
 	store.initMetrics()
 	store.bcache = newCacheManager(&config, reg, func(key, fpath string, force bool) bool {
@@ -731,7 +898,7 @@ func NewCachedStore(storage object.ObjectStorage, config Config, reg prometheus.
 		}
 		p := NewOffPage(size)
 		defer p.Release()
-		_ = store.load(key, p, true, true)
+		_ = store.load(key, p, true, true, ClassPrefetch)
 	})
 
 	if store.conf.CacheDir != "memory" && store.conf.Writeback {
@@ -830,10 +997,29 @@ func (store *cachedStore) regMetrics(reg prometheus.Registerer) {
 		}))
 }
 
+// cacheRange caches a range of the block read from object storage.
+func (store *cachedStore) cacheRange(key string, off int, data []byte) {
+	if rc, ok := store.bcache.(rangeCache); ok {
+		p := NewOffPage(len(data))
+		copy(p.Data, data)
+		rc.cacheRange(key, off, p)
+		p.Release()
+	}
+}
+
 func (store *cachedStore) shouldCache(size int) bool {
 	return store.conf.CacheFullBlock || size < store.conf.BlockSize || store.conf.UploadDelay > 0
 }
 
+func loadCompressDict(storage object.ObjectStorage, key string) ([]byte, error) {
+	r, err := storage.Get(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
 func parseObjOrigSize(key string) int {
 	p := strings.LastIndexByte(key, '_')
 	l, _ := strconv.Atoi(key[p+1:])
@@ -841,10 +1027,8 @@ func parseObjOrigSize(key string) int {
 }
 
 func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
-	store.currentUpload <- true
-	defer func() {
-		<-store.currentUpload
-	}()
+	store.uploads.acquire(ClassWriteback)
+	defer store.uploads.release()
 
 	store.pendingMutex.Lock()
 	item, ok := store.pendingKeys[key]
@@ -854,7 +1038,7 @@ func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
 		return
 	}
 	blen := parseObjOrigSize(key)
-	f, err := openCacheFile(stagingPath, blen, store.conf.CacheChecksum)
+	f, err := openCacheFile(stagingPath, blen, store.conf.CacheChecksum, store.cipher, key)
 	if err != nil {
 		store.pendingMutex.Lock()
 		_, ok = store.pendingKeys[key]
@@ -966,7 +1150,7 @@ func (store *cachedStore) FillCache(id uint64, length uint32) error {
 		}
 		p := NewOffPage(size)
 		defer p.Release()
-		if e := store.load(k, p, true, true); e != nil {
+		if e := store.load(k, p, true, true, ClassPrefetch); e != nil {
 			logger.Warnf("Failed to load key: %s %s", k, e)
 			err = e
 		}
@@ -978,25 +1162,35 @@ func (store *cachedStore) UsedMemory() int64 {
 	return store.bcache.usedMemory()
 }
 
-func (store *cachedStore) UpdateLimit(upload, download int64) {
-	if upload = upload * 1e6 / 8; upload != store.conf.UploadLimit {
-		logger.Infof("Upload limit changed from %d to %d", store.conf.UploadLimit, upload)
-		store.conf.UploadLimit = upload
-		if upload > 0 {
-			store.upLimit = ratelimit.NewBucketWithRate(float64(upload)*0.85, upload)
-		} else {
-			store.upLimit = nil
-		}
+// HasDataKey checks whether the data key is loaded, so the blocks encrypted by it can be read and written.
+func (store *cachedStore) HasDataKey(id string) bool {
+	return store.keys.get(id) != nil
+}
+
+// UpdateCache changes the cache dirs and the total size of cache (in MiB) without remounting,
+// the current one is kept if dirs is empty or size is zero.
+func (store *cachedStore) UpdateCache(dirs string, size int64) error {
+	if dirs == "" {
+		dirs = store.conf.CacheDir
 	}
-	if download = download * 1e6 / 8; download != store.conf.DownloadLimit {
-		logger.Infof("Download limit changed from %d to %d", store.conf.DownloadLimit, download)
-		store.conf.DownloadLimit = download
-		if download > 0 {
-			store.downLimit = ratelimit.NewBucketWithRate(float64(download)*0.85, download)
-		} else {
-			store.downLimit = nil
-		}
+	if size == 0 {
+		size = store.conf.CacheSize
+	}
+	if err := store.bcache.update(dirs, size); err != nil {
+		return err
 	}
+	logger.Infof("Cache is updated: dirs %s, size %d MiB", dirs, size)
+	store.conf.CacheDir, store.conf.CacheSize = dirs, size
+	return nil
+}
+
+// UpdateLimit changes the base bandwidth limits (in Mbps), which are
+// still overridden by the scheduled ones within their windows.
+func (store *cachedStore) UpdateLimit(upload, download int64) {
+	store.limitMu.Lock()
+	store.baseUpload, store.baseDownload = upload*1e6/8, download*1e6/8
+	store.limitMu.Unlock()
+	store.applyLimits(time.Now())
 }
 
 var _ ChunkStore = &cachedStore{}
@@ -23,6 +23,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -149,6 +150,410 @@ func TestStoreLimited(t *testing.T) {
 	testStore(t, store)
 }
 
+func TestStoreTagged(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.ObjectTags = map[string]string{"juicefs-volume": "uuid"}
+	store := NewCachedStore(mem, conf, nil)
+	if err := forgetSlice(store, 10, 1024); err != nil {
+		t.Fatalf("write slice 10: %s", err)
+	}
+	tags, err := mem.(object.SupportTagging).GetTags("chunks/0/0/10_0_1024")
+	if err != nil {
+		t.Fatalf("get tags: %s", err)
+	}
+	if tags["juicefs-volume"] != "uuid" || tags["juicefs-chunk"] != "10" || tags["juicefs-created"] == "" {
+		t.Fatalf("unexpected tags: %+v", tags)
+	}
+
+	// the packed blocks are tagged by their pack
+	pack := &memPack{blocks: make(map[string]string), offs: make(map[string][2]uint32), refs: make(map[string]int64)}
+	ps := NewPackStorage(mem, pack, 16<<10)
+	store = NewCachedStore(ps, conf, nil)
+	if err := forgetSlice(store, 11, 1024); err != nil {
+		t.Fatalf("write slice 11: %s", err)
+	}
+	pk := pack.blocks["11_0_1024"]
+	if pk == "" {
+		t.Fatalf("block 11_0_1024 should be packed")
+	}
+	if tags, err = mem.(object.SupportTagging).GetTags(pk); err != nil || tags["juicefs-volume"] != "uuid" {
+		t.Fatalf("tags of pack %s: %+v, %v", pk, tags, err)
+	}
+	if tags, err = ps.(object.SupportTagging).GetTags("chunks/0/0/11_0_1024"); err != nil || tags["juicefs-volume"] != "uuid" {
+		t.Fatalf("tags of packed block: %+v, %v", tags, err)
+	}
+}
+
+func TestStoreDataKey(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tenant"), []byte("secret"), 0600); err != nil {
+		t.Fatalf("write key: %s", err)
+	}
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.DataKeyDir = dir
+	store := NewCachedStore(mem, conf, nil)
+	if !store.(*cachedStore).HasDataKey("tenant") || store.(*cachedStore).HasDataKey("other") {
+		t.Fatalf("data keys are not loaded")
+	}
+	w := store.NewWriter(20)
+	w.SetDataKey("tenant")
+	if _, err := w.WriteAt([]byte("hello world"), 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(11); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	in, err := mem.Get("chunks/0/0/20_0_11", 0, -1)
+	if err != nil {
+		t.Fatalf("get block: %s", err)
+	}
+	raw, _ := io.ReadAll(in)
+	if !isSealed(raw) || bytes.Contains(raw, []byte("hello")) {
+		t.Fatalf("block is not encrypted: %q", raw)
+	}
+
+	ctx := WithDataKey(context.Background(), "tenant")
+	p := NewPage(make([]byte, 5))
+	if n, err := store.NewReader(20, 11).ReadAt(ctx, p, 6); n != 5 || err != nil || string(p.Data) != "world" {
+		t.Fatalf("read encrypted block: %d %s %q", n, err, p.Data)
+	}
+
+	// revoke the key
+	_ = os.Remove(filepath.Join(dir, "tenant"))
+	store.(*cachedStore).keys.loaded = time.Time{}
+	if _, err := store.NewReader(20, 11).ReadAt(ctx, NewPage(make([]byte, 5)), 6); err == nil {
+		t.Fatalf("read should fail after the key is revoked")
+	}
+	if store.(*cachedStore).HasDataKey("tenant") {
+		t.Fatalf("key should be revoked")
+	}
+}
+
+type memInline struct {
+	sync.Mutex
+	blocks map[string][]byte
+}
+
+func (m *memInline) GetInline(key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	if data, ok := m.blocks[key]; ok {
+		return data, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *memInline) SetInline(key string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.blocks[key] = data
+	return nil
+}
+
+func (m *memInline) DeleteInline(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.blocks[key]; !ok {
+		return os.ErrNotExist
+	}
+	delete(m.blocks, key)
+	return nil
+}
+
+func TestStoreInline(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	inline := &memInline{blocks: make(map[string][]byte)}
+	conf := defaultConf
+	conf.CacheDir = "memory"
+	store := NewCachedStore(NewInlineStorage(mem, inline, 4<<10), conf, nil)
+	testStore(t, store)
+
+	if err := forgetSlice(store, 10, 1024); err != nil {
+		t.Fatalf("write slice 10: %s", err)
+	}
+	if _, ok := inline.blocks["10_0_1024"]; !ok {
+		t.Fatalf("block 10_0_1024 should be inlined")
+	}
+	if _, err := mem.Head("chunks/0/0/10_0_1024"); err == nil {
+		t.Fatalf("block 10_0_1024 should not be in object storage")
+	}
+	if err := forgetSlice(store, 11, 8<<10); err != nil {
+		t.Fatalf("write slice 11: %s", err)
+	}
+	if _, err := mem.Head("chunks/0/0/11_0_8192"); err != nil {
+		t.Fatalf("block 11_0_8192 should be in object storage: %s", err)
+	}
+	store.(*cachedStore).bcache.remove("chunks/0/0/10_0_1024")
+	p := NewPage(make([]byte, 1024))
+	if n, err := store.NewReader(10, 1024).ReadAt(context.Background(), p, 0); n != 1024 || err != nil {
+		t.Fatalf("read inlined block: %d %s", n, err)
+	} else if !bytes.Equal(p.Data, bytes.Repeat([]byte{0x41}, 1024)) {
+		t.Fatalf("unexpected data of inlined block")
+	}
+	if err := store.Remove(10, 1024); err != nil {
+		t.Fatalf("remove slice 10: %s", err)
+	}
+	if len(inline.blocks) != 0 {
+		t.Fatalf("inlined blocks should be removed: %d", len(inline.blocks))
+	}
+
+	// stop inlining new blocks, the inlined ones are still readable and removable
+	if err := forgetSlice(store, 12, 1024); err != nil {
+		t.Fatalf("write slice 12: %s", err)
+	}
+	store = NewCachedStore(NewInlineStorage(mem, inline, 0), conf, nil)
+	if err := forgetSlice(store, 13, 1024); err != nil {
+		t.Fatalf("write slice 13: %s", err)
+	}
+	if _, ok := inline.blocks["13_0_1024"]; ok {
+		t.Fatalf("block 13_0_1024 should not be inlined")
+	}
+	if n, err := store.NewReader(12, 1024).ReadAt(context.Background(), p, 0); n != 1024 || err != nil {
+		t.Fatalf("read inlined block after disabled: %d %s", n, err)
+	}
+	if err := store.Remove(12, 1024); err != nil {
+		t.Fatalf("remove slice 12: %s", err)
+	}
+	if len(inline.blocks) != 0 {
+		t.Fatalf("inlined blocks should be removed after disabled: %d", len(inline.blocks))
+	}
+}
+
+type memDedupe struct {
+	sync.Mutex
+	hashes map[string]string
+	refs   map[string]int64
+}
+
+func (m *memDedupe) RefBlock(key, hash string) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.hashes[key]; !ok {
+		if m.refs[hash] < 0 {
+			return -1, nil
+		}
+		m.hashes[key] = hash
+		m.refs[hash]++
+	}
+	return m.refs[hash], nil
+}
+
+func (m *memDedupe) UnrefBlock(key string) (string, int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	hash, ok := m.hashes[key]
+	if !ok {
+		return "", 0, os.ErrNotExist
+	}
+	delete(m.hashes, key)
+	if m.refs[hash]--; m.refs[hash] == 0 {
+		m.refs[hash] = -1
+		return hash, 0, nil
+	}
+	return hash, m.refs[hash], nil
+}
+
+func (m *memDedupe) DropContent(hash string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.refs[hash] < 0 {
+		delete(m.refs, hash)
+	}
+	return nil
+}
+
+func (m *memDedupe) GetBlockHash(key string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if hash, ok := m.hashes[key]; ok {
+		return hash, nil
+	}
+	return "", os.ErrNotExist
+}
+
+func TestStoreDedupe(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	dedupe := &memDedupe{hashes: make(map[string]string), refs: make(map[string]int64)}
+	conf := defaultConf
+	conf.CacheDir = "memory"
+	store := NewCachedStore(NewDedupeStorage(mem, dedupe), conf, nil)
+	testStore(t, store)
+
+	for _, id := range []uint64{10, 11} {
+		if err := forgetSlice(store, id, 8<<10); err != nil {
+			t.Fatalf("write slice %d: %s", id, err)
+		}
+	}
+	if len(dedupe.refs) != 1 {
+		t.Fatalf("blocks with the same content should be deduplicated: %v", dedupe.refs)
+	}
+	objs, _, _, _ := mem.List("", "", "", "", 100)
+	if len(objs) != 1 {
+		t.Fatalf("expect 1 object, but got %d", len(objs))
+	}
+	if err := store.Remove(10, 8<<10); err != nil {
+		t.Fatalf("remove slice 10: %s", err)
+	}
+	store.(*cachedStore).bcache.remove("chunks/0/0/11_0_8192")
+	p := NewPage(make([]byte, 8<<10))
+	if n, err := store.NewReader(11, 8<<10).ReadAt(context.Background(), p, 0); n != 8<<10 || err != nil {
+		t.Fatalf("read deduplicated block: %d %s", n, err)
+	}
+	if err := store.Remove(11, 8<<10); err != nil {
+		t.Fatalf("remove slice 11: %s", err)
+	}
+	if objs, _, _, _ = mem.List("", "", "", "", 100); len(objs) != 0 {
+		t.Fatalf("the content should be removed: %d", len(objs))
+	}
+	if len(dedupe.refs) != 0 {
+		t.Fatalf("the content should be dropped: %v", dedupe.refs)
+	}
+
+	// a block with the content being deleted waits for the deletion
+	var hash string
+	if err := forgetSlice(store, 12, 8<<10); err != nil {
+		t.Fatalf("write slice 12: %s", err)
+	}
+	if hash = dedupe.hashes["12_0_8192"]; hash == "" {
+		t.Fatalf("block 12_0_8192 should be deduplicated")
+	}
+	if _, refs, err := dedupe.UnrefBlock("12_0_8192"); err != nil || refs != 0 {
+		t.Fatalf("unref block 12_0_8192: %d %s", refs, err)
+	}
+	done := make(chan error)
+	go func() { done <- forgetSlice(store, 13, 8<<10) }()
+	time.Sleep(time.Millisecond * 300)
+	if _, err := dedupe.GetBlockHash("13_0_8192"); err == nil {
+		t.Fatalf("block 13_0_8192 should not be recorded before the content is dropped")
+	}
+	_ = mem.Delete(contentKey(hash))
+	_ = dedupe.DropContent(hash)
+	if err := <-done; err != nil {
+		t.Fatalf("write slice 13: %s", err)
+	}
+	if _, err := mem.Head(contentKey(hash)); err != nil {
+		t.Fatalf("the content should be uploaded again: %s", err)
+	}
+}
+
+type memPack struct {
+	sync.Mutex
+	blocks map[string]string
+	offs   map[string][2]uint32
+	refs   map[string]int64
+}
+
+func (m *memPack) PackBlocks(pack string, blocks map[string][2]uint32) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	for k, b := range blocks {
+		if _, ok := m.blocks[k]; !ok {
+			m.blocks[k], m.offs[k] = pack, b
+			m.refs[pack]++
+		}
+	}
+	return m.refs[pack], nil
+}
+
+func (m *memPack) GetPackedBlock(key string) (string, uint32, uint32, error) {
+	m.Lock()
+	defer m.Unlock()
+	if pack, ok := m.blocks[key]; ok {
+		return pack, m.offs[key][0], m.offs[key][1], nil
+	}
+	return "", 0, 0, os.ErrNotExist
+}
+
+func (m *memPack) UnpackBlock(key string) (string, int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	pack, ok := m.blocks[key]
+	if !ok {
+		return "", 0, os.ErrNotExist
+	}
+	delete(m.blocks, key)
+	m.refs[pack]--
+	return pack, m.refs[pack], nil
+}
+
+func TestStorePack(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	pack := &memPack{blocks: make(map[string]string), offs: make(map[string][2]uint32), refs: make(map[string]int64)}
+	conf := defaultConf
+	conf.CacheDir = "memory"
+	store := NewCachedStore(NewPackStorage(mem, pack, 16<<10), conf, nil)
+	testStore(t, store)
+
+	var wg sync.WaitGroup
+	for _, id := range []uint64{10, 11} {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			if err := forgetSlice(store, id, 8<<10); err != nil {
+				t.Errorf("write slice %d: %s", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+	if _, ok := pack.blocks["10_0_8192"]; !ok {
+		t.Fatalf("block 10_0_8192 should be packed")
+	}
+	if _, err := mem.Head("chunks/0/0/10_0_8192"); err == nil {
+		t.Fatalf("packed block should not be uploaded")
+	}
+	if err := store.Remove(10, 8<<10); err != nil {
+		t.Fatalf("remove slice 10: %s", err)
+	}
+	store.(*cachedStore).bcache.remove("chunks/0/0/11_0_8192")
+	p := NewPage(make([]byte, 8<<10))
+	if n, err := store.NewReader(11, 8<<10).ReadAt(context.Background(), p, 0); n != 8<<10 || err != nil {
+		t.Fatalf("read packed block: %d %s", n, err)
+	}
+	if !bytes.Equal(p.Data, bytes.Repeat([]byte{0x41}, 8<<10)) {
+		t.Fatalf("data of packed block is wrong")
+	}
+	pk := pack.blocks["11_0_8192"]
+	if err := store.Remove(11, 8<<10); err != nil {
+		t.Fatalf("remove slice 11: %s", err)
+	}
+	if pack.refs[pk] == 0 {
+		if _, err := mem.Head(pk); err == nil {
+			t.Fatalf("pack %s should be removed", pk)
+		}
+	}
+
+	if err := forgetSlice(store, 12, 8<<10); err != nil {
+		t.Fatalf("write slice 12: %s", err)
+	}
+	ps := NewPackStorage(mem, pack, 16<<10)
+	if r, err := ps.Get("chunks/0/0/12_0_8192", 8<<10, -1); err != nil {
+		t.Fatalf("read packed block at the end: %s", err)
+	} else if data, _ := io.ReadAll(r); len(data) != 0 {
+		t.Fatalf("read %d bytes at the end of packed block", len(data))
+	}
+	// stop packing new blocks, the packed ones are still readable and removable
+	store = NewCachedStore(NewPackStorage(mem, pack, 0), conf, nil)
+	if err := forgetSlice(store, 13, 8<<10); err != nil {
+		t.Fatalf("write slice 13: %s", err)
+	}
+	if _, err := mem.Head("chunks/0/0/13_0_8192"); err != nil {
+		t.Fatalf("block 13_0_8192 should not be packed: %s", err)
+	}
+	if n, err := store.NewReader(12, 8<<10).ReadAt(context.Background(), p, 0); n != 8<<10 || err != nil {
+		t.Fatalf("read packed block after disabled: %d %s", n, err)
+	}
+	pk = pack.blocks["12_0_8192"]
+	if err := store.Remove(12, 8<<10); err != nil {
+		t.Fatalf("remove slice 12: %s", err)
+	}
+	if _, err := mem.Head(pk); err == nil {
+		t.Fatalf("pack %s should be removed after disabled", pk)
+	}
+}
+
 func TestStoreFull(t *testing.T) {
 	mem, _ := object.CreateStorage("mem", "", "", "", "")
 	conf := defaultConf
@@ -292,3 +697,38 @@ func BenchmarkUncachedRead(b *testing.B) {
 		}
 	}
 }
+
+func TestLimitSchedule(t *testing.T) {
+	s, err := ParseLimitSchedule("09:00-18:00=50, 22:00-06:00=0")
+	if err != nil {
+		t.Fatalf("parse schedule: %s", err)
+	}
+	day := func(h, m int) time.Time { return time.Date(2023, 1, 1, h, m, 0, 0, time.Local) }
+	if l, ok := s.at(day(9, 0)); !ok || l != 50*1e6/8 {
+		t.Fatalf("limit at 09:00: %d %v", l, ok)
+	}
+	if _, ok := s.at(day(18, 0)); ok {
+		t.Fatalf("18:00 should be out of any window")
+	}
+	if l, ok := s.at(day(3, 30)); !ok || l != 0 {
+		t.Fatalf("limit at 03:30: %d %v", l, ok)
+	}
+	for _, bad := range []string{"09:00=50", "09:00-09:00=1", "25:00-26:00=1", "09:00-18:00=-1", "09:00-18:00=x"} {
+		if _, err := ParseLimitSchedule(bad); err == nil {
+			t.Fatalf("schedule %q should be invalid", bad)
+		}
+	}
+
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = "memory"
+	conf.UploadSchedule = "00:00-24:00=8"
+	store := NewCachedStore(mem, conf, nil).(*cachedStore)
+	if store.conf.UploadLimit != 1e6 || store.upLimit == nil {
+		t.Fatalf("scheduled upload limit should be applied: %d", store.conf.UploadLimit)
+	}
+	store.UpdateLimit(16, 16)
+	if store.conf.UploadLimit != 1e6 || store.conf.DownloadLimit != 2e6 {
+		t.Fatalf("schedule should override base limit: %d %d", store.conf.UploadLimit, store.conf.DownloadLimit)
+	}
+}
@@ -29,6 +29,9 @@ type Writer interface {
 	io.WriterAt
 	ID() uint64
 	SetID(id uint64)
+	SetCachePolicy(policy CachePolicy)
+	SetIOClass(class IOClass)
+	SetDataKey(id string)
 	FlushTo(offset int) error
 	Finish(length int) error
 	Abort()
@@ -41,4 +44,5 @@ type ChunkStore interface {
 	FillCache(id uint64, length uint32) error
 	UsedMemory() int64
 	UpdateLimit(upload, download int64)
+	UpdateCache(dirs string, size int64) error
 }
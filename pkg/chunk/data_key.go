@@ -0,0 +1,179 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const dataKeyTTL = time.Minute
+
+// blocks encrypted by a data key start with the magic, followed by the length of key id,
+// the key id, the nonce and the sealed data
+var dataKeyMagic = []byte("\x00JFSKEY1")
+
+var validKeyID = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,63}$`)
+
+// ErrNoDataKey means the data key of a block is not in the keyring (not loaded or revoked).
+var ErrNoDataKey = errors.New("data key is not available")
+
+// ValidDataKeyID checks whether the name can be used as the id of a data key.
+func ValidDataKeyID(id string) bool {
+	return validKeyID.MatchString(id)
+}
+
+// dataKeyOverhead is the maximum number of bytes added to a block by the encryption.
+const dataKeyOverhead = 8 + 1 + 64 + 12 + 16
+
+// keyring holds the data keys loaded from a directory, in which every file is a key named by its
+// id, and the content of it is hashed into an AES-256 key. The directory is reloaded periodically,
+// so a key can be revoked from running clients by removing the file.
+type keyring struct {
+	sync.Mutex
+	dir    string
+	keys   map[string]cipher.AEAD
+	loaded time.Time
+}
+
+func newKeyring(dir string) *keyring {
+	if dir == "" {
+		return nil
+	}
+	k := &keyring{dir: dir}
+	if err := k.reload(); err != nil {
+		logger.Fatalf("Load data keys from %s: %s", dir, err)
+	}
+	return k
+}
+
+func (k *keyring) reload() error {
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]cipher.AEAD, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !ValidDataKeyID(e.Name()) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(k.dir, e.Name()))
+		if err != nil {
+			logger.Warnf("Read data key %s: %s", e.Name(), err)
+			continue
+		}
+		sum := sha256.Sum256(bytes.TrimSpace(content))
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return err
+		}
+		if keys[e.Name()], err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+	k.keys, k.loaded = keys, time.Now()
+	return nil
+}
+
+func (k *keyring) get(id string) cipher.AEAD {
+	if k == nil {
+		return nil
+	}
+	k.Lock()
+	defer k.Unlock()
+	if time.Since(k.loaded) > dataKeyTTL {
+		if err := k.reload(); err != nil {
+			logger.Warnf("Reload data keys from %s: %s", k.dir, err)
+			k.loaded = time.Now() // keep the old keys and retry later
+		}
+	}
+	return k.keys[id]
+}
+
+// seal encrypts the block with the data key, the key of block is authenticated to avoid swapping of blocks.
+func (k *keyring) seal(id, key string, data []byte) ([]byte, error) {
+	aead := k.get(id)
+	if aead == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoDataKey, id)
+	}
+	buf := make([]byte, 0, len(dataKeyMagic)+1+len(id)+aead.NonceSize()+len(data)+aead.Overhead())
+	buf = append(buf, dataKeyMagic...)
+	buf = append(buf, byte(len(id)))
+	buf = append(buf, id...)
+	nonce := buf[len(buf) : len(buf)+aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	buf = buf[:len(buf)+len(nonce)]
+	return aead.Seal(buf, nonce, data, []byte(key)), nil
+}
+
+// isSealed checks whether the block is encrypted by a data key.
+func isSealed(data []byte) bool {
+	return len(data) > len(dataKeyMagic) && bytes.Equal(data[:len(dataKeyMagic)], dataKeyMagic)
+}
+
+// open decrypts a sealed block in place and returns the plain data.
+func (k *keyring) open(key string, data []byte) ([]byte, error) {
+	p := len(dataKeyMagic)
+	l := int(data[p])
+	if p+1+l > len(data) {
+		return nil, fmt.Errorf("invalid header of sealed block %s", key)
+	}
+	id := string(data[p+1 : p+1+l])
+	aead := k.get(id)
+	if aead == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoDataKey, id)
+	}
+	p += 1 + l
+	if p+aead.NonceSize() > len(data) {
+		return nil, fmt.Errorf("invalid header of sealed block %s", key)
+	}
+	nonce := data[p : p+aead.NonceSize()]
+	sealed := data[p+aead.NonceSize():]
+	plain, err := aead.Open(sealed[:0], nonce, sealed, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt block %s with data key %s: %s", key, id, err)
+	}
+	return plain, nil
+}
+
+type dataKeyKey struct{}
+
+// WithDataKey returns a context telling that the blocks to read are encrypted by the data key.
+func WithDataKey(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, dataKeyKey{}, id)
+}
+
+func dataKeyOf(ctx context.Context) string {
+	id, _ := ctx.Value(dataKeyKey{}).(string)
+	return id
+}
@@ -0,0 +1,207 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// DedupeStore keeps the hash of blocks and the refcount of contents, which is usually the meta engine.
+type DedupeStore interface {
+	RefBlock(key, hash string) (int64, error)
+	UnrefBlock(key string) (string, int64, error)
+	GetBlockHash(key string) (string, error)
+	DropContent(hash string) error
+}
+
+// dedupeStorage stores the blocks by the SHA256 of their (compressed) content, so identical blocks
+// of different files share one object in dedupe/, which is removed when the last reference is gone.
+// The blocks written before dedupe is enabled are still read from their original keys.
+//
+// A content is marked as deleting when its last reference is gone, and it can't be referenced again
+// until it's deleted from object storage and dropped from DedupeStore, so a new block with the same
+// content will not be lost by a concurrent deletion.
+type dedupeStorage struct {
+	object.ObjectStorage
+	store DedupeStore
+}
+
+// NewDedupeStorage returns an object storage which shares the blocks with identical content.
+func NewDedupeStorage(storage object.ObjectStorage, store DedupeStore) object.ObjectStorage {
+	return &dedupeStorage{storage, store}
+}
+
+func (s *dedupeStorage) String() string {
+	return fmt.Sprintf("%s(dedupe)", s.ObjectStorage)
+}
+
+func contentKey(hash string) string {
+	return fmt.Sprintf("dedupe/%s/%s", hash[:2], hash)
+}
+
+// resolve returns the key of the content for a block.
+func (s *dedupeStorage) resolve(key string) (string, error) {
+	if parseObjOrigSize(key) <= 0 { // not a block
+		return key, nil
+	}
+	hash, err := s.store.GetBlockHash(path.Base(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return key, nil
+	} else if err != nil {
+		return "", err
+	}
+	return contentKey(hash), nil
+}
+
+func (s *dedupeStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	k, err := s.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.ObjectStorage.Get(k, off, limit)
+}
+
+func (s *dedupeStorage) Head(key string) (object.Object, error) {
+	k, err := s.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.ObjectStorage.Head(k)
+}
+
+func (s *dedupeStorage) Put(key string, in io.Reader) error {
+	if parseObjOrigSize(key) <= 0 {
+		return s.ObjectStorage.Put(key, in)
+	}
+	return s.put(key, in, s.ObjectStorage.Put)
+}
+
+// PutWithTags uploads the content with the tags if it's not there, a content shares the tags with
+// all the blocks referencing it.
+func (s *dedupeStorage) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	put := func(key string, in io.Reader) error { return object.PutWithTags(s.ObjectStorage, key, in, tags) }
+	if parseObjOrigSize(key) <= 0 {
+		return put(key, in)
+	}
+	return s.put(key, in, put)
+}
+
+func (s *dedupeStorage) put(key string, in io.Reader, put func(key string, in io.Reader) error) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	refs, err := s.ref(path.Base(key), hash)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		// the content could be still uploading or failed by others, upload it again if it's not there
+		if _, err = s.ObjectStorage.Head(contentKey(hash)); err == nil {
+			logger.Debugf("Block %s is deduplicated as %s (%d refs)", key, hash, refs)
+			return nil
+		}
+	}
+	if err = put(contentKey(hash), bytes.NewReader(data)); err != nil {
+		if _, refs, e := s.store.UnrefBlock(path.Base(key)); e != nil {
+			logger.Warnf("Unref block %s: %s", key, e)
+		} else if refs == 0 {
+			if e = s.deleteContent(hash); e != nil {
+				logger.Warnf("Delete content %s: %s", hash, e)
+			}
+		}
+	}
+	return err
+}
+
+// ref records the hash of a block, it waits for the content to be deleted if it's being deleted.
+func (s *dedupeStorage) ref(key, hash string) (int64, error) {
+	for i := 0; ; i++ {
+		refs, err := s.store.RefBlock(key, hash)
+		if err != nil || refs >= 0 {
+			return refs, err
+		}
+		if i < 20 {
+			time.Sleep(time.Millisecond * 100 * time.Duration(i+1))
+			continue
+		}
+		// the client deleting it may be gone, finish the deletion for it
+		logger.Warnf("Content %s is being deleted for too long, delete it again", hash)
+		if err = s.deleteContent(hash); err != nil {
+			return 0, err
+		}
+		i = 0
+	}
+}
+
+// deleteContent deletes a content whose last reference is gone.
+func (s *dedupeStorage) deleteContent(hash string) error {
+	if err := s.ObjectStorage.Delete(contentKey(hash)); err != nil {
+		return err
+	}
+	return s.store.DropContent(hash)
+}
+
+func (s *dedupeStorage) SetTags(key string, tags map[string]string) error {
+	o, ok := s.ObjectStorage.(object.SupportTagging)
+	if !ok {
+		return utils.ENOTSUP
+	}
+	k, err := s.resolve(key)
+	if err != nil {
+		return err
+	}
+	return o.SetTags(k, tags)
+}
+
+func (s *dedupeStorage) GetTags(key string) (map[string]string, error) {
+	o, ok := s.ObjectStorage.(object.SupportTagging)
+	if !ok {
+		return nil, utils.ENOTSUP
+	}
+	k, err := s.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	return o.GetTags(k)
+}
+
+func (s *dedupeStorage) Delete(key string) error {
+	if parseObjOrigSize(key) <= 0 {
+		return s.ObjectStorage.Delete(key)
+	}
+	hash, refs, err := s.store.UnrefBlock(path.Base(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.ObjectStorage.Delete(key)
+	} else if err != nil || refs > 0 {
+		return err
+	}
+	return s.deleteContent(hash)
+}
@@ -57,8 +57,10 @@ type cacheItem struct {
 }
 
 type pendingFile struct {
-	key  string
-	page *Page
+	key    string
+	page   *Page
+	off    int
+	ranged bool // only a range of the block
 }
 
 type cacheStore struct {
@@ -76,12 +78,19 @@ type cacheStore struct {
 
 	used      int64
 	keys      map[cacheKey]cacheItem
+	ranges    map[cacheKey]*rangeItem // blocks with only some ranges cached
+	rangeUsed int64
+	pinned    map[cacheKey]struct{} // never evicted
 	scanned   bool
 	stageFull bool
 	rawFull   bool
 	eviction  string
 	checksum  string // checksum level
 	uploader  func(key, path string, force bool) bool
+	journal   *stagingJournal
+	cipher    *cacheCipher  // nil if cache is not encrypted
+	ring      *uring        // nil if io_uring is not used
+	closed    chan struct{} // closed after the dir is drained
 }
 
 func newCacheStore(m *cacheManagerMetrics, dir string, cacheSize int64, pendingPages int, config *Config, uploader func(key, path string, force bool) bool) *cacheStore {
@@ -102,11 +111,27 @@ func newCacheStore(m *cacheManagerMetrics, dir string, cacheSize int64, pendingP
 		hashPrefix:   config.HashPrefix,
 		scanInterval: config.CacheScanInterval,
 		keys:         make(map[cacheKey]cacheItem),
+		ranges:       make(map[cacheKey]*rangeItem),
+		pinned:       make(map[cacheKey]struct{}),
 		pending:      make(chan pendingFile, pendingPages),
 		pages:        make(map[string]*Page),
 		uploader:     uploader,
+		closed:       make(chan struct{}),
+	}
+	if uploader != nil {
+		c.journal = newStagingJournal(filepath.Join(dir, journalName), c.mode)
+	}
+	if len(config.CacheKey) > 0 {
+		var err error
+		if c.cipher, err = newCacheCipher(config.CacheKey); err != nil {
+			logger.Fatalf("Create cipher for cache dir %s: %s", dir, err)
+		}
+	}
+	if config.CacheIOUring {
+		c.ring = sharedRing()
 	}
 	c.createDir(c.dir)
+	c.checkCipher()
 	br, fr := c.curFreeRatio()
 	if br < c.freeRatio || fr < c.freeRatio {
 		logger.Warnf("not enough space (%d%%) or inodes (%d%%) for caching in %s: free ratio should be >= %d%%", int(br*100), int(fr*100), c.dir, int(c.freeRatio*100))
@@ -126,7 +151,7 @@ func (c *cacheStore) usedMemory() int64 {
 func (cache *cacheStore) stats() (int64, int64) {
 	cache.Lock()
 	defer cache.Unlock()
-	return int64(len(cache.pages) + len(cache.keys)), cache.used + cache.usedMemory()
+	return int64(len(cache.pages) + len(cache.keys) + len(cache.ranges)), cache.used + cache.usedMemory()
 }
 
 func (cache *cacheStore) checkFreeSpace() {
@@ -145,7 +170,11 @@ func (cache *cacheStore) checkFreeSpace() {
 		if cache.rawFull {
 			cache.uploadStaging()
 		}
-		time.Sleep(time.Second)
+		select {
+		case <-cache.closed:
+			return
+		case <-time.After(time.Second):
+		}
 	}
 }
 
@@ -156,14 +185,23 @@ func (cache *cacheStore) refreshCacheKeys() {
 	cache.scanCached()
 	if cache.scanInterval > 0 {
 		for {
-			time.Sleep(cache.scanInterval)
+			select {
+			case <-cache.closed:
+				return
+			case <-time.After(cache.scanInterval):
+			}
 			cache.scanCached()
 		}
 	}
 }
 func (cache *cacheStore) removeStage(key string) error {
 	var err error
-	if err = os.Remove(cache.stagePath(key)); err == nil {
+	if err = os.Remove(cache.stagePath(key)); err == nil || os.IsNotExist(err) {
+		if cache.journal != nil {
+			cache.journal.remove(key)
+		}
+	}
+	if err == nil {
 		cache.m.stageBlocks.Sub(1)
 		cache.m.stageBlockBytes.Sub(float64(parseObjOrigSize(key)))
 	}
@@ -192,11 +230,11 @@ func (cache *cacheStore) cache(key string, p *Page, force bool) {
 	cache.pages[key] = p
 	atomic.AddInt64(&cache.totalPages, int64(cap(p.Data)))
 	select {
-	case cache.pending <- pendingFile{key, p}:
+	case cache.pending <- pendingFile{key: key, page: p}:
 	default:
 		if force {
 			cache.Unlock()
-			cache.pending <- pendingFile{key, p}
+			cache.pending <- pendingFile{key: key, page: p}
 			cache.Lock()
 		} else {
 			// does not have enough bandwidth to write it into disk, discard it
@@ -209,12 +247,19 @@ func (cache *cacheStore) cache(key string, p *Page, force bool) {
 	}
 }
 
+func (cache *cacheStore) writeAt(f *os.File, b []byte, off int64) (int, error) {
+	if cache.ring != nil {
+		return cache.ring.pwrite(f, b, off)
+	}
+	return f.WriteAt(b, off)
+}
+
 func (cache *cacheStore) curFreeRatio() (float32, float32) {
 	total, free, files, ffree := getDiskUsage(cache.dir)
 	return float32(free) / float32(total), float32(ffree) / float32(files)
 }
 
-func (cache *cacheStore) flushPage(path string, data []byte) (err error) {
+func (cache *cacheStore) flushPage(key, path string, data []byte, sync bool) (err error) {
 	start := time.Now()
 	cache.m.cacheWrites.Add(1)
 	cache.m.cacheWriteBytes.Add(float64(len(data)))
@@ -234,18 +279,37 @@ func (cache *cacheStore) flushPage(path string, data []byte) (err error) {
 		}
 	}()
 
-	if _, err = f.Write(data); err != nil {
+	var sum []byte
+	if cache.checksum != CsNone {
+		sum = checksum(data)
+	}
+	if cache.cipher != nil {
+		buf := NewOffPage(len(data))
+		defer buf.Release()
+		copy(buf.Data, data)
+		cache.cipher.xorAt(key, buf.Data, 0)
+		cache.cipher.xorAt(key, sum, int64(len(data)))
+		data = buf.Data
+	}
+	if _, err = cache.writeAt(f, data, 0); err != nil {
 		logger.Warnf("Write to cache file %s failed: %s", tmp, err)
 		_ = f.Close()
 		return
 	}
-	if cache.checksum != CsNone {
-		if _, err = f.Write(checksum(data)); err != nil {
+	if sum != nil {
+		if _, err = cache.writeAt(f, sum, int64(len(data))); err != nil {
 			logger.Warnf("Write checksum to cache file %s failed: %s", tmp, err)
 			_ = f.Close()
 			return
 		}
 	}
+	if sync {
+		if err = f.Sync(); err != nil {
+			logger.Warnf("Sync cache file %s failed: %s", tmp, err)
+			_ = f.Close()
+			return
+		}
+	}
 	if err = f.Close(); err != nil {
 		logger.Warnf("Close cache file %s failed: %s", tmp, err)
 		return
@@ -316,6 +380,8 @@ func (cache *cacheStore) remove(key string) {
 	delete(cache.pages, key)
 	path := cache.cachePath(key)
 	k := cache.getCacheKey(key)
+	delete(cache.pinned, k)
+	ranged := cache.dropRange(k)
 	if it, ok := cache.keys[k]; ok {
 		if it.size > 0 {
 			cache.used -= int64(it.size + 4096)
@@ -325,12 +391,22 @@ func (cache *cacheStore) remove(key string) {
 		path = "" // not existed
 	}
 	cache.Unlock()
+	if ranged {
+		cache.removeRangeFiles(key)
+	}
 	if path != "" {
 		_ = os.Remove(path)
 		_ = cache.removeStage(key)
 	}
 }
 
+// pin keeps the block from being evicted until it's removed, it's not persisted across restarts.
+func (cache *cacheStore) pin(key string) {
+	cache.Lock()
+	cache.pinned[cache.getCacheKey(key)] = struct{}{}
+	cache.Unlock()
+}
+
 func (cache *cacheStore) load(key string) (ReadCloser, error) {
 	cache.Lock()
 	defer cache.Unlock()
@@ -342,9 +418,14 @@ func (cache *cacheStore) load(key string) (ReadCloser, error) {
 		return nil, errors.New("not cached")
 	}
 	cache.Unlock()
-	f, err := openCacheFile(cache.cachePath(key), parseObjOrigSize(key), cache.checksum)
+	f, err := openCacheFile(cache.cachePath(key), parseObjOrigSize(key), cache.checksum, cache.cipher, key)
+	if errors.Is(err, errCorrupted) {
+		cache.invalidate(key, err)
+	}
 	cache.Lock()
 	if err == nil {
+		f.ring = cache.ring
+		f.onCorrupt = func(err error) { cache.invalidate(key, err) }
 		if it, ok := cache.keys[k]; ok {
 			// update atime
 			cache.keys[k] = cacheItem{it.size, uint32(time.Now().Unix())}
@@ -358,6 +439,24 @@ func (cache *cacheStore) load(key string) (ReadCloser, error) {
 	return f, err
 }
 
+// invalidate removes a corrupted cache file, so the block will be fetched from object storage again.
+func (cache *cacheStore) invalidate(key string, cause error) {
+	cache.m.cacheCorruptions.WithLabelValues(cache.dir).Inc()
+	k := cache.getCacheKey(key)
+	cache.Lock()
+	if it, ok := cache.keys[k]; ok && it.size < 0 {
+		cache.Unlock()
+		logger.Errorf("Staging block %s in %s is corrupted: %s", key, cache.dir, cause)
+		return
+	} else if ok {
+		cache.used -= int64(it.size + 4096)
+		delete(cache.keys, k)
+	}
+	cache.Unlock()
+	logger.Warnf("Remove corrupted cache block %s in %s: %s", key, cache.dir, cause)
+	_ = os.Remove(cache.cachePath(key))
+}
+
 func (cache *cacheStore) cachePath(key string) string {
 	return filepath.Join(cache.dir, cacheDir, key)
 }
@@ -369,10 +468,24 @@ func (cache *cacheStore) stagePath(key string) string {
 // flush cached block into disk
 func (cache *cacheStore) flush() {
 	for {
-		w := <-cache.pending
+		var w pendingFile
+		select {
+		case w = <-cache.pending:
+		case <-cache.closed:
+			return
+		}
+		if w.ranged {
+			if cache.capacity > 0 {
+				cache.flushRange(w.key, w.off, w.page.Data)
+			}
+			atomic.AddInt64(&cache.totalPages, -int64(cap(w.page.Data)))
+			w.page.Release()
+			continue
+		}
 		path := cache.cachePath(w.key)
-		if cache.capacity > 0 && cache.flushPage(path, w.page.Data) == nil {
+		if cache.capacity > 0 && cache.flushPage(w.key, path, w.page.Data, false) == nil {
 			cache.add(w.key, int32(len(w.page.Data)), uint32(time.Now().Unix()))
+			cache.removeRange(w.key) // superseded by the whole block
 		}
 		cache.Lock()
 		_, ok := cache.pages[w.key]
@@ -415,8 +528,14 @@ func (cache *cacheStore) stage(key string, data []byte, keepCache bool) (string,
 	if cache.stageFull {
 		return stagingPath, errors.New("space not enough on device")
 	}
-	err := cache.flushPage(stagingPath, data)
+	// staging blocks are the only copy of acknowledged writes, persist them before recording them
+	err := cache.flushPage(key, stagingPath, data, true)
 	if err == nil {
+		if cache.journal != nil {
+			if e := cache.journal.add(key); e != nil {
+				logger.Warnf("Add %s into staging journal: %s", key, e)
+			}
+		}
 		cache.m.stageBlocks.Add(1)
 		cache.m.stageBlockBytes.Add(float64(len(data)))
 		if cache.capacity > 0 && keepCache {
@@ -461,6 +580,12 @@ func (cache *cacheStore) cleanup() {
 		}
 	}
 
+	// evict cached ranges in proportion to their usage
+	var rtodel []cacheKey
+	if cache.rangeUsed > 0 && cache.used > 0 {
+		rtodel = cache.evictRanges(int64(float64(goal) * float64(cache.rangeUsed) / float64(cache.used)))
+	}
+
 	var todel []cacheKey
 	var freed int64
 	var cnt int
@@ -472,6 +597,9 @@ func (cache *cacheStore) cleanup() {
 		if value.size < 0 {
 			continue // staging
 		}
+		if _, ok := cache.pinned[k]; ok {
+			continue
+		}
 		if cnt == 0 || lastValue.atime > value.atime {
 			lastK = k
 			lastValue = value
@@ -497,6 +625,9 @@ func (cache *cacheStore) cleanup() {
 	for _, k := range todel {
 		_ = os.Remove(cache.cachePath(cache.getPathFromKey(k)))
 	}
+	for _, k := range rtodel {
+		cache.removeRangeFiles(cache.getPathFromKey(k))
+	}
 	cache.Lock()
 }
 
@@ -598,6 +729,7 @@ func (cache *cacheStore) scanCached() {
 		}
 		return nil
 	})
+	cache.scanRanges()
 
 	cache.Lock()
 	cache.scanned = true
@@ -616,6 +748,16 @@ func (cache *cacheStore) scanStaging() {
 	var oneMinAgo = start.Add(-time.Minute)
 	var count int
 	stagingPrefix := filepath.Join(cache.dir, stagingDir)
+	journaled := make(map[string]bool)
+	if cache.journal != nil {
+		keys, err := cache.journal.load()
+		if err != nil {
+			logger.Warnf("Load staging journal in %s: %s", cache.dir, err)
+		}
+		for _, k := range keys {
+			journaled[k] = true
+		}
+	}
 	logger.Debugf("Scan %s to find staging blocks", stagingPrefix)
 	_ = filepath.WalkDir(stagingPrefix, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -635,6 +777,7 @@ func (cache *cacheStore) scanStaging() {
 				if runtime.GOOS == "windows" {
 					key = strings.ReplaceAll(key, "\\", "/")
 				}
+				delete(journaled, key)
 				if !pathReg.MatchString(key) {
 					logger.Warnf("Ignore invalid file in staging: %s", path)
 					return nil
@@ -656,11 +799,23 @@ func (cache *cacheStore) scanStaging() {
 	if count > 0 {
 		logger.Infof("Found %d staging blocks (%d bytes) in %s with %s", count, cache.used, cache.dir, time.Since(start))
 	}
+	for key := range journaled {
+		if _, err := os.Stat(cache.stagePath(key)); os.IsNotExist(err) {
+			logger.Errorf("Staging block %s in %s is lost, the data written into it could be corrupted", key, cache.dir)
+			cache.journal.remove(key)
+		}
+	}
 }
 
 type cacheManager struct {
-	stores  []*cacheStore
-	metrics *cacheManagerMetrics
+	sync.RWMutex
+	stores   []*cacheStore // blocks are distributed by the hash of key
+	draining []*cacheStore // removed ones, closed after all the blocks are moved or uploaded
+	changed  bool          // dirs were changed at runtime, so blocks could be in other stores
+	metrics  *cacheManagerMetrics
+	config   *Config
+	uploader func(key, path string, force bool) bool
+	balancer sync.Mutex
 }
 
 func keyHash(s string) uint32 {
@@ -711,6 +866,7 @@ func expandDir(pattern string) []string {
 type CacheManager interface {
 	cache(key string, p *Page, force bool)
 	remove(key string)
+	pin(key string)
 	load(key string) (ReadCloser, error)
 	uploaded(key string, size int)
 	stage(key string, data []byte, keepCache bool) (string, error)
@@ -718,15 +874,42 @@ type CacheManager interface {
 	stagePath(key string) string
 	stats() (int64, int64)
 	usedMemory() int64
+	update(cacheDir string, cacheSize int64) error
 }
 
 func newCacheManager(config *Config, reg prometheus.Registerer, uploader func(key, path string, force bool) bool) CacheManager {
 	metrics := newCacheManagerMetrics(reg)
 	if config.CacheDir == "memory" || config.CacheSize == 0 {
-		return newMemStore(config, metrics)
+		return newMemStore(config, config.CacheSize<<20, metrics)
+	}
+	disk := newDiskCacheManager(config, config.CacheDir, config.CacheSize, metrics, uploader)
+	if disk == nil {
+		logger.Warnf("No cache dir existed")
+		return newMemStore(config, config.CacheSize<<20, metrics)
 	}
+	if config.MemCacheSize == 0 && (config.ColdCacheDir == "" || config.ColdCacheSize == 0) {
+		return disk
+	}
+	var tiers []CacheManager
+	if config.MemCacheSize > 0 {
+		tiers = append(tiers, newMemStore(config, config.MemCacheSize<<20, metrics))
+	}
+	tiers = append(tiers, disk)
+	if config.ColdCacheDir != "" && config.ColdCacheSize > 0 {
+		if cold := newDiskCacheManager(config, config.ColdCacheDir, config.ColdCacheSize, metrics, uploader); cold != nil {
+			tiers = append(tiers, cold)
+		} else {
+			logger.Warnf("No cold cache dir existed")
+		}
+	}
+	return newTieredCache(tiers, disk, config.CachePromoteHits, metrics)
+}
+
+// cacheDirs returns the sorted dirs (with trailing separator) in cacheDir, the ones not existed are
+// skipped unless AutoCreate is enabled.
+func cacheDirs(config *Config, cacheDir string) []string {
 	var dirs []string
-	for _, d := range utils.SplitDir(config.CacheDir) {
+	for _, d := range utils.SplitDir(cacheDir) {
 		dd := expandDir(d)
 		if config.AutoCreate {
 			dirs = append(dirs, dd...)
@@ -738,37 +921,86 @@ func newCacheManager(config *Config, reg prometheus.Registerer, uploader func(ke
 			}
 		}
 	}
+	sort.Strings(dirs)
+	for i, d := range dirs {
+		dirs[i] = strings.TrimSpace(d) + string(filepath.Separator)
+	}
+	return dirs
+}
+
+// newDiskCacheManager returns nil if none of the dirs exists.
+func newDiskCacheManager(config *Config, cacheDir string, cacheSize int64, metrics *cacheManagerMetrics, uploader func(key, path string, force bool) bool) *cacheManager {
+	dirs := cacheDirs(config, cacheDir)
 	if len(dirs) == 0 {
-		logger.Warnf("No cache dir existed")
-		return newMemStore(config, metrics)
+		return nil
 	}
-	sort.Strings(dirs)
-	dirCacheSize := config.CacheSize << 20
+	dirCacheSize := cacheSize << 20
 	dirCacheSize /= int64(len(dirs))
 	m := &cacheManager{
-		stores:  make([]*cacheStore, len(dirs)),
-		metrics: metrics,
+		stores:   make([]*cacheStore, len(dirs)),
+		metrics:  metrics,
+		config:   config,
+		uploader: uploader,
 	}
-
-	// 20% of buffer could be used for pending pages
-	pendingPages := config.BufferSize * 2 / 10 / config.BlockSize / len(dirs)
 	for i, d := range dirs {
-		m.stores[i] = newCacheStore(metrics, strings.TrimSpace(d)+string(filepath.Separator), dirCacheSize, pendingPages, config, uploader)
+		m.stores[i] = newCacheStore(metrics, d, dirCacheSize, m.pendingPages(len(dirs)), config, uploader)
 	}
 	return m
 }
 
+// 20% of buffer could be used for pending pages
+func (m *cacheManager) pendingPages(dirs int) int {
+	return m.config.BufferSize * 2 / 10 / m.config.BlockSize / dirs
+}
+
 func (m *cacheManager) removeStage(key string) error {
-	return m.getStore(key).removeStage(key)
+	return m.stagingStore(key).removeStage(key)
 }
 
 func (m *cacheManager) getStore(key string) *cacheStore {
+	m.RLock()
+	defer m.RUnlock()
 	return m.stores[keyHash(key)%uint32(len(m.stores))]
 }
 
+// all returns the current stores and the draining ones.
+func (m *cacheManager) all() []*cacheStore {
+	m.RLock()
+	defer m.RUnlock()
+	return append(append(make([]*cacheStore, 0, len(m.stores)+len(m.draining)), m.stores...), m.draining...)
+}
+
+// others returns the stores which could have the block other than its owner, after the dirs are changed.
+func (m *cacheManager) others(owner *cacheStore) []*cacheStore {
+	m.RLock()
+	changed := m.changed
+	m.RUnlock()
+	if !changed {
+		return nil
+	}
+	var ss []*cacheStore
+	for _, s := range m.all() {
+		if s != owner {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+// stagingStore returns the store which has the staging block, which could be moved or drained.
+func (m *cacheManager) stagingStore(key string) *cacheStore {
+	owner := m.getStore(key)
+	for _, s := range m.others(owner) {
+		if _, err := os.Stat(s.stagePath(key)); err == nil {
+			return s
+		}
+	}
+	return owner
+}
+
 func (m *cacheManager) usedMemory() int64 {
 	var used int64
-	for _, s := range m.stores {
+	for _, s := range m.all() {
 		used += s.usedMemory()
 	}
 	return used
@@ -776,7 +1008,7 @@ func (m *cacheManager) usedMemory() int64 {
 
 func (m *cacheManager) stats() (int64, int64) {
 	var cnt, used int64
-	for _, s := range m.stores {
+	for _, s := range m.all() {
 		c, u := s.stats()
 		cnt += c
 		used += u
@@ -795,11 +1027,36 @@ type ReadCloser interface {
 }
 
 func (m *cacheManager) load(key string) (ReadCloser, error) {
-	return m.getStore(key).load(key)
+	owner := m.getStore(key)
+	r, err := owner.load(key)
+	if err != nil {
+		for _, s := range m.others(owner) {
+			if r, e := s.load(key); e == nil {
+				return r, nil
+			}
+		}
+	}
+	return r, err
 }
 
 func (m *cacheManager) remove(key string) {
-	m.getStore(key).remove(key)
+	owner := m.getStore(key)
+	owner.remove(key)
+	for _, s := range m.others(owner) {
+		s.remove(key)
+	}
+}
+
+func (m *cacheManager) cacheRange(key string, off int, p *Page) {
+	m.getStore(key).cacheRange(key, off, p)
+}
+
+func (m *cacheManager) loadRange(key string, p []byte, off int) (int, error) {
+	return m.getStore(key).loadRange(key, p, off)
+}
+
+func (m *cacheManager) pin(key string) {
+	m.getStore(key).pin(key)
 }
 
 func (m *cacheManager) stage(key string, data []byte, keepCache bool) (string, error) {
@@ -811,7 +1068,7 @@ func (m *cacheManager) stagePath(key string) string {
 }
 
 func (m *cacheManager) uploaded(key string, size int) {
-	m.getStore(key).uploaded(key, size)
+	m.stagingStore(key).uploaded(key, size)
 }
 
 /* --- Checksum --- */
@@ -828,10 +1085,16 @@ var crc32c = crc32.MakeTable(crc32.Castagnoli)
 
 type cacheFile struct {
 	*os.File
-	length  int // length of data
-	csLevel string
+	length    int // length of data
+	csLevel   string
+	onCorrupt func(err error)
+	cipher    *cacheCipher
+	key       string
+	ring      *uring
 }
 
+var errCorrupted = errors.New("corrupted cache file")
+
 // Calculate 32-bits checksum for every 32 KiB data, so 512 Bytes for 4 MiB in total
 func checksum(data []byte) []byte {
 	length := len(data)
@@ -847,7 +1110,7 @@ func checksum(data []byte) []byte {
 	return buf.Bytes()
 }
 
-func openCacheFile(name string, length int, level string) (*cacheFile, error) {
+func openCacheFile(name string, length int, level string, cc *cacheCipher, key string) (*cacheFile, error) {
 	fp, err := os.Open(name)
 	if err != nil {
 		return nil, err
@@ -860,13 +1123,24 @@ func openCacheFile(name string, length int, level string) (*cacheFile, error) {
 	checksumLength := ((length-1)/csBlock + 1) * 4
 	switch fi.Size() - int64(length) {
 	case 0:
-		return &cacheFile{fp, length, CsNone}, nil
+		return &cacheFile{File: fp, length: length, csLevel: CsNone, cipher: cc, key: key}, nil
 	case int64(checksumLength):
-		return &cacheFile{fp, length, level}, nil
+		return &cacheFile{File: fp, length: length, csLevel: level, cipher: cc, key: key}, nil
 	default:
 		_ = fp.Close()
-		return nil, fmt.Errorf("invalid file size %d, data length %d", fi.Size(), length)
+		return nil, fmt.Errorf("%w: invalid file size %d, data length %d", errCorrupted, fi.Size(), length)
+	}
+}
+
+// readAt reads the raw file, and decrypts the data if it's encrypted.
+func (cf *cacheFile) readAt(b []byte, off int64) (n int, err error) {
+	if cf.ring != nil {
+		n, err = cf.ring.pread(cf.File, b, off)
+	} else {
+		n, err = cf.File.ReadAt(b, off)
 	}
+	cf.cipher.xorAt(cf.key, b[:n], off)
+	return n, err
 }
 
 func (cf *cacheFile) ReadAt(b []byte, off int64) (n int, err error) {
@@ -875,7 +1149,7 @@ func (cf *cacheFile) ReadAt(b []byte, off int64) (n int, err error) {
 		logger.Tracef("CacheFile readat returns n %d err %s", n, err)
 	}()
 	if cf.csLevel == CsNone || cf.csLevel == CsFull && (off != 0 || len(b) != cf.length) {
-		return cf.File.ReadAt(b, off)
+		return cf.readAt(b, off)
 	}
 	var rb = b     // read buffer
 	var roff = off // read offset
@@ -901,7 +1175,7 @@ func (cf *cacheFile) ReadAt(b []byte, off int64) (n int, err error) {
 			}()
 		}
 	}
-	if n, err = cf.File.ReadAt(rb, roff); err != nil {
+	if n, err = cf.readAt(rb, roff); err != nil {
 		return
 	}
 
@@ -925,7 +1199,7 @@ func (cf *cacheFile) ReadAt(b []byte, off int64) (n int, err error) {
 	// now rb contains the data to check
 	length := len(rb)
 	buf := utils.NewBuffer(uint32((length-1)/csBlock+1) * 4)
-	if _, err = cf.File.ReadAt(buf.Bytes(), int64(cf.length+ioff*4)); err != nil {
+	if _, err = cf.readAt(buf.Bytes(), int64(cf.length+ioff*4)); err != nil {
 		logger.Warnf("Read checksum of data length %d checksum offset %d: %s", length, cf.length+ioff*4, err)
 		return
 	}
@@ -938,7 +1212,11 @@ func (cf *cacheFile) ReadAt(b []byte, off int64) (n int, err error) {
 		expect := buf.Get32()
 		logger.Debugf("Cache file read data start %d end %d checksum %d, expected %d", start, end, sum, expect)
 		if sum != expect {
-			err = fmt.Errorf("data checksum %d != expect %d", sum, expect)
+			err = fmt.Errorf("%w: data checksum %d != expect %d", errCorrupted, sum, expect)
+			if cf.onCorrupt != nil {
+				cf.onCorrupt(err)
+				cf.onCorrupt = nil
+			}
 			break
 		}
 	}
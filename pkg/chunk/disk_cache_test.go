@@ -17,6 +17,7 @@
 package chunk
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"os"
@@ -129,6 +130,130 @@ func TestMetrics(t *testing.T) {
 	}
 }
 
+func TestTieredCache(t *testing.T) {
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.MemCacheSize = 1
+	conf.ColdCacheDir = t.TempDir()
+	conf.ColdCacheSize = 10
+	conf.CachePromoteHits = 2
+	m := newCacheManager(&conf, nil, nil)
+	tc, ok := m.(*tieredCache)
+	if !ok || len(tc.tiers) != 3 {
+		t.Fatalf("expect 3 tiers of cache, got %T", m)
+	}
+	content := []byte("helloworld")
+	key := fmt.Sprintf("chunks/0/0/1_0_%d", len(content))
+	m.cache(key, NewPage(content), true)
+	inTier := func(i int) bool {
+		r, err := tc.tiers[i].load(key)
+		if err == nil {
+			_ = r.Close()
+		}
+		return err == nil
+	}
+	if inTier(0) || inTier(1) || !inTier(2) {
+		t.Fatalf("new block should be cached in the coldest tier")
+	}
+	for i := 0; i < 2; i++ {
+		r, err := m.load(key)
+		if err != nil {
+			t.Fatalf("load %s: %s", key, err)
+		}
+		buf := make([]byte, len(content))
+		if n, _ := r.ReadAt(buf, 0); n != len(content) || string(buf) != string(content) {
+			t.Fatalf("read %s: %q", key, buf[:n])
+		}
+		_ = r.Close()
+	}
+	if !inTier(1) || inTier(0) {
+		t.Fatalf("block should be promoted into the disk tier")
+	}
+	if toFloat64(tc.metrics.cachePromotions) != 1 {
+		t.Fatalf("expect 1 promotion")
+	}
+	m.remove(key)
+	if _, err := m.load(key); err == nil {
+		t.Fatalf("block should be removed from all tiers")
+	}
+}
+
+func TestUpdateCacheDirs(t *testing.T) {
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	m := newCacheManager(&conf, nil, nil).(*cacheManager)
+	var keys []string
+	for i := 1; i <= 20; i++ {
+		key := fmt.Sprintf("chunks/0/0/%d_0_10", i)
+		m.cache(key, NewPage([]byte("helloworld")), true)
+		keys = append(keys, key)
+	}
+	waitFor := func(what string, cond func() bool) {
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(time.Millisecond * 100)
+		}
+		if !cond() {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+	waitFor("cached blocks", func() bool { n, _ := m.stats(); return n == 20 && m.usedMemory() == 0 })
+
+	newDirs := t.TempDir() + string(os.PathListSeparator) + t.TempDir()
+	if err := m.update(newDirs, 20); err != nil {
+		t.Fatalf("update cache dirs: %s", err)
+	}
+	if len(m.stores) != 2 || m.stores[0].capacity != 10<<20 {
+		t.Fatalf("expect 2 cache dirs of 10 MiB, but got %d", len(m.stores))
+	}
+	waitFor("draining", func() bool { m.RLock(); defer m.RUnlock(); return len(m.draining) == 0 })
+	for _, key := range keys {
+		r, err := m.getStore(key).load(key)
+		if err != nil {
+			t.Fatalf("block %s should be moved: %s", key, err)
+		}
+		_ = r.Close()
+	}
+	if err := m.update(t.TempDir()+"/not-exist/*", 20); err == nil {
+		t.Fatalf("update to dirs not existed should fail")
+	}
+}
+
+func TestPinCache(t *testing.T) {
+	metrics := newCacheManagerMetrics(nil)
+	mem := newMemStore(&defaultConf, 100, metrics)
+	pinned := "chunks/0/0/1_0_40"
+	mem.cache(pinned, NewPage(make([]byte, 40)), false)
+	mem.pin(pinned)
+	for i := 2; i < 10; i++ {
+		mem.cache(fmt.Sprintf("chunks/0/0/%d_0_40", i), NewPage(make([]byte, 40)), false)
+	}
+	if r, err := mem.load(pinned); err != nil {
+		t.Fatalf("pinned block should not be evicted from memory: %s", err)
+	} else {
+		_ = r.Close()
+	}
+
+	s := newCacheStore(metrics, t.TempDir()+"/", 1<<20, 1, &defaultConf, nil)
+	s.Lock()
+	for i := 1; i < 100; i++ {
+		s.keys[s.getCacheKey(fmt.Sprintf("chunks/0/0/%d_0_40960", i))] = cacheItem{40960, uint32(i)}
+		s.used += 40960 + 4096
+	}
+	s.Unlock()
+	s.pin("chunks/0/0/1_0_40960")
+	s.Lock()
+	s.cleanup()
+	_, ok := s.keys[s.getCacheKey("chunks/0/0/1_0_40960")]
+	s.Unlock()
+	if !ok {
+		t.Fatalf("pinned block should not be evicted from disk")
+	}
+	s.remove("chunks/0/0/1_0_40960")
+	if len(s.pinned) != 0 {
+		t.Fatalf("block should be unpinned after removed")
+	}
+}
+
 func TestChecksum(t *testing.T) {
 	m := newCacheManager(&defaultConf, nil, nil)
 	s := m.(*cacheManager).stores[0]
@@ -149,25 +274,29 @@ func TestChecksum(t *testing.T) {
 	s.cache(k3, NewPage(buf), true)
 
 	fpath := s.cachePath(k4)
-	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, s.mode)
-	if err != nil {
-		t.Fatalf("Create cache file %s: %s", fpath, err)
-	}
-	if _, err = f.Write(buf); err != nil {
-		_ = f.Close()
-		t.Fatalf("Write cache file %s: %s", fpath, err)
-	}
 	corrupt := make([]byte, 102400)
 	copy(corrupt, buf)
 	for i := 98304; i < 102400; i++ { // reset 96K ~ 100K
 		corrupt[i] = 0
 	}
-	if _, err = f.Write(checksum(corrupt)); err != nil {
+	writeCorrupt := func(data []byte) {
+		f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, s.mode)
+		if err != nil {
+			t.Fatalf("Create cache file %s: %s", fpath, err)
+		}
+		if _, err = f.Write(data); err != nil {
+			_ = f.Close()
+			t.Fatalf("Write cache file %s: %s", fpath, err)
+		}
+		if _, err = f.Write(checksum(corrupt)); err != nil {
+			_ = f.Close()
+			t.Fatalf("Write checksum to cache file %s: %s", fpath, err)
+		}
 		_ = f.Close()
-		t.Fatalf("Write checksum to cache file %s: %s", fpath, err)
+		s.add(k4, 102400, uint32(time.Now().Unix()))
 	}
-	_ = f.Close()
-	s.add(k4, 102400, uint32(time.Now().Unix()))
+	writeCorrupt(buf)
+	k4data := append([]byte(nil), buf...)
 
 	buf = make([]byte, 1048576)
 	_, _ = rand.Read(buf)
@@ -202,6 +331,7 @@ func TestChecksum(t *testing.T) {
 		{k5, 131072, 131072, true},
 		{k5, 102400, 512000, true},
 	}
+	var err error
 	for _, l := range []string{CsNone, CsFull, CsShrink, CsExtend} {
 		s.checksum = l
 		if l != CsNone {
@@ -211,11 +341,22 @@ func TestChecksum(t *testing.T) {
 			cases[7].expect = false
 		}
 		for _, c := range cases {
+			if c.key == k4 {
+				writeCorrupt(k4data) // corrupted file is removed once detected
+			}
 			if err = check(c.key, c.off, c.size); (err == nil) != c.expect {
 				t.Fatalf("CacheStore check level %s case %+v: %s", l, c, err)
 			}
+			if !c.expect {
+				if _, err = os.Stat(fpath); !os.IsNotExist(err) {
+					t.Fatalf("corrupted cache file %s should be removed: %v", fpath, err)
+				}
+			}
 		}
 	}
+	if n := toFloat64(s.m.cacheCorruptions.WithLabelValues(s.dir)); n != 4 {
+		t.Fatalf("expect 4 corruptions, but got %v", n)
+	}
 }
 
 func TestExpand(t *testing.T) {
@@ -297,3 +438,90 @@ func TestCheckPath(t *testing.T) {
 		}
 	}
 }
+
+func TestRangeCache(t *testing.T) {
+	var es extents
+	es = es.add(100, 200)
+	es = es.add(300, 400)
+	es = es.add(200, 250)
+	if len(es) != 2 || es.bytes() != 250 || !es.covers(120, 250) || es.covers(240, 310) {
+		t.Fatalf("unexpected extents: %v", es)
+	}
+	if es = es.add(50, 500); len(es) != 1 || es.bytes() != 450 {
+		t.Fatalf("unexpected extents: %v", es)
+	}
+
+	dir := t.TempDir()
+	metrics := newCacheManagerMetrics(nil)
+	conf := defaultConf
+	conf.CacheScanInterval = -1 // scan it manually
+	s := newCacheStore(metrics, dir, 1<<30, 1, &conf, nil)
+	key := "chunks/0/0/1_0_1048576"
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	s.flushRange(key, 1000, data[:200])
+	s.flushRange(key, 1200, data[200:])
+	buf := make([]byte, 100)
+	if n, err := s.loadRange(key, buf, 1150); err != nil || n != 100 || !bytes.Equal(buf, data[150:250]) {
+		t.Fatalf("load range: %d %v", n, err)
+	}
+	if _, err := s.loadRange(key, buf, 900); err == nil {
+		t.Fatalf("range out of extents should not be loaded")
+	}
+	if cnt, used := s.stats(); cnt != 1 || used != 300+4096 {
+		t.Fatalf("cache cnt %d used %d", cnt, used)
+	}
+
+	s2 := newCacheStore(metrics, dir, 1<<30, 1, &conf, nil)
+	s2.scanCached()
+	if n, err := s2.loadRange(key, buf, 1200); err != nil || n != 100 || !bytes.Equal(buf, data[200:]) {
+		t.Fatalf("load range after restart: %d %v", n, err)
+	}
+	s2.remove(key)
+	if _, err := os.Stat(s2.rangePath(key)); !os.IsNotExist(err) {
+		t.Fatalf("range cache should be removed: %v", err)
+	}
+}
+
+func TestCacheEncryption(t *testing.T) {
+	dir := t.TempDir()
+	conf := defaultConf
+	conf.CacheScanInterval = -1
+	conf.CacheChecksum = CsFull
+	conf.CacheKey = bytes.Repeat([]byte{1}, 32)
+	s := newCacheStore(newCacheManagerMetrics(nil), dir, 1<<30, 1, &conf, nil)
+	key := "chunks/0/0/1_0_100000"
+	data := make([]byte, 100000)
+	rand.Read(data)
+	if err := s.flushPage(key, s.cachePath(key), data, false); err != nil {
+		t.Fatalf("flush page: %s", err)
+	}
+	raw, _ := os.ReadFile(s.cachePath(key))
+	if len(raw) != len(data)+len(checksum(data)) || bytes.Contains(raw, data[:100]) {
+		t.Fatalf("cache file should be encrypted")
+	}
+	r, err := s.load(key)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	buf := make([]byte, 1000)
+	for _, off := range []int64{0, 7, 32<<10 - 3, 99000} {
+		if n, err := r.ReadAt(buf, off); err != nil || n != len(buf) || !bytes.Equal(buf, data[off:off+1000]) {
+			t.Fatalf("read at %d: %d %v", off, n, err)
+		}
+	}
+	_ = r.Close()
+
+	s.flushRange("chunks/0/0/2_0_100000", 33, data[33:1033])
+	if n, err := s.loadRange("chunks/0/0/2_0_100000", buf[:500], 100); err != nil || !bytes.Equal(buf[:n], data[100:600]) {
+		t.Fatalf("load range: %d %v", n, err)
+	}
+
+	conf.CacheKey = bytes.Repeat([]byte{2}, 32)
+	_ = newCacheStore(newCacheManagerMetrics(nil), dir, 1<<30, 1, &conf, nil)
+	if _, err := os.Stat(s.cachePath(key)); !os.IsNotExist(err) {
+		t.Fatalf("blocks encrypted by another key should be dropped: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// InlineStore keeps the data of small blocks, which is usually the meta engine.
+type InlineStore interface {
+	GetInline(key string) ([]byte, error)
+	SetInline(key string, data []byte) error
+	DeleteInline(key string) error
+}
+
+// inlineStorage keeps the blocks not larger than size in InlineStore instead of object storage,
+// to save the requests and latency for tiny files. Blocks are routed by their original size in key,
+// and it falls back to the other side when not found, so size could be changed at any time.
+type inlineStorage struct {
+	object.ObjectStorage
+	store InlineStore
+	size  int
+}
+
+// NewInlineStorage returns an object storage which keeps small blocks in store.
+func NewInlineStorage(storage object.ObjectStorage, store InlineStore, size int) object.ObjectStorage {
+	return &inlineStorage{storage, store, size}
+}
+
+func (s *inlineStorage) String() string {
+	return fmt.Sprintf("%s(inline<=%d)", s.ObjectStorage, s.size)
+}
+
+func (s *inlineStorage) inlined(key string) bool {
+	n := parseObjOrigSize(key)
+	return n > 0 && n <= s.size
+}
+
+func (s *inlineStorage) getInline(key string, off, limit int64) (io.ReadCloser, error) {
+	data, err := s.store.GetInline(path.Base(key))
+	if err != nil {
+		return nil, err
+	}
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	data = data[off:]
+	if limit >= 0 && limit < int64(len(data)) {
+		data = data[:limit]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *inlineStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if s.inlined(key) {
+		r, err := s.getInline(key, off, limit)
+		if !errors.Is(err, os.ErrNotExist) {
+			return r, err
+		}
+		return s.ObjectStorage.Get(key, off, limit)
+	}
+	r, err := s.ObjectStorage.Get(key, off, limit)
+	if err != nil && parseObjOrigSize(key) > 0 {
+		if ir, e := s.getInline(key, off, limit); e == nil {
+			return ir, nil
+		}
+	}
+	return r, err
+}
+
+func (s *inlineStorage) Put(key string, in io.Reader) error {
+	if !s.inlined(key) {
+		return s.ObjectStorage.Put(key, in)
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	return s.store.SetInline(path.Base(key), data)
+}
+
+// PutWithTags drops the tags of the inlined blocks, since they are not in object storage.
+func (s *inlineStorage) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	if !s.inlined(key) {
+		return object.PutWithTags(s.ObjectStorage, key, in, tags)
+	}
+	return s.Put(key, in)
+}
+
+func (s *inlineStorage) SetTags(key string, tags map[string]string) error {
+	if o, ok := s.ObjectStorage.(object.SupportTagging); ok {
+		return o.SetTags(key, tags)
+	}
+	return utils.ENOTSUP
+}
+
+func (s *inlineStorage) GetTags(key string) (map[string]string, error) {
+	if o, ok := s.ObjectStorage.(object.SupportTagging); ok {
+		return o.GetTags(key)
+	}
+	return nil, utils.ENOTSUP
+}
+
+func (s *inlineStorage) Delete(key string) error {
+	if parseObjOrigSize(key) <= 0 { // not a block
+		return s.ObjectStorage.Delete(key)
+	}
+	err := s.store.DeleteInline(path.Base(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.ObjectStorage.Delete(key)
+	}
+	return err
+}
+
+func (s *inlineStorage) Head(key string) (object.Object, error) {
+	if parseObjOrigSize(key) <= 0 {
+		return s.ObjectStorage.Head(key)
+	}
+	data, err := s.store.GetInline(path.Base(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.ObjectStorage.Head(key)
+	} else if err != nil {
+		return nil, err
+	}
+	return &inlineObj{key, int64(len(data))}, nil
+}
+
+type inlineObj struct {
+	key  string
+	size int64
+}
+
+func (o *inlineObj) Key() string          { return o.key }
+func (o *inlineObj) Size() int64          { return o.size }
+func (o *inlineObj) Mtime() time.Time     { return time.Time{} }
+func (o *inlineObj) IsDir() bool          { return false }
+func (o *inlineObj) IsSymlink() bool      { return false }
+func (o *inlineObj) StorageClass() string { return "" }
@@ -0,0 +1,147 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const journalName = "rawstaging.journal"
+
+// stagingJournal records the staging blocks which are not uploaded yet into a durable file, so
+// they could be recovered in the next start after a crash, and the lost ones (e.g. the staging
+// files are damaged) are reported loudly instead of silently losing acknowledged writes.
+// Every record is a line of "+key" (staged) or "-key" (uploaded or removed), and the file is
+// rewritten with the pending keys when there are too many records.
+type stagingJournal struct {
+	sync.Mutex
+	path    string
+	mode    os.FileMode
+	f       *os.File
+	records int
+	pending map[string]struct{}
+}
+
+func newStagingJournal(path string, mode os.FileMode) *stagingJournal {
+	return &stagingJournal{path: path, mode: mode, pending: make(map[string]struct{})}
+}
+
+// load replays the journal and compacts it, the pending keys are returned.
+func (j *stagingJournal) load() ([]string, error) {
+	j.Lock()
+	defer j.Unlock()
+	fp, err := os.Open(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		s := bufio.NewScanner(fp)
+		for s.Scan() {
+			line := s.Text()
+			if len(line) < 2 || !strings.HasPrefix(line[1:], "chunks/") {
+				continue // torn or damaged record
+			}
+			switch line[0] {
+			case '+':
+				j.pending[line[1:]] = struct{}{}
+			case '-':
+				delete(j.pending, line[1:])
+			}
+		}
+		err = s.Err()
+		_ = fp.Close()
+		if err != nil {
+			logger.Warnf("Read staging journal %s: %s", j.path, err)
+		}
+	}
+	keys := make([]string, 0, len(j.pending))
+	for k := range j.pending {
+		keys = append(keys, k)
+	}
+	return keys, j.rewrite()
+}
+
+// locked
+func (j *stagingJournal) rewrite() error {
+	tmp := j.path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, j.mode)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	for k := range j.pending {
+		_, _ = fmt.Fprintf(w, "+%s\n", k)
+	}
+	if err = w.Flush(); err == nil {
+		err = fp.Sync()
+	}
+	_ = fp.Close()
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if j.f != nil {
+		_ = j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, j.mode)
+	j.records = len(j.pending)
+	return err
+}
+
+// locked
+func (j *stagingJournal) append(op byte, key string) error {
+	if j.f == nil {
+		if err := j.rewrite(); err != nil {
+			return err
+		}
+	}
+	if _, err := j.f.WriteString(string(op) + key + "\n"); err != nil {
+		return err
+	}
+	j.records++
+	if j.records > 2*len(j.pending)+10000 {
+		return j.rewrite()
+	}
+	return j.f.Sync()
+}
+
+// add records a staging block, it should be called after the block is persisted.
+func (j *stagingJournal) add(key string) error {
+	j.Lock()
+	defer j.Unlock()
+	j.pending[key] = struct{}{}
+	return j.append('+', key)
+}
+
+func (j *stagingJournal) remove(key string) {
+	j.Lock()
+	defer j.Unlock()
+	if _, ok := j.pending[key]; !ok {
+		return
+	}
+	delete(j.pending, key)
+	if err := j.append('-', key); err != nil {
+		logger.Warnf("Remove %s from staging journal: %s", key, err)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStagingJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), journalName)
+	j := newStagingJournal(path, 0600)
+	for _, k := range []string{"chunks/0/0/1_0_4", "chunks/0/0/2_0_4", "chunks/0/0/3_0_4"} {
+		if err := j.add(k); err != nil {
+			t.Fatalf("add %s: %s", k, err)
+		}
+	}
+	j.remove("chunks/0/0/2_0_4")
+	// a torn record after crash
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("open journal: %s", err)
+	}
+	_, _ = f.WriteString("-chun")
+	_ = f.Close()
+
+	j = newStagingJournal(path, 0600)
+	keys, err := j.load()
+	if err != nil {
+		t.Fatalf("load journal: %s", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expect 2 pending blocks, but got %v", keys)
+	}
+	if j.records != 2 {
+		t.Fatalf("journal should be compacted into 2 records, but got %d", j.records)
+	}
+	j.remove("chunks/0/0/1_0_4")
+	j.remove("chunks/0/0/3_0_4")
+	if keys, _ = newStagingJournal(path, 0600).load(); len(keys) != 0 {
+		t.Fatalf("expect no pending blocks, but got %v", keys)
+	}
+}
@@ -33,15 +33,17 @@ type memcache struct {
 	capacity int64
 	used     int64
 	pages    map[string]memItem
+	pinned   map[string]struct{}
 	eviction string
 
 	metrics *cacheManagerMetrics
 }
 
-func newMemStore(config *Config, metrics *cacheManagerMetrics) *memcache {
+func newMemStore(config *Config, capacity int64, metrics *cacheManagerMetrics) *memcache {
 	c := &memcache{
-		capacity: config.CacheSize << 20,
+		capacity: capacity,
 		pages:    make(map[string]memItem),
+		pinned:   make(map[string]struct{}),
 		eviction: config.CacheEviction,
 		metrics:  metrics,
 	}
@@ -105,12 +107,19 @@ func (c *memcache) delete(key string, p *Page) {
 func (c *memcache) remove(key string) {
 	c.Lock()
 	defer c.Unlock()
+	delete(c.pinned, key)
 	if item, ok := c.pages[key]; ok {
 		c.delete(key, item.page)
 		logger.Debugf("remove %s from cache", key)
 	}
 }
 
+func (c *memcache) pin(key string) {
+	c.Lock()
+	c.pinned[key] = struct{}{}
+	c.Unlock()
+}
+
 func (c *memcache) load(key string) (ReadCloser, error) {
 	c.Lock()
 	defer c.Unlock()
@@ -129,6 +138,9 @@ func (c *memcache) cleanup() {
 	var now = time.Now()
 	// for each two random keys, then compare the access time, evict the older one
 	for k, v := range c.pages {
+		if _, ok := c.pinned[k]; ok {
+			continue
+		}
 		if cnt == 0 || lastValue.atime.After(v.atime) {
 			lastKey = k
 			lastValue = v
@@ -146,6 +158,25 @@ func (c *memcache) cleanup() {
 	}
 }
 
+func (c *memcache) update(cacheDir string, cacheSize int64) error {
+	if cacheDir != "" && cacheDir != "memory" {
+		return errors.New("cache dir can't be added to memory cache, please mount again")
+	}
+	if c.capacity == 0 {
+		return errors.New("cache is disabled, please mount again")
+	}
+	if cacheSize <= 0 {
+		return errors.New("cache size should be positive")
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.capacity = cacheSize << 20
+	if c.used > c.capacity && c.eviction != "none" {
+		c.cleanup()
+	}
+	return nil
+}
+
 func (c *memcache) stage(key string, data []byte, keepCache bool) (string, error) {
 	return "", errors.New("not supported")
 }
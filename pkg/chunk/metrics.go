@@ -20,13 +20,15 @@ import "github.com/prometheus/client_golang/prometheus"
 
 // CacheManager Metrics
 type cacheManagerMetrics struct {
-	cacheDrops      prometheus.Counter
-	cacheWrites     prometheus.Counter
-	cacheEvicts     prometheus.Counter
-	cacheWriteBytes prometheus.Counter
-	cacheWriteHist  prometheus.Histogram
-	stageBlocks     prometheus.Gauge
-	stageBlockBytes prometheus.Gauge
+	cacheDrops       prometheus.Counter
+	cacheWrites      prometheus.Counter
+	cacheEvicts      prometheus.Counter
+	cachePromotions  prometheus.Counter
+	cacheCorruptions *prometheus.CounterVec
+	cacheWriteBytes  prometheus.Counter
+	cacheWriteHist   prometheus.Histogram
+	stageBlocks      prometheus.Gauge
+	stageBlockBytes  prometheus.Gauge
 }
 
 func newCacheManagerMetrics(reg prometheus.Registerer) *cacheManagerMetrics {
@@ -41,6 +43,8 @@ func (c *cacheManagerMetrics) registerMetrics(reg prometheus.Registerer) {
 		reg.MustRegister(c.cacheDrops)
 		reg.MustRegister(c.cacheWrites)
 		reg.MustRegister(c.cacheEvicts)
+		reg.MustRegister(c.cachePromotions)
+		reg.MustRegister(c.cacheCorruptions)
 		reg.MustRegister(c.cacheWriteHist)
 		reg.MustRegister(c.cacheWriteBytes)
 		reg.MustRegister(c.stageBlocks)
@@ -61,6 +65,14 @@ func (c *cacheManagerMetrics) initMetrics() {
 		Name: "blockcache_evicts",
 		Help: "evicted cache blocks",
 	})
+	c.cachePromotions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blockcache_promotions",
+		Help: "cache blocks promoted into the hotter tier",
+	})
+	c.cacheCorruptions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blockcache_corruptions",
+		Help: "corrupted cache blocks found in each cache dir",
+	}, []string{"cache_dir"})
 	c.cacheWriteBytes = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "blockcache_write_bytes",
 		Help: "write bytes of cached block",
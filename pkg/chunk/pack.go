@@ -0,0 +1,241 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package chunk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+const (
+	packTarget = 16 << 20              // a pack is uploaded when it's larger than this
+	packDelay  = 20 * time.Millisecond // max time to wait for more blocks before uploading a pack
+)
+
+// PackStore keeps the location of packed blocks, which is usually the meta engine.
+type PackStore interface {
+	PackBlocks(pack string, blocks map[string][2]uint32) (int64, error)
+	GetPackedBlock(key string) (string, uint32, uint32, error)
+	UnpackBlock(key string) (string, int64, error)
+}
+
+// packStorage coalesces the blocks not larger than size, which are uploaded at about the same time,
+// into one object under packs/ and keeps their offsets in PackStore, to save the requests and costs
+// of small files. A pack is removed when all the blocks in it are deleted. The blocks written before
+// packing is enabled are still read from their original keys.
+type packStorage struct {
+	object.ObjectStorage
+	store PackStore
+	size  int
+
+	sync.Mutex
+	current *pack // the one collecting blocks
+}
+
+type pack struct {
+	name   string
+	buf    bytes.Buffer
+	blocks map[string][2]uint32
+	tags   map[string]string // the tags shared by all the blocks
+	done   chan struct{}
+	err    error
+}
+
+// NewPackStorage returns an object storage which packs small blocks into larger objects.
+func NewPackStorage(storage object.ObjectStorage, store PackStore, size int) object.ObjectStorage {
+	return &packStorage{ObjectStorage: storage, store: store, size: size}
+}
+
+func (s *packStorage) String() string {
+	return fmt.Sprintf("%s(pack<=%d)", s.ObjectStorage, s.size)
+}
+
+func (s *packStorage) packable(key string) bool {
+	n := parseObjOrigSize(key)
+	return n > 0 && n <= s.size
+}
+
+func (s *packStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if parseObjOrigSize(key) <= 0 {
+		return s.ObjectStorage.Get(key, off, limit)
+	}
+	p, poff, plen, err := s.store.GetPackedBlock(path.Base(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.ObjectStorage.Get(key, off, limit)
+	} else if err != nil {
+		return nil, err
+	}
+	if off >= int64(plen) {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if limit < 0 || off+limit > int64(plen) {
+		limit = int64(plen) - off
+	}
+	return s.ObjectStorage.Get(p, int64(poff)+off, limit)
+}
+
+func (s *packStorage) Head(key string) (object.Object, error) {
+	if parseObjOrigSize(key) <= 0 {
+		return s.ObjectStorage.Head(key)
+	}
+	_, _, plen, err := s.store.GetPackedBlock(path.Base(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.ObjectStorage.Head(key)
+	} else if err != nil {
+		return nil, err
+	}
+	return &inlineObj{key, int64(plen)}, nil
+}
+
+// Put adds the block into current pack, and returns after the pack is uploaded.
+func (s *packStorage) Put(key string, in io.Reader) error {
+	if !s.packable(key) {
+		return s.ObjectStorage.Put(key, in)
+	}
+	return s.add(key, in, nil)
+}
+
+// PutWithTags adds the block into current pack like Put, the pack is tagged with the tags shared
+// by all the blocks in it.
+func (s *packStorage) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	if !s.packable(key) {
+		return object.PutWithTags(s.ObjectStorage, key, in, tags)
+	}
+	return s.add(key, in, tags)
+}
+
+func (s *packStorage) add(key string, in io.Reader, tags map[string]string) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	p := s.current
+	if p == nil {
+		p = &pack{name: "packs/" + uuid.New().String(), blocks: make(map[string][2]uint32), done: make(chan struct{})}
+		p.tags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			p.tags[k] = v
+		}
+		s.current = p
+		time.AfterFunc(packDelay, func() { s.seal(p) })
+	}
+	for k, v := range p.tags {
+		if t, ok := tags[k]; !ok || t != v {
+			delete(p.tags, k)
+		}
+	}
+	p.blocks[path.Base(key)] = [2]uint32{uint32(p.buf.Len()), uint32(len(data))}
+	p.buf.Write(data)
+	full := p.buf.Len() >= packTarget
+	s.Unlock()
+	if full {
+		s.seal(p)
+	}
+	<-p.done
+	return p.err
+}
+
+// seal stops adding blocks into the pack and uploads it.
+func (s *packStorage) seal(p *pack) {
+	s.Lock()
+	if s.current != p {
+		s.Unlock()
+		return
+	}
+	s.current = nil
+	s.Unlock()
+
+	defer close(p.done)
+	if len(p.tags) > 0 {
+		p.err = object.PutWithTags(s.ObjectStorage, p.name, bytes.NewReader(p.buf.Bytes()), p.tags)
+	} else {
+		p.err = s.ObjectStorage.Put(p.name, bytes.NewReader(p.buf.Bytes()))
+	}
+	if p.err != nil {
+		return
+	}
+	refs, err := s.store.PackBlocks(p.name, p.blocks)
+	if err != nil || refs == 0 { // failed or all the blocks were packed before
+		if e := s.ObjectStorage.Delete(p.name); e != nil {
+			logger.Warnf("Delete pack %s: %s", p.name, e)
+		}
+		p.err = err
+		return
+	}
+	logger.Debugf("Packed %d blocks into %s (%d bytes)", len(p.blocks), p.name, p.buf.Len())
+}
+
+// locate returns the key of the object which has the block, which is the pack for a packed block.
+func (s *packStorage) locate(key string) (string, error) {
+	if parseObjOrigSize(key) <= 0 {
+		return key, nil
+	}
+	p, _, _, err := s.store.GetPackedBlock(path.Base(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return key, nil
+	}
+	return p, err
+}
+
+// SetTags sets the tags of the object which has the block, a packed block shares the tags with
+// the other blocks in its pack.
+func (s *packStorage) SetTags(key string, tags map[string]string) error {
+	o, ok := s.ObjectStorage.(object.SupportTagging)
+	if !ok {
+		return utils.ENOTSUP
+	}
+	k, err := s.locate(key)
+	if err != nil {
+		return err
+	}
+	return o.SetTags(k, tags)
+}
+
+func (s *packStorage) GetTags(key string) (map[string]string, error) {
+	o, ok := s.ObjectStorage.(object.SupportTagging)
+	if !ok {
+		return nil, utils.ENOTSUP
+	}
+	k, err := s.locate(key)
+	if err != nil {
+		return nil, err
+	}
+	return o.GetTags(k)
+}
+
+func (s *packStorage) Delete(key string) error {
+	if parseObjOrigSize(key) <= 0 {
+		return s.ObjectStorage.Delete(key)
+	}
+	p, refs, err := s.store.UnpackBlock(path.Base(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.ObjectStorage.Delete(key)
+	} else if err != nil || refs > 0 {
+		return err
+	}
+	return s.ObjectStorage.Delete(p)
+}
@@ -0,0 +1,60 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"context"
+	"fmt"
+)
+
+// CachePolicy tells how the blocks of a file are kept in local cache.
+type CachePolicy uint8
+
+const (
+	CacheNormal  CachePolicy = iota
+	CachePin                 // cached blocks are never evicted
+	CacheExclude             // blocks are never cached
+	CacheDirect              // blocks are never cached, and the page cache of kernel is bypassed
+)
+
+var cachePolicyNames = []string{"normal", "pin", "exclude", "direct"}
+
+func (p CachePolicy) String() string { return cachePolicyNames[p] }
+
+func (p CachePolicy) cacheable() bool { return p != CacheExclude && p != CacheDirect }
+
+// ParseCachePolicy parses the name of a cache policy.
+func ParseCachePolicy(name string) (CachePolicy, error) {
+	for i, n := range cachePolicyNames {
+		if n == name {
+			return CachePolicy(i), nil
+		}
+	}
+	return CacheNormal, fmt.Errorf("invalid cache policy: %q", name)
+}
+
+type cachePolicyKey struct{}
+
+// WithCachePolicy returns a context carrying the cache policy of the blocks to read.
+func WithCachePolicy(ctx context.Context, policy CachePolicy) context.Context {
+	return context.WithValue(ctx, cachePolicyKey{}, policy)
+}
+
+func cachePolicyOf(ctx context.Context) CachePolicy {
+	p, _ := ctx.Value(cachePolicyKey{}).(CachePolicy)
+	return p
+}
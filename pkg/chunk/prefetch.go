@@ -16,7 +16,23 @@
 
 package chunk
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
+
+type prefetchKey struct{}
+
+// WithPrefetch returns a context telling whether the whole block should be fetched into cache
+// after a partial read of it.
+func WithPrefetch(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, prefetchKey{}, enabled)
+}
+
+func prefetchEnabled(ctx context.Context) bool {
+	enabled, ok := ctx.Value(prefetchKey{}).(bool)
+	return !ok || enabled
+}
 
 type prefetcher struct {
 	sync.Mutex
@@ -0,0 +1,135 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"context"
+	"math"
+	"sync"
+)
+
+// IOClass is the priority class of requests to object storage.
+type IOClass uint8
+
+const (
+	ClassForeground IOClass = iota // reads and writes from applications
+	ClassPrefetch                  // prefetch and warmup
+	ClassWriteback                 // uploading of staging blocks
+	ClassCompaction                // compaction of slices
+	numIOClasses
+)
+
+var ioClassNames = [numIOClasses]string{"foreground", "prefetch", "writeback", "compaction"}
+
+// share of slots for each class when all of them are busy
+var ioClassWeights = [numIOClasses]int{8, 4, 2, 1}
+
+func (c IOClass) String() string { return ioClassNames[c] }
+
+type ioClassKey struct{}
+
+// WithIOClass returns a context carrying the priority class of the requests.
+func WithIOClass(ctx context.Context, class IOClass) context.Context {
+	return context.WithValue(ctx, ioClassKey{}, class)
+}
+
+func ioClassOf(ctx context.Context) IOClass {
+	c, _ := ctx.Value(ioClassKey{}).(IOClass)
+	return c
+}
+
+type ioWaiter struct {
+	tag  float64
+	done chan struct{}
+}
+
+// ioScheduler shares a number of slots (concurrent requests) among the classes by weighted fair
+// queueing: when all slots are busy, the waiting requests are tagged with a virtual finish time,
+// which advances by 1/weight for each request of a class, and a released slot is handed over to
+// the one with the smallest tag. So background requests still make progress, but they could not
+// take the slots away from foreground ones. The bandwidth limit is enforced inside the slots, so
+// it's shared in the same way. Zero slots means unlimited.
+type ioScheduler struct {
+	sync.Mutex
+	slots   int
+	busy    int
+	clock   float64               // virtual time of the last handed over request
+	finish  [numIOClasses]float64 // virtual finish time of the last request of each class
+	waiting [numIOClasses][]*ioWaiter
+	nwait   int
+}
+
+func newIOScheduler(slots int) *ioScheduler {
+	return &ioScheduler{slots: slots}
+}
+
+func (s *ioScheduler) acquire(class IOClass) {
+	if s.slots <= 0 {
+		return
+	}
+	s.Lock()
+	if s.busy < s.slots && s.nwait == 0 {
+		s.busy++
+		s.Unlock()
+		return
+	}
+	start := math.Max(s.finish[class], s.clock)
+	s.finish[class] = start + 1/float64(ioClassWeights[class])
+	w := &ioWaiter{s.finish[class], make(chan struct{})}
+	s.waiting[class] = append(s.waiting[class], w)
+	s.nwait++
+	s.Unlock()
+	<-w.done
+}
+
+// tryAcquire returns false if there is no free slot.
+func (s *ioScheduler) tryAcquire() bool {
+	if s.slots <= 0 {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.busy < s.slots && s.nwait == 0 {
+		s.busy++
+		return true
+	}
+	return false
+}
+
+func (s *ioScheduler) release() {
+	if s.slots <= 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	next := -1
+	for c, q := range s.waiting {
+		if len(q) > 0 && (next < 0 || q[0].tag < s.waiting[next][0].tag) {
+			next = c
+		}
+	}
+	if next < 0 {
+		s.busy--
+		return
+	}
+	w := s.waiting[next][0]
+	s.waiting[next][0] = nil
+	s.waiting[next] = s.waiting[next][1:]
+	s.nwait--
+	s.clock = w.tag
+	close(w.done) // hand over the slot
+}
@@ -0,0 +1,87 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIOScheduler(t *testing.T) {
+	s := newIOScheduler(1)
+	s.acquire(ClassForeground)
+	if s.tryAcquire() {
+		t.Fatalf("no slot should be free")
+	}
+
+	var mu sync.Mutex
+	var order []IOClass
+	var wg sync.WaitGroup
+	enqueue := func(class IOClass, n int) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.acquire(class)
+				mu.Lock()
+				order = append(order, class)
+				mu.Unlock()
+				s.release()
+			}()
+			for { // keep the order of arriving
+				s.Lock()
+				queued := len(s.waiting[class])
+				s.Unlock()
+				if queued == i+1 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	enqueue(ClassCompaction, 4)
+	enqueue(ClassForeground, 8)
+	s.release()
+	wg.Wait()
+
+	if len(order) != 12 {
+		t.Fatalf("expect 12 requests, but got %d", len(order))
+	}
+	var fg int
+	for _, c := range order[:9] {
+		if c == ClassForeground {
+			fg++
+		}
+	}
+	if fg != 8 {
+		t.Fatalf("foreground requests should go first, but got %v", order)
+	}
+	if order[len(order)-1] != ClassCompaction {
+		t.Fatalf("background requests should not starve: %v", order)
+	}
+	if !s.tryAcquire() {
+		t.Fatalf("slot should be free")
+	}
+	s.release()
+
+	unlimited := newIOScheduler(0)
+	unlimited.acquire(ClassCompaction)
+	if !unlimited.tryAcquire() {
+		t.Fatalf("unlimited scheduler should never block")
+	}
+}
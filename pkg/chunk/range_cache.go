@@ -0,0 +1,324 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var rangeDir = "rawranges"
+
+var errNotCached = errors.New("not cached")
+
+// rangeCache caches the byte ranges read from a block instead of the whole block,
+// which is much more efficient for random reads on large files.
+type rangeCache interface {
+	cacheRange(key string, off int, p *Page)
+	loadRange(key string, p []byte, off int) (int, error)
+}
+
+type extent struct {
+	off, end uint32
+}
+
+// extents are sorted and never overlap or touch each other.
+type extents []extent
+
+func (es extents) covers(off, end uint32) bool {
+	i := sort.Search(len(es), func(i int) bool { return es[i].end >= end })
+	return i < len(es) && es[i].off <= off
+}
+
+func (es extents) bytes() int64 {
+	var n int64
+	for _, e := range es {
+		n += int64(e.end - e.off)
+	}
+	return n
+}
+
+func (es extents) add(off, end uint32) extents {
+	r := make(extents, 0, len(es)+1)
+	var i int
+	for ; i < len(es) && es[i].end < off; i++ {
+		r = append(r, es[i])
+	}
+	for ; i < len(es) && es[i].off <= end; i++ {
+		if es[i].off < off {
+			off = es[i].off
+		}
+		if es[i].end > end {
+			end = es[i].end
+		}
+	}
+	r = append(r, extent{off, end})
+	return append(r, es[i:]...)
+}
+
+func (es extents) marshal() []byte {
+	buf := make([]byte, len(es)*8)
+	for i, e := range es {
+		binary.BigEndian.PutUint32(buf[i*8:], e.off)
+		binary.BigEndian.PutUint32(buf[i*8+4:], e.end)
+	}
+	return buf
+}
+
+func unmarshalExtents(buf []byte) (extents, bool) {
+	if len(buf)%8 != 0 {
+		return nil, false
+	}
+	es := make(extents, len(buf)/8)
+	for i := range es {
+		es[i].off = binary.BigEndian.Uint32(buf[i*8:])
+		es[i].end = binary.BigEndian.Uint32(buf[i*8+4:])
+		if es[i].off >= es[i].end || i > 0 && es[i].off <= es[i-1].end {
+			return nil, false
+		}
+	}
+	return es, true
+}
+
+type rangeItem struct {
+	exts  extents
+	atime uint32
+}
+
+func (cache *cacheStore) rangePath(key string) string {
+	return filepath.Join(cache.dir, rangeDir, key)
+}
+
+func (cache *cacheStore) cacheRange(key string, off int, p *Page) {
+	if cache.capacity == 0 || cache.rawFull && cache.eviction == "none" {
+		return
+	}
+	k := cache.getCacheKey(key)
+	cache.Lock()
+	defer cache.Unlock()
+	if _, ok := cache.keys[k]; ok {
+		return // the whole block is cached
+	}
+	if it, ok := cache.ranges[k]; ok && it.exts.covers(uint32(off), uint32(off+len(p.Data))) {
+		return
+	}
+	p.Acquire()
+	select {
+	case cache.pending <- pendingFile{key: key, page: p, off: off, ranged: true}:
+		atomic.AddInt64(&cache.totalPages, int64(cap(p.Data)))
+	default:
+		logger.Debugf("Caching queue is full (%s), drop range %d of %s (%d bytes)", cache.dir, off, key, len(p.Data))
+		cache.m.cacheDrops.Add(1)
+		p.Release()
+	}
+}
+
+// flushRange writes the range into a sparse file, then persists the extents of it.
+func (cache *cacheStore) flushRange(key string, off int, data []byte) {
+	path := cache.rangePath(key)
+	cache.createDir(filepath.Dir(path))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, cache.mode)
+	if err != nil {
+		logger.Warnf("Can't create range cache file %s: %s", path, err)
+		return
+	}
+	cache.m.cacheWrites.Add(1)
+	cache.m.cacheWriteBytes.Add(float64(len(data)))
+	if cache.cipher != nil {
+		buf := NewOffPage(len(data))
+		defer buf.Release()
+		copy(buf.Data, data)
+		cache.cipher.xorAt(key, buf.Data, int64(off))
+		data = buf.Data
+	}
+	_, err = f.WriteAt(data, int64(off))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		logger.Warnf("Write range %d of cache file %s: %s", off, path, err)
+		return
+	}
+
+	k := cache.getCacheKey(key)
+	cache.Lock()
+	it, ok := cache.ranges[k]
+	if !ok {
+		it = &rangeItem{}
+		cache.ranges[k] = it
+		cache.used += 4096
+		cache.rangeUsed += 4096
+	}
+	old := it.exts.bytes()
+	it.exts = it.exts.add(uint32(off), uint32(off+len(data)))
+	it.atime = uint32(time.Now().Unix())
+	added := it.exts.bytes() - old
+	cache.used += added
+	cache.rangeUsed += added
+	buf := it.exts.marshal()
+	cache.Unlock()
+
+	tmp := path + ".ext.tmp"
+	if err = os.WriteFile(tmp, buf, cache.mode); err == nil {
+		err = os.Rename(tmp, path+".ext")
+	}
+	if err != nil {
+		logger.Warnf("Write extents of cache file %s: %s", path, err)
+		_ = os.Remove(tmp)
+		cache.removeRange(key)
+		return
+	}
+
+	cache.Lock()
+	if cache.used > cache.capacity && cache.eviction != "none" {
+		cache.cleanup()
+	}
+	cache.Unlock()
+}
+
+func (cache *cacheStore) loadRange(key string, p []byte, off int) (int, error) {
+	k := cache.getCacheKey(key)
+	cache.Lock()
+	it, ok := cache.ranges[k]
+	if !ok || !it.exts.covers(uint32(off), uint32(off+len(p))) {
+		cache.Unlock()
+		return 0, errNotCached
+	}
+	it.atime = uint32(time.Now().Unix())
+	cache.Unlock()
+
+	f, err := os.Open(cache.rangePath(key))
+	if err != nil {
+		cache.removeRange(key)
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(p, int64(off))
+	cache.cipher.xorAt(key, p[:n], int64(off))
+	if err != nil {
+		logger.Warnf("Read range %d of cache file %s: %s", off, f.Name(), err)
+		cache.removeRange(key)
+	}
+	return n, err
+}
+
+// dropRange forgets the cached ranges of the block, returns whether there were any. locked
+func (cache *cacheStore) dropRange(k cacheKey) bool {
+	it, ok := cache.ranges[k]
+	if ok {
+		delete(cache.ranges, k)
+		cache.used -= it.exts.bytes() + 4096
+		cache.rangeUsed -= it.exts.bytes() + 4096
+	}
+	return ok
+}
+
+func (cache *cacheStore) removeRange(key string) {
+	cache.Lock()
+	ok := cache.dropRange(cache.getCacheKey(key))
+	cache.Unlock()
+	if ok {
+		cache.removeRangeFiles(key)
+	}
+}
+
+func (cache *cacheStore) removeRangeFiles(key string) {
+	path := cache.rangePath(key)
+	_ = os.Remove(path + ".ext")
+	_ = os.Remove(path)
+}
+
+// evictRanges evicts cached ranges until they use no more than goal, returns the evicted blocks. locked
+func (cache *cacheStore) evictRanges(goal int64) []cacheKey {
+	var todel []cacheKey
+	var cnt int
+	var lastK cacheKey
+	var lastValue *rangeItem
+	// for each two random blocks, then compare the access time, evict the older one
+	for k, value := range cache.ranges {
+		if cache.rangeUsed <= goal {
+			break
+		}
+		if _, ok := cache.pinned[k]; ok {
+			continue
+		}
+		if cnt == 0 || lastValue.atime > value.atime {
+			lastK = k
+			lastValue = value
+		}
+		cnt++
+		if cnt > 1 {
+			cache.dropRange(lastK)
+			todel = append(todel, lastK)
+			cache.m.cacheEvicts.Add(1)
+			cnt = 0
+		}
+	}
+	return todel
+}
+
+// scanRanges loads the extents of cached ranges, and removes the files without valid extents.
+func (cache *cacheStore) scanRanges() {
+	cache.Lock()
+	cache.ranges = make(map[cacheKey]*rangeItem)
+	cache.rangeUsed = 0
+	cache.Unlock()
+
+	var oneMinAgo = time.Now().Add(-time.Minute)
+	rangePrefix := filepath.Join(cache.dir, rangeDir)
+	_ = filepath.WalkDir(rangePrefix, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		fi, _ := d.Info()
+		if fi == nil || fi.IsDir() || !strings.HasSuffix(path, ".ext") {
+			if fi != nil && fi.ModTime().Before(oneMinAgo) {
+				if fi.IsDir() || strings.HasSuffix(path, ".tmp") {
+					_ = os.Remove(path)
+				} else if _, err := os.Stat(path + ".ext"); os.IsNotExist(err) {
+					_ = os.Remove(path) // written but extents are lost
+				}
+			}
+			return nil
+		}
+		key := strings.TrimSuffix(path[len(rangePrefix)+1:], ".ext")
+		if runtime.GOOS == "windows" {
+			key = strings.ReplaceAll(key, "\\", "/")
+		}
+		buf, err := os.ReadFile(path)
+		es, ok := unmarshalExtents(buf)
+		if st, e := os.Stat(cache.rangePath(key)); err != nil || !ok || len(es) == 0 || e != nil || st.Size() < int64(es[len(es)-1].end) {
+			logger.Warnf("Remove invalid range cache of %s in %s", key, cache.dir)
+			cache.removeRangeFiles(key)
+			return nil
+		}
+		cache.Lock()
+		cache.ranges[cache.getCacheKey(key)] = &rangeItem{es, uint32(getAtime(fi).Unix())}
+		cache.used += es.bytes() + 4096
+		cache.rangeUsed += es.bytes() + 4096
+		cache.Unlock()
+		return nil
+	})
+}
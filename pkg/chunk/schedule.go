@@ -0,0 +1,143 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// limitWindow is a daily time window with its own bandwidth limit.
+type limitWindow struct {
+	start, end int   // minutes since midnight, end is exclusive
+	limit      int64 // bytes per second, 0 means unlimited
+}
+
+func (w limitWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end // crossing midnight
+}
+
+// LimitSchedule is a list of daily windows with bandwidth limits.
+type LimitSchedule []limitWindow
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		if strings.TrimSpace(s) == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ParseLimitSchedule parses a schedule like "09:00-18:00=50,18:00-09:00=0",
+// where each window is followed by its bandwidth limit in Mbps (0 means unlimited).
+// Windows are in local time and may cross midnight; the first matched one wins.
+func ParseLimitSchedule(s string) (LimitSchedule, error) {
+	var schedule LimitSchedule
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		ps := strings.SplitN(item, "=", 2)
+		if len(ps) != 2 {
+			return nil, fmt.Errorf("invalid window %q: expect START-END=LIMIT", item)
+		}
+		ts := strings.SplitN(ps[0], "-", 2)
+		if len(ts) != 2 {
+			return nil, fmt.Errorf("invalid window %q: expect START-END=LIMIT", item)
+		}
+		var w limitWindow
+		var err error
+		if w.start, err = parseClock(ts[0]); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseClock(ts[1]); err != nil {
+			return nil, err
+		}
+		if w.start == w.end {
+			return nil, fmt.Errorf("invalid window %q: empty time range", item)
+		}
+		mbps, err := strconv.ParseInt(strings.TrimSpace(ps[1]), 10, 64)
+		if err != nil || mbps < 0 {
+			return nil, fmt.Errorf("invalid limit %q", ps[1])
+		}
+		w.limit = mbps * 1e6 / 8
+		schedule = append(schedule, w)
+	}
+	return schedule, nil
+}
+
+// at returns the limit of the window covering t, and false if there is none.
+func (s LimitSchedule) at(t time.Time) (int64, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s {
+		if w.contains(minute) {
+			return w.limit, true
+		}
+	}
+	return 0, false
+}
+
+func newLimitBucket(limit int64) *ratelimit.Bucket {
+	if limit <= 0 {
+		return nil
+	}
+	// there are overheads coming from HTTP/TCP/IP
+	return ratelimit.NewBucketWithRate(float64(limit)*0.85, limit)
+}
+
+// applyLimits sets the bandwidth limits for time t: the limit of the matched
+// window in the schedule, or the base one if no window matches.
+func (store *cachedStore) applyLimits(t time.Time) {
+	store.limitMu.Lock()
+	defer store.limitMu.Unlock()
+	upload, download := store.baseUpload, store.baseDownload
+	if l, ok := store.upSchedule.at(t); ok {
+		upload = l
+	}
+	if l, ok := store.downSchedule.at(t); ok {
+		download = l
+	}
+	if upload != store.conf.UploadLimit {
+		logger.Infof("Upload limit changed from %d to %d", store.conf.UploadLimit, upload)
+		store.conf.UploadLimit = upload
+		store.upLimit = newLimitBucket(upload)
+	}
+	if download != store.conf.DownloadLimit {
+		logger.Infof("Download limit changed from %d to %d", store.conf.DownloadLimit, download)
+		store.conf.DownloadLimit = download
+		store.downLimit = newLimitBucket(download)
+	}
+}
+
+func (store *cachedStore) scheduleLimits() {
+	for {
+		now := time.Now()
+		store.applyLimits(now)
+		// wake up at the start of next minute
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+	}
+}
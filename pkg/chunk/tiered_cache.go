@@ -0,0 +1,176 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"errors"
+	"sync"
+)
+
+const maxTrackedKeys = 1 << 20
+
+// tieredCache chains multiple caches from the hottest (memory) to the coldest (e.g. HDD).
+// New blocks are written into the coldest tier, and promoted into the hotter one after they
+// are hit for promoteHits times in a colder tier. The tiers are inclusive, so a block is
+// demoted by being evicted from the hotter tier while the copy in colder tier is still there.
+// Staging blocks (writeback) are always kept in the disk tier next to memory.
+type tieredCache struct {
+	sync.Mutex
+	tiers       []CacheManager // hottest first
+	stager      CacheManager
+	promoteHits int
+	hits        map[string]int
+	metrics     *cacheManagerMetrics
+}
+
+func newTieredCache(tiers []CacheManager, stager CacheManager, promoteHits int, metrics *cacheManagerMetrics) *tieredCache {
+	if promoteHits <= 0 {
+		promoteHits = 2
+	}
+	return &tieredCache{
+		tiers:       tiers,
+		stager:      stager,
+		promoteHits: promoteHits,
+		hits:        make(map[string]int),
+		metrics:     metrics,
+	}
+}
+
+func (c *tieredCache) coldest() CacheManager {
+	return c.tiers[len(c.tiers)-1]
+}
+
+func (c *tieredCache) cache(key string, p *Page, force bool) {
+	c.coldest().cache(key, p, force)
+}
+
+func (c *tieredCache) remove(key string) {
+	c.Lock()
+	delete(c.hits, key)
+	c.Unlock()
+	for _, t := range c.tiers {
+		t.remove(key)
+	}
+}
+
+func (c *tieredCache) pin(key string) {
+	for _, t := range c.tiers {
+		t.pin(key)
+	}
+}
+
+// hit returns true if the block should be promoted.
+func (c *tieredCache) hit(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.hits) >= maxTrackedKeys { // forget the history to bound the memory
+		c.hits = make(map[string]int)
+	}
+	c.hits[key]++
+	if c.hits[key] >= c.promoteHits {
+		delete(c.hits, key)
+		return true
+	}
+	return false
+}
+
+func (c *tieredCache) load(key string) (ReadCloser, error) {
+	for i, t := range c.tiers {
+		r, err := t.load(key)
+		if err != nil {
+			continue
+		}
+		if i == 0 || !c.hit(key) {
+			return r, nil
+		}
+		return c.promote(key, r, c.tiers[i-1]), nil
+	}
+	return nil, errors.New("not found")
+}
+
+// promote copies the block into the hotter tier, r is returned back if it fails.
+func (c *tieredCache) promote(key string, r ReadCloser, to CacheManager) ReadCloser {
+	size := parseObjOrigSize(key)
+	if size <= 0 {
+		return r
+	}
+	p := NewOffPage(size)
+	if n, err := r.ReadAt(p.Data, 0); n != size {
+		logger.Warnf("Read %s for promotion: %d bytes, %v", key, n, err)
+		p.Release()
+		return r
+	}
+	_ = r.Close()
+	to.cache(key, p, false)
+	c.metrics.cachePromotions.Add(1)
+	pr := NewPageReader(p)
+	p.Release()
+	return pr
+}
+
+// ranges are cached in the disk tier next to memory, the same as staging blocks.
+func (c *tieredCache) cacheRange(key string, off int, p *Page) {
+	if rc, ok := c.stager.(rangeCache); ok {
+		rc.cacheRange(key, off, p)
+	}
+}
+
+func (c *tieredCache) loadRange(key string, p []byte, off int) (int, error) {
+	if rc, ok := c.stager.(rangeCache); ok {
+		return rc.loadRange(key, p, off)
+	}
+	return 0, errNotCached
+}
+
+func (c *tieredCache) uploaded(key string, size int) {
+	c.stager.uploaded(key, size)
+}
+
+func (c *tieredCache) stage(key string, data []byte, keepCache bool) (string, error) {
+	return c.stager.stage(key, data, keepCache)
+}
+
+func (c *tieredCache) removeStage(key string) error {
+	return c.stager.removeStage(key)
+}
+
+func (c *tieredCache) stagePath(key string) string {
+	return c.stager.stagePath(key)
+}
+
+// update changes the dirs and size of the tier for staging, the others are not changed.
+func (c *tieredCache) update(cacheDir string, cacheSize int64) error {
+	return c.stager.update(cacheDir, cacheSize)
+}
+
+func (c *tieredCache) stats() (int64, int64) {
+	var cnt, used int64
+	for _, t := range c.tiers {
+		n, u := t.stats()
+		cnt += n
+		used += u
+	}
+	return cnt, used
+}
+
+func (c *tieredCache) usedMemory() int64 {
+	var used int64
+	for _, t := range c.tiers {
+		used += t.usedMemory()
+	}
+	return used
+}
@@ -0,0 +1,330 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioringSetupSQPoll     = 1 << 1
+	ioringFeatSingleMmap  = 1 << 0
+	ioringFeatNonFixed    = 1 << 7 // SQPOLL without registered files, Linux 5.11+
+	ioringOffSQRing       = 0
+	ioringOffCQRing       = 0x8000000
+	ioringOffSQEs         = 0x10000000
+	ioringEnterGetEvents  = 1 << 0
+	ioringEnterSQWakeup   = 1 << 1
+	ioringSQNeedWakeup    = 1 << 0
+	ioringOpRead          = 22 // Linux 5.6+
+	ioringOpWrite         = 23
+	ioringSQThreadIdleMs  = 1000
+	ioringDefaultEntries  = 256
+	ioringSQEBytes        = 64
+	ioringCQEBytes        = 16
+	ioringSQRingArrayElem = 4
+)
+
+type ioringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioringSQOffsets
+	cqOff                                                                  ioringCQOffsets
+}
+
+type ioringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type ioringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring submits the reads and writes of cache files to io_uring. With SQPOLL, the submissions are
+// picked up by a kernel thread without syscalls, and the completions are reaped by one goroutine,
+// so a syscall could complete many requests.
+type uring struct {
+	fd     int
+	sqpoll bool
+	rings  [][]byte
+
+	sqHead, sqTail, sqMask, sqFlags *uint32
+	sqArray                         []uint32
+	sqes                            []ioringSQE
+	cqHead, cqTail, cqMask          *uint32
+	cqes                            []ioringCQE
+
+	sync.Mutex
+	inflight chan struct{} // limits the requests in flight, so the rings never overflow
+	nextID   uint64
+	waiting  map[uint64]chan int32
+}
+
+var (
+	cacheRing     *uring
+	cacheRingOnce sync.Once
+)
+
+// sharedRing returns the io_uring shared by all the cache dirs, or nil if it can't be created.
+func sharedRing() *uring {
+	cacheRingOnce.Do(func() {
+		var err error
+		if cacheRing, err = newURing(ioringDefaultEntries); err != nil {
+			logger.Warnf("Create io_uring for cache: %s, fall back to normal I/O", err)
+		} else {
+			logger.Infof("Read and write cache files through io_uring (SQPOLL: %v)", cacheRing.sqpoll)
+		}
+	})
+	return cacheRing
+}
+
+func ioringSetup(entries uint32, p *ioringParams) (int, error) {
+	fd, _, errno := syscall.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(p)), 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func ioringEnter(fd int, submit, minComplete, flags uint32) error {
+	for {
+		_, _, errno := syscall.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(fd), uintptr(submit), uintptr(minComplete), uintptr(flags), 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+func ptr32(b []byte, off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&b[off]))
+}
+
+// newURing creates an io_uring with SQPOLL if it's permitted, or a normal one otherwise.
+func newURing(entries uint32) (*uring, error) {
+	p := ioringParams{flags: ioringSetupSQPoll, sqThreadIdle: ioringSQThreadIdleMs}
+	fd, err := ioringSetup(entries, &p)
+	if err == nil && p.features&ioringFeatNonFixed == 0 {
+		_ = syscall.Close(fd)
+		err = syscall.EINVAL
+	}
+	if err == syscall.EPERM || err == syscall.EINVAL {
+		p = ioringParams{}
+		fd, err = ioringSetup(entries, &p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("io_uring_setup: %s", err)
+	}
+	r := &uring{fd: fd, sqpoll: p.flags&ioringSetupSQPoll != 0, waiting: make(map[uint64]chan int32)}
+	if err = r.mmap(&p); err != nil {
+		r.close()
+		return nil, err
+	}
+	r.inflight = make(chan struct{}, p.sqEntries)
+	go r.reap()
+	return r, nil
+}
+
+func (r *uring) mmap(p *ioringParams) error {
+	sqSize := int(p.sqOff.array + p.sqEntries*ioringSQRingArrayElem)
+	cqSize := int(p.cqOff.cqes + p.cqEntries*ioringCQEBytes)
+	single := p.features&ioringFeatSingleMmap != 0
+	if single && cqSize > sqSize {
+		sqSize = cqSize
+	}
+	mmap := func(off int64, size int) ([]byte, error) {
+		b, err := unix.Mmap(r.fd, off, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			return nil, fmt.Errorf("mmap io_uring: %s", err)
+		}
+		r.rings = append(r.rings, b)
+		return b, nil
+	}
+	sq, err := mmap(ioringOffSQRing, sqSize)
+	if err != nil {
+		return err
+	}
+	cq := sq
+	if !single {
+		if cq, err = mmap(ioringOffCQRing, cqSize); err != nil {
+			return err
+		}
+	}
+	sqes, err := mmap(ioringOffSQEs, int(p.sqEntries)*ioringSQEBytes)
+	if err != nil {
+		return err
+	}
+	r.sqHead, r.sqTail = ptr32(sq, p.sqOff.head), ptr32(sq, p.sqOff.tail)
+	r.sqMask, r.sqFlags = ptr32(sq, p.sqOff.ringMask), ptr32(sq, p.sqOff.flags)
+	r.sqArray = unsafe.Slice(ptr32(sq, p.sqOff.array), p.sqEntries)
+	r.sqes = unsafe.Slice((*ioringSQE)(unsafe.Pointer(&sqes[0])), p.sqEntries)
+	r.cqHead, r.cqTail, r.cqMask = ptr32(cq, p.cqOff.head), ptr32(cq, p.cqOff.tail), ptr32(cq, p.cqOff.ringMask)
+	r.cqes = unsafe.Slice((*ioringCQE)(unsafe.Pointer(&cq[p.cqOff.cqes])), p.cqEntries)
+	return nil
+}
+
+// close releases the ring before the completions are reaped.
+func (r *uring) close() {
+	for _, b := range r.rings {
+		_ = unix.Munmap(b)
+	}
+	r.rings = nil
+	_ = syscall.Close(r.fd)
+}
+
+// reap dispatches the completions to the waiting requests, it runs until the ring is closed.
+func (r *uring) reap() {
+	for {
+		head := atomic.LoadUint32(r.cqHead)
+		if head == atomic.LoadUint32(r.cqTail) {
+			if err := ioringEnter(r.fd, 0, 1, ioringEnterGetEvents); err != nil {
+				if err != syscall.EBADF {
+					logger.Errorf("Wait for completions of io_uring: %s", err)
+				}
+				return
+			}
+			continue
+		}
+		tail := atomic.LoadUint32(r.cqTail)
+		r.Lock()
+		for ; head != tail; head++ {
+			cqe := &r.cqes[head&*r.cqMask]
+			if ch, ok := r.waiting[cqe.userData]; ok {
+				delete(r.waiting, cqe.userData)
+				ch <- cqe.res
+			}
+		}
+		r.Unlock()
+		atomic.StoreUint32(r.cqHead, head)
+	}
+}
+
+// submit queues one request and returns the result of it, which is the number of bytes or -errno.
+func (r *uring) submit(op uint8, fd int, b []byte, off int64) int32 {
+	if len(b) == 0 {
+		return 0
+	}
+	r.inflight <- struct{}{}
+	defer func() { <-r.inflight }()
+	done := make(chan int32, 1)
+	r.Lock()
+	r.nextID++
+	id := r.nextID
+	r.waiting[id] = done
+	tail := *r.sqTail
+	idx := tail & *r.sqMask
+	r.sqes[idx] = ioringSQE{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&b[0]))),
+		len:      uint32(len(b)),
+		userData: id,
+	}
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	var err error
+	if !r.sqpoll {
+		// submit the ones left by failed calls too
+		err = ioringEnter(r.fd, tail+1-atomic.LoadUint32(r.sqHead), 0, 0)
+	} else if atomic.LoadUint32(r.sqFlags)&ioringSQNeedWakeup != 0 {
+		err = ioringEnter(r.fd, 0, 0, ioringEnterSQWakeup)
+	}
+	r.Unlock()
+	if err != nil {
+		// the request is still in the ring, wait for it to keep the buffer alive
+		logger.Warnf("Submit to io_uring: %s", err)
+	}
+	res := <-done
+	runtime.KeepAlive(b)
+	return res
+}
+
+// pread reads len(b) bytes from the file at offset off like ReadAt, the buffer should not be on stack.
+func (r *uring) pread(f *os.File, b []byte, off int64) (int, error) {
+	var n int
+	for n < len(b) {
+		res := r.submit(ioringOpRead, int(f.Fd()), b[n:], off+int64(n))
+		if res < 0 {
+			runtime.KeepAlive(f)
+			return n, &os.PathError{Op: "read", Path: f.Name(), Err: syscall.Errno(-res)}
+		}
+		if res == 0 {
+			runtime.KeepAlive(f)
+			return n, io.EOF
+		}
+		n += int(res)
+	}
+	runtime.KeepAlive(f)
+	return n, nil
+}
+
+// pwrite writes all the data into the file at offset off like WriteAt.
+func (r *uring) pwrite(f *os.File, b []byte, off int64) (int, error) {
+	var n int
+	for n < len(b) {
+		res := r.submit(ioringOpWrite, int(f.Fd()), b[n:], off+int64(n))
+		if res < 0 {
+			runtime.KeepAlive(f)
+			return n, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.Errno(-res)}
+		}
+		if res == 0 {
+			runtime.KeepAlive(f)
+			return n, io.ErrShortWrite
+		}
+		n += int(res)
+	}
+	runtime.KeepAlive(f)
+	return n, nil
+}
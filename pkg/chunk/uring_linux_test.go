@@ -0,0 +1,111 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestURing(t *testing.T) {
+	r, err := newURing(8)
+	if err != nil {
+		t.Skipf("io_uring is not available: %s", err)
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "ring"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	defer f.Close()
+
+	// more requests than the entries of ring
+	var wg sync.WaitGroup
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if n, err := r.pwrite(f, data[i<<10:(i+1)<<10], int64(i<<10)); err != nil || n != 1<<10 {
+				t.Errorf("pwrite %d: %d %v", i, n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 2000)
+			off := int64(i) * 1000
+			if n, err := r.pread(f, buf, off); err != nil || n != len(buf) || !bytes.Equal(buf, data[off:off+2000]) {
+				t.Errorf("pread %d: %d %v", i, n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	buf := make([]byte, 100)
+	if n, err := r.pread(f, buf, int64(len(data))-10); err != io.EOF || n != 10 || !bytes.Equal(buf[:n], data[len(data)-10:]) {
+		t.Fatalf("pread at the end: %d %v", n, err)
+	}
+	ro, _ := os.Open(f.Name())
+	defer ro.Close()
+	if _, err := r.pwrite(ro, buf, 0); err == nil {
+		t.Fatalf("pwrite into a read-only file should fail")
+	}
+}
+
+func TestCacheIOUring(t *testing.T) {
+	if sharedRing() == nil {
+		t.Skip("io_uring is not available")
+	}
+	conf := defaultConf
+	conf.CacheScanInterval = -1
+	conf.CacheChecksum = CsFull
+	conf.CacheIOUring = true
+	s := newCacheStore(newCacheManagerMetrics(nil), t.TempDir(), 1<<30, 1, &conf, nil)
+	if s.ring == nil {
+		t.Fatalf("io_uring should be used")
+	}
+	key := "chunks/0/0/1_0_100000"
+	data := make([]byte, 100000)
+	rand.Read(data)
+	if err := s.flushPage(key, s.cachePath(key), data, false); err != nil {
+		t.Fatalf("flush page: %s", err)
+	}
+	raw, _ := os.ReadFile(s.cachePath(key))
+	if !bytes.Equal(raw, append(append([]byte(nil), data...), checksum(data)...)) {
+		t.Fatalf("unexpected content of cache file")
+	}
+	r, err := s.load(key)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	defer r.Close()
+	buf := make([]byte, 1000)
+	for _, off := range []int64{0, 7, 32<<10 - 3, 99000} {
+		if n, err := r.ReadAt(buf, off); err != nil || n != len(buf) || !bytes.Equal(buf, data[off:off+1000]) {
+			t.Fatalf("read at %d: %d %v", off, n, err)
+		}
+	}
+}
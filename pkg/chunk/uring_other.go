@@ -0,0 +1,43 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"os"
+	"sync"
+)
+
+// uring is only available on Linux.
+type uring struct{}
+
+var warnRingOnce sync.Once
+
+func sharedRing() *uring {
+	warnRingOnce.Do(func() { logger.Warnf("io_uring is only supported on Linux, fall back to normal I/O") })
+	return nil
+}
+
+func (r *uring) pread(f *os.File, b []byte, off int64) (int, error) {
+	return f.ReadAt(b, off)
+}
+
+func (r *uring) pwrite(f *os.File, b []byte, off int64) (int, error) {
+	return f.WriteAt(b, off)
+}
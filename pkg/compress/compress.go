@@ -27,6 +27,9 @@ import (
 // ZSTD_LEVEL compression level used by Zstd
 const ZSTD_LEVEL = 1 // fastest
 
+// ZSTD_MAX_LEVEL the max compression level of Zstd
+const ZSTD_MAX_LEVEL = 22
+
 // Compressor interface to be implemented by a compression algo
 type Compressor interface {
 	Name() string
@@ -48,6 +51,25 @@ func NewCompressor(algr string) Compressor {
 	return nil
 }
 
+// NewZStandard returns a Zstd compressor with the level (0 means ZSTD_LEVEL) and an optional
+// dictionary, which can be trained from samples of small blocks by `zstd --train`.
+func NewZStandard(level int, dict []byte) (Compressor, error) {
+	if level == 0 {
+		level = ZSTD_LEVEL
+	}
+	if level < 1 || level > ZSTD_MAX_LEVEL {
+		return nil, fmt.Errorf("invalid zstd level %d, it should be in [1, %d]", level, ZSTD_MAX_LEVEL)
+	}
+	if len(dict) == 0 {
+		return ZStandard{level}, nil
+	}
+	p, err := zstd.NewBulkProcessor(dict, level)
+	if err != nil {
+		return nil, fmt.Errorf("load zstd dictionary: %s", err)
+	}
+	return &zstdDict{p}, nil
+}
+
 type noOp struct{}
 
 func (n noOp) Name() string            { return "Noop" }
@@ -96,12 +118,47 @@ func (n ZStandard) Decompress(dst, src []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	return copyInto(dst, d)
+}
+
+// zstdDict implements Compressor using zstd library with a dictionary
+type zstdDict struct {
+	p *zstd.BulkProcessor
+}
+
+func (n *zstdDict) Name() string            { return "Zstd" }
+func (n *zstdDict) CompressBound(l int) int { return zstd.CompressBound(l) }
+
+func (n *zstdDict) Compress(dst, src []byte) (int, error) {
+	d, err := n.p.Compress(dst, src)
+	if err != nil {
+		return 0, err
+	}
 	if len(d) > 0 && len(dst) > 0 && &d[0] != &dst[0] {
-		return 0, fmt.Errorf("buffer too short: %d < %d", len(dst), len(d))
+		return 0, fmt.Errorf("buffer too short: %d < %d", cap(dst), cap(d))
 	}
 	return len(d), err
 }
 
+func (n *zstdDict) Decompress(dst, src []byte) (int, error) {
+	d, err := n.p.Decompress(dst, src)
+	if err != nil {
+		return 0, err
+	}
+	return copyInto(dst, d)
+}
+
+// copyInto moves the decompressed data into dst if zstd had to allocate a new buffer
+func copyInto(dst, d []byte) (int, error) {
+	if len(d) > 0 && (len(dst) == 0 || &d[0] != &dst[0]) {
+		if len(dst) < len(d) {
+			return 0, fmt.Errorf("buffer too short: %d < %d", len(dst), len(d))
+		}
+		copy(dst, d)
+	}
+	return len(d), nil
+}
+
 // LZ4 implements Compressor using LZ4 library
 type LZ4 struct{}
 
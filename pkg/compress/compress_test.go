@@ -19,6 +19,7 @@ package compress
 import (
 	"io"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -71,6 +72,50 @@ func TestZstd(t *testing.T) {
 	testCompress(t, NewCompressor("zstd"))
 }
 
+func TestZstdLevelDict(t *testing.T) {
+	if _, err := NewZStandard(ZSTD_MAX_LEVEL+1, nil); err == nil {
+		t.Fatalf("level %d should be invalid", ZSTD_MAX_LEVEL+1)
+	}
+	c, err := NewZStandard(19, nil)
+	if err != nil {
+		t.Fatalf("create zstd with level 19: %s", err)
+	}
+	testCompress(t, c)
+
+	dict := []byte(strings.Repeat("juicefs is a distributed POSIX file system built on top of Redis and S3. ", 50))
+	src := []byte("juicefs is a distributed POSIX file system built on top of Redis and S3.")
+	size := func(c Compressor) int {
+		dst := make([]byte, c.CompressBound(len(src)))
+		n, err := c.Compress(dst, src)
+		if err != nil {
+			t.Fatalf("compress: %s", err)
+		}
+		buf := make([]byte, len(src))
+		if m, err := c.Decompress(buf, dst[:n]); err != nil || string(buf[:m]) != string(src) {
+			t.Fatalf("decompress: %q %v", buf[:m], err)
+		}
+		return n
+	}
+	d, err := NewZStandard(3, dict)
+	if err != nil {
+		t.Fatalf("create zstd with dictionary: %s", err)
+	}
+	testCompress(t, d)
+	payload := []byte(strings.Repeat("juicefs is a distributed POSIX file system. ", 1000))
+	buf := make([]byte, d.CompressBound(len(payload)))
+	n, err := d.Compress(buf, payload)
+	if err != nil {
+		t.Fatalf("compress with dictionary: %s", err)
+	}
+	out := make([]byte, len(payload))
+	if m, err := d.Decompress(out, buf[:n]); err != nil || string(out[:m]) != string(payload) {
+		t.Fatalf("round trip with dictionary: %d %v", m, err)
+	}
+	if a, b := size(d), size(NewCompressor("zstd")); a >= b {
+		t.Fatalf("compressed size with dictionary %d should be smaller than %d", a, b)
+	}
+}
+
 func TestLZ4(t *testing.T) {
 	testCompress(t, NewCompressor("lz4"))
 }
@@ -0,0 +1,359 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+// Billy returns a billy.Filesystem (used by go-git and others) of the volume, the operations are done
+// with the given context (user and groups). The parent directories are created on demand for new files,
+// as the osfs of billy does.
+func (fs *FileSystem) Billy(ctx meta.Context) billy.Filesystem {
+	return &billyFS{ctx, fs, "/"}
+}
+
+type billyFS struct {
+	ctx  meta.Context
+	fs   *FileSystem
+	root string
+}
+
+func (b *billyFS) abs(name string) (string, error) {
+	p := path.Join(b.root, name)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if b.root != "/" && p != b.root && !strings.HasPrefix(p, b.root+"/") {
+		return "", billy.ErrCrossedBoundary
+	}
+	return p, nil
+}
+
+func (b *billyFS) Create(filename string) (billy.File, error) {
+	return b.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (b *billyFS) Open(filename string) (billy.File, error) {
+	return b.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (b *billyFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	p, err := b.abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	var mode uint32 = vfs.MODE_MASK_R
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		mode = vfs.MODE_MASK_W
+	case os.O_RDWR:
+		mode = vfs.MODE_MASK_R | vfs.MODE_MASK_W
+	}
+	var f *File
+	var eno syscall.Errno
+	if flag&os.O_CREATE != 0 {
+		if eno = b.fs.MkdirAll(b.ctx, parentDir(p), 0755); eno != 0 {
+			return nil, pathError("open", filename, eno)
+		}
+		f, eno = b.fs.Create(b.ctx, p, uint16(perm.Perm()))
+		if eno == syscall.EEXIST && flag&os.O_EXCL == 0 {
+			f, eno = b.fs.Open(b.ctx, p, mode)
+		} else if eno == 0 {
+			f.flags = mode | vfs.MODE_MASK_W
+			flag &^= os.O_TRUNC
+		}
+	} else {
+		f, eno = b.fs.Open(b.ctx, p, mode)
+	}
+	if eno != 0 {
+		return nil, pathError("open", filename, eno)
+	}
+	if f.info.IsDir() && mode&vfs.MODE_MASK_W != 0 {
+		_ = f.Close(b.ctx)
+		return nil, pathError("open", filename, syscall.EISDIR)
+	}
+	if flag&os.O_TRUNC != 0 && mode&vfs.MODE_MASK_W != 0 {
+		if eno = f.Truncate(b.ctx, 0); eno != 0 {
+			_ = f.Close(b.ctx)
+			return nil, pathError("truncate", filename, eno)
+		}
+	}
+	if flag&os.O_APPEND != 0 {
+		_, _ = f.Seek(b.ctx, 0, io.SeekEnd)
+	}
+	return &billyFile{f: f, ctx: b.ctx, name: filename}, nil
+}
+
+func (b *billyFS) Stat(filename string) (os.FileInfo, error) {
+	p, err := b.abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, eno := b.fs.Stat(b.ctx, p)
+	if eno != 0 {
+		return nil, pathError("stat", filename, eno)
+	}
+	return fi, nil
+}
+
+func (b *billyFS) Rename(oldpath, newpath string) error {
+	src, err := b.abs(oldpath)
+	if err != nil {
+		return err
+	}
+	dst, err := b.abs(newpath)
+	if err != nil {
+		return err
+	}
+	if eno := b.fs.MkdirAll(b.ctx, parentDir(dst), 0755); eno != 0 {
+		return pathError("rename", newpath, eno)
+	}
+	return pathError("rename", oldpath, b.fs.Rename(b.ctx, src, dst, 0))
+}
+
+func (b *billyFS) Remove(filename string) error {
+	p, err := b.abs(filename)
+	if err != nil {
+		return err
+	}
+	return pathError("remove", filename, b.fs.Delete(b.ctx, p))
+}
+
+func (b *billyFS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (b *billyFS) TempFile(dir, prefix string) (billy.File, error) {
+	for i := 0; i < 10000; i++ {
+		name := path.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := b.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+	return nil, pathError("createtemp", path.Join(dir, prefix+"*"), syscall.EEXIST)
+}
+
+// ReadDir returns the entries of a directory sorted by name.
+func (b *billyFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	p, err := b.abs(dirname)
+	if err != nil {
+		return nil, err
+	}
+	f, eno := b.fs.Open(b.ctx, p, 0)
+	if eno != 0 {
+		return nil, pathError("readdir", dirname, eno)
+	}
+	defer f.Close(b.ctx)
+	if !f.info.IsDir() {
+		return nil, pathError("readdir", dirname, syscall.ENOTDIR)
+	}
+	fis, eno := f.Readdir(b.ctx, 0)
+	if eno != 0 {
+		return nil, pathError("readdir", dirname, eno)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (b *billyFS) MkdirAll(filename string, perm os.FileMode) error {
+	p, err := b.abs(filename)
+	if err != nil {
+		return err
+	}
+	return pathError("mkdir", filename, b.fs.MkdirAll(b.ctx, p, uint16(perm.Perm())))
+}
+
+func (b *billyFS) Lstat(filename string) (os.FileInfo, error) {
+	p, err := b.abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, eno := b.fs.Lstat(b.ctx, p)
+	if eno != 0 {
+		return nil, pathError("lstat", filename, eno)
+	}
+	return fi, nil
+}
+
+func (b *billyFS) Symlink(target, link string) error {
+	p, err := b.abs(link)
+	if err != nil {
+		return err
+	}
+	if eno := b.fs.MkdirAll(b.ctx, parentDir(p), 0755); eno != 0 {
+		return pathError("symlink", link, eno)
+	}
+	return pathError("symlink", link, b.fs.Symlink(b.ctx, target, p))
+}
+
+func (b *billyFS) Readlink(link string) (string, error) {
+	p, err := b.abs(link)
+	if err != nil {
+		return "", err
+	}
+	target, eno := b.fs.Readlink(b.ctx, p)
+	if eno != 0 {
+		return "", pathError("readlink", link, eno)
+	}
+	return string(target), nil
+}
+
+// lookup returns a File of the path without opening it, which can be used to change its attributes.
+func (b *billyFS) lookup(op, name string, follow bool) (*File, error) {
+	p, err := b.abs(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, eno := b.fs.resolve(b.ctx, p, follow)
+	if eno != 0 {
+		return nil, pathError(op, name, eno)
+	}
+	return &File{path: p, inode: fi.inode, info: fi, fs: b.fs}, nil
+}
+
+func (b *billyFS) Chmod(name string, mode os.FileMode) error {
+	f, err := b.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	return pathError("chmod", name, f.Chmod(b.ctx, uint16(mode.Perm())))
+}
+
+func (b *billyFS) Lchown(name string, uid, gid int) error {
+	f, err := b.lookup("lchown", name, false)
+	if err != nil {
+		return err
+	}
+	return pathError("lchown", name, f.Chown(b.ctx, uint32(uid), uint32(gid)))
+}
+
+func (b *billyFS) Chown(name string, uid, gid int) error {
+	f, err := b.lookup("chown", name, true)
+	if err != nil {
+		return err
+	}
+	return pathError("chown", name, f.Chown(b.ctx, uint32(uid), uint32(gid)))
+}
+
+func (b *billyFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	f, err := b.lookup("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	return pathError("chtimes", name, f.Utime(b.ctx, atime.UnixNano()/1e6, mtime.UnixNano()/1e6))
+}
+
+func (b *billyFS) Chroot(p string) (billy.Filesystem, error) {
+	root, err := b.abs(p)
+	if err != nil {
+		return nil, err
+	}
+	return &billyFS{b.ctx, b.fs, root}, nil
+}
+
+func (b *billyFS) Root() string {
+	return b.root
+}
+
+func (b *billyFS) Capabilities() billy.Capability {
+	return billy.DefaultCapabilities
+}
+
+// billyLockOwner generates the owners of flock, in a range not used by the kernel or share modes.
+var billyLockOwner uint64 = 1 << 62
+
+type billyFile struct {
+	f      *File
+	ctx    meta.Context
+	name   string
+	locked uint64 // the owner of flock
+}
+
+func (f *billyFile) Name() string {
+	return f.name
+}
+
+func (f *billyFile) Read(b []byte) (int, error) {
+	n, err := f.f.Read(f.ctx, b)
+	if err != nil && err != io.EOF {
+		err = pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+func (f *billyFile) ReadAt(b []byte, off int64) (int, error) {
+	return (&ioFile{f.f, f.ctx, f.name}).ReadAt(b, off)
+}
+
+func (f *billyFile) Write(b []byte) (int, error) {
+	n, eno := f.f.Write(f.ctx, b)
+	return n, pathError("write", f.name, eno)
+}
+
+func (f *billyFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(f.ctx, offset, whence)
+}
+
+func (f *billyFile) Truncate(size int64) error {
+	if size < 0 {
+		return pathError("truncate", f.name, syscall.EINVAL)
+	}
+	return pathError("truncate", f.name, f.f.Truncate(f.ctx, uint64(size)))
+}
+
+// Lock acquires an exclusive flock on the file, which is honored by all the clients.
+func (f *billyFile) Lock() error {
+	owner := atomic.AddUint64(&billyLockOwner, 1)
+	if eno := f.f.fs.m.Flock(f.ctx, f.f.inode, owner, meta.F_WRLCK, true); eno != 0 {
+		return pathError("lock", f.name, eno)
+	}
+	f.locked = owner
+	return nil
+}
+
+func (f *billyFile) Unlock() error {
+	if f.locked == 0 {
+		return nil
+	}
+	eno := f.f.fs.m.Flock(f.ctx, f.f.inode, f.locked, meta.F_UNLCK, false)
+	f.locked = 0
+	return pathError("unlock", f.name, eno)
+}
+
+func (f *billyFile) Close() error {
+	_ = f.Unlock()
+	if eno := f.f.Flush(f.ctx); eno != 0 {
+		_ = f.f.Close(f.ctx)
+		return pathError("close", f.name, eno)
+	}
+	return pathError("close", f.name, f.f.Close(f.ctx))
+}
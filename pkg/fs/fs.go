@@ -19,8 +19,10 @@ package fs
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
@@ -56,14 +58,30 @@ func IsNotEmpty(err error) bool {
 	return err == syscall.ENOTEMPTY
 }
 
-func errstr(e error) string {
+// errString is the result of an operation in access log, which is "OK" for success.
+type errString string
+
+func errstr(e error) errString {
 	if e == nil {
 		return "OK"
 	}
 	if eno, ok := e.(syscall.Errno); ok && eno == 0 {
 		return "OK"
 	}
-	return e.Error()
+	return errString(e.Error())
+}
+
+// accessEntry is an access log in JSON format.
+type accessEntry struct {
+	Time    string  `json:"time"`
+	Uid     uint32  `json:"uid"`
+	Gid     uint32  `json:"gid"`
+	Pid     uint32  `json:"pid"`
+	Op      string  `json:"op"`
+	Path    string  `json:"path,omitempty"`
+	Cmd     string  `json:"cmd"`
+	Error   string  `json:"error,omitempty"`
+	Latency float64 `json:"latency"` // in seconds
 }
 
 type FileStat struct {
@@ -108,6 +126,7 @@ func (fs *FileStat) Gid() int         { return int(fs.attr.Gid) }
 
 func (fs *FileStat) Atime() int64 { return fs.attr.Atime*1000 + int64(fs.attr.Atimensec/1e6) }
 func (fs *FileStat) Mtime() int64 { return fs.attr.Mtime*1000 + int64(fs.attr.Mtimensec/1e6) }
+func (fs *FileStat) Btime() int64 { return fs.attr.Btime*1000 + int64(fs.attr.Btimensec/1e6) }
 
 func AttrToFileInfo(inode Ino, attr *Attr) *FileStat {
 	return &FileStat{inode: inode, attr: attr}
@@ -129,6 +148,7 @@ type FileSystem struct {
 	reader vfs.DataReader
 	writer vfs.DataWriter
 	m      meta.Meta
+	store  chunk.ChunkStore
 
 	cacheM          sync.Mutex
 	entries         map[Ino]map[string]*entryCache
@@ -155,12 +175,14 @@ type File struct {
 	wdata    vfs.FileWriter
 	dircache []os.FileInfo
 	entries  []*meta.Entry
+	share    uint64 // owner of share mode
 }
 
 func NewFileSystem(conf *vfs.Config, m meta.Meta, d chunk.ChunkStore) (*FileSystem, error) {
 	reader := vfs.NewDataReader(conf, m, d)
 	fs := &FileSystem{
 		m:               m,
+		store:           d,
 		conf:            conf,
 		reader:          reader,
 		writer:          vfs.NewDataWriter(conf, m, d, reader),
@@ -193,6 +215,9 @@ func NewFileSystem(conf *vfs.Config, m meta.Meta, d chunk.ChunkStore) (*FileSyst
 			logger.Errorf("Open access log %s: %s", conf.AccessLog, err)
 		} else {
 			_ = os.Chmod(conf.AccessLog, 0666)
+			if conf.AccessLogRotate > 0 {
+				fs.rotateAccessLog = conf.AccessLogRotate << 20
+			}
 			fs.logBuffer = make(chan string, 1024)
 			go fs.flushLog(f, fs.logBuffer, conf.AccessLog)
 		}
@@ -267,11 +292,42 @@ func (fs *FileSystem) log(ctx LogContext, format string, args ...interface{}) {
 	if fs.logBuffer == nil {
 		return
 	}
+	var p, errmsg string
+	for _, a := range args {
+		switch a := a.(type) {
+		case string:
+			if p == "" {
+				p = a
+			}
+		case errString:
+			if a != "OK" {
+				errmsg = string(a)
+			}
+		}
+	}
+	// failed operations are always logged
+	if r := fs.conf.AccessLogSample; r > 0 && r < 1 && errmsg == "" && rand.Float64() >= r {
+		return
+	}
 	now := utils.Now()
 	cmd := fmt.Sprintf(format, args...)
 	ts := now.Format("2006.01.02 15:04:05.000000")
-	cmd += fmt.Sprintf(" <%.6f>", used.Seconds())
-	line := fmt.Sprintf("%s [uid:%d,gid:%d,pid:%d] %s\n", ts, ctx.Uid(), ctx.Gid(), ctx.Pid(), cmd)
+	var line string
+	if fs.conf.AccessLogFormat == "json" {
+		op := cmd
+		if i := strings.IndexByte(cmd, ' '); i > 0 {
+			op = cmd[:i]
+		}
+		data, err := json.Marshal(&accessEntry{ts, ctx.Uid(), ctx.Gid(), ctx.Pid(), op, p, cmd, errmsg, used.Seconds()})
+		if err != nil {
+			logger.Warnf("marshal access log: %s", err)
+			return
+		}
+		line = string(data) + "\n"
+	} else {
+		cmd += fmt.Sprintf(" <%.6f>", used.Seconds())
+		line = fmt.Sprintf("%s [uid:%d,gid:%d,pid:%d] %s\n", ts, ctx.Uid(), ctx.Gid(), ctx.Pid(), cmd)
+	}
 	select {
 	case fs.logBuffer <- line:
 	default:
@@ -337,6 +393,12 @@ func (fs *FileSystem) Meta() meta.Meta {
 	return fs.m
 }
 
+// UpdateCache changes the cache dirs and size (in MiB) without re-initializing, empty dirs or zero
+// size means unchanged.
+func (fs *FileSystem) UpdateCache(dirs string, size int64) error {
+	return fs.store.UpdateCache(dirs, size)
+}
+
 func (fs *FileSystem) StatFS(ctx meta.Context) (totalspace uint64, availspace uint64) {
 	defer trace.StartRegion(context.TODO(), "fs.StatFS").End()
 	l := vfs.NewLogContext(ctx)
@@ -566,6 +628,9 @@ func (fs *FileSystem) SetXattr(ctx meta.Context, p string, name string, value []
 	defer trace.StartRegion(context.TODO(), "fs.SetXattr").End()
 	l := vfs.NewLogContext(ctx)
 	defer func() { fs.log(l, "SetXAttr (%s,%s,%d,%d): %s", p, name, len(value), flags, errstr(err)) }()
+	if err = vfs.CheckXattr(ctx, name, true, fs.conf.StrictXattrs); err != 0 {
+		return
+	}
 	fi, err := fs.resolve(ctx, p, true)
 	if err != 0 {
 		return
@@ -578,6 +643,9 @@ func (fs *FileSystem) GetXattr(ctx meta.Context, p string, name string) (result
 	defer trace.StartRegion(context.TODO(), "fs.GetXattr").End()
 	l := vfs.NewLogContext(ctx)
 	defer func() { fs.log(l, "GetXattr (%s,%s): (%d,%s)", p, name, len(result), errstr(err)) }()
+	if err = vfs.CheckXattr(ctx, name, false, false); err != 0 {
+		return
+	}
 	fi, err := fs.resolve(ctx, p, true)
 	if err != 0 {
 		return
@@ -594,7 +662,9 @@ func (fs *FileSystem) ListXattr(ctx meta.Context, p string) (names []byte, err s
 	if err != 0 {
 		return
 	}
-	err = fs.m.ListXattr(ctx, fi.inode, &names)
+	if err = fs.m.ListXattr(ctx, fi.inode, &names); err == 0 {
+		names = vfs.FilterXattrs(ctx, names)
+	}
 	return
 }
 
@@ -602,6 +672,9 @@ func (fs *FileSystem) RemoveXattr(ctx meta.Context, p string, name string) (err
 	defer trace.StartRegion(context.TODO(), "fs.RemoveXattr").End()
 	l := vfs.NewLogContext(ctx)
 	defer func() { fs.log(l, "RemoveXattr (%s,%s): %s", p, name, errstr(err)) }()
+	if err = vfs.CheckXattr(ctx, name, true, false); err != 0 {
+		return
+	}
 	fi, err := fs.resolve(ctx, p, true)
 	if err != 0 {
 		return
@@ -610,6 +683,30 @@ func (fs *FileSystem) RemoveXattr(ctx meta.Context, p string, name string) (err
 	return
 }
 
+func (fs *FileSystem) GetFacl(ctx meta.Context, p string, aclType uint8, rule *meta.ACLRule) (err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.GetFacl").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { fs.log(l, "GetFacl (%s,%d): %s", p, aclType, errstr(err)) }()
+	fi, err := fs.resolve(ctx, p, true)
+	if err != 0 {
+		return
+	}
+	err = fs.m.GetFacl(ctx, fi.inode, aclType, rule)
+	return
+}
+
+func (fs *FileSystem) SetFacl(ctx meta.Context, p string, aclType uint8, rule *meta.ACLRule) (err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.SetFacl").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { fs.log(l, "SetFacl (%s,%d): %s", p, aclType, errstr(err)) }()
+	fi, err := fs.resolve(ctx, p, true)
+	if err != 0 {
+		return
+	}
+	err = fs.m.SetFacl(ctx, fi.inode, aclType, rule)
+	return
+}
+
 func (fs *FileSystem) lookup(ctx meta.Context, parent Ino, name string, inode *Ino, attr *Attr) (err syscall.Errno) {
 	now := time.Now()
 	if fs.conf.DirEntryTimeout > 0 || fs.conf.EntryTimeout > 0 {
@@ -644,6 +741,9 @@ func (fs *FileSystem) lookup(ctx meta.Context, parent Ino, name string, inode *I
 	}
 
 	err = fs.m.Lookup(ctx, parent, name, inode, attr, false)
+	if err == syscall.ENOENT && fs.conf.CaseInsensitive {
+		_, err = fs.lookupFold(ctx, parent, name, inode, attr)
+	}
 	if err == 0 && (fs.conf.DirEntryTimeout > 0 && attr.Typ == meta.TypeDirectory || fs.conf.EntryTimeout > 0 && attr.Typ != meta.TypeDirectory) {
 		fs.cacheM.Lock()
 		if fs.conf.AttrTimeout > 0 {
@@ -666,6 +766,50 @@ func (fs *FileSystem) lookup(ctx meta.Context, parent Ino, name string, inode *I
 	return err
 }
 
+// lookupFold finds the entry whose name is equal to the given one under case-folding, and returns the stored name.
+func (fs *FileSystem) lookupFold(ctx meta.Context, parent Ino, name string, inode *Ino, attr *Attr) (string, syscall.Errno) {
+	e := fs.m.ResolveCase(ctx, parent, name)
+	if e == nil {
+		return "", syscall.ENOENT
+	}
+	*inode = e.Inode
+	return string(e.Name), fs.m.GetAttr(ctx, e.Inode, attr)
+}
+
+// CanonicalPath returns the path with the names stored in meta, which may be different from the given
+// one in case for case-insensitive mounts. The names after a symlink are kept as they are.
+func (fs *FileSystem) CanonicalPath(ctx meta.Context, p string) (string, syscall.Errno) {
+	parent := Ino(1)
+	var attr Attr
+	var names []string
+	ss := strings.Split(p, "/")
+	for i, name := range ss {
+		if len(name) == 0 {
+			continue
+		}
+		if parent == meta.RootInode && i == len(ss)-1 && vfs.IsSpecialName(name) {
+			names = append(names, name)
+			break
+		}
+		var inode Ino
+		st := fs.m.Lookup(ctx, parent, name, &inode, &attr, false)
+		// meta looks up the folded names by itself for case-insensitive volume, so the stored name is resolved again
+		if fs.conf.CaseInsensitive && (st == syscall.ENOENT || st == 0 && fs.m.GetFormat().CaseInsensitive) {
+			name, st = fs.lookupFold(ctx, parent, name, &inode, &attr)
+		}
+		if st != 0 {
+			return "", st
+		}
+		names = append(names, name)
+		if attr.Typ == meta.TypeSymlink {
+			names = append(names, ss[i+1:]...)
+			break
+		}
+		parent = inode
+	}
+	return "/" + strings.Join(names, "/"), 0
+}
+
 func (fs *FileSystem) resolve(ctx meta.Context, p string, followLastSymlink bool) (fi *FileStat, err syscall.Errno) {
 	var inode Ino
 	var attr = &Attr{}
@@ -1005,6 +1149,45 @@ func (f *File) Fsync(ctx meta.Context) (err syscall.Errno) {
 	return
 }
 
+// Truncate changes the length of the opened file, as ftruncate(2).
+func (f *File) Truncate(ctx meta.Context, length uint64) (err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.Ftruncate").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { f.fs.log(l, "Ftruncate (%s,%d): %s", f.path, length, errstr(err)) }()
+	if f.flags&vfs.MODE_MASK_W == 0 {
+		return syscall.EBADF
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.wdata != nil {
+		if err = f.wdata.Flush(ctx); err != 0 {
+			return
+		}
+	}
+	var attr Attr
+	if err = f.fs.m.Truncate(ctx, f.inode, 0, length, &attr, true); err != 0 {
+		return
+	}
+	f.fs.writer.Truncate(f.inode, length)
+	f.fs.reader.Truncate(f.inode, length)
+	f.info.attr.Length = length
+	f.fs.invalidateAttr(f.inode)
+	return
+}
+
+// SetShareMode sets the share mode of the opened file, see vfs.SetShareMode.
+func (f *File) SetShareMode(ctx meta.Context, access, deny uint8) (err syscall.Errno) {
+	l := vfs.NewLogContext(ctx)
+	defer func() { f.fs.log(l, "SetShareMode (%s,%d,%d): %s", f.path, access, deny, errstr(err)) }()
+	f.Lock()
+	defer f.Unlock()
+	if f.flags == 0 || f.info.IsDir() || f.share != 0 {
+		return syscall.EINVAL
+	}
+	f.share, err = vfs.AcquireShareMode(ctx, f.fs.m, f.inode, access, deny)
+	return
+}
+
 func (f *File) Close(ctx meta.Context) (err syscall.Errno) {
 	l := vfs.NewLogContext(ctx)
 	defer func() { f.fs.log(l, "Close (%s): %s", f.path, errstr(err)) }()
@@ -1023,6 +1206,10 @@ func (f *File) Close(ctx meta.Context) (err syscall.Errno) {
 			err = f.wdata.Close(meta.Background)
 			f.wdata = nil
 		}
+		if f.share != 0 {
+			vfs.ReleaseShareMode(ctx, f.fs.m, f.inode, f.share)
+			f.share = 0
+		}
 		_ = f.fs.m.Close(ctx, f.inode)
 	}
 	return
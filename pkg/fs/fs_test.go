@@ -17,17 +17,22 @@
 package fs
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
+	iofs "io/fs"
 	"os"
 	"sort"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // mutate_test_job_number: 5
@@ -270,13 +275,16 @@ func TestFileSystem(t *testing.T) {
 }
 
 func createTestFS(t *testing.T) *FileSystem {
-	m := meta.NewClient("memkv://", nil)
-	format := &meta.Format{
+	return newTestFS(t, &meta.Format{
 		Name:      "test",
 		BlockSize: 4096,
 		Capacity:  1 << 30,
 		DirStats:  true,
-	}
+	})
+}
+
+func newTestFS(t *testing.T, format *meta.Format) *FileSystem {
+	m := meta.NewClient("memkv://", nil)
 	_ = m.Init(format, true)
 	var conf = vfs.Config{
 		Meta: meta.DefaultConf(),
@@ -300,3 +308,275 @@ func createTestFS(t *testing.T) *FileSystem {
 	}
 	return jfs
 }
+
+func TestAccessLogJSON(t *testing.T) {
+	jfs := &FileSystem{
+		conf:                  &vfs.Config{AccessLogFormat: "json", AccessLogSample: 1e-9},
+		logBuffer:             make(chan string, 10),
+		opsDurationsHistogram: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test"}),
+	}
+	ctx := vfs.NewLogContext(meta.NewContext(10, 1, []uint32{2}))
+	for i := 0; i < 5; i++ {
+		jfs.log(ctx, "Open (%s,%d): %s", "/ok", 0, errstr(nil))
+	}
+	jfs.log(ctx, "Open (%s,%d): %s", "/f", 0, errstr(syscall.ENOENT))
+	var line string
+	select {
+	case line = <-jfs.logBuffer:
+	default:
+		t.Fatalf("failed operation should be logged")
+	}
+	var e accessEntry
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatalf("invalid access log %q: %s", line, err)
+	}
+	if e.Op != "Open" || e.Path != "/f" || e.Error != syscall.ENOENT.Error() || e.Uid != 1 || e.Gid != 2 || e.Pid != 10 {
+		t.Fatalf("unexpected access log: %+v", e)
+	}
+	if len(jfs.logBuffer) != 0 {
+		t.Fatalf("successful operations should be sampled")
+	}
+}
+
+func TestXattrNamespaces(t *testing.T) {
+	fs := createTestFS(t)
+	ctx := meta.NewContext(1, 1, []uint32{2})
+	f, e := fs.Create(ctx, "/xattrs", 0644)
+	if e != 0 {
+		t.Fatalf("create /xattrs: %s", e)
+	}
+	_ = f.Close(ctx)
+	if e := fs.SetXattr(ctx, "/xattrs", "user.k", []byte("value"), 0); e != 0 {
+		t.Fatalf("setxattr user.k: %s", e)
+	}
+	if e := fs.SetXattr(ctx, "/xattrs", "trusted.k", []byte("value"), 0); e != syscall.EPERM {
+		t.Fatalf("setxattr trusted.k by normal user: %s", e)
+	}
+	if e := fs.SetXattr(meta.Background, "/xattrs", "trusted.k", []byte("value"), 0); e != 0 {
+		t.Fatalf("setxattr trusted.k by root: %s", e)
+	}
+	if names, e := fs.ListXattr(ctx, "/xattrs"); e != 0 || string(names) != "user.k\x00" {
+		t.Fatalf("listxattr by normal user: %s %+v", e, names)
+	}
+	if _, e := fs.GetXattr(ctx, "/xattrs", "trusted.k"); e != meta.ENOATTR {
+		t.Fatalf("getxattr trusted.k by normal user: %s", e)
+	}
+	if e := fs.RemoveXattr(meta.Background, "/xattrs", "trusted.k"); e != 0 {
+		t.Fatalf("removexattr trusted.k: %s", e)
+	}
+}
+
+func TestStrictXattrs(t *testing.T) {
+	fs := createTestFS(t)
+	ctx := meta.NewContext(1, 1, []uint32{2})
+	f, e := fs.Create(ctx, "/xattrs", 0644)
+	if e != 0 {
+		t.Fatalf("create /xattrs: %s", e)
+	}
+	_ = f.Close(ctx)
+	if e := fs.SetXattr(ctx, "/xattrs", "k", []byte("value"), 0); e != 0 {
+		t.Fatalf("setxattr without namespace: %s", e)
+	}
+	fs.conf.StrictXattrs = true
+	if e := fs.SetXattr(ctx, "/xattrs", "k2", []byte("value"), 0); e != syscall.ENOTSUP {
+		t.Fatalf("setxattr without namespace (strict): %s", e)
+	}
+	if e := fs.SetXattr(ctx, "/xattrs", "user.k", []byte("value"), 0); e != 0 {
+		t.Fatalf("setxattr user.k (strict): %s", e)
+	}
+	if v, e := fs.GetXattr(ctx, "/xattrs", "k"); e != 0 || string(v) != "value" {
+		t.Fatalf("getxattr without namespace (strict): %s %s", e, string(v))
+	}
+	if e := fs.RemoveXattr(ctx, "/xattrs", "k"); e != 0 {
+		t.Fatalf("removexattr without namespace (strict): %s", e)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	fs := createTestFS(t)
+	ctx := meta.NewContext(1, 0, []uint32{0})
+	if e := fs.Mkdir(ctx, "/Docs", 0755); e != 0 {
+		t.Fatalf("mkdir /Docs: %s", e)
+	}
+	if f, e := fs.Create(ctx, "/Docs/ReadMe.txt", 0644); e != 0 {
+		t.Fatalf("create /Docs/ReadMe.txt: %s", e)
+	} else {
+		_ = f.Close(ctx)
+	}
+	if _, e := fs.Stat(ctx, "/docs/readme.TXT"); e != syscall.ENOENT {
+		t.Fatalf("stat in case-sensitive mount: %s", e)
+	}
+	fs.conf.CaseInsensitive = true
+	if fi, e := fs.Stat(ctx, "/docs/readme.TXT"); e != 0 || fi.Size() != 0 {
+		t.Fatalf("stat in case-insensitive mount: %s", e)
+	}
+	if p, e := fs.CanonicalPath(ctx, "/DOCS/readme.txt"); e != 0 || p != "/Docs/ReadMe.txt" {
+		t.Fatalf("canonical path: %s %s", p, e)
+	}
+	if _, e := fs.CanonicalPath(ctx, "/docs/missing"); e != syscall.ENOENT {
+		t.Fatalf("canonical path of missing file: %s", e)
+	}
+}
+
+func TestCaseInsensitiveVolume(t *testing.T) {
+	fs := newTestFS(t, &meta.Format{
+		Name:            "test",
+		BlockSize:       4096,
+		CaseInsensitive: true, // the names are indexed by the folded ones
+	})
+	if _, err := fs.m.Load(true); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	ctx := meta.NewContext(1, 0, []uint32{0})
+	if e := fs.Mkdir(ctx, "/Docs", 0755); e != 0 {
+		t.Fatalf("mkdir /Docs: %s", e)
+	}
+	if f, e := fs.Create(ctx, "/Docs/ReadMe.txt", 0644); e != 0 {
+		t.Fatalf("create /Docs/ReadMe.txt: %s", e)
+	} else {
+		_ = f.Close(ctx)
+	}
+	fs.conf.CaseInsensitive = true
+	if p, e := fs.CanonicalPath(ctx, "/docs/README.TXT"); e != 0 || p != "/Docs/ReadMe.txt" {
+		t.Fatalf("canonical path: %s %s", p, e)
+	}
+	if _, e := fs.Stat(ctx, "/DOCS/readme.txt"); e != 0 {
+		t.Fatalf("stat: %s", e)
+	}
+}
+
+func TestIOFS(t *testing.T) {
+	fs := createTestFS(t)
+	ctx := meta.NewContext(1, 0, []uint32{0})
+	if e := fs.Mkdir(ctx, "/d", 0755); e != 0 {
+		t.Fatalf("mkdir /d: %s", e)
+	}
+	for _, name := range []string{"/d/b", "/d/a", "/d/c"} {
+		f, e := fs.Create(ctx, name, 0644)
+		if e != 0 {
+			t.Fatalf("create %s: %s", name, e)
+		}
+		if _, e = f.Write(ctx, []byte("hello "+name)); e != 0 {
+			t.Fatalf("write %s: %s", name, e)
+		}
+		_ = f.Close(ctx)
+	}
+
+	fsys := fs.IOFS(ctx)
+	if data, err := iofs.ReadFile(fsys, "d/a"); err != nil || string(data) != "hello /d/a" {
+		t.Fatalf("read file d/a: %q %v", data, err)
+	}
+	if _, err := iofs.Stat(fsys, "d/missing"); !errors.Is(err, iofs.ErrNotExist) {
+		t.Fatalf("stat d/missing: %v", err)
+	}
+	if _, err := fsys.Open("/d"); !errors.Is(err, iofs.ErrInvalid) {
+		t.Fatalf("open /d: %v", err)
+	}
+	entries, err := iofs.ReadDir(fsys, "d")
+	if err != nil || len(entries) != 3 || entries[0].Name() != "a" || entries[2].Name() != "c" {
+		t.Fatalf("readdir d: %v %v", entries, err)
+	}
+	d, err := fsys.Open("d")
+	if err != nil {
+		t.Fatalf("open d: %v", err)
+	}
+	defer d.Close()
+	dir := d.(iofs.ReadDirFile)
+	var names []string
+	for {
+		es, err := dir.ReadDir(2)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("readdir d: %v", err)
+		}
+		for _, e := range es {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) != 3 {
+		t.Fatalf("readdir d by pages: %v", names)
+	}
+	var found []string
+	err = iofs.WalkDir(fsys, "d", func(path string, d iofs.DirEntry, err error) error {
+		found = append(found, path)
+		return err
+	})
+	if err != nil || len(found) != 4 {
+		t.Fatalf("walk: %v %v", found, err)
+	}
+}
+
+func TestBilly(t *testing.T) {
+	fs := createTestFS(t)
+	ctx := meta.NewContext(1, 0, []uint32{0})
+	b := fs.Billy(ctx)
+
+	f, err := b.Create("a/b/file")
+	if err != nil {
+		t.Fatalf("create a/b/file: %s", err)
+	}
+	if _, err = f.Write([]byte("hello world")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err = f.Truncate(5); err != nil {
+		t.Fatalf("truncate: %s", err)
+	}
+	if err = f.Lock(); err != nil {
+		t.Fatalf("lock: %s", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if fi, err := b.Stat("a/b/file"); err != nil || fi.Size() != 5 {
+		t.Fatalf("stat a/b/file: %v %s", fi, err)
+	}
+
+	f, err = b.OpenFile("a/b/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open for append: %s", err)
+	}
+	_, _ = f.Write([]byte("!"))
+	_ = f.Close()
+	f, err = b.Open("a/b/file")
+	if err != nil {
+		t.Fatalf("open a/b/file: %s", err)
+	}
+	buf := make([]byte, 10)
+	if n, err := f.ReadAt(buf, 0); err != io.EOF || string(buf[:n]) != "hello!" {
+		t.Fatalf("read a/b/file: %q %v", buf[:n], err)
+	}
+	_ = f.Close()
+	if _, err = b.OpenFile("a/b/file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Fatalf("create existed file exclusively: %v", err)
+	}
+
+	if err = b.Rename("a/b/file", "c/file"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	tmp, err := b.TempFile("c", "tmp")
+	if err != nil {
+		t.Fatalf("temp file: %s", err)
+	}
+	_ = tmp.Close()
+	if fis, err := b.ReadDir("c"); err != nil || len(fis) != 2 || fis[0].Name() != "file" {
+		t.Fatalf("readdir c: %v %v", fis, err)
+	}
+
+	c, err := b.Chroot("c")
+	if err != nil {
+		t.Fatalf("chroot c: %s", err)
+	}
+	if _, err = c.Stat("file"); err != nil {
+		t.Fatalf("stat file in chroot: %s", err)
+	}
+	if _, err = c.Stat("../a"); err != billy.ErrCrossedBoundary {
+		t.Fatalf("stat ../a in chroot: %v", err)
+	}
+	if err = b.Remove("c/file"); err != nil {
+		t.Fatalf("remove c/file: %s", err)
+	}
+	if _, err = b.Stat("c/file"); !os.IsNotExist(err) {
+		t.Fatalf("stat removed file: %v", err)
+	}
+}
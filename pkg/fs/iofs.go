@@ -0,0 +1,184 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"io"
+	iofs "io/fs"
+	"sort"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+// IOFS returns a read-only io/fs.FS of the volume, the operations are done with the given context
+// (user and groups). The names are slash-separated paths relative to the root, as required by io/fs.
+func (fs *FileSystem) IOFS(ctx meta.Context) iofs.FS {
+	return &ioFS{ctx, fs}
+}
+
+type ioFS struct {
+	ctx meta.Context
+	fs  *FileSystem
+}
+
+func pathError(op, name string, err error) error {
+	if eno, ok := err.(syscall.Errno); ok && eno == 0 {
+		return nil
+	}
+	return &iofs.PathError{Op: op, Path: name, Err: econv(err)}
+}
+
+func (f *ioFS) abs(op, name string) (string, error) {
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	if name == "." {
+		return "/", nil
+	}
+	return "/" + name, nil
+}
+
+func (f *ioFS) Open(name string) (iofs.File, error) {
+	p, err := f.abs("open", name)
+	if err != nil {
+		return nil, err
+	}
+	fh, eno := f.fs.Open(f.ctx, p, vfs.MODE_MASK_R)
+	if eno != 0 {
+		return nil, pathError("open", name, eno)
+	}
+	return &ioFile{fh, f.ctx, name}, nil
+}
+
+func (f *ioFS) Stat(name string) (iofs.FileInfo, error) {
+	p, err := f.abs("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, eno := f.fs.Stat(f.ctx, p)
+	if eno != 0 {
+		return nil, pathError("stat", name, eno)
+	}
+	return fi, nil
+}
+
+func (f *ioFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.(*ioFile).ReadDir(-1)
+}
+
+func (f *ioFS) ReadFile(name string) ([]byte, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &iofs.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	data := make([]byte, 0, fi.Size())
+	buf := make([]byte, 1<<17)
+	for {
+		n, err := file.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			return data, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ioFile implements io/fs.File, io/fs.ReadDirFile, io.Seeker and io.ReaderAt.
+type ioFile struct {
+	f    *File
+	ctx  meta.Context
+	name string
+}
+
+func (f *ioFile) Stat() (iofs.FileInfo, error) {
+	return f.f.Stat()
+}
+
+func (f *ioFile) Read(b []byte) (int, error) {
+	if f.f.info.IsDir() {
+		return 0, &iofs.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	n, err := f.f.Read(f.ctx, b)
+	if err != nil && err != io.EOF {
+		err = pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+func (f *ioFile) ReadAt(b []byte, off int64) (int, error) {
+	var got int
+	for got < len(b) {
+		n, err := f.f.Pread(f.ctx, b[got:], off+int64(got))
+		got += n
+		if err == io.EOF {
+			return got, err
+		} else if err != nil {
+			return got, pathError("read", f.name, err)
+		}
+		if n == 0 {
+			return got, io.EOF
+		}
+	}
+	return got, nil
+}
+
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(f.ctx, offset, whence)
+}
+
+// ReadDir follows the semantics of io/fs.ReadDirFile: with n > 0, it returns at most n entries and
+// io.EOF at the end of directory, otherwise all the remaining entries sorted by name.
+func (f *ioFile) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if !f.f.info.IsDir() {
+		return nil, &iofs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	fis, eno := f.f.Readdir(f.ctx, n)
+	if eno != 0 {
+		return nil, pathError("readdir", f.name, eno)
+	}
+	if n > 0 && len(fis) == 0 {
+		return nil, io.EOF
+	}
+	entries := make([]iofs.DirEntry, len(fis))
+	for i, fi := range fis {
+		entries[i] = iofs.FileInfoToDirEntry(fi)
+	}
+	if n <= 0 {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+	return entries, nil
+}
+
+func (f *ioFile) Close() error {
+	return pathError("close", f.name, f.f.Close(f.ctx))
+}
@@ -18,9 +18,11 @@ package fuse
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -36,8 +38,9 @@ var logger = utils.GetLogger("juicefs")
 
 type fileSystem struct {
 	fuse.RawFileSystem
-	conf *vfs.Config
-	v    *vfs.VFS
+	conf   *vfs.Config
+	v      *vfs.VFS
+	xattrs bool // support extended attributes other than POSIX ACLs
 }
 
 func newFileSystem(conf *vfs.Config, v *vfs.VFS) *fileSystem {
@@ -116,6 +119,13 @@ func (fs *fileSystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *f
 	return 0
 }
 
+// Access checks the permission for access(2), which is not checked by the kernel without default_permissions.
+func (fs *fileSystem) Access(cancel <-chan struct{}, in *fuse.AccessIn) (code fuse.Status) {
+	ctx := fs.newContext(cancel, &in.InHeader)
+	defer releaseContext(ctx)
+	return fuse.Status(fs.v.Access(ctx, Ino(in.NodeId), int(in.Mask)))
+}
+
 func (fs *fileSystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string, out *fuse.EntryOut) (code fuse.Status) {
 	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
@@ -184,7 +194,15 @@ func (fs *fileSystem) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (o
 	return path, fuse.Status(err)
 }
 
+// isACLXattr returns true if the extended attribute keeps POSIX ACL.
+func isACLXattr(name string) bool {
+	return name == "system.posix_acl_access" || name == "system.posix_acl_default"
+}
+
 func (fs *fileSystem) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (sz uint32, code fuse.Status) {
+	if !fs.xattrs && !isACLXattr(attr) {
+		return 0, fuse.Status(syscall.ENOTSUP)
+	}
 	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
 	value, err := fs.v.GetXattr(ctx, Ino(header.NodeId), attr, uint32(len(dest)))
@@ -198,6 +216,23 @@ func (fs *fileSystem) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, at
 func (fs *fileSystem) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
 	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
+	if !fs.xattrs {
+		data, err := fs.v.ListXattr(ctx, Ino(header.NodeId), 0)
+		if err != 0 {
+			return 0, fuse.Status(err)
+		}
+		var acls []byte
+		for _, name := range strings.Split(string(data), "\x00") {
+			if isACLXattr(name) {
+				acls = append(acls, name+"\x00"...)
+			}
+		}
+		if len(dest) > 0 && len(acls) > len(dest) {
+			return 0, fuse.Status(syscall.ERANGE)
+		}
+		copy(dest, acls)
+		return uint32(len(acls)), 0
+	}
 	data, err := fs.v.ListXattr(ctx, Ino(header.NodeId), len(dest))
 	if err != 0 {
 		return 0, fuse.Status(err)
@@ -207,6 +242,9 @@ func (fs *fileSystem) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, d
 }
 
 func (fs *fileSystem) SetXAttr(cancel <-chan struct{}, in *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if !fs.xattrs && !isACLXattr(attr) {
+		return fuse.Status(syscall.ENOTSUP)
+	}
 	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	err := fs.v.SetXattr(ctx, Ino(in.NodeId), attr, data, in.Flags)
@@ -214,6 +252,9 @@ func (fs *fileSystem) SetXAttr(cancel <-chan struct{}, in *fuse.SetXAttrIn, attr
 }
 
 func (fs *fileSystem) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) (code fuse.Status) {
+	if !fs.xattrs && !isACLXattr(attr) {
+		return fuse.Status(syscall.ENOTSUP)
+	}
 	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
 	err := fs.v.RemoveXattr(ctx, Ino(header.NodeId), attr)
@@ -223,11 +264,29 @@ func (fs *fileSystem) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader,
 func (fs *fileSystem) Create(cancel <-chan struct{}, in *fuse.CreateIn, name string, out *fuse.CreateOut) (code fuse.Status) {
 	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
-	entry, fh, err := fs.v.Create(ctx, Ino(in.NodeId), name, uint16(in.Mode), 0, in.Flags)
+	entry, fh, err := fs.v.Create(ctx, Ino(in.NodeId), name, uint16(in.Mode), getCreateUmask(in), in.Flags)
+	if err != 0 {
+		return fuse.Status(err)
+	}
+	out.Fh = fh
+	if entry.Attr.DirectIO {
+		out.OpenFlags |= fuse.FOPEN_DIRECT_IO
+	}
+	return fs.replyEntry(ctx, &out.EntryOut, entry)
+}
+
+// Tmpfile serves FUSE_TMPFILE (Linux 6.1+), which is used by open(2) with O_TMPFILE.
+func (fs *fileSystem) Tmpfile(cancel <-chan struct{}, in *fuse.CreateIn, out *fuse.CreateOut) (code fuse.Status) {
+	ctx := fs.newContext(cancel, &in.InHeader)
+	defer releaseContext(ctx)
+	entry, fh, err := fs.v.TmpFile(ctx, Ino(in.NodeId), uint16(in.Mode), getCreateUmask(in), in.Flags)
 	if err != 0 {
 		return fuse.Status(err)
 	}
 	out.Fh = fh
+	if entry.Attr.DirectIO {
+		out.OpenFlags |= fuse.FOPEN_DIRECT_IO
+	}
 	return fs.replyEntry(ctx, &out.EntryOut, entry)
 }
 
@@ -239,7 +298,7 @@ func (fs *fileSystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Op
 		return fuse.Status(err)
 	}
 	out.Fh = fh
-	if vfs.IsSpecialNode(Ino(in.NodeId)) {
+	if vfs.IsSpecialNode(Ino(in.NodeId)) || entry.Attr.DirectIO {
 		out.OpenFlags |= fuse.FOPEN_DIRECT_IO
 	} else if entry.Attr.KeepCache {
 		out.OpenFlags |= fuse.FOPEN_KEEP_CACHE
@@ -294,10 +353,26 @@ func (fs *fileSystem) Fallocate(cancel <-chan struct{}, in *fuse.FallocateIn) (c
 	return fuse.Status(err)
 }
 
+func (fs *fileSystem) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	ctx := fs.newContext(cancel, &in.InHeader)
+	defer releaseContext(ctx)
+	off, err := fs.v.Lseek(ctx, Ino(in.NodeId), in.Fh, int64(in.Offset), in.Whence)
+	if err != 0 {
+		return fuse.Status(err)
+	}
+	out.Offset = uint64(off)
+	return 0
+}
+
 func (fs *fileSystem) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (written uint32, code fuse.Status) {
 	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
-	copied, err := fs.v.CopyFileRange(ctx, Ino(in.NodeId), in.FhIn, in.OffIn, Ino(in.NodeIdOut), in.FhOut, in.OffOut, in.Len, uint32(in.Flags))
+	// the number of copied bytes is returned in 32 bits, keep it page aligned like the kernel does
+	size := in.Len
+	if size > math.MaxUint32&^0xFFF {
+		size = math.MaxUint32 &^ 0xFFF
+	}
+	copied, err := fs.v.CopyFileRange(ctx, Ino(in.NodeId), in.FhIn, in.OffIn, Ino(in.NodeIdOut), in.FhOut, in.OffOut, size, uint32(in.Flags))
 	if err != 0 {
 		return 0, fuse.Status(err)
 	}
@@ -425,6 +500,35 @@ func (fs *fileSystem) Ioctl(cancel <-chan struct{}, in *fuse.IoctlIn, out *fuse.
 	return 0
 }
 
+// parseOptions parses the FUSE options into opt, and returns congestion_threshold (0 means 3/4 of
+// max_background, which is set by the FUSE library).
+func parseOptions(conf *vfs.Config, opt *fuse.MountOptions, options string) (congestion int, err error) {
+	for _, n := range strings.Split(options, ",") {
+		if n == "allow_other" || n == "allow_root" {
+			opt.AllowOther = true
+		} else if n == "nonempty" || n == "ro" {
+		} else if n == "debug" {
+			opt.Debug = true
+		} else if n == "writeback_cache" || n == "writeback" {
+			conf.WritebackCache = true
+		} else if strings.HasPrefix(n, "max_background=") {
+			if opt.MaxBackground, err = strconv.Atoi(n[len("max_background="):]); err != nil || opt.MaxBackground <= 0 || opt.MaxBackground > 65535 {
+				return 0, fmt.Errorf("invalid option: %s", n)
+			}
+		} else if strings.HasPrefix(n, "congestion_threshold=") {
+			if congestion, err = strconv.Atoi(n[len("congestion_threshold="):]); err != nil || congestion <= 0 || congestion > 65535 {
+				return 0, fmt.Errorf("invalid option: %s", n)
+			}
+		} else if strings.TrimSpace(n) != "" {
+			opt.Options = append(opt.Options, strings.TrimSpace(n))
+		}
+	}
+	if congestion > opt.MaxBackground {
+		return 0, fmt.Errorf("congestion_threshold (%d) should not be larger than max_background (%d)", congestion, opt.MaxBackground)
+	}
+	return congestion, nil
+}
+
 // Serve starts a server to serve requests from FUSE.
 func Serve(v *vfs.VFS, options string, xattrs, ioctl bool) error {
 	if err := syscall.Setpriority(syscall.PRIO_PROCESS, os.Getpid(), -19); err != nil {
@@ -438,6 +542,7 @@ func Serve(v *vfs.VFS, options string, xattrs, ioctl bool) error {
 
 	conf := v.Conf
 	imp := newFileSystem(conf, v)
+	imp.xattrs = xattrs
 
 	var opt fuse.MountOptions
 	opt.FsName = "JuiceFS:" + conf.Format.Name
@@ -445,26 +550,32 @@ func Serve(v *vfs.VFS, options string, xattrs, ioctl bool) error {
 	opt.SingleThreaded = false
 	opt.MaxBackground = 50
 	opt.EnableLocks = true
-	opt.DisableXAttrs = !xattrs
+	opt.DisableXAttrs = !xattrs && !conf.Format.EnableACL // ACLs are kept in extended attributes
 	opt.EnableIoctl = ioctl
 	opt.IgnoreSecurityLabels = true
 	opt.MaxWrite = 1 << 20
 	opt.MaxReadAhead = 1 << 20
 	opt.DirectMount = true
 	opt.AllowOther = os.Getuid() == 0
-	for _, n := range strings.Split(options, ",") {
-		if n == "allow_other" || n == "allow_root" {
-			opt.AllowOther = true
-		} else if n == "nonempty" || n == "ro" {
-		} else if n == "debug" {
-			opt.Debug = true
-		} else if n == "writeback_cache" || n == "writeback" {
-			opt.EnableWriteback = true
-		} else if strings.TrimSpace(n) != "" {
-			opt.Options = append(opt.Options, strings.TrimSpace(n))
+	congestion, err := parseOptions(conf, &opt, options)
+	if err != nil {
+		return err
+	}
+	if congestion > 0 {
+		if runtime.GOOS != "linux" {
+			logger.Warnf("congestion_threshold is only supported on Linux, ignore it")
+			congestion = 0
+		} else if err = checkFusectl(); err != nil {
+			logger.Warnf("congestion_threshold can't be set: %s", err)
+			congestion = 0
 		}
 	}
-	if !conf.NonDefaultPermission {
+	if conf.WritebackCache && runtime.GOOS != "linux" {
+		logger.Warnf("writeback_cache is only supported on Linux, ignore it")
+		conf.WritebackCache = false
+	}
+	opt.EnableWriteback = conf.WritebackCache
+	if !conf.NonDefaultPermission && !conf.Format.EnableACL { // the kernel doesn't check the ACLs
 		opt.Options = append(opt.Options, "default_permissions")
 	}
 	if runtime.GOOS == "darwin" {
@@ -487,6 +598,20 @@ func Serve(v *vfs.VFS, options string, xattrs, ioctl bool) error {
 		v.InvalidateEntry = func(parent Ino, name string) syscall.Errno {
 			return syscall.Errno(fssrv.EntryNotify(uint64(parent), name))
 		}
+		v.InvalidateInode = func(ino Ino) syscall.Errno {
+			return syscall.Errno(fssrv.InodeNotify(uint64(ino), 0, 0))
+		}
+	}
+
+	if congestion > 0 {
+		go func() {
+			if err := fssrv.WaitMount(); err != nil {
+				return
+			}
+			if err := setCongestionThreshold(conf.Meta.MountPoint, congestion); err != nil {
+				logger.Warnf("set congestion_threshold to %d: %s", congestion, err)
+			}
+		}()
 	}
 
 	fssrv.Serve()
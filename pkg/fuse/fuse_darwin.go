@@ -17,6 +17,8 @@
 package fuse
 
 import (
+	"errors"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -24,5 +26,22 @@ func getUmask(in *fuse.MknodIn) uint16 {
 	return 0
 }
 
+func getCreateUmask(in *fuse.CreateIn) uint16 {
+	return 0
+}
+
 func setBlksize(out *fuse.Attr, size uint32) {
 }
+
+func setBtime(out *fuse.Attr, attr *Attr) {
+	out.Crtime_ = uint64(attr.Btime)
+	out.Crtimensec_ = attr.Btimensec
+}
+
+func checkFusectl() error {
+	return errors.New("not supported on macOS")
+}
+
+func setCongestionThreshold(mp string, threshold int) error {
+	return errors.New("not supported on macOS")
+}
@@ -17,13 +17,52 @@
 package fuse
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 func getUmask(in *fuse.MknodIn) uint16 {
 	return uint16(in.Umask)
 }
 
+func getCreateUmask(in *fuse.CreateIn) uint16 {
+	return uint16(in.Umask)
+}
+
 func setBlksize(out *fuse.Attr, size uint32) {
 	out.Blksize = size
 }
+
+// birth time can only be returned by FUSE_STATX, which is not supported by the FUSE library yet
+func setBtime(out *fuse.Attr, attr *Attr) {
+}
+
+var fusectlDir = "/sys/fs/fuse/connections"
+
+// checkFusectl checks whether the FUSE control file system is mounted, which is empty otherwise.
+func checkFusectl() error {
+	var dev, parent syscall.Stat_t
+	if err := syscall.Stat(fusectlDir, &dev); err != nil {
+		return fmt.Errorf("%s: %s, please load the fuse module first", fusectlDir, err)
+	}
+	if err := syscall.Stat(fusectlDir+"/..", &parent); err == nil && dev.Dev == parent.Dev {
+		return fmt.Errorf("fusectl is not mounted, please mount it by `mount -t fusectl none %s`", fusectlDir)
+	}
+	return nil
+}
+
+// setCongestionThreshold tunes the connection through fusectl, because the threshold sent in INIT
+// is always 3/4 of max_background in the FUSE library.
+func setCongestionThreshold(mp string, threshold int) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(mp, &st); err != nil {
+		return err
+	}
+	p := fmt.Sprintf("%s/%d/congestion_threshold", fusectlDir, unix.Minor(st.Dev))
+	return os.WriteFile(p, []byte(strconv.Itoa(threshold)), 0644)
+}
@@ -28,6 +28,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"testing"
@@ -35,12 +36,14 @@ import (
 
 	"github.com/gofrs/flock"
 	"github.com/google/uuid"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/posixtest"
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/vfs"
 	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
 )
 
 func format(url string) {
@@ -300,3 +303,76 @@ func TestFUSE(t *testing.T) {
 		})
 	}
 }
+
+func TestParseOptions(t *testing.T) {
+	cases := []struct {
+		options    string
+		background int
+		congestion int
+		valid      bool
+	}{
+		{"", 50, 0, true},
+		{"max_background=200", 200, 0, true},
+		{"max_background=200,congestion_threshold=150", 200, 150, true},
+		{"congestion_threshold=50", 50, 50, true},
+		{"congestion_threshold=60", 0, 0, false}, // larger than the default max_background
+		{"max_background=100,congestion_threshold=101", 0, 0, false},
+		{"max_background=0", 0, 0, false},
+		{"congestion_threshold=abc", 0, 0, false},
+	}
+	for _, c := range cases {
+		opt := fuse.MountOptions{MaxBackground: 50}
+		congestion, err := parseOptions(&vfs.Config{}, &opt, c.options)
+		if !c.valid {
+			if err == nil {
+				t.Fatalf("options %q should be invalid", c.options)
+			}
+			continue
+		}
+		if err != nil || opt.MaxBackground != c.background || congestion != c.congestion {
+			t.Fatalf("options %q: max_background %d, congestion_threshold %d, err %v", c.options, opt.MaxBackground, congestion, err)
+		}
+	}
+	conf := &vfs.Config{}
+	opt := fuse.MountOptions{}
+	if _, err := parseOptions(conf, &opt, "allow_other,writeback,debug,fsname=x"); err != nil {
+		t.Fatalf("parse options: %s", err)
+	}
+	if !opt.AllowOther || !opt.Debug || !conf.WritebackCache || len(opt.Options) != 1 || opt.Options[0] != "fsname=x" {
+		t.Fatalf("parsed options: %+v, writeback %v", opt, conf.WritebackCache)
+	}
+}
+
+func TestCongestionThreshold(t *testing.T) {
+	old := fusectlDir
+	defer func() { fusectlDir = old }()
+	fusectlDir = filepath.Join(t.TempDir(), "connections")
+	if err := checkFusectl(); err == nil {
+		t.Fatalf("fusectl does not exist")
+	}
+	if err := os.Mkdir(fusectlDir, 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := checkFusectl(); err == nil || !strings.Contains(err.Error(), "not mounted") {
+		t.Fatalf("fusectl is not mounted: %v", err)
+	}
+
+	mp := t.TempDir()
+	var st syscall.Stat_t
+	if err := syscall.Stat(mp, &st); err != nil {
+		t.Fatalf("stat %s: %s", mp, err)
+	}
+	if err := setCongestionThreshold(mp, 100); err == nil {
+		t.Fatalf("the connection does not exist")
+	}
+	conn := filepath.Join(fusectlDir, strconv.Itoa(int(unix.Minor(st.Dev))))
+	if err := os.Mkdir(conn, 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := setCongestionThreshold(mp, 100); err != nil {
+		t.Fatalf("set congestion_threshold: %s", err)
+	}
+	if d, err := os.ReadFile(filepath.Join(conn, "congestion_threshold")); err != nil || string(d) != "100" {
+		t.Fatalf("congestion_threshold: %q %v", d, err)
+	}
+}
@@ -34,6 +34,7 @@ func attrToStat(inode Ino, attr *Attr, out *fuse.Attr) {
 	out.Mtimensec = attr.Mtimensec
 	out.Ctime = uint64(attr.Ctime)
 	out.Ctimensec = attr.Ctimensec
+	setBtime(out, attr)
 
 	var size, blocks uint64
 	switch attr.Typ {
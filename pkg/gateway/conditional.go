@@ -0,0 +1,62 @@
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"net/http"
+	_ "unsafe" // for go:linkname
+
+	miniogo "github.com/minio/minio-go/v7"
+)
+
+// globalHandlers are the middlewares of MinIO applied to all the requests.
+//
+//go:linkname globalHandlers github.com/minio/minio/cmd.globalHandlers
+var globalHandlers []func(http.Handler) http.Handler
+
+func init() {
+	globalHandlers = append(globalHandlers, conditionalPut)
+}
+
+type ifNoneMatchKey struct{}
+
+// conditionalPut passes `If-None-Match: *` of PutObject to the object layer by the context, since
+// the handlers of MinIO ignore it, then the object is created only if it does not exist.
+func conditionalPut(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.Header.Get("If-None-Match") == "*" && r.Header.Get("X-Amz-Copy-Source") == "" &&
+			r.URL.Query().Get("uploadId") == "" {
+			r = r.WithContext(context.WithValue(r.Context(), ifNoneMatchKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ifNoneMatch(ctx context.Context) bool {
+	return ctx.Value(ifNoneMatchKey{}) != nil
+}
+
+func preconditionFailed(bucket, object string) error {
+	return miniogo.ErrorResponse{
+		Code:       "PreconditionFailed",
+		Message:    "At least one of the pre-conditions you specified did not hold",
+		BucketName: bucket,
+		Key:        object,
+		StatusCode: http.StatusPreconditionFailed,
+	}
+}
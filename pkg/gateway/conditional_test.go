@@ -0,0 +1,79 @@
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	miniogo "github.com/minio/minio-go/v7"
+	minio "github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/hash"
+)
+
+func TestConditionalPut(t *testing.T) {
+	if len(globalHandlers) == 0 || reflect.ValueOf(globalHandlers[len(globalHandlers)-1]).Pointer() != reflect.ValueOf(conditionalPut).Pointer() {
+		t.Fatalf("conditionalPut is not registered as a middleware of MinIO")
+	}
+	iam := newTestIAM(t)
+	layer, err := NewJFSGateway(iam.fs, iam.conf, iam.gConf)
+	if err != nil {
+		t.Fatalf("new gateway: %s", err)
+	}
+	var putErr error
+	h := conditionalPut(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		hr, _ := hash.NewReader(bytes.NewReader(data), int64(len(data)), "", "", int64(len(data)), false)
+		_, putErr = layer.PutObject(r.Context(), "test", "a", minio.NewPutObjReader(hr), minio.ObjectOptions{})
+	}))
+	put := func(body string, header http.Header) error {
+		r := httptest.NewRequest("PUT", "http://example.com/test/a", bytes.NewReader([]byte(body)))
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		return putErr
+	}
+	get := func() string {
+		var buf bytes.Buffer
+		if err := layer.GetObject(context.Background(), "test", "a", 0, -1, &buf, "", minio.ObjectOptions{}); err != nil {
+			t.Fatalf("get a: %s", err)
+		}
+		return buf.String()
+	}
+
+	ifNoneMatch := http.Header{"If-None-Match": []string{"*"}}
+	if err := put("v1", ifNoneMatch); err != nil {
+		t.Fatalf("create a: %s", err)
+	}
+	var resp miniogo.ErrorResponse
+	if err := put("v2", ifNoneMatch); !errors.As(err, &resp) || resp.StatusCode != http.StatusPreconditionFailed || resp.Key != "a" {
+		t.Fatalf("expect precondition failed but got %v", err)
+	}
+	if v := get(); v != "v1" {
+		t.Fatalf("a should not be overwritten: %s", v)
+	}
+	if err := put("v3", nil); err != nil || get() != "v3" {
+		t.Fatalf("overwrite a without condition: %v", err)
+	}
+}
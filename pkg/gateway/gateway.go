@@ -157,6 +157,17 @@ func (n *jfsObjects) isValidBucketName(bucket string) error {
 	return nil
 }
 
+// isReserved returns true if the object resolves into the internal directory of gateway, which is
+// the case for keys under metaBucket in the default single-bucket mode.
+func (n *jfsObjects) isReserved(bucket, object string) bool {
+	return !n.gConf.MultiBucket && bucket == n.conf.Format.Name && isReservedKey(object)
+}
+
+func isReservedKey(key string) bool {
+	key = path.Clean(sep + key)
+	return key == sep+metaBucket || strings.HasPrefix(key, sep+metaBucket+sep)
+}
+
 func (n *jfsObjects) path(p ...string) string {
 	if len(p) > 0 && p[0] == n.conf.Format.Name {
 		p = p[1:]
@@ -286,6 +297,9 @@ func (n *jfsObjects) isLeaf(bucket, leafPath string) bool {
 
 func (n *jfsObjects) listDirFactory() minio.ListDirFunc {
 	return func(bucket, prefixDir, prefixEntry string) (emptyDir bool, entries []string, delayIsLeaf bool) {
+		if n.isReserved(bucket, prefixDir) {
+			return true, nil, false
+		}
 		f, eno := n.fs.Open(mctx, n.path(bucket, prefixDir), 0)
 		if eno != 0 {
 			return fs.IsNotExist(eno), nil, false
@@ -328,11 +342,25 @@ func (n *jfsObjects) checkBucket(ctx context.Context, bucket string) error {
 	return nil
 }
 
+// checkObject checks the bucket and rejects the objects in the internal directory of gateway.
+func (n *jfsObjects) checkObject(ctx context.Context, bucket, object string) error {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	if n.isReserved(bucket, object) {
+		return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
+	}
+	return nil
+}
+
 // ListObjects lists all blobs in JFS bucket filtered by prefix.
 func (n *jfsObjects) ListObjects(ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int) (loi minio.ListObjectsInfo, err error) {
 	if err := n.checkBucket(ctx, bucket); err != nil {
 		return loi, err
 	}
+	if n.isReserved(bucket, prefix) {
+		return loi, nil
+	}
 	getObjectInfo := func(ctx context.Context, bucket, object string) (obj minio.ObjectInfo, err error) {
 		fi, eno := n.fs.Stat(mctx, n.path(bucket, object))
 		if eno == 0 {
@@ -394,7 +422,7 @@ func (n *jfsObjects) setFileAtime(p string, atime int64) {
 }
 
 func (n *jfsObjects) DeleteObject(ctx context.Context, bucket, object string, options minio.ObjectOptions) (info minio.ObjectInfo, err error) {
-	if err = n.checkBucket(ctx, bucket); err != nil {
+	if err = n.checkObject(ctx, bucket, object); err != nil {
 		return
 	}
 	info.Bucket = bucket
@@ -466,10 +494,10 @@ func (n *jfsObjects) GetObjectNInfo(ctx context.Context, bucket, object string,
 }
 
 func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string, srcInfo minio.ObjectInfo, srcOpts, dstOpts minio.ObjectOptions) (info minio.ObjectInfo, err error) {
-	if err = n.checkBucket(ctx, srcBucket); err != nil {
+	if err = n.checkObject(ctx, srcBucket, srcObject); err != nil {
 		return
 	}
-	if err = n.checkBucket(ctx, dstBucket); err != nil {
+	if err = n.checkObject(ctx, dstBucket, dstObject); err != nil {
 		return
 	}
 	dst := n.path(dstBucket, dstObject)
@@ -509,9 +537,9 @@ func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBu
 
 	var etag []byte
 	if n.gConf.KeepEtag {
-		etag, _ = n.fs.GetXattr(mctx, src, s3Etag)
+		etag, _ = n.getXattr(src, s3Etag)
 		if len(etag) != 0 {
-			eno = n.fs.SetXattr(mctx, dst, s3Etag, etag, 0)
+			eno = n.setXattr(dst, s3Etag, etag)
 			if eno != 0 {
 				logger.Warnf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", dst, s3Etag, etag, 0)
 			}
@@ -537,7 +565,7 @@ var buffPool = sync.Pool{
 }
 
 func (n *jfsObjects) GetObject(ctx context.Context, bucket, object string, startOffset, length int64, writer io.Writer, etag string, opts minio.ObjectOptions) (err error) {
-	if err = n.checkBucket(ctx, bucket); err != nil {
+	if err = n.checkObject(ctx, bucket, object); err != nil {
 		return
 	}
 	f, eno := n.fs.Open(mctx, n.path(bucket, object), vfs.MODE_MASK_R)
@@ -569,7 +597,7 @@ func (n *jfsObjects) GetObject(ctx context.Context, bucket, object string, start
 }
 
 func (n *jfsObjects) GetObjectInfo(ctx context.Context, bucket, object string, opts minio.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
-	if err = n.checkBucket(ctx, bucket); err != nil {
+	if err = n.checkObject(ctx, bucket, object); err != nil {
 		return
 	}
 	fi, eno := n.fs.Stat(mctx, n.path(bucket, object))
@@ -584,7 +612,7 @@ func (n *jfsObjects) GetObjectInfo(ctx context.Context, bucket, object string, o
 	}
 	var etag []byte
 	if n.gConf.KeepEtag && !fi.IsDir() {
-		etag, _ = n.fs.GetXattr(mctx, n.path(bucket, object), s3Etag)
+		etag, _ = n.getXattr(n.path(bucket, object), s3Etag)
 	}
 	size := fi.Size()
 	var contentType string
@@ -669,19 +697,30 @@ func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *mi
 	if dir != "" {
 		_ = n.mkdirAll(ctx, dir, os.FileMode(n.gConf.DirMode))
 	}
-	if eno := n.fs.Rename(mctx, tmpname, object, 0); eno != 0 {
+	var flags uint32
+	if ifNoneMatch(ctx) {
+		flags = meta.RenameNoReplace
+	}
+	if eno := n.fs.Rename(mctx, tmpname, object, flags); eno == syscall.EEXIST && flags != 0 {
+		err = preconditionFailed(bucket, strings.TrimPrefix(object, n.path(bucket)+sep))
+	} else if eno != 0 {
 		err = jfsToObjectErr(ctx, eno, bucket, object)
-		return
 	}
 	return
 }
 
 func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string, r *minio.PutObjReader, opts minio.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
-	if err = n.checkBucket(ctx, bucket); err != nil {
+	if err = n.checkObject(ctx, bucket, object); err != nil {
 		return
 	}
 
 	p := n.path(bucket, object)
+	if ifNoneMatch(ctx) {
+		// checked again when the object is renamed into place
+		if _, eno := n.fs.Stat(mctx, p); eno == 0 {
+			return objInfo, preconditionFailed(bucket, object)
+		}
+	}
 	if strings.HasSuffix(object, sep) {
 		if err = n.mkdirAll(ctx, p, os.FileMode(n.gConf.DirMode)); err != nil {
 			err = jfsToObjectErr(ctx, err, bucket, object)
@@ -706,7 +745,7 @@ func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string
 	}
 	etag := r.MD5CurrentHexString()
 	if n.gConf.KeepEtag && !strings.HasSuffix(object, sep) {
-		eno = n.fs.SetXattr(mctx, p, s3Etag, []byte(etag), 0)
+		eno = n.setXattr(p, s3Etag, []byte(etag))
 		if eno != 0 {
 			logger.Errorf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", p, s3Etag, etag, 0)
 		}
@@ -723,14 +762,14 @@ func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string
 }
 
 func (n *jfsObjects) NewMultipartUpload(ctx context.Context, bucket string, object string, opts minio.ObjectOptions) (uploadID string, err error) {
-	if err = n.checkBucket(ctx, bucket); err != nil {
+	if err = n.checkObject(ctx, bucket, object); err != nil {
 		return
 	}
 	uploadID = minio.MustGetUUID()
 	p := n.upath(bucket, uploadID)
 	err = n.mkdirAll(ctx, p, os.FileMode(n.gConf.DirMode))
 	if err == nil {
-		eno := n.fs.SetXattr(mctx, p, uploadKeyName, []byte(object), 0)
+		eno := n.setXattr(p, uploadKeyName, []byte(object))
 		if eno != 0 {
 			logger.Warnf("set object %s on upload %s: %s", object, uploadID, eno)
 		}
@@ -741,6 +780,26 @@ func (n *jfsObjects) NewMultipartUpload(ctx context.Context, bucket string, obje
 const uploadKeyName = "s3-object"
 const s3Etag = "s3-etag"
 
+// getXattr and setXattr access the internal attributes of gateway, which are out of the namespaces
+// of extended attributes and not accessible by FileSystem.
+func (n *jfsObjects) getXattr(p, name string) ([]byte, syscall.Errno) {
+	fi, eno := n.fs.Stat(mctx, p)
+	if eno != 0 {
+		return nil, eno
+	}
+	var value []byte
+	eno = n.fs.Meta().GetXattr(mctx, fi.Inode(), name, &value)
+	return value, eno
+}
+
+func (n *jfsObjects) setXattr(p, name string, value []byte) syscall.Errno {
+	fi, eno := n.fs.Stat(mctx, p)
+	if eno != 0 {
+		return eno
+	}
+	return n.fs.Meta().SetXattr(mctx, fi.Inode(), name, value, 0)
+}
+
 func (n *jfsObjects) ListMultipartUploads(ctx context.Context, bucket string, prefix string, keyMarker string, uploadIDMarker string, delimiter string, maxUploads int) (lmi minio.ListMultipartsInfo, err error) {
 	if err = n.checkBucket(ctx, bucket); err != nil {
 		return
@@ -762,7 +821,7 @@ func (n *jfsObjects) ListMultipartUploads(ctx context.Context, bucket string, pr
 	for _, e := range entries {
 		uploadID := string(e.Name)
 		if uploadID > uploadIDMarker {
-			object_, _ := n.fs.GetXattr(mctx, n.upath(bucket, uploadID), uploadKeyName)
+			object_, _ := n.getXattr(n.upath(bucket, uploadID), uploadKeyName)
 			object := string(object_)
 			if strings.HasPrefix(object, prefix) && object > keyMarker {
 				lmi.Uploads = append(lmi.Uploads, minio.MultipartInfo{
@@ -783,7 +842,7 @@ func (n *jfsObjects) ListMultipartUploads(ctx context.Context, bucket string, pr
 }
 
 func (n *jfsObjects) checkUploadIDExists(ctx context.Context, bucket, object, uploadID string) (err error) {
-	if err = n.checkBucket(ctx, bucket); err != nil {
+	if err = n.checkObject(ctx, bucket, object); err != nil {
 		return
 	}
 	_, eno := n.fs.Stat(mctx, n.upath(bucket, uploadID))
@@ -813,7 +872,7 @@ func (n *jfsObjects) ListObjectParts(ctx context.Context, bucket, object, upload
 	for _, entry := range entries {
 		num, er := strconv.Atoi(string(entry.Name))
 		if er == nil && num > partNumberMarker {
-			etag, _ := n.fs.GetXattr(mctx, n.ppath(bucket, uploadID, string(entry.Name)), s3Etag)
+			etag, _ := n.getXattr(n.ppath(bucket, uploadID, string(entry.Name)), s3Etag)
 			result.Parts = append(result.Parts, minio.PartInfo{
 				PartNumber:   num,
 				Size:         int64(entry.Attr.Length),
@@ -855,7 +914,7 @@ func (n *jfsObjects) PutObjectPart(ctx context.Context, bucket, object, uploadID
 		return
 	}
 	etag := r.MD5CurrentHexString()
-	if n.fs.SetXattr(mctx, p, s3Etag, []byte(etag), 0) != 0 {
+	if n.setXattr(p, s3Etag, []byte(etag)) != 0 {
 		logger.Warnf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", p, s3Etag, etag, 0)
 	}
 	info.PartNumber = partID
@@ -934,7 +993,7 @@ func (n *jfsObjects) CompleteMultipartUpload(ctx context.Context, bucket, object
 	// Calculate s3 compatible md5sum for complete multipart.
 	s3MD5 := minio.ComputeCompleteMultipartMD5(parts)
 	if n.gConf.KeepEtag {
-		eno = n.fs.SetXattr(mctx, name, s3Etag, []byte(s3MD5), 0)
+		eno = n.setXattr(name, s3Etag, []byte(s3MD5))
 		if eno != 0 {
 			logger.Warnf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", name, s3Etag, s3MD5, 0)
 		}
@@ -0,0 +1,684 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+// MinIO knows only the root credential, so the gateway serves the clients by a proxy in front of
+// it when multiple users are enabled: the requests of users are verified and checked against their
+// policies, then signed again with the root credential. The requests of root and anonymous ones are
+// passed to MinIO as they are.
+//
+// The users are saved in the volume (secret keys are encrypted, and the file is not accessible
+// through S3), so they are shared by all the gateways of the same volume,
+// and they are managed by the admin API (authenticated with the root credential):
+//
+//	GET    /.juicefs/admin/users        list all the users (without secret keys)
+//	GET    /.juicefs/admin/users/<AK>   show a user
+//	PUT    /.juicefs/admin/users/<AK>   create or update a user, the body is a User in JSON
+//	DELETE /.juicefs/admin/users/<AK>   remove a user
+
+const (
+	adminPrefix   = "/.juicefs/admin/users"
+	iamFile       = sep + metaBucket + "/.iam.json" // not a valid bucket name
+	iamReloadTime = time.Second * 10
+)
+
+var accessKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.@=+-]{3,128}$`)
+
+// Policy limits what a user can do through the gateway.
+type Policy struct {
+	// ReadOnly denies any request which modifies objects.
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Prefixes are the allowed "bucket/prefix" (or the whole bucket), any if it's empty.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Quota is the capacity in bytes of each prefix, set as the quota of the directory.
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// User is an access key managed by the gateway.
+type User struct {
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey,omitempty"`
+	Policy    Policy `json:"policy"`
+}
+
+// savedUser is a User in iamFile, the secret key is encrypted with a key derived from the volume.
+type savedUser struct {
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey,omitempty"` // in plaintext, written by older versions
+	Encrypted string `json:"encryptedSecret,omitempty"`
+	Policy    Policy `json:"policy"`
+}
+
+type IAM struct {
+	sync.Mutex
+	fs      *fs.FileSystem
+	conf    *vfs.Config
+	gConf   *Config
+	root    *credentials.Credentials
+	rootAK  string
+	rootSK  string
+	users   map[string]*User
+	aead    cipher.AEAD
+	version string // inode, length and mtime of iamFile
+	checked time.Time
+	now     func() time.Time
+}
+
+// NewIAM creates the manager of users, with the root credential of the gateway.
+func NewIAM(jfs *fs.FileSystem, conf *vfs.Config, gConf *Config, accessKey, secretKey string) (*IAM, error) {
+	iam := &IAM{
+		fs:     jfs,
+		conf:   conf,
+		gConf:  gConf,
+		root:   credentials.NewStaticCredentials(accessKey, secretKey, ""),
+		rootAK: accessKey,
+		rootSK: secretKey,
+		users:  make(map[string]*User),
+		now:    time.Now,
+	}
+	key := hmac.New(sha256.New, []byte(conf.Format.UUID))
+	_, _ = key.Write([]byte("juicefs gateway users"))
+	block, err := aes.NewCipher(key.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	if iam.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	if err := iam.reload(true); err != nil {
+		return nil, err
+	}
+	logger.Infof("Loaded %d users of gateway", len(iam.users))
+	return iam, nil
+}
+
+// reload reads the users from the volume if they are changed.
+func (iam *IAM) reload(force bool) error {
+	iam.Lock()
+	defer iam.Unlock()
+	if !force && iam.now().Sub(iam.checked) < iamReloadTime {
+		return nil
+	}
+	iam.checked = iam.now()
+	fi, eno := iam.fs.Stat(mctx, iamFile)
+	if eno == syscall.ENOENT {
+		iam.users, iam.version = make(map[string]*User), ""
+		return nil
+	} else if eno != 0 {
+		return fmt.Errorf("stat %s: %s", iamFile, eno)
+	}
+	version := fmt.Sprintf("%d-%d-%d", fi.Inode(), fi.Size(), fi.ModTime().UnixNano())
+	if version == iam.version {
+		return nil
+	}
+	f, eno := iam.fs.Open(mctx, iamFile, vfs.MODE_MASK_R)
+	if eno != 0 {
+		return fmt.Errorf("open %s: %s", iamFile, eno)
+	}
+	defer f.Close(mctx)
+	data := make([]byte, fi.Size())
+	if n, err := f.Pread(mctx, data, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("read %s: %s", iamFile, err)
+	} else {
+		data = data[:n]
+	}
+	var users []*savedUser
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("decode %s: %s", iamFile, err)
+	}
+	iam.users = make(map[string]*User, len(users))
+	for _, u := range users {
+		secret := u.SecretKey
+		if u.Encrypted != "" {
+			var err error
+			if secret, err = iam.decrypt(u.AccessKey, u.Encrypted); err != nil {
+				return fmt.Errorf("decrypt secret key of %s: %s", u.AccessKey, err)
+			}
+		}
+		iam.users[u.AccessKey] = &User{AccessKey: u.AccessKey, SecretKey: secret, Policy: u.Policy}
+	}
+	iam.version = version
+	return nil
+}
+
+// save writes the users into the volume, it should be called with lock held.
+func (iam *IAM) save() error {
+	users := make([]*savedUser, 0, len(iam.users))
+	for _, u := range iam.users {
+		users = append(users, &savedUser{AccessKey: u.AccessKey, Encrypted: iam.encrypt(u.AccessKey, u.SecretKey), Policy: u.Policy})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].AccessKey < users[j].AccessKey })
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if eno := iam.fs.MkdirAll(mctx, path.Dir(iamFile), 0700); eno != 0 {
+		return fmt.Errorf("mkdir %s: %s", path.Dir(iamFile), eno)
+	}
+	tmp := iamFile + ".tmp"
+	f, eno := iam.fs.Create(mctx, tmp, 0600)
+	if eno == syscall.EEXIST {
+		f, eno = iam.fs.Open(mctx, tmp, vfs.MODE_MASK_W)
+		if eno == 0 {
+			eno = f.Truncate(mctx, 0)
+		}
+	}
+	if eno != 0 {
+		return fmt.Errorf("create %s: %s", tmp, eno)
+	}
+	if _, eno = f.Write(mctx, data); eno == 0 {
+		eno = f.Close(mctx)
+	} else {
+		_ = f.Close(mctx)
+	}
+	if eno == 0 {
+		eno = iam.fs.Rename(mctx, tmp, iamFile, 0)
+	}
+	if eno != 0 {
+		return fmt.Errorf("save %s: %s", iamFile, eno)
+	}
+	iam.version = "" // reload it next time
+	return nil
+}
+
+// encrypt seals the secret key of a user, which can't be hashed because it's needed to verify the
+// signatures.
+func (iam *IAM) encrypt(ak, secret string) string {
+	nonce := make([]byte, iam.aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(iam.aead.Seal(nonce, nonce, []byte(secret), []byte(ak)))
+}
+
+func (iam *IAM) decrypt(ak, encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	ns := iam.aead.NonceSize()
+	if len(data) < ns {
+		return "", fmt.Errorf("too short")
+	}
+	secret, err := iam.aead.Open(nil, data[:ns], data[ns:], []byte(ak))
+	return string(secret), err
+}
+
+func (iam *IAM) getUser(ak string) *User {
+	if err := iam.reload(false); err != nil {
+		logger.Warnf("Reload users of gateway: %s", err)
+	}
+	iam.Lock()
+	defer iam.Unlock()
+	return iam.users[ak]
+}
+
+// prefixDir returns the directory in the volume of "bucket/prefix".
+func (iam *IAM) prefixDir(prefix string) string {
+	bucket, p, _ := strings.Cut(prefix, "/")
+	if !iam.gConf.MultiBucket && bucket == iam.conf.Format.Name {
+		return path.Join(sep, p)
+	}
+	return path.Join(sep, bucket, p)
+}
+
+// normalize checks the policy and converts every prefix into "bucket/prefix".
+func (p *Policy) normalize() error {
+	if p.Quota < 0 {
+		return fmt.Errorf("invalid quota %d", p.Quota)
+	}
+	for i, prefix := range p.Prefixes {
+		prefix = strings.TrimPrefix(prefix, "/")
+		if !strings.Contains(prefix, "/") {
+			prefix += "/"
+		}
+		if prefix == "/" {
+			return fmt.Errorf("invalid prefix %q", p.Prefixes[i])
+		}
+		if p.Quota > 0 && !strings.HasSuffix(prefix, "/") {
+			return fmt.Errorf("prefix %q should be a directory (ends with '/') to have quota", p.Prefixes[i])
+		}
+		p.Prefixes[i] = prefix
+	}
+	return nil
+}
+
+func (p *Policy) allowed(bucket, key string) bool {
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	name := bucket + "/" + key
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBucket returns true if the user can access any object in the bucket.
+func (p *Policy) hasBucket(bucket string) bool {
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(prefix, bucket+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketAndKey returns the bucket and key of a request, in path style or virtual-hosted style (with
+// MINIO_DOMAIN).
+func bucketAndKey(r *http.Request) (string, string) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, domain := range strings.Split(os.Getenv("MINIO_DOMAIN"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" && strings.HasSuffix(host, "."+domain) {
+			return strings.TrimSuffix(host, "."+domain), p
+		}
+	}
+	bucket, key, _ := strings.Cut(p, "/")
+	return bucket, key
+}
+
+// listing subresources of bucket which are allowed for a user with some prefixes in the bucket
+var listQueries = []string{"list-type", "prefix", "delimiter", "marker", "max-keys", "continuation-token",
+	"start-after", "fetch-owner", "encoding-type", "uploads", "key-marker", "upload-id-marker", "versions",
+	"version-id-marker", "max-uploads", "location", "metadata"}
+
+func isListing(query url.Values) bool {
+	for k := range query {
+		found := false
+		for _, q := range listQueries {
+			if k == q {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// authorize checks whether the request is allowed by the policy of user.
+func authorize(u *User, r *http.Request) error {
+	p := &u.Policy
+	bucket, key := bucketAndKey(r)
+	query := r.URL.Query()
+	if bucket == "minio" || strings.HasPrefix(bucket, ".") || isReservedKey(key) || isReservedKey(query.Get("prefix")) {
+		return errAccessDenied("The reserved path is only for root.")
+	}
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if !read && p.ReadOnly {
+		return errAccessDenied("The user is read-only.")
+	}
+	switch {
+	case bucket == "":
+		if !read || len(p.Prefixes) > 0 {
+			return errAccessDenied("Listing buckets is not allowed.")
+		}
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		return authorizeDeletes(p, r, bucket)
+	case key == "" && read:
+		if !p.hasBucket(bucket) {
+			return errAccessDenied("Access to the bucket is not allowed.")
+		}
+		if r.Method == http.MethodGet && !isListing(query) {
+			if !p.allowed(bucket, "") {
+				return errAccessDenied("Only listing is allowed in the bucket.")
+			}
+		} else if r.Method == http.MethodGet && !query.Has("location") && !p.allowed(bucket, query.Get("prefix")) {
+			return errAccessDenied("Listing of the prefix is not allowed.")
+		}
+	case key == "":
+		return errAccessDenied("Managing buckets is only allowed for root.")
+	default:
+		if !p.allowed(bucket, key) {
+			return errAccessDenied("Access to the object is not allowed.")
+		}
+		if sb, sk, ok := copySource(r); ok && (strings.HasPrefix(sb, ".") || isReservedKey(sk) || !p.allowed(sb, sk)) {
+			return errAccessDenied("Access to the source object is not allowed.")
+		}
+	}
+	return nil
+}
+
+// authorizeDeletes checks every key in the body of DeleteObjects.
+func authorizeDeletes(p *Policy, r *http.Request, bucket string) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+	_ = r.Body.Close()
+	if err != nil {
+		if e, ok := err.(*s3Error); ok {
+			return e
+		}
+		return errIncompleteBody
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var req struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err = xml.Unmarshal(body, &req); err != nil {
+		return &s3Error{"MalformedXML", "The XML you provided was not well-formed.", http.StatusBadRequest}
+	}
+	for _, o := range req.Objects {
+		if isReservedKey(o.Key) || !p.allowed(bucket, o.Key) {
+			return errAccessDenied(fmt.Sprintf("Deleting %s is not allowed.", o.Key))
+		}
+	}
+	return nil
+}
+
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// resign signs the request with the root credential.
+func (iam *IAM) resign(r *http.Request, region string) error {
+	for _, h := range hopHeaders {
+		r.Header.Del(h)
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") == "" {
+		r.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+	signer := v4.NewSigner(iam.root, func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+	})
+	body := r.Body // Sign() replaces it
+	_, err := signer.Sign(r, nil, "s3", region, iam.now())
+	r.Body = body
+	return err
+}
+
+// verify checks the signature of a request from a user, and prepares the body to be forwarded.
+func (iam *IAM) verify(r *http.Request, a *v4Auth, secret string) error {
+	if err := verifyV4(r, a, secret, iam.now()); err != nil {
+		return err
+	}
+	switch hash := payloadHash(r, a); {
+	case hash == streamingPayload:
+		if err := removeChunkedEncoding(r, signingKey(secret, a), a); err != nil {
+			return err
+		}
+	case strings.HasPrefix(hash, "STREAMING-"):
+		return errUnsupportedAuth
+	case a.presigned:
+		r.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	default:
+		// MinIO verifies the payload with the hash
+		r.Header.Set("X-Amz-Content-Sha256", hash)
+	}
+	unsign(r, a)
+	return nil
+}
+
+// Handler returns the handler which serves the admin API and the requests of users, others are
+// passed to next.
+func (iam *IAM) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == adminPrefix || strings.HasPrefix(r.URL.Path, adminPrefix+"/") {
+			iam.serveAdmin(w, r)
+			return
+		}
+		a, err := parseV4(r)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		if a == nil || a.accessKey == iam.rootAK {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := iam.getUser(a.accessKey)
+		if u == nil {
+			next.ServeHTTP(w, r) // MinIO will reject it
+			return
+		}
+		if err = iam.verify(r, a, u.SecretKey); err == nil {
+			if err = authorize(u, r); err == nil {
+				err = iam.resign(r, a.region)
+			}
+		}
+		if err != nil {
+			logger.Debugf("Request %s %s from %s: %s", r.Method, r.URL.Path, a.accessKey, err)
+			writeS3Error(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Serve listens on address for the clients, and forwards the allowed requests to MinIO on backend.
+func (iam *IAM) Serve(address, backend string) error {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: backend})
+	proxy.FlushInterval = -1
+	logger.Infof("Serving S3 clients with multiple users on %s", address)
+	return http.ListenAndServe(address, iam.Handler(proxy))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (iam *IAM) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	a, err := parseV4(r)
+	if err == nil && (a == nil || a.accessKey != iam.rootAK) {
+		err = errAccessDenied("The admin API is only for root.")
+	}
+	if err == nil {
+		err = verifyV4(r, a, iam.rootSK, iam.now())
+	}
+	var body []byte
+	if err == nil && r.Body != nil {
+		if body, err = io.ReadAll(io.LimitReader(r.Body, 1<<20)); err == nil {
+			if h := payloadHash(r, a); h != unsignedPayload && h != sha256Hex(body) {
+				err = errContentSHA256
+			}
+		}
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	ak := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+	if ak == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err = iam.reload(true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		iam.Lock()
+		users := make([]User, 0, len(iam.users))
+		for _, u := range iam.users {
+			users = append(users, User{AccessKey: u.AccessKey, Policy: u.Policy})
+		}
+		iam.Unlock()
+		sort.Slice(users, func(i, j int) bool { return users[i].AccessKey < users[j].AccessKey })
+		writeJSON(w, http.StatusOK, users)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if err = iam.reload(true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		iam.Lock()
+		u := iam.users[ak]
+		iam.Unlock()
+		if u == nil {
+			http.Error(w, "no such user", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, User{AccessKey: u.AccessKey, Policy: u.Policy})
+	case http.MethodPut:
+		var u User
+		if err = json.Unmarshal(body, &u); err != nil {
+			http.Error(w, fmt.Sprintf("decode user: %s", err), http.StatusBadRequest)
+			return
+		}
+		u.AccessKey = ak
+		created, err := iam.setUser(&u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, u) // the secret key is only shown here
+	case http.MethodDelete:
+		if err = iam.removeUser(ak); os.IsNotExist(err) {
+			http.Error(w, "no such user", http.StatusNotFound)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func randomSecret() string {
+	buf := make([]byte, 30)
+	_, _ = rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// setUser creates or updates a user, a secret key is generated for a new user if it's empty, or
+// kept for an existing one.
+func (iam *IAM) setUser(u *User) (bool, error) {
+	if !accessKeyPattern.MatchString(u.AccessKey) || u.AccessKey == iam.rootAK {
+		return false, fmt.Errorf("invalid access key %q", u.AccessKey)
+	}
+	if err := u.Policy.normalize(); err != nil {
+		return false, err
+	}
+	if err := iam.reload(true); err != nil {
+		return false, err
+	}
+	iam.Lock()
+	defer iam.Unlock()
+	old := iam.users[u.AccessKey]
+	if u.SecretKey == "" {
+		if old != nil {
+			u.SecretKey = old.SecretKey
+		} else {
+			u.SecretKey = randomSecret()
+		}
+	}
+	if len(u.SecretKey) < 8 {
+		return false, fmt.Errorf("secret key should have at least 8 characters")
+	}
+	if u.Policy.Quota > 0 {
+		for _, prefix := range u.Policy.Prefixes {
+			if err := iam.setQuota(prefix, u.Policy.Quota); err != nil {
+				return false, err
+			}
+		}
+	}
+	iam.users[u.AccessKey] = u
+	if err := iam.save(); err != nil {
+		if old != nil {
+			iam.users[u.AccessKey] = old
+		} else {
+			delete(iam.users, u.AccessKey)
+		}
+		return false, err
+	}
+	logger.Infof("Saved user %s of gateway: %+v", u.AccessKey, u.Policy)
+	return old == nil, nil
+}
+
+// setQuota sets the capacity of the directory of a prefix, the directory is created if missing.
+func (iam *IAM) setQuota(prefix string, capacity int64) error {
+	dir := iam.prefixDir(prefix)
+	if eno := iam.fs.MkdirAll(mctx, dir, iam.gConf.DirMode); eno != 0 {
+		return fmt.Errorf("mkdir %s: %s", dir, eno)
+	}
+	qs := map[string]*meta.Quota{dir: {MaxSpace: capacity, MaxInodes: -1}}
+	if err := iam.fs.Meta().HandleQuota(mctx, meta.QuotaSet, dir, qs, false, false); err != nil {
+		return fmt.Errorf("set quota of %s: %s", dir, err)
+	}
+	return nil
+}
+
+// removeUser removes a user, the data and quotas of the prefixes are kept.
+func (iam *IAM) removeUser(ak string) error {
+	if err := iam.reload(true); err != nil {
+		return err
+	}
+	iam.Lock()
+	defer iam.Unlock()
+	old := iam.users[ak]
+	if old == nil {
+		return os.ErrNotExist
+	}
+	delete(iam.users, ak)
+	if err := iam.save(); err != nil {
+		iam.users[ak] = old
+		return err
+	}
+	logger.Infof("Removed user %s of gateway", ak)
+	return nil
+}
@@ -0,0 +1,304 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func signRequest(t *testing.T, r *http.Request, ak, sk string, body []byte) {
+	signer := v4.NewSigner(credentials.NewStaticCredentials(ak, sk, ""), func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+	})
+	if _, err := signer.Sign(r, bytes.NewReader(body), "s3", "us-east-1", time.Now()); err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+}
+
+func TestVerifyV4(t *testing.T) {
+	r := httptest.NewRequest("PUT", "http://example.com/bucket/a%20b?tagging", nil)
+	body := []byte("hello")
+	signRequest(t, r, "alice", "alicesecret", body)
+	a, err := parseV4(r)
+	if err != nil || a == nil || a.accessKey != "alice" || a.region != "us-east-1" {
+		t.Fatalf("parse: %+v %v", a, err)
+	}
+	if err = verifyV4(r, a, "alicesecret", time.Now()); err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+	if err = verifyV4(r, a, "wrongsecret", time.Now()); err != errSignature {
+		t.Fatalf("verify with wrong secret: %v", err)
+	}
+	if err = verifyV4(r, a, "alicesecret", time.Now().Add(time.Hour)); err != errTimeSkewed {
+		t.Fatalf("verify with skewed time: %v", err)
+	}
+	r.Method = "DELETE"
+	if err = verifyV4(r, a, "alicesecret", time.Now()); err != errSignature {
+		t.Fatalf("verify tampered request: %v", err)
+	}
+
+	// presigned
+	r = httptest.NewRequest("GET", "http://example.com/bucket/key", nil)
+	signer := v4.NewSigner(credentials.NewStaticCredentials("alice", "alicesecret", ""), func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+	})
+	if _, err = signer.Presign(r, nil, "s3", "us-east-1", time.Minute, time.Now()); err != nil {
+		t.Fatalf("presign: %s", err)
+	}
+	if a, err = parseV4(r); err != nil || a == nil || !a.presigned {
+		t.Fatalf("parse presigned: %+v %v", a, err)
+	}
+	if err = verifyV4(r, a, "alicesecret", time.Now()); err != nil {
+		t.Fatalf("verify presigned: %s", err)
+	}
+	if err = verifyV4(r, a, "alicesecret", time.Now().Add(time.Hour)); err != errExpiredPresign {
+		t.Fatalf("verify expired: %v", err)
+	}
+	unsign(r, a)
+	if strings.Contains(r.URL.RawQuery, "X-Amz-") {
+		t.Fatalf("signature is not removed: %s", r.URL.RawQuery)
+	}
+
+	// not signed
+	r = httptest.NewRequest("GET", "http://example.com/bucket/key", nil)
+	if a, err = parseV4(r); a != nil || err != nil {
+		t.Fatalf("parse anonymous: %+v %v", a, err)
+	}
+}
+
+func TestChunkedReader(t *testing.T) {
+	a := &v4Auth{date: "20230101", region: "us-east-1", service: "s3", signature: "seed",
+		amzDate: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	key := signingKey("alicesecret", a)
+	var body bytes.Buffer
+	prev := a.signature
+	for _, data := range []string{"hello ", "world", ""} {
+		toSign := strings.Join([]string{signV4Algorithm + "-PAYLOAD", a.amzDate.Format(iso8601Format), a.scope(),
+			prev, emptySHA256, sha256Hex([]byte(data))}, "\n")
+		prev = hex.EncodeToString(hmacSHA256(key, toSign))
+		fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n%s\r\n", len(data), prev, data)
+	}
+	encoded := body.Bytes()
+	data, err := io.ReadAll(newChunkedReader(io.NopCloser(bytes.NewReader(encoded)), key, a))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("decode: %q %v", data, err)
+	}
+	tampered := bytes.Replace(encoded, []byte("world"), []byte("WORLD"), 1)
+	if _, err = io.ReadAll(newChunkedReader(io.NopCloser(bytes.NewReader(tampered)), key, a)); err != errSignature {
+		t.Fatalf("decode tampered: %v", err)
+	}
+	if _, err = io.ReadAll(newChunkedReader(io.NopCloser(bytes.NewReader(encoded[:20])), key, a)); err == nil {
+		t.Fatalf("decode truncated should fail")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	u := &User{AccessKey: "alice", Policy: Policy{Prefixes: []string{"bucket/alice/", "shared", "bucket/.sys/"}}}
+	if err := u.Policy.normalize(); err != nil {
+		t.Fatalf("normalize: %s", err)
+	}
+	if u.Policy.Prefixes[1] != "shared/" {
+		t.Fatalf("bucket should be normalized into a prefix: %v", u.Policy.Prefixes)
+	}
+	cases := []struct {
+		method, uri string
+		header      map[string]string
+		allowed     bool
+	}{
+		{"GET", "/bucket/alice/a", nil, true},
+		{"PUT", "/bucket/alice/a", nil, true},
+		{"GET", "/bucket/bob/a", nil, false},
+		{"GET", "/bucket?list-type=2&prefix=alice/", nil, true},
+		{"GET", "/bucket?list-type=2&prefix=", nil, false},
+		{"HEAD", "/bucket", nil, true},
+		{"GET", "/bucket?policy", nil, false},
+		{"GET", "/shared?policy", nil, true},
+		{"PUT", "/bucket", nil, false},
+		{"DELETE", "/shared", nil, false},
+		{"GET", "/", nil, false},
+		{"GET", "/minio/admin/v3/info", nil, false},
+		{"GET", "/bucket/.sys/.iam.json", nil, false},
+		{"GET", "/shared/a/../.sys/.iam.json", nil, false},
+		{"GET", "/shared?list-type=2&prefix=.sys/", nil, false},
+		{"PUT", "/shared/a", map[string]string{"X-Amz-Copy-Source": "shared/.sys/.iam.json"}, false},
+		{"PUT", "/bucket/alice/b", map[string]string{"X-Amz-Copy-Source": "/bucket/bob/a"}, false},
+		{"PUT", "/bucket/alice/b", map[string]string{"X-Amz-Copy-Source": "shared/a%20b"}, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "http://example.com"+c.uri, nil)
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		if err := authorize(u, r); (err == nil) != c.allowed {
+			t.Fatalf("%s %s: expect allowed=%t, got %v", c.method, c.uri, c.allowed, err)
+		}
+	}
+
+	body := `<Delete><Object><Key>alice/a</Key></Object><Object><Key>bob/a</Key></Object></Delete>`
+	r := httptest.NewRequest("POST", "http://example.com/bucket?delete", strings.NewReader(body))
+	if err := authorize(u, r); err == nil {
+		t.Fatalf("delete objects of others should be denied")
+	}
+	body = `<Delete><Object><Key>alice/a</Key></Object><Object><Key>.sys/.iam.json</Key></Object></Delete>`
+	r = httptest.NewRequest("POST", "http://example.com/bucket?delete", strings.NewReader(body))
+	if err := authorize(u, r); err == nil {
+		t.Fatalf("delete reserved objects should be denied")
+	}
+	body = `<Delete><Object><Key>alice/a</Key></Object></Delete>`
+	r = httptest.NewRequest("POST", "http://example.com/bucket?delete", strings.NewReader(body))
+	if err := authorize(u, r); err != nil {
+		t.Fatalf("delete objects: %s", err)
+	}
+	if d, _ := io.ReadAll(r.Body); string(d) != body {
+		t.Fatalf("body should be kept for MinIO: %q", d)
+	}
+
+	u.Policy.ReadOnly = true
+	if err := authorize(u, httptest.NewRequest("PUT", "http://example.com/bucket/alice/a", nil)); err == nil {
+		t.Fatalf("write of read-only user should be denied")
+	}
+}
+
+func newTestIAM(t *testing.T) *IAM {
+	m := meta.NewClient("memkv://", nil)
+	format := &meta.Format{Name: "test", BlockSize: 4096, Capacity: 1 << 30, DirStats: true}
+	_ = m.Init(format, true)
+	conf := &vfs.Config{
+		Meta:   meta.DefaultConf(),
+		Format: *format,
+		Chunk: &chunk.Config{
+			BlockSize:  format.BlockSize << 10,
+			MaxUpload:  1,
+			BufferSize: 100 << 20,
+		},
+	}
+	objStore, _ := object.CreateStorage("mem", "", "", "", "")
+	store := chunk.NewCachedStore(objStore, *conf.Chunk, nil)
+	jfs, err := fs.NewFileSystem(conf, m, store)
+	if err != nil {
+		t.Fatalf("initialize failed: %s", err)
+	}
+	mctx = meta.Background
+	iam, err := NewIAM(jfs, conf, &Config{DirMode: 0755, Mode: 0644}, "rootuser", "rootsecret")
+	if err != nil {
+		t.Fatalf("new IAM: %s", err)
+	}
+	return iam
+}
+
+func TestIAMHandler(t *testing.T) {
+	iam := newTestIAM(t)
+	var forwarded *http.Request
+	var forwardedBody []byte
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		forwardedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	})
+	h := iam.Handler(backend)
+	do := func(method, uri, ak, sk string, body []byte) *httptest.ResponseRecorder {
+		forwarded = nil
+		r := httptest.NewRequest(method, "http://example.com"+uri, bytes.NewReader(body))
+		if ak != "" {
+			signRequest(t, r, ak, sk, body)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	user := []byte(`{"secretKey":"alicesecret","policy":{"prefixes":["test/alice/"],"quota":1048576}}`)
+	if w := do("PUT", adminPrefix+"/alice", "alice", "alicesecret", user); w.Code != http.StatusForbidden {
+		t.Fatalf("admin API should be only for root: %d", w.Code)
+	}
+	if w := do("PUT", adminPrefix+"/alice", "rootuser", "rootsecret", user); w.Code != http.StatusCreated {
+		t.Fatalf("create user: %d %s", w.Code, w.Body)
+	}
+	w := do("GET", adminPrefix, "rootuser", "rootsecret", nil)
+	var users []User
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil || len(users) != 1 || users[0].SecretKey != "" {
+		t.Fatalf("list users: %s %v", w.Body, err)
+	}
+	f, eno := iam.fs.Open(meta.Background, iamFile, vfs.MODE_MASK_R)
+	if eno != 0 {
+		t.Fatalf("open %s: %s", iamFile, eno)
+	}
+	saved := make([]byte, 4096)
+	n, _ := f.Pread(meta.Background, saved, 0)
+	_ = f.Close(meta.Background)
+	if bytes.Contains(saved[:n], []byte("alicesecret")) {
+		t.Fatalf("secret key is saved in plaintext: %s", saved[:n])
+	}
+	qs := map[string]*meta.Quota{"/alice": {}}
+	if err := iam.fs.Meta().HandleQuota(meta.Background, meta.QuotaGet, "/alice", qs, false, false); err != nil || qs["/alice"].MaxSpace != 1048576 {
+		t.Fatalf("quota of /alice: %+v %v", qs["/alice"], err)
+	}
+
+	// the requests of root are passed as they are
+	if w = do("GET", "/test/bob/a", "rootuser", "rootsecret", nil); w.Code != http.StatusOK || forwarded == nil {
+		t.Fatalf("request of root: %d", w.Code)
+	}
+	// the requests of user are signed again with root
+	if w = do("PUT", "/test/alice/a", "alice", "alicesecret", []byte("data")); w.Code != http.StatusOK || forwarded == nil {
+		t.Fatalf("request of user: %d %s", w.Code, w.Body)
+	}
+	a, err := parseV4(forwarded)
+	if err != nil || a == nil || a.accessKey != "rootuser" || string(forwardedBody) != "data" {
+		t.Fatalf("forwarded request: %+v %v %q", a, err, forwardedBody)
+	}
+	if err = verifyV4(forwarded, a, "rootsecret", time.Now()); err != nil {
+		t.Fatalf("verify forwarded request with root: %s", err)
+	}
+	if w = do("GET", "/test/bob/a", "alice", "alicesecret", nil); w.Code != http.StatusForbidden || forwarded != nil {
+		t.Fatalf("request out of prefixes: %d", w.Code)
+	}
+	if w = do("GET", "/test/alice/a", "alice", "wrongsecret", nil); w.Code != http.StatusForbidden || forwarded != nil {
+		t.Fatalf("request with wrong secret: %d", w.Code)
+	}
+
+	// shared by other gateways of the same volume
+	other, err := NewIAM(iam.fs, iam.conf, iam.gConf, "rootuser", "rootsecret")
+	if err != nil || other.getUser("alice") == nil {
+		t.Fatalf("load users: %v", err)
+	}
+	if w = do("DELETE", adminPrefix+"/alice", "rootuser", "rootsecret", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("remove user: %d", w.Code)
+	}
+	if w = do("GET", "/test/alice/a", "alice", "alicesecret", nil); forwarded == nil || forwarded.Header.Get("Authorization") == "" {
+		t.Fatalf("request of unknown user should be rejected by MinIO: %d", w.Code)
+	}
+	if a, _ = parseV4(forwarded); a.accessKey != "alice" {
+		t.Fatalf("request of unknown user should not be signed again: %+v", a)
+	}
+}
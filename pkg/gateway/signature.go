@@ -0,0 +1,395 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/pkg/s3utils"
+)
+
+// The requests of the users managed by the gateway are verified here (AWS Signature Version 4),
+// and then signed again with the root credential before they are passed to MinIO.
+
+const (
+	signV4Algorithm  = "AWS4-HMAC-SHA256"
+	iso8601Format    = "20060102T150405Z"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxSkewTime      = 15 * time.Minute
+	maxChunkSize     = 16 << 20
+)
+
+// s3Error is an error responded to S3 clients.
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func errAccessDenied(msg string) *s3Error {
+	return &s3Error{"AccessDenied", msg, http.StatusForbidden}
+}
+
+var (
+	errMalformedAuth   = &s3Error{"AuthorizationHeaderMalformed", "The authorization header is malformed.", http.StatusBadRequest}
+	errSignature       = &s3Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.", http.StatusForbidden}
+	errTimeSkewed      = &s3Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.", http.StatusForbidden}
+	errExpiredPresign  = &s3Error{"AccessDenied", "Request has expired.", http.StatusForbidden}
+	errUnsupportedAuth = &s3Error{"NotImplemented", "The authorization or payload type is not supported for this user.", http.StatusNotImplemented}
+	errIncompleteBody  = &s3Error{"IncompleteBody", "The request body terminated unexpectedly.", http.StatusBadRequest}
+	errContentSHA256   = &s3Error{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.", http.StatusBadRequest}
+)
+
+// v4Auth is the signature of a request, from the Authorization header or the query (presigned).
+type v4Auth struct {
+	accessKey     string
+	date          string // yyyymmdd
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	presigned     bool
+	expires       time.Duration
+}
+
+func (a *v4Auth) scope() string {
+	return strings.Join([]string{a.date, a.region, a.service, "aws4_request"}, "/")
+}
+
+func parseCredential(a *v4Auth, cred string) error {
+	ps := strings.Split(cred, "/")
+	if len(ps) < 5 || ps[len(ps)-1] != "aws4_request" {
+		return errMalformedAuth
+	}
+	// the access key may contain '/'
+	n := len(ps)
+	a.accessKey, a.date, a.region, a.service = strings.Join(ps[:n-4], "/"), ps[n-4], ps[n-3], ps[n-2]
+	return nil
+}
+
+// parseV4 returns the signature of a request, or nil if it's not signed by V4.
+func parseV4(r *http.Request) (*v4Auth, error) {
+	a := &v4Auth{}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, signV4Algorithm) {
+		for _, kv := range strings.Split(strings.TrimSpace(h[len(signV4Algorithm):]), ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+			if !ok {
+				return nil, errMalformedAuth
+			}
+			switch k {
+			case "Credential":
+				if err := parseCredential(a, v); err != nil {
+					return nil, err
+				}
+			case "SignedHeaders":
+				a.signedHeaders = strings.Split(v, ";")
+			case "Signature":
+				a.signature = v
+			}
+		}
+		date := r.Header.Get("X-Amz-Date")
+		if date == "" {
+			date = r.Header.Get("Date")
+		}
+		t, err := time.Parse(iso8601Format, date)
+		if err != nil {
+			if t, err = http.ParseTime(date); err != nil {
+				return nil, errMalformedAuth
+			}
+		}
+		a.amzDate = t
+	} else if q := r.URL.Query(); q.Get("X-Amz-Algorithm") == signV4Algorithm {
+		a.presigned = true
+		if err := parseCredential(a, q.Get("X-Amz-Credential")); err != nil {
+			return nil, err
+		}
+		a.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+		a.signature = q.Get("X-Amz-Signature")
+		t, err := time.Parse(iso8601Format, q.Get("X-Amz-Date"))
+		if err != nil {
+			return nil, errMalformedAuth
+		}
+		a.amzDate = t
+		expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || expires > 7*24*3600 {
+			return nil, errMalformedAuth
+		}
+		a.expires = time.Second * time.Duration(expires)
+	} else {
+		return nil, nil
+	}
+	if a.accessKey == "" || a.signature == "" || len(a.signedHeaders) == 0 {
+		return nil, errMalformedAuth
+	}
+	return a, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func signingKey(secret string, a *v4Auth) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), a.date)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, a.service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// payloadHash returns the hash of payload which is signed by the client.
+func payloadHash(r *http.Request, a *v4Auth) string {
+	if a.presigned {
+		if h := r.URL.Query().Get("X-Amz-Content-Sha256"); h != "" {
+			return h
+		}
+		return unsignedPayload
+	}
+	if h := r.Header.Get("X-Amz-Content-Sha256"); h != "" {
+		return h
+	}
+	return emptySHA256
+}
+
+func canonicalHeaderValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		return strconv.FormatInt(r.ContentLength, 10)
+	case "expect":
+		if v := r.Header.Get("Expect"); v != "" {
+			return v
+		}
+		return "100-continue" // removed by Go
+	case "transfer-encoding":
+		return strings.Join(r.TransferEncoding, ",")
+	}
+	vals := r.Header.Values(name)
+	for i, v := range vals {
+		vals[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(vals, ",")
+}
+
+func canonicalRequest(r *http.Request, a *v4Auth) string {
+	query := r.URL.Query()
+	query.Del("X-Amz-Signature")
+	var headers strings.Builder
+	for _, h := range a.signedHeaders {
+		headers.WriteString(h + ":" + canonicalHeaderValue(r, h) + "\n")
+	}
+	return strings.Join([]string{
+		r.Method,
+		s3utils.EncodePath(r.URL.Path),
+		strings.ReplaceAll(query.Encode(), "+", "%20"),
+		headers.String(),
+		strings.Join(a.signedHeaders, ";"),
+		payloadHash(r, a),
+	}, "\n")
+}
+
+func stringToSign(a *v4Auth, canonical string) string {
+	return strings.Join([]string{signV4Algorithm, a.amzDate.Format(iso8601Format), a.scope(), sha256Hex([]byte(canonical))}, "\n")
+}
+
+// verifyV4 checks the signature of a request with the secret key.
+func verifyV4(r *http.Request, a *v4Auth, secret string, now time.Time) error {
+	if a.service != "s3" {
+		return errMalformedAuth
+	}
+	if a.presigned {
+		if now.Before(a.amzDate.Add(-maxSkewTime)) {
+			return errTimeSkewed
+		}
+		if now.After(a.amzDate.Add(a.expires)) {
+			return errExpiredPresign
+		}
+	} else if d := now.Sub(a.amzDate); d > maxSkewTime || d < -maxSkewTime {
+		return errTimeSkewed
+	}
+	if !sort.StringsAreSorted(a.signedHeaders) {
+		return errMalformedAuth
+	}
+	sig := hex.EncodeToString(hmacSHA256(signingKey(secret, a), stringToSign(a, canonicalRequest(r, a))))
+	if !hmac.Equal([]byte(sig), []byte(a.signature)) {
+		return errSignature
+	}
+	return nil
+}
+
+// chunkedReader decodes the payload of aws-chunked encoding, and verifies the signature of every
+// chunk, which is chained from the signature of the request.
+type chunkedReader struct {
+	r       *bufio.Reader
+	body    io.Closer
+	key     []byte
+	a       *v4Auth
+	prevSig string
+	buf     []byte
+	done    bool
+	err     error
+}
+
+func newChunkedReader(body io.ReadCloser, key []byte, a *v4Auth) *chunkedReader {
+	return &chunkedReader{r: bufio.NewReader(body), body: body, key: key, a: a, prevSig: a.signature}
+}
+
+func (c *chunkedReader) next() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return errIncompleteBody
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	hexSize, sig, ok := strings.Cut(line, ";chunk-signature=")
+	if !ok {
+		return errMalformedAuth
+	}
+	size, err := strconv.ParseInt(hexSize, 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errMalformedAuth
+	}
+	data := make([]byte, size+2)
+	if _, err = io.ReadFull(c.r, data); err != nil || !bytes.HasSuffix(data, []byte("\r\n")) {
+		return errIncompleteBody
+	}
+	data = data[:size]
+	toSign := strings.Join([]string{signV4Algorithm + "-PAYLOAD", c.a.amzDate.Format(iso8601Format), c.a.scope(),
+		c.prevSig, emptySHA256, sha256Hex(data)}, "\n")
+	if expected := hex.EncodeToString(hmacSHA256(c.key, toSign)); !hmac.Equal([]byte(expected), []byte(sig)) {
+		return errSignature
+	}
+	c.prevSig = sig
+	c.buf = data
+	c.done = size == 0
+	return nil
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+		c.err = c.next()
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
+
+// unsign removes the signature of the client from a request.
+func unsign(r *http.Request, a *v4Auth) {
+	r.Header.Del("Authorization")
+	r.Header.Del("X-Amz-Date")
+	if a.presigned {
+		q := r.URL.Query()
+		for k := range q {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-") && k != "x-amz-version-id" {
+				q.Del(k)
+			}
+		}
+		r.URL.RawQuery = strings.ReplaceAll(q.Encode(), "+", "%20")
+	}
+}
+
+// removeChunkedEncoding replaces the body of aws-chunked encoding with the decoded one.
+func removeChunkedEncoding(r *http.Request, key []byte, a *v4Auth) error {
+	size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return &s3Error{"MissingContentLength", "You must provide the Content-Length HTTP header.", http.StatusLengthRequired}
+	}
+	r.Body = newChunkedReader(r.Body, key, a)
+	r.ContentLength = size
+	r.Header.Del("Content-Length")
+	r.Header.Del("X-Amz-Decoded-Content-Length")
+	var encodings []string
+	for _, e := range strings.Split(r.Header.Get("Content-Encoding"), ",") {
+		if e = strings.TrimSpace(e); e != "" && e != "aws-chunked" {
+			encodings = append(encodings, e)
+		}
+	}
+	if len(encodings) > 0 {
+		r.Header.Set("Content-Encoding", strings.Join(encodings, ","))
+	} else {
+		r.Header.Del("Content-Encoding")
+	}
+	r.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	return nil
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*s3Error)
+	if !ok {
+		e = &s3Error{"InternalError", err.Error(), http.StatusInternalServerError}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status)
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n<Error><Code>%s</Code><Message>%s</Message><Resource>%s</Resource></Error>",
+		e.Code, xmlEscape(e.Message), xmlEscape(r.URL.Path))
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// copySource returns the bucket and key of x-amz-copy-source.
+func copySource(r *http.Request) (string, string, bool) {
+	src := r.Header.Get("X-Amz-Copy-Source")
+	if src == "" {
+		return "", "", false
+	}
+	if u, err := url.PathUnescape(src); err == nil {
+		src = u
+	}
+	src, _, _ = strings.Cut(src, "?versionId=")
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+	return bucket, key, true
+}
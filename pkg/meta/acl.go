@@ -0,0 +1,346 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+const (
+	ACLTypeAccess  = 1
+	ACLTypeDefault = 2
+)
+
+const (
+	aclNone      = 0      // id of no ACL
+	aclUnset     = 0xFFFF // the mask is not set
+	aclXattrVer  = 2      // version of POSIX ACL in extended attribute
+	aclUndefined = 0xFFFFFFFF
+)
+
+// tags of entries in POSIX ACL extended attribute
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+// ACLEntry is a named user or group in an ACL.
+type ACLEntry struct {
+	Id   uint32
+	Perm uint16
+}
+
+// ACLRule is a POSIX ACL, which is immutable once it's stored and shared by inodes.
+type ACLRule struct {
+	Owner       uint16
+	Group       uint16
+	Mask        uint16
+	Other       uint16
+	NamedUsers  []ACLEntry
+	NamedGroups []ACLEntry
+}
+
+// NewACLRule returns a rule with the same permissions as mode.
+func NewACLRule(mode uint16) *ACLRule {
+	r := &ACLRule{Mask: aclUnset}
+	r.SetMode(mode)
+	return r
+}
+
+func (r *ACLRule) Dup() *ACLRule {
+	n := *r
+	n.NamedUsers = append([]ACLEntry(nil), r.NamedUsers...)
+	n.NamedGroups = append([]ACLEntry(nil), r.NamedGroups...)
+	return &n
+}
+
+// HasMask returns true if the mask entry is set.
+func (r *ACLRule) HasMask() bool {
+	return r.Mask != aclUnset
+}
+
+// UpdateMask sets the mask to the union of the group class if named entries exist without it.
+func (r *ACLRule) UpdateMask() {
+	if r.IsMinimal() || r.Mask != aclUnset {
+		return
+	}
+	r.Mask = r.Group
+	for _, e := range r.NamedUsers {
+		r.Mask |= e.Perm
+	}
+	for _, e := range r.NamedGroups {
+		r.Mask |= e.Perm
+	}
+}
+
+// IsMinimal returns true if the rule can be represented by the mode bits.
+func (r *ACLRule) IsMinimal() bool {
+	return len(r.NamedUsers) == 0 && len(r.NamedGroups) == 0
+}
+
+// GetMode returns the permission bits of the rule, the mask is used for group if it's set.
+func (r *ACLRule) GetMode() uint16 {
+	group := r.Group
+	if r.Mask != aclUnset {
+		group = r.Mask
+	}
+	return (r.Owner&7)<<6 | (group&7)<<3 | r.Other&7
+}
+
+// SetMode updates the rule with the permission bits, which change the mask instead of group if it's set.
+func (r *ACLRule) SetMode(mode uint16) {
+	r.Owner = (mode >> 6) & 7
+	if r.Mask != aclUnset {
+		r.Mask = (mode >> 3) & 7
+	} else {
+		r.Group = (mode >> 3) & 7
+	}
+	r.Other = mode & 7
+}
+
+// ChildAccessACL returns the access ACL of a new node inherited from this default ACL.
+func (r *ACLRule) ChildAccessACL(mode uint16) *ACLRule {
+	c := r.Dup()
+	c.Owner &= (mode >> 6) & 7
+	if c.Mask != aclUnset {
+		c.Mask &= (mode >> 3) & 7
+	} else {
+		c.Group &= (mode >> 3) & 7
+	}
+	c.Other &= mode & 7
+	return c
+}
+
+// ChangeOwner returns a rule in which the permissions stay with the users and groups when the owner (group)
+// is changed from oldUid (oldGid) to uid (gid), as the ACEs in Windows do: the old owner gets a named entry with
+// the permissions of the owner, and the owner takes the permissions of the named entry of the new owner (if any).
+// It returns nil if the rule is not changed.
+func (r *ACLRule) ChangeOwner(oldUid, uid, oldGid, gid uint32) *ACLRule {
+	if oldUid == uid && oldGid == gid {
+		return nil
+	}
+	c := r.Dup()
+	if oldUid != uid {
+		c.Owner, c.NamedUsers = moveNamed(c.NamedUsers, oldUid, uid, c.Owner)
+	}
+	if oldGid != gid {
+		c.Group, c.NamedGroups = moveNamed(c.NamedGroups, oldGid, gid, c.Group)
+	}
+	c.UpdateMask()
+	return c
+}
+
+// moveNamed gives the permissions of the owner to a named entry of old, and returns the permissions of the
+// named entry of id (which is removed) as the ones of the new owner.
+func moveNamed(entries []ACLEntry, old, id uint32, perm uint16) (uint16, []ACLEntry) {
+	named := make([]ACLEntry, 0, len(entries)+1)
+	owner := perm
+	for _, e := range entries {
+		switch e.Id {
+		case id:
+			owner = e.Perm
+		case old:
+		default:
+			named = append(named, e)
+		}
+	}
+	named = append(named, ACLEntry{Id: old, Perm: perm})
+	sort.Slice(named, func(i, j int) bool { return named[i].Id < named[j].Id })
+	return owner, named
+}
+
+// CanAccess checks the permission following the access check algorithm of POSIX ACL.
+func (r *ACLRule) CanAccess(uid uint32, gids []uint32, fUid, fGid uint32, mmask uint16) bool {
+	if uid == fUid {
+		return r.Owner&mmask == mmask
+	}
+	mask := uint16(7)
+	if r.Mask != aclUnset {
+		mask = r.Mask
+	}
+	for _, e := range r.NamedUsers {
+		if e.Id == uid {
+			return e.Perm&mask&mmask == mmask
+		}
+	}
+	var inGroup bool
+	for _, gid := range gids {
+		if gid == fGid {
+			if r.Group&mask&mmask == mmask {
+				return true
+			}
+			inGroup = true
+		}
+		for _, e := range r.NamedGroups {
+			if e.Id == gid {
+				if e.Perm&mask&mmask == mmask {
+					return true
+				}
+				inGroup = true
+			}
+		}
+	}
+	if inGroup {
+		return false
+	}
+	return r.Other&mmask == mmask
+}
+
+func (r *ACLRule) Encode() []byte {
+	w := utils.NewBuffer(uint32(16 + (len(r.NamedUsers)+len(r.NamedGroups))*6))
+	w.Put16(r.Owner)
+	w.Put16(r.Group)
+	w.Put16(r.Mask)
+	w.Put16(r.Other)
+	w.Put32(uint32(len(r.NamedUsers)))
+	for _, e := range r.NamedUsers {
+		w.Put32(e.Id)
+		w.Put16(e.Perm)
+	}
+	w.Put32(uint32(len(r.NamedGroups)))
+	for _, e := range r.NamedGroups {
+		w.Put32(e.Id)
+		w.Put16(e.Perm)
+	}
+	return w.Bytes()
+}
+
+func (r *ACLRule) Decode(buf []byte) {
+	rb := utils.FromBuffer(buf)
+	r.Owner = rb.Get16()
+	r.Group = rb.Get16()
+	r.Mask = rb.Get16()
+	r.Other = rb.Get16()
+	r.NamedUsers = make([]ACLEntry, rb.Get32())
+	for i := range r.NamedUsers {
+		r.NamedUsers[i] = ACLEntry{rb.Get32(), rb.Get16()}
+	}
+	r.NamedGroups = make([]ACLEntry, rb.Get32())
+	for i := range r.NamedGroups {
+		r.NamedGroups[i] = ACLEntry{rb.Get32(), rb.Get16()}
+	}
+}
+
+// EncodeXattr encodes the rule into the value of system.posix_acl_access or system.posix_acl_default.
+func (r *ACLRule) EncodeXattr() []byte {
+	n := 3 + len(r.NamedUsers) + len(r.NamedGroups)
+	if r.Mask != aclUnset {
+		n++
+	}
+	buf := make([]byte, 4+n*8)
+	binary.LittleEndian.PutUint32(buf, aclXattrVer)
+	off := 4
+	put := func(tag, perm uint16, id uint32) {
+		binary.LittleEndian.PutUint16(buf[off:], tag)
+		binary.LittleEndian.PutUint16(buf[off+2:], perm)
+		binary.LittleEndian.PutUint32(buf[off+4:], id)
+		off += 8
+	}
+	put(aclUserObj, r.Owner, aclUndefined)
+	for _, e := range r.NamedUsers {
+		put(aclUser, e.Perm, e.Id)
+	}
+	put(aclGroupObj, r.Group, aclUndefined)
+	for _, e := range r.NamedGroups {
+		put(aclGroup, e.Perm, e.Id)
+	}
+	if r.Mask != aclUnset {
+		put(aclMask, r.Mask, aclUndefined)
+	}
+	put(aclOther, r.Other, aclUndefined)
+	return buf
+}
+
+// DecodeXattr parses the value of POSIX ACL extended attribute.
+func DecodeXattr(buf []byte) (*ACLRule, syscall.Errno) {
+	if len(buf) < 4 || (len(buf)-4)%8 != 0 || binary.LittleEndian.Uint32(buf) != aclXattrVer {
+		return nil, syscall.EINVAL
+	}
+	r := &ACLRule{Owner: aclUnset, Group: aclUnset, Mask: aclUnset, Other: aclUnset}
+	for off := 4; off < len(buf); off += 8 {
+		tag := binary.LittleEndian.Uint16(buf[off:])
+		perm := binary.LittleEndian.Uint16(buf[off+2:])
+		id := binary.LittleEndian.Uint32(buf[off+4:])
+		if perm&^7 != 0 {
+			return nil, syscall.EINVAL
+		}
+		switch tag {
+		case aclUserObj:
+			r.Owner = perm
+		case aclUser:
+			r.NamedUsers = append(r.NamedUsers, ACLEntry{id, perm})
+		case aclGroupObj:
+			r.Group = perm
+		case aclGroup:
+			r.NamedGroups = append(r.NamedGroups, ACLEntry{id, perm})
+		case aclMask:
+			r.Mask = perm
+		case aclOther:
+			r.Other = perm
+		default:
+			return nil, syscall.EINVAL
+		}
+	}
+	if r.Owner == aclUnset || r.Group == aclUnset || r.Other == aclUnset {
+		return nil, syscall.EINVAL
+	}
+	if !r.IsMinimal() && r.Mask == aclUnset {
+		return nil, syscall.EINVAL
+	}
+	sort.Slice(r.NamedUsers, func(i, j int) bool { return r.NamedUsers[i].Id < r.NamedUsers[j].Id })
+	sort.Slice(r.NamedGroups, func(i, j int) bool { return r.NamedGroups[i].Id < r.NamedGroups[j].Id })
+	return r, 0
+}
+
+// aclCache keeps the rules by id, and the id of rules to reuse them.
+type aclCache struct {
+	sync.Mutex
+	rules map[uint32]*ACLRule
+	ids   map[string]uint32
+}
+
+func newACLCache() *aclCache {
+	return &aclCache{rules: make(map[uint32]*ACLRule), ids: make(map[string]uint32)}
+}
+
+func (c *aclCache) put(id uint32, r *ACLRule) {
+	c.Lock()
+	defer c.Unlock()
+	c.rules[id] = r
+	c.ids[string(r.Encode())] = id
+}
+
+func (c *aclCache) get(id uint32) *ACLRule {
+	c.Lock()
+	defer c.Unlock()
+	return c.rules[id]
+}
+
+func (c *aclCache) getId(r *ACLRule) uint32 {
+	c.Lock()
+	defer c.Unlock()
+	return c.ids[string(r.Encode())]
+}
@@ -0,0 +1,58 @@
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestACLChangeOwner(t *testing.T) {
+	r := &ACLRule{
+		Owner:       7,
+		Group:       5,
+		Mask:        7,
+		Other:       0,
+		NamedUsers:  []ACLEntry{{Id: 1000, Perm: 4}, {Id: 1002, Perm: 6}},
+		NamedGroups: []ACLEntry{{Id: 2000, Perm: 1}},
+	}
+	if r.ChangeOwner(10, 10, 20, 20) != nil {
+		t.Fatalf("rule should not be changed")
+	}
+	c := r.ChangeOwner(10, 1002, 20, 2000)
+	expected := &ACLRule{
+		Owner:       6,
+		Group:       1,
+		Mask:        7,
+		Other:       0,
+		NamedUsers:  []ACLEntry{{Id: 10, Perm: 7}, {Id: 1000, Perm: 4}},
+		NamedGroups: []ACLEntry{{Id: 20, Perm: 5}},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expect %+v, got %+v", expected, c)
+	}
+	if len(r.NamedUsers) != 2 || r.NamedUsers[1].Id != 1002 || r.Owner != 7 {
+		t.Fatalf("the origin rule should not be changed: %+v", r)
+	}
+
+	// the mask is added for the new named entry
+	r = NewACLRule(0640)
+	c = r.ChangeOwner(10, 11, 20, 20)
+	if c.Owner != 6 || !c.HasMask() || c.Mask != 6 || len(c.NamedUsers) != 1 || c.NamedUsers[0] != (ACLEntry{Id: 10, Perm: 6}) {
+		t.Fatalf("change owner of minimal rule: %+v", c)
+	}
+}
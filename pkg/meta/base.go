@@ -26,6 +26,7 @@ import (
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,16 +36,18 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/version"
+	"github.com/juju/ratelimit"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
-	inodeBatch    = 100
-	sliceIdBatch  = 1000
-	minUpdateTime = time.Millisecond * 10
-	nlocks        = 1024
+	inodeBatch      = 100
+	sliceIdBatch    = 1000
+	minUpdateTime   = time.Millisecond * 10
+	nlocks          = 1024
+	readdirPageSize = 10000
 )
 
 type engine interface {
@@ -60,7 +63,8 @@ type engine interface {
 	doLoad() ([]byte, error)
 
 	doNewSession(sinfo []byte) error
-	doRefreshSession() error
+	doRefreshSession() error // returns errSessionEvicted if the session is evicted
+	doEvictSession(sid uint64) error
 	doFindStaleSessions(limit int) ([]uint64, error) // limit < 0 means all
 	doCleanStaleSession(sid uint64) error
 	doInit(format *Format, force bool) error
@@ -74,6 +78,25 @@ type engine interface {
 	doCleanupDelayedSlices(edge int64) (int, error)
 	doDeleteSlice(id uint64, size uint32) error
 
+	// small blocks kept in meta engine, os.ErrNotExist is returned if not found
+	doGetInline(key string) ([]byte, error)
+	doSetInline(key string, data []byte) error
+	doDeleteInline(key string) error
+	doScanInline(fn func(key string, data []byte) error) error
+
+	// hash of deduplicated blocks and refcount of the contents
+	doRefBlock(key, hash string) (int64, error)
+	doUnrefBlock(key string) (string, int64, error)
+	doGetBlockHash(key string) (string, error)
+	doDropContent(hash string) error
+	doScanBlockHash(fn func(key, hash string) error) error
+
+	// location of packed blocks and refcount of the packs
+	doPackBlocks(pack string, locs map[string]string) (int64, error)
+	doGetPackedBlock(key string) (string, error)
+	doUnpackBlock(key string) (string, int64, error)
+	doScanPackedBlock(fn func(key, loc string) error) error
+
 	doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string, ino Ino, attr *Attr, cmode uint8, cumask uint16, top bool) syscall.Errno
 	doAttachDirNode(ctx Context, parent Ino, dstIno Ino, name string) syscall.Errno
 	doFindDetachedNodes(t time.Time) []Ino
@@ -85,6 +108,15 @@ type engine interface {
 	doLoadQuotas(ctx Context) (map[Ino]*Quota, error)
 	doFlushQuotas(ctx Context, quotas map[Ino]*Quota) error
 
+	doLogChanges(ts int64, inodes []Ino) error
+	doScanChanges(ctx Context, since, until int64, fn func(inode Ino)) error // since <= ts < until
+	doTrimChanges(before int64) error
+	// publish the inodes changed by this client, the published ones before the given time can be cleaned up
+	doPublishInvalidation(ts int64, msg []byte) error
+	// call fn with the messages published by all the clients until an error happens
+	doSubscribeInvalidation(fn func(msg []byte)) error
+	doCleanupInvalidation(before int64) error
+
 	doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno
 	doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno
 	doMknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno
@@ -93,9 +125,16 @@ type engine interface {
 	doRmdir(ctx Context, parent Ino, name string, inode *Ino, skipCheckTrash ...bool) syscall.Errno
 	doReadlink(ctx Context, inode Ino, noatime bool) (int64, []byte, error)
 	doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry, limit int) syscall.Errno
+	// find the entry with the folded name in case-insensitive volume
+	doLookupFolded(ctx Context, parent Ino, name string) *Entry
+	// appends the entries whose names are after the given one in byte order
+	doReaddirPage(ctx Context, inode Ino, plus uint8, after []byte, limit int, entries *[]*Entry) syscall.Errno
 	doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode, tinode *Ino, attr, tattr *Attr) syscall.Errno
 	doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
 	doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
+	doSetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno
+	doGetACL(id uint32) (*ACLRule, error)
+	doInsertACL(id uint32, rule *ACLRule) error
 	doRepair(ctx Context, inode Ino, attr *Attr) syscall.Errno
 	doTouchAtime(ctx Context, inode Ino, attr *Attr, ts time.Time) (bool, error)
 
@@ -159,25 +198,55 @@ type baseMeta struct {
 	msgCallbacks *msgCallbacks
 	reloadCb     []func(*Format)
 	umounting    bool
+	frozen       int32 // read-only because the metadata is migrated (atomic)
+	evicted      bool  // read-only because the session is evicted
+	leaseExpire  int64 // in nanoseconds, the session may be cleaned up by others after it
 	sesMu        sync.Mutex
 
+	pauseMu      sync.Mutex
+	resumed      chan struct{}    // closed when the paused writes are resumed, nil if not paused
+	writing      int              // number of write transactions in flight
+	blocked      bool             // the write transactions are blocked (after the changes in flight are finished)
+	changing     int              // number of changes of the tree in flight
+	pending      *pendingSnapshot // the snapshot being filled, the changes are kept in it first
+	snapshotting int64            // deadline of the snapshot being created by this client
+
 	dirStatsLock sync.Mutex
 	dirStats     map[Ino]dirStat
 	*fsStat
+	rootUsage subtreeUsage // usage of the mounted subdir, for statfs
+
+	parentMu    sync.Mutex     // protect dirParents
+	quotaMu     sync.RWMutex   // protect dirQuotas and ownerQuotas
+	dirParents  map[Ino]Ino    // directory inode -> parent inode
+	dirQuotas   map[Ino]*Quota // directory inode -> quota
+	ownerQuotas map[Ino]*Quota // userQuotaIno(uid) or groupQuotaIno(gid) -> quota
 
-	parentMu   sync.Mutex     // protect dirParents
-	quotaMu    sync.RWMutex   // protect dirQuotas
-	dirParents map[Ino]Ino    // directory inode -> parent inode
-	dirQuotas  map[Ino]*Quota // directory inode -> quota
+	changesMu sync.Mutex
+	changes   map[Ino]struct{} // changed inodes to be logged
 
-	freeMu     sync.Mutex
-	freeInodes freeID
-	freeSlices freeID
+	watchMu   sync.Mutex
+	watchers  map[*Watcher]struct{}
+	watching  int32     // number of watchers
+	subscribe sync.Once // subscribe the invalidations for cache or watchers
+
+	acls *aclCache // rules of ACL by id
+
+	freeMu      sync.Mutex
+	freeInodes  freeID
+	freeSlices  freeID
+	inodeBase   Ino         // added to the allocated inodes, to make them unique across shards
+	sliceSource *baseMeta   // allocate the ids of slices from another shard
+	quotaSource *baseMeta   // keep the quotas of users and groups in another shard
+	quotaShards []*baseMeta // all the shards, whose usage is counted in the quotas of users and groups
+
+	opsRate  int64        // limit of metadata operations per second
+	opsLimit atomic.Value // *ratelimit.Bucket
 
 	usedSpaceG  prometheus.Gauge
 	usedInodesG prometheus.Gauge
-	txDist      prometheus.Histogram
-	txRestart   prometheus.Counter
+	txDist      *prometheus.HistogramVec
+	txRestart   *prometheus.CounterVec
 	opDist      *prometheus.HistogramVec
 
 	en engine
@@ -197,6 +266,10 @@ func newBaseMeta(addr string, conf *Config) *baseMeta {
 		dirStats:     make(map[Ino]dirStat),
 		dirParents:   make(map[Ino]Ino),
 		dirQuotas:    make(map[Ino]*Quota),
+		ownerQuotas:  make(map[Ino]*Quota),
+		changes:      make(map[Ino]struct{}),
+		watchers:     make(map[*Watcher]struct{}),
+		acls:         newACLCache(),
 		msgCallbacks: &msgCallbacks{
 			callbacks: make(map[uint32]MsgCallback),
 		},
@@ -209,15 +282,15 @@ func newBaseMeta(addr string, conf *Config) *baseMeta {
 			Name: "used_inodes",
 			Help: "Total number of inodes.",
 		}),
-		txDist: prometheus.NewHistogram(prometheus.HistogramOpts{
+		txDist: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "transaction_durations_histogram_seconds",
 			Help:    "Transactions latency distributions.",
 			Buckets: prometheus.ExponentialBuckets(0.0001, 1.5, 30),
-		}),
-		txRestart: prometheus.NewCounter(prometheus.CounterOpts{
+		}, []string{"method"}),
+		txRestart: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "transaction_restart",
 			Help: "The number of times a transaction is restarted.",
-		}),
+		}, []string{"method"}),
 		opDist: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "meta_ops_durations_histogram_seconds",
 			Help:    "Operation latency distributions.",
@@ -251,6 +324,75 @@ func (m *baseMeta) InitMetrics(reg prometheus.Registerer) {
 
 func (m *baseMeta) timeit(method string, start time.Time) {
 	m.opDist.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if limit, _ := m.opsLimit.Load().(*ratelimit.Bucket); limit != nil {
+		limit.Wait(1)
+	}
+}
+
+func (m *baseMeta) ClientLimit() *ClientLimit {
+	host, _ := os.Hostname()
+	format := m.GetFormat()
+	return format.ClientLimit(m.sid, host)
+}
+
+// updateOpsLimit applies the limit of metadata operations defined for this client.
+func (m *baseMeta) updateOpsLimit() {
+	var rate int64
+	if l := m.ClientLimit(); l != nil {
+		rate = l.MetaOps
+	}
+	if rate == m.opsRate {
+		return
+	}
+	logger.Infof("Limit of metadata operations changed from %d to %d per second", m.opsRate, rate)
+	m.opsRate = rate
+	var limit *ratelimit.Bucket
+	if rate > 0 {
+		limit = ratelimit.NewBucketWithRate(float64(rate), rate)
+	}
+	m.opsLimit.Store(limit)
+}
+
+var txnMethods sync.Map // pc -> name of method
+
+// txnMethod returns the name of the method which starts a transaction, for example, "doMknod"
+// for (*redisMeta).doMknod. It should be called in the function of transaction directly.
+func txnMethod() string {
+	pc, _, _, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown"
+	}
+	if name, ok := txnMethods.Load(pc); ok {
+		return name.(string)
+	}
+	name := "unknown"
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		name = fn.Name()                                 // github.com/juicedata/juicefs/pkg/meta.(*redisMeta).doMknod.func1
+		name = name[strings.LastIndexByte(name, '/')+1:] // meta.(*redisMeta).doMknod.func1
+		if p := strings.LastIndex(name, ")."); p >= 0 {
+			name = name[p+2:]
+		} else {
+			name = name[strings.IndexByte(name, '.')+1:]
+		}
+		if p := strings.IndexByte(name, '.'); p > 0 {
+			name = name[:p] // strip the closures
+		}
+	}
+	txnMethods.Store(pc, name)
+	return name
+}
+
+// observeTxn records the duration and restarts of a transaction, and logs it with the keys or inodes
+// it works on if it's slower than SlowTxn.
+func (m *baseMeta) observeTxn(method string, start time.Time, restarts int, args interface{}) {
+	used := time.Since(start)
+	m.txDist.WithLabelValues(method).Observe(used.Seconds())
+	if restarts > 0 {
+		m.txRestart.WithLabelValues(method).Add(float64(restarts))
+	}
+	if m.conf.SlowTxn > 0 && used > m.conf.SlowTxn {
+		logger.Warnf("Slow transaction %s: used %s, restarted %d times, args: %v", method, used, restarts, args)
+	}
 }
 
 func (m *baseMeta) getBase() *baseMeta {
@@ -437,6 +579,9 @@ func (m *baseMeta) Load(checkVersion bool) (*Format, error) {
 		}
 	}
 	m.fmt = &format
+	if format.CaseInsensitive {
+		m.conf.CaseInsensi = true
+	}
 	return m.fmt, nil
 }
 
@@ -471,9 +616,16 @@ func (m *baseMeta) newSessionInfo() []byte {
 }
 
 func (m *baseMeta) NewSession() error {
+	if m.fmt != nil && m.fmt.MigratedTo != "" {
+		return fmt.Errorf("metadata of volume %s has been migrated to %s, please use it instead", m.fmt.Name, m.fmt.MigratedTo)
+	}
 	go m.refresh()
+	if m.conf.CacheInvalidation {
+		m.subscribe.Do(func() { go m.subscribeInvalidation() })
+	}
 	if m.conf.ReadOnly {
 		logger.Infof("Create read-only session OK with version: %s", version.Version())
+		m.updateOpsLimit()
 		return nil
 	}
 
@@ -486,11 +638,17 @@ func (m *baseMeta) NewSession() error {
 		return fmt.Errorf("create session: %s", err)
 	}
 	logger.Infof("Create session %d OK with version: %s", m.sid, version.Version())
+	m.extendLease(time.Now())
+	if err = m.checkPause(); err != nil {
+		return fmt.Errorf("check paused writes: %s", err)
+	}
+	m.updateOpsLimit()
 
 	m.loadQuotas()
 	go m.en.flushStats()
 	go m.flushDirStat()
 	go m.flushQuotas()
+	go m.flushChanges()
 
 	if m.conf.MaxDeletes > 0 {
 		m.dslices = make(chan Slice, m.conf.MaxDeletes*10240)
@@ -510,6 +668,8 @@ func (m *baseMeta) NewSession() error {
 	return nil
 }
 
+var errSessionEvicted = errors.New("session is evicted")
+
 func (m *baseMeta) expireTime() int64 {
 	if m.conf.Heartbeat > 0 {
 		return time.Now().Add(m.conf.Heartbeat * 5).Unix()
@@ -524,6 +684,33 @@ func (m *baseMeta) OnReload(fn func(f *Format)) {
 	m.reloadCb = append(m.reloadCb, fn)
 }
 
+// checkMigrated freezes the client once the metadata is migrated to another engine, so no more changes
+// are made to the old one during cutover. The buffered writes are flushed before that.
+func (m *baseMeta) checkMigrated() {
+	if m.fmt.MigratedTo != "" && !m.isFrozen() {
+		if !m.conf.ReadOnly {
+			m.msgCallbacks.Lock()
+			_, ok := m.msgCallbacks.callbacks[FlushWrites]
+			m.msgCallbacks.Unlock()
+			if ok {
+				if err := m.newMsg(FlushWrites); err != nil {
+					logger.Warnf("Flush buffered writes before freezing: %s", err)
+				}
+			}
+		}
+		atomic.StoreInt32(&m.frozen, 1)
+		logger.Warnf("Metadata has been migrated to %s, the volume is read-only now, please remount it with the new META-URL", m.fmt.MigratedTo)
+	} else if m.fmt.MigratedTo == "" && m.isFrozen() {
+		atomic.StoreInt32(&m.frozen, 0)
+		logger.Infof("Migration of metadata is aborted, the volume is writable again")
+	}
+}
+
+// isFrozen returns true if no changes can be made because the metadata is migrated.
+func (m *baseMeta) isFrozen() bool {
+	return atomic.LoadInt32(&m.frozen) == 1
+}
+
 func (m *baseMeta) refresh() {
 	for {
 		if m.conf.Heartbeat > 0 {
@@ -537,8 +724,22 @@ func (m *baseMeta) refresh() {
 			return
 		}
 		if !m.conf.ReadOnly && m.conf.Heartbeat > 0 {
-			if err := m.en.doRefreshSession(); err != nil {
+			start := time.Now()
+			err := m.checkPause()
+			if err == nil {
+				err = m.en.doRefreshSession()
+			}
+			if err == errSessionEvicted {
+				logger.Errorf("Session %d is evicted, the volume is read-only now, please remount it", m.sid)
+				m.conf.ReadOnly = true
+				m.evicted = true
+			} else if err != nil {
 				logger.Errorf("Refresh session %d: %s", m.sid, err)
+				if m.leaseExpired() {
+					logger.Warnf("Lease of session %d is expired, no more changes can be made until it's renewed", m.sid)
+				}
+			} else {
+				m.extendLease(start)
 			}
 		}
 		m.sesMu.Unlock()
@@ -558,20 +759,22 @@ func (m *baseMeta) refresh() {
 				cb(m.fmt)
 			}
 		}
+		m.checkMigrated()
+		m.updateOpsLimit()
 
-		if v, err := m.en.getCounter(usedSpace); err == nil {
+		if v, err := m.volumeUsage(usedSpace, snapshotSpace); err == nil {
 			atomic.StoreInt64(&m.usedSpace, v)
 		} else {
 			logger.Warnf("Get counter %s: %s", usedSpace, err)
 		}
-		if v, err := m.en.getCounter(totalInodes); err == nil {
+		if v, err := m.volumeUsage(totalInodes, snapshotInodes); err == nil {
 			atomic.StoreInt64(&m.usedInodes, v)
 		} else {
 			logger.Warnf("Get counter %s: %s", totalInodes, err)
 		}
 		m.loadQuotas()
 
-		if m.conf.ReadOnly || m.conf.NoBGJob || m.conf.Heartbeat == 0 {
+		if m.conf.ReadOnly || m.conf.NoBGJob || m.conf.Heartbeat == 0 || m.writesPaused() || m.isFrozen() {
 			continue
 		}
 		if ok, err := m.en.setIfSmall("lastCleanupSessions", time.Now().Unix(), int64((m.conf.Heartbeat * 9 / 10).Seconds())); err != nil {
@@ -594,32 +797,92 @@ func (m *baseMeta) CleanStaleSessions() {
 			logger.Warnf("Get session info %d: %s", sid, err)
 			s = &Session{Sid: sid}
 		}
+		if err = m.markLostChanges(sid); err != nil {
+			logger.Warnf("Skip cleaning up stale session %d: %s", sid, err)
+			continue
+		}
 		logger.Infof("clean up stale session %d %+v: %s", sid, s.SessionInfo, m.en.doCleanStaleSession(sid))
 	}
 }
 
+// extendLease extends the lease of session for 4 heartbeats since start, which is one heartbeat
+// shorter than the expire time seen by others, to tolerate the clock skew.
+func (m *baseMeta) extendLease(start time.Time) {
+	if m.conf.Heartbeat > 0 {
+		atomic.StoreInt64(&m.leaseExpire, start.Add(m.conf.Heartbeat*4).UnixNano())
+	}
+}
+
+// leaseExpired returns true if the session is not refreshed in time, then the locks and sustained
+// inodes of it may be cleaned up by other clients, so no changes should be made until it's renewed.
+func (m *baseMeta) leaseExpired() bool {
+	expire := atomic.LoadInt64(&m.leaseExpire)
+	return expire > 0 && time.Now().UnixNano() > expire
+}
+
+func (m *baseMeta) EvictSession(ctx Context, sid uint64) error {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if sid == m.sid {
+		return fmt.Errorf("can't evict the current session %d", sid)
+	}
+	s, err := m.en.GetSession(sid, false)
+	if err != nil {
+		return err
+	}
+	if err = m.en.doEvictSession(sid); err != nil {
+		return fmt.Errorf("evict session %d: %s", sid, err)
+	}
+	if err = m.markLostChanges(sid); err != nil {
+		return err
+	}
+	logger.Infof("evict session %d %+v: %s", sid, s.SessionInfo, m.en.doCleanStaleSession(sid))
+	return nil
+}
+
 func (m *baseMeta) CloseSession() error {
 	if m.conf.ReadOnly {
 		return nil
 	}
 	m.doFlushDirStat()
+	err := m.logChanges()
 	m.sesMu.Lock()
 	m.umounting = true
 	m.sesMu.Unlock()
+	if err != nil && m.changelogOn() {
+		// it will be cleaned up by others as a stale session, and the lost changes are marked then
+		logger.Warnf("Leave session %d open since the changes are not logged: %s", m.sid, err)
+		return nil
+	}
 	logger.Infof("close session %d: %s", m.sid, m.en.doCleanStaleSession(m.sid))
 	return nil
 }
 
-func (m *baseMeta) checkQuota(ctx Context, space, inodes int64, parents ...Ino) syscall.Errno {
+func (m *baseMeta) checkQuota(ctx Context, space, inodes int64, uid, gid uint32, parents ...Ino) syscall.Errno {
 	if space <= 0 && inodes <= 0 {
 		return 0
 	}
+	if st := m.checkCapacity(space, inodes); st != 0 {
+		return st
+	}
+	if m.checkOwnerQuota(uid, gid, space, inodes) {
+		return syscall.EDQUOT
+	}
+	return m.checkDirQuotas(ctx, space, inodes, parents)
+}
+
+func (m *baseMeta) checkCapacity(space, inodes int64) syscall.Errno {
 	if space > 0 && m.fmt.Capacity > 0 && atomic.LoadInt64(&m.usedSpace)+atomic.LoadInt64(&m.newSpace)+space > int64(m.fmt.Capacity) {
 		return syscall.ENOSPC
 	}
 	if inodes > 0 && m.fmt.Inodes > 0 && atomic.LoadInt64(&m.usedInodes)+atomic.LoadInt64(&m.newInodes)+inodes > int64(m.fmt.Inodes) {
 		return syscall.ENOSPC
 	}
+	return 0
+}
+
+func (m *baseMeta) checkDirQuotas(ctx Context, space, inodes int64, parents []Ino) syscall.Errno {
 	if !m.GetFormat().DirStats {
 		return 0
 	}
@@ -635,23 +898,25 @@ func (m *baseMeta) loadQuotas() {
 	quotas, err := m.en.doLoadQuotas(Background)
 	if err == nil {
 		m.quotaMu.Lock()
-		for ino := range m.dirQuotas {
-			if _, ok := quotas[ino]; !ok {
-				logger.Infof("Quota for inode %d is deleted", ino)
-				delete(m.dirQuotas, ino)
+		for _, qs := range []map[Ino]*Quota{m.dirQuotas, m.ownerQuotas} {
+			for ino := range qs {
+				if _, ok := quotas[ino]; !ok {
+					logger.Infof("Quota for %s is deleted", quotaName(ino))
+					delete(qs, ino)
+				}
 			}
 		}
 		for ino, q := range quotas {
-			logger.Debugf("Load quotas got %d -> %+v", ino, q)
-			if _, ok := m.dirQuotas[ino]; !ok {
-				m.dirQuotas[ino] = q
+			logger.Debugf("Load quotas got %s -> %+v", quotaName(ino), q)
+			if qs := m.quotaMap(ino); qs[ino] == nil {
+				qs[ino] = q
 			}
 		}
 		m.quotaMu.Unlock()
 
-		// skip lock since I'm the only one updating the m.dirQuotas
+		// skip lock since I'm the only one updating the m.dirQuotas and m.ownerQuotas
 		for ino, q := range quotas {
-			quota := m.dirQuotas[ino]
+			quota := m.quotaMap(ino)[ino]
 			atomic.SwapInt64(&quota.MaxSpace, q.MaxSpace)
 			atomic.SwapInt64(&quota.MaxInodes, q.MaxInodes)
 			atomic.SwapInt64(&quota.UsedSpace, q.UsedSpace)
@@ -746,30 +1011,247 @@ func (m *baseMeta) updateDirQuota(ctx Context, inode Ino, space, inodes int64) {
 	}
 }
 
+// The quotas of users and groups are saved together with the directory quotas, using the id plus
+// a base as the inode, which is far beyond the range of normal inodes.
+const (
+	groupQuotaBase Ino = 0x7FFFFFFD00000000
+	userQuotaBase  Ino = 0x7FFFFFFE00000000
+)
+
+func userQuotaIno(uid uint32) Ino  { return userQuotaBase + Ino(uid) }
+func groupQuotaIno(gid uint32) Ino { return groupQuotaBase + Ino(gid) }
+
+func isOwnerQuota(ino Ino) bool {
+	return ino >= groupQuotaBase && ino < userQuotaBase+1<<32
+}
+
+// parseOwnerQuota parses the name of quota for user (uid:<uid>) or group (gid:<gid>).
+func parseOwnerQuota(name string) (Ino, bool) {
+	var kind string
+	var id uint32
+	if n, err := fmt.Sscanf(name, "%3s:%d", &kind, &id); err != nil || n != 2 || fmt.Sprintf("%s:%d", kind, id) != name {
+		return 0, false
+	}
+	switch kind {
+	case "uid":
+		return userQuotaIno(id), true
+	case "gid":
+		return groupQuotaIno(id), true
+	}
+	return 0, false
+}
+
+func quotaName(ino Ino) string {
+	switch {
+	case ino >= userQuotaBase && ino < userQuotaBase+1<<32:
+		return fmt.Sprintf("uid:%d", ino-userQuotaBase)
+	case ino >= groupQuotaBase && ino < groupQuotaBase+1<<32:
+		return fmt.Sprintf("gid:%d", ino-groupQuotaBase)
+	default:
+		return fmt.Sprintf("inode %d", ino)
+	}
+}
+
+// ownerQuotaMeta returns the meta which keeps the quotas of users and groups.
+func (m *baseMeta) ownerQuotaMeta() *baseMeta {
+	if m.quotaSource != nil {
+		return m.quotaSource
+	}
+	return m
+}
+
+// quotaMap returns the map that the quota of ino belongs to, the caller should hold quotaMu.
+func (m *baseMeta) quotaMap(ino Ino) map[Ino]*Quota {
+	if isOwnerQuota(ino) {
+		return m.ownerQuotas
+	}
+	return m.dirQuotas
+}
+
+func (m *baseMeta) hasOwnerQuota() bool {
+	m = m.ownerQuotaMeta()
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	return len(m.ownerQuotas) > 0
+}
+
+// checkOwnerQuota returns true if it will exceed the quota of the user or the group.
+func (m *baseMeta) checkOwnerQuota(uid, gid uint32, space, inodes int64) bool {
+	m = m.ownerQuotaMeta()
+	m.quotaMu.RLock()
+	uq, gq := m.ownerQuotas[userQuotaIno(uid)], m.ownerQuotas[groupQuotaIno(gid)]
+	m.quotaMu.RUnlock()
+	return uq != nil && uq.check(space, inodes) || gq != nil && gq.check(space, inodes)
+}
+
+func (m *baseMeta) updateOwnerQuota(uid, gid uint32, space, inodes int64) {
+	if space == 0 && inodes == 0 {
+		return
+	}
+	m = m.ownerQuotaMeta()
+	m.quotaMu.RLock()
+	uq, gq := m.ownerQuotas[userQuotaIno(uid)], m.ownerQuotas[groupQuotaIno(gid)]
+	m.quotaMu.RUnlock()
+	if uq != nil {
+		uq.update(space, inodes)
+	}
+	if gq != nil {
+		gq.update(space, inodes)
+	}
+}
+
+// ownerUsage returns the usage of an inode counted in the quotas of its owner.
+func ownerUsage(attr *Attr) (space, inodes int64) {
+	if attr.Typ == TypeFile {
+		return align4K(attr.Length), 1
+	}
+	return align4K(0), 1
+}
+
+// checkOwnerChange returns EDQUOT if the new user or group of an inode will exceed its quota.
+func (m *baseMeta) checkOwnerChange(cur, attr *Attr) syscall.Errno {
+	space, inodes := ownerUsage(cur)
+	var qs []*Quota
+	m = m.ownerQuotaMeta()
+	m.quotaMu.RLock()
+	if attr.Uid != cur.Uid {
+		qs = append(qs, m.ownerQuotas[userQuotaIno(attr.Uid)])
+	}
+	if attr.Gid != cur.Gid {
+		qs = append(qs, m.ownerQuotas[groupQuotaIno(attr.Gid)])
+	}
+	m.quotaMu.RUnlock()
+	for _, q := range qs {
+		if q != nil && q.check(space, inodes) {
+			return syscall.EDQUOT
+		}
+	}
+	return 0
+}
+
+// moveOwnerQuota moves the usage of an inode from its old owner to the new one.
+func (m *baseMeta) moveOwnerQuota(cur, attr *Attr) {
+	if cur.Uid == attr.Uid && cur.Gid == attr.Gid {
+		return
+	}
+	space, inodes := ownerUsage(cur)
+	m.updateOwnerQuota(cur.Uid, cur.Gid, -space, -inodes)
+	m.updateOwnerQuota(attr.Uid, attr.Gid, space, inodes)
+}
+
+// inheritGid returns true if a new inode should use the group of its parent.
+func inheritGid(ctx Context, pattr *Attr) bool {
+	return ctx.Value(CtxKey("behavior")) == "Hadoop" || runtime.GOOS == "darwin" ||
+		runtime.GOOS == "linux" && pattr.Mode&02000 != 0
+}
+
+// calcOwnerUsage walks through the whole tree (including trash) to calculate the usage of a user or group,
+// the files with multiple hard links are only counted once.
+func (m *baseMeta) calcOwnerUsage(ctx Context, qino Ino) (space, inodes int64, st syscall.Errno) {
+	if len(m.quotaShards) == 0 {
+		return m.scanOwnerUsage(ctx, qino, true)
+	}
+	for i, s := range m.quotaShards {
+		// the root directory is shared by all the shards, count it only once
+		sp, in, st := s.scanOwnerUsage(ctx, qino, i == 0)
+		if st != 0 {
+			return 0, 0, st
+		}
+		space += sp
+		inodes += in
+	}
+	return
+}
+
+// scanOwnerUsage calculates the usage of a user or group in the tree of this meta.
+func (m *baseMeta) scanOwnerUsage(ctx Context, qino Ino, withRoot bool) (space, inodes int64, st syscall.Errno) {
+	match := func(attr *Attr) bool {
+		if qino >= userQuotaBase {
+			return userQuotaIno(attr.Uid) == qino
+		}
+		return groupQuotaIno(attr.Gid) == qino
+	}
+	var root Attr
+	if st = m.en.doGetAttr(ctx, RootInode, &root); st != 0 {
+		return
+	}
+	if withRoot && match(&root) {
+		space, inodes = align4K(0), 1
+	}
+	seen := make(map[Ino]bool)
+	var walk func(ino Ino) syscall.Errno
+	walk = func(ino Ino) syscall.Errno {
+		var entries []*Entry
+		if st := m.en.doReaddir(ctx, ino, 1, &entries, -1); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if ctx.Canceled() {
+				return syscall.EINTR
+			}
+			if ino == RootInode && string(e.Name) == SnapshotDir {
+				continue // snapshots are not counted
+			}
+			if e.Attr.Typ != TypeDirectory && e.Attr.Nlink > 1 {
+				if seen[e.Inode] {
+					continue
+				}
+				seen[e.Inode] = true
+			}
+			if match(e.Attr) {
+				inodes++
+				if e.Attr.Typ == TypeFile {
+					space += align4K(e.Attr.Length)
+				} else {
+					space += align4K(0)
+				}
+			}
+			if e.Attr.Typ == TypeDirectory {
+				if st := walk(e.Inode); st != 0 {
+					return st
+				}
+			}
+		}
+		return 0
+	}
+	if st = walk(RootInode); st == 0 {
+		if st = walk(TrashInode); st == syscall.ENOENT {
+			st = 0
+		}
+	}
+	return
+}
+
 func (m *baseMeta) flushQuotas() {
 	quotas := make(map[Ino]*Quota)
 	var newSpace, newInodes int64
 	for {
 		time.Sleep(time.Second * 3)
-		if !m.GetFormat().DirStats {
-			continue
-		}
 		m.quotaMu.RLock()
-		for ino, q := range m.dirQuotas {
-			newSpace = atomic.LoadInt64(&q.newSpace)
-			newInodes = atomic.LoadInt64(&q.newInodes)
-			if newSpace != 0 || newInodes != 0 {
-				quotas[ino] = &Quota{newSpace: newSpace, newInodes: newInodes}
+		qss := []map[Ino]*Quota{m.ownerQuotas}
+		if m.GetFormat().DirStats {
+			qss = append(qss, m.dirQuotas)
+		}
+		for _, qs := range qss {
+			for ino, q := range qs {
+				newSpace = atomic.LoadInt64(&q.newSpace)
+				newInodes = atomic.LoadInt64(&q.newInodes)
+				if newSpace != 0 || newInodes != 0 {
+					quotas[ino] = &Quota{newSpace: newSpace, newInodes: newInodes}
+				}
 			}
 		}
 		m.quotaMu.RUnlock()
+		if len(quotas) == 0 && len(qss) == 1 {
+			continue
+		}
 
 		if err := m.en.doFlushQuotas(Background, quotas); err != nil {
 			logger.Warnf("Flush quotas: %s", err)
 		} else {
 			m.quotaMu.RLock()
 			for ino, snap := range quotas {
-				q := m.dirQuotas[ino]
+				q := m.quotaMap(ino)[ino]
 				if q == nil {
 					continue
 				}
@@ -791,6 +1273,9 @@ func (m *baseMeta) Init(format *Format, force bool) error {
 }
 
 func (m *baseMeta) HandleQuota(ctx Context, cmd uint8, dpath string, quotas map[string]*Quota, strict, repair bool) error {
+	if qino, ok := parseOwnerQuota(dpath); ok {
+		return m.handleOwnerQuota(ctx, cmd, qino, dpath, quotas, repair)
+	}
 	var inode Ino
 	if cmd != QuotaList {
 		if st := m.resolve(ctx, dpath, &inode); st != 0 {
@@ -863,7 +1348,9 @@ func (m *baseMeta) HandleQuota(ctx Context, cmd uint8, dpath string, quotas map[
 		}
 		var p string
 		for ino, quota := range quotaMap {
-			if ps := m.GetPaths(ctx, ino); len(ps) > 0 {
+			if isOwnerQuota(ino) {
+				quotas[quotaName(ino)] = quota
+			} else if ps := m.GetPaths(ctx, ino); len(ps) > 0 {
 				p = ps[0]
 			} else {
 				p = fmt.Sprintf("inode:%d", ino)
@@ -908,6 +1395,87 @@ func (m *baseMeta) HandleQuota(ctx Context, cmd uint8, dpath string, quotas map[
 	return nil
 }
 
+// handleOwnerQuota manages the quota of a user (name is uid:<uid>) or a group (name is gid:<gid>).
+func (m *baseMeta) handleOwnerQuota(ctx Context, cmd uint8, qino Ino, name string, quotas map[string]*Quota, repair bool) error {
+	switch cmd {
+	case QuotaSet:
+		q, err := m.en.doGetQuota(ctx, qino)
+		if err != nil {
+			return err
+		}
+		quota := quotas[name]
+		if q == nil {
+			space, inodes, st := m.calcOwnerUsage(ctx, qino)
+			if st != 0 {
+				return st
+			}
+			quota.UsedSpace, quota.UsedInodes = space, inodes
+			if quota.MaxSpace < 0 {
+				quota.MaxSpace = 0
+			}
+			if quota.MaxInodes < 0 {
+				quota.MaxInodes = 0
+			}
+			return m.en.doSetQuota(ctx, qino, quota, true)
+		}
+		quota.UsedSpace, quota.UsedInodes = q.UsedSpace, q.UsedInodes
+		if quota.MaxSpace < 0 {
+			quota.MaxSpace = q.MaxSpace
+		}
+		if quota.MaxInodes < 0 {
+			quota.MaxInodes = q.MaxInodes
+		}
+		if quota.MaxSpace == q.MaxSpace && quota.MaxInodes == q.MaxInodes {
+			return nil // nothing to update
+		}
+		return m.en.doSetQuota(ctx, qino, quota, false)
+	case QuotaGet:
+		q, err := m.en.doGetQuota(ctx, qino)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			return fmt.Errorf("no quota for %s", name)
+		}
+		quotas[name] = q
+	case QuotaDel:
+		return m.en.doDelQuota(ctx, qino)
+	case QuotaCheck:
+		q, err := m.en.doGetQuota(ctx, qino)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			return fmt.Errorf("no quota for %s", name)
+		}
+		usedSpace, usedInodes, st := m.calcOwnerUsage(ctx, qino)
+		if st != 0 {
+			return st
+		}
+		if q.UsedInodes == usedInodes && q.UsedSpace == usedSpace {
+			logger.Infof("quota of %s is consistent", name)
+			quotas[name] = q
+			return nil
+		}
+		logger.Warnf(
+			"%s: quota(%s, %s) != usage(%s, %s)", name,
+			humanize.Comma(q.UsedInodes), humanize.IBytes(uint64(q.UsedSpace)),
+			humanize.Comma(usedInodes), humanize.IBytes(uint64(usedSpace)),
+		)
+		if repair {
+			q.UsedInodes = usedInodes
+			q.UsedSpace = usedSpace
+			quotas[name] = q
+			logger.Info("repairing...")
+			return m.en.doSetQuota(ctx, qino, q, true)
+		}
+		return fmt.Errorf("quota of %s is inconsistent, please repair it with --repair flag", name)
+	default:
+		return fmt.Errorf("invalid quota command: %d", cmd)
+	}
+	return nil
+}
+
 func (m *baseMeta) cleanupDeletedFiles() {
 	for {
 		utils.SleepWithJitter(time.Minute)
@@ -952,7 +1520,8 @@ func (m *baseMeta) StatFS(ctx Context, ino Ino, totalspace, availspace, iused, i
 	}
 	var usage *Quota
 	var attr Attr
-	for root := ino; root >= RootInode; root = attr.Parent {
+	inside := true // the usage outside of the mounted root is not visible, but its quota still limits the available space
+	for root := ino; root >= RootInode; inside, root = inside && root != m.root, attr.Parent {
 		if st := m.GetAttr(ctx, root, &attr); st != 0 {
 			return st
 		}
@@ -966,7 +1535,7 @@ func (m *baseMeta) StatFS(ctx Context, ino Ino, totalspace, availspace, iused, i
 		if q == nil {
 			continue
 		}
-		if usage == nil {
+		if usage == nil && inside {
 			usage = q
 		}
 		if q.MaxSpace > 0 {
@@ -989,6 +1558,11 @@ func (m *baseMeta) StatFS(ctx Context, ino Ino, totalspace, availspace, iused, i
 		}
 	}
 	if usage == nil {
+		if m.root != RootInode { // the usage of other directories is hidden from a subdir mount
+			space, inodes := m.subtreeUsage(ctx)
+			*totalspace = uint64(space) + *availspace
+			*iused = uint64(inodes)
+		}
 		return 0
 	}
 	*totalspace = uint64(usage.UsedSpace) + *availspace
@@ -996,18 +1570,49 @@ func (m *baseMeta) StatFS(ctx Context, ino Ino, totalspace, availspace, iused, i
 	return 0
 }
 
+type subtreeUsage struct {
+	sync.Mutex
+	root          Ino
+	space, inodes int64
+	expire        time.Time
+}
+
+// subtreeUsage returns the usage of the mounted subdir (like the usage of a directory quota), which is
+// summed up from the dir stats and cached for a second. It's 0 if dir stats are disabled, since it's
+// too expensive to count all the entries for statfs.
+func (m *baseMeta) subtreeUsage(ctx Context) (space, inodes int64) {
+	u := &m.rootUsage
+	u.Lock()
+	defer u.Unlock()
+	now := time.Now()
+	if u.root == m.root && now.Before(u.expire) {
+		return u.space, u.inodes
+	}
+	u.root, u.space, u.inodes, u.expire = m.root, 0, 0, now.Add(time.Second)
+	if !m.GetFormat().DirStats {
+		return 0, 0
+	}
+	var sum Summary
+	if st := m.getDirSummary(ctx, m.root, &sum, true, false, make(chan struct{}, 50), nil); st != 0 {
+		logger.Warnf("Get usage of subdir %d: %s", m.root, st)
+		return 0, 0
+	}
+	u.space, u.inodes = int64(sum.Size), int64(sum.Dirs+sum.Files)
+	return u.space, u.inodes
+}
+
 func (m *baseMeta) statRootFs(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
 	var used, inodes int64
 	var err error
 	err = utils.WithTimeout(func() error {
-		used, err = m.en.getCounter(usedSpace)
+		used, err = m.volumeUsage(usedSpace, snapshotSpace)
 		return err
 	}, time.Millisecond*150)
 	if err != nil {
 		used = atomic.LoadInt64(&m.usedSpace)
 	}
 	err = utils.WithTimeout(func() error {
-		inodes, err = m.en.getCounter(totalInodes)
+		inodes, err = m.volumeUsage(totalInodes, snapshotInodes)
 		return err
 	}, time.Millisecond*150)
 	if err != nil {
@@ -1049,7 +1654,21 @@ func (m *baseMeta) statRootFs(ctx Context, totalspace, availspace, iused, iavail
 	return 0
 }
 
+// foldName returns the normalized name to look up an entry case-insensitively.
+func foldName(name string) string {
+	return strings.ToLower(name)
+}
+
+// caseFolded tells whether the entries in the directory are indexed by the folded names,
+// which is true for case-insensitive volume (except the trash).
+func (m *baseMeta) caseFolded(parent Ino) bool {
+	return m.fmt != nil && m.fmt.CaseInsensitive && !isTrash(parent)
+}
+
 func (m *baseMeta) resolveCase(ctx Context, parent Ino, name string) *Entry {
+	if m.caseFolded(parent) {
+		return m.en.doLookupFolded(ctx, parent, name)
+	}
 	var entries []*Entry
 	_ = m.en.doReaddir(ctx, parent, 0, &entries, -1)
 	for _, e := range entries {
@@ -1061,6 +1680,11 @@ func (m *baseMeta) resolveCase(ctx Context, parent Ino, name string) *Entry {
 	return nil
 }
 
+func (m *baseMeta) ResolveCase(ctx Context, parent Ino, name string) *Entry {
+	defer m.timeit("ResolveCase", time.Now())
+	return m.resolveCase(ctx, m.checkRoot(parent), name)
+}
+
 func (m *baseMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr, checkPerm bool) syscall.Errno {
 	if inode == nil || attr == nil {
 		return syscall.EINVAL // bad request
@@ -1142,12 +1766,20 @@ func (m *baseMeta) parseAttr(buf []byte, attr *Attr) {
 	if rb.Left() >= 8 {
 		attr.Parent = Ino(rb.Get64())
 	}
+	if rb.Left() >= 8 {
+		attr.AccessACL = rb.Get32()
+		attr.DefaultACL = rb.Get32()
+	}
+	if rb.Left() >= 12 {
+		attr.Btime = int64(rb.Get64())
+		attr.Btimensec = rb.Get32()
+	}
 	attr.Full = true
 	logger.Tracef("attr: %+v -> %+v", buf, attr)
 }
 
 func (m *baseMeta) marshal(attr *Attr) []byte {
-	w := utils.NewBuffer(36 + 24 + 4 + 8)
+	w := utils.NewBuffer(36 + 24 + 4 + 8 + 8 + 12)
 	w.Put8(attr.Flags)
 	w.Put16((uint16(attr.Typ) << 12) | (attr.Mode & 0xfff))
 	w.Put32(attr.Uid)
@@ -1162,6 +1794,10 @@ func (m *baseMeta) marshal(attr *Attr) []byte {
 	w.Put64(attr.Length)
 	w.Put32(attr.Rdev)
 	w.Put64(uint64(attr.Parent))
+	w.Put32(attr.AccessACL)
+	w.Put32(attr.DefaultACL)
+	w.Put64(uint64(attr.Btime))
+	w.Put32(attr.Btimensec)
 	logger.Tracef("attr: %+v -> %+v", attr, w.Bytes())
 	return w.Bytes()
 }
@@ -1226,6 +1862,17 @@ func (m *baseMeta) Access(ctx Context, inode Ino, mmask uint8, attr *Attr) sysca
 			return err
 		}
 	}
+	if attr.AccessACL != aclNone {
+		rule, err := m.getACL(attr.AccessACL)
+		if err != nil {
+			return errno(err)
+		}
+		if !rule.CanAccess(ctx.Uid(), ctx.Gids(), attr.Uid, attr.Gid, uint16(mmask)) {
+			logger.Debugf("Access inode %d by ACL %d, request mode %o", inode, attr.AccessACL, mmask)
+			return syscall.EACCES
+		}
+		return 0
+	}
 	mode := accessMode(attr, ctx.Uid(), ctx.Gids())
 	if mode&mmask != mmask {
 		logger.Debugf("Access inode %d %o, mode %o, request mode %o", inode, attr.Mode, mode, mmask)
@@ -1284,7 +1931,7 @@ func (m *baseMeta) nextInode() (Ino, error) {
 		n = m.freeInodes.next
 		m.freeInodes.next++
 	}
-	return Ino(n), nil
+	return m.inodeBase + Ino(n), nil
 }
 
 func (m *baseMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
@@ -1303,8 +1950,19 @@ func (m *baseMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode
 
 	defer m.timeit("Mknod", time.Now())
 	parent = m.checkRoot(parent)
+	if st := m.beginChange(ctx, parent); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	var space, inodes int64 = align4K(0), 1
-	if err := m.checkQuota(ctx, space, inodes, parent); err != 0 {
+	gid := ctx.Gid()
+	if m.hasOwnerQuota() {
+		var pattr Attr
+		if st := m.GetAttr(ctx, parent, &pattr); st == 0 && inheritGid(ctx, &pattr) {
+			gid = pattr.Gid
+		}
+	}
+	if err := m.checkQuota(ctx, space, inodes, ctx.Uid(), gid, parent); err != 0 {
 		return err
 	}
 	err := m.en.doMknod(ctx, parent, name, _type, mode, cumask, rdev, path, inode, attr)
@@ -1312,6 +1970,11 @@ func (m *baseMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode
 		m.en.updateStats(space, inodes)
 		m.updateDirStat(ctx, parent, 0, space, inodes)
 		m.updateDirQuota(ctx, parent, space, inodes)
+		if !isSnapshotCtx(ctx) {
+			m.updateOwnerQuota(attr.Uid, attr.Gid, space, inodes)
+		}
+		m.logChange(parent, *inode)
+		m.notify(EventCreate, *inode, parent, name, 0, "")
 	}
 	return err
 }
@@ -1330,6 +1993,32 @@ func (m *baseMeta) Create(ctx Context, parent Ino, name string, mode uint16, cum
 	return eno
 }
 
+func (m *baseMeta) TmpFile(ctx Context, parent Ino, mode uint16, cumask uint16, inode *Ino, attr *Attr) syscall.Errno {
+	if attr == nil {
+		attr = &Attr{}
+	}
+	// create it with a hidden name and unlink it at once, then it's kept as a sustained inode until closed
+	var name string
+	var eno syscall.Errno
+	for i := 0; i < 10; i++ {
+		name = fmt.Sprintf(".tmpfile.%d.%d", m.sid, time.Now().UnixNano())
+		if eno = m.Mknod(ctx, parent, name, TypeFile, mode, cumask, 0, "", inode, attr); eno != syscall.EEXIST {
+			break
+		}
+	}
+	if eno != 0 {
+		return eno
+	}
+	m.of.Open(*inode, attr)
+	if eno = m.Unlink(ctx, parent, name, true); eno != 0 {
+		logger.Warnf("Unlink tmpfile %s in %d: %s", name, parent, eno)
+		_ = m.Close(ctx, *inode)
+		return eno
+	}
+	attr.Nlink = 0
+	return 0
+}
+
 func (m *baseMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16, copysgid uint8, inode *Ino, attr *Attr) syscall.Errno {
 	st := m.Mknod(ctx, parent, name, TypeDirectory, mode, cumask, 0, "", inode, attr)
 	if st == 0 {
@@ -1364,6 +2053,10 @@ func (m *baseMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr)
 		attr = &Attr{}
 	}
 	parent = m.checkRoot(parent)
+	if st := m.beginChange(ctx, parent); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	if st := m.GetAttr(ctx, inode, attr); st != 0 {
 		return st
 	}
@@ -1374,8 +2067,15 @@ func (m *baseMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr)
 	defer func() { m.of.InvalidateChunk(inode, invalidateAttrOnly) }()
 	err := m.en.doLink(ctx, inode, parent, name, attr)
 	if err == 0 {
+		if attr.Nlink == 1 { // an anonymous file (O_TMPFILE) is linked
+			m.Lock()
+			delete(m.removedFiles, inode)
+			m.Unlock()
+		}
 		m.updateDirStat(ctx, parent, int64(attr.Length), align4K(attr.Length), 1)
 		m.updateDirQuota(ctx, parent, align4K(attr.Length), 1)
+		m.logChange(parent, inode)
+		m.notify(EventCreate, inode, parent, name, 0, "")
 	}
 	return err
 }
@@ -1426,15 +2126,29 @@ func (m *baseMeta) Unlink(ctx Context, parent Ino, name string, skipCheckTrash .
 
 	defer m.timeit("Unlink", time.Now())
 	parent = m.checkRoot(parent)
+	if st := m.beginChange(ctx, parent); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
+	var inode Ino
+	if m.loggingChanges() || m.hasWatchers() {
+		_ = m.en.doLookup(ctx, parent, name, &inode, nil)
+	}
 	var attr Attr
 	err := m.en.doUnlink(ctx, parent, name, &attr, skipCheckTrash...)
 	if err == 0 {
+		m.logChange(parent, inode)
+		m.logTrash(parent)
+		m.notify(EventDelete, inode, parent, name, 0, "")
 		var diffLength uint64
 		if attr.Typ == TypeFile {
 			diffLength = attr.Length
 		}
 		m.updateDirStat(ctx, parent, -int64(diffLength), -align4K(diffLength), -1)
 		m.updateDirQuota(ctx, parent, -align4K(diffLength), -1)
+		if attr.Nlink == 0 && !isSnapshotCtx(ctx) {
+			m.updateOwnerQuota(attr.Uid, attr.Gid, -align4K(diffLength), -1)
+		}
 	}
 	return err
 }
@@ -1455,9 +2169,24 @@ func (m *baseMeta) Rmdir(ctx Context, parent Ino, name string, skipCheckTrash ..
 
 	defer m.timeit("Rmdir", time.Now())
 	parent = m.checkRoot(parent)
+	if st := m.beginChange(ctx, parent); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
+	var owner *Attr
+	if m.hasOwnerQuota() && !isSnapshotCtx(ctx) {
+		var ino Ino
+		owner = new(Attr)
+		if st := m.en.doLookup(ctx, parent, name, &ino, owner); st != 0 {
+			owner = nil
+		}
+	}
 	var inode Ino
 	st := m.en.doRmdir(ctx, parent, name, &inode, skipCheckTrash...)
 	if st == 0 {
+		m.logChange(parent, inode)
+		m.logTrash(parent)
+		m.notify(EventDelete, inode, parent, name, 0, "")
 		if !isTrash(parent) {
 			m.parentMu.Lock()
 			delete(m.dirParents, inode)
@@ -1465,6 +2194,10 @@ func (m *baseMeta) Rmdir(ctx Context, parent Ino, name string, skipCheckTrash ..
 		}
 		m.updateDirStat(ctx, parent, 0, -align4K(0), -1)
 		m.updateDirQuota(ctx, parent, -align4K(0), -1)
+		// the directory is moved into trash if it's enabled
+		if owner != nil && (!m.toTrash(parent) || len(skipCheckTrash) > 0 && skipCheckTrash[0]) {
+			m.updateOwnerQuota(owner.Uid, owner.Gid, -align4K(0), -1)
+		}
 	}
 	return st
 }
@@ -1485,7 +2218,12 @@ func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 	switch flags {
 	case 0, RenameNoReplace, RenameExchange:
 	case RenameWhiteout, RenameNoReplace | RenameWhiteout:
-		return syscall.ENOTSUP
+		if ctx.Uid() != 0 { // CAP_MKNOD is required to create a whiteout
+			return syscall.EPERM
+		}
+		if st := m.checkQuota(ctx, align4K(0), 1, ctx.Uid(), ctx.Gid(), m.checkRoot(parentSrc)); st != 0 {
+			return st
+		}
 	default:
 		return syscall.EINVAL
 	}
@@ -1499,6 +2237,10 @@ func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 	}
 	parentSrc = m.checkRoot(parentSrc)
 	parentDst = m.checkRoot(parentDst)
+	if st := m.beginChange(ctx, parentSrc, parentDst); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	var quotaSrc bool = !isTrash(parentSrc) && m.hasDirQuota(ctx, parentSrc)
 	var quotaDst bool
 	if parentSrc == parentDst {
@@ -1538,6 +2280,15 @@ func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 	tattr := new(Attr)
 	st := m.en.doRename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, tinode, attr, tattr)
 	if st == 0 {
+		m.logChange(parentSrc, parentDst, *inode, *tinode)
+		m.logTrash(parentDst)
+		if flags&RenameExchange == 0 && *tinode > 0 {
+			m.notify(EventDelete, *tinode, parentDst, nameDst, 0, "")
+		}
+		m.notify(EventRename, *inode, parentSrc, nameSrc, parentDst, nameDst)
+		if flags&RenameExchange != 0 {
+			m.notify(EventRename, *tinode, parentDst, nameDst, parentSrc, nameSrc)
+		}
 		var diffLength uint64
 		if attr.Typ == TypeDirectory {
 			m.parentMu.Lock()
@@ -1556,6 +2307,21 @@ func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 				m.updateDirQuota(ctx, parentDst, space, inodes)
 			}
 		}
+		if flags&RenameWhiteout != 0 {
+			m.en.updateStats(align4K(0), 1)
+			m.updateDirStat(ctx, parentSrc, 0, align4K(0), 1)
+			if quotaSrc {
+				m.updateDirQuota(ctx, parentSrc, align4K(0), 1)
+			}
+			m.updateOwnerQuota(ctx.Uid(), ctx.Gid(), align4K(0), 1)
+			if m.loggingChanges() || m.hasWatchers() {
+				var wino Ino
+				if m.en.doLookup(ctx, parentSrc, nameSrc, &wino, new(Attr)) == 0 {
+					m.logChange(wino)
+					m.notify(EventCreate, wino, parentSrc, nameSrc, 0, "")
+				}
+			}
+		}
 		if *tinode > 0 && flags != RenameExchange {
 			diffLength = 0
 			if tattr.Typ == TypeDirectory {
@@ -1569,11 +2335,35 @@ func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			if quotaDst {
 				m.updateDirQuota(ctx, parentDst, -align4K(diffLength), -1)
 			}
+			if tattr.Nlink == 0 {
+				m.updateOwnerQuota(tattr.Uid, tattr.Gid, -align4K(diffLength), -1)
+			}
 		}
 	}
 	return st
 }
 
+// whiteoutAttr returns the attributes of a whiteout (a character device with 0/0 device number),
+// which is left in place of the source entry by RENAME_WHITEOUT.
+func whiteoutAttr(ctx Context, parent Ino, now time.Time) *Attr {
+	return &Attr{
+		Typ:       TypeCharDev,
+		Uid:       ctx.Uid(),
+		Gid:       ctx.Gid(),
+		Atime:     now.Unix(),
+		Mtime:     now.Unix(),
+		Ctime:     now.Unix(),
+		Btime:     now.Unix(),
+		Atimensec: uint32(now.Nanosecond()),
+		Mtimensec: uint32(now.Nanosecond()),
+		Ctimensec: uint32(now.Nanosecond()),
+		Btimensec: uint32(now.Nanosecond()),
+		Nlink:     1,
+		Parent:    parent,
+		Full:      true,
+	}
+}
+
 // caller makes sure inode is not special inode.
 func (m *baseMeta) touchAtime(ctx Context, inode Ino, attr *Attr) {
 	if m.conf.AtimeMode == NoAtime || m.conf.ReadOnly {
@@ -1652,6 +2442,9 @@ func (m *baseMeta) InvalidateChunkCache(ctx Context, inode Ino, indx uint32) sys
 }
 
 func (m *baseMeta) NewSlice(ctx Context, id *uint64) syscall.Errno {
+	if m.sliceSource != nil {
+		return m.sliceSource.NewSlice(ctx, id)
+	}
 	m.freeMu.Lock()
 	defer m.freeMu.Unlock()
 	if m.freeSlices.next >= m.freeSlices.maxid {
@@ -1682,7 +2475,11 @@ func (m *baseMeta) Close(ctx Context, inode Ino) syscall.Errno {
 	return 0
 }
 
-func (m *baseMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) (rerr syscall.Errno) {
+func (m *baseMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
+	return m.ReaddirPage(ctx, inode, plus, nil, 0, entries)
+}
+
+func (m *baseMeta) ReaddirPage(ctx Context, inode Ino, plus uint8, after []byte, limit int, entries *[]*Entry) (rerr syscall.Errno) {
 	var attr Attr
 	defer func() {
 		if rerr == 0 {
@@ -1704,6 +2501,9 @@ func (m *baseMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 	if inode == m.root {
 		attr.Parent = m.root
 	}
+	if after != nil {
+		return m.en.doReaddirPage(ctx, inode, plus, after, limit, entries)
+	}
 	*entries = []*Entry{
 		{
 			Inode: inode,
@@ -1716,9 +2516,37 @@ func (m *baseMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 		Name:  []byte(".."),
 		Attr:  &Attr{Typ: TypeDirectory},
 	})
+	if limit > 0 {
+		return m.en.doReaddirPage(ctx, inode, plus, nil, limit, entries)
+	}
 	return m.en.doReaddir(ctx, inode, plus, entries, -1)
 }
 
+// readdirByPage lists a directory with pages of bounded size, so a big directory is not scanned
+// in a single long transaction.
+func (m *baseMeta) readdirByPage(ctx Context, inode Ino, plus uint8, entries *[]*Entry, limit int) syscall.Errno {
+	var after []byte
+	for limit != 0 {
+		size := readdirPageSize
+		if limit > 0 && limit < size {
+			size = limit
+		}
+		n := len(*entries)
+		if st := m.en.doReaddirPage(ctx, inode, plus, after, size, entries); st != 0 {
+			return st
+		}
+		got := len(*entries) - n
+		if got < size {
+			break
+		}
+		if limit > 0 {
+			limit -= got
+		}
+		after = (*entries)[len(*entries)-1].Name
+	}
+	return 0
+}
+
 func (m *baseMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
 	if m.conf.ReadOnly {
 		return syscall.EROFS
@@ -1728,7 +2556,17 @@ func (m *baseMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, f
 	}
 
 	defer m.timeit("SetXattr", time.Now())
-	return m.en.doSetXattr(ctx, m.checkRoot(inode), name, value, flags)
+	inode = m.checkRoot(inode)
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
+	st := m.en.doSetXattr(ctx, inode, name, value, flags)
+	if st == 0 {
+		m.logChange(inode)
+		m.notifyAttr(ctx, inode, nil)
+	}
+	return st
 }
 
 func (m *baseMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
@@ -1740,7 +2578,165 @@ func (m *baseMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errn
 	}
 
 	defer m.timeit("RemoveXattr", time.Now())
-	return m.en.doRemoveXattr(ctx, m.checkRoot(inode), name)
+	inode = m.checkRoot(inode)
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
+	st := m.en.doRemoveXattr(ctx, inode, name)
+	if st == 0 {
+		m.logChange(inode)
+		m.notifyAttr(ctx, inode, nil)
+	}
+	return st
+}
+
+func (m *baseMeta) aclEnabled() bool {
+	return m.fmt != nil && m.fmt.EnableACL
+}
+
+func (m *baseMeta) getACL(id uint32) (*ACLRule, error) {
+	if rule := m.acls.get(id); rule != nil {
+		return rule, nil
+	}
+	rule, err := m.en.doGetACL(id)
+	if err != nil {
+		return nil, err
+	}
+	m.acls.put(id, rule)
+	return rule, nil
+}
+
+// insertACL returns the id of the rule, which is stored if it's not seen before.
+func (m *baseMeta) insertACL(rule *ACLRule) (uint32, error) {
+	if id := m.acls.getId(rule); id != aclNone {
+		return id, nil
+	}
+	id, err := m.en.incrCounter("nextACL", 1)
+	if err != nil {
+		return aclNone, err
+	}
+	if err = m.en.doInsertACL(uint32(id), rule); err != nil {
+		return aclNone, err
+	}
+	m.acls.put(uint32(id), rule.Dup())
+	return uint32(id), nil
+}
+
+// inheritACL sets the mode and ACLs of a new node, the default ACL of parent is used instead of umask if it's set.
+func (m *baseMeta) inheritACL(attr, pattr *Attr, mode, cumask uint16) syscall.Errno {
+	attr.Mode = mode & ^cumask
+	attr.AccessACL, attr.DefaultACL = aclNone, aclNone
+	if pattr.DefaultACL == aclNone || attr.Typ == TypeSymlink {
+		return 0
+	}
+	def, err := m.getACL(pattr.DefaultACL)
+	if err != nil {
+		return errno(err)
+	}
+	if attr.Typ == TypeDirectory {
+		attr.DefaultACL = pattr.DefaultACL
+	}
+	rule := def.ChildAccessACL(mode)
+	attr.Mode = (mode & 07000) | rule.GetMode()
+	if !rule.IsMinimal() {
+		if attr.AccessACL, err = m.insertACL(rule); err != nil {
+			return errno(err)
+		}
+	}
+	return 0
+}
+
+// applyFacl updates the attributes with the rule, returns whether they are changed.
+func (m *baseMeta) applyFacl(ctx Context, attr *Attr, aclType uint8, rule *ACLRule) (bool, syscall.Errno) {
+	if ctx.Uid() != 0 && ctx.Uid() != attr.Uid {
+		return false, syscall.EPERM
+	}
+	if attr.Flags&FlagImmutable != 0 {
+		return false, syscall.EPERM
+	}
+	var id uint32
+	var err error
+	if aclType == ACLTypeDefault {
+		if attr.Typ != TypeDirectory {
+			if rule == nil {
+				return false, 0
+			}
+			return false, syscall.EACCES
+		}
+		if rule != nil {
+			if id, err = m.insertACL(rule); err != nil {
+				return false, errno(err)
+			}
+		}
+		changed := id != attr.DefaultACL
+		attr.DefaultACL = id
+		return changed, 0
+	}
+	mode := attr.Mode
+	if rule != nil {
+		mode = (attr.Mode & 07000) | rule.GetMode()
+		if !rule.IsMinimal() {
+			if id, err = m.insertACL(rule); err != nil {
+				return false, errno(err)
+			}
+		}
+	}
+	changed := id != attr.AccessACL || mode != attr.Mode
+	attr.AccessACL, attr.Mode = id, mode
+	return changed, 0
+}
+
+func (m *baseMeta) GetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno {
+	if !m.aclEnabled() {
+		return syscall.ENOTSUP
+	}
+	if aclType != ACLTypeAccess && aclType != ACLTypeDefault {
+		return syscall.EINVAL
+	}
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	id := attr.AccessACL
+	if aclType == ACLTypeDefault {
+		id = attr.DefaultACL
+	}
+	if id == aclNone {
+		return ENOATTR
+	}
+	r, err := m.getACL(id)
+	if err != nil {
+		return errno(err)
+	}
+	*rule = *r.Dup()
+	return 0
+}
+
+func (m *baseMeta) SetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno {
+	if !m.aclEnabled() {
+		return syscall.ENOTSUP
+	}
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if aclType != ACLTypeAccess && aclType != ACLTypeDefault {
+		return syscall.EINVAL
+	}
+
+	defer m.timeit("SetFacl", time.Now())
+	inode = m.checkRoot(inode)
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
+	st := m.en.doSetFacl(ctx, inode, aclType, rule)
+	if st == 0 {
+		m.of.InvalidateChunk(inode, invalidateAttrOnly)
+		m.logChange(inode)
+		m.notifyAttr(ctx, inode, nil)
+	}
+	return st
 }
 
 func (m *baseMeta) GetParents(ctx Context, inode Ino) map[Ino]int {
@@ -1759,6 +2755,31 @@ func (m *baseMeta) GetParents(ctx Context, inode Ino) map[Ino]int {
 	}
 }
 
+func (m *baseMeta) InRoot(ctx Context, inode Ino) bool {
+	if m.root == RootInode {
+		return true
+	}
+	if inode = m.checkRoot(inode); inode == m.root {
+		return true
+	}
+	if inode == RootInode || isTrash(inode) {
+		return false
+	}
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return false
+	}
+	dirs := make(map[Ino]bool)
+	if attr.Typ == TypeDirectory {
+		m.ancestors(dirs, inode)
+	} else {
+		for parent := range m.GetParents(ctx, inode) {
+			m.ancestors(dirs, parent)
+		}
+	}
+	return dirs[m.root]
+}
+
 func (m *baseMeta) GetPaths(ctx Context, inode Ino) []string {
 	if inode == RootInode {
 		return []string{"/"}
@@ -1982,6 +3003,7 @@ func (m *baseMeta) Check(ctx Context, fpath string, repair bool, recursive bool,
 						}
 						if st1 := m.en.doRepair(ctx, inode, attr); st1 == 0 || st1 == syscall.ENOENT {
 							logger.Debugf("Path %s (inode %d) is successfully repaired", path, inode)
+							m.logChange(inode)
 						} else {
 							hasError = true
 							logger.Errorf("Repair path %s inode %d: %s", path, inode, st1)
@@ -2104,6 +3126,22 @@ func (m *baseMeta) GetFormat() Format {
 	return *m.fmt
 }
 
+// compactHoles compacts the chunks covered by a punched or zeroed range in background,
+// so the slices hidden by the holes can be released.
+func (m *baseMeta) compactHoles(inode Ino, off, size, length uint64) {
+	if off >= length {
+		return
+	}
+	if off+size > length {
+		size = length - off
+	}
+	go func() {
+		for indx := off / ChunkSize; indx <= (off+size-1)/ChunkSize; indx++ {
+			m.en.compactChunk(inode, uint32(indx), false)
+		}
+	}()
+}
+
 func (m *baseMeta) CompactAll(ctx Context, threads int, bar *utils.Bar) syscall.Errno {
 	var wg sync.WaitGroup
 	ch := make(chan cchunk, 1000000)
@@ -2177,7 +3215,32 @@ func (m *baseMeta) deleteSlice(id uint64, size uint32) {
 }
 
 func (m *baseMeta) toTrash(parent Ino) bool {
-	return m.fmt.TrashDays > 0 && !isTrash(parent)
+	if parent == 0 { // not for an entry, e.g. the delayed slices of compaction
+		return m.fmt.TrashDays > 0
+	}
+	return !isTrash(parent) && m.trashDays(Background, parent) > 0
+}
+
+// trashDays returns the days to keep the files removed from a directory in trash, which is decided by
+// the trash policy of the nearest ancestor, or TrashDays of the volume if there is none.
+func (m *baseMeta) trashDays(ctx Context, parent Ino) int {
+	format := m.GetFormat()
+	if len(format.TrashPolicies) == 0 {
+		return format.TrashDays
+	}
+	var st syscall.Errno
+	for inode := parent; ; {
+		if days, ok := format.TrashPolicies[inode]; ok {
+			return days
+		}
+		if inode <= RootInode {
+			break
+		}
+		if inode, st = m.getDirParent(ctx, inode); st != 0 {
+			break
+		}
+	}
+	return format.TrashDays
 }
 
 func (m *baseMeta) checkTrash(parent Ino, trash *Ino) syscall.Errno {
@@ -2207,6 +3270,7 @@ func (m *baseMeta) checkTrash(parent Ino, trash *Ino) syscall.Errno {
 	} else {
 		m.subTrash.inode = *trash
 		m.subTrash.name = name
+		m.logChange(TrashInode, *trash)
 		st = 0
 	}
 	return st
@@ -2252,8 +3316,15 @@ func (m *baseMeta) CleanupDetachedNodesBefore(ctx Context, edge time.Time, incre
 }
 
 func (m *baseMeta) CleanupTrashBefore(ctx Context, edge time.Time, increProgress func(int)) {
+	m.cleanupTrashBefore(ctx, edge, true, increProgress)
+}
+
+// cleanupTrashBefore deletes the files in trash before edge, the ones removed from the directories with
+// trash policies are kept until they are expired if withPolicies is true.
+func (m *baseMeta) cleanupTrashBefore(ctx Context, edge time.Time, withPolicies bool, increProgress func(int)) {
 	logger.Debugf("cleanup trash: started")
 	now := time.Now()
+	withPolicies = withPolicies && len(m.GetFormat().TrashPolicies) > 0
 	var st syscall.Errno
 	var entries []*Entry
 	if st = m.en.doReaddir(ctx, TrashInode, 0, &entries, -1); st != 0 {
@@ -2289,7 +3360,13 @@ func (m *baseMeta) CleanupTrashBefore(ctx Context, edge time.Time, increProgress
 			if rmdir {
 				entries = entries[1:]
 			}
+			var kept int
 			for _, se := range subEntries {
+				if withPolicies && !m.trashExpired(ctx, string(se.Name), ts, now) {
+					kept++
+					rmdir = false
+					continue
+				}
 				var c uint64
 				st = m.Remove(ctx, e.Inode, string(se.Name), &c)
 				if st == 0 {
@@ -2310,6 +3387,8 @@ func (m *baseMeta) CleanupTrashBefore(ctx Context, edge time.Time, increProgress
 				if st = m.en.doRmdir(ctx, TrashInode, string(e.Name), nil); st != 0 {
 					logger.Warnf("rmdir subTrash %s: %s", e.Name, st)
 				}
+			} else if kept > 0 && len(subEntries) >= batch {
+				entries = entries[1:] // the kept entries will be checked next time
 			}
 		} else {
 			break
@@ -2353,12 +3432,31 @@ func (m *baseMeta) scanTrashFiles(ctx Context, scan trashFileScan) error {
 	return nil
 }
 
+// trashExpired checks whether an entry in trash should be deleted according to the trash days of the
+// directory it was removed from, whose inode is the prefix of the name.
+func (m *baseMeta) trashExpired(ctx Context, name string, ts, now time.Time) bool {
+	ps := strings.SplitN(name, "-", 2)
+	parent, err := strconv.ParseUint(ps[0], 10, 64)
+	if err != nil || len(ps) < 2 {
+		return true
+	}
+	days := m.trashDays(ctx, Ino(parent))
+	return ts.Before(now.Add(-time.Duration(24*days+1) * time.Hour))
+}
+
 func (m *baseMeta) doCleanupTrash(force bool) {
-	edge := time.Now().Add(-time.Duration(24*m.fmt.TrashDays+1) * time.Hour)
+	format := m.GetFormat()
+	days := format.TrashDays
+	for _, d := range format.TrashPolicies {
+		if d > 0 && (days == 0 || d < days) {
+			days = d // the shortest one
+		}
+	}
+	edge := time.Now().Add(-time.Duration(24*days+1) * time.Hour)
 	if force {
 		edge = time.Now()
 	}
-	m.CleanupTrashBefore(Background, edge, nil)
+	m.cleanupTrashBefore(Background, edge, !force, nil)
 }
 
 func (m *baseMeta) cleanupDelayedSlices() {
@@ -2413,6 +3511,10 @@ func (m *baseMeta) Clone(ctx Context, srcIno, parent Ino, name string, cmode uin
 
 	defer m.timeit("Clone", time.Now())
 	parent = m.checkRoot(parent)
+	if st := m.beginChange(ctx, parent); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 
 	var attr Attr
 	var eno syscall.Errno
@@ -2437,13 +3539,32 @@ func (m *baseMeta) Clone(ctx Context, srcIno, parent Ino, name string, cmode uin
 	if eno != 0 {
 		return eno
 	}
-	if err := m.checkQuota(ctx, int64(sum.Size), int64(sum.Dirs)+int64(sum.Files), parent); err != 0 {
-		return err
+	space, inodes := int64(sum.Size), int64(sum.Dirs)+int64(sum.Files)
+	if eno = m.checkCapacity(space, inodes); eno != 0 {
+		return eno
+	}
+	if cmode&CLONE_MODE_PRESERVE_ATTR == 0 {
+		if m.checkOwnerQuota(ctx.Uid(), ctx.Gid(), space, inodes) {
+			return syscall.EDQUOT
+		}
+	} else if m.hasOwnerQuota() {
+		// the owners are preserved, so check the quota of each of them
+		owned := &cloneUsage{owners: make(map[[2]uint32]*[2]int64)}
+		if eno = m.cloneUsageOf(ctx, srcIno, &attr, owned); eno != 0 {
+			return eno
+		}
+		if eno = owned.checkOwners(m); eno != 0 {
+			return eno
+		}
+	}
+	if eno = m.checkDirQuotas(ctx, space, inodes, []Ino{parent}); eno != 0 {
+		return eno
 	}
 	*total = sum.Dirs + sum.Files
 	concurrent := make(chan struct{}, 4)
+	usage := &cloneUsage{owners: make(map[[2]uint32]*[2]int64)}
 	if attr.Typ == TypeDirectory {
-		eno = m.cloneEntry(ctx, srcIno, parent, name, &dstIno, cmode, cumask, count, true, concurrent)
+		eno = m.cloneEntry(ctx, srcIno, parent, name, &dstIno, cmode, cumask, count, usage, true, concurrent)
 		if eno == 0 {
 			eno = m.en.doAttachDirNode(ctx, parent, dstIno, name)
 		}
@@ -2453,16 +3574,92 @@ func (m *baseMeta) Clone(ctx Context, srcIno, parent Ino, name string, cmode uin
 			}
 		}
 	} else {
-		eno = m.cloneEntry(ctx, srcIno, parent, name, nil, cmode, cumask, count, true, concurrent)
+		eno = m.cloneEntry(ctx, srcIno, parent, name, nil, cmode, cumask, count, usage, true, concurrent)
 	}
 	if eno == 0 {
+		m.logChange(parent)
 		m.updateDirStat(ctx, parent, int64(attr.Length), align4K(attr.Length), 1)
-		m.updateDirQuota(ctx, parent, int64(sum.Size), int64(sum.Dirs)+int64(sum.Files))
+		// the tree may be changed during cloning, so use the usage of the cloned entries rather than the summary
+		m.updateDirQuota(ctx, parent, usage.space, usage.inodes)
+		for o, u := range usage.owners {
+			m.updateOwnerQuota(o[0], o[1], u[0], u[1])
+		}
 	}
 	return eno
 }
 
-func (m *baseMeta) cloneEntry(ctx Context, srcIno Ino, parent Ino, name string, dstIno *Ino, cmode uint8, cumask uint16, count *uint64, top bool, concurrent chan struct{}) syscall.Errno {
+// cloneUsage accumulates the usage of cloned entries, grouped by the owners.
+type cloneUsage struct {
+	sync.Mutex
+	space, inodes int64
+	owners        map[[2]uint32]*[2]int64 // uid, gid -> space, inodes
+}
+
+func (u *cloneUsage) add(attr *Attr) {
+	space, inodes := ownerUsage(attr)
+	u.Lock()
+	defer u.Unlock()
+	u.space += space
+	u.inodes += inodes
+	o := [2]uint32{attr.Uid, attr.Gid}
+	if u.owners[o] == nil {
+		u.owners[o] = new([2]int64)
+	}
+	u.owners[o][0] += space
+	u.owners[o][1] += inodes
+}
+
+// checkOwners returns EDQUOT if the usage will exceed the quota of any user or group.
+func (u *cloneUsage) checkOwners(m *baseMeta) syscall.Errno {
+	users := make(map[uint32]*[2]int64)
+	groups := make(map[uint32]*[2]int64)
+	for o, usage := range u.owners {
+		for i, sum := range []map[uint32]*[2]int64{users, groups} {
+			if sum[o[i]] == nil {
+				sum[o[i]] = new([2]int64)
+			}
+			sum[o[i]][0] += usage[0]
+			sum[o[i]][1] += usage[1]
+		}
+	}
+	m = m.ownerQuotaMeta()
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	for uid, usage := range users {
+		if q := m.ownerQuotas[userQuotaIno(uid)]; q != nil && q.check(usage[0], usage[1]) {
+			return syscall.EDQUOT
+		}
+	}
+	for gid, usage := range groups {
+		if q := m.ownerQuotas[groupQuotaIno(gid)]; q != nil && q.check(usage[0], usage[1]) {
+			return syscall.EDQUOT
+		}
+	}
+	return 0
+}
+
+// cloneUsageOf walks a tree to collect the usage of its owners.
+func (m *baseMeta) cloneUsageOf(ctx Context, inode Ino, attr *Attr, u *cloneUsage) syscall.Errno {
+	u.add(attr)
+	if attr.Typ != TypeDirectory {
+		return 0
+	}
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, inode, 1, &entries, -1); st != 0 && st != syscall.ENOENT {
+		return st
+	}
+	for _, e := range entries {
+		if st := m.cloneUsageOf(ctx, e.Inode, e.Attr, u); st != 0 {
+			return st
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return 0
+}
+
+func (m *baseMeta) cloneEntry(ctx Context, srcIno Ino, parent Ino, name string, dstIno *Ino, cmode uint8, cumask uint16, count *uint64, usage *cloneUsage, top bool, concurrent chan struct{}) syscall.Errno {
 	ino, err := m.nextInode()
 	if err != nil {
 		return errno(err)
@@ -2476,7 +3673,9 @@ func (m *baseMeta) cloneEntry(ctx Context, srcIno Ino, parent Ino, name string,
 		return eno
 	}
 	m.en.updateStats(align4K(attr.Length), 1)
+	m.logChange(ino)
 	atomic.AddUint64(count, 1)
+	usage.add(&attr)
 	if attr.Typ != TypeDirectory {
 		return 0
 	}
@@ -2504,7 +3703,7 @@ func (m *baseMeta) cloneEntry(ctx Context, srcIno Ino, parent Ino, name string,
 	var skipped uint32
 	var errCh = make(chan syscall.Errno, cap(concurrent))
 	cloneChild := func(e *Entry) syscall.Errno {
-		eno := m.cloneEntry(ctx, e.Inode, ino, string(e.Name), nil, cmode, cumask, count, false, concurrent)
+		eno := m.cloneEntry(ctx, e.Inode, ino, string(e.Name), nil, cmode, cumask, count, usage, false, concurrent)
 		if eno == syscall.ENOENT {
 			logger.Warnf("ignore deleted %s in dir %d", string(e.Name), srcIno)
 			if e.Attr.Typ == TypeDirectory {
@@ -2554,12 +3753,17 @@ LOOP:
 		attr.Nlink -= skipped
 		if eno := m.en.doRepair(ctx, ino, &attr); eno != 0 {
 			logger.Warnf("fix nlink of %d: %s", ino, eno)
+		} else {
+			m.logChange(ino)
 		}
 	}
 	return eno
 }
 
 func (m *baseMeta) mergeAttr(ctx Context, inode Ino, set uint16, cur, attr *Attr, now time.Time) (*Attr, syscall.Errno) {
+	if cur.Flags&FlagSnapshot != 0 && !isSnapshotCtx(ctx) {
+		return nil, syscall.EPERM
+	}
 	dirtyAttr := *cur
 	if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 		attr.Mode |= (cur.Mode & 06000)
@@ -2600,6 +3804,17 @@ func (m *baseMeta) mergeAttr(ctx Context, inode Ino, set uint16, cur, attr *Attr
 				return nil, syscall.EPERM
 			}
 			dirtyAttr.Mode = attr.Mode
+			if cur.AccessACL != aclNone { // the mode is a view of access ACL
+				rule, err := m.getACL(cur.AccessACL)
+				if err != nil {
+					return nil, errno(err)
+				}
+				rule = rule.Dup()
+				rule.SetMode(attr.Mode)
+				if dirtyAttr.AccessACL, err = m.insertACL(rule); err != nil {
+					return nil, errno(err)
+				}
+			}
 			changed = true
 		}
 	}
@@ -2647,6 +3862,9 @@ func (m *baseMeta) mergeAttr(ctx Context, inode Ino, set uint16, cur, attr *Attr
 		*attr = *cur
 		return nil, 0
 	}
+	if st := m.checkOwnerChange(cur, &dirtyAttr); st != 0 {
+		return nil, st
+	}
 	return &dirtyAttr, 0
 }
 
@@ -22,6 +22,7 @@ package meta
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
@@ -30,6 +31,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -121,7 +123,9 @@ func testMeta(t *testing.T, m Meta) {
 	testMetaClient(t, m)
 	testTruncateAndDelete(t, m)
 	testTrash(t, m)
+	testTrashPolicy(t, m)
 	testParents(t, m)
+	testTmpFile(t, m)
 	testRemove(t, m)
 	testStickyBit(t, m)
 	testLocks(t, m)
@@ -132,19 +136,31 @@ func testMeta(t *testing.T, m Meta) {
 	testCompaction(t, m, true)
 	testCopyFileRange(t, m)
 	testCloseSession(t, m)
+	testEvictSession(t, m)
 	testConcurrentDir(t, m)
 	testAttrFlags(t, m)
+	testACL(t, m)
 	testQuota(t, m)
+	testOwnerQuota(t, m)
+	testCloneQuota(t, m)
 	testAtime(t, m)
+	testInline(t, m)
+	testDedupe(t, m)
+	testPack(t, m)
 	base := m.getBase()
 	base.conf.OpenCache = time.Second
 	base.of.expire = time.Second
 	testOpenCache(t, m)
 	base.conf.CaseInsensi = true
 	testCaseIncensi(t, m)
+	base.fmt.CaseInsensitive = true // look up the folded names
+	testCaseIncensi(t, m)
+	base.fmt.CaseInsensitive = false
 	testCheckAndRepair(t, m)
 	testDirStat(t, m)
 	testClone(t, m)
+	testSnapshot(t, m)
+	testWatch(t, m)
 	base.conf.ReadOnly = true
 	testReadOnly(t, m)
 }
@@ -336,11 +352,20 @@ func testMetaClient(t *testing.T, m Meta) {
 	} else if string(entries[0].Name) != "." || string(entries[1].Name) != ".." || string(entries[2].Name) != "f" {
 		t.Fatalf("entries: %+v", entries)
 	}
-	if st := m.Rename(ctx, parent, "f", 1, "f2", RenameWhiteout, &inode, attr); st != syscall.ENOTSUP {
-		t.Fatalf("rename d/f -> f2: %s", st)
+	if st := m.Rename(ctx2, parent, "f", 1, "f2", RenameWhiteout, &inode, attr); st != syscall.EPERM {
+		t.Fatalf("rename d/f -> f2 with whiteout by non-root: %s", st)
+	}
+	if st := m.Rename(ctx, parent, "f", 1, "f2", RenameWhiteout, &inode, attr); st != 0 {
+		t.Fatalf("rename d/f -> f2 with whiteout: %s", st)
+	}
+	var wino Ino
+	if st := m.Lookup(ctx, parent, "f", &wino, attr, true); st != 0 {
+		t.Fatalf("lookup whiteout d/f: %s", st)
+	} else if attr.Typ != TypeCharDev || attr.Rdev != 0 || wino == inode {
+		t.Fatalf("whiteout d/f: type %d rdev %d inode %d", attr.Typ, attr.Rdev, wino)
 	}
-	if st := m.Rename(ctx, parent, "f", 1, "f2", 0, &inode, attr); st != 0 {
-		t.Fatalf("rename d/f -> f2: %s", st)
+	if st := m.Unlink(ctx, parent, "f"); st != 0 {
+		t.Fatalf("unlink whiteout d/f: %s", st)
 	}
 	defer func() {
 		_ = m.Unlink(ctx, 1, "f2")
@@ -356,6 +381,10 @@ func testMetaClient(t *testing.T, m Meta) {
 	}
 	_ = m.Close(ctx, inode)
 	defer m.Unlink(ctx, 1, "f")
+	var battr Attr
+	if st := m.GetAttr(ctx, inode, &battr); st != 0 || battr.Btime != battr.Ctime || battr.Btimensec != battr.Ctimensec || battr.Btime == 0 {
+		t.Fatalf("birth time of f: %s %+v", st, battr)
+	}
 	if st := m.Rename(ctx, 1, "f2", 1, "f", RenameNoReplace, &inode, attr); st != syscall.EEXIST {
 		t.Fatalf("rename f2 -> f: %s", st)
 	}
@@ -578,8 +607,30 @@ func testMetaClient(t *testing.T, m Meta) {
 	if st := m.StatFS(ctx, RootInode, &totalspace, &availspace, &iused, &iavail); st != 0 {
 		t.Fatalf("statfs: %s", st)
 	}
-	if totalspace != 1<<20 || iavail != 96 {
-		t.Fatalf("total space %d, iavail %d", totalspace, iavail)
+	if totalspace != availspace || iused != 0 || iavail != 96 { // subdir is empty, usage of other directories is hidden
+		t.Fatalf("total space %d, avail space %d, iused %d, iavail %d", totalspace, availspace, iused, iavail)
+	}
+	var subFile Ino
+	if st := m.Create(ctx, RootInode, "f", 0644, 0, 0, &subFile, attr); st != 0 {
+		t.Fatalf("create subdir/f: %s", st)
+	}
+	if st := m.Truncate(ctx, subFile, 0, 5000, attr, false); st != 0 {
+		t.Fatalf("truncate subdir/f: %s", st)
+	}
+	base.doFlushDirStat()
+	base.rootUsage.expire = time.Time{}
+	if st := m.StatFS(ctx, RootInode, &totalspace, &availspace, &iused, &iavail); st != 0 {
+		t.Fatalf("statfs: %s", st)
+	}
+	if totalspace-availspace != uint64(align4K(5000)) || iused != 1 { // usage of subdir from dir stats
+		t.Fatalf("total space %d, avail space %d, iused %d", totalspace, availspace, iused)
+	}
+	if st := m.Unlink(ctx, RootInode, "f"); st != 0 {
+		t.Fatalf("unlink subdir/f: %s", st)
+	}
+	base.doFlushDirStat()
+	if !m.InRoot(ctx, RootInode) || m.InRoot(ctx, parent) || m.InRoot(ctx, TrashInode) {
+		t.Fatalf("only the inodes inside subdir should be in root")
 	}
 
 	if err := m.HandleQuota(ctx, QuotaSet, "/subdir", map[string]*Quota{
@@ -1015,6 +1066,31 @@ func testRemove(t *testing.T, m Meta) {
 	} else if len(entries) != 4099 {
 		t.Fatalf("entries: %d", len(entries))
 	}
+	// list by pages
+	var after []byte
+	names := make(map[string]bool)
+	for {
+		var page []*Entry
+		if st := m.ReaddirPage(ctx, 1, 1, after, 1000, &page); st != 0 {
+			t.Fatalf("readdir page after %s: %s", after, st)
+		}
+		if after == nil {
+			page = page[2:] // "." and ".."
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, e := range page {
+			if bytes.Compare(e.Name, after) <= 0 || names[string(e.Name)] {
+				t.Fatalf("entry %s after %s", e.Name, after)
+			}
+			names[string(e.Name)] = true
+			after = e.Name
+		}
+	}
+	if len(names) != 4097 {
+		t.Fatalf("entries by pages: %d", len(names))
+	}
 	if st := m.Remove(ctx, 1, "d", nil); st != 0 {
 		t.Fatalf("rmr d: %s", st)
 	}
@@ -1046,6 +1122,12 @@ func testCaseIncensi(t *testing.T, m Meta) {
 	if st := m.Lookup(ctx, 1, "Bar", &inode, attr, true); st != 0 {
 		t.Fatalf("lookup Bar should be OK")
 	}
+	if e := m.ResolveCase(ctx, 1, "BAR"); e == nil || string(e.Name) != "bar" || e.Inode != inode {
+		t.Fatalf("resolve case of BAR: %+v", e)
+	}
+	if e := m.ResolveCase(ctx, 1, "baz"); e != nil {
+		t.Fatalf("resolve case of baz: %+v", e)
+	}
 	if st := m.Link(ctx, inode, 1, "foo", attr); st != syscall.EEXIST {
 		t.Fatalf("link should fail with EEXIST")
 	}
@@ -1125,6 +1207,21 @@ func testCompaction(t *testing.T, m Meta, trash bool) {
 		t.Fatalf("expect 1 slice, but got %+v", cs)
 	}
 
+	// punch hole
+	m.NewSlice(ctx, &sliceId)
+	_ = m.Write(ctx, inode, 2, 0, Slice{Id: sliceId, Size: 1 << 20, Len: 1 << 20}, time.Now())
+	if st := m.Fallocate(ctx, inode, fallocPunchHole|fallocKeepSize, 2*ChunkSize, 1<<20); st != 0 {
+		t.Fatalf("punch hole: %s", st)
+	}
+	if c, ok := m.(compactor); ok {
+		c.compactChunk(inode, 2, true)
+	}
+	cs = nil
+	_ = m.Read(ctx, inode, 2, &cs)
+	if len(cs) != 0 {
+		t.Fatalf("expect no slice after punching hole, but got %+v", cs)
+	}
+
 	// append
 	var size uint32 = 100000
 	for i := 0; i < 200; i++ {
@@ -1401,6 +1498,113 @@ func testCloseSession(t *testing.T, m Meta) {
 	}
 }
 
+func testEvictSession(t *testing.T, m Meta) {
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	ctx := Background
+	base := m.getBase()
+	if err := m.EvictSession(ctx, base.sid); err == nil {
+		t.Fatalf("evict the current session should fail")
+	}
+	if err := m.EvictSession(ctx, base.sid+100); err == nil {
+		t.Fatalf("evict a nonexistent session should fail")
+	}
+
+	atomic.StoreInt64(&base.leaseExpire, time.Now().Add(-time.Second).UnixNano())
+	var inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "evict", 0755, 022, 0, &inode, &attr); st != syscall.EROFS {
+		t.Fatalf("mkdir with expired lease: %s", st)
+	}
+	if err := base.en.doRefreshSession(); err != nil {
+		t.Fatalf("refresh session with expired lease: %s", err)
+	}
+	atomic.StoreInt64(&base.leaseExpire, 0)
+	if st := m.Mkdir(ctx, 1, "evict", 0755, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir with renewed lease: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "evict"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+
+	if err := base.en.doEvictSession(base.sid); err != nil {
+		t.Fatalf("evict session: %s", err)
+	}
+	if err := base.en.doRefreshSession(); err != errSessionEvicted {
+		t.Fatalf("refresh an evicted session: %v", err)
+	}
+	if err := m.CloseSession(); err != nil {
+		t.Fatalf("close session: %s", err)
+	}
+}
+
+func testTrashPolicy(t *testing.T, m Meta) {
+	ctx := Background
+	var parent, sub, inode Ino
+	attr := &Attr{}
+	if st := m.Mkdir(ctx, 1, "tp", 0755, 022, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir tp: %s", st)
+	}
+	if st := m.Mkdir(ctx, parent, "sub", 0755, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir tp/sub: %s", st)
+	}
+	format := testFormat()
+	format.TrashDays = 0
+	format.TrashPolicies = map[Ino]int{parent: 2}
+	if err := m.Init(format, false); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	defer func() {
+		if err := m.Init(testFormat(), false); err != nil {
+			t.Fatalf("init: %v", err)
+		}
+	}()
+	if !format.trashEnabled() {
+		t.Fatalf("trash should be enabled by policies")
+	}
+	base := m.getBase()
+	if days := base.trashDays(ctx, sub); days != 2 {
+		t.Fatalf("trash days of tp/sub: %d", days)
+	}
+	if days := base.trashDays(ctx, 1); days != 0 {
+		t.Fatalf("trash days of root: %d", days)
+	}
+	if st := m.Create(ctx, sub, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create tp/sub/f: %s", st)
+	}
+	if st := m.Unlink(ctx, sub, "f"); st != 0 {
+		t.Fatalf("unlink tp/sub/f: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || !isTrash(attr.Parent) {
+		t.Fatalf("getattr tp/sub/f(%d): %s, attr %+v", inode, st, attr)
+	}
+	ts := time.Now().Add(-time.Hour * 24)
+	if base.trashExpired(ctx, fmt.Sprintf("%d-%d-f", sub, inode), ts, time.Now()) {
+		t.Fatalf("tp/sub/f should not be expired in 2 days")
+	}
+	if !base.trashExpired(ctx, fmt.Sprintf("%d-%d-f", 1, inode), ts, time.Now()) {
+		t.Fatalf("files removed from root should be expired")
+	}
+	if st := m.Create(ctx, 1, "tpf", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create tpf: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "tpf"); st != 0 {
+		t.Fatalf("unlink tpf: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != syscall.ENOENT {
+		t.Fatalf("tpf should be deleted: %s", st)
+	}
+	base.doCleanupTrash(true)
+	if st := m.Rmdir(ctx, parent, "sub"); st != 0 {
+		t.Fatalf("rmdir tp/sub: %s", st)
+	}
+	base.doCleanupTrash(true)
+	if st := m.Rmdir(ctx, 1, "tp"); st != 0 {
+		t.Fatalf("rmdir tp: %s", st)
+	}
+}
+
 func testTrash(t *testing.T, m Meta) {
 	format := testFormat()
 	format.TrashDays = 1
@@ -1524,6 +1728,50 @@ func testTrash(t *testing.T, m Meta) {
 	}
 }
 
+func testTmpFile(t *testing.T, m Meta) {
+	ctx := Background
+	var dir, inode, tmp Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "tmpdir", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir tmpdir: %s", st)
+	}
+	if st := m.TmpFile(ctx, dir, 0644, 022, &inode, attr); st != 0 || attr.Nlink != 0 {
+		t.Fatalf("tmpfile: %s, nlink %d", st, attr.Nlink)
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, dir, 0, &entries); st != 0 || len(entries) != 2 {
+		t.Fatalf("readdir tmpdir: %s, %d entries", st, len(entries))
+	}
+	if st := m.Link(ctx, inode, dir, "f", attr); st != 0 || attr.Nlink != 1 || attr.Parent != dir {
+		t.Fatalf("link tmpfile: %s, nlink %d, parent %d", st, attr.Nlink, attr.Parent)
+	}
+	if st := m.Close(ctx, inode); st != 0 {
+		t.Fatalf("close tmpfile: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Nlink != 1 {
+		t.Fatalf("getattr of linked tmpfile: %s, nlink %d", st, attr.Nlink)
+	}
+	if ps := m.GetParents(ctx, inode); len(ps) != 1 || ps[dir] != 1 {
+		t.Fatalf("parents of linked tmpfile: %+v", ps)
+	}
+
+	if st := m.TmpFile(ctx, dir, 0644, 022, &tmp, attr); st != 0 {
+		t.Fatalf("tmpfile: %s", st)
+	}
+	if st := m.Close(ctx, tmp); st != 0 {
+		t.Fatalf("close tmpfile: %s", st)
+	}
+	if st := m.GetAttr(ctx, tmp, attr); st != syscall.ENOENT {
+		t.Fatalf("tmpfile should be removed after closed: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != 0 {
+		t.Fatalf("unlink f: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "tmpdir"); st != 0 {
+		t.Fatalf("rmdir tmpdir: %s", st)
+	}
+}
+
 func testParents(t *testing.T, m Meta) {
 	ctx := Background
 	var inode, parent Ino
@@ -1918,6 +2166,99 @@ func setAttr(t *testing.T, m Meta, inode Ino, attr *Attr) {
 	}
 }
 
+func testACL(t *testing.T, m Meta) {
+	ctx := Background
+	var rule ACLRule
+	if st := m.GetFacl(ctx, RootInode, ACLTypeAccess, &rule); st != syscall.ENOTSUP {
+		t.Fatalf("getfacl without ACL enabled: %s", st)
+	}
+	m.getBase().fmt.EnableACL = true
+	defer func() { m.getBase().fmt.EnableACL = false }()
+
+	var dir, inode, sub Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, RootInode, "acl", 0755, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir acl: %s", st)
+	}
+	if st := m.GetFacl(ctx, dir, ACLTypeAccess, &rule); st != ENOATTR {
+		t.Fatalf("getfacl: %s", st)
+	}
+	ctxA := NewContext(1, 1, []uint32{1})
+	ctxB := NewContext(1, 2, []uint32{2})
+	acc := NewACLRule(0755)
+	acc.NamedUsers = []ACLEntry{{Id: 1, Perm: 7}}
+	acc.UpdateMask()
+	if r, st := DecodeXattr(acc.EncodeXattr()); st != 0 || string(r.Encode()) != string(acc.Encode()) {
+		t.Fatalf("decode xattr: %s %+v", st, r)
+	}
+	if st := m.SetFacl(ctxA, dir, ACLTypeAccess, acc); st != syscall.EPERM {
+		t.Fatalf("setfacl by others: %s", st)
+	}
+	if st := m.SetFacl(ctx, dir, ACLTypeAccess, acc); st != 0 {
+		t.Fatalf("setfacl: %s", st)
+	}
+	if st := m.GetAttr(ctx, dir, attr); st != 0 || attr.Mode != 0775 || attr.AccessACL == 0 {
+		t.Fatalf("getattr: %s mode %o acl %d", st, attr.Mode, attr.AccessACL)
+	}
+	if st := m.GetFacl(ctx, dir, ACLTypeAccess, &rule); st != 0 || len(rule.NamedUsers) != 1 || rule.Mask != 7 {
+		t.Fatalf("getfacl: %s %+v", st, rule)
+	}
+	if st := m.Access(ctxA, dir, MODE_MASK_W, nil); st != 0 {
+		t.Fatalf("access by named user: %s", st)
+	}
+	if st := m.Access(ctxB, dir, MODE_MASK_W, nil); st != syscall.EACCES {
+		t.Fatalf("access by others: %s", st)
+	}
+
+	// the default ACL is inherited by new nodes, and umask is ignored
+	if st := m.SetFacl(ctx, dir, ACLTypeDefault, acc); st != 0 {
+		t.Fatalf("setfacl default: %s", st)
+	}
+	if st := m.Create(ctxA, dir, "f", 0666, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	if attr.Mode != 0664 || attr.AccessACL == 0 || attr.DefaultACL != 0 {
+		t.Fatalf("inherited attr of file: mode %o acl %d %d", attr.Mode, attr.AccessACL, attr.DefaultACL)
+	}
+	if st := m.SetFacl(ctxA, inode, ACLTypeDefault, acc); st != syscall.EACCES {
+		t.Fatalf("setfacl default on file: %s", st)
+	}
+	if st := m.Mkdir(ctxA, dir, "d", 0777, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	if attr.Mode != 0775 || attr.AccessACL == 0 || attr.DefaultACL == 0 {
+		t.Fatalf("inherited attr of dir: mode %o acl %d %d", attr.Mode, attr.AccessACL, attr.DefaultACL)
+	}
+
+	// chmod changes the mask instead of the owning group
+	attr.Mode = 0640
+	if st := m.SetAttr(ctxA, inode, SetAttrMode, 0, attr); st != 0 {
+		t.Fatalf("chmod f: %s", st)
+	}
+	if st := m.GetFacl(ctx, inode, ACLTypeAccess, &rule); st != 0 || rule.Owner != 6 || rule.Group != 5 || rule.Mask != 4 || rule.Other != 0 {
+		t.Fatalf("getfacl after chmod: %s %+v", st, rule)
+	}
+
+	if st := m.SetFacl(ctx, dir, ACLTypeDefault, nil); st != 0 {
+		t.Fatalf("remove default acl: %s", st)
+	}
+	if st := m.SetFacl(ctx, dir, ACLTypeAccess, nil); st != 0 {
+		t.Fatalf("remove access acl: %s", st)
+	}
+	if st := m.GetAttr(ctx, dir, attr); st != 0 || attr.Mode != 0775 || attr.AccessACL != 0 || attr.DefaultACL != 0 {
+		t.Fatalf("getattr: %s mode %o acl %d %d", st, attr.Mode, attr.AccessACL, attr.DefaultACL)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != 0 {
+		t.Fatalf("unlink f: %s", st)
+	}
+	if st := m.Rmdir(ctx, dir, "d"); st != 0 {
+		t.Fatalf("rmdir d: %s", st)
+	}
+	if st := m.Rmdir(ctx, RootInode, "acl"); st != 0 {
+		t.Fatalf("rmdir acl: %s", st)
+	}
+}
+
 func testCheckAndRepair(t *testing.T, m Meta) {
 	var checkInode, d1Inode, d2Inode, d3Inode, d4Inode Ino
 	dirAttr := &Attr{Mode: 0644, Full: true, Typ: TypeDirectory, Nlink: 3}
@@ -2127,6 +2468,188 @@ func testDirStat(t *testing.T, m Meta) {
 	checkResult(0, 0, 0)
 }
 
+func testSnapshot(t *testing.T, m Meta) {
+	ctx := Background
+	base := m.getBase()
+	// only the current session is alive
+	ses, err := m.ListSessions()
+	if err != nil {
+		t.Fatalf("list sessions: %s", err)
+	}
+	for _, s := range ses {
+		if s.Sid != base.sid {
+			_ = base.en.doCleanStaleSession(s.Sid)
+		}
+	}
+	var inode Ino
+	attr := &Attr{}
+	if st := m.Create(ctx, RootInode, "snapFile", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create snapFile: %s", st)
+	}
+	var count uint64
+	if st := m.CreateSnapshot(ctx, "s/1", time.Minute, &count); st != syscall.EINVAL {
+		t.Fatalf("create snapshot with invalid name: %s", st)
+	}
+	if st := m.CreateSnapshot(ctx, "s1", time.Minute, &count); st != 0 || count == 0 {
+		t.Fatalf("create snapshot s1: %s, count %d", st, count)
+	}
+	if st := m.CreateSnapshot(ctx, "s1", time.Minute, &count); st != syscall.EEXIST {
+		t.Fatalf("create snapshot s1 again: %s", st)
+	}
+	if st := m.CreateSnapshot(ctx, "s2", time.Minute, &count); st != 0 {
+		t.Fatalf("create snapshot s2: %s", st)
+	}
+	entries, st := m.ListSnapshots(ctx)
+	if st != 0 || len(entries) != 2 {
+		t.Fatalf("list snapshots: %s, %d entries", st, len(entries))
+	}
+	var sroot, snap, sfile Ino
+	if st := m.Lookup(ctx, RootInode, SnapshotDir, &sroot, attr, false); st != 0 {
+		t.Fatalf("lookup %s: %s", SnapshotDir, st)
+	}
+	if st := m.Lookup(ctx, sroot, "s2", &snap, attr, false); st != 0 {
+		t.Fatalf("lookup snapshot s2: %s", st)
+	}
+	if st := m.Lookup(ctx, snap, SnapshotDir, &inode, attr, false); st != syscall.ENOENT {
+		t.Fatalf("snapshots should not be included in a snapshot: %s", st)
+	}
+	if st := m.Unlink(ctx, RootInode, "snapFile"); st != 0 {
+		t.Fatalf("unlink snapFile: %s", st)
+	}
+	if st := m.Lookup(ctx, snap, "snapFile", &sfile, attr, false); st != 0 {
+		t.Fatalf("lookup snapFile in snapshot: %s", st)
+	}
+
+	// the changes after the point of snapshot are not in it, even if they are done before it's filled
+	if st := m.Create(ctx, RootInode, "cowFile", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create cowFile: %s", st)
+	}
+	sinodes, err := base.en.getCounter(snapshotInodes)
+	if err != nil {
+		t.Fatalf("get counter %s: %s", snapshotInodes, err)
+	}
+	sctx := snapshotCtx(ctx)
+	puntil, st := base.pauseAll(time.Minute)
+	if st != 0 {
+		t.Fatalf("pause all: %s", st)
+	}
+	p, st := base.startSnapshot(sctx, sroot, "s4", puntil)
+	base.resumeAll(puntil)
+	if st != 0 {
+		t.Fatalf("start snapshot s4: %s", st)
+	}
+	if st := m.Unlink(ctx, RootInode, "cowFile"); st != 0 {
+		t.Fatalf("unlink cowFile: %s", st)
+	}
+	if st := m.Create(ctx, RootInode, "newFile", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create newFile: %s", st)
+	}
+	if st := base.fillPending(sctx, p, &count); st != 0 {
+		t.Fatalf("fill snapshot s4: %s", st)
+	}
+	base.finishSnapshot(sctx, p, time.Second)
+	if st := base.setSnapshotFlags(sctx, p.root, snapshotFlags); st != 0 {
+		t.Fatalf("set flags of snapshot s4: %s", st)
+	}
+	if st := m.Lookup(ctx, p.root, "cowFile", &inode, attr, false); st != 0 {
+		t.Fatalf("lookup cowFile in snapshot s4: %s", st)
+	}
+	if st := m.Lookup(ctx, p.root, "newFile", &inode, attr, false); st != syscall.ENOENT {
+		t.Fatalf("lookup newFile in snapshot s4: %s", st)
+	}
+	if st := m.Unlink(ctx, RootInode, "newFile"); st != 0 {
+		t.Fatalf("unlink newFile: %s", st)
+	}
+	// the usage of snapshots is excluded from the volume
+	var sum Summary
+	if st := m.GetSummary(ctx, p.root, &sum, true, false); st != 0 {
+		t.Fatalf("get summary of snapshot s4: %s", st)
+	}
+	if v, err := base.en.getCounter(snapshotInodes); err != nil || v-sinodes != int64(sum.Dirs+sum.Files) {
+		t.Fatalf("counter %s: %d -> %d, %s, summary %+v", snapshotInodes, sinodes, v, err, sum)
+	}
+
+	// snapshots can only be changed by the command
+	if st := m.Create(ctx, sroot, "f", 0644, 022, 0, &inode, attr); st != syscall.EPERM {
+		t.Fatalf("create in %s: %s", SnapshotDir, st)
+	}
+	if st := m.Unlink(ctx, snap, "snapFile"); st != syscall.EPERM {
+		t.Fatalf("unlink snapFile in snapshot: %s", st)
+	}
+	if st := m.Rename(ctx, RootInode, SnapshotDir, RootInode, "renamed", 0, &inode, attr); st != syscall.EPERM {
+		t.Fatalf("rename %s: %s", SnapshotDir, st)
+	}
+	attr.Mode = 0600
+	if st := m.SetAttr(ctx, sfile, SetAttrMode, 0, attr); st != syscall.EPERM {
+		t.Fatalf("chmod snapFile in snapshot: %s", st)
+	}
+	attr.Flags = 0
+	if st := m.SetAttr(ctx, sfile, SetAttrFlag, 0, attr); st != syscall.EPERM {
+		t.Fatalf("clear flags of snapFile in snapshot: %s", st)
+	}
+	// the files cloned out of a snapshot are writable
+	var total uint64
+	if st := m.Clone(ctx, sfile, RootInode, "restored", CLONE_MODE_PRESERVE_ATTR, 0, &count, &total); st != 0 {
+		t.Fatalf("clone snapFile out of snapshot: %s", st)
+	}
+	if st := m.Lookup(ctx, RootInode, "restored", &inode, attr, false); st != 0 || attr.Flags != 0 {
+		t.Fatalf("lookup restored: %s, flags %d", st, attr.Flags)
+	}
+	if st := m.Unlink(ctx, RootInode, "restored"); st != 0 {
+		t.Fatalf("unlink restored: %s", st)
+	}
+
+	// writes are paused while a snapshot is being created by another client
+	now := time.Now().Unix()
+	until := now + 30
+	if ok, err := base.en.setIfSmall(snapshotPause, until, until-now); err != nil || !ok {
+		t.Fatalf("set %s: %v, %v", snapshotPause, ok, err)
+	}
+	if st := m.CreateSnapshot(ctx, "s3", time.Minute, &count); st != syscall.EBUSY {
+		t.Fatalf("create snapshot s3 while another is being created: %s", st)
+	}
+	if err := base.checkPause(); err != nil || !base.writesPaused() {
+		t.Fatalf("writes should be paused: %v", err)
+	}
+	done := make(chan syscall.Errno, 1)
+	go func() {
+		var pinode Ino
+		done <- m.Mkdir(ctx, RootInode, "paused", 0755, 022, 0, &pinode, &Attr{})
+	}()
+	select {
+	case st := <-done:
+		t.Fatalf("mkdir should be paused: %s", st)
+	case <-time.After(time.Millisecond * 300):
+	}
+	base.resumeAll(until)
+	select {
+	case st := <-done:
+		if st != 0 {
+			t.Fatalf("mkdir after resumed: %s", st)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("writes are not resumed")
+	}
+	if st := m.Rmdir(ctx, RootInode, "paused"); st != 0 {
+		t.Fatalf("rmdir paused: %s", st)
+	}
+
+	for _, name := range []string{"s1", "s2", "s4"} {
+		if st := m.DeleteSnapshot(ctx, name, &count); st != 0 {
+			t.Fatalf("delete snapshot %s: %s", name, st)
+		}
+	}
+	if st := m.DeleteSnapshot(ctx, "s1", &count); st != syscall.ENOENT {
+		t.Fatalf("delete snapshot s1 again: %s", st)
+	}
+	if entries, st = m.ListSnapshots(ctx); st != 0 || len(entries) != 0 {
+		t.Fatalf("list snapshots: %s, %d entries", st, len(entries))
+	}
+	if st := m.Lookup(ctx, RootInode, SnapshotDir, &sroot, attr, false); st != syscall.ENOENT {
+		t.Fatalf("%s should be removed with the last snapshot: %s", SnapshotDir, st)
+	}
+}
+
 func testClone(t *testing.T, m Meta) {
 	//$ tree cloneDir
 	//.
@@ -2570,6 +3093,309 @@ func testQuota(t *testing.T, m Meta) {
 	}
 }
 
+func testOwnerQuota(t *testing.T, m Meta) {
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("New session: %s", err)
+	}
+	defer m.CloseSession()
+	var parent, inode Ino
+	var attr Attr
+	if st := m.Mkdir(Background, RootInode, "ownerquota", 0777, 0, 0, &parent, &attr); st != 0 {
+		t.Fatalf("Mkdir ownerquota: %s", st)
+	}
+	name := "uid:1234"
+	if err := m.HandleQuota(Background, QuotaSet, name, map[string]*Quota{name: {MaxSpace: -1, MaxInodes: 2}}, false, false); err != nil {
+		t.Fatalf("HandleQuota set %s: %s", name, err)
+	}
+	m.getBase().loadQuotas()
+	ctx := NewContext(1, 1234, []uint32{5678})
+	if st := m.Mkdir(ctx, parent, "d", 0755, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("Mkdir ownerquota/d: %s", st)
+	}
+	if st := m.Create(ctx, inode, "f1", 0644, 0, 0, nil, &attr); st != 0 {
+		t.Fatalf("Create ownerquota/d/f1: %s", st)
+	}
+	if st := m.Create(ctx, inode, "f2", 0644, 0, 0, nil, &attr); st != syscall.EDQUOT {
+		t.Fatalf("Create ownerquota/d/f2: %s", st)
+	}
+	var f1, f3 Ino
+	if st := m.Lookup(ctx, inode, "f1", &f1, &attr, false); st != 0 {
+		t.Fatalf("Lookup ownerquota/d/f1: %s", st)
+	}
+	if st := m.Create(Background, inode, "f3", 0644, 0, 0, &f3, &attr); st != 0 {
+		t.Fatalf("Create ownerquota/d/f3 by root: %s", st)
+	}
+	attr.Uid = 1234
+	if st := m.SetAttr(Background, f3, SetAttrUID, 0, &attr); st != syscall.EDQUOT {
+		t.Fatalf("Chown ownerquota/d/f3 to user out of quota: %s", st)
+	}
+	time.Sleep(time.Second * 4)
+
+	qs := make(map[string]*Quota)
+	if err := m.HandleQuota(Background, QuotaCheck, name, qs, false, false); err != nil {
+		t.Fatalf("HandleQuota check %s: %s", name, err)
+	} else if q := qs[name]; q.UsedInodes != 2 || q.UsedSpace != 2*4<<10 {
+		t.Fatalf("HandleQuota check %s: %+v", name, q)
+	}
+	// the usage is moved to the new owner
+	attr.Uid = 0
+	if st := m.SetAttr(Background, f1, SetAttrUID, 0, &attr); st != 0 {
+		t.Fatalf("Chown ownerquota/d/f1 to root: %s", st)
+	}
+	attr.Uid = 1234
+	if st := m.SetAttr(Background, f3, SetAttrUID, 0, &attr); st != 0 {
+		t.Fatalf("Chown ownerquota/d/f3: %s", st)
+	}
+	attr.Uid = 0
+	if st := m.SetAttr(Background, f3, SetAttrUID, 0, &attr); st != 0 {
+		t.Fatalf("Chown ownerquota/d/f3 to root: %s", st)
+	}
+	time.Sleep(time.Second * 4)
+	if err := m.HandleQuota(Background, QuotaCheck, name, qs, false, false); err != nil {
+		t.Fatalf("HandleQuota check %s after chown: %s", name, err)
+	} else if q := qs[name]; q.UsedInodes != 1 || q.UsedSpace != 4<<10 {
+		t.Fatalf("HandleQuota check %s after chown: %+v", name, q)
+	}
+	if err := m.HandleQuota(Background, QuotaList, "", qs, false, false); err != nil || qs[name] == nil {
+		t.Fatalf("HandleQuota list: %s %+v", err, qs)
+	}
+	if err := m.HandleQuota(Background, QuotaDel, name, nil, false, false); err != nil {
+		t.Fatalf("HandleQuota del %s: %s", name, err)
+	}
+	m.getBase().loadQuotas()
+	if st := m.Create(ctx, inode, "f2", 0644, 0, 0, nil, &attr); st != 0 {
+		t.Fatalf("Create ownerquota/d/f2 without quota: %s", st)
+	}
+
+	// new inodes in a setgid directory belong to the group of the directory
+	if runtime.GOOS != "linux" {
+		return
+	}
+	var sgid Ino
+	if st := m.Mkdir(Background, parent, "sgid", 02777, 0, 0, &sgid, &attr); st != 0 {
+		t.Fatalf("Mkdir ownerquota/sgid: %s", st)
+	}
+	attr.Gid = 4321
+	attr.Mode = 02777
+	if st := m.SetAttr(Background, sgid, SetAttrGID|SetAttrMode, 0, &attr); st != 0 {
+		t.Fatalf("Chown ownerquota/sgid: %s", st)
+	}
+	gname := "gid:4321"
+	if err := m.HandleQuota(Background, QuotaSet, gname, map[string]*Quota{gname: {MaxSpace: -1, MaxInodes: 1}}, false, false); err != nil {
+		t.Fatalf("HandleQuota set %s: %s", gname, err)
+	}
+	m.getBase().loadQuotas()
+	if st := m.Mknod(ctx, sgid, "f", TypeFile, 0644, 0, 0, "", &inode, &attr); st != syscall.EDQUOT {
+		t.Fatalf("Mknod ownerquota/sgid/f: %s", st)
+	}
+	if err := m.HandleQuota(Background, QuotaDel, gname, nil, false, false); err != nil {
+		t.Fatalf("HandleQuota del %s: %s", gname, err)
+	}
+	m.getBase().loadQuotas()
+}
+
+func testCloneQuota(t *testing.T, m Meta) {
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("New session: %s", err)
+	}
+	defer m.CloseSession()
+	var parent, src, dst, inode Ino
+	var attr Attr
+	if st := m.Mkdir(Background, RootInode, "clonequota", 0777, 0, 0, &parent, &attr); st != 0 {
+		t.Fatalf("Mkdir clonequota: %s", st)
+	}
+	if st := m.Mkdir(Background, parent, "dst", 0777, 0, 0, &dst, &attr); st != 0 {
+		t.Fatalf("Mkdir clonequota/dst: %s", st)
+	}
+	u1, u2, dpath := "uid:1234", "uid:2345", "/clonequota/dst"
+	quotas := map[string]*Quota{
+		u1:    {MaxSpace: -1, MaxInodes: 4},
+		u2:    {MaxSpace: -1, MaxInodes: 2},
+		dpath: {MaxSpace: 1 << 30, MaxInodes: 10},
+	}
+	for name := range quotas {
+		if err := m.HandleQuota(Background, QuotaSet, name, quotas, false, false); err != nil {
+			t.Fatalf("HandleQuota set %s: %s", name, err)
+		}
+	}
+	m.getBase().loadQuotas()
+
+	// src (1234), src/f1 (1234, 5000 bytes), src/f2 (2345)
+	ctx1, ctx2 := NewContext(1, 1234, []uint32{1234}), NewContext(1, 2345, []uint32{2345})
+	if st := m.Mkdir(ctx1, parent, "src", 0777, 0, 0, &src, &attr); st != 0 {
+		t.Fatalf("Mkdir clonequota/src: %s", st)
+	}
+	if st := m.Create(ctx1, src, "f1", 0644, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("Create clonequota/src/f1: %s", st)
+	}
+	if st := m.Truncate(ctx1, inode, 0, 5000, &attr, false); st != 0 {
+		t.Fatalf("Truncate clonequota/src/f1: %s", st)
+	}
+	if st := m.Create(ctx2, src, "f2", 0644, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("Create clonequota/src/f2: %s", st)
+	}
+	// the whole tree (3 inodes) exceeds the quota of 1234, but only 2 of them belong to 1234,
+	// and the caller (2345) is charged only for the one it owns since the owners are preserved
+	var count, total uint64
+	if st := m.Clone(ctx2, src, dst, "c1", CLONE_MODE_PRESERVE_ATTR, 0, &count, &total); st != 0 {
+		t.Fatalf("Clone clonequota/src: %s", st)
+	}
+	time.Sleep(time.Second * 4)
+	expect := map[string][2]int64{
+		u1:    {2 * (4<<10 + 8<<10), 4},
+		u2:    {2 * 4 << 10, 2},
+		dpath: {4<<10 + 8<<10 + 4<<10, 3},
+	}
+	qs := make(map[string]*Quota)
+	for name, e := range expect {
+		if err := m.HandleQuota(Background, QuotaGet, name, qs, false, false); err != nil {
+			t.Fatalf("HandleQuota get %s: %s", name, err)
+		} else if q := qs[name]; q.UsedSpace != e[0] || q.UsedInodes != e[1] {
+			t.Fatalf("HandleQuota get %s: expect %v, got %+v", name, e, q)
+		}
+	}
+
+	// 1234 has enough quota now, but 2345 does not
+	quotas[u1].MaxInodes = 10
+	if err := m.HandleQuota(Background, QuotaSet, u1, quotas, false, false); err != nil {
+		t.Fatalf("HandleQuota set %s: %s", u1, err)
+	}
+	m.getBase().loadQuotas()
+	if st := m.Clone(Background, src, dst, "c2", CLONE_MODE_PRESERVE_ATTR, 0, &count, &total); st != syscall.EDQUOT {
+		t.Fatalf("Clone clonequota/src with owner out of quota: %s", st)
+	}
+	if st := m.Lookup(Background, dst, "c2", &inode, &attr, false); st != syscall.ENOENT {
+		t.Fatalf("Lookup clonequota/dst/c2: %s", st)
+	}
+	// the clone belongs to the caller without preserving the attributes
+	if st := m.Clone(ctx2, src, dst, "c3", 0, 0, &count, &total); st != syscall.EDQUOT {
+		t.Fatalf("Clone clonequota/src by 2345: %s", st)
+	}
+	if st := m.Clone(ctx1, src, dst, "c3", 0, 0, &count, &total); st != 0 {
+		t.Fatalf("Clone clonequota/src by 1234: %s", st)
+	}
+	time.Sleep(time.Second * 4)
+	expect[u1] = [2]int64{3*(4<<10+8<<10) + 4<<10, 7}
+	expect[dpath] = [2]int64{2 * (4<<10 + 8<<10 + 4<<10), 6}
+	for name, e := range expect {
+		if err := m.HandleQuota(Background, QuotaGet, name, qs, false, false); err != nil {
+			t.Fatalf("HandleQuota get %s: %s", name, err)
+		} else if q := qs[name]; q.UsedSpace != e[0] || q.UsedInodes != e[1] {
+			t.Fatalf("HandleQuota get %s after clone: expect %v, got %+v", name, e, q)
+		}
+	}
+	for name := range quotas {
+		if err := m.HandleQuota(Background, QuotaDel, name, nil, false, false); err != nil {
+			t.Fatalf("HandleQuota del %s: %s", name, err)
+		}
+	}
+	m.getBase().loadQuotas()
+}
+
+func testInline(t *testing.T, m Meta) {
+	if _, err := m.GetInline("1_0_5"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get inline 1_0_5: %v", err)
+	}
+	if err := m.SetInline("1_0_5", []byte("hello")); err != nil {
+		t.Fatalf("set inline 1_0_5: %s", err)
+	}
+	if data, err := m.GetInline("1_0_5"); err != nil || string(data) != "hello" {
+		t.Fatalf("get inline 1_0_5: %q %v", data, err)
+	}
+	if err := m.SetInline("1_0_big", make([]byte, MaxInlineSize*2)); err == nil {
+		t.Fatalf("set inline with large block should fail")
+	}
+	var buf bytes.Buffer
+	if err := m.DumpMeta(&buf, RootInode, false); err != nil {
+		t.Fatalf("dump meta: %s", err)
+	}
+	if !strings.Contains(buf.String(), `"Inline"`) {
+		t.Fatalf("inline blocks are not dumped")
+	}
+	if err := m.DeleteInline("1_0_5"); err != nil {
+		t.Fatalf("delete inline 1_0_5: %s", err)
+	}
+	if err := m.DeleteInline("1_0_5"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("delete inline 1_0_5 again: %v", err)
+	}
+}
+
+func testDedupe(t *testing.T, m Meta) {
+	hash := strings.Repeat("ab", 32)
+	expected := []int64{1, 2, 2} // idempotent for the same block
+	for i, key := range []string{"1_0_100", "2_0_100", "2_0_100"} {
+		if refs, err := m.RefBlock(key, hash); err != nil || refs != expected[i] {
+			t.Fatalf("ref block %s: %d %v", key, refs, err)
+		}
+	}
+	if _, err := m.RefBlock("1_0_100", strings.Repeat("cd", 32)); err == nil {
+		t.Fatalf("ref block with different hash should fail")
+	}
+	if h, err := m.GetBlockHash("2_0_100"); err != nil || h != hash {
+		t.Fatalf("get block hash: %s %v", h, err)
+	}
+	if _, err := m.GetBlockHash("3_0_100"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get block hash of 3_0_100: %v", err)
+	}
+	if h, refs, err := m.UnrefBlock("1_0_100"); err != nil || h != hash || refs != 1 {
+		t.Fatalf("unref block 1_0_100: %s %d %v", h, refs, err)
+	}
+	if _, _, err := m.UnrefBlock("1_0_100"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unref block 1_0_100 again: %v", err)
+	}
+	if _, refs, err := m.UnrefBlock("2_0_100"); err != nil || refs != 0 {
+		t.Fatalf("unref block 2_0_100: %d %v", refs, err)
+	}
+	// the content can't be referenced until it's dropped
+	if refs, err := m.RefBlock("3_0_100", hash); err != nil || refs != -1 {
+		t.Fatalf("ref block of deleting content: %d %v", refs, err)
+	}
+	if _, err := m.GetBlockHash("3_0_100"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("block of deleting content should not be recorded: %v", err)
+	}
+	if err := m.DropContent(hash); err != nil {
+		t.Fatalf("drop content: %v", err)
+	}
+	if refs, err := m.RefBlock("3_0_100", hash); err != nil || refs != 1 {
+		t.Fatalf("ref block after dropped: %d %v", refs, err)
+	}
+	if err := m.DropContent(hash); err != nil {
+		t.Fatalf("drop referenced content: %v", err)
+	}
+	if refs, err := m.RefBlock("4_0_100", hash); err != nil || refs != 2 {
+		t.Fatalf("referenced content should not be dropped: %d %v", refs, err)
+	}
+}
+
+func testPack(t *testing.T, m Meta) {
+	blocks := map[string][2]uint32{"1_0_100": {0, 80}, "2_0_100": {80, 90}}
+	if refs, err := m.PackBlocks("packs/p1", blocks); err != nil || refs != 2 {
+		t.Fatalf("pack blocks: %d %v", refs, err)
+	}
+	blocks = map[string][2]uint32{"2_0_100": {0, 90}, "3_0_100": {90, 100}}
+	if refs, err := m.PackBlocks("packs/p2", blocks); err != nil || refs != 1 { // 2_0_100 is packed already
+		t.Fatalf("pack blocks again: %d %v", refs, err)
+	}
+	if p, off, l, err := m.GetPackedBlock("2_0_100"); err != nil || p != "packs/p1" || off != 80 || l != 90 {
+		t.Fatalf("get packed block: %s %d %d %v", p, off, l, err)
+	}
+	if _, _, _, err := m.GetPackedBlock("4_0_100"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("get packed block 4_0_100: %v", err)
+	}
+	if p, refs, err := m.UnpackBlock("1_0_100"); err != nil || p != "packs/p1" || refs != 1 {
+		t.Fatalf("unpack block 1_0_100: %s %d %v", p, refs, err)
+	}
+	if _, _, err := m.UnpackBlock("1_0_100"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unpack block 1_0_100 again: %v", err)
+	}
+	if p, refs, err := m.UnpackBlock("2_0_100"); err != nil || p != "packs/p1" || refs != 0 {
+		t.Fatalf("unpack block 2_0_100: %s %d %v", p, refs, err)
+	}
+	if p, refs, err := m.UnpackBlock("3_0_100"); err != nil || p != "packs/p2" || refs != 0 {
+		t.Fatalf("unpack block 3_0_100: %s %d %v", p, refs, err)
+	}
+}
+
 func testAtime(t *testing.T, m Meta) {
 	ctx := Background
 	var inode, parent Ino
@@ -2686,3 +3512,71 @@ func testAtime(t *testing.T, m Meta) {
 		}
 	}
 }
+
+func testWatch(t *testing.T, m Meta) {
+	ctx := Background
+	var parent, other, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, RootInode, "watched", 0755, 0, 0, &parent, &attr); st != 0 {
+		t.Fatalf("mkdir watched: %s", st)
+	}
+	if st := m.Mkdir(ctx, RootInode, "unwatched", 0755, 0, 0, &other, &attr); st != 0 {
+		t.Fatalf("mkdir unwatched: %s", st)
+	}
+	w, st := m.Watch(ctx, parent, 10)
+	if st != 0 {
+		t.Fatalf("watch: %s", st)
+	}
+	if st := m.Create(ctx, other, "f", 0644, 0, 0, nil, &attr); st != 0 {
+		t.Fatalf("create unwatched/f: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f", 0644, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create watched/f: %s", st)
+	}
+	if st := m.Rename(ctx, parent, "f", parent, "f2", 0, nil, nil); st != 0 {
+		t.Fatalf("rename watched/f: %s", st)
+	}
+	attr.Mode = 0600
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, &attr); st != 0 {
+		t.Fatalf("setattr watched/f2: %s", st)
+	}
+	if st := m.Unlink(ctx, parent, "f2"); st != 0 {
+		t.Fatalf("unlink watched/f2: %s", st)
+	}
+	expected := []Event{
+		{Type: EventCreate, Inode: inode, Parent: parent, Name: "f"},
+		{Type: EventRename, Inode: inode, Parent: parent, Name: "f", NewParent: parent, NewName: "f2"},
+		{Type: EventAttr, Inode: inode, Parent: parent},
+		{Type: EventDelete, Inode: inode, Parent: parent, Name: "f2"},
+	}
+	for _, exp := range expected {
+		select {
+		case e := <-w.Events():
+			e.Time = 0
+			if *e != exp {
+				t.Fatalf("expect event %+v, but got %+v", exp, *e)
+			}
+		default:
+			t.Fatalf("expect event %+v, but got nothing", exp)
+		}
+	}
+	// changes made by other clients
+	m.getBase().notifyChanges([]Ino{other, parent})
+	select {
+	case e := <-w.Events():
+		if e.Type != EventChange || e.Inode != parent || e.Parent != RootInode {
+			t.Fatalf("expect change of %d, but got %+v", parent, *e)
+		}
+	default:
+		t.Fatalf("expect change of %d, but got nothing", parent)
+	}
+	select {
+	case e := <-w.Events():
+		t.Fatalf("unexpected event %+v", *e)
+	default:
+	}
+	w.Close()
+	if _, ok := <-w.Events(); ok {
+		t.Fatalf("events should be closed")
+	}
+}
@@ -0,0 +1,475 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// The changes are logged with the clock of clients, which may be skewed, so the changes logged
+// within this window before the given time are dumped again in the next incremental backup.
+const changelogSkew = time.Minute
+
+// lostChanges is logged into changelog when a session is ended uncleanly, since the changes not flushed
+// by it are lost, so the next incremental dump has to include all the inodes.
+const lostChanges Ino = 1<<63 - 1
+
+// DumpedChanges is the header of an incremental dump, followed by the changed inodes (one per line).
+type DumpedChanges struct {
+	Since    int64 // unix milliseconds
+	Until    int64
+	Setting  Format
+	Counters *DumpedCounters
+	Quotas   map[Ino]*DumpedQuota `json:",omitempty"`
+}
+
+type DumpedDirent struct {
+	Name  string `json:"name"`
+	Inode Ino    `json:"inode"`
+	Type  string `json:"type"`
+}
+
+// DumpedChange is the latest state of a changed inode.
+type DumpedChange struct {
+	Inode   Ino             `json:"inode"`
+	Removed bool            `json:"removed,omitempty"`
+	Attr    *DumpedAttr     `json:"attr,omitempty"`
+	Symlink string          `json:"symlink,omitempty"`
+	Xattrs  []*DumpedXattr  `json:"xattrs,omitempty"`
+	Chunks  []*DumpedChunk  `json:"chunks,omitempty"`
+	Entries []*DumpedDirent `json:"entries,omitempty"`
+}
+
+func (m *baseMeta) changelogOn() bool {
+	f := m.fmt
+	return f != nil && f.Changelog
+}
+
+// loggingChanges returns true if the changed inodes are needed by changelog or cache invalidation.
+func (m *baseMeta) loggingChanges() bool {
+	return m.changelogOn() || m.conf.CacheInvalidation
+}
+
+// logChange marks the inodes as changed, which will be flushed into changelog
+// and published to other clients (if cache invalidation is enabled) later.
+func (m *baseMeta) logChange(inodes ...Ino) {
+	if !m.loggingChanges() {
+		return
+	}
+	m.changesMu.Lock()
+	for _, inode := range inodes {
+		if inode > 0 {
+			m.changes[inode] = struct{}{}
+		}
+	}
+	m.changesMu.Unlock()
+}
+
+// logTrash marks the current trash directory as changed, when an entry could be moved into it.
+func (m *baseMeta) logTrash(parent Ino) {
+	if !m.loggingChanges() || !m.toTrash(parent) {
+		return
+	}
+	m.Lock()
+	trash := m.subTrash.inode
+	m.Unlock()
+	m.logChange(trash)
+}
+
+func (m *baseMeta) flushChanges() {
+	var lastCleanup time.Time
+	for {
+		time.Sleep(time.Second)
+		m.logChanges()
+		if m.conf.CacheInvalidation && !m.conf.NoBGJob && time.Since(lastCleanup) > invalidationTTL {
+			lastCleanup = time.Now()
+			if err := m.en.doCleanupInvalidation(lastCleanup.Add(-invalidationTTL).UnixMilli()); err != nil {
+				logger.Warnf("Cleanup invalidations: %s", err)
+			}
+		}
+	}
+}
+
+// logChanges writes the changed inodes into changelog, and publishes them to other clients.
+// It returns the error if they are not written into changelog (they will be retried later).
+func (m *baseMeta) logChanges() error {
+	m.changesMu.Lock()
+	if len(m.changes) == 0 {
+		m.changesMu.Unlock()
+		return nil
+	}
+	changes := m.changes
+	m.changes = make(map[Ino]struct{})
+	m.changesMu.Unlock()
+
+	inodes := make([]Ino, 0, len(changes))
+	for inode := range changes {
+		inodes = append(inodes, inode)
+	}
+	now := time.Now().UnixMilli()
+	if m.changelogOn() {
+		if err := m.en.doLogChanges(now, inodes); err != nil {
+			logger.Warnf("Log %d changed inodes: %s", len(inodes), err)
+			m.logChange(inodes...) // retry later
+			return err
+		}
+	}
+	if m.conf.CacheInvalidation {
+		if err := m.en.doPublishInvalidation(now, encodeInvalidation(m.sid, inodes)); err != nil {
+			logger.Warnf("Publish %d changed inodes: %s", len(inodes), err)
+		}
+	}
+	return nil
+}
+
+// markLostChanges is called before a stale session is cleaned up, since the changes made by it may not be
+// in changelog.
+func (m *baseMeta) markLostChanges(sid uint64) error {
+	if !m.changelogOn() {
+		return nil
+	}
+	if err := m.en.doLogChanges(time.Now().UnixMilli(), []Ino{lostChanges}); err != nil {
+		return fmt.Errorf("mark lost changes of session %d: %s", sid, err)
+	}
+	return nil
+}
+
+// scanAllInodes calls fn for all the inodes in the tree and trash.
+func (m *baseMeta) scanAllInodes(ctx Context, fn func(inode Ino)) error {
+	seen := make(map[Ino]bool) // hard links
+	var walk func(ino Ino) syscall.Errno
+	walk = func(ino Ino) syscall.Errno {
+		fn(ino)
+		var entries []*Entry
+		if st := m.en.doReaddir(ctx, ino, 1, &entries, -1); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if e.Attr.Typ == TypeDirectory {
+				if st := walk(e.Inode); st != 0 && st != syscall.ENOENT {
+					return st
+				}
+				continue
+			}
+			if e.Attr.Nlink > 1 {
+				if seen[e.Inode] {
+					continue
+				}
+				seen[e.Inode] = true
+			}
+			fn(e.Inode)
+		}
+		return 0
+	}
+	if st := walk(RootInode); st != 0 {
+		return st
+	}
+	if st := walk(TrashInode); st != 0 && st != syscall.ENOENT {
+		return st
+	}
+	return nil
+}
+
+// TrimChanges removes the changelog before the given time.
+func (m *baseMeta) TrimChanges(before time.Time) error {
+	return m.en.doTrimChanges(before.Add(-changelogSkew).UnixMilli())
+}
+
+// DumpChanges dumps the inodes changed between since and until (according to the changelog).
+func (m *baseMeta) DumpChanges(w io.Writer, since, until time.Time, keepSecret bool) error {
+	ctx := Background
+	body, err := m.en.doLoad()
+	if err != nil {
+		return err
+	}
+	dc := &DumpedChanges{Since: since.UnixMilli(), Until: until.UnixMilli()}
+	if err = json.Unmarshal(body, &dc.Setting); err != nil {
+		return fmt.Errorf("json: %s", err)
+	}
+	if !dc.Setting.Changelog {
+		return fmt.Errorf("changelog is not enabled")
+	}
+	if !keepSecret && dc.Setting.SecretKey != "" {
+		dc.Setting.SecretKey = "removed"
+		logger.Warnf("Secret key is removed for the sake of safety")
+	}
+	if !keepSecret && dc.Setting.SessionToken != "" {
+		dc.Setting.SessionToken = "removed"
+		logger.Warnf("Session token is removed for the sake of safety")
+	}
+	var cs [6]int64
+	for i, name := range []string{usedSpace, totalInodes, "nextInode", "nextChunk", "nextSession", "nextTrash"} {
+		if cs[i], err = m.en.getCounter(name); err != nil {
+			return fmt.Errorf("get counter %s: %s", name, err)
+		}
+	}
+	dc.Counters = &DumpedCounters{UsedSpace: cs[0], UsedInodes: cs[1], NextInode: cs[2], NextChunk: cs[3], NextSession: cs[4], NextTrash: cs[5]}
+	quotas, err := m.en.doLoadQuotas(ctx)
+	if err != nil {
+		return fmt.Errorf("load quotas: %s", err)
+	}
+	dc.Quotas = make(map[Ino]*DumpedQuota, len(quotas))
+	for inode, q := range quotas {
+		dc.Quotas[inode] = &DumpedQuota{MaxSpace: q.MaxSpace, MaxInodes: q.MaxInodes}
+	}
+
+	var lost bool
+	inodes := make(map[Ino]struct{})
+	err = m.en.doScanChanges(ctx, since.Add(-changelogSkew).UnixMilli(), until.UnixMilli(), func(inode Ino) {
+		if inode == lostChanges {
+			lost = true
+		} else {
+			inodes[inode] = struct{}{}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("scan changelog: %s", err)
+	}
+	if !lost { // the stale sessions are not cleaned up yet
+		sids, err := m.en.doFindStaleSessions(1)
+		if err != nil {
+			return fmt.Errorf("find stale sessions: %s", err)
+		}
+		lost = len(sids) > 0
+	}
+	if lost {
+		logger.Warnf("Some changes may be missing in changelog since a session is ended uncleanly, dump all the inodes")
+		if err = m.scanAllInodes(ctx, func(inode Ino) { inodes[inode] = struct{}{} }); err != nil {
+			return fmt.Errorf("scan all inodes: %s", err)
+		}
+	}
+	bw := bufio.NewWriterSize(w, jsonWriteSize)
+	enc := json.NewEncoder(bw)
+	if err = enc.Encode(dc); err != nil {
+		return err
+	}
+	for inode := range inodes {
+		c, err := m.dumpChange(ctx, inode)
+		if err != nil {
+			return err
+		}
+		if err = enc.Encode(c); err != nil {
+			return err
+		}
+	}
+	logger.Infof("Dumped %d changed inodes since %s", len(inodes), since.Format(time.RFC3339))
+	return bw.Flush()
+}
+
+func (m *baseMeta) dumpChange(ctx Context, inode Ino) (*DumpedChange, error) {
+	c := &DumpedChange{Inode: inode}
+	removed := func(st syscall.Errno) (*DumpedChange, error) {
+		if st == syscall.ENOENT {
+			return &DumpedChange{Inode: inode, Removed: true}, nil
+		}
+		return nil, fmt.Errorf("dump inode %d: %s", inode, st)
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return removed(st)
+	}
+	c.Attr = &DumpedAttr{Inode: inode}
+	dumpAttr(&attr, c.Attr)
+	switch attr.Typ {
+	case TypeFile:
+		for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
+			var ss []Slice
+			if st := m.en.(Meta).Read(ctx, inode, indx, &ss); st != 0 {
+				return removed(st)
+			}
+			var dc = &DumpedChunk{Index: indx}
+			var pos uint32
+			for _, s := range ss {
+				if s.Id > 0 {
+					dc.Slices = append(dc.Slices, &DumpedSlice{Id: s.Id, Pos: pos, Size: s.Size, Off: s.Off, Len: s.Len})
+				}
+				pos += s.Len
+			}
+			if len(dc.Slices) > 0 {
+				c.Chunks = append(c.Chunks, dc)
+			}
+		}
+	case TypeDirectory:
+		var entries []*Entry
+		if st := m.en.doReaddir(ctx, inode, 0, &entries, -1); st != 0 {
+			return removed(st)
+		}
+		for _, e := range entries {
+			c.Entries = append(c.Entries, &DumpedDirent{escape(string(e.Name)), e.Inode, typeToString(e.Attr.Typ)})
+		}
+	case TypeSymlink:
+		_, target, err := m.en.doReadlink(ctx, inode, true)
+		if err != nil {
+			return removed(errno(err))
+		}
+		c.Symlink = escape(string(target))
+	}
+	var names []byte
+	if st := m.en.(Meta).ListXattr(ctx, inode, &names); st != 0 {
+		return removed(st)
+	}
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		var value []byte
+		if st := m.en.(Meta).GetXattr(ctx, inode, string(name), &value); st == 0 {
+			c.Xattrs = append(c.Xattrs, &DumpedXattr{string(name), escape(string(value))})
+		} else if st != ENOATTR {
+			return removed(st)
+		}
+	}
+	return c, nil
+}
+
+// LoadMetaWithChanges loads a full dump and the incremental ones after it into m, which should be empty.
+// The changes are applied to a temporary badger database in dir, which is dumped into m at last.
+func LoadMetaWithChanges(m Meta, full io.Reader, changes []io.Reader, dir string) error {
+	tmpDir, err := os.MkdirTemp(dir, "juicefs-load-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	conf := DefaultConf()
+	conf.NoBGJob = true
+	tm, err := newKVMeta("badger", tmpDir, conf)
+	if err != nil {
+		return fmt.Errorf("create temporary database: %s", err)
+	}
+	defer tm.Shutdown()
+	tmp := tm.(*kvMeta)
+	if err = tmp.LoadMeta(full); err != nil {
+		return fmt.Errorf("load full dump: %s", err)
+	}
+	var last int64
+	for i, r := range changes {
+		if last, err = tmp.applyChanges(r, last); err != nil {
+			return fmt.Errorf("apply incremental dump %d: %s", i+1, err)
+		}
+	}
+	if _, err = tmp.Load(false); err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(tmp.DumpMeta(pw, RootInode, true))
+	}()
+	err = m.LoadMeta(pr)
+	_ = pr.CloseWithError(err)
+	return err
+}
+
+// applyChanges applies an incremental dump, whose since should not be after the until of last one.
+func (m *kvMeta) applyChanges(r io.Reader, last int64) (int64, error) {
+	dec := json.NewDecoder(bufio.NewReaderSize(r, jsonWriteSize))
+	var dc DumpedChanges
+	if err := dec.Decode(&dc); err != nil {
+		return 0, fmt.Errorf("decode header: %s", err)
+	}
+	if last > 0 && dc.Since > last {
+		return 0, fmt.Errorf("changes between %s and %s are missing", time.UnixMilli(last), time.UnixMilli(dc.Since))
+	}
+	var n int
+	for dec.More() {
+		var c DumpedChange
+		if err := dec.Decode(&c); err != nil {
+			return 0, fmt.Errorf("decode change: %s", err)
+		}
+		if err := m.applyChange(&c); err != nil {
+			return 0, err
+		}
+		n++
+	}
+
+	setting, err := json.MarshalIndent(dc.Setting, "", "")
+	if err != nil {
+		return 0, err
+	}
+	err = m.txn(func(tx *kvTxn) error {
+		tx.set(m.fmtKey("setting"), setting)
+		tx.set(m.counterKey(usedSpace), packCounter(dc.Counters.UsedSpace))
+		tx.set(m.counterKey(totalInodes), packCounter(dc.Counters.UsedInodes))
+		tx.set(m.counterKey("nextInode"), packCounter(dc.Counters.NextInode))
+		tx.set(m.counterKey("nextChunk"), packCounter(dc.Counters.NextChunk))
+		tx.set(m.counterKey("nextSession"), packCounter(dc.Counters.NextSession))
+		tx.set(m.counterKey("nextTrash"), packCounter(dc.Counters.NextTrash))
+		tx.deleteKeys(m.fmtKey("QD"))
+		for inode, q := range dc.Quotas {
+			tx.set(m.dirQuotaKey(inode), m.packQuota(&Quota{MaxSpace: q.MaxSpace, MaxInodes: q.MaxInodes}))
+		}
+		return nil
+	})
+	if err == nil {
+		logger.Infof("Applied %d changed inodes until %s", n, time.UnixMilli(dc.Until).Format(time.RFC3339))
+	}
+	return dc.Until, err
+}
+
+func (m *kvMeta) applyChange(c *DumpedChange) error {
+	inode := c.Inode
+	return m.txn(func(tx *kvTxn) error {
+		if c.Removed {
+			tx.deleteKeys(m.fmtKey("A", inode))
+			return nil
+		}
+		var attr Attr
+		if a := tx.get(m.inodeKey(inode)); a != nil {
+			m.parseAttr(a, &attr) // keep parent
+		}
+		parent := attr.Parent
+		attr = *loadAttr(c.Attr)
+		attr.Parent = parent
+		switch attr.Typ {
+		case TypeFile:
+			attr.Length = c.Attr.Length
+			tx.deleteKeys(m.fmtKey("A", inode, "C"))
+			for _, dc := range c.Chunks {
+				slices := make([]byte, 0, sliceBytes*len(dc.Slices))
+				for _, s := range dc.Slices {
+					slices = append(slices, marshalSlice(s.Pos, s.Id, s.Size, s.Off, s.Len)...)
+				}
+				tx.set(m.chunkKey(inode, dc.Index), slices)
+			}
+		case TypeDirectory:
+			attr.Length = 4 << 10
+			tx.deleteKeys(m.fmtKey("A", inode, "D"))
+			tx.deleteKeys(m.fmtKey("A", inode, "F"))
+			for _, e := range c.Entries {
+				m.setEntry(tx, inode, string(unescape(e.Name)), m.packEntry(typeFromString(e.Type), e.Inode))
+			}
+			tx.delete(m.dirStatKey(inode))
+		case TypeSymlink:
+			target := unescape(c.Symlink)
+			attr.Length = uint64(len(target))
+			tx.set(m.symKey(inode), target)
+		}
+		tx.deleteKeys(m.fmtKey("A", inode, "X"))
+		for _, x := range c.Xattrs {
+			tx.set(m.xattrKey(inode, x.Name), unescape(x.Value))
+		}
+		tx.set(m.inodeKey(inode), m.marshal(&attr))
+		return nil
+	}, inode)
+}
@@ -25,6 +25,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/version"
@@ -46,6 +47,9 @@ type Config struct {
 	Subdir             string
 	AtimeMode          string
 	DirStatFlushPeriod time.Duration
+	CacheInvalidation  bool          // publish the changed inodes to invalidate the caches of other clients
+	SlowTxn            time.Duration // log the transactions slower than it (0 means disabled)
+	Namespace          string        // the namespace in a shared meta engine, set from META-URL
 }
 
 func DefaultConf() *Config {
@@ -75,25 +79,84 @@ type Format struct {
 	AccessKey        string `json:",omitempty"`
 	SecretKey        string `json:",omitempty"`
 	SessionToken     string `json:",omitempty"`
+	MirrorStorage    string `json:",omitempty"`
+	MirrorBucket     string `json:",omitempty"`
+	MirrorAccessKey  string `json:",omitempty"`
+	MirrorSecretKey  string `json:",omitempty"`
+	MirrorAsync      bool   `json:",omitempty"`
+	FallbackBuckets  string `json:",omitempty"` // replicas to read from, separated by comma
+	ReplicaRead      string `json:",omitempty"` // how to read from the primary and replicas: primary, fastest or balance
 	BlockSize        int
 	Compression      string `json:",omitempty"`
+	CompressLevel    int    `json:",omitempty"`
+	CompressDict     string `json:",omitempty"` // key of the zstd dictionary in object storage
+	InlineSize       int    `json:",omitempty"` // blocks not larger than it are kept in meta engine
+	Inlined          bool   `json:",omitempty"` // some blocks may be kept in meta engine (InlineSize was set)
+	Dedupe           bool   `json:",omitempty"` // share the blocks with identical content
+	PackSize         int    `json:",omitempty"` // blocks not larger than it are packed into larger objects
+	Packed           bool   `json:",omitempty"` // some blocks may be packed (PackSize was set)
 	Shards           int    `json:",omitempty"`
 	HashPrefix       bool   `json:",omitempty"`
 	Capacity         uint64 `json:",omitempty"`
 	Inodes           uint64 `json:",omitempty"`
 	EncryptKey       string `json:",omitempty"`
 	EncryptAlgo      string `json:",omitempty"`
+	EncryptMasterKey string `json:",omitempty"`
 	KeyEncrypted     bool   `json:",omitempty"`
 	UploadLimit      int64  `json:",omitempty"` // Mbps
 	DownloadLimit    int64  `json:",omitempty"` // Mbps
+	VerifyChecksum   bool   `json:",omitempty"`
 	TrashDays        int
-	MetaVersion      int    `json:",omitempty"`
-	MinClientVersion string `json:",omitempty"`
-	MaxClientVersion string `json:",omitempty"`
-	DirStats         bool   `json:",omitempty"`
+	MetaVersion      int                     `json:",omitempty"`
+	MinClientVersion string                  `json:",omitempty"`
+	MaxClientVersion string                  `json:",omitempty"`
+	DirStats         bool                    `json:",omitempty"`
+	MigratedTo       string                  `json:",omitempty"` // the metadata engine that this volume is migrated to
+	Changelog        bool                    `json:",omitempty"` // log the changed inodes for incremental backup
+	CaseInsensitive  bool                    `json:",omitempty"` // look up names case-insensitively (and preserve the case)
+	EnableACL        bool                    `json:",omitempty"` // support POSIX ACL, which can not be disabled later
+	TrashPolicies    map[Ino]int             `json:",omitempty"` // trash days of directories, which override TrashDays for their subtrees
+	ClientLimits     map[string]*ClientLimit `json:",omitempty"` // limits of clients by session ID, hostname or "*" for all
+}
+
+// ClientLimit is the limits of a client, which are fetched at heartbeat and enforced by the client itself.
+type ClientLimit struct {
+	MetaOps       int64 `json:",omitempty"` // metadata operations per second
+	UploadLimit   int64 `json:",omitempty"` // Mbps
+	DownloadLimit int64 `json:",omitempty"` // Mbps
+}
+
+// ClientLimit returns the limit of the client with the session ID on host, matched in the order of
+// session ID, hostname and "*", or nil if there is none.
+func (f *Format) ClientLimit(sid uint64, host string) *ClientLimit {
+	if len(f.ClientLimits) == 0 {
+		return nil
+	}
+	for _, key := range []string{strconv.FormatUint(sid, 10), host, "*"} {
+		if l, ok := f.ClientLimits[key]; ok && key != "" && key != "0" {
+			return l
+		}
+	}
+	return nil
+}
+
+// trashEnabled returns true if any removed file could be moved into trash.
+func (f *Format) trashEnabled() bool {
+	if f.TrashDays > 0 {
+		return true
+	}
+	for _, days := range f.TrashPolicies {
+		if days > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 func (f *Format) update(old *Format, force bool) error {
+	// the inlined or packed blocks are still there after InlineSize or PackSize is disabled
+	f.Inlined = f.Inlined || f.InlineSize > 0 || old.Inlined || old.InlineSize > 0
+	f.Packed = f.Packed || f.PackSize > 0 || old.Packed || old.PackSize > 0
 	if force {
 		logger.Warnf("Existing volume will be overwrited: %s", old)
 	} else {
@@ -105,12 +168,20 @@ func (f *Format) update(old *Format, force bool) error {
 			args = []interface{}{"block size", old.BlockSize, f.BlockSize}
 		case f.Compression != old.Compression:
 			args = []interface{}{"compression", old.Compression, f.Compression}
+		case f.CompressDict != old.CompressDict:
+			args = []interface{}{"compression dictionary", old.CompressDict, f.CompressDict}
 		case f.Shards != old.Shards:
 			args = []interface{}{"shards", old.Shards, f.Shards}
 		case f.HashPrefix != old.HashPrefix:
 			args = []interface{}{"hash prefix", old.HashPrefix, f.HashPrefix}
 		case f.MetaVersion != old.MetaVersion:
 			args = []interface{}{"meta version", old.MetaVersion, f.MetaVersion}
+		case f.CaseInsensitive != old.CaseInsensitive:
+			args = []interface{}{"case insensitive", old.CaseInsensitive, f.CaseInsensitive}
+		case old.EnableACL && !f.EnableACL:
+			args = []interface{}{"enable ACL", old.EnableACL, f.EnableACL}
+		case old.Dedupe && !f.Dedupe:
+			args = []interface{}{"dedupe", old.Dedupe, f.Dedupe}
 		}
 		if args == nil {
 			f.UUID = old.UUID
@@ -128,6 +199,9 @@ func (f *Format) RemoveSecret() {
 	if f.SessionToken != "" {
 		f.SessionToken = "removed"
 	}
+	if f.MirrorSecretKey != "" {
+		f.MirrorSecretKey = "removed"
+	}
 	if f.EncryptKey != "" {
 		f.EncryptKey = "removed"
 	}
@@ -167,7 +241,7 @@ func (f *Format) CheckVersion() error {
 }
 
 func (f *Format) Encrypt() error {
-	if f.KeyEncrypted || f.SecretKey == "" && f.EncryptKey == "" && f.SessionToken == "" {
+	if f.KeyEncrypted || f.SecretKey == "" && f.EncryptKey == "" && f.SessionToken == "" && f.MirrorSecretKey == "" {
 		return nil
 	}
 	key := md5.Sum([]byte(f.UUID))
@@ -196,6 +270,7 @@ func (f *Format) Encrypt() error {
 
 	encrypt(&f.SecretKey)
 	encrypt(&f.SessionToken)
+	encrypt(&f.MirrorSecretKey)
 	encrypt(&f.EncryptKey)
 	f.KeyEncrypted = true
 	return nil
@@ -238,6 +313,7 @@ func (f *Format) Decrypt() error {
 	decrypt(&f.EncryptKey)
 	decrypt(&f.SecretKey)
 	decrypt(&f.SessionToken)
+	decrypt(&f.MirrorSecretKey)
 	f.KeyEncrypted = false
 	return err
 }
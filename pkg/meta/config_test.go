@@ -52,3 +52,45 @@ func TestEncrypt(t *testing.T) {
 		t.Fatalf("invalid format: %+v", format)
 	}
 }
+
+func TestClientLimit(t *testing.T) {
+	format := Format{Name: "test"}
+	if l := format.ClientLimit(3, "host1"); l != nil {
+		t.Fatalf("limit without any: %+v", l)
+	}
+	format.ClientLimits = map[string]*ClientLimit{
+		"3":     {MetaOps: 100},
+		"host1": {UploadLimit: 10},
+		"*":     {DownloadLimit: 20},
+	}
+	if l := format.ClientLimit(3, "host1"); l == nil || l.MetaOps != 100 {
+		t.Fatalf("limit of session 3: %+v", l)
+	}
+	if l := format.ClientLimit(4, "host1"); l == nil || l.UploadLimit != 10 {
+		t.Fatalf("limit of host1: %+v", l)
+	}
+	if l := format.ClientLimit(0, "host2"); l == nil || l.DownloadLimit != 20 {
+		t.Fatalf("limit of others: %+v", l)
+	}
+}
+
+func TestFormatUpdate(t *testing.T) {
+	old := &Format{Name: "test", UUID: "uuid", InlineSize: 4 << 10, PackSize: 64 << 10}
+	f := &Format{Name: "test"}
+	if err := f.update(old, false); err != nil {
+		t.Fatalf("disable inline size and pack size: %s", err)
+	}
+	if f.UUID != "uuid" || !f.Inlined || !f.Packed {
+		t.Fatalf("inlined and packed blocks should be kept: %+v", f)
+	}
+	old, f = f, &Format{Name: "test"}
+	if err := f.update(old, false); err != nil || !f.Inlined || !f.Packed {
+		t.Fatalf("inlined and packed should be kept: %s %+v", err, f)
+	}
+	if err := (&Format{Name: "test"}).update(&Format{Name: "test", Dedupe: true}, false); err == nil {
+		t.Fatalf("dedupe should not be disabled")
+	}
+	if err := (&Format{Name: "other"}).update(old, false); err == nil {
+		t.Fatalf("name should not be changed")
+	}
+}
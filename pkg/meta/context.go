@@ -87,6 +87,11 @@ func NewContext(pid, uid uint32, gids []uint32) Context {
 	return wrap(context.Background(), pid, uid, gids)
 }
 
+// NewContextFrom returns a Context of the user, which is canceled together with the parent.
+func NewContextFrom(parent context.Context, pid, uid uint32, gids []uint32) Context {
+	return wrap(parent, pid, uid, gids)
+}
+
 func WrapContext(ctx context.Context) Context {
 	return wrap(ctx, 0, 0, []uint32{0})
 }
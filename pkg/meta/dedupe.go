@@ -0,0 +1,77 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"time"
+)
+
+// RefBlock records the hash of a block and increases the refcount of its content. The refcount
+// after it is returned, so the caller should upload the content when it's 1. It's idempotent
+// for the same block. -1 is returned without recording anything if the content is being deleted,
+// the caller should retry after it's dropped.
+func (m *baseMeta) RefBlock(key, hash string) (int64, error) {
+	defer m.timeit("RefBlock", time.Now())
+	return m.en.doRefBlock(key, hash)
+}
+
+// UnrefBlock removes the hash of a block and decreases the refcount of its content. The hash and
+// remaining refcount are returned. When it's 0, the content is marked as deleting (so it can't be
+// referenced again), and the caller should delete the content and then call DropContent.
+// os.ErrNotExist is returned if the block is not deduplicated.
+func (m *baseMeta) UnrefBlock(key string) (string, int64, error) {
+	defer m.timeit("UnrefBlock", time.Now())
+	return m.en.doUnrefBlock(key)
+}
+
+// DropContent removes the refcount of a content if it's still marked as deleting.
+func (m *baseMeta) DropContent(hash string) error {
+	defer m.timeit("DropContent", time.Now())
+	return m.en.doDropContent(hash)
+}
+
+// GetBlockHash returns the hash of a deduplicated block, os.ErrNotExist is returned if not found.
+func (m *baseMeta) GetBlockHash(key string) (string, error) {
+	defer m.timeit("GetBlockHash", time.Now())
+	return m.en.doGetBlockHash(key)
+}
+
+func (m *baseMeta) dumpBlockHashes() (map[string]string, error) {
+	hashes := make(map[string]string)
+	err := m.en.doScanBlockHash(func(key, hash string) error {
+		hashes[key] = hash
+		return nil
+	})
+	if len(hashes) == 0 {
+		hashes = nil
+	}
+	return hashes, err
+}
+
+// countBlockRefs rebuilds the refcount of contents from the dumped hashes of blocks.
+func countBlockRefs(hashes map[string]string) map[string]int64 {
+	refs := make(map[string]int64)
+	for _, h := range hashes {
+		refs[h]++
+	}
+	return refs
+}
+
+func errHashMismatch(key, old, hash string) error {
+	return fmt.Errorf("block %s was deduplicated as %s, not %s", key, old, hash)
+}
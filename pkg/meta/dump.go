@@ -66,6 +66,8 @@ type DumpedAttr struct {
 	Atimensec uint32 `json:"atimensec,omitempty"`
 	Mtimensec uint32 `json:"mtimensec,omitempty"`
 	Ctimensec uint32 `json:"ctimensec,omitempty"`
+	Btime     int64  `json:"btime,omitempty"`
+	Btimensec uint32 `json:"btimensec,omitempty"`
 	Nlink     uint32 `json:"nlink"`
 	Length    uint64 `json:"length"`
 	Rdev      uint32 `json:"rdev,omitempty"`
@@ -253,6 +255,9 @@ type DumpedMeta struct {
 	Sustained []*DumpedSustained
 	DelFiles  []*DumpedDelFile
 	Quotas    map[Ino]*DumpedQuota `json:",omitempty"`
+	Inline    map[string][]byte    `json:",omitempty"` // small blocks kept in meta engine
+	Dedupe    map[string]string    `json:",omitempty"` // hash of deduplicated blocks
+	Packed    map[string]string    `json:",omitempty"` // location of packed blocks
 	FSTree    *DumpedEntry         `json:",omitempty"`
 	Trash     *DumpedEntry         `json:",omitempty"`
 }
@@ -294,6 +299,8 @@ func dumpAttr(a *Attr, d *DumpedAttr) {
 	d.Atimensec = a.Atimensec
 	d.Mtimensec = a.Mtimensec
 	d.Ctimensec = a.Ctimensec
+	d.Btime = a.Btime
+	d.Btimensec = a.Btimensec
 	d.Nlink = a.Nlink
 	d.Rdev = a.Rdev
 	if a.Typ == TypeFile {
@@ -316,6 +323,8 @@ func loadAttr(d *DumpedAttr) *Attr {
 		Atimensec: d.Atimensec,
 		Mtimensec: d.Mtimensec,
 		Ctimensec: d.Ctimensec,
+		Btime:     d.Btime,
+		Btimensec: d.Btimensec,
 		Nlink:     d.Nlink,
 		Rdev:      d.Rdev,
 		Full:      true,
@@ -327,15 +336,29 @@ type chunkKey struct {
 	size uint32
 }
 
-func loadEntries(r io.Reader, load func(*DumpedEntry), addChunk func(*chunkKey)) (dm *DumpedMeta,
+func (m *baseMeta) loadEntries(r io.Reader, load func(*DumpedEntry), addChunk func(*chunkKey)) (dm *DumpedMeta,
 	counters *DumpedCounters, parents map[Ino][]Ino, refs map[chunkKey]int64, err error) {
 	logger.Infoln("Loading from file ...")
+	header := func(dm *DumpedMeta) error {
+		m.fmt = &dm.Setting // the entries are loaded according to it
+		return nil
+	}
+	br := bufio.NewReaderSize(r, jsonWriteSize)
+	if isBinaryDump(br) {
+		return decodeBinaryDump(br, header, load, addChunk, false)
+	}
+	return decodeJSONDump(br, header, load, addChunk, false)
+}
+
+// decodeJSONDump decodes a dumped JSON file, header is called before decoding the tree.
+func decodeJSONDump(r io.Reader, header func(*DumpedMeta) error, load func(*DumpedEntry), addChunk func(*chunkKey), quiet bool) (dm *DumpedMeta,
+	counters *DumpedCounters, parents map[Ino][]Ino, refs map[chunkKey]int64, err error) {
 	dec := json.NewDecoder(r)
 	if _, err = dec.Token(); err != nil {
 		return
 	}
 
-	progress := utils.NewProgress(false)
+	progress := utils.NewProgress(quiet)
 	bar := progress.AddCountBar("Loaded entries", 1) // with root
 	dm = &DumpedMeta{}
 	counters = &DumpedCounters{ // rebuild counters
@@ -345,12 +368,19 @@ func loadEntries(r io.Reader, load func(*DumpedEntry), addChunk func(*chunkKey))
 	parents = make(map[Ino][]Ino)
 	refs = make(map[chunkKey]int64)
 	var name json.Token
+	var treeStarted bool
 	for dec.More() {
 		name, err = dec.Token()
 		if err != nil {
 			err = fmt.Errorf("parse name: %s", err)
 			return
 		}
+		if (name == "FSTree" || name == "Trash") && !treeStarted {
+			treeStarted = true
+			if err = header(dm); err != nil {
+				return
+			}
+		}
 		switch name {
 		case "Setting":
 			if err = dec.Decode(&dm.Setting); err == nil {
@@ -366,6 +396,12 @@ func loadEntries(r io.Reader, load func(*DumpedEntry), addChunk func(*chunkKey))
 			err = dec.Decode(&dm.DelFiles)
 		case "Quotas":
 			err = dec.Decode(&dm.Quotas)
+		case "Inline":
+			err = dec.Decode(&dm.Inline)
+		case "Dedupe":
+			err = dec.Decode(&dm.Dedupe)
+		case "Packed":
+			err = dec.Decode(&dm.Packed)
 		case "FSTree":
 			_, err = decodeEntry(dec, 0, counters, parents, dm.Quotas, refs, bar, load, addChunk)
 		case "Trash":
@@ -378,6 +414,10 @@ func loadEntries(r io.Reader, load func(*DumpedEntry), addChunk func(*chunkKey))
 	}
 	_, _ = dec.Token() // }
 	progress.Done()
+	if dm.Counters == nil {
+		err = fmt.Errorf("no counters found")
+		return
+	}
 	logger.Infof("Dumped counters: %+v", *dm.Counters)
 	logger.Infof("Loaded counters: %+v", *counters)
 	return
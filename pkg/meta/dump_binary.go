@@ -0,0 +1,425 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/goccy/go-json"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// The binary dump is a stream of segments after the magic, each of them is
+//
+//	type (1 byte) | size of payload (4 bytes) | crc32 of payload (4 bytes) | payload
+//
+// The first segment is the header (DumpedMeta without the tree in JSON), followed by the entries
+// in batches, and the index of all the segments at last. The file ends with the offset of the index
+// (8 bytes), so the index can be found without scanning the whole file.
+//
+// The entries are in the same order as they are loaded from a JSON dump, so the children of a
+// directory come before itself, and the names and values are escaped in the same way.
+const (
+	binaryMagic     = "JFSDUMP\x01"
+	segHeaderSize   = 9
+	binaryBatchSize = 4 << 20
+
+	segHeader  = 1
+	segEntries = 2
+	segIndex   = 3
+)
+
+func isBinaryDump(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(binaryMagic))
+	return string(magic) == binaryMagic
+}
+
+type dumpSegment struct {
+	typ     uint8
+	offset  uint64
+	entries uint32
+}
+
+type binaryWriter struct {
+	w      *bufio.Writer
+	offset uint64
+	index  []dumpSegment
+	batch  []byte
+	count  uint32
+}
+
+func newBinaryWriter(w io.Writer) (*binaryWriter, error) {
+	bw := &binaryWriter{w: bufio.NewWriterSize(w, jsonWriteSize)}
+	if _, err := bw.w.WriteString(binaryMagic); err != nil {
+		return nil, err
+	}
+	bw.offset = uint64(len(binaryMagic))
+	return bw, nil
+}
+
+func (bw *binaryWriter) writeSegment(typ uint8, payload []byte, entries uint32) error {
+	hdr := utils.NewBuffer(segHeaderSize)
+	hdr.Put8(typ)
+	hdr.Put32(uint32(len(payload)))
+	hdr.Put32(crc32.ChecksumIEEE(payload))
+	if _, err := bw.w.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(payload); err != nil {
+		return err
+	}
+	bw.index = append(bw.index, dumpSegment{typ, bw.offset, entries})
+	bw.offset += segHeaderSize + uint64(len(payload))
+	return nil
+}
+
+func (bw *binaryWriter) writeHeader(dm *DumpedMeta) error {
+	data, err := json.Marshal(dm)
+	if err != nil {
+		return err
+	}
+	return bw.writeSegment(segHeader, data, 0)
+}
+
+func (bw *binaryWriter) writeEntry(e *DumpedEntry) error {
+	bw.batch = append(bw.batch, encodeDumpedEntry(e)...)
+	bw.count++
+	if len(bw.batch) >= binaryBatchSize {
+		return bw.flushEntries()
+	}
+	return nil
+}
+
+func (bw *binaryWriter) flushEntries() error {
+	if bw.count == 0 {
+		return nil
+	}
+	err := bw.writeSegment(segEntries, bw.batch, bw.count)
+	bw.batch, bw.count = bw.batch[:0], 0
+	return err
+}
+
+func (bw *binaryWriter) finish() error {
+	if err := bw.flushEntries(); err != nil {
+		return err
+	}
+	offset := bw.offset
+	idx := utils.NewBuffer(uint32(4 + 13*len(bw.index)))
+	idx.Put32(uint32(len(bw.index)))
+	for _, s := range bw.index {
+		idx.Put8(s.typ)
+		idx.Put64(s.offset)
+		idx.Put32(s.entries)
+	}
+	if err := bw.writeSegment(segIndex, idx.Bytes(), 0); err != nil {
+		return err
+	}
+	tail := utils.NewBuffer(8)
+	tail.Put64(offset)
+	if _, err := bw.w.Write(tail.Bytes()); err != nil {
+		return err
+	}
+	return bw.w.Flush()
+}
+
+func encodeDumpedEntry(e *DumpedEntry) []byte {
+	size := 76 + 4 + len(e.Symlink) + 2 + 4 + 4
+	for _, x := range e.Xattrs {
+		size += 6 + len(x.Name) + len(x.Value)
+	}
+	for _, c := range e.Chunks {
+		size += 8 + 24*len(c.Slices)
+	}
+	for name := range e.Entries {
+		size += 19 + len(name)
+	}
+	b := utils.NewBuffer(uint32(size))
+	a := e.Attr
+	b.Put64(uint64(a.Inode))
+	b.Put64(uint64(e.Parents[0]))
+	b.Put8(a.Flags)
+	b.Put8(typeFromString(a.Type))
+	b.Put16(a.Mode)
+	b.Put32(a.Uid)
+	b.Put32(a.Gid)
+	b.Put64(uint64(a.Atime))
+	b.Put64(uint64(a.Mtime))
+	b.Put64(uint64(a.Ctime))
+	b.Put32(a.Atimensec)
+	b.Put32(a.Mtimensec)
+	b.Put32(a.Ctimensec)
+	b.Put64(a.Length)
+	b.Put32(a.Rdev)
+	b.Put32(uint32(len(e.Symlink)))
+	b.Put([]byte(e.Symlink))
+	b.Put16(uint16(len(e.Xattrs)))
+	for _, x := range e.Xattrs {
+		b.Put16(uint16(len(x.Name)))
+		b.Put([]byte(x.Name))
+		b.Put32(uint32(len(x.Value)))
+		b.Put([]byte(x.Value))
+	}
+	b.Put32(uint32(len(e.Chunks)))
+	for _, c := range e.Chunks {
+		b.Put32(c.Index)
+		b.Put32(uint32(len(c.Slices)))
+		for _, s := range c.Slices {
+			id := s.Id
+			if id == 0 {
+				id = s.Chunkid
+			}
+			b.Put64(id)
+			b.Put32(s.Pos)
+			b.Put32(s.Size)
+			b.Put32(s.Off)
+			b.Put32(s.Len)
+		}
+	}
+	b.Put32(uint32(len(e.Entries)))
+	for name, c := range e.Entries {
+		b.Put16(uint16(len(name)))
+		b.Put([]byte(name))
+		b.Put64(uint64(c.Attr.Inode))
+		b.Put8(typeFromString(c.Attr.Type))
+		b.Put64(c.Attr.Length)
+	}
+	return b.Bytes()
+}
+
+func decodeDumpedEntry(b *utils.Buffer) *DumpedEntry {
+	a := &DumpedAttr{Inode: Ino(b.Get64())}
+	e := &DumpedEntry{Attr: a, Parents: []Ino{Ino(b.Get64())}}
+	a.Flags = b.Get8()
+	a.Type = typeToString(b.Get8())
+	a.Mode = b.Get16()
+	a.Uid = b.Get32()
+	a.Gid = b.Get32()
+	a.Atime = int64(b.Get64())
+	a.Mtime = int64(b.Get64())
+	a.Ctime = int64(b.Get64())
+	a.Atimensec = b.Get32()
+	a.Mtimensec = b.Get32()
+	a.Ctimensec = b.Get32()
+	a.Length = b.Get64()
+	a.Rdev = b.Get32()
+	e.Symlink = string(b.Get(int(b.Get32())))
+	if n := int(b.Get16()); n > 0 {
+		e.Xattrs = make([]*DumpedXattr, n)
+		for i := range e.Xattrs {
+			name := string(b.Get(int(b.Get16())))
+			e.Xattrs[i] = &DumpedXattr{name, string(b.Get(int(b.Get32())))}
+		}
+	}
+	if n := int(b.Get32()); n > 0 {
+		e.Chunks = make([]*DumpedChunk, n)
+		for i := range e.Chunks {
+			c := &DumpedChunk{Index: b.Get32()}
+			c.Slices = make([]*DumpedSlice, b.Get32())
+			for j := range c.Slices {
+				c.Slices[j] = &DumpedSlice{Id: b.Get64(), Pos: b.Get32(), Size: b.Get32(), Off: b.Get32(), Len: b.Get32()}
+			}
+			e.Chunks[i] = c
+		}
+	}
+	if n := int(b.Get32()); n > 0 || a.Type == typeToString(TypeDirectory) {
+		e.Entries = make(map[string]*DumpedEntry, n)
+		for i := 0; i < n; i++ {
+			name := string(b.Get(int(b.Get16())))
+			c := &DumpedAttr{Inode: Ino(b.Get64()), Type: typeToString(b.Get8()), Length: b.Get64()}
+			e.Entries[name] = &DumpedEntry{Attr: c}
+		}
+	}
+	return e
+}
+
+func readSegment(r io.Reader, hdr *utils.Buffer) (uint8, []byte, error) {
+	hdr.Seek(0)
+	if _, err := io.ReadFull(r, hdr.Bytes()); err != nil {
+		return 0, nil, err
+	}
+	typ, size, sum := hdr.Get8(), hdr.Get32(), hdr.Get32()
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return 0, nil, fmt.Errorf("checksum mismatch of segment %d", typ)
+	}
+	return typ, payload, nil
+}
+
+// decodeBinaryDump decodes a binary dump, and returns the same results as decodeJSONDump.
+func decodeBinaryDump(r io.Reader, header func(*DumpedMeta) error, load func(*DumpedEntry), addChunk func(*chunkKey), quiet bool) (dm *DumpedMeta,
+	counters *DumpedCounters, parents map[Ino][]Ino, refs map[chunkKey]int64, err error) {
+	if _, err = io.ReadFull(r, make([]byte, len(binaryMagic))); err != nil {
+		return
+	}
+	progress := utils.NewProgress(quiet)
+	bar := progress.AddCountBar("Loaded entries", 1)
+	counters = &DumpedCounters{NextInode: 2, NextChunk: 1}
+	parents = make(map[Ino][]Ino)
+	refs = make(map[chunkKey]int64)
+	usage := make(map[Ino][2]int64) // usage of directories for quotas
+	hdr := utils.NewBuffer(segHeaderSize)
+	for {
+		typ, payload, e := readSegment(r, hdr)
+		if e != nil {
+			err = fmt.Errorf("read segment: %s", e)
+			break
+		}
+		switch typ {
+		case segHeader:
+			dm = &DumpedMeta{}
+			if err = json.Unmarshal(payload, dm); err == nil && dm.Counters == nil {
+				err = fmt.Errorf("no counters found")
+			}
+			if err == nil {
+				bar.SetTotal(dm.Counters.UsedInodes)
+				err = header(dm)
+			}
+		case segEntries:
+			if dm == nil {
+				err = fmt.Errorf("entries before header")
+				break
+			}
+			err = decodeBinaryEntries(utils.ReadBuffer(payload), func(e *DumpedEntry) {
+				loadBinaryEntry(e, counters, parents, refs, addChunk)
+				if len(dm.Quotas) > 0 && e.Entries != nil {
+					var u [2]int64
+					for _, c := range e.Entries {
+						u[0] += align4K(c.Attr.Length)
+						u[1]++
+					}
+					usage[e.Attr.Inode] = u
+				}
+				load(e)
+				bar.Increment()
+			})
+		case segIndex:
+			if dm == nil {
+				err = fmt.Errorf("no header found")
+			}
+		default:
+			err = fmt.Errorf("unknown segment %d", typ)
+		}
+		if err != nil || typ == segIndex {
+			break
+		}
+	}
+	progress.Done()
+	if err != nil {
+		return
+	}
+	for inode, u := range usage {
+		for i := inode; ; i = parents[i][0] {
+			if q := dm.Quotas[i]; q != nil {
+				q.UsedSpace += u[0]
+				q.UsedInodes += u[1]
+			}
+			if i <= 1 || len(parents[i]) == 0 {
+				break
+			}
+		}
+	}
+	logger.Infof("Dumped counters: %+v", *dm.Counters)
+	logger.Infof("Loaded counters: %+v", *counters)
+	return
+}
+
+func decodeBinaryEntries(b *utils.Buffer, load func(*DumpedEntry)) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("corrupted entry: %v", p)
+		}
+	}()
+	for b.HasMore() {
+		load(decodeDumpedEntry(b))
+	}
+	return nil
+}
+
+// loadBinaryEntry updates the counters, parents and references of slices as decodeEntry does.
+func loadBinaryEntry(e *DumpedEntry, cs *DumpedCounters, parents map[Ino][]Ino, refs map[chunkKey]int64, addChunk func(*chunkKey)) {
+	inode := e.Attr.Inode
+	if inode == RootInode || inode == TrashInode {
+		parents[inode] = append(parents[inode], e.Parents[0])
+	}
+	if typeFromString(e.Attr.Type) == TypeDirectory {
+		e.Attr.Nlink = 2
+		for _, c := range e.Entries {
+			if typeFromString(c.Attr.Type) == TypeDirectory {
+				e.Attr.Nlink++
+			}
+			parents[c.Attr.Inode] = append(parents[c.Attr.Inode], inode)
+		}
+	} else {
+		e.Attr.Nlink = 1
+	}
+	if inode > 1 && inode != TrashInode {
+		cs.UsedSpace += align4K(e.Attr.Length)
+		cs.UsedInodes += 1
+	}
+	if inode < TrashInode {
+		if cs.NextInode <= int64(inode) {
+			cs.NextInode = int64(inode) + 1
+		}
+	} else if cs.NextTrash < int64(inode-TrashInode) {
+		cs.NextTrash = int64(inode - TrashInode)
+	}
+	for _, c := range e.Chunks {
+		for _, s := range c.Slices {
+			ck := chunkKey{s.Id, s.Size}
+			refs[ck]++
+			if addChunk != nil && refs[ck] == 1 {
+				addChunk(&ck)
+			}
+			if cs.NextChunk <= int64(s.Id) {
+				cs.NextChunk = int64(s.Id) + 1
+			}
+		}
+	}
+}
+
+// DumpMetaBinary dumps the metadata in the binary format, which is converted from the JSON one on the fly.
+func DumpMetaBinary(m Meta, w io.Writer, root Ino, keepSecret bool) error {
+	bw, err := newBinaryWriter(w)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(m.DumpMeta(pw, root, keepSecret))
+	}()
+	var werr error
+	_, _, _, _, err = decodeJSONDump(pr, bw.writeHeader, func(e *DumpedEntry) {
+		if werr == nil {
+			werr = bw.writeEntry(e)
+		}
+	}, nil, true)
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		_ = pr.CloseWithError(err)
+		return err
+	}
+	_, _ = io.Copy(io.Discard, pr)
+	return bw.finish()
+}
@@ -0,0 +1,58 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxInlineSize is the max size of blocks which can be kept in meta engine.
+const MaxInlineSize = 32 << 10
+
+// GetInline returns the data of a small block kept in meta engine, os.ErrNotExist is returned if not found.
+func (m *baseMeta) GetInline(key string) ([]byte, error) {
+	defer m.timeit("GetInline", time.Now())
+	return m.en.doGetInline(key)
+}
+
+// SetInline keeps the data of a small block in meta engine instead of object storage.
+func (m *baseMeta) SetInline(key string, data []byte) error {
+	if len(data) > MaxInlineSize+1024 { // compressed data could be slightly larger
+		return fmt.Errorf("block %s is too large to be inlined: %d", key, len(data))
+	}
+	defer m.timeit("SetInline", time.Now())
+	return m.en.doSetInline(key, data)
+}
+
+// DeleteInline removes a small block from meta engine, os.ErrNotExist is returned if not found.
+func (m *baseMeta) DeleteInline(key string) error {
+	defer m.timeit("DeleteInline", time.Now())
+	return m.en.doDeleteInline(key)
+}
+
+func (m *baseMeta) dumpInline() (map[string][]byte, error) {
+	blocks := make(map[string][]byte)
+	err := m.en.doScanInline(func(key string, data []byte) error {
+		blocks[key] = data
+		return nil
+	})
+	if len(blocks) == 0 {
+		blocks = nil
+	}
+	return blocks, err
+}
@@ -38,7 +38,7 @@ const (
 	ChunkSize = 1 << 26 // 64M
 	// DeleteSlice is a message to delete a slice from object store.
 	DeleteSlice = 1000
-	// CompactChunk is a message to compact a chunk in object store.
+	// CompactChunk is a message to compact a chunk in object store, args: slices, id of new slice and inode.
 	CompactChunk = 1001
 	// Rmr is a message to remove a directory recursively.
 	Rmr = 1002
@@ -52,6 +52,14 @@ const (
 	Clone = 1006
 	// OpSummary is a message to get tree summary of directories.
 	OpSummary = 1007
+	// OpWatch is a message to watch the changes of a directory.
+	OpWatch = 1008
+	// InvalidateInodes is a message to invalidate the cached inodes which are changed by other clients.
+	InvalidateInodes = 1009
+	// UpdateCache is a message to change the cache dirs and size of a mount point.
+	UpdateCache = 1010
+	// FlushWrites is a message to flush the buffered writes, before the client is frozen for migration of metadata.
+	FlushWrites = 1011
 )
 
 const (
@@ -87,6 +95,7 @@ const (
 const (
 	FlagImmutable = 1 << iota
 	FlagAppend
+	FlagSnapshot // the entry of a snapshot, which can't be changed
 )
 
 const (
@@ -132,12 +141,17 @@ type Attr struct {
 	Atimensec uint32 // nanosecond part of atime
 	Mtimensec uint32 // nanosecond part of mtime
 	Ctimensec uint32 // nanosecond part of ctime
+	Btime     int64  // birth time; 0 means unknown
+	Btimensec uint32 // nanosecond part of btime
 	Nlink     uint32 // number of links (sub-directories or hardlinks)
 	Length    uint64 // length of regular file
 
-	Parent    Ino  // inode of parent; 0 means tracked by parentKey (for hardlinks)
-	Full      bool // the attributes are completed or not
-	KeepCache bool // whether to keep the cached page or not
+	Parent     Ino    // inode of parent; 0 means tracked by parentKey (for hardlinks)
+	AccessACL  uint32 // id of access ACL; 0 means no ACL
+	DefaultACL uint32 // id of default ACL for directory; 0 means no ACL
+	Full       bool   // the attributes are completed or not
+	KeepCache  bool   // whether to keep the cached page or not
+	DirectIO   bool   // whether to bypass the page cache of kernel or not
 }
 
 func typeToStatType(_type uint8) uint32 {
@@ -327,6 +341,8 @@ type Meta interface {
 	ListLocks(ctx context.Context, inode Ino) ([]PLockItem, []FLockItem, error)
 	// CleanStaleSessions cleans up sessions not active for more than 5 minutes
 	CleanStaleSessions()
+	// EvictSession revokes the lease of a session and cleans it up, the client can't make changes anymore.
+	EvictSession(ctx Context, sid uint64) error
 	// CleanupTrashBefore deletes all files in trash before the given time.
 	CleanupTrashBefore(ctx Context, edge time.Time, increProgress func(int))
 	// CleanupDetachedNodesBefore deletes all detached nodes before the given time.
@@ -338,6 +354,8 @@ type Meta interface {
 	Access(ctx Context, inode Ino, modemask uint8, attr *Attr) syscall.Errno
 	// Lookup returns the inode and attributes for the given entry in a directory.
 	Lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr, checkPerm bool) syscall.Errno
+	// ResolveCase returns the entry in a directory whose name is equal to the given one under case-folding, or nil.
+	ResolveCase(ctx Context, parent Ino, name string) *Entry
 	// Resolve fetches the inode and attributes for an entry identified by the given path.
 	// ENOTSUP will be returned if there's no natural implementation for this operation or
 	// if there are any symlink following involved.
@@ -373,8 +391,15 @@ type Meta interface {
 	Link(ctx Context, inodeSrc, parent Ino, name string, attr *Attr) syscall.Errno
 	// Readdir returns all entries for given directory, which include attributes if plus is true.
 	Readdir(ctx Context, inode Ino, wantattr uint8, entries *[]*Entry) syscall.Errno
+	// ReaddirPage returns the entries of given directory whose names are after the given one (in byte order),
+	// at most limit entries for engines supporting paging ("." and ".." are returned when after is nil).
+	// It's used to list big directories without loading all the entries into memory.
+	ReaddirPage(ctx Context, inode Ino, wantattr uint8, after []byte, limit int, entries *[]*Entry) syscall.Errno
 	// Create creates a file in a directory with given name.
 	Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, flags uint32, inode *Ino, attr *Attr) syscall.Errno
+	// TmpFile creates an anonymous file (O_TMPFILE) in a directory, which is opened and removed
+	// once closed, unless it's linked into a directory.
+	TmpFile(ctx Context, parent Ino, mode uint16, cumask uint16, inode *Ino, attr *Attr) syscall.Errno
 	// Open checks permission on a node and track it as open.
 	Open(ctx Context, inode Ino, flags uint32, attr *Attr) syscall.Errno
 	// Close a file.
@@ -402,6 +427,10 @@ type Meta interface {
 	SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
 	// RemoveXattr removes the extended attribute of a node.
 	RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
+	// GetFacl returns the access or default ACL of a node, ENOATTR if it's not set.
+	GetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno
+	// SetFacl updates the access or default ACL of a node, nil rule removes it.
+	SetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno
 	// Flock tries to put a lock on given file.
 	Flock(ctx Context, inode Ino, owner uint64, ltype uint32, block bool) syscall.Errno
 	// Getlk returns the current lock owner for a range on a file.
@@ -421,8 +450,18 @@ type Meta interface {
 	GetTreeSummary(ctx Context, root *TreeSummary, depth, topN uint8, strict bool, updateProgress func(count uint64, bytes uint64)) syscall.Errno
 	// Clone a file or directory
 	Clone(ctx Context, srcIno, dstParentIno Ino, dstName string, cmode uint8, cumask uint16, count, total *uint64) syscall.Errno
+	// CreateSnapshot creates a point-in-time snapshot of the volume, the writes are paused until it's done
+	CreateSnapshot(ctx Context, name string, timeout time.Duration, count *uint64) syscall.Errno
+	// ListSnapshots returns all the snapshots of the volume
+	ListSnapshots(ctx Context) ([]*Entry, syscall.Errno)
+	// DeleteSnapshot removes a snapshot of the volume permanently
+	DeleteSnapshot(ctx Context, name string, count *uint64) syscall.Errno
 	// GetPaths returns all paths of an inode
 	GetPaths(ctx Context, inode Ino) []string
+	// InRoot checks whether an inode is inside the mounted root (the trash is outside of any subdir)
+	InRoot(ctx Context, inode Ino) bool
+	// Watch subscribes the changes of a directory (recursively) made by this client, the watcher should be closed after use
+	Watch(ctx Context, root Ino, size int) (*Watcher, syscall.Errno)
 	// Check integrity of an absolute path and repair it if asked
 	Check(ctx Context, fpath string, repair bool, recursive bool, statAll bool) error
 	// Change root to a directory specified by subdir
@@ -431,6 +470,31 @@ type Meta interface {
 	chroot(inode Ino)
 	// Get a copy of the current format
 	GetFormat() Format
+	// ClientLimit returns the limits defined for this client, or nil if there is none
+	ClientLimit() *ClientLimit
+
+	// GetInline returns the data of a small block kept in meta engine
+	GetInline(key string) ([]byte, error)
+	// SetInline keeps the data of a small block in meta engine
+	SetInline(key string, data []byte) error
+	// DeleteInline removes a small block from meta engine
+	DeleteInline(key string) error
+	// RefBlock records the hash of a deduplicated block, and returns the refcount of its content
+	RefBlock(key, hash string) (int64, error)
+	// UnrefBlock removes a deduplicated block, and returns its hash and the remaining refcount
+	UnrefBlock(key string) (string, int64, error)
+	// GetBlockHash returns the hash of a deduplicated block
+	GetBlockHash(key string) (string, error)
+	// DropContent removes the refcount of a content after it's deleted
+	DropContent(hash string) error
+	// PackBlocks records the offset and length of blocks in a pack, and returns the refcount of the pack
+	PackBlocks(pack string, blocks map[string][2]uint32) (int64, error)
+	// GetPackedBlock returns the pack, offset and length of a packed block
+	GetPackedBlock(key string) (string, uint32, uint32, error)
+	// UnpackBlock removes a packed block, and returns its pack and the remaining refcount
+	UnpackBlock(key string) (string, int64, error)
+	// ListPacks returns the refcount of all the packs which have packed blocks
+	ListPacks() (map[string]int64, error)
 
 	// OnMsg add a callback for the given message type.
 	OnMsg(mtype uint32, cb MsgCallback)
@@ -442,6 +506,10 @@ type Meta interface {
 	// Dump the tree under root, which may be modified by checkRoot
 	DumpMeta(w io.Writer, root Ino, keepSecret bool) error
 	LoadMeta(r io.Reader) error
+	// DumpChanges dumps the inodes changed between since and until, requires changelog enabled.
+	DumpChanges(w io.Writer, since, until time.Time, keepSecret bool) error
+	// TrimChanges removes the changelog before the given time.
+	TrimChanges(before time.Time) error
 
 	// getBase return the base engine.
 	getBase() *baseMeta
@@ -501,7 +569,12 @@ func NewClient(uri string, conf *Config) Meta {
 	} else {
 		conf.SelfCheck()
 	}
-	m, err := f(driver, uri[p+3:], conf)
+	addr, ns, err := popNamespace(uri[p+3:])
+	if err != nil {
+		logger.Fatalf(err.Error())
+	}
+	conf.Namespace = ns
+	m, err := f(driver, addr, conf)
 	if err != nil {
 		logger.Fatalf("Meta %s is not available: %s", utils.RemovePassword(uri), err)
 	}
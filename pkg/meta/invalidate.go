@@ -0,0 +1,96 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+const (
+	// The published invalidations are kept for a while in the engines without pub/sub (SQL and TKV),
+	// and they are polled within a window to tolerate the clock skew of clients.
+	invalidationTTL    = time.Minute
+	invalidationWindow = time.Second * 10
+)
+
+func encodeInvalidation(sid uint64, inodes []Ino) []byte {
+	w := utils.NewBuffer(uint32(8 + 8*len(inodes)))
+	w.Put64(sid)
+	for _, inode := range inodes {
+		w.Put64(uint64(inode))
+	}
+	return w.Bytes()
+}
+
+func decodeInvalidation(buf []byte) (uint64, []Ino) {
+	if len(buf) < 8 || len(buf)%8 != 0 {
+		return 0, nil
+	}
+	rb := utils.FromBuffer(buf)
+	sid := rb.Get64()
+	inodes := make([]Ino, 0, rb.Left()/8)
+	for rb.HasMore() {
+		inodes = append(inodes, Ino(rb.Get64()))
+	}
+	return sid, inodes
+}
+
+// subscribeInvalidation invalidates the cached inodes which are changed by other clients,
+// and sends them to the watchers.
+func (m *baseMeta) subscribeInvalidation() {
+	for {
+		err := m.en.doSubscribeInvalidation(func(msg []byte) {
+			sid, inodes := decodeInvalidation(msg)
+			if sid == m.sid && sid > 0 || len(inodes) == 0 {
+				return
+			}
+			for _, inode := range inodes {
+				m.of.InvalidateChunk(inode, invalidateAllChunks)
+			}
+			_ = m.newMsg(InvalidateInodes, inodes)
+			m.notifyChanges(inodes)
+		})
+		logger.Warnf("Subscribe invalidations: %s", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// pollInvalidation calls scan periodically to find the invalidations published within
+// the window, each of them is passed to fn only once.
+func pollInvalidation(scan func(since int64, fn func(key string, msg []byte)) error, fn func(msg []byte)) error {
+	seen := make(map[string]time.Time)
+	for {
+		now := time.Now()
+		err := scan(now.Add(-invalidationWindow).UnixMilli(), func(key string, msg []byte) {
+			if _, ok := seen[key]; !ok {
+				seen[key] = now
+				fn(msg)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		for key, t := range seen {
+			if now.Sub(t) > invalidationWindow*2 {
+				delete(seen, key)
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,423 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// the inodes changed within this window before the given time are synchronized again,
+// to tolerate the clock difference between clients
+const syncClockSkew = time.Minute
+
+type syncedSlice struct {
+	id   uint64
+	size uint32
+}
+
+type metaSyncer struct {
+	src    engine
+	srcm   Meta
+	dst    *kvMeta
+	since  int64 // unix nano
+	synced int64
+	sem    chan struct{}
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// SyncMeta copies the changes made in src since the given time into dst, which should be loaded from a dump of src
+// started after that time. Only the transactional key-value engines are supported as dst.
+//
+// The whole tree of src is walked, the inodes with ctime before since are skipped; the entries of a changed
+// directory are compared with dst to find the removed ones. The reference counts of slices in dst are kept
+// consistent with its own chunks, except that a slice created after the dump may be over counted, which is
+// leaked (and can be cleaned by gc) rather than deleted early. When final is true, the counters, quotas and
+// setting are also copied, and src should not be changed by any client at this time.
+// It returns the number of synchronized inodes.
+func SyncMeta(src, dst Meta, since time.Time, threads int, final bool) (int64, error) {
+	if err := CheckSyncTarget(dst); err != nil {
+		return 0, err
+	}
+	kv := dst.(*kvMeta)
+	if threads <= 0 {
+		threads = 1
+	}
+	s := &metaSyncer{
+		src:   src.getBase().en,
+		srcm:  src,
+		dst:   kv,
+		since: since.Add(-syncClockSkew).UnixNano(),
+		sem:   make(chan struct{}, threads),
+	}
+	ctx := Background
+	for _, ino := range []Ino{RootInode, TrashInode} {
+		var attr Attr
+		if st := s.src.doGetAttr(ctx, ino, &attr); st != 0 {
+			if ino == TrashInode && st == syscall.ENOENT {
+				continue
+			}
+			return 0, fmt.Errorf("get attribute of inode %d: %s", ino, st)
+		}
+		s.wg.Add(1)
+		s.walk(ctx, ino, &attr)
+	}
+	s.wg.Wait()
+	if s.err != nil {
+		return s.synced, s.err
+	}
+	if final {
+		if err := s.finish(ctx); err != nil {
+			return s.synced, err
+		}
+	}
+	return s.synced, nil
+}
+
+// CheckSyncTarget returns an error if dst can not be used as the destination of SyncMeta.
+func CheckSyncTarget(dst Meta) error {
+	if _, ok := dst.(*kvMeta); !ok {
+		return fmt.Errorf("%s is not supported as the destination of migration", dst.Name())
+	}
+	return nil
+}
+
+func (s *metaSyncer) changed(attr *Attr) bool {
+	return attr.Ctime*1e9+int64(attr.Ctimensec) >= s.since
+}
+
+func (s *metaSyncer) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+}
+
+func (s *metaSyncer) failed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil
+}
+
+// walk synchronizes the directory and all the changed inodes under it.
+func (s *metaSyncer) walk(ctx Context, ino Ino, attr *Attr) {
+	defer s.wg.Done()
+	if s.failed() {
+		return
+	}
+	var entries []*Entry
+	if st := s.src.doReaddir(ctx, ino, 1, &entries, -1); st != 0 {
+		if st != syscall.ENOENT { // removed after listed
+			s.fail(fmt.Errorf("readdir %d: %s", ino, st))
+		}
+		return
+	}
+	if s.changed(attr) {
+		if err := s.syncInode(ctx, ino, attr); err != nil {
+			s.fail(err)
+			return
+		}
+		if err := s.syncEntries(ctx, ino, entries); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+	for _, e := range entries {
+		if e.Attr.Typ == TypeDirectory {
+			s.wg.Add(1)
+			select {
+			case s.sem <- struct{}{}:
+				go func(e *Entry) {
+					s.walk(ctx, e.Inode, e.Attr)
+					<-s.sem
+				}(e)
+			default:
+				s.walk(ctx, e.Inode, e.Attr)
+			}
+		} else if s.changed(e.Attr) {
+			if err := s.syncInode(ctx, e.Inode, e.Attr); err != nil {
+				s.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// syncEntries replaces the entries of a directory in dst with those in src.
+func (s *metaSyncer) syncEntries(ctx Context, parent Ino, entries []*Entry) error {
+	m := s.dst
+	names := make(map[string]*Entry, len(entries))
+	for _, e := range entries {
+		names[string(e.Name)] = e
+	}
+	prefix := m.fmtKey("A", parent, "D")
+	removed := make(map[string]Ino)
+	err := m.txn(func(tx *kvTxn) error {
+		for k := range removed {
+			delete(removed, k)
+		}
+		tx.scan(prefix, nextKey(prefix), false, func(k, v []byte) bool {
+			name := string(k[len(prefix):])
+			_, inode := m.parseEntry(v)
+			if e, ok := names[name]; !ok || e.Inode != inode {
+				removed[name] = inode
+			}
+			return true
+		})
+		for name := range removed {
+			m.deleteEntry(tx, parent, name)
+		}
+		for name, e := range names {
+			m.setEntry(tx, parent, name, m.packEntry(e.Attr.Typ, e.Inode))
+		}
+		tx.delete(m.dirStatKey(parent)) // recalculated when used
+		return nil
+	}, parent)
+	if err != nil {
+		return fmt.Errorf("sync entries of %d: %s", parent, err)
+	}
+	for _, inode := range removed {
+		if err = s.removeInode(ctx, inode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeInode removes an inode from dst if it does not exist in src anymore (not moved or linked elsewhere).
+// The data is not touched, which was deleted by src already.
+func (s *metaSyncer) removeInode(ctx Context, inode Ino) error {
+	if st := s.src.doGetAttr(ctx, inode, nil); st == 0 {
+		return nil
+	} else if st != syscall.ENOENT {
+		return fmt.Errorf("get attribute of inode %d: %s", inode, st)
+	}
+	m := s.dst
+	var children []Ino
+	err := m.txn(func(tx *kvTxn) error {
+		children = children[:0]
+		prefix := m.fmtKey("A", inode, "D")
+		tx.scan(prefix, nextKey(prefix), false, func(k, v []byte) bool {
+			_, child := m.parseEntry(v)
+			children = append(children, child)
+			return true
+		})
+		s.updateRefs(tx, s.deleteChunks(tx, inode), nil)
+		tx.deleteKeys(m.fmtKey("A", inode))
+		tx.delete(m.dirStatKey(inode))
+		return nil
+	}, inode)
+	if err != nil {
+		return fmt.Errorf("remove inode %d: %s", inode, err)
+	}
+	for _, child := range children {
+		if err = s.removeInode(ctx, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteChunks deletes the chunks of an inode in dst, and returns the number of references to each slice.
+func (s *metaSyncer) deleteChunks(tx *kvTxn, inode Ino) map[syncedSlice]int64 {
+	m := s.dst
+	refs := make(map[syncedSlice]int64)
+	prefix := m.fmtKey("A", inode, "C")
+	tx.scan(prefix, nextKey(prefix), false, func(k, v []byte) bool {
+		for _, sl := range readSliceBuf(v) {
+			if sl.id > 0 {
+				refs[syncedSlice{sl.id, sl.size}]++
+			}
+		}
+		tx.delete(k)
+		return true
+	})
+	return refs
+}
+
+func (s *metaSyncer) updateRefs(tx *kvTxn, old, new map[syncedSlice]int64) {
+	m := s.dst
+	diff := make(map[syncedSlice]int64, len(new))
+	for r, c := range new {
+		diff[r] += c
+	}
+	for r, c := range old {
+		diff[r] -= c
+	}
+	for r, d := range diff {
+		if d == 0 {
+			continue
+		}
+		if tx.incrBy(m.sliceKey(r.id, r.size), d) < 0 {
+			tx.delete(m.sliceKey(r.id, r.size))
+		}
+	}
+}
+
+// syncInode copies the attribute, chunks, symlink, xattrs and parents of an inode from src into dst.
+func (s *metaSyncer) syncInode(ctx Context, inode Ino, attr *Attr) error {
+	var chunks = make(map[uint32][]byte)
+	var newRefs = make(map[syncedSlice]int64)
+	var target []byte
+	var parents map[Ino]int
+	switch attr.Typ {
+	case TypeFile:
+		for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
+			var ss []Slice
+			if st := s.srcm.Read(ctx, inode, indx, &ss); st != 0 {
+				return s.ignoreRemoved(inode, "read chunks", st)
+			}
+			var buf []byte
+			var pos uint32
+			for _, sl := range ss {
+				if sl.Id > 0 {
+					buf = append(buf, marshalSlice(pos, sl.Id, sl.Size, sl.Off, sl.Len)...)
+					newRefs[syncedSlice{sl.Id, sl.Size}]++
+				}
+				pos += sl.Len
+			}
+			if len(buf) > 0 {
+				chunks[indx] = buf
+			}
+		}
+		if attr.Parent == 0 { // hard linked, even if nlink drops back to 1
+			parents = s.src.doGetParents(ctx, inode)
+		}
+	case TypeSymlink:
+		var err error
+		if _, target, err = s.src.doReadlink(ctx, inode, true); err != nil {
+			return s.ignoreRemoved(inode, "readlink", errno(err))
+		}
+	}
+	xattrs := make(map[string][]byte)
+	var names []byte
+	if st := s.srcm.ListXattr(ctx, inode, &names); st != 0 {
+		return s.ignoreRemoved(inode, "list xattr", st)
+	}
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		var value []byte
+		if st := s.srcm.GetXattr(ctx, inode, string(name), &value); st == 0 {
+			xattrs[string(name)] = value
+		} else if st != ENOATTR {
+			return s.ignoreRemoved(inode, "get xattr", st)
+		}
+	}
+
+	m := s.dst
+	err := m.txn(func(tx *kvTxn) error {
+		tx.set(m.inodeKey(inode), m.marshal(attr))
+		if attr.Typ == TypeFile {
+			s.updateRefs(tx, s.deleteChunks(tx, inode), newRefs)
+			for indx, buf := range chunks {
+				tx.set(m.chunkKey(inode, indx), buf)
+			}
+		} else if attr.Typ == TypeSymlink {
+			tx.set(m.symKey(inode), target)
+		}
+		tx.deleteKeys(m.fmtKey("A", inode, "P")) // stale parents
+		for p, c := range parents {
+			tx.set(m.parentKey(inode, p), packCounter(int64(c)))
+		}
+		tx.deleteKeys(m.fmtKey("A", inode, "X"))
+		for name, value := range xattrs {
+			tx.set(m.xattrKey(inode, name), value)
+		}
+		return nil
+	}, inode)
+	if err != nil {
+		return fmt.Errorf("sync inode %d: %s", inode, err)
+	}
+	atomic.AddInt64(&s.synced, 1)
+	return nil
+}
+
+// ignoreRemoved ignores the inodes removed during walking, which will be removed from dst with their parents.
+func (s *metaSyncer) ignoreRemoved(inode Ino, op string, st syscall.Errno) error {
+	if st == syscall.ENOENT {
+		return nil
+	}
+	return fmt.Errorf("%s of inode %d: %s", op, inode, st)
+}
+
+// finish copies the counters, quotas and setting of src into dst.
+func (s *metaSyncer) finish(ctx Context) error {
+	m := s.dst
+	counters := make(map[string]int64)
+	for _, name := range []string{usedSpace, totalInodes, "nextInode", "nextChunk", "nextSession", "nextTrash"} {
+		v, err := s.src.getCounter(name)
+		if err != nil {
+			return fmt.Errorf("get counter %s: %s", name, err)
+		}
+		counters[name] = v
+	}
+	body, err := s.src.doLoad()
+	if err != nil {
+		return fmt.Errorf("load setting: %s", err)
+	}
+	var format Format
+	if err = json.Unmarshal(body, &format); err != nil {
+		return fmt.Errorf("json: %s", err)
+	}
+	format.MigratedTo = ""
+	if body, err = json.MarshalIndent(&format, "", ""); err != nil {
+		return fmt.Errorf("json: %s", err)
+	}
+	err = m.txn(func(tx *kvTxn) error {
+		for name, v := range counters {
+			tx.set(m.counterKey(name), packCounter(v))
+		}
+		tx.set(m.fmtKey("setting"), body)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("copy counters and setting: %s", err)
+	}
+
+	quotas, err := s.src.doLoadQuotas(ctx)
+	if err != nil {
+		return fmt.Errorf("load quotas: %s", err)
+	}
+	old, err := m.doLoadQuotas(ctx)
+	if err != nil {
+		return fmt.Errorf("load quotas of destination: %s", err)
+	}
+	for inode := range old {
+		if _, ok := quotas[inode]; !ok {
+			if err = m.doDelQuota(ctx, inode); err != nil {
+				return fmt.Errorf("delete quota of %d: %s", inode, err)
+			}
+		}
+	}
+	for inode, q := range quotas {
+		if err = m.doSetQuota(ctx, inode, q, true); err != nil {
+			return fmt.Errorf("set quota of %d: %s", inode, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Multiple volumes can share one meta engine under different namespaces, which is specified by
+// the "namespace" parameter of META-URL. Every namespace has its own format, counters, quotas and
+// sessions, they are isolated by the prefix of keys (Redis and TKV) or table names (SQL):
+//
+//	Redis:  {NS}KEY (or {DB-NS}KEY for cluster)
+//	TKV:    0xFE NS 0xFD KEY
+//	SQL:    jfsNS_TABLE
+//
+// The volume without namespace keeps the original layout, so it can live together with them.
+const namespaceMark = 0xFE
+
+var namespaceRE = regexp.MustCompile(`^[a-z0-9]{1,32}$`)
+
+// popNamespace removes the namespace parameter from uri, since the drivers do not understand it.
+func popNamespace(uri string) (string, string, error) {
+	p := strings.LastIndex(uri, "?")
+	if p < 0 {
+		return uri, "", nil
+	}
+	values, err := url.ParseQuery(uri[p+1:])
+	if err != nil || !values.Has("namespace") {
+		return uri, "", nil
+	}
+	ns := values.Get("namespace")
+	if !namespaceRE.MatchString(ns) {
+		return "", "", fmt.Errorf("invalid namespace %q: only lowercase letters and digits are allowed (up to 32 characters)", ns)
+	}
+	values.Del("namespace")
+	uri = uri[:p]
+	if len(values) > 0 {
+		uri += "?" + values.Encode()
+	}
+	return uri, ns, nil
+}
+
+func kvNamespacePrefix(ns string) []byte {
+	return append(append([]byte{namespaceMark}, ns...), 0xFD)
+}
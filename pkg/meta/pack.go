@@ -0,0 +1,116 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package meta
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxPackSize is the max size of blocks which can be packed.
+const MaxPackSize = 1 << 20
+
+// PackBlocks records the offset and length of blocks in a pack, the blocks packed before are skipped.
+// The number of blocks recorded is returned, which is the refcount of the pack.
+func (m *baseMeta) PackBlocks(pack string, blocks map[string][2]uint32) (int64, error) {
+	defer m.timeit("PackBlocks", time.Now())
+	locs := make(map[string]string, len(blocks))
+	for k, b := range blocks {
+		locs[k] = formatPackedBlock(pack, b[0], b[1])
+	}
+	return m.en.doPackBlocks(pack, locs)
+}
+
+// GetPackedBlock returns the pack, offset and length of a packed block, os.ErrNotExist is returned if not found.
+func (m *baseMeta) GetPackedBlock(key string) (string, uint32, uint32, error) {
+	defer m.timeit("GetPackedBlock", time.Now())
+	loc, err := m.en.doGetPackedBlock(key)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return parsePackedBlock(loc)
+}
+
+// UnpackBlock removes a packed block and decreases the refcount of its pack. The pack and remaining
+// refcount are returned, so the caller should delete the pack when it's 0. os.ErrNotExist is returned
+// if the block is not packed.
+func (m *baseMeta) UnpackBlock(key string) (string, int64, error) {
+	defer m.timeit("UnpackBlock", time.Now())
+	loc, refs, err := m.en.doUnpackBlock(key)
+	if err != nil {
+		return "", 0, err
+	}
+	pack, _, _, err := parsePackedBlock(loc)
+	return pack, refs, err
+}
+
+// ListPacks returns the refcount of all the packs which have packed blocks.
+func (m *baseMeta) ListPacks() (map[string]int64, error) {
+	refs := make(map[string]int64)
+	err := m.en.doScanPackedBlock(func(key, loc string) error {
+		refs[packOf(loc)]++
+		return nil
+	})
+	return refs, err
+}
+
+func (m *baseMeta) dumpPackedBlocks() (map[string]string, error) {
+	locs := make(map[string]string)
+	err := m.en.doScanPackedBlock(func(key, loc string) error {
+		locs[key] = loc
+		return nil
+	})
+	if len(locs) == 0 {
+		locs = nil
+	}
+	return locs, err
+}
+
+// location of a packed block: $pack:$offset:$length
+func formatPackedBlock(pack string, off, length uint32) string {
+	return fmt.Sprintf("%s:%d:%d", pack, off, length)
+}
+
+func parsePackedBlock(loc string) (string, uint32, uint32, error) {
+	ps := strings.Split(loc, ":")
+	if len(ps) != 3 {
+		return "", 0, 0, fmt.Errorf("invalid location of packed block: %s", loc)
+	}
+	off, err1 := strconv.ParseUint(ps[1], 10, 32)
+	length, err2 := strconv.ParseUint(ps[2], 10, 32)
+	if err1 != nil || err2 != nil {
+		return "", 0, 0, fmt.Errorf("invalid location of packed block: %s", loc)
+	}
+	return ps[0], uint32(off), uint32(length), nil
+}
+
+func packOf(loc string) string {
+	if i := strings.IndexByte(loc, ':'); i >= 0 {
+		return loc[:i]
+	}
+	return loc
+}
+
+// countPackRefs rebuilds the refcount of packs from the dumped locations of blocks.
+func countPackRefs(locs map[string]string) map[string]int64 {
+	refs := make(map[string]int64)
+	for _, loc := range locs {
+		refs[packOf(loc)]++
+	}
+	return refs
+}
@@ -21,6 +21,7 @@ package meta
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -60,6 +61,7 @@ import (
 	Flock:      lockf$inode -> { $sid_$owner -> ltype }
 	POSIX lock: lockp$inode -> { $sid_$owner -> Plock(pid,ltype,start,end) }
 	Sessions:   sessions -> [ $sid -> heartbeat ]
+	Evicted:    evictedSessions -> { $sid -> seconds }
 	sustained:  session$sid -> [$inode]
 	locked:     locked$sid -> { lockf$inode or lockp$inode }
 
@@ -73,6 +75,13 @@ import (
 	Quota:             dirQuota -> { $inode -> {maxSpace, maxInodes} }
 	Quota used space:  dirQuotaUsedSpace -> { $inode -> usedSpace }
 	Quota used inodes: dirQuotaUsedInodes -> { $inode -> usedInodes }
+	Invalidation:      invalidation (channel) -> $sid + [$inode]
+	ACL:               acl -> { $id -> rule }
+	Inline blocks:     b$sliceId_$indx_$size -> data
+	Dedupe blocks:     h$sliceId_$indx_$size -> hash
+	Dedupe refs:       o$hash -> refcount
+	Packed blocks:     j$sliceId_$indx_$size -> $pack:$offset:$length
+	Pack refs:         y$pack -> refcount
 
 	Redis features:
 	  Sorted Set: 1.2+
@@ -85,6 +94,8 @@ import (
 type redisMeta struct {
 	*baseMeta
 	rdb        redis.UniversalClient
+	replicas   *redisReplicas // nil if reading from replicas is disabled
+	cache      *redisCache    // nil if client-side caching is disabled
 	prefix     string
 	shaLookup  string // The SHA returned by Redis for the loaded `scriptLookup`
 	shaResolve string // The SHA returned by Redis for the loaded `scriptResolve`
@@ -112,6 +123,10 @@ func newRedisMeta(driver, addr string, conf *Config) (Meta, error) {
 	readTimeout := query.duration("read-timeout", "read_timeout", time.Second*30)
 	writeTimeout := query.duration("write-timeout", "write_timeout", time.Second*5)
 	routeRead := query.pop("route-read")
+	readReplicas := query.pop("read-replicas")
+	maxStaleness := query.duration("max-staleness", "max_staleness", time.Second)
+	cacheSize, _ := strconv.Atoi(query.pop("client-cache"))
+	cacheTTL := query.duration("client-cache-ttl", "client_cache_ttl", time.Minute)
 	skipVerify := query.pop("insecure-skip-verify")
 	certFile := query.pop("tls-cert-file")
 	keyFile := query.pop("tls-key-file")
@@ -241,18 +256,55 @@ func newRedisMeta(driver, addr string, conf *Config) (Meta, error) {
 			prefix = fmt.Sprintf("{%d}", opt.DB)
 		}
 	}
+	cluster := prefix != ""
+	if conf.Namespace != "" {
+		if cluster {
+			prefix = fmt.Sprintf("{%d-%s}", opt.DB, conf.Namespace)
+		} else {
+			prefix = "{" + conf.Namespace + "}"
+		}
+	}
 
 	m := &redisMeta{
 		baseMeta: newBaseMeta(addr, conf),
 		rdb:      rdb,
 		prefix:   prefix,
 	}
+	if readReplicas != "" {
+		if cluster {
+			logger.Warnf("read-replicas is not supported for Redis cluster, use route-read instead")
+		} else {
+			m.replicas = newRedisReplicas(rdb, opt, readReplicas, maxStaleness)
+			m.replicas.readScript = m.isReadScript
+		}
+	}
+	if cacheSize > 0 {
+		if cluster {
+			logger.Warnf("client-cache is not supported for Redis cluster")
+		} else if m.cache, err = newRedisCache(opt, cacheSize, cacheTTL); err != nil {
+			logger.Warnf("Disable client-side caching: %s", err)
+			m.cache = nil
+		} else {
+			m.cache.readScript = m.isReadScript
+			rdb.AddHook(m.cache)
+		}
+	}
 	m.en = m
 	m.checkServerConfig()
 	return m, nil
 }
 
+func (m *redisMeta) isReadScript(sha string) bool {
+	return sha == m.shaLookup || sha == m.shaResolve
+}
+
 func (m *redisMeta) Shutdown() error {
+	if m.replicas != nil {
+		m.replicas.close()
+	}
+	if m.cache != nil {
+		_ = m.cache.close()
+	}
 	return m.rdb.Close()
 }
 
@@ -260,6 +312,272 @@ func (m *redisMeta) doDeleteSlice(id uint64, size uint32) error {
 	return m.rdb.HDel(Background, m.sliceRefs(), m.sliceKey(id, size)).Err()
 }
 
+func (m *redisMeta) doGetInline(key string) ([]byte, error) {
+	data, err := m.rdb.Get(Background, m.inlineKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, os.ErrNotExist
+	}
+	return data, err
+}
+
+func (m *redisMeta) doSetInline(key string, data []byte) error {
+	return m.rdb.Set(Background, m.inlineKey(key), data, 0).Err()
+}
+
+func (m *redisMeta) doDeleteInline(key string) error {
+	n, err := m.rdb.Del(Background, m.inlineKey(key)).Result()
+	if err == nil && n == 0 {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (m *redisMeta) doRefBlock(key, hash string) (int64, error) {
+	ctx := Background
+	var refs int64
+	err := m.txn(ctx, func(tx *redis.Tx) error {
+		old, err := tx.Get(ctx, m.blockHashKey(key)).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			if old != hash {
+				return errHashMismatch(key, old, hash)
+			}
+			refs, err = tx.Get(ctx, m.dedupeRefKey(hash)).Int64()
+			if err == redis.Nil {
+				err = nil
+			}
+			return err
+		}
+		if cur, err := tx.Get(ctx, m.dedupeRefKey(hash)).Int64(); err != nil && err != redis.Nil {
+			return err
+		} else if cur < 0 { // being deleted
+			refs = -1
+			return nil
+		}
+		var incr *redis.IntCmd
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, m.blockHashKey(key), hash, 0)
+			incr = pipe.IncrBy(ctx, m.dedupeRefKey(hash), 1)
+			return nil
+		})
+		if err == nil {
+			refs = incr.Val()
+		}
+		return err
+	}, m.blockHashKey(key), m.dedupeRefKey(hash))
+	return refs, err
+}
+
+func (m *redisMeta) doUnrefBlock(key string) (string, int64, error) {
+	ctx := Background
+	hash, err := m.rdb.Get(ctx, m.blockHashKey(key)).Result()
+	if err == redis.Nil {
+		return "", 0, os.ErrNotExist
+	} else if err != nil {
+		return "", 0, err
+	}
+	var refs int64
+	err = m.txn(ctx, func(tx *redis.Tx) error {
+		old, err := tx.Get(ctx, m.blockHashKey(key)).Result()
+		if err == redis.Nil {
+			return os.ErrNotExist
+		} else if err != nil {
+			return err
+		}
+		if old != hash {
+			return errHashMismatch(key, old, hash)
+		}
+		refs, err = tx.Get(ctx, m.dedupeRefKey(hash)).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if refs > 0 {
+			refs--
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, m.blockHashKey(key))
+			if refs > 0 {
+				pipe.Set(ctx, m.dedupeRefKey(hash), refs, 0)
+			} else {
+				refs = 0
+				pipe.Set(ctx, m.dedupeRefKey(hash), -1, 0) // deleting
+			}
+			return nil
+		})
+		return err
+	}, m.blockHashKey(key), m.dedupeRefKey(hash))
+	return hash, refs, err
+}
+
+func (m *redisMeta) doDropContent(hash string) error {
+	ctx := Background
+	return m.txn(ctx, func(tx *redis.Tx) error {
+		refs, err := tx.Get(ctx, m.dedupeRefKey(hash)).Int64()
+		if err == redis.Nil || err == nil && refs >= 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, m.dedupeRefKey(hash))
+			return nil
+		})
+		return err
+	}, m.dedupeRefKey(hash))
+}
+
+func (m *redisMeta) doGetBlockHash(key string) (string, error) {
+	hash, err := m.rdb.Get(Background, m.blockHashKey(key)).Result()
+	if err == redis.Nil {
+		return "", os.ErrNotExist
+	}
+	return hash, err
+}
+
+func (m *redisMeta) doScanBlockHash(fn func(key, hash string) error) error {
+	prefix := len(m.blockHashKey(""))
+	return m.scan(Background, "h*", func(keys []string) error {
+		values, err := m.rdb.MGet(Background, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				if err = fn(keys[i][prefix:], s); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (m *redisMeta) doPackBlocks(pack string, locs map[string]string) (int64, error) {
+	ctx := Background
+	keys := make([]string, 0, len(locs)+1)
+	for k := range locs {
+		keys = append(keys, m.packedBlockKey(k))
+	}
+	keys = append(keys, m.packRefKey(pack))
+	var refs int64
+	err := m.txn(ctx, func(tx *redis.Tx) error {
+		refs = 0
+		exists := make([]*redis.IntCmd, 0, len(locs))
+		names := make([]string, 0, len(locs))
+		_, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for k := range locs {
+				names = append(names, k)
+				exists = append(exists, pipe.Exists(ctx, m.packedBlockKey(k)))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, k := range names {
+				if exists[i].Val() == 0 {
+					pipe.Set(ctx, m.packedBlockKey(k), locs[k], 0)
+					refs++
+				}
+			}
+			if refs > 0 {
+				pipe.Set(ctx, m.packRefKey(pack), refs, 0)
+			}
+			return nil
+		})
+		return err
+	}, keys...)
+	return refs, err
+}
+
+func (m *redisMeta) doGetPackedBlock(key string) (string, error) {
+	loc, err := m.rdb.Get(Background, m.packedBlockKey(key)).Result()
+	if err == redis.Nil {
+		return "", os.ErrNotExist
+	}
+	return loc, err
+}
+
+func (m *redisMeta) doUnpackBlock(key string) (string, int64, error) {
+	ctx := Background
+	loc, err := m.rdb.Get(ctx, m.packedBlockKey(key)).Result()
+	if err == redis.Nil {
+		return "", 0, os.ErrNotExist
+	} else if err != nil {
+		return "", 0, err
+	}
+	pack := packOf(loc)
+	var refs int64
+	err = m.txn(ctx, func(tx *redis.Tx) error {
+		old, err := tx.Get(ctx, m.packedBlockKey(key)).Result()
+		if err == redis.Nil {
+			return os.ErrNotExist
+		} else if err != nil {
+			return err
+		}
+		if old != loc {
+			return fmt.Errorf("block %s was moved from %s to %s", key, loc, old)
+		}
+		refs, err = tx.Get(ctx, m.packRefKey(pack)).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if refs > 0 {
+			refs--
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, m.packedBlockKey(key))
+			if refs > 0 {
+				pipe.Set(ctx, m.packRefKey(pack), refs, 0)
+			} else {
+				pipe.Del(ctx, m.packRefKey(pack))
+			}
+			return nil
+		})
+		return err
+	}, m.packedBlockKey(key), m.packRefKey(pack))
+	return loc, refs, err
+}
+
+func (m *redisMeta) doScanPackedBlock(fn func(key, loc string) error) error {
+	prefix := len(m.packedBlockKey(""))
+	return m.scan(Background, "j*", func(keys []string) error {
+		values, err := m.rdb.MGet(Background, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				if err = fn(keys[i][prefix:], s); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (m *redisMeta) doScanInline(fn func(key string, data []byte) error) error {
+	prefix := len(m.inlineKey(""))
+	return m.scan(Background, "b*", func(keys []string) error {
+		values, err := m.rdb.MGet(Background, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				if err = fn(keys[i][prefix:], []byte(s)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
 func (m *redisMeta) Name() string {
 	return "redis"
 }
@@ -302,7 +620,7 @@ func (m *redisMeta) doInit(format *Format, force bool) error {
 		Length: 4 << 10,
 		Parent: 1,
 	}
-	if format.TrashDays > 0 {
+	if format.trashEnabled() {
 		attr.Mode = 0555
 		if err = m.rdb.SetNX(ctx, m.inodeKey(TrashInode), m.marshal(attr), 0).Err(); err != nil {
 			return err
@@ -327,6 +645,12 @@ func (m *redisMeta) Reset() error {
 			return m.rdb.Del(Background, keys...).Err()
 		})
 	}
+	// keys of namespaces are prefixed with "{"
+	if err := m.scan(Background, "{*", func(keys []string) error {
+		return fmt.Errorf("found key of namespace: %s, remove the namespaces first", keys[0])
+	}); err != nil {
+		return err
+	}
 	return m.rdb.FlushDB(Background).Err()
 }
 
@@ -540,6 +864,25 @@ func (m *redisMeta) entryKey(parent Ino) string {
 	return m.prefix + "d" + parent.String()
 }
 
+func (m *redisMeta) foldKey(parent Ino) string {
+	return m.prefix + "f" + parent.String()
+}
+
+// setEntry and delEntry also maintain the folded names of entries for case-insensitive volume.
+func (m *redisMeta) setEntry(ctx Context, pipe redis.Pipeliner, parent Ino, name string, buf []byte) {
+	pipe.HSet(ctx, m.entryKey(parent), name, buf)
+	if m.caseFolded(parent) {
+		pipe.HSet(ctx, m.foldKey(parent), foldName(name), name)
+	}
+}
+
+func (m *redisMeta) delEntry(ctx Context, pipe redis.Pipeliner, parent Ino, name string) {
+	pipe.HDel(ctx, m.entryKey(parent), name)
+	if m.caseFolded(parent) {
+		pipe.HDel(ctx, m.foldKey(parent), foldName(name))
+	}
+}
+
 func (m *redisMeta) parentKey(inode Ino) string {
 	return m.prefix + "p" + inode.String()
 }
@@ -569,6 +912,26 @@ func (m *redisMeta) plockKey(inode Ino) string {
 	return m.prefix + "lockp" + inode.String()
 }
 
+func (m *redisMeta) inlineKey(key string) string {
+	return m.prefix + "b" + key
+}
+
+func (m *redisMeta) blockHashKey(key string) string {
+	return m.prefix + "h" + key
+}
+
+func (m *redisMeta) dedupeRefKey(hash string) string {
+	return m.prefix + "o" + hash
+}
+
+func (m *redisMeta) packedBlockKey(key string) string {
+	return m.prefix + "j" + key
+}
+
+func (m *redisMeta) packRefKey(pack string) string {
+	return m.prefix + "y" + pack
+}
+
 func (m *redisMeta) setting() string {
 	return m.prefix + "setting"
 }
@@ -601,6 +964,10 @@ func (m *redisMeta) dirQuotaKey() string {
 	return m.prefix + "dirQuota"
 }
 
+func (m *redisMeta) aclKey() string {
+	return m.prefix + "acl"
+}
+
 func (m *redisMeta) totalInodesKey() string {
 	return m.prefix + totalInodes
 }
@@ -609,6 +976,14 @@ func (m *redisMeta) delfiles() string {
 	return m.prefix + "delfiles"
 }
 
+func (m *redisMeta) changelog() string {
+	return m.prefix + "changelog"
+}
+
+func (m *redisMeta) invalidationChannel() string {
+	return m.prefix + "invalidation"
+}
+
 func (m *redisMeta) detachedNodes() string {
 	return m.prefix + "detachedNodes"
 }
@@ -625,6 +1000,10 @@ func (m *redisMeta) sessionInfos() string {
 	return m.prefix + "sessionInfos"
 }
 
+func (m *redisMeta) evictedSessions() string {
+	return m.prefix + "evictedSessions"
+}
+
 func (m *redisMeta) sliceRefs() string {
 	return m.prefix + "sliceRef"
 }
@@ -736,7 +1115,11 @@ func (m *redisMeta) doLookup(ctx Context, parent Ino, name string, inode *Ino, a
 	var encodedAttr []byte
 	var err error
 	entryKey := m.entryKey(parent)
-	if len(m.shaLookup) > 0 && attr != nil && !m.conf.CaseInsensi && m.prefix == "" {
+	if m.cache != nil {
+		return m.cachedLookup(ctx, entryKey, name, inode, attr)
+	}
+	rdb, replica := m.reader()
+	if len(m.shaLookup) > 0 && attr != nil && !m.conf.CaseInsensi && m.prefix == "" && !replica {
 		var res interface{}
 		var returnedIno int64
 		var returnedAttr string
@@ -752,12 +1135,12 @@ func (m *redisMeta) doLookup(ctx Context, parent Ino, name string, inode *Ino, a
 	}
 	if foundIno == 0 || len(encodedAttr) == 0 {
 		var buf []byte
-		buf, err = m.rdb.HGet(ctx, entryKey, name).Bytes()
+		buf, err = rdb.HGet(ctx, entryKey, name).Bytes()
 		if err != nil {
 			return errno(err)
 		}
 		foundType, foundIno = m.parseEntry(buf)
-		encodedAttr, err = m.rdb.Get(ctx, m.inodeKey(foundIno)).Bytes()
+		encodedAttr, err = rdb.Get(ctx, m.inodeKey(foundIno)).Bytes()
 	}
 
 	if err == nil {
@@ -796,7 +1179,17 @@ func (m *redisMeta) Resolve(ctx Context, parent Ino, path string, inode *Ino, at
 }
 
 func (m *redisMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
-	a, err := m.rdb.Get(ctx, m.inodeKey(inode)).Bytes()
+	if m.cache != nil {
+		a, err := m.cache.get(m.inodeKey(inode), "", func(rdb *redis.Client) ([]byte, error) {
+			return rdb.Get(ctx, m.inodeKey(inode)).Bytes()
+		})
+		if err == nil {
+			m.parseAttr(a, attr)
+		}
+		return errno(err)
+	}
+	rdb, _ := m.reader()
+	a, err := rdb.Get(ctx, m.inodeKey(inode)).Bytes()
 	if err == nil {
 		m.parseAttr(a, attr)
 	}
@@ -872,7 +1265,9 @@ func replaceErrno(txf func(tx *redis.Tx) error) func(tx *redis.Tx) error {
 }
 
 func (m *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...string) error {
-	if m.conf.ReadOnly {
+	m.beginWrite()
+	defer m.endWrite()
+	if m.conf.ReadOnly || m.leaseExpired() || m.isFrozen() {
 		return syscall.EROFS
 	}
 	for _, k := range keys {
@@ -884,8 +1279,9 @@ func (m *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...strin
 	_, _ = khash.Write([]byte(keys[0]))
 	h := uint(khash.Sum32())
 
-	start := time.Now()
-	defer func() { m.txDist.Observe(time.Since(start).Seconds()) }()
+	method, start := txnMethod(), time.Now()
+	var restarts int
+	defer func() { m.observeTxn(method, start, restarts, keys) }()
 
 	m.txLock(h)
 	defer m.txUnlock(h)
@@ -904,8 +1300,14 @@ func (m *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...strin
 				err = syscall.Errno(eno)
 			}
 		}
+		if m.replicas != nil {
+			m.replicas.wrote() // it may be changed even if failed
+		}
+		if m.cache != nil {
+			m.cache.invalidate(keys...)
+		}
 		if err != nil && m.shouldRetry(err, retryOnFailture) {
-			m.txRestart.Add(1)
+			restarts++
 			logger.Debugf("Transaction failed, restart it (tried %d): %s", i+1, err)
 			lastErr = err
 			time.Sleep(time.Millisecond * time.Duration(rand.Int()%((i+1)*(i+1))))
@@ -921,6 +1323,10 @@ func (m *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...strin
 
 func (m *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr, skipPermCheck bool) syscall.Errno {
 	defer m.timeit("Truncate", time.Now())
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -956,7 +1362,7 @@ func (m *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 		}
 		newLength = int64(length) - int64(t.Length)
 		newSpace = align4K(length) - align4K(t.Length)
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(ctx, tx, inode, t.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, t.Uid, t.Gid, m.getParents(ctx, tx, inode, t.Parent)...); err != 0 {
 			return err
 		}
 		var zeroChunks []uint32
@@ -1024,7 +1430,10 @@ func (m *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 		return err
 	}, m.inodeKey(inode))
 	if err == nil {
+		m.logChange(inode)
+		m.notifyAttr(ctx, inode, attr)
 		m.updateParentStat(ctx, inode, attr.Parent, newLength, newSpace)
+		m.updateOwnerQuota(attr.Uid, attr.Gid, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -1046,6 +1455,10 @@ func (m *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		return syscall.EINVAL
 	}
 	defer m.timeit("Fallocate", time.Now())
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -1087,7 +1500,7 @@ func (m *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		old := t.Length
 		newLength = int64(length) - int64(old)
 		newSpace = align4K(length) - align4K(old)
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(ctx, tx, inode, t.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, t.Uid, t.Gid, m.getParents(ctx, tx, inode, t.Parent)...); err != 0 {
 			return err
 		}
 		t.Length = length
@@ -1121,7 +1534,12 @@ func (m *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		return err
 	}, m.inodeKey(inode))
 	if err == nil {
+		m.logChange(inode)
 		m.updateParentStat(ctx, inode, t.Parent, newLength, newSpace)
+		m.updateOwnerQuota(t.Uid, t.Gid, newSpace, 0)
+		if mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			m.compactHoles(inode, off, size, t.Length)
+		}
 	}
 	return errno(err)
 }
@@ -1129,9 +1547,14 @@ func (m *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 func (m *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
 	defer m.timeit("SetAttr", time.Now())
 	inode = m.checkRoot(inode)
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	defer func() { m.of.InvalidateChunk(inode, invalidateAttrOnly) }()
-	return errno(m.txn(ctx, func(tx *redis.Tx) error {
-		var cur Attr
+	defer m.logChange(inode)
+	var cur Attr
+	st := errno(m.txn(ctx, func(tx *redis.Tx) error {
 		a, err := tx.Get(ctx, m.inodeKey(inode)).Bytes()
 		if err != nil {
 			return err
@@ -1156,6 +1579,11 @@ func (m *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 		}
 		return err
 	}, m.inodeKey(inode)))
+	if st == 0 {
+		m.moveOwnerQuota(&cur, attr)
+		m.notifyAttr(ctx, inode, attr)
+	}
+	return st
 }
 
 func (m *redisMeta) doReadlink(ctx Context, inode Ino, noatime bool) (atime int64, target []byte, err error) {
@@ -1271,6 +1699,9 @@ func (m *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 			}
 			return syscall.EEXIST
 		}
+		if st := m.inheritACL(attr, &pattr, mode, cumask); st != 0 {
+			return st
+		}
 
 		var updateParent bool
 		now := time.Now()
@@ -1293,6 +1724,8 @@ func (m *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 		attr.Mtimensec = uint32(now.Nanosecond())
 		attr.Ctime = now.Unix()
 		attr.Ctimensec = uint32(now.Nanosecond())
+		attr.Btime = now.Unix()
+		attr.Btimensec = uint32(now.Nanosecond())
 		if ctx.Value(CtxKey("behavior")) == "Hadoop" || runtime.GOOS == "darwin" {
 			attr.Gid = pattr.Gid
 		} else if runtime.GOOS == "linux" && pattr.Mode&02000 != 0 {
@@ -1313,7 +1746,7 @@ func (m *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HSet(ctx, m.entryKey(parent), name, m.packEntry(_type, ino))
+			m.setEntry(ctx, pipe, parent, name, m.packEntry(_type, ino))
 			if updateParent {
 				pipe.Set(ctx, m.inodeKey(parent), m.marshal(&pattr), 0)
 			}
@@ -1425,7 +1858,7 @@ func (m *redisMeta) doUnlink(ctx Context, parent Ino, name string, attr *Attr, s
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HDel(ctx, m.entryKey(parent), name)
+			m.delEntry(ctx, pipe, parent, name)
 			if updateParent {
 				pipe.Set(ctx, m.inodeKey(parent), m.marshal(&pattr), 0)
 			}
@@ -1556,7 +1989,7 @@ func (m *redisMeta) doRmdir(ctx Context, parent Ino, name string, pinode *Ino, s
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HDel(ctx, m.entryKey(parent), name)
+			m.delEntry(ctx, pipe, parent, name)
 			if !isTrash(parent) {
 				pipe.Set(ctx, m.inodeKey(parent), m.marshal(&pattr), 0)
 			}
@@ -1589,6 +2022,13 @@ func (m *redisMeta) doRmdir(ctx Context, parent Ino, name string, pinode *Ino, s
 
 func (m *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode, tInode *Ino, attr, tAttr *Attr) syscall.Errno {
 	exchange := flags == RenameExchange
+	var wino Ino // inode of the whiteout
+	if flags&RenameWhiteout != 0 {
+		var err error
+		if wino, err = m.nextInode(); err != nil {
+			return errno(err)
+		}
+	}
 	var opened bool
 	var trash, dino Ino
 	var dtyp uint8
@@ -1636,7 +2076,7 @@ func (m *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 			return err
 		}
 		if err == nil {
-			if flags == RenameNoReplace {
+			if flags&RenameNoReplace != 0 {
 				return syscall.EEXIST
 			}
 			dtyp, dino = m.parseEntry(dbuf)
@@ -1794,8 +2234,15 @@ func (m *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 					pipe.HIncrBy(ctx, m.parentKey(dino), parentSrc.String(), 1)
 					pipe.HIncrBy(ctx, m.parentKey(dino), parentDst.String(), -1)
 				}
+			} else if wino > 0 {
+				pipe.HSet(ctx, m.entryKey(parentSrc), nameSrc, m.packEntry(TypeCharDev, wino))
+				pipe.Set(ctx, m.inodeKey(wino), m.marshal(whiteoutAttr(ctx, parentSrc, now)), 0)
+				pipe.IncrBy(ctx, m.usedSpaceKey(), align4K(0))
+				pipe.Incr(ctx, m.totalInodesKey())
 			} else {
-				pipe.HDel(ctx, m.entryKey(parentSrc), nameSrc)
+				m.delEntry(ctx, pipe, parentSrc, nameSrc)
+			}
+			if !exchange {
 				if dino > 0 {
 					if trash > 0 {
 						pipe.Set(ctx, m.inodeKey(dino), m.marshal(&tattr), 0)
@@ -1853,7 +2300,7 @@ func (m *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 				}
 			}
 			pipe.Set(ctx, m.inodeKey(ino), m.marshal(&iattr), 0)
-			pipe.HSet(ctx, m.entryKey(parentDst), nameDst, buf)
+			m.setEntry(ctx, pipe, parentDst, nameDst, buf)
 			if dupdate {
 				pipe.Set(ctx, m.inodeKey(parentDst), m.marshal(&dattr), 0)
 			}
@@ -1907,7 +2354,12 @@ func (m *redisMeta) doLink(ctx Context, inode, parent Ino, name string, attr *At
 			return syscall.EPERM
 		}
 		oldParent := iattr.Parent
-		iattr.Parent = 0
+		relink := iattr.Nlink == 0 // anonymous file (O_TMPFILE)
+		if relink {
+			iattr.Parent = parent
+		} else {
+			iattr.Parent = 0
+		}
 		iattr.Ctime = now.Unix()
 		iattr.Ctimensec = uint32(now.Nanosecond())
 		iattr.Nlink++
@@ -1922,11 +2374,15 @@ func (m *redisMeta) doLink(ctx Context, inode, parent Ino, name string, attr *At
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HSet(ctx, m.entryKey(parent), name, m.packEntry(iattr.Typ, inode))
+			m.setEntry(ctx, pipe, parent, name, m.packEntry(iattr.Typ, inode))
 			if updateParent {
 				pipe.Set(ctx, m.inodeKey(parent), m.marshal(&pattr), 0)
 			}
 			pipe.Set(ctx, m.inodeKey(inode), m.marshal(&iattr), 0)
+			if relink {
+				pipe.SRem(ctx, m.sustained(m.sid), strconv.Itoa(int(inode)))
+				return nil
+			}
 			if oldParent > 0 {
 				pipe.HIncrBy(ctx, m.parentKey(inode), oldParent.String(), 1)
 			}
@@ -1940,9 +2396,24 @@ func (m *redisMeta) doLink(ctx Context, inode, parent Ino, name string, attr *At
 	}, m.inodeKey(parent), m.entryKey(parent), m.inodeKey(inode)))
 }
 
+func (m *redisMeta) doLookupFolded(ctx Context, parent Ino, name string) *Entry {
+	rdb, _ := m.reader()
+	found, err := rdb.HGet(ctx, m.foldKey(parent), foldName(name)).Result()
+	if err != nil {
+		return nil
+	}
+	buf, err := rdb.HGet(ctx, m.entryKey(parent), found).Bytes()
+	if err != nil {
+		return nil
+	}
+	typ, inode := m.parseEntry(buf)
+	return &Entry{Inode: inode, Name: []byte(found), Attr: &Attr{Typ: typ}}
+}
+
 func (m *redisMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry, limit int) syscall.Errno {
 	var stop = errors.New("stop")
-	err := m.hscan(ctx, m.entryKey(inode), func(keys []string) error {
+	rdb, _ := m.reader()
+	err := m.hscanOn(ctx, rdb, m.entryKey(inode), func(keys []string) error {
 		newEntries := make([]Entry, len(keys)/2)
 		newAttrs := make([]Attr, len(keys)/2)
 		for i := 0; i < len(keys); i += 2 {
@@ -1976,7 +2447,7 @@ func (m *redisMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*En
 			for i, e := range es {
 				keys[i] = m.inodeKey(e.Inode)
 			}
-			rs, err := m.rdb.MGet(ctx, keys...).Result()
+			rs, err := rdb.MGet(ctx, keys...).Result()
 			if err != nil {
 				return err
 			}
@@ -2026,6 +2497,19 @@ func (m *redisMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*En
 	return 0
 }
 
+// Entries in a hash are not ordered, so the whole directory is read and sorted, then all the entries after
+// the given name are returned regardless of limit (the next page will be empty).
+func (m *redisMeta) doReaddirPage(ctx Context, inode Ino, plus uint8, after []byte, limit int, entries *[]*Entry) syscall.Errno {
+	var all []*Entry
+	if st := m.doReaddir(ctx, inode, plus, &all, -1); st != 0 {
+		return st
+	}
+	sort.Slice(all, func(i, j int) bool { return bytes.Compare(all[i].Name, all[j].Name) < 0 })
+	i := sort.Search(len(all), func(i int) bool { return bytes.Compare(all[i].Name, after) > 0 })
+	*entries = append(*entries, all[i:]...)
+	return 0
+}
+
 func (m *redisMeta) doCleanStaleSession(sid uint64) error {
 	var fail bool
 	// release locks
@@ -2131,6 +2615,11 @@ func (m *redisMeta) doFindStaleSessions(limit int) ([]uint64, error) {
 func (m *redisMeta) doRefreshSession() error {
 	ctx := Background
 	ssid := strconv.FormatUint(m.sid, 10)
+	if evicted, err := m.rdb.HExists(ctx, m.evictedSessions(), ssid).Result(); err != nil {
+		return err
+	} else if evicted {
+		return errSessionEvicted
+	}
 	// we have to check sessionInfo here because the operations are not within a transaction
 	ok, err := m.rdb.HExists(ctx, m.sessionInfos(), ssid).Result()
 	if err == nil && !ok {
@@ -2145,6 +2634,10 @@ func (m *redisMeta) doRefreshSession() error {
 		Member: ssid}).Err()
 }
 
+func (m *redisMeta) doEvictSession(sid uint64) error {
+	return m.rdb.HSet(Background, m.evictedSessions(), strconv.FormatUint(sid, 10), time.Now().Unix()).Err()
+}
+
 func (m *redisMeta) doDeleteSustainedInode(sid uint64, inode Ino) error {
 	var attr Attr
 	var ctx = Background
@@ -2212,6 +2705,10 @@ func (m *redisMeta) Read(ctx Context, inode Ino, indx uint32, slices *[]Slice) (
 
 func (m *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice, mtime time.Time) syscall.Errno {
 	defer m.timeit("Write", time.Now())
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -2238,7 +2735,7 @@ func (m *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(ctx, tx, inode, attr.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, attr.Uid, attr.Gid, m.getParents(ctx, tx, inode, attr.Parent)...); err != 0 {
 			return err
 		}
 		now := time.Now()
@@ -2267,13 +2764,19 @@ func (m *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 		if needCompact {
 			go m.compactChunk(inode, indx, false)
 		}
+		m.logChange(inode)
 		m.updateParentStat(ctx, inode, attr.Parent, newLength, newSpace)
+		m.updateOwnerQuota(attr.Uid, attr.Gid, newSpace, 0)
 	}
 	return errno(err)
 }
 
 func (m *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
 	defer m.timeit("CopyFileRange", time.Now())
+	if st := m.beginChangeOf(ctx, fout); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(fout)
 	if f != nil {
 		f.Lock()
@@ -2319,7 +2822,7 @@ func (m *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(ctx, tx, fout, attr.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, attr.Uid, attr.Gid, m.getParents(ctx, tx, fout, attr.Parent)...); err != 0 {
 			return err
 		}
 		now := time.Now()
@@ -2398,7 +2901,9 @@ func (m *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 		return err
 	}, m.inodeKey(fout), m.inodeKey(fin))
 	if err == nil {
+		m.logChange(fout)
 		m.updateParentStat(ctx, fout, attr.Parent, newLength, newSpace)
+		m.updateOwnerQuota(attr.Uid, attr.Gid, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -2892,22 +3397,27 @@ func (m *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	skipped := skipSome(ss)
 	ss = ss[skipped:]
 	pos, size, slices := compactChunk(ss)
-	if len(ss) < 2 || size == 0 {
+	if len(ss) < 2 {
 		return
 	}
 
+	// size is 0 when all the slices are covered by holes, they can be dropped directly
 	var id uint64
-	st := m.NewSlice(ctx, &id)
-	if st != 0 {
-		return
-	}
-	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
-	err = m.newMsg(CompactChunk, slices, id)
-	if err != nil {
-		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
-			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+	if size > 0 {
+		st := m.NewSlice(ctx, &id)
+		if st != 0 {
+			return
 		}
-		return
+		logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
+		err = m.newMsg(CompactChunk, slices, id, inode)
+		if err != nil {
+			if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
+				logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+			}
+			return
+		}
+	} else {
+		logger.Debugf("compact %d:%d: drop %d slices covered by holes", inode, indx, len(ss))
 	}
 	var buf []byte         // trash enabled: track delayed slices
 	var rs []*redis.IntCmd // trash disabled: check reference of slices
@@ -2938,11 +3448,15 @@ func (m *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 
 		_, err = tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
 			pipe.LTrim(ctx, key, int64(len(vals)), -1)
-			pipe.LPush(ctx, key, marshalSlice(pos, id, size, 0, size))
+			if id > 0 {
+				pipe.LPush(ctx, key, marshalSlice(pos, id, size, 0, size))
+			}
 			for i := skipped; i > 0; i-- {
 				pipe.LPush(ctx, key, vals[i-1])
 			}
-			pipe.HSet(ctx, m.sliceRefs(), m.sliceKey(id, size), "0") // create the key to tracking it
+			if id > 0 {
+				pipe.HSet(ctx, m.sliceRefs(), m.sliceKey(id, size), "0") // create the key to tracking it
+			}
 			if trash {
 				if len(buf) > 0 {
 					pipe.HSet(ctx, m.delSlices(), fmt.Sprintf("%d_%d", id, time.Now().Unix()), buf)
@@ -2959,7 +3473,7 @@ func (m *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		return err
 	}, key))
 	// there could be false-negative that the compaction is successful, double-check
-	if errno != 0 && errno != syscall.EINVAL {
+	if errno != 0 && errno != syscall.EINVAL && id > 0 {
 		if e := m.rdb.HGet(ctx, m.sliceRefs(), m.sliceKey(id, size)).Err(); e == redis.Nil {
 			errno = syscall.EINVAL // failed
 		} else if e == nil {
@@ -2968,12 +3482,17 @@ func (m *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	}
 
 	if errno == syscall.EINVAL {
-		m.rdb.HIncrBy(ctx, m.sliceRefs(), m.sliceKey(id, size), -1)
-		logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, id, size)
-		m.deleteSlice(id, size)
+		if id > 0 {
+			m.rdb.HIncrBy(ctx, m.sliceRefs(), m.sliceKey(id, size), -1)
+			logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, id, size)
+			m.deleteSlice(id, size)
+		}
 	} else if errno == 0 {
 		m.of.InvalidateChunk(inode, indx)
-		m.cleanupZeroRef(m.sliceKey(id, size))
+		m.logChange(inode)
+		if id > 0 {
+			m.cleanupZeroRef(m.sliceKey(id, size))
+		}
 		if !trash {
 			for i, s := range ss {
 				if s.id > 0 && rs[i].Err() == nil && rs[i].Val() < 0 {
@@ -3110,9 +3629,13 @@ func (m *redisMeta) scan(ctx context.Context, pattern string, f func([]string) e
 }
 
 func (m *redisMeta) hscan(ctx context.Context, key string, f func([]string) error) error {
+	return m.hscanOn(ctx, m.rdb, key, f)
+}
+
+func (m *redisMeta) hscanOn(ctx context.Context, rdb redis.Cmdable, key string, f func([]string) error) error {
 	var cursor uint64
 	for {
-		keys, c, err := m.rdb.HScan(ctx, key, cursor, "*", 10000).Result()
+		keys, c, err := rdb.HScan(ctx, key, cursor, "*", 10000).Result()
 		if err != nil {
 			logger.Warnf("HSCAN %s: %s", key, err)
 			return err
@@ -3425,6 +3948,11 @@ func (m *redisMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte
 }
 
 func (m *redisMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	m.beginWrite() // not in a transaction
+	defer m.endWrite()
+	if m.conf.ReadOnly || m.leaseExpired() || m.isFrozen() {
+		return syscall.EROFS
+	}
 	n, err := m.rdb.HDel(ctx, m.xattrKey(inode), name).Result()
 	if err != nil {
 		return errno(err)
@@ -3435,6 +3963,46 @@ func (m *redisMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.E
 	}
 }
 
+func (m *redisMeta) doSetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno {
+	return errno(m.txn(ctx, func(tx *redis.Tx) error {
+		var attr Attr
+		a, err := tx.Get(ctx, m.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		m.parseAttr(a, &attr)
+		changed, st := m.applyFacl(ctx, &attr, aclType, rule)
+		if st != 0 {
+			return st
+		}
+		if !changed {
+			return nil
+		}
+		now := time.Now()
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, m.inodeKey(inode), m.marshal(&attr), 0)
+			return nil
+		})
+		return err
+	}, m.inodeKey(inode)))
+}
+
+func (m *redisMeta) doGetACL(id uint32) (*ACLRule, error) {
+	buf, err := m.rdb.HGet(Background, m.aclKey(), strconv.FormatUint(uint64(id), 10)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	rule := &ACLRule{}
+	rule.Decode(buf)
+	return rule, nil
+}
+
+func (m *redisMeta) doInsertACL(id uint32, rule *ACLRule) error {
+	return m.rdb.HSet(Background, m.aclKey(), strconv.FormatUint(uint64(id), 10), rule.Encode()).Err()
+}
+
 func (m *redisMeta) doGetQuota(ctx Context, inode Ino) (*Quota, error) {
 	field := inode.String()
 	cmds, err := m.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
@@ -3538,6 +4106,74 @@ func (m *redisMeta) doFlushQuotas(ctx Context, quotas map[Ino]*Quota) error {
 	return err
 }
 
+func (m *redisMeta) doLogChanges(ts int64, inodes []Ino) error {
+	members := make([]redis.Z, 0, len(inodes))
+	for _, inode := range inodes {
+		members = append(members, redis.Z{Score: float64(ts), Member: inode.String()})
+	}
+	for len(members) > 0 {
+		n := len(members)
+		if n > 1000 {
+			n = 1000
+		}
+		if err := m.rdb.ZAdd(Background, m.changelog(), members[:n]...).Err(); err != nil {
+			return err
+		}
+		members = members[n:]
+	}
+	return nil
+}
+
+func (m *redisMeta) doScanChanges(ctx Context, since, until int64, fn func(inode Ino)) error {
+	var offset int64
+	for {
+		vals, err := m.rdb.ZRangeByScore(ctx, m.changelog(), &redis.ZRangeBy{
+			Min:    strconv.FormatInt(since, 10),
+			Max:    "(" + strconv.FormatInt(until, 10),
+			Offset: offset,
+			Count:  10000,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		for _, v := range vals {
+			if inode, err := strconv.ParseUint(v, 10, 64); err == nil {
+				fn(Ino(inode))
+			} else {
+				logger.Warnf("Invalid inode in changelog: %s", v)
+			}
+		}
+		if len(vals) < 10000 {
+			return nil
+		}
+		offset += int64(len(vals))
+	}
+}
+
+func (m *redisMeta) doTrimChanges(before int64) error {
+	return m.rdb.ZRemRangeByScore(Background, m.changelog(), "-inf", "("+strconv.FormatInt(before, 10)).Err()
+}
+
+func (m *redisMeta) doPublishInvalidation(ts int64, msg []byte) error {
+	return m.rdb.Publish(Background, m.invalidationChannel(), msg).Err()
+}
+
+func (m *redisMeta) doSubscribeInvalidation(fn func(msg []byte)) error {
+	sub := m.rdb.Subscribe(Background, m.invalidationChannel())
+	defer sub.Close()
+	for {
+		msg, err := sub.ReceiveMessage(Background)
+		if err != nil {
+			return err
+		}
+		fn([]byte(msg.Payload))
+	}
+}
+
+func (m *redisMeta) doCleanupInvalidation(before int64) error {
+	return nil // nothing is kept by pub/sub
+}
+
 func (m *redisMeta) checkServerConfig() {
 	rawInfo, err := m.rdb.Info(Background).Result()
 	if err != nil {
@@ -3912,6 +4548,15 @@ func (m *redisMeta) DumpMeta(w io.Writer, root Ino, keepSecret bool) (err error)
 		DelFiles:  dels,
 		Quotas:    quotas,
 	}
+	if dm.Inline, err = m.dumpInline(); err != nil {
+		return err
+	}
+	if dm.Dedupe, err = m.dumpBlockHashes(); err != nil {
+		return err
+	}
+	if dm.Packed, err = m.dumpPackedBlocks(); err != nil {
+		return err
+	}
 	if !keepSecret && dm.Setting.SecretKey != "" {
 		dm.Setting.SecretKey = "removed"
 		logger.Warnf("Secret key is removed for the sake of safety")
@@ -3996,6 +4641,7 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, p redis.Pipeliner, tryExec func())
 	} else if attr.Typ == TypeDirectory {
 		attr.Length = 4 << 10
 		dentries := make(map[string]interface{}, batch)
+		folded := make(map[string]interface{})
 		var stat dirStat
 		for name, c := range e.Entries {
 			length := uint64(0)
@@ -4007,8 +4653,15 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, p redis.Pipeliner, tryExec func())
 			stat.inodes++
 
 			dentries[string(unescape(name))] = m.packEntry(typeFromString(c.Attr.Type), c.Attr.Inode)
+			if m.caseFolded(inode) {
+				folded[foldName(string(unescape(name)))] = string(unescape(name))
+			}
 			if len(dentries) >= batch {
 				p.HSet(ctx, m.entryKey(inode), dentries)
+				if len(folded) > 0 {
+					p.HSet(ctx, m.foldKey(inode), folded)
+					folded = make(map[string]interface{})
+				}
 				tryExec()
 				dentries = make(map[string]interface{}, batch)
 			}
@@ -4016,6 +4669,9 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, p redis.Pipeliner, tryExec func())
 		if len(dentries) > 0 {
 			p.HSet(ctx, m.entryKey(inode), dentries)
 		}
+		if len(folded) > 0 {
+			p.HSet(ctx, m.foldKey(inode), folded)
+		}
 		field := inode.String()
 		p.HSet(ctx, m.dirDataLengthKey(), field, stat.length)
 		p.HSet(ctx, m.dirUsedSpaceKey(), field, stat.space)
@@ -4039,7 +4695,7 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, p redis.Pipeliner, tryExec func())
 
 func (m *redisMeta) LoadMeta(r io.Reader) (err error) {
 	ctx := Background
-	if _, ok := m.rdb.(*redis.ClusterClient); ok {
+	if m.prefix != "" {
 		err = m.scan(ctx, "*", func(keys []string) error {
 			return fmt.Errorf("found key with same prefix: %s", keys[0])
 		})
@@ -4052,7 +4708,17 @@ func (m *redisMeta) LoadMeta(r io.Reader) (err error) {
 			return err
 		}
 		if dbsize > 0 {
-			return fmt.Errorf("Database redis://%s is not empty", m.addr)
+			err = m.scan(ctx, "*", func(keys []string) error {
+				for _, k := range keys {
+					if !strings.HasPrefix(k, "{") {
+						return fmt.Errorf("Database redis://%s is not empty", m.addr)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -4080,7 +4746,7 @@ func (m *redisMeta) LoadMeta(r io.Reader) (err error) {
 		}
 	}()
 
-	dm, counters, parents, refs, err := loadEntries(r, func(e *DumpedEntry) { m.loadEntry(e, p, tryExec) }, nil)
+	dm, counters, parents, refs, err := m.loadEntries(r, func(e *DumpedEntry) { m.loadEntry(e, p, tryExec) }, nil)
 	if err != nil {
 		return err
 	}
@@ -4113,6 +4779,26 @@ func (m *redisMeta) LoadMeta(r io.Reader) (err error) {
 		}
 		p.ZAdd(ctx, m.delfiles(), zs...)
 	}
+	for k, v := range dm.Inline {
+		p.Set(ctx, m.inlineKey(k), v, 0)
+		tryExec()
+	}
+	for k, h := range dm.Dedupe {
+		p.Set(ctx, m.blockHashKey(k), h, 0)
+		tryExec()
+	}
+	for h, n := range countBlockRefs(dm.Dedupe) {
+		p.Set(ctx, m.dedupeRefKey(h), n, 0)
+		tryExec()
+	}
+	for k, loc := range dm.Packed {
+		p.Set(ctx, m.packedBlockKey(k), loc, 0)
+		tryExec()
+	}
+	for pack, n := range countPackRefs(dm.Packed) {
+		p.Set(ctx, m.packRefKey(pack), n, 0)
+		tryExec()
+	}
 	slices := make(map[string]interface{})
 	for k, v := range refs {
 		if v > 1 {
@@ -4174,14 +4860,17 @@ func (m *redisMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name strin
 			attr.Atime = now.Unix()
 			attr.Mtime = now.Unix()
 			attr.Ctime = now.Unix()
+			attr.Btime = now.Unix()
 			attr.Atimensec = uint32(now.Nanosecond())
 			attr.Mtimensec = uint32(now.Nanosecond())
 			attr.Ctimensec = uint32(now.Nanosecond())
+			attr.Btimensec = uint32(now.Nanosecond())
 		}
 		// TODO: preserve hardlink
 		if attr.Typ == TypeFile && attr.Nlink > 1 {
 			attr.Nlink = 1
 		}
+		attr.Flags = clonedFlags(attr.Flags, cmode)
 		srcXattr, err := tx.HGetAll(ctx, m.xattrKey(srcIno)).Result()
 		if err != nil {
 			return err
@@ -4220,7 +4909,7 @@ func (m *redisMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name strin
 			if top && attr.Typ == TypeDirectory {
 				p.ZAdd(ctx, m.detachedNodes(), redis.Z{Member: ino.String(), Score: float64(time.Now().Unix())})
 			} else {
-				p.HSet(ctx, m.entryKey(parent), name, m.packEntry(attr.Typ, ino))
+				m.setEntry(ctx, p, parent, name, m.packEntry(attr.Typ, ino))
 				if top {
 					now := time.Now()
 					pattr.Mtime = now.Unix()
@@ -4338,7 +5027,7 @@ func (m *redisMeta) doAttachDirNode(ctx Context, parent Ino, dstIno Ino, name st
 		}
 
 		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
-			p.HSet(ctx, m.entryKey(parent), name, m.packEntry(TypeDirectory, dstIno))
+			m.setEntry(ctx, p, parent, name, m.packEntry(TypeDirectory, dstIno))
 			pattr.Nlink++
 			now := time.Now()
 			pattr.Mtime = now.Unix()
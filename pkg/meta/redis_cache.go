@@ -0,0 +1,341 @@
+//go:build !noredis
+// +build !noredis
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const invalidateChannel = "__redis__:invalidate"
+
+type cachedKey struct {
+	token  uint64
+	expire time.Time
+	fields map[string][]byte // "" for the value of string key, nil value for not existed
+}
+
+// redisCache caches the hot keys in client with server-assisted invalidation (client tracking of Redis 6+).
+//
+// The keys are read by a dedicated client, whose connections enable tracking with REDIRECT to the
+// connection subscribed to __redis__:invalidate, so the invalidation messages are received as normal
+// Pub/Sub messages no matter which protocol is used. When the subscriber is reconnected, the
+// connections with old redirection are dropped together with all the cached keys.
+type redisCache struct {
+	opt        redis.Options
+	size       int
+	ttl        time.Duration
+	readScript func(sha string) bool
+
+	sub      *redis.Client
+	pubsub   *redis.PubSub
+	redirect int64 // client id of the subscriber
+
+	mu      sync.Mutex
+	tracked *redis.Client
+	trackID int64 // the redirect id used by tracked
+	token   uint64
+	keys    map[string]*cachedKey
+}
+
+func newRedisCache(opt *redis.Options, size int, ttl time.Duration) (*redisCache, error) {
+	c := &redisCache{opt: *opt, size: size, ttl: ttl, keys: make(map[string]*cachedKey)}
+	c.opt.OnConnect = nil
+	sopt := c.opt
+	sopt.PoolSize = 1
+	sopt.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		id, err := cn.ClientID(ctx).Result()
+		if err != nil {
+			return err
+		}
+		if old := atomic.SwapInt64(&c.redirect, id); old != 0 && old != id {
+			logger.Infof("Subscriber of invalidation is reconnected (%d -> %d), flush client cache", old, id)
+			c.flush()
+		}
+		return nil
+	}
+	c.sub = redis.NewClient(&sopt)
+	c.pubsub = c.sub.Subscribe(Background, invalidateChannel)
+	if _, err := c.pubsub.Receive(Background); err != nil {
+		_ = c.close()
+		return nil, fmt.Errorf("subscribe %s: %s", invalidateChannel, err)
+	}
+	if _, err := c.client().Ping(Background).Result(); err != nil {
+		_ = c.close()
+		return nil, fmt.Errorf("enable client tracking: %s", err)
+	}
+	go c.invalidator()
+	return c, nil
+}
+
+// client returns the tracked client, which is renewed when the subscriber changed.
+func (c *redisCache) client() *redis.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	redirect := atomic.LoadInt64(&c.redirect)
+	if c.tracked != nil && c.trackID == redirect {
+		return c.tracked
+	}
+	if c.tracked != nil {
+		old := c.tracked
+		go func() { _ = old.Close() }()
+	}
+	topt := c.opt
+	topt.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		return cn.Process(ctx, redis.NewStatusCmd(ctx, "client", "tracking", "on", "redirect", redirect))
+	}
+	c.tracked = redis.NewClient(&topt)
+	c.trackID = redirect
+	c.keys = make(map[string]*cachedKey)
+	return c.tracked
+}
+
+func (c *redisCache) invalidator() {
+	for msg := range c.pubsub.Channel() {
+		if msg.Channel != invalidateChannel {
+			continue
+		}
+		if len(msg.PayloadSlice) == 0 && msg.Payload == "" {
+			c.flush() // FLUSHDB or FLUSHALL
+			continue
+		}
+		c.mu.Lock()
+		for _, k := range msg.PayloadSlice {
+			delete(c.keys, k)
+		}
+		if msg.Payload != "" {
+			delete(c.keys, msg.Payload)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *redisCache) flush() {
+	c.mu.Lock()
+	c.keys = make(map[string]*cachedKey)
+	c.mu.Unlock()
+}
+
+// invalidate drops the keys changed by this client, without waiting for the notification.
+func (c *redisCache) invalidate(keys ...string) {
+	c.mu.Lock()
+	for _, k := range keys {
+		delete(c.keys, k)
+	}
+	c.mu.Unlock()
+}
+
+// reserve returns the field of a key (use empty field for string key) if it's cached, otherwise
+// returns a token to fill it after loaded.
+func (c *redisCache) reserve(key, field string) ([]byte, bool, uint64) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ck := c.keys[key]
+	if ck != nil && now.After(ck.expire) {
+		delete(c.keys, key)
+		ck = nil
+	}
+	if ck != nil {
+		if v, ok := ck.fields[field]; ok {
+			return v, true, 0
+		}
+	} else {
+		if len(c.keys) >= c.size {
+			for k := range c.keys { // evict a random one
+				delete(c.keys, k)
+				break
+			}
+		}
+		c.token++
+		ck = &cachedKey{token: c.token, expire: now.Add(c.ttl), fields: make(map[string][]byte)}
+		c.keys[key] = ck
+	}
+	return nil, false, ck.token
+}
+
+// fill caches the loaded field, it's dropped if the key is invalidated during loading.
+func (c *redisCache) fill(key, field string, token uint64, v []byte) {
+	c.mu.Lock()
+	if ck := c.keys[key]; ck != nil && ck.token == token {
+		ck.fields[field] = v
+	}
+	c.mu.Unlock()
+}
+
+// get returns the field of a key from cache, or loads it from the tracked client.
+func (c *redisCache) get(key, field string, load func(rdb *redis.Client) ([]byte, error)) ([]byte, error) {
+	rdb := c.client()
+	v, ok, token := c.reserve(key, field)
+	if ok {
+		if v == nil {
+			return nil, redis.Nil
+		}
+		return v, nil
+	}
+	v, err := load(rdb)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	c.fill(key, field, token, v)
+	return v, err
+}
+
+// cmdKeys returns the keys accessed by a command.
+func cmdKeys(cmd redis.Cmder) []string {
+	args := cmd.Args()
+	if len(args) < 2 {
+		return nil
+	}
+	var keys []interface{}
+	switch strings.ToLower(cmd.Name()) {
+	case "del", "unlink", "exists", "mget", "watch":
+		keys = args[1:]
+	case "mset", "msetnx":
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+	case "eval", "evalsha":
+		if len(args) > 2 {
+			n, _ := strconv.Atoi(fmt.Sprint(args[2]))
+			if 3+n > len(args) {
+				n = len(args) - 3
+			}
+			keys = args[3 : 3+n]
+		}
+	case "rename", "renamenx", "smove", "rpoplpush", "lmove":
+		keys = args[1:2]
+		if len(args) > 2 {
+			keys = args[1:3]
+		}
+	default:
+		keys = args[1:2]
+	}
+	ks := make([]string, 0, len(keys))
+	for _, k := range keys {
+		switch k := k.(type) {
+		case string:
+			ks = append(ks, k)
+		case []byte:
+			ks = append(ks, string(k))
+		}
+	}
+	return ks
+}
+
+func (c *redisCache) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook drops the keys changed by any command of this client, so they are visible to itself
+// without waiting for the notification.
+func (c *redisCache) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if isWriteCmd(cmd, c.readScript) {
+			c.invalidate(cmdKeys(cmd)...)
+		}
+		return err
+	}
+}
+
+func (c *redisCache) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			if isWriteCmd(cmd, c.readScript) {
+				c.invalidate(cmdKeys(cmd)...)
+			}
+		}
+		return err
+	}
+}
+
+func (c *redisCache) close() error {
+	c.mu.Lock()
+	if c.tracked != nil {
+		_ = c.tracked.Close()
+	}
+	c.mu.Unlock()
+	_ = c.pubsub.Close()
+	return c.sub.Close()
+}
+
+func (m *redisMeta) cachedLookup(ctx Context, entryKey, name string, inode *Ino, attr *Attr) syscall.Errno {
+	rdb := m.cache.client()
+	buf, ok, etoken := m.cache.reserve(entryKey, name)
+	if ok && buf == nil {
+		return syscall.ENOENT
+	}
+	if !ok && len(m.shaLookup) > 0 && attr != nil && !m.conf.CaseInsensi && m.prefix == "" {
+		// keys read by the script are tracked too
+		var returnedIno int64
+		var returnedAttr string
+		res, err := rdb.EvalSha(ctx, m.shaLookup, []string{entryKey, name}).Result()
+		if st := m.handleLuaResult("lookup", res, err, &returnedIno, &returnedAttr); st == 0 {
+			foundIno := Ino(returnedIno)
+			_, _, atoken := m.cache.reserve(m.inodeKey(foundIno), "")
+			m.cache.fill(m.inodeKey(foundIno), "", atoken, []byte(returnedAttr))
+			m.parseAttr([]byte(returnedAttr), attr)
+			m.cache.fill(entryKey, name, etoken, m.packEntry(attr.Typ, foundIno))
+			*inode = foundIno
+			return 0
+		} else if st == syscall.EAGAIN {
+			return m.cachedLookup(ctx, entryKey, name, inode, attr)
+		} else if st != syscall.ENOTSUP {
+			if st == syscall.ENOENT {
+				m.cache.fill(entryKey, name, etoken, nil)
+			}
+			return st
+		}
+	}
+	if !ok {
+		var err error
+		buf, err = rdb.HGet(ctx, entryKey, name).Bytes()
+		if err != nil && err != redis.Nil {
+			return errno(err)
+		}
+		m.cache.fill(entryKey, name, etoken, buf)
+		if err != nil {
+			return errno(err)
+		}
+	}
+	foundType, foundIno := m.parseEntry(buf)
+	a, err := m.cache.get(m.inodeKey(foundIno), "", func(rdb *redis.Client) ([]byte, error) {
+		return rdb.Get(ctx, m.inodeKey(foundIno)).Bytes()
+	})
+	if err == nil {
+		m.parseAttr(a, attr)
+	} else if err == redis.Nil { // corrupt entry
+		logger.Warnf("no attribute for inode %d (%s)", foundIno, name)
+		*attr = Attr{Typ: foundType}
+		err = nil
+	}
+	*inode = foundIno
+	return errno(err)
+}
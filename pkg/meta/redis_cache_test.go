@@ -0,0 +1,164 @@
+//go:build !noredis
+// +build !noredis
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestCmdKeys(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		args []interface{}
+		keys []string
+	}{
+		{[]interface{}{"ping"}, nil},
+		{[]interface{}{"set", "k", "v"}, []string{"k"}},
+		{[]interface{}{"hset", "d1", "name", []byte("v")}, []string{"d1"}},
+		{[]interface{}{"DEL", "a", "b"}, []string{"a", "b"}},
+		{[]interface{}{"mset", "a", "1", "b", "2"}, []string{"a", "b"}},
+		{[]interface{}{"evalsha", "sha", 2, "a", "b", "arg"}, []string{"a", "b"}},
+		{[]interface{}{"evalsha", "sha", 3, "a"}, []string{"a"}},
+		{[]interface{}{"rename", "a", "b"}, []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		keys := cmdKeys(redis.NewCmd(ctx, c.args...))
+		if len(keys) == 0 && len(c.keys) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(keys, c.keys) {
+			t.Fatalf("keys of %v: expect %v, got %v", c.args, c.keys, keys)
+		}
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := &redisCache{size: 2, ttl: time.Minute, keys: make(map[string]*cachedKey)}
+	_, ok, token := c.reserve("d1", "a")
+	if ok {
+		t.Fatalf("should not be cached")
+	}
+	c.fill("d1", "a", token, []byte("v"))
+	if v, ok, _ := c.reserve("d1", "a"); !ok || string(v) != "v" {
+		t.Fatalf("should be cached: %s %t", v, ok)
+	}
+
+	// changed during loading
+	_, _, token = c.reserve("d1", "b")
+	process := c.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error { return nil })
+	_ = process(context.Background(), redis.NewCmd(context.Background(), "hset", "d1", "b", "v2"))
+	c.fill("d1", "b", token, []byte("v1"))
+	if _, ok, _ = c.reserve("d1", "b"); ok {
+		t.Fatalf("stale value should be dropped")
+	}
+	if _, ok, _ = c.reserve("d1", "a"); ok {
+		t.Fatalf("all fields of changed key should be dropped")
+	}
+
+	// reads don't invalidate
+	_, _, token = c.reserve("i1", "")
+	c.fill("i1", "", token, []byte("attr"))
+	_ = process(context.Background(), redis.NewCmd(context.Background(), "get", "i1"))
+	if _, ok, _ = c.reserve("i1", ""); !ok {
+		t.Fatalf("should be cached after read")
+	}
+	pipeline := c.ProcessPipelineHook(func(ctx context.Context, cmds []redis.Cmder) error { return nil })
+	_ = pipeline(context.Background(), []redis.Cmder{redis.NewCmd(context.Background(), "incrby", "i1", 1)})
+	if _, ok, _ = c.reserve("i1", ""); ok {
+		t.Fatalf("should be dropped after changed in pipeline")
+	}
+}
+
+func TestRedisClientCache(t *testing.T) { //skip mutate
+	m, err := newRedisMeta("redis", "127.0.0.1:6379/11?client-cache=1000", testConfig())
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	r := m.(*redisMeta)
+	if r.cache == nil {
+		t.Skipf("client-side caching is not supported")
+	}
+	defer m.Shutdown()
+	_ = m.Reset()
+	if err = m.Init(testFormat(), true); err != nil {
+		t.Fatalf("initialize failed: %s", err)
+	}
+	if err = m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	defer m.CloseSession()
+
+	ctx := Background
+	var inode, found Ino
+	attr := &Attr{}
+	if st := m.Lookup(ctx, RootInode, "d", &found, attr, false); st != syscall.ENOENT {
+		t.Fatalf("lookup d: %s", st)
+	}
+	if st := m.Mkdir(ctx, RootInode, "d", 0755, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	if st := m.Lookup(ctx, RootInode, "d", &found, attr, false); st != 0 || found != inode {
+		t.Fatalf("lookup d: %s %d", st, found)
+	}
+	// changed by transaction
+	attr.Mode = 0700
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, attr); st != 0 {
+		t.Fatalf("setattr d: %s", st)
+	}
+	if st := m.Lookup(ctx, RootInode, "d", &found, attr, false); st != 0 || attr.Mode != 0700 {
+		t.Fatalf("lookup d after chmod: %s %o", st, attr.Mode)
+	}
+	// changed without transaction
+	attr.Mode = 0711
+	if err = r.rdb.Set(ctx, r.inodeKey(inode), r.marshal(attr), 0).Err(); err != nil {
+		t.Fatalf("set attr: %s", err)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Mode != 0711 {
+		t.Fatalf("getattr d after set: %s %o", st, attr.Mode)
+	}
+	// changed by another client
+	m2, err := newRedisMeta("redis", "127.0.0.1:6379/11", testConfig())
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	defer m2.Shutdown()
+	if _, err = m2.Load(true); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if st := m2.Rmdir(ctx, RootInode, "d"); st != 0 {
+		t.Fatalf("rmdir d: %s", st)
+	}
+	var st syscall.Errno
+	for i := 0; i < 100; i++ {
+		if st = m.Lookup(ctx, RootInode, "d", &found, attr, false); st == syscall.ENOENT {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if st != syscall.ENOENT {
+		t.Fatalf("lookup d after removed by another client: %s", st)
+	}
+}
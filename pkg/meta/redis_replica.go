@@ -0,0 +1,263 @@
+//go:build !noredis
+// +build !noredis
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type replOffset struct {
+	ts     time.Time
+	offset int64
+}
+
+type redisReplica struct {
+	client   *redis.Client
+	syncedAt int64 // unix nano, the replica has all the changes before it
+}
+
+// redisReplicas routes the non-transactional reads to replicas, whose lag is bounded by maxStaleness.
+//
+// The replication offset of primary is sampled periodically, a replica has all the changes made
+// before a sample if its offset is not less than that of the sample, so it's safe to read from
+// the replica until maxStaleness after that. The changes made by this client are always visible
+// to itself, since a replica is only used after it caught up with the last change.
+type redisReplicas struct {
+	primary      redis.UniversalClient
+	replicas     []*redisReplica
+	maxStaleness time.Duration
+	lastWrite    int64 // unix nano
+	readScript   func(sha string) bool
+	done         chan struct{}
+
+	mu      sync.Mutex
+	samples []replOffset
+}
+
+// commands that never change anything in primary, all the others are treated as writes.
+var redisReadCmds = map[string]bool{
+	"get": true, "mget": true, "strlen": true, "getrange": true, "exists": true, "type": true,
+	"ttl": true, "pttl": true, "scan": true, "keys": true, "dbsize": true,
+	"hget": true, "hmget": true, "hgetall": true, "hexists": true, "hlen": true, "hkeys": true, "hvals": true, "hscan": true,
+	"smembers": true, "sismember": true, "scard": true, "sscan": true,
+	"zrange": true, "zrangebyscore": true, "zrevrange": true, "zscore": true, "zcard": true, "zcount": true, "zscan": true,
+	"lrange": true, "llen": true, "lindex": true,
+	"ping": true, "info": true, "hello": true, "auth": true, "select": true, "client": true, "config": true,
+	"time": true, "watch": true, "unwatch": true, "script": true,
+}
+
+// isWriteCmd tells whether a command may change something, readScript tells whether a script is read-only.
+func isWriteCmd(cmd redis.Cmder, readScript func(sha string) bool) bool {
+	name := strings.ToLower(cmd.Name())
+	if redisReadCmds[name] {
+		return false
+	}
+	if name == "evalsha" && readScript != nil {
+		if args := cmd.Args(); len(args) > 1 {
+			if sha, ok := args[1].(string); ok && readScript(sha) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r *redisReplicas) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook marks the changes made by any command, so they are visible to the following reads.
+func (r *redisReplicas) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if isWriteCmd(cmd, r.readScript) {
+			r.wrote() // it may be changed even if failed
+		}
+		return err
+	}
+}
+
+func (r *redisReplicas) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			if isWriteCmd(cmd, r.readScript) {
+				r.wrote()
+				break
+			}
+		}
+		return err
+	}
+}
+
+func newRedisReplicas(primary redis.UniversalClient, opt *redis.Options, addrs string, maxStaleness time.Duration) *redisReplicas {
+	r := &redisReplicas{primary: primary, maxStaleness: maxStaleness, done: make(chan struct{})}
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "6379")
+		}
+		ropt := *opt
+		ropt.Addr = addr
+		r.replicas = append(r.replicas, &redisReplica{client: redis.NewClient(&ropt)})
+	}
+	primary.AddHook(r)
+	go r.refresh()
+	return r
+}
+
+func parseReplInfo(info, field string) (int64, bool) {
+	var linkUp = true
+	var offset int64 = -1
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "master_link_status":
+			linkUp = kv[1] == "up"
+		case field:
+			offset, _ = strconv.ParseInt(kv[1], 10, 64)
+		}
+	}
+	return offset, linkUp && offset >= 0
+}
+
+func (r *redisReplicas) interval() time.Duration {
+	d := r.maxStaleness / 4
+	if d < time.Millisecond*100 {
+		d = time.Millisecond * 100
+	}
+	return d
+}
+
+func (r *redisReplicas) refresh() {
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+	for {
+		r.check()
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check samples the offset of primary, then updates the time that each replica is synced to.
+func (r *redisReplicas) check() {
+	ctx := Background
+	info, err := r.primary.Info(ctx, "replication").Result()
+	if err != nil {
+		logger.Warnf("Get replication info of primary: %s", err)
+		return
+	}
+	offset, ok := parseReplInfo(info, "master_repl_offset")
+	if !ok {
+		logger.Warnf("No replication offset found in primary")
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	r.samples = append(r.samples, replOffset{now, offset})
+	var i int
+	for i < len(r.samples)-1 && now.Sub(r.samples[i].ts) > r.maxStaleness {
+		i++
+	}
+	r.samples = r.samples[i:]
+	samples := r.samples
+	r.mu.Unlock()
+
+	for _, rep := range r.replicas {
+		info, err := rep.client.Info(ctx, "replication").Result()
+		if err != nil {
+			logger.Debugf("Get replication info of replica %s: %s", rep.client.Options().Addr, err)
+			continue
+		}
+		offset, ok := parseReplInfo(info, "slave_repl_offset")
+		if !ok {
+			logger.Debugf("Replica %s is not connected to primary", rep.client.Options().Addr)
+			continue
+		}
+		for j := len(samples) - 1; j >= 0; j-- {
+			if samples[j].offset <= offset {
+				if ts := samples[j].ts.UnixNano(); ts > atomic.LoadInt64(&rep.syncedAt) {
+					atomic.StoreInt64(&rep.syncedAt, ts)
+				}
+				break
+			}
+		}
+	}
+}
+
+// wrote is called after this client changed something in primary.
+func (r *redisReplicas) wrote() {
+	atomic.StoreInt64(&r.lastWrite, time.Now().UnixNano())
+}
+
+// pick returns a replica that is fresh enough, or nil if there is none.
+func (r *redisReplicas) pick() *redis.Client {
+	if len(r.replicas) == 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	lastWrite := atomic.LoadInt64(&r.lastWrite)
+	start := rand.Intn(len(r.replicas))
+	for i := range r.replicas {
+		rep := r.replicas[(start+i)%len(r.replicas)]
+		syncedAt := atomic.LoadInt64(&rep.syncedAt)
+		if syncedAt > lastWrite && now < syncedAt+int64(r.maxStaleness) {
+			return rep.client
+		}
+	}
+	return nil
+}
+
+func (r *redisReplicas) close() {
+	close(r.done)
+	for _, rep := range r.replicas {
+		_ = rep.client.Close()
+	}
+}
+
+// reader returns the client for non-transactional reads.
+func (m *redisMeta) reader() (redis.Cmdable, bool) {
+	if m.replicas != nil {
+		if c := m.replicas.pick(); c != nil {
+			return c, true
+		}
+	}
+	return m.rdb, false
+}
@@ -0,0 +1,112 @@
+//go:build !noredis
+// +build !noredis
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestParseReplInfo(t *testing.T) {
+	primary := "# Replication\r\nrole:master\r\nconnected_slaves:1\r\nmaster_repl_offset:12345\r\n"
+	if offset, ok := parseReplInfo(primary, "master_repl_offset"); !ok || offset != 12345 {
+		t.Fatalf("primary offset: %d %t", offset, ok)
+	}
+	replica := "# Replication\r\nrole:slave\r\nmaster_link_status:up\r\nslave_repl_offset:12000\r\n"
+	if offset, ok := parseReplInfo(replica, "slave_repl_offset"); !ok || offset != 12000 {
+		t.Fatalf("replica offset: %d %t", offset, ok)
+	}
+	down := "# Replication\r\nrole:slave\r\nmaster_link_status:down\r\nslave_repl_offset:12000\r\n"
+	if _, ok := parseReplInfo(down, "slave_repl_offset"); ok {
+		t.Fatalf("replica with link down should not be used")
+	}
+	if _, ok := parseReplInfo("# Replication\r\nrole:master\r\n", "master_repl_offset"); ok {
+		t.Fatalf("info without offset should not be used")
+	}
+}
+
+func TestReplicaPick(t *testing.T) {
+	r := &redisReplicas{maxStaleness: time.Second, done: make(chan struct{})}
+	if r.pick() != nil {
+		t.Fatalf("no replica")
+	}
+	for _, addr := range []string{"127.0.0.1:1", "127.0.0.1:2"} {
+		r.replicas = append(r.replicas, &redisReplica{client: redis.NewClient(&redis.Options{Addr: addr})})
+	}
+	defer r.close()
+	if r.pick() != nil {
+		t.Fatalf("replicas are not synced yet")
+	}
+	now := time.Now()
+	r.replicas[1].syncedAt = now.UnixNano()
+	for i := 0; i < 10; i++ {
+		if c := r.pick(); c != r.replicas[1].client {
+			t.Fatalf("should pick the synced replica, got %v", c)
+		}
+	}
+	r.wrote()
+	if r.pick() != nil {
+		t.Fatalf("replica is behind the last write")
+	}
+	r.replicas[0].syncedAt = time.Now().UnixNano()
+	if c := r.pick(); c != r.replicas[0].client {
+		t.Fatalf("should pick the replica synced after the last write, got %v", c)
+	}
+	r.replicas[0].syncedAt = now.Add(-time.Second * 2).UnixNano()
+	if r.pick() != nil {
+		t.Fatalf("stale replica should not be used")
+	}
+}
+
+func TestReplicaHook(t *testing.T) {
+	r := &redisReplicas{maxStaleness: time.Second, done: make(chan struct{})}
+	r.readScript = func(sha string) bool { return sha == "lookup" }
+	ctx := context.Background()
+	process := r.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error { return nil })
+	for _, args := range [][]interface{}{{"get", "k"}, {"HGETALL", "k"}, {"info", "replication"}, {"evalsha", "lookup", 1, "k"}} {
+		_ = process(ctx, redis.NewCmd(ctx, args...))
+		if r.lastWrite != 0 {
+			t.Fatalf("%v should not be a write", args)
+		}
+	}
+	for _, args := range [][]interface{}{{"set", "k", "v"}, {"evalsha", "other", 1, "k"}, {"hincrby", "k", "f", 1}} {
+		r.lastWrite = 0
+		_ = process(ctx, redis.NewCmd(ctx, args...))
+		if r.lastWrite == 0 {
+			t.Fatalf("%v should be a write", args)
+		}
+	}
+	r.lastWrite = 0
+	pipeline := r.ProcessPipelineHook(func(ctx context.Context, cmds []redis.Cmder) error { return nil })
+	_ = pipeline(ctx, []redis.Cmder{redis.NewCmd(ctx, "get", "a"), redis.NewCmd(ctx, "del", "b")})
+	if r.lastWrite == 0 {
+		t.Fatalf("pipeline with del should be a write")
+	}
+
+	r.close()
+	select {
+	case <-r.done:
+	default:
+		t.Fatalf("refresh should be stopped after closed")
+	}
+}
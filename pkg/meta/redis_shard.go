@@ -0,0 +1,849 @@
+//go:build !noredis
+// +build !noredis
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	shardBits   = 48 // the id of shard is kept in bits 48-55 of inode
+	maxShards   = 256
+	shardVnodes = 64 // virtual nodes of each shard in the hash ring
+)
+
+func init() {
+	Register("shards", newShardedMeta)
+}
+
+type shardPoint struct {
+	hash  uint32
+	shard int
+}
+
+// shardedMeta spreads the metadata of one volume across multiple Redis servers (shards).
+//
+// The entries in root directory are placed into shards by consistent hashing of their names, and the
+// whole subtree of a top-level entry lives in the same shard, so all the operations below root are
+// done by the transactions of a single shard. The id of shard is encoded into the inodes it allocates,
+// so any inode can be routed to its shard. The root directory is the union of the roots of all shards.
+//
+// The shard of every name used in root directory is recorded in an index in the first shard, which is
+// set only once (HSETNX), so all the clients create, look up and rename an entry of the same name in
+// the same shard, where the existence of it is checked atomically by the transaction. The names are
+// kept in the index after the entries are removed, so an entry is never placed into two shards, even
+// when shards are added. Renaming or linking across shards returns EXDEV.
+//
+// The first shard keeps the sessions, the counter of slices, and the blocks kept in meta engine (inline,
+// deduplicated or packed), so slice ids are unique in the volume. It also keeps the quotas of users and
+// groups, which are shared by the clients of all the shards, so the usage of an owner is checked against
+// the limit once for the whole volume.
+type shardedMeta struct {
+	Meta   // the first shard
+	shards []Meta
+	ring   []shardPoint
+	index  *redisMeta // the first shard, which keeps the shards of the names in root
+	fixed  int        // the shard of mounted subdir, -1 if the root is mounted
+}
+
+// newShardedMeta creates a client with the addresses of shards separated by ";", for example,
+// shards://redis://host1:6379/1;redis://host2:6379/1, new shards should be appended to the end.
+func newShardedMeta(driver, addr string, conf *Config) (Meta, error) {
+	addrs := strings.Split(addr, ";")
+	if len(addrs) > maxShards {
+		return nil, fmt.Errorf("too many shards: %d > %d", len(addrs), maxShards)
+	}
+	m := &shardedMeta{fixed: -1}
+	for i, a := range addrs {
+		p := strings.Index(a, "://")
+		if p < 0 {
+			a = "redis://" + a
+			p = 5
+		}
+		d := a[:p]
+		if d != "redis" && d != "rediss" && d != "unix" {
+			m.shutdown()
+			return nil, fmt.Errorf("shard %d: only Redis is supported, got %s", i, d)
+		}
+		c := *conf
+		s, err := newRedisMeta(d, a[p+3:], &c)
+		if err != nil {
+			m.shutdown()
+			return nil, fmt.Errorf("shard %d: %s", i, err)
+		}
+		base := s.getBase()
+		base.inodeBase = Ino(i) << shardBits
+		if i > 0 {
+			base.sliceSource = m.shards[0].getBase()
+			base.quotaSource = m.shards[0].getBase()
+		}
+		m.shards = append(m.shards, s)
+	}
+	first := m.shards[0].getBase()
+	for _, s := range m.shards {
+		first.quotaShards = append(first.quotaShards, s.getBase())
+	}
+	m.Meta = m.shards[0]
+	m.index = m.shards[0].(*redisMeta)
+	m.ring = newShardRing(len(m.shards))
+	return m, nil
+}
+
+func newShardRing(n int) []shardPoint {
+	var ring []shardPoint
+	for s := 0; s < n; s++ {
+		for v := 0; v < shardVnodes; v++ {
+			ring = append(ring, shardPoint{shardHash(fmt.Sprintf("shard-%d-%d", s, v)), s})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func shardHash(name string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return h.Sum32()
+}
+
+func shardOf(inode Ino) int {
+	if inode >= 1<<(shardBits+8) { // trash or other special inodes
+		return 0
+	}
+	return int(inode >> shardBits)
+}
+
+// hashed returns the shard of a new entry in root directory.
+func (m *shardedMeta) hashed(name string) int {
+	h := shardHash(name)
+	i := sort.Search(len(m.ring), func(i int) bool { return m.ring[i].hash >= h })
+	if i == len(m.ring) {
+		i = 0
+	}
+	return m.ring[i].shard
+}
+
+// idOf returns the id of the shard of an inode.
+func (m *shardedMeta) idOf(inode Ino) int {
+	if m.fixed >= 0 {
+		return m.fixed
+	}
+	if s := shardOf(inode); s < len(m.shards) {
+		return s
+	}
+	return 0 // the shard will return ENOENT
+}
+
+// of returns the shard of an inode.
+func (m *shardedMeta) of(inode Ino) Meta {
+	return m.shards[m.idOf(inode)]
+}
+
+func (m *shardedMeta) isRoot(inode Ino) bool {
+	return m.fixed < 0 && inode == RootInode
+}
+
+func (m *shardedMeta) indexKey() string {
+	return m.index.prefix + "rootShards"
+}
+
+// locate returns the shard of a name in root directory from the index, ENOENT if it's never used.
+func (m *shardedMeta) locate(ctx Context, name string) (int, syscall.Errno) {
+	s, err := m.index.rdb.HGet(ctx, m.indexKey(), name).Int()
+	if err == redis.Nil {
+		return -1, syscall.ENOENT
+	} else if err != nil {
+		return -1, errno(err)
+	}
+	if s >= len(m.shards) {
+		logger.Errorf("%s is placed in shard %d, but there are only %d shards", name, s, len(m.shards))
+		return -1, syscall.EIO
+	}
+	return s, 0
+}
+
+// place returns the shard of a name in root directory, it's placed into the given shard if it's
+// never used, otherwise the shard recorded in the index is returned.
+func (m *shardedMeta) place(ctx Context, name string, shard int) (int, syscall.Errno) {
+	ok, err := m.index.rdb.HSetNX(ctx, m.indexKey(), name, shard).Result()
+	if err != nil {
+		return -1, errno(err)
+	}
+	if ok {
+		return shard, 0
+	}
+	return m.locate(ctx, name)
+}
+
+// parentOf returns the shard to change an entry of a directory.
+func (m *shardedMeta) parentOf(ctx Context, parent Ino, name string) (Meta, syscall.Errno) {
+	if !m.isRoot(parent) || name == "." || name == ".." || name == "" {
+		return m.of(parent), 0
+	}
+	s, st := m.locate(ctx, name)
+	if st != 0 {
+		return nil, st
+	}
+	return m.shards[s], 0
+}
+
+// pathOf returns the shard of an absolute path.
+func (m *shardedMeta) pathOf(ctx Context, p string) (Meta, syscall.Errno) {
+	if m.fixed >= 0 {
+		return m.shards[m.fixed], 0
+	}
+	top := strings.SplitN(strings.Trim(p, "/"), "/", 2)[0]
+	if top == "" {
+		return nil, 0 // root
+	}
+	s, st := m.locate(ctx, top)
+	if st != 0 {
+		return nil, st
+	}
+	return m.shards[s], 0
+}
+
+func (m *shardedMeta) each(f func(s Meta) error) error {
+	for i, s := range m.shards {
+		if err := f(s); err != nil {
+			if len(m.shards) == 1 {
+				return err
+			}
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (m *shardedMeta) eachErrno(f func(s Meta) syscall.Errno) syscall.Errno {
+	for _, s := range m.shards {
+		if st := f(s); st != 0 {
+			return st
+		}
+	}
+	return 0
+}
+
+func (m *shardedMeta) shutdown() {
+	for _, s := range m.shards {
+		_ = s.Shutdown()
+	}
+}
+
+func (m *shardedMeta) Init(format *Format, force bool) error {
+	if format.TrashDays > 0 || len(format.TrashPolicies) > 0 {
+		// the inodes of trash are not unique across shards
+		logger.Warnf("Trash is not supported for sharded metadata, disable it")
+		format.TrashDays = 0
+		format.TrashPolicies = nil
+	}
+	return m.each(func(s Meta) error { return s.Init(format, force) })
+}
+
+func (m *shardedMeta) Load(checkVersion bool) (*Format, error) {
+	format, err := m.shards[0].Load(checkVersion)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range m.shards[1:] {
+		f, err := s.Load(checkVersion)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %s", i+1, err)
+		}
+		if f.UUID != format.UUID {
+			return nil, fmt.Errorf("shard %d belongs to another volume (%s != %s)", i+1, f.UUID, format.UUID)
+		}
+	}
+	return format, nil
+}
+
+func (m *shardedMeta) Shutdown() error {
+	return m.each(func(s Meta) error { return s.Shutdown() })
+}
+
+func (m *shardedMeta) Reset() error {
+	return m.each(func(s Meta) error { return s.Reset() })
+}
+
+func (m *shardedMeta) NewSession() error {
+	return m.each(func(s Meta) error { return s.NewSession() })
+}
+
+func (m *shardedMeta) CloseSession() error {
+	return m.each(func(s Meta) error { return s.CloseSession() })
+}
+
+func (m *shardedMeta) CleanStaleSessions() {
+	_ = m.each(func(s Meta) error { s.CleanStaleSessions(); return nil })
+}
+
+func (m *shardedMeta) OnMsg(mtype uint32, cb MsgCallback) {
+	_ = m.each(func(s Meta) error { s.OnMsg(mtype, cb); return nil })
+}
+
+func (m *shardedMeta) InitMetrics(reg prometheus.Registerer) {
+	m.shards[0].InitMetrics(reg) // the metrics of other shards can't be registered twice
+}
+
+func (m *shardedMeta) ScanDeletedObject(ctx Context, tss trashSliceScan, pss pendingSliceScan, tfs trashFileScan, pfs pendingFileScan) error {
+	return m.each(func(s Meta) error { return s.ScanDeletedObject(ctx, tss, pss, tfs, pfs) })
+}
+
+func (m *shardedMeta) ListLocks(ctx context.Context, inode Ino) ([]PLockItem, []FLockItem, error) {
+	return m.of(inode).ListLocks(ctx, inode)
+}
+
+func (m *shardedMeta) CleanupTrashBefore(ctx Context, edge time.Time, increProgress func(int)) {
+	_ = m.each(func(s Meta) error { s.CleanupTrashBefore(ctx, edge, increProgress); return nil })
+}
+
+func (m *shardedMeta) CleanupDetachedNodesBefore(ctx Context, edge time.Time, increProgress func()) {
+	_ = m.each(func(s Meta) error { s.CleanupDetachedNodesBefore(ctx, edge, increProgress); return nil })
+}
+
+func (m *shardedMeta) StatFS(ctx Context, ino Ino, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
+	if !m.isRoot(ino) {
+		return m.of(ino).StatFS(ctx, ino, totalspace, availspace, iused, iavail)
+	}
+	var total, used, itotal, iusedSum uint64
+	for _, s := range m.shards {
+		var t, a, iu, ia uint64
+		if st := s.StatFS(ctx, ino, &t, &a, &iu, &ia); st != 0 {
+			return st
+		}
+		if t > total {
+			total = t
+		}
+		if t > a {
+			used += t - a
+		}
+		if iu+ia > itotal {
+			itotal = iu + ia
+		}
+		iusedSum += iu
+	}
+	if used > total {
+		total = used
+	}
+	if iusedSum > itotal {
+		itotal = iusedSum
+	}
+	*totalspace, *availspace = total, total-used
+	*iused, *iavail = iusedSum, itotal-iusedSum
+	return 0
+}
+
+func (m *shardedMeta) Access(ctx Context, inode Ino, modemask uint8, attr *Attr) syscall.Errno {
+	return m.of(inode).Access(ctx, inode, modemask, attr)
+}
+
+func (m *shardedMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr, checkPerm bool) syscall.Errno {
+	if !m.isRoot(parent) || name == "." || name == ".." {
+		return m.of(parent).Lookup(ctx, parent, name, inode, attr, checkPerm)
+	}
+	s, st := m.locate(ctx, name)
+	if st != 0 {
+		return st
+	}
+	return m.shards[s].Lookup(ctx, parent, name, inode, attr, checkPerm)
+}
+
+func (m *shardedMeta) ResolveCase(ctx Context, parent Ino, name string) *Entry {
+	if !m.isRoot(parent) {
+		return m.of(parent).ResolveCase(ctx, parent, name)
+	}
+	for _, s := range m.shards {
+		if e := s.ResolveCase(ctx, parent, name); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (m *shardedMeta) Resolve(ctx Context, parent Ino, path string, inode *Ino, attr *Attr) syscall.Errno {
+	if m.isRoot(parent) {
+		return syscall.ENOTSUP
+	}
+	return m.of(parent).Resolve(ctx, parent, path, inode, attr)
+}
+
+func (m *shardedMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+	return m.of(inode).GetAttr(ctx, inode, attr)
+}
+
+func (m *shardedMeta) SetAttr(ctx Context, inode Ino, set uint16, sggidclearmode uint8, attr *Attr) syscall.Errno {
+	return m.of(inode).SetAttr(ctx, inode, set, sggidclearmode, attr)
+}
+
+func (m *shardedMeta) CheckSetAttr(ctx Context, inode Ino, set uint16, attr Attr) syscall.Errno {
+	return m.of(inode).CheckSetAttr(ctx, inode, set, attr)
+}
+
+func (m *shardedMeta) Truncate(ctx Context, inode Ino, flags uint8, attrlength uint64, attr *Attr, skipPermCheck bool) syscall.Errno {
+	return m.of(inode).Truncate(ctx, inode, flags, attrlength, attr, skipPermCheck)
+}
+
+func (m *shardedMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	return m.of(inode).Fallocate(ctx, inode, mode, off, size)
+}
+
+func (m *shardedMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno {
+	return m.of(inode).ReadLink(ctx, inode, path)
+}
+
+// creator returns the shard to create a new entry, which checks whether it exists.
+func (m *shardedMeta) creator(ctx Context, parent Ino, name string) (Meta, syscall.Errno) {
+	if !m.isRoot(parent) {
+		return m.of(parent), 0
+	}
+	s, st := m.place(ctx, name, m.hashed(name))
+	if st != 0 {
+		return nil, st
+	}
+	return m.shards[s], 0
+}
+
+// linker returns EXDEV if a new entry of the directory can't be in the shard s.
+func (m *shardedMeta) linker(ctx Context, parent Ino, name string, s int) syscall.Errno {
+	t := m.idOf(parent)
+	if m.isRoot(parent) {
+		var st syscall.Errno
+		if t, st = m.place(ctx, name, s); st != 0 {
+			return st
+		}
+	}
+	if t != s {
+		return syscall.EXDEV
+	}
+	return 0
+}
+
+func (m *shardedMeta) Symlink(ctx Context, parent Ino, name string, path string, inode *Ino, attr *Attr) syscall.Errno {
+	s, st := m.creator(ctx, parent, name)
+	if st != 0 {
+		return st
+	}
+	return s.Symlink(ctx, parent, name, path, inode, attr)
+}
+
+func (m *shardedMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode uint16, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
+	s, st := m.creator(ctx, parent, name)
+	if st != 0 {
+		return st
+	}
+	return s.Mknod(ctx, parent, name, _type, mode, cumask, rdev, path, inode, attr)
+}
+
+func (m *shardedMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16, copysgid uint8, inode *Ino, attr *Attr) syscall.Errno {
+	s, st := m.creator(ctx, parent, name)
+	if st != 0 {
+		return st
+	}
+	return s.Mkdir(ctx, parent, name, mode, cumask, copysgid, inode, attr)
+}
+
+func (m *shardedMeta) Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+	s, st := m.creator(ctx, parent, name)
+	if st != 0 {
+		return st
+	}
+	return s.Create(ctx, parent, name, mode, cumask, flags, inode, attr)
+}
+
+func (m *shardedMeta) TmpFile(ctx Context, parent Ino, mode uint16, cumask uint16, inode *Ino, attr *Attr) syscall.Errno {
+	return m.of(parent).TmpFile(ctx, parent, mode, cumask, inode, attr)
+}
+
+func (m *shardedMeta) Unlink(ctx Context, parent Ino, name string, skipCheckTrash ...bool) syscall.Errno {
+	s, st := m.parentOf(ctx, parent, name)
+	if st != 0 {
+		return st
+	}
+	return s.Unlink(ctx, parent, name, skipCheckTrash...)
+}
+
+func (m *shardedMeta) Rmdir(ctx Context, parent Ino, name string, skipCheckTrash ...bool) syscall.Errno {
+	s, st := m.parentOf(ctx, parent, name)
+	if st != 0 {
+		return st
+	}
+	return s.Rmdir(ctx, parent, name, skipCheckTrash...)
+}
+
+func (m *shardedMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+	src := m.idOf(parentSrc)
+	if m.isRoot(parentSrc) && nameSrc != "." && nameSrc != ".." {
+		var st syscall.Errno
+		if src, st = m.locate(ctx, nameSrc); st != 0 {
+			return st
+		}
+	}
+	if st := m.linker(ctx, parentDst, nameDst, src); st != 0 {
+		return st
+	}
+	return m.shards[src].Rename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, attr)
+}
+
+func (m *shardedMeta) Link(ctx Context, inodeSrc, parent Ino, name string, attr *Attr) syscall.Errno {
+	if st := m.linker(ctx, parent, name, m.idOf(inodeSrc)); st != 0 {
+		return st
+	}
+	return m.of(inodeSrc).Link(ctx, inodeSrc, parent, name, attr)
+}
+
+func (m *shardedMeta) Readdir(ctx Context, inode Ino, wantattr uint8, entries *[]*Entry) syscall.Errno {
+	if !m.isRoot(inode) {
+		return m.of(inode).Readdir(ctx, inode, wantattr, entries)
+	}
+	return m.ReaddirPage(ctx, inode, wantattr, nil, 0, entries)
+}
+
+func (m *shardedMeta) ReaddirPage(ctx Context, inode Ino, wantattr uint8, after []byte, limit int, entries *[]*Entry) syscall.Errno {
+	if !m.isRoot(inode) {
+		return m.of(inode).ReaddirPage(ctx, inode, wantattr, after, limit, entries)
+	}
+	var dots, all []*Entry
+	for i, s := range m.shards {
+		var es []*Entry
+		var st syscall.Errno
+		if limit > 0 {
+			st = s.ReaddirPage(ctx, inode, wantattr, after, limit, &es)
+		} else {
+			st = s.Readdir(ctx, inode, wantattr, &es)
+		}
+		if st != 0 {
+			return st
+		}
+		for _, e := range es {
+			if name := string(e.Name); name == "." || name == ".." {
+				if i == 0 {
+					dots = append(dots, e)
+				}
+			} else if i == 0 || name != TrashName {
+				all = append(all, e)
+			}
+		}
+	}
+	if limit > 0 {
+		sort.Slice(all, func(i, j int) bool { return bytes.Compare(all[i].Name, all[j].Name) < 0 })
+		if len(all) > limit {
+			all = all[:limit]
+		}
+	}
+	*entries = append(append(*entries, dots...), all...)
+	return 0
+}
+
+func (m *shardedMeta) Open(ctx Context, inode Ino, flags uint32, attr *Attr) syscall.Errno {
+	return m.of(inode).Open(ctx, inode, flags, attr)
+}
+
+func (m *shardedMeta) Close(ctx Context, inode Ino) syscall.Errno {
+	return m.of(inode).Close(ctx, inode)
+}
+
+func (m *shardedMeta) Read(ctx Context, inode Ino, indx uint32, slices *[]Slice) syscall.Errno {
+	return m.of(inode).Read(ctx, inode, indx, slices)
+}
+
+func (m *shardedMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice, mtime time.Time) syscall.Errno {
+	return m.of(inode).Write(ctx, inode, indx, off, slice, mtime)
+}
+
+func (m *shardedMeta) InvalidateChunkCache(ctx Context, inode Ino, indx uint32) syscall.Errno {
+	return m.of(inode).InvalidateChunkCache(ctx, inode, indx)
+}
+
+func (m *shardedMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
+	if m.of(fin) != m.of(fout) {
+		return syscall.EXDEV
+	}
+	return m.of(fin).CopyFileRange(ctx, fin, offIn, fout, offOut, size, flags, copied)
+}
+
+func (m *shardedMeta) GetParents(ctx Context, inode Ino) map[Ino]int {
+	return m.of(inode).GetParents(ctx, inode)
+}
+
+func (m *shardedMeta) GetDirStat(ctx Context, inode Ino) (*dirStat, syscall.Errno) {
+	if !m.isRoot(inode) {
+		return m.of(inode).GetDirStat(ctx, inode)
+	}
+	var sum dirStat
+	for _, s := range m.shards {
+		stat, st := s.GetDirStat(ctx, inode)
+		if st != 0 {
+			return nil, st
+		}
+		sum.length += stat.length
+		sum.space += stat.space
+		sum.inodes += stat.inodes
+	}
+	return &sum, 0
+}
+
+func (m *shardedMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
+	return m.of(inode).GetXattr(ctx, inode, name, vbuff)
+}
+
+func (m *shardedMeta) ListXattr(ctx Context, inode Ino, dbuff *[]byte) syscall.Errno {
+	return m.of(inode).ListXattr(ctx, inode, dbuff)
+}
+
+func (m *shardedMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
+	return m.of(inode).SetXattr(ctx, inode, name, value, flags)
+}
+
+func (m *shardedMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	return m.of(inode).RemoveXattr(ctx, inode, name)
+}
+
+func (m *shardedMeta) GetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno {
+	return m.of(inode).GetFacl(ctx, inode, aclType, rule)
+}
+
+func (m *shardedMeta) SetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno {
+	return m.of(inode).SetFacl(ctx, inode, aclType, rule)
+}
+
+func (m *shardedMeta) Flock(ctx Context, inode Ino, owner uint64, ltype uint32, block bool) syscall.Errno {
+	return m.of(inode).Flock(ctx, inode, owner, ltype, block)
+}
+
+func (m *shardedMeta) Getlk(ctx Context, inode Ino, owner uint64, ltype *uint32, start, end *uint64, pid *uint32) syscall.Errno {
+	return m.of(inode).Getlk(ctx, inode, owner, ltype, start, end, pid)
+}
+
+func (m *shardedMeta) Setlk(ctx Context, inode Ino, owner uint64, block bool, ltype uint32, start, end uint64, pid uint32) syscall.Errno {
+	return m.of(inode).Setlk(ctx, inode, owner, block, ltype, start, end, pid)
+}
+
+func (m *shardedMeta) CompactAll(ctx Context, threads int, bar *utils.Bar) syscall.Errno {
+	return m.eachErrno(func(s Meta) syscall.Errno { return s.CompactAll(ctx, threads, bar) })
+}
+
+func (m *shardedMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, showProgress func()) syscall.Errno {
+	return m.eachErrno(func(s Meta) syscall.Errno { return s.ListSlices(ctx, slices, delete, showProgress) })
+}
+
+func (m *shardedMeta) Remove(ctx Context, parent Ino, name string, count *uint64) syscall.Errno {
+	s, st := m.parentOf(ctx, parent, name)
+	if st != 0 {
+		return st
+	}
+	return s.Remove(ctx, parent, name, count)
+}
+
+func (m *shardedMeta) GetSummary(ctx Context, inode Ino, summary *Summary, recursive bool, strict bool) syscall.Errno {
+	if !m.isRoot(inode) {
+		return m.of(inode).GetSummary(ctx, inode, summary, recursive, strict)
+	}
+	for i, s := range m.shards {
+		var sum Summary
+		if st := s.GetSummary(ctx, inode, &sum, recursive, strict); st != 0 {
+			return st
+		}
+		if i > 0 {
+			sum.Dirs-- // root is counted by all shards
+			sum.Size -= uint64(align4K(0))
+		}
+		summary.Length += sum.Length
+		summary.Size += sum.Size
+		summary.Files += sum.Files
+		summary.Dirs += sum.Dirs
+	}
+	return 0
+}
+
+func (m *shardedMeta) GetTreeSummary(ctx Context, root *TreeSummary, depth, topN uint8, strict bool, updateProgress func(count uint64, bytes uint64)) syscall.Errno {
+	if !m.isRoot(root.Inode) {
+		return m.of(root.Inode).GetTreeSummary(ctx, root, depth, topN, strict, updateProgress)
+	}
+	var omitted *TreeSummary
+	for i, s := range m.shards {
+		tree := &TreeSummary{Inode: root.Inode, Path: root.Path, Type: root.Type}
+		if st := s.GetTreeSummary(ctx, tree, depth, topN, strict, updateProgress); st != 0 {
+			return st
+		}
+		if i > 0 {
+			tree.Dirs--
+			tree.Size -= uint64(align4K(0))
+		}
+		root.Size += tree.Size
+		root.Files += tree.Files
+		root.Dirs += tree.Dirs
+		for _, c := range tree.Children {
+			if c.Inode == 0 && c.Path == path.Join(tree.Path, "...") {
+				if omitted == nil {
+					omitted = c
+				} else {
+					omitted.Size += c.Size
+					omitted.Files += c.Files
+					omitted.Dirs += c.Dirs
+				}
+				continue
+			}
+			root.Children = append(root.Children, c)
+		}
+	}
+	if omitted != nil {
+		root.Children = append(root.Children, omitted)
+	}
+	pickTopN(root, topN)
+	return 0
+}
+
+func (m *shardedMeta) Clone(ctx Context, srcIno, dstParentIno Ino, dstName string, cmode uint8, cumask uint16, count, total *uint64) syscall.Errno {
+	if st := m.linker(ctx, dstParentIno, dstName, m.idOf(srcIno)); st != 0 {
+		return st
+	}
+	return m.of(srcIno).Clone(ctx, srcIno, dstParentIno, dstName, cmode, cumask, count, total)
+}
+
+func (m *shardedMeta) CreateSnapshot(ctx Context, name string, timeout time.Duration, count *uint64) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+func (m *shardedMeta) ListSnapshots(ctx Context) ([]*Entry, syscall.Errno) {
+	return nil, syscall.ENOTSUP
+}
+
+func (m *shardedMeta) DeleteSnapshot(ctx Context, name string, count *uint64) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+func (m *shardedMeta) GetPaths(ctx Context, inode Ino) []string {
+	return m.of(inode).GetPaths(ctx, inode)
+}
+
+func (m *shardedMeta) InRoot(ctx Context, inode Ino) bool {
+	return m.of(inode).InRoot(ctx, inode)
+}
+
+func (m *shardedMeta) Watch(ctx Context, root Ino, size int) (*Watcher, syscall.Errno) {
+	if m.isRoot(root) {
+		return nil, syscall.ENOTSUP // the changes are made in different shards
+	}
+	return m.of(root).Watch(ctx, root, size)
+}
+
+func (m *shardedMeta) Check(ctx Context, fpath string, repair bool, recursive bool, statAll bool) error {
+	s, st := m.pathOf(ctx, fpath)
+	if st != 0 {
+		return st
+	}
+	if s != nil {
+		return s.Check(ctx, fpath, repair, recursive, statAll)
+	}
+	return m.each(func(s Meta) error { return s.Check(ctx, fpath, repair, recursive, statAll) })
+}
+
+func (m *shardedMeta) Chroot(ctx Context, subdir string) syscall.Errno {
+	if m.fixed >= 0 {
+		return m.shards[m.fixed].Chroot(ctx, subdir)
+	}
+	top := strings.SplitN(strings.Trim(subdir, "/"), "/", 2)[0]
+	if top == "" {
+		return 0
+	}
+	s, st := m.place(ctx, top, m.hashed(top)) // could be created by Chroot
+	if st != 0 {
+		return st
+	}
+	if st = m.shards[s].Chroot(ctx, subdir); st == 0 {
+		m.fixed = s
+	}
+	return st
+}
+
+func (m *shardedMeta) chroot(inode Ino) {
+	if inode == RootInode {
+		m.fixed = -1
+		_ = m.each(func(s Meta) error { s.chroot(inode); return nil })
+		return
+	}
+	m.fixed = -1
+	s := m.of(inode)
+	s.chroot(inode)
+	m.fixed = shardOf(inode)
+}
+
+func (m *shardedMeta) HandleQuota(ctx Context, cmd uint8, dpath string, quotas map[string]*Quota, strict, repair bool) error {
+	if _, ok := parseOwnerQuota(dpath); ok {
+		// the quotas of users and groups are kept in the first shard
+		return m.shards[0].HandleQuota(ctx, cmd, dpath, quotas, strict, repair)
+	}
+	if cmd == QuotaList {
+		return m.each(func(s Meta) error {
+			qs := make(map[string]*Quota)
+			if err := s.HandleQuota(ctx, cmd, dpath, qs, strict, repair); err != nil {
+				return err
+			}
+			for k, q := range qs {
+				if _, ok := parseOwnerQuota(k); ok && s != m.shards[0] {
+					continue // stale ones
+				}
+				quotas[k] = q
+			}
+			return nil
+		})
+	}
+	s, st := m.pathOf(ctx, dpath)
+	if st != 0 {
+		return st
+	}
+	if s == nil {
+		return errors.New("quota of root directory is not supported for sharded metadata")
+	}
+	return s.HandleQuota(ctx, cmd, dpath, quotas, strict, repair)
+}
+
+func (m *shardedMeta) DumpMeta(w io.Writer, root Ino, keepSecret bool) error {
+	if !m.isRoot(root) {
+		return m.of(root).DumpMeta(w, root, keepSecret)
+	}
+	return errors.New("dump of sharded metadata is not supported, please dump each shard separately")
+}
+
+func (m *shardedMeta) LoadMeta(r io.Reader) error {
+	return errors.New("load into sharded metadata is not supported, please load each shard separately")
+}
+
+func (m *shardedMeta) DumpChanges(w io.Writer, since, until time.Time, keepSecret bool) error {
+	return errors.New("changelog of sharded metadata is not supported, please dump each shard separately")
+}
+
+func (m *shardedMeta) TrimChanges(before time.Time) error {
+	return m.each(func(s Meta) error { return s.TrimChanges(before) })
+}
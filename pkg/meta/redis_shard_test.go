@@ -0,0 +1,297 @@
+//go:build !noredis
+// +build !noredis
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//nolint:errcheck
+package meta
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShardRing(t *testing.T) {
+	m := &shardedMeta{shards: make([]Meta, 3), ring: newShardRing(3), fixed: -1}
+	counts := make([]int, 3)
+	placed := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		name := fmt.Sprintf("dir%d", i)
+		s := m.hashed(name)
+		counts[s]++
+		placed[name] = s
+	}
+	for s, c := range counts {
+		if c < 500 {
+			t.Fatalf("shard %d has too few entries: %v", s, counts)
+		}
+	}
+	// adding a shard only moves some entries into it
+	m.shards, m.ring = make([]Meta, 4), newShardRing(4)
+	var moved int
+	for name, s := range placed {
+		if n := m.hashed(name); n != s {
+			if n != 3 {
+				t.Fatalf("%s moved from shard %d to %d", name, s, n)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 1500 {
+		t.Fatalf("unexpected moved entries: %d", moved)
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	cases := map[Ino]int{
+		RootInode:            0,
+		100:                  0,
+		1<<shardBits + 2:     1,
+		5<<shardBits + 1000:  5,
+		TrashInode:           0,
+		TrashInode + 10:      0,
+		255<<shardBits + 100: 255,
+	}
+	for inode, s := range cases {
+		if shardOf(inode) != s {
+			t.Fatalf("shard of %d should be %d, got %d", inode, s, shardOf(inode))
+		}
+	}
+}
+
+func TestShardedRedis(t *testing.T) { //skip mutate
+	m, err := newShardedMeta("shards", "redis://127.0.0.1:6379/12;redis://127.0.0.1:6379/13", testConfig())
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	defer m.Shutdown()
+	if _, err = newShardedMeta("shards", "redis://127.0.0.1:6379/12;sqlite3://x.db", testConfig()); err == nil {
+		t.Fatalf("only Redis can be used as shards")
+	}
+	_ = m.Reset()
+	format := testFormat()
+	format.TrashDays = 1
+	if err = m.Init(format, true); err != nil {
+		t.Fatalf("initialize failed: %s", err)
+	}
+	if format.TrashDays != 0 {
+		t.Fatalf("trash should be disabled")
+	}
+	if _, err = m.Load(true); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if err = m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	defer m.CloseSession()
+	sm := m.(*shardedMeta)
+
+	ctx := Background
+	var inode Ino
+	var attr Attr
+	names := make(map[int]string) // the first top-level directory in each shard
+	dirs := make(map[string]Ino)
+	for i := 0; len(names) < 2; i++ {
+		name := fmt.Sprintf("d%d", i)
+		if st := m.Mkdir(ctx, RootInode, name, 0755, 0, 0, &inode, &attr); st != 0 {
+			t.Fatalf("mkdir %s: %s", name, st)
+		}
+		s := sm.hashed(name)
+		if shardOf(inode) != s {
+			t.Fatalf("%s should be created in shard %d, got inode %d", name, s, inode)
+		}
+		dirs[name] = inode
+		if _, ok := names[s]; !ok {
+			names[s] = name
+		}
+	}
+	d0, d1 := names[0], names[1]
+	// the entries below a top-level directory are in the same shard
+	var f0, f1 Ino
+	if st := m.Create(ctx, dirs[d1], "f", 0644, 0, 0, &f1, &attr); st != 0 || shardOf(f1) != 1 {
+		t.Fatalf("create %s/f: %s %d", d1, st, f1)
+	}
+	if st := m.Create(ctx, dirs[d0], "f", 0644, 0, 0, &f0, &attr); st != 0 || shardOf(f0) != 0 {
+		t.Fatalf("create %s/f: %s %d", d0, st, f0)
+	}
+	if st := m.Lookup(ctx, dirs[d1], "f", &inode, &attr, false); st != 0 || inode != f1 {
+		t.Fatalf("lookup %s/f: %s %d", d1, st, inode)
+	}
+	// slice ids are allocated from the first shard
+	var s0, s1 uint64
+	m.NewSlice(ctx, &s0)
+	sm.shards[1].NewSlice(ctx, &s1)
+	if s1 != s0+1 {
+		t.Fatalf("slice ids should be unique across shards: %d %d", s0, s1)
+	}
+	if st := m.Write(ctx, f1, 0, 0, Slice{Id: s1, Size: 100, Len: 100}, time.Now()); st != 0 {
+		t.Fatalf("write %s/f: %s", d1, st)
+	}
+
+	// the root directory is the union of all shards
+	var entries []*Entry
+	if st := m.Readdir(ctx, RootInode, 0, &entries); st != 0 {
+		t.Fatalf("readdir root: %s", st)
+	}
+	if len(entries) != len(dirs)+2 {
+		t.Fatalf("root should have %d entries, got %d", len(dirs)+2, len(entries))
+	}
+	entries = entries[:0]
+	if st := m.ReaddirPage(ctx, RootInode, 0, nil, 1, &entries); st != 0 || len(entries) != 3 || string(entries[2].Name) != "d0" {
+		t.Fatalf("readdir first page of root: %s %d", st, len(entries))
+	}
+	for name, ino := range dirs {
+		if st := m.Lookup(ctx, RootInode, name, &inode, &attr, false); st != 0 || inode != ino {
+			t.Fatalf("lookup %s: %s %d", name, st, inode)
+		}
+	}
+	// a name is unique in root, even it's created concurrently
+	var wg sync.WaitGroup
+	var created int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var ino Ino
+			var a Attr
+			if st := m.Mkdir(ctx, RootInode, "x", 0755, 0, 0, &ino, &a); st == 0 {
+				atomic.AddInt32(&created, 1)
+			} else if st != syscall.EEXIST {
+				t.Errorf("mkdir x: %s", st)
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("x should be created once, got %d", created)
+	}
+	if st := m.Rmdir(ctx, RootInode, "x"); st != 0 {
+		t.Fatalf("rmdir x: %s", st)
+	}
+	// the shard of a name is kept after it's removed
+	other := 1 - sm.hashed("y")
+	if s, st := sm.place(ctx, "y", other); st != 0 || s != other {
+		t.Fatalf("place y into shard %d: %d %s", other, s, st)
+	}
+	if s, st := sm.place(ctx, "y", 1-other); st != 0 || s != other {
+		t.Fatalf("y should be kept in shard %d: %d %s", other, s, st)
+	}
+	if st := m.Mkdir(ctx, RootInode, "y", 0755, 0, 0, &inode, &attr); st != 0 || shardOf(inode) != other {
+		t.Fatalf("mkdir y: %s %d", st, inode)
+	}
+	if st := m.Rmdir(ctx, RootInode, "y"); st != 0 {
+		t.Fatalf("rmdir y: %s", st)
+	}
+	if st := m.Lookup(ctx, RootInode, "y", &inode, &attr, false); st != syscall.ENOENT {
+		t.Fatalf("lookup removed y: %s", st)
+	}
+	if st := m.Rename(ctx, RootInode, names[1-other], RootInode, "y", 0, &inode, &attr); st != syscall.EXDEV {
+		t.Fatalf("rename %s to y in another shard: %s", names[1-other], st)
+	}
+
+	// rename within a shard, or across shards
+	if st := m.Rename(ctx, dirs[d1], "f", dirs[d1], "g", 0, &inode, &attr); st != 0 {
+		t.Fatalf("rename %s/f: %s", d1, st)
+	}
+	if st := m.Rename(ctx, dirs[d1], "g", dirs[d0], "g", 0, &inode, &attr); st != syscall.EXDEV {
+		t.Fatalf("rename %s/g to %s: %s", d1, d0, st)
+	}
+	if st := m.Rename(ctx, RootInode, d1, RootInode, "renamed", 0, &inode, &attr); st != 0 {
+		t.Fatalf("rename %s in root: %s", d1, st)
+	}
+	if st := m.Lookup(ctx, RootInode, "renamed", &inode, &attr, false); st != 0 || inode != dirs[d1] {
+		t.Fatalf("lookup renamed: %s %d", st, inode)
+	}
+	if st := m.Rename(ctx, RootInode, "renamed", RootInode, d1, 0, &inode, &attr); st != 0 {
+		t.Fatalf("rename back %s: %s", d1, st)
+	}
+	if st := m.Link(ctx, f0, dirs[d1], "l", &attr); st != syscall.EXDEV {
+		t.Fatalf("link across shards: %s", st)
+	}
+
+	// usage of root is summed across shards
+	var summary Summary
+	if st := m.GetSummary(ctx, RootInode, &summary, true, true); st != 0 {
+		t.Fatalf("summary of root: %s", st)
+	}
+	if summary.Dirs != uint64(len(dirs)+1) || summary.Files != 2 || summary.Length != 100 {
+		t.Fatalf("summary of root: %+v", summary)
+	}
+	var totalspace, availspace, iused, iavail uint64
+	if st := m.StatFS(ctx, RootInode, &totalspace, &availspace, &iused, &iavail); st != 0 {
+		t.Fatalf("statfs: %s", st)
+	}
+	if iused != uint64(len(dirs)+2) {
+		t.Fatalf("used inodes should be %d, got %d", len(dirs)+2, iused)
+	}
+
+	// the quota of a user is shared by all the shards
+	name := "uid:1234"
+	if err := m.HandleQuota(ctx, QuotaSet, name, map[string]*Quota{name: {MaxSpace: -1, MaxInodes: 2}}, false, false); err != nil {
+		t.Fatalf("set quota %s: %s", name, err)
+	}
+	sm.shards[0].getBase().loadQuotas()
+	uctx := NewContext(1, 1234, []uint32{5678})
+	for _, d := range []string{d0, d1} {
+		if st := m.SetAttr(ctx, dirs[d], SetAttrMode, 0, &Attr{Mode: 0777}); st != 0 {
+			t.Fatalf("chmod %s: %s", d, st)
+		}
+	}
+	if st := m.Create(uctx, dirs[d0], "q", 0644, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create %s/q: %s", d0, st)
+	}
+	if st := m.Create(uctx, dirs[d1], "q", 0644, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create %s/q: %s", d1, st)
+	}
+	if st := m.Create(uctx, dirs[d1], "q2", 0644, 0, 0, &inode, &attr); st != syscall.EDQUOT {
+		t.Fatalf("create %s/q2 should exceed the quota: %s", d1, st)
+	}
+	qs := make(map[string]*Quota)
+	time.Sleep(time.Second * 4)
+	if err := m.HandleQuota(ctx, QuotaCheck, name, qs, false, false); err != nil {
+		t.Fatalf("check quota %s: %s", name, err)
+	} else if q := qs[name]; q.UsedInodes != 2 {
+		t.Fatalf("quota %s: %+v", name, q)
+	}
+	for _, d := range []string{d0, d1} {
+		if st := m.Unlink(ctx, dirs[d], "q"); st != 0 {
+			t.Fatalf("unlink %s/q: %s", d, st)
+		}
+	}
+	if err := m.HandleQuota(ctx, QuotaDel, name, nil, false, false); err != nil {
+		t.Fatalf("delete quota %s: %s", name, err)
+	}
+
+	// mount a subdir in the second shard
+	if st := m.Chroot(ctx, d1); st != 0 {
+		t.Fatalf("chroot %s: %s", d1, st)
+	}
+	if st := m.Lookup(ctx, RootInode, "g", &inode, &attr, false); st != 0 || inode != f1 {
+		t.Fatalf("lookup g in %s: %s %d", d1, st, inode)
+	}
+	if st := m.Create(ctx, RootInode, "h", 0644, 0, 0, &inode, &attr); st != 0 || shardOf(inode) != 1 {
+		t.Fatalf("create h in %s: %s %d", d1, st, inode)
+	}
+	m.chroot(RootInode)
+	if st := m.Lookup(ctx, dirs[d1], "h", &inode, &attr, false); st != 0 {
+		t.Fatalf("lookup %s/h: %s", d1, st)
+	}
+}
@@ -161,6 +161,10 @@ func compactChunk(ss []*slice) (uint32, uint32, []Slice) {
 		pos = chunk[0].Len
 		chunk = chunk[1:]
 	}
+	// trailing holes (punched or zeroed) need no data
+	for len(chunk) > 0 && chunk[len(chunk)-1].Id == 0 {
+		chunk = chunk[:len(chunk)-1]
+	}
 	var size uint32
 	for _, c := range chunk {
 		size += c.Len
@@ -0,0 +1,913 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SnapshotDir is the directory under root to keep the snapshots of the volume, each snapshot is a copy
+// of the whole tree which shares the slices with the origin ones (copy-on-write).
+//
+// A snapshot is point-in-time: the changes of all the sessions are paused for a moment to agree on the
+// point, then the snapshot is filled in background while the volume is writable. The directories are
+// filled one level at a time (the files are cloned, the subdirectories are created empty and filled
+// later). Before a directory or the parent of a file is changed, the session fills it first (if not yet),
+// so the snapshot gets the entries as they were at the point. The snapshots are immutable (FlagImmutable),
+// and can only be removed by DeleteSnapshot. The usage of snapshots is not counted in the usage of the
+// volume, nor the quotas of users and groups.
+const SnapshotDir = ".snapshots"
+
+// snapshotPause is the counter to pause the changes of all the sessions, which is the deadline (in
+// unix seconds) of the pause, or 0 if there is none.
+const snapshotPause = "snapshotPause"
+
+// snapshotPending is the counter of the snapshot being filled (the inode of its root), or 0 if there is none.
+// The root of it keeps the states of the directories being filled in xattrs. The snapshot is abandoned
+// if its creator is not alive (snapshotAlive, in unix seconds) for snapshotLease.
+const (
+	snapshotPending = "snapshotPending"
+	snapshotAlive   = "snapshotAlive"
+	snapshotLease   = 300
+)
+
+// snapshotSpace and snapshotInodes are the usage of all the snapshots, which is excluded from the volume.
+const (
+	snapshotSpace  = "snapshotSpace"
+	snapshotInodes = "snapshotInodes"
+)
+
+const snapshotFlags = FlagImmutable | FlagSnapshot
+
+// pendingSnapshot is the snapshot being filled.
+type pendingSnapshot struct {
+	root Ino
+	kept sync.Map // the directories (or the inodes) which are kept in the snapshot already
+}
+
+// The xattrs kept in the root of a pending snapshot.
+func snapshotDst(src Ino) string  { return fmt.Sprintf("snap.dst.%d", src) }  // the copy of a directory
+func snapshotSrc(dst Ino) string  { return fmt.Sprintf("snap.src.%d", dst) }  // the origin of a copy
+func snapshotFill(src Ino) string { return fmt.Sprintf("snap.fill.%d", src) } // the session filling it
+func snapshotDone(src Ino) string { return fmt.Sprintf("snap.done.%d", src) } // filled or failed
+
+const snapshotFailed = "failed"
+
+func validSnapshotName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// snapshotCtx returns a context (of root) to change the entries of snapshots.
+func snapshotCtx(ctx Context) Context {
+	sctx := NewContextFrom(ctx, ctx.Pid(), 0, []uint32{0})
+	sctx.WithValue(CtxKey("snapshot"), true)
+	return sctx
+}
+
+func isSnapshotCtx(ctx Context) bool {
+	return ctx.Value(CtxKey("snapshot")) != nil
+}
+
+// clonedFlags returns the flags of a cloned entry: the entries of snapshots are immutable, and they
+// are writable again when cloned out of a snapshot.
+func clonedFlags(flags uint8, cmode uint8) uint8 {
+	if flags&FlagSnapshot != 0 {
+		flags &^= snapshotFlags
+	}
+	if cmode&CLONE_MODE_SNAPSHOT != 0 {
+		flags |= snapshotFlags
+	}
+	return flags
+}
+
+// beginWrite is called before a write transaction, it blocks while the writes are paused.
+func (m *baseMeta) beginWrite() {
+	for {
+		m.pauseMu.Lock()
+		resumed := m.resumed
+		if resumed == nil || !m.blocked {
+			m.writing++
+			m.pauseMu.Unlock()
+			return
+		}
+		m.pauseMu.Unlock()
+		<-resumed
+	}
+}
+
+func (m *baseMeta) endWrite() {
+	m.pauseMu.Lock()
+	m.writing--
+	m.pauseMu.Unlock()
+}
+
+func (m *baseMeta) writesPaused() bool {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+	return m.resumed != nil
+}
+
+// startChange is called before an operation changing the tree, it blocks while the changes are paused,
+// then keeps the entries in the snapshot being filled by keep.
+func (m *baseMeta) startChange(ctx Context, keep func(p *pendingSnapshot) syscall.Errno) syscall.Errno {
+	if isSnapshotCtx(ctx) {
+		return 0
+	}
+	var p *pendingSnapshot
+	for {
+		m.pauseMu.Lock()
+		resumed := m.resumed
+		if resumed == nil {
+			m.changing++
+			p = m.pending
+			m.pauseMu.Unlock()
+			break
+		}
+		m.pauseMu.Unlock()
+		<-resumed
+	}
+	if p == nil {
+		return 0
+	}
+	st := keep(p)
+	if st != 0 {
+		m.endChange(ctx)
+	}
+	return st
+}
+
+// beginChange is called before changing the entries of dirs, endChange should be called after it if 0 is returned.
+func (m *baseMeta) beginChange(ctx Context, dirs ...Ino) syscall.Errno {
+	return m.startChange(ctx, func(p *pendingSnapshot) syscall.Errno {
+		for _, dir := range dirs {
+			if st := m.keepDir(ctx, p, dir); st != 0 {
+				return st
+			}
+		}
+		return 0
+	})
+}
+
+// beginChangeOf is called before changing an inode (attributes, xattrs or content), endChange should be called
+// after it if 0 is returned.
+func (m *baseMeta) beginChangeOf(ctx Context, inode Ino) syscall.Errno {
+	return m.startChange(ctx, func(p *pendingSnapshot) syscall.Errno {
+		if _, ok := p.kept.Load(inode); ok || inode == RootInode {
+			return 0
+		}
+		var attr Attr
+		if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+			return st
+		}
+		if attr.Flags&FlagSnapshot != 0 {
+			return 0
+		}
+		// the inode is cloned into the snapshot when its parents are filled
+		parents := map[Ino]int{attr.Parent: 1}
+		if attr.Parent == 0 {
+			parents = m.en.doGetParents(ctx, inode)
+		}
+		for parent := range parents {
+			if st := m.keepDir(ctx, p, parent); st != 0 {
+				return st
+			}
+		}
+		p.kept.Store(inode, struct{}{})
+		return 0
+	})
+}
+
+func (m *baseMeta) endChange(ctx Context) {
+	if isSnapshotCtx(ctx) {
+		return
+	}
+	m.pauseMu.Lock()
+	m.changing--
+	m.pauseMu.Unlock()
+}
+
+// keepDir makes sure the entries of a directory are kept in the snapshot before they are changed, the parents
+// of it are kept first, so it's created in the snapshot if it exists at the point of snapshot.
+func (m *baseMeta) keepDir(ctx Context, p *pendingSnapshot, dir Ino) syscall.Errno {
+	if _, ok := p.kept.Load(dir); ok || dir == 0 || isTrash(dir) {
+		return 0
+	}
+	if dir != RootInode {
+		var attr Attr
+		if st := m.en.doGetAttr(ctx, dir, &attr); st != 0 {
+			return st
+		}
+		if attr.Flags&FlagSnapshot != 0 {
+			return 0
+		}
+		if st := m.keepDir(ctx, p, attr.Parent); st != 0 {
+			return st
+		}
+	}
+	st := m.fillDir(ctx, p, dir)
+	if st == 0 {
+		p.kept.Store(dir, struct{}{})
+	}
+	return st
+}
+
+// fillDir clones the entries of a directory into its copy in the snapshot, which is done only once by any session.
+// The others wait for it to be done.
+func (m *baseMeta) fillDir(ctx Context, p *pendingSnapshot, src Ino) syscall.Errno {
+	ctx = snapshotCtx(ctx) // the entries are cloned regardless of the permissions of the caller
+	var buf []byte
+	st := m.en.(Meta).GetXattr(ctx, p.root, snapshotDst(src), &buf)
+	if st == ENOATTR {
+		return 0 // created after the point of snapshot
+	} else if st != 0 {
+		return st
+	}
+	dst, err := strconv.ParseUint(string(buf), 10, 64)
+	if err != nil {
+		logger.Errorf("Invalid copy of directory %d in snapshot %d: %q", src, p.root, buf)
+		return syscall.EIO
+	}
+	if st = m.en.(Meta).GetXattr(ctx, p.root, snapshotDone(src), &buf); st != ENOATTR {
+		return st
+	}
+	st = m.en.doSetXattr(ctx, p.root, snapshotFill(src), []byte(strconv.FormatUint(m.sid, 10)), XattrCreate)
+	if st == syscall.EEXIST {
+		return m.waitFilled(ctx, p, src)
+	} else if st != 0 {
+		return st
+	}
+
+	var done []byte
+	st = m.cloneLevel(ctx, p, src, Ino(dst))
+	if st != 0 {
+		logger.Errorf("Fill directory %d into snapshot %d: %s", src, p.root, st)
+		done = []byte(snapshotFailed)
+	}
+	if eno := m.en.doSetXattr(ctx, p.root, snapshotDone(src), done, XattrCreateOrReplace); st == 0 {
+		st = eno
+	}
+	return st
+}
+
+// cloneLevel clones the entries of src into dst: the files are cloned, and the directories are created empty.
+func (m *baseMeta) cloneLevel(ctx Context, p *pendingSnapshot, src, dst Ino) syscall.Errno {
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, src, 0, &entries, -1); st != 0 && st != syscall.ENOENT {
+		return st
+	}
+	var space, inodes int64
+	defer func() {
+		if inodes > 0 {
+			m.updateSnapshotUsage(space, inodes)
+		}
+	}()
+	for _, e := range entries {
+		name := string(e.Name)
+		if src == RootInode && (name == TrashName || name == SnapshotDir) {
+			continue
+		}
+		ino, err := m.nextInode()
+		if err != nil {
+			return errno(err)
+		}
+		var attr Attr
+		st := m.en.doCloneEntry(ctx, e.Inode, dst, name, ino, &attr, CLONE_MODE_PRESERVE_ATTR|CLONE_MODE_SNAPSHOT, 0, false)
+		if st == syscall.ENOENT {
+			logger.Warnf("ignore deleted %s in dir %d", name, src)
+			continue
+		} else if st != 0 {
+			return st
+		}
+		s, i := ownerUsage(&attr)
+		space += s
+		inodes += i
+		if attr.Typ == TypeDirectory {
+			if st = m.en.doSetXattr(ctx, p.root, snapshotDst(e.Inode), []byte(ino.String()), XattrCreateOrReplace); st != 0 {
+				return st
+			}
+			if st = m.en.doSetXattr(ctx, p.root, snapshotSrc(ino), []byte(e.Inode.String()), XattrCreateOrReplace); st != 0 {
+				return st
+			}
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return 0
+}
+
+// waitFilled waits until a directory is filled by another session, or the snapshot is not pending anymore.
+func (m *baseMeta) waitFilled(ctx Context, p *pendingSnapshot, src Ino) syscall.Errno {
+	var buf []byte
+	for {
+		st := m.en.(Meta).GetXattr(ctx, p.root, snapshotDone(src), &buf)
+		if st != ENOATTR {
+			return st
+		}
+		m.pauseMu.Lock()
+		pending := m.pending == p
+		m.pauseMu.Unlock()
+		if !pending {
+			return 0
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// fillSnapshot fills the copy of src and all the directories under it, from the top down. The directories
+// removed after the point of snapshot are filled before any entry is removed from them, or they are empty.
+func (m *baseMeta) fillSnapshot(ctx Context, p *pendingSnapshot, src, dst Ino, count *uint64) syscall.Errno {
+	if st := m.fillDir(ctx, p, src); st != 0 {
+		return st
+	}
+	var buf []byte
+	if st := m.en.(Meta).GetXattr(ctx, p.root, snapshotDone(src), &buf); st != 0 {
+		return st
+	} else if string(buf) == snapshotFailed {
+		return syscall.EIO
+	}
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, dst, 0, &entries, -1); st != 0 && st != syscall.ENOENT {
+		return st
+	}
+	atomic.AddUint64(count, uint64(len(entries)))
+	for _, e := range entries {
+		if e.Attr.Typ != TypeDirectory {
+			continue
+		}
+		if st := m.en.(Meta).GetXattr(ctx, p.root, snapshotSrc(e.Inode), &buf); st != 0 {
+			return st
+		}
+		child, err := strconv.ParseUint(string(buf), 10, 64)
+		if err != nil {
+			return syscall.EIO
+		}
+		if st := m.fillSnapshot(ctx, p, Ino(child), e.Inode, count); st != 0 {
+			return st
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return 0
+}
+
+// volumeUsage returns the counter of usage excluding the snapshots.
+func (m *baseMeta) volumeUsage(name, snapshot string) (int64, error) {
+	v, err := m.en.getCounter(name)
+	if err != nil {
+		return 0, err
+	}
+	s, err := m.en.getCounter(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	return v - s, nil
+}
+
+func (m *baseMeta) updateSnapshotUsage(space, inodes int64) {
+	if _, err := m.en.incrCounter(snapshotSpace, space); err != nil {
+		logger.Warnf("Update counter %s: %s", snapshotSpace, err)
+	}
+	if _, err := m.en.incrCounter(snapshotInodes, inodes); err != nil {
+		logger.Warnf("Update counter %s: %s", snapshotInodes, err)
+	}
+}
+
+// pauseWrites blocks the new changes until the deadline or the pause is cancelled, and waits for the ones in
+// flight to finish, then blocks the other write transactions and waits for them too.
+func (m *baseMeta) pauseWrites(until int64) {
+	m.pauseMu.Lock()
+	if m.resumed == nil {
+		logger.Infof("Pause writes for a snapshot of the volume (until %s)", time.Unix(until, 0))
+		m.resumed = make(chan struct{})
+		go m.waitResume(until, m.resumed)
+	}
+	m.pauseMu.Unlock()
+	for time.Now().Unix() < until {
+		m.pauseMu.Lock()
+		if m.changing == 0 {
+			m.blocked = true
+		}
+		paused := m.blocked && m.writing == 0
+		m.pauseMu.Unlock()
+		if paused {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	logger.Warnf("Write transactions are not finished before %s", time.Unix(until, 0))
+}
+
+// waitResume resumes the writes once the pause is cancelled (the counter is changed) or the deadline.
+func (m *baseMeta) waitResume(until int64, resumed chan struct{}) {
+	for time.Now().Unix() < until {
+		time.Sleep(time.Millisecond * 100)
+		if v, err := m.en.getCounter(snapshotPause); err == nil && v != until {
+			break
+		}
+	}
+	m.pauseMu.Lock()
+	if m.resumed == resumed { // not resumed by resumeAll
+		m.resumed = nil
+		m.blocked = false
+		close(resumed)
+	}
+	m.pauseMu.Unlock()
+	logger.Infof("Resume writes")
+}
+
+// checkPause loads the snapshot being filled, and pauses the writes if a snapshot is being created by other
+// clients. It's called before refreshing the session, so the creator knows that the snapshot is seen by
+// the session once the session is refreshed.
+func (m *baseMeta) checkPause() error {
+	if err := m.loadPending(); err != nil {
+		return err
+	}
+	v, err := m.en.getCounter(snapshotPause)
+	if err == nil && v > time.Now().Unix() && v != atomic.LoadInt64(&m.snapshotting) {
+		m.pauseWrites(v)
+	}
+	return err
+}
+
+// loadPending loads the snapshot being filled by other clients.
+func (m *baseMeta) loadPending() error {
+	v, err := m.en.getCounter(snapshotPending)
+	if err != nil {
+		return err
+	}
+	if v > 0 {
+		alive, err := m.en.getCounter(snapshotAlive)
+		if err != nil {
+			return err
+		}
+		if time.Now().Unix()-alive > snapshotLease {
+			v = 0 // abandoned
+		}
+	}
+	m.pauseMu.Lock()
+	if v == 0 {
+		m.pending = nil
+	} else if m.pending == nil || m.pending.root != Ino(v) {
+		m.pending = &pendingSnapshot{root: Ino(v)}
+	}
+	m.pauseMu.Unlock()
+	return nil
+}
+
+// pauseAll asks all the sessions to pause the changes until they agree on the point of snapshot or the deadline,
+// which is returned.
+func (m *baseMeta) pauseAll(timeout time.Duration) (int64, syscall.Errno) {
+	now := time.Now().Unix()
+	until := now + int64(timeout/time.Second)
+	// only if there is no other snapshot being created
+	if ok, err := m.en.setIfSmall(snapshotPause, until, until-now); err != nil {
+		return 0, errno(err)
+	} else if !ok {
+		logger.Errorf("Another snapshot is being created, please try again later")
+		return 0, syscall.EBUSY
+	}
+	atomic.StoreInt64(&m.snapshotting, until)
+	// pause the changes of this session too, after the last pause is resumed
+	m.pauseMu.Lock()
+	for m.resumed != nil {
+		m.pauseMu.Unlock()
+		time.Sleep(time.Millisecond * 10)
+		m.pauseMu.Lock()
+	}
+	m.resumed = make(chan struct{})
+	m.pauseMu.Unlock()
+	return until, 0
+}
+
+// resumeAll resets the counter to resume the writes, if it's not taken by another snapshot after the deadline.
+func (m *baseMeta) resumeAll(until int64) {
+	if _, err := m.en.setIfSmall(snapshotPause, 0, -until); err != nil {
+		logger.Warnf("Resume writes: %s", err)
+	}
+	atomic.StoreInt64(&m.snapshotting, 0)
+	m.pauseMu.Lock()
+	if m.resumed != nil {
+		close(m.resumed)
+		m.resumed = nil
+		m.blocked = false
+	}
+	m.pauseMu.Unlock()
+}
+
+// waitPaused waits until all the other sessions have paused writes. A session may have checked the counter
+// just before it's set, so it's paused only after it's refreshed twice. The sessions created later check
+// the counter before any write.
+func (m *baseMeta) waitPaused(ctx Context, until int64) syscall.Errno {
+	n, st := m.waitRefreshed(ctx, until)
+	if st == syscall.ETIMEDOUT {
+		logger.Errorf("%d sessions did not pause writes in time, please try again with a longer timeout", n)
+	}
+	return st
+}
+
+// waitRefreshed waits until all the other sessions are refreshed twice (or closed), it returns the number of
+// sessions which are not refreshed before the deadline.
+func (m *baseMeta) waitRefreshed(ctx Context, until int64) (int, syscall.Errno) {
+	sessions, err := m.en.(Meta).ListSessions()
+	if err != nil {
+		return 0, errno(err)
+	}
+	expires := make(map[uint64]time.Time)
+	refreshed := make(map[uint64]int)
+	for _, s := range sessions {
+		if s.Sid != m.sid {
+			expires[s.Sid] = s.Expire
+		}
+	}
+	for len(expires) > 0 {
+		if ctx.Canceled() {
+			return len(expires), syscall.EINTR
+		}
+		if time.Now().Unix() >= until {
+			return len(expires), syscall.ETIMEDOUT
+		}
+		time.Sleep(time.Millisecond * 500)
+		if sessions, err = m.en.(Meta).ListSessions(); err != nil {
+			return len(expires), errno(err)
+		}
+		alive := make(map[uint64]bool)
+		now := time.Now()
+		for _, s := range sessions {
+			last, ok := expires[s.Sid]
+			if !ok {
+				continue
+			}
+			alive[s.Sid] = true
+			if s.Expire.After(last) {
+				expires[s.Sid] = s.Expire
+				if refreshed[s.Sid]++; refreshed[s.Sid] >= 2 {
+					delete(expires, s.Sid)
+				}
+			} else if s.Expire.Before(now) { // the lease is expired, so it can't write
+				delete(expires, s.Sid)
+			}
+		}
+		for sid := range expires {
+			if !alive[sid] { // closed
+				delete(expires, sid)
+			}
+		}
+	}
+	return 0, 0
+}
+
+func (m *baseMeta) setSnapshotFlags(ctx Context, inode Ino, flags uint8) syscall.Errno {
+	attr := Attr{Flags: flags}
+	return m.en.(Meta).SetAttr(ctx, inode, SetAttrFlag, 0, &attr)
+}
+
+// unlockSnapshot clears the flags of all the entries in a snapshot, so they can be removed.
+func (m *baseMeta) unlockSnapshot(ctx Context, inode Ino, typ uint8) syscall.Errno {
+	if st := m.setSnapshotFlags(ctx, inode, 0); st != 0 {
+		return st
+	}
+	if typ != TypeDirectory {
+		return 0
+	}
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, inode, 1, &entries, -1); st != 0 && st != syscall.ENOENT {
+		return st
+	}
+	for _, e := range entries {
+		if e.Attr.Flags&FlagSnapshot == 0 && e.Attr.Typ != TypeDirectory {
+			continue
+		}
+		if st := m.unlockSnapshot(ctx, e.Inode, e.Attr.Typ); st != 0 && st != syscall.ENOENT {
+			return st
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return 0
+}
+
+// snapshotRoot returns the inode of SnapshotDir, which is created if it does not exist and create is true.
+func (m *baseMeta) snapshotRoot(ctx Context, create bool) (Ino, syscall.Errno) {
+	var inode Ino
+	var attr Attr
+	st := m.en.doLookup(ctx, RootInode, SnapshotDir, &inode, &attr)
+	if st == syscall.ENOENT && create {
+		st = m.Mkdir(ctx, RootInode, SnapshotDir, 0555, 0, 0, &inode, &attr)
+		if st == 0 {
+			st = m.setSnapshotFlags(ctx, inode, snapshotFlags)
+			attr.Flags = snapshotFlags
+		} else if st == syscall.EEXIST {
+			st = m.en.doLookup(ctx, RootInode, SnapshotDir, &inode, &attr)
+		}
+	}
+	if st == 0 && attr.Typ != TypeDirectory {
+		st = syscall.ENOTDIR
+	}
+	if st == 0 && attr.Flags&FlagSnapshot == 0 {
+		logger.Errorf("%s is not created by snapshot, please rename it", SnapshotDir)
+		st = syscall.EEXIST
+	}
+	return inode, st
+}
+
+// addSnapshot creates an empty directory in SnapshotDir (which is immutable) for a new snapshot.
+func (m *baseMeta) addSnapshot(ctx Context, sroot Ino, name string, inode *Ino) syscall.Errno {
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, RootInode, &attr); st != 0 {
+		return st
+	}
+	if st := m.setSnapshotFlags(ctx, sroot, 0); st != 0 {
+		return st
+	}
+	st := m.Mkdir(ctx, sroot, name, attr.Mode, 0, 0, inode, &attr)
+	if eno := m.setSnapshotFlags(ctx, sroot, snapshotFlags); st == 0 {
+		st = eno
+	}
+	return st
+}
+
+// startSnapshot creates the root of a new snapshot in SnapshotDir and makes it pending, so the changes are
+// kept in it once they are paused in all the sessions (before until).
+func (m *baseMeta) startSnapshot(ctx Context, sroot Ino, name string, until int64) (*pendingSnapshot, syscall.Errno) {
+	now := time.Now().Unix()
+	old, err := m.en.getCounter(snapshotPending)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if old > 0 {
+		if alive, err := m.en.getCounter(snapshotAlive); err != nil {
+			return nil, errno(err)
+		} else if now-alive <= snapshotLease {
+			logger.Errorf("Another snapshot is being filled, please try again later")
+			return nil, syscall.EBUSY
+		}
+		logger.Warnf("Snapshot (inode %d) is abandoned by its creator, please delete it", old)
+	}
+	var inode Ino
+	if st := m.addSnapshot(ctx, sroot, name, &inode); st != 0 {
+		return nil, st
+	}
+	p := &pendingSnapshot{root: inode}
+	m.updateSnapshotUsage(align4K(0), 1)
+	if st := m.en.doSetXattr(ctx, inode, snapshotDst(RootInode), []byte(inode.String()), XattrCreate); st != 0 {
+		return p, st
+	}
+	if _, err = m.en.setIfSmall(snapshotAlive, now, 0); err != nil {
+		return p, errno(err)
+	}
+	if ok, err := m.en.setIfSmall(snapshotPending, int64(inode), int64(inode)-old); err != nil {
+		return p, errno(err)
+	} else if !ok {
+		logger.Errorf("Another snapshot is being filled, please try again later")
+		return p, syscall.EBUSY
+	}
+	// the changes of this session are paused by pauseAll, wait for the ones in flight
+	m.pauseMu.Lock()
+	m.pending = p
+	for m.changing > 0 && time.Now().Unix() < until {
+		m.pauseMu.Unlock()
+		time.Sleep(time.Millisecond * 10)
+		m.pauseMu.Lock()
+	}
+	m.pauseMu.Unlock()
+	return p, 0
+}
+
+// fillPending fills the pending snapshot from the top down, and keeps it alive for other clients.
+func (m *baseMeta) fillPending(ctx Context, p *pendingSnapshot, count *uint64) syscall.Errno {
+	var lost int32
+	done := make(chan struct{})
+	go func() {
+		last := time.Now().Unix()
+		ticker := time.NewTicker(time.Second * 10)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			now := time.Now().Unix()
+			if now-last > snapshotLease/2 {
+				atomic.StoreInt32(&lost, 1)
+			}
+			if _, err := m.en.setIfSmall(snapshotAlive, now, 0); err != nil {
+				logger.Warnf("Update counter %s: %s", snapshotAlive, err)
+			} else {
+				last = now
+			}
+		}
+	}()
+	st := m.fillSnapshot(ctx, p, RootInode, p.root, count)
+	close(done)
+	if st == 0 && atomic.LoadInt32(&lost) == 1 {
+		logger.Errorf("Snapshot (inode %d) could be abandoned by other clients", p.root)
+		st = syscall.ETIMEDOUT
+	}
+	return st
+}
+
+// finishSnapshot stops keeping the changes in the snapshot, and removes the states of filling from it after
+// all the sessions know that.
+func (m *baseMeta) finishSnapshot(ctx Context, p *pendingSnapshot, timeout time.Duration) {
+	v, err := m.en.getCounter(snapshotPending)
+	if err == nil && v == int64(p.root) {
+		_, err = m.en.incrCounter(snapshotPending, -v)
+	}
+	if err != nil {
+		logger.Warnf("Reset counter %s: %s", snapshotPending, err)
+	}
+	m.pauseMu.Lock()
+	if m.pending == p {
+		m.pending = nil
+	}
+	m.pauseMu.Unlock()
+	if n, st := m.waitRefreshed(ctx, time.Now().Add(timeout).Unix()); st != 0 {
+		logger.Warnf("%d sessions are not refreshed after snapshot (inode %d) is filled: %s", n, p.root, st)
+	}
+	var names []byte
+	if st := m.en.(Meta).ListXattr(ctx, p.root, &names); st != 0 {
+		logger.Warnf("List xattrs of snapshot (inode %d): %s", p.root, st)
+		return
+	}
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if bytes.HasPrefix(name, []byte("snap.")) {
+			if st := m.en.doRemoveXattr(ctx, p.root, string(name)); st != 0 && st != ENOATTR {
+				logger.Warnf("Remove xattr %s of snapshot (inode %d): %s", name, p.root, st)
+			}
+		}
+	}
+}
+
+// removeSnapshot removes a snapshot permanently (bypassing the trash).
+func (m *baseMeta) removeSnapshot(ctx Context, sroot Ino, name string, inode Ino, count *uint64) syscall.Errno {
+	var sum Summary
+	if st := m.GetSummary(ctx, inode, &sum, true, false); st != 0 {
+		return st
+	}
+	if st := m.unlockSnapshot(ctx, inode, TypeDirectory); st != 0 {
+		return st
+	}
+	if st := m.emptyDir(ctx, inode, true, count, make(chan int, 50)); st != 0 {
+		var left Summary
+		if m.GetSummary(ctx, inode, &left, true, false) == 0 {
+			m.updateSnapshotUsage(-int64(sum.Size-left.Size), -int64(sum.Dirs+sum.Files-left.Dirs-left.Files))
+		}
+		return st
+	}
+	if st := m.setSnapshotFlags(ctx, sroot, 0); st != 0 {
+		return st
+	}
+	st := m.Rmdir(ctx, sroot, name, true)
+	if st == 0 {
+		m.updateSnapshotUsage(-int64(sum.Size), -int64(sum.Dirs+sum.Files))
+		if count != nil {
+			atomic.AddUint64(count, 1)
+		}
+	}
+	var entries []*Entry
+	if eno := m.en.doReaddir(ctx, sroot, 0, &entries, 1); (eno == 0 || eno == syscall.ENOENT) && len(entries) == 0 {
+		if eno := m.Rmdir(ctx, RootInode, SnapshotDir, true); eno == 0 || eno == syscall.ENOENT {
+			return st
+		}
+	}
+	if eno := m.setSnapshotFlags(ctx, sroot, snapshotFlags); st == 0 {
+		st = eno
+	}
+	return st
+}
+
+// CreateSnapshot creates a point-in-time snapshot of the volume in SnapshotDir/name. The changes of all the
+// sessions are paused until they agree on the point of snapshot, or the timeout is reached (ETIMEDOUT is
+// returned then), then it's filled while the volume is writable.
+func (m *baseMeta) CreateSnapshot(ctx Context, name string, timeout time.Duration, count *uint64) syscall.Errno {
+	if !validSnapshotName(name) || timeout < time.Second {
+		return syscall.EINVAL
+	}
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if ctx.Uid() != 0 {
+		return syscall.EPERM
+	}
+	defer m.timeit("CreateSnapshot", time.Now())
+	ctx = snapshotCtx(ctx)
+	sroot, st := m.snapshotRoot(ctx, true)
+	if st != 0 {
+		return st
+	}
+	var inode Ino
+	var attr Attr
+	if st = m.en.doLookup(ctx, sroot, name, &inode, &attr); st != syscall.ENOENT {
+		if st == 0 {
+			st = syscall.EEXIST
+		}
+		return st
+	}
+	until, st := m.pauseAll(timeout)
+	if st != 0 {
+		return st
+	}
+	p, st := m.startSnapshot(ctx, sroot, name, until)
+	if st == 0 {
+		st = m.waitPaused(ctx, until)
+	}
+	if v, err := m.en.getCounter(snapshotPause); st == 0 && (err != nil || v != until || time.Now().Unix() >= until) {
+		logger.Errorf("Writes are resumed before all the sessions see snapshot %s, please try again with a longer timeout", name)
+		st = syscall.ETIMEDOUT
+	}
+	m.resumeAll(until)
+	if p == nil {
+		return st
+	}
+	if st == 0 {
+		st = m.fillPending(ctx, p, count)
+	}
+	m.finishSnapshot(ctx, p, timeout)
+	if st == 0 {
+		st = m.setSnapshotFlags(ctx, p.root, snapshotFlags)
+	}
+	if st != 0 {
+		if eno := m.removeSnapshot(ctx, sroot, name, p.root, nil); eno != 0 {
+			logger.Errorf("Remove incomplete snapshot %s: %s", name, eno)
+		}
+	}
+	return st
+}
+
+// ListSnapshots returns the snapshots of the volume.
+func (m *baseMeta) ListSnapshots(ctx Context) ([]*Entry, syscall.Errno) {
+	sroot, st := m.snapshotRoot(ctx, false)
+	if st == syscall.ENOENT {
+		return nil, 0
+	} else if st != 0 {
+		return nil, st
+	}
+	var entries []*Entry
+	if st = m.en.doReaddir(ctx, sroot, 1, &entries, -1); st != 0 {
+		return nil, st
+	}
+	return entries, 0
+}
+
+// DeleteSnapshot removes a snapshot permanently (bypassing the trash), the slices are released
+// when they are not referenced by any other file.
+func (m *baseMeta) DeleteSnapshot(ctx Context, name string, count *uint64) syscall.Errno {
+	if !validSnapshotName(name) {
+		return syscall.EINVAL
+	}
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if ctx.Uid() != 0 {
+		return syscall.EPERM
+	}
+	defer m.timeit("DeleteSnapshot", time.Now())
+	ctx = snapshotCtx(ctx)
+	sroot, st := m.snapshotRoot(ctx, false)
+	if st != 0 {
+		return st
+	}
+	var inode Ino
+	var attr Attr
+	if st = m.en.doLookup(ctx, sroot, name, &inode, &attr); st != 0 {
+		return st
+	}
+	if v, err := m.en.getCounter(snapshotPending); err != nil {
+		return errno(err)
+	} else if v == int64(inode) {
+		if alive, err := m.en.getCounter(snapshotAlive); err != nil {
+			return errno(err)
+		} else if time.Now().Unix()-alive <= snapshotLease {
+			return syscall.EBUSY
+		}
+	}
+	return m.removeSnapshot(ctx, sroot, name, inode, count)
+}
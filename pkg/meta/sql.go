@@ -27,8 +27,10 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"os"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -63,23 +65,35 @@ type edge struct {
 	Type   uint8  `xorm:"notnull"`
 }
 
+// foldedEdge maps the folded name of an entry to its name in case-insensitive volume.
+type foldedEdge struct {
+	Id     int64  `xorm:"pk bigserial"`
+	Parent Ino    `xorm:"unique(folded) notnull"`
+	Folded []byte `xorm:"unique(folded) varbinary(255) notnull"`
+	Name   []byte `xorm:"varbinary(255) notnull"`
+}
+
 type node struct {
-	Inode     Ino    `xorm:"pk"`
-	Type      uint8  `xorm:"notnull"`
-	Flags     uint8  `xorm:"notnull"`
-	Mode      uint16 `xorm:"notnull"`
-	Uid       uint32 `xorm:"notnull"`
-	Gid       uint32 `xorm:"notnull"`
-	Atime     int64  `xorm:"notnull"`
-	Mtime     int64  `xorm:"notnull"`
-	Ctime     int64  `xorm:"notnull"`
-	Atimensec int16  `xorm:"notnull default 0"`
-	Mtimensec int16  `xorm:"notnull default 0"`
-	Ctimensec int16  `xorm:"notnull default 0"`
-	Nlink     uint32 `xorm:"notnull"`
-	Length    uint64 `xorm:"notnull"`
-	Rdev      uint32
-	Parent    Ino
+	Inode        Ino    `xorm:"pk"`
+	Type         uint8  `xorm:"notnull"`
+	Flags        uint8  `xorm:"notnull"`
+	Mode         uint16 `xorm:"notnull"`
+	Uid          uint32 `xorm:"notnull"`
+	Gid          uint32 `xorm:"notnull"`
+	Atime        int64  `xorm:"notnull"`
+	Mtime        int64  `xorm:"notnull"`
+	Ctime        int64  `xorm:"notnull"`
+	Atimensec    int16  `xorm:"notnull default 0"`
+	Mtimensec    int16  `xorm:"notnull default 0"`
+	Ctimensec    int16  `xorm:"notnull default 0"`
+	Nlink        uint32 `xorm:"notnull"`
+	Length       uint64 `xorm:"notnull"`
+	Rdev         uint32
+	Parent       Ino
+	AccessACLId  uint32 `xorm:"'access_acl_id' notnull default 0"`
+	DefaultACLId uint32 `xorm:"'default_acl_id' notnull default 0"`
+	Btime        int64  `xorm:"notnull default 0"`
+	Btimensec    int16  `xorm:"notnull default 0"`
 }
 
 type namedNode struct {
@@ -100,10 +114,6 @@ type sliceRef struct {
 	Refs int    `xorm:"notnull"`
 }
 
-func (c *sliceRef) TableName() string {
-	return "jfs_chunk_ref"
-}
-
 type delslices struct {
 	Id      uint64 `xorm:"pk chunkid"`
 	Deleted int64  `xorm:"notnull"` // timestamp
@@ -122,6 +132,22 @@ type xattr struct {
 	Value []byte `xorm:"blob notnull"`
 }
 
+type acl struct {
+	Id   uint32 `xorm:"pk"`
+	Rule []byte `xorm:"blob notnull"`
+}
+
+type evictedSession struct {
+	Sid     uint64 `xorm:"pk"`
+	Evicted int64  `xorm:"notnull"`
+}
+
+type invalidation struct {
+	Id  int64  `xorm:"pk bigserial"`
+	Ts  int64  `xorm:"index notnull"`
+	Msg []byte `xorm:"blob notnull"`
+}
+
 type flock struct {
 	Id    int64  `xorm:"pk bigserial"`
 	Inode Ino    `xorm:"notnull unique(flock)"`
@@ -182,10 +208,42 @@ type dirQuota struct {
 	UsedInodes int64 `xorm:"notnull"`
 }
 
+type changelog struct {
+	Inode Ino   `xorm:"pk"`
+	Ts    int64 `xorm:"index notnull"`
+}
+
+type inlineBlock struct {
+	Name string `xorm:"pk varchar(255) notnull"`
+	Data []byte `xorm:"blob notnull"`
+}
+
+type dedupeBlock struct {
+	Name string `xorm:"pk varchar(255) notnull"`
+	Hash string `xorm:"varchar(64) notnull"`
+}
+
+type dedupeRef struct {
+	Hash string `xorm:"pk varchar(64) notnull"`
+	Refs int64  `xorm:"notnull"`
+}
+
+type packedBlock struct {
+	Name string `xorm:"pk varchar(255) notnull"`
+	Loc  string `xorm:"varchar(255) notnull"`
+}
+
+type packRef struct {
+	Pack string `xorm:"pk varchar(255) notnull"`
+	Refs int64  `xorm:"notnull"`
+}
+
 type dbMeta struct {
 	*baseMeta
-	db   *xorm.Engine
-	snap *dbSnap
+	db          *xorm.Engine
+	snap        *dbSnap
+	tablePrefix string       // "jfs_", or "jfsNS_" for namespace NS
+	replicas    *sqlReplicas // nil if reading from replicas is disabled
 
 	noReadOnlyTxn bool
 }
@@ -199,7 +257,19 @@ type dbSnap struct {
 }
 
 func newSQLMeta(driver, addr string, conf *Config) (Meta, error) {
-	var searchPath string
+	var searchPath, readReplicas, staleness string
+	if driver == "mysql" || driver == "postgres" {
+		addr, readReplicas = popSQLOption(addr, "read-replicas")
+		addr, staleness = popSQLOption(addr, "max-staleness")
+	}
+	maxStaleness := time.Second
+	if staleness != "" {
+		d, err := time.ParseDuration(staleness)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max-staleness %s: %s", staleness, err)
+		}
+		maxStaleness = d
+	}
 	if driver == "postgres" {
 		addr = driver + "://" + addr
 		driver = "pgx"
@@ -219,18 +289,7 @@ func newSQLMeta(driver, addr string, conf *Config) (Meta, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to use data source %s: %s", driver, err)
 	}
-	switch logger.Level { // make xorm less verbose
-	case logrus.TraceLevel:
-		engine.SetLogLevel(log.LOG_DEBUG)
-	case logrus.DebugLevel:
-		engine.SetLogLevel(log.LOG_INFO)
-	case logrus.InfoLevel, logrus.WarnLevel:
-		engine.SetLogLevel(log.LOG_WARNING)
-	case logrus.ErrorLevel:
-		engine.SetLogLevel(log.LOG_ERR)
-	default:
-		engine.SetLogLevel(log.LOG_OFF)
-	}
+	setLogLevel(engine)
 
 	start := time.Now()
 	if err = engine.Ping(); err != nil {
@@ -244,16 +303,80 @@ func newSQLMeta(driver, addr string, conf *Config) (Meta, error) {
 	}
 	engine.DB().SetMaxIdleConns(runtime.GOMAXPROCS(-1) * 2)
 	engine.DB().SetConnMaxIdleTime(time.Minute * 5)
-	engine.SetTableMapper(names.NewPrefixMapper(engine.GetTableMapper(), "jfs_"))
+	tablePrefix := "jfs_"
+	if conf.Namespace != "" {
+		tablePrefix = "jfs" + conf.Namespace + "_"
+	}
+	engine.SetTableMapper(tableMapper{engine.GetTableMapper(), tablePrefix})
 	m := &dbMeta{
-		baseMeta: newBaseMeta(addr, conf),
-		db:       engine,
+		baseMeta:    newBaseMeta(addr, conf),
+		db:          engine,
+		tablePrefix: tablePrefix,
+	}
+	if readReplicas != "" {
+		m.replicas, err = newSQLReplicas(driver, addr, readReplicas, maxStaleness, func(db *xorm.Engine) {
+			setLogLevel(db)
+			if searchPath != "" {
+				db.SetSchema(searchPath)
+			}
+			db.SetTableMapper(tableMapper{db.GetTableMapper(), tablePrefix})
+		})
+		if err != nil {
+			_ = engine.Close()
+			return nil, err
+		}
 	}
 	m.en = m
 	return m, nil
 }
 
+func setLogLevel(engine *xorm.Engine) {
+	switch logger.Level { // make xorm less verbose
+	case logrus.TraceLevel:
+		engine.SetLogLevel(log.LOG_DEBUG)
+	case logrus.DebugLevel:
+		engine.SetLogLevel(log.LOG_INFO)
+	case logrus.InfoLevel, logrus.WarnLevel:
+		engine.SetLogLevel(log.LOG_WARNING)
+	case logrus.ErrorLevel:
+		engine.SetLogLevel(log.LOG_ERR)
+	default:
+		engine.SetLogLevel(log.LOG_OFF)
+	}
+}
+
+// tableMapper adds the prefix to table names, sliceRef is kept in table chunk_ref for compatibility.
+type tableMapper struct {
+	names.Mapper
+	prefix string
+}
+
+func (t tableMapper) Obj2Table(name string) string {
+	if name == "sliceRef" {
+		return t.prefix + "chunk_ref"
+	}
+	return t.prefix + t.Mapper.Obj2Table(name)
+}
+
+func (t tableMapper) Table2Obj(name string) string {
+	if name == t.prefix+"chunk_ref" {
+		return "sliceRef"
+	}
+	return t.Mapper.Table2Obj(strings.TrimPrefix(name, t.prefix))
+}
+
+// sql replaces the table names in raw statement for namespace.
+func (m *dbMeta) sql(stmt string) string {
+	if m.tablePrefix == "jfs_" {
+		return stmt
+	}
+	return strings.ReplaceAll(stmt, "jfs_", m.tablePrefix)
+}
+
 func (m *dbMeta) Shutdown() error {
+	if m.replicas != nil {
+		m.replicas.close()
+	}
 	return m.db.Close()
 }
 
@@ -267,11 +390,254 @@ func (m *dbMeta) Name() string {
 
 func (m *dbMeta) doDeleteSlice(id uint64, size uint32) error {
 	return m.txn(func(s *xorm.Session) error {
-		_, err := s.Exec("delete from jfs_chunk_ref where chunkid=?", id)
+		_, err := s.Exec(m.sql("delete from jfs_chunk_ref where chunkid=?"), id)
+		return err
+	})
+}
+
+func (m *dbMeta) doGetInline(key string) ([]byte, error) {
+	var b = inlineBlock{Name: key}
+	var ok bool
+	err := m.roTxn(func(s *xorm.Session) (err error) {
+		ok, err = s.Get(&b)
+		return err
+	})
+	if err == nil && !ok {
+		err = os.ErrNotExist
+	}
+	return b.Data, err
+}
+
+func (m *dbMeta) doSetInline(key string, data []byte) error {
+	return m.txn(func(s *xorm.Session) error {
+		ok, err := s.Exist(&inlineBlock{Name: key})
+		if err != nil {
+			return err
+		}
+		if ok {
+			_, err = s.Cols("data").Update(&inlineBlock{Data: data}, &inlineBlock{Name: key})
+		} else {
+			err = mustInsert(s, &inlineBlock{key, data})
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doDeleteInline(key string) error {
+	return m.txn(func(s *xorm.Session) error {
+		n, err := s.Delete(&inlineBlock{Name: key})
+		if err == nil && n == 0 {
+			err = os.ErrNotExist
+		}
 		return err
 	})
 }
 
+func (m *dbMeta) doRefBlock(key, hash string) (int64, error) {
+	var refs int64
+	err := m.txn(func(s *xorm.Session) error {
+		var b = dedupeBlock{Name: key}
+		ok, err := s.ForUpdate().Get(&b)
+		if err != nil {
+			return err
+		}
+		if ok && b.Hash != hash {
+			return errHashMismatch(key, b.Hash, hash)
+		}
+		var r = dedupeRef{Hash: hash}
+		exist, err := s.ForUpdate().Get(&r)
+		if err != nil {
+			return err
+		}
+		if ok {
+			refs = r.Refs
+			return nil
+		}
+		if exist && r.Refs < 0 { // being deleted
+			refs = -1
+			return nil
+		}
+		if err = mustInsert(s, &dedupeBlock{key, hash}); err != nil {
+			return err
+		}
+		refs = r.Refs + 1
+		if exist {
+			_, err = s.Cols("refs").Update(&dedupeRef{Refs: refs}, &dedupeRef{Hash: hash})
+		} else {
+			err = mustInsert(s, &dedupeRef{hash, refs})
+		}
+		return err
+	})
+	return refs, err
+}
+
+func (m *dbMeta) doUnrefBlock(key string) (string, int64, error) {
+	var b = dedupeBlock{Name: key}
+	var refs int64
+	err := m.txn(func(s *xorm.Session) error {
+		ok, err := s.ForUpdate().Get(&b)
+		if err != nil {
+			return err
+		} else if !ok {
+			return os.ErrNotExist
+		}
+		var r = dedupeRef{Hash: b.Hash}
+		if _, err = s.ForUpdate().Get(&r); err != nil {
+			return err
+		}
+		if _, err = s.Delete(&dedupeBlock{Name: key}); err != nil {
+			return err
+		}
+		refs = r.Refs - 1
+		if refs > 0 {
+			_, err = s.Cols("refs").Update(&dedupeRef{Refs: refs}, &dedupeRef{Hash: b.Hash})
+		} else {
+			refs = 0
+			_, err = s.Cols("refs").Update(&dedupeRef{Refs: -1}, &dedupeRef{Hash: b.Hash}) // deleting
+		}
+		return err
+	})
+	return b.Hash, refs, err
+}
+
+func (m *dbMeta) doDropContent(hash string) error {
+	return m.txn(func(s *xorm.Session) error {
+		var r = dedupeRef{Hash: hash}
+		ok, err := s.ForUpdate().Get(&r)
+		if err != nil || !ok || r.Refs >= 0 {
+			return err
+		}
+		_, err = s.Delete(&dedupeRef{Hash: hash})
+		return err
+	})
+}
+
+func (m *dbMeta) doGetBlockHash(key string) (string, error) {
+	var b = dedupeBlock{Name: key}
+	var ok bool
+	err := m.roTxn(func(s *xorm.Session) (err error) {
+		ok, err = s.Get(&b)
+		return err
+	})
+	if err == nil && !ok {
+		err = os.ErrNotExist
+	}
+	return b.Hash, err
+}
+
+func (m *dbMeta) doScanBlockHash(fn func(key, hash string) error) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var blocks []dedupeBlock
+		if err := s.Find(&blocks); err != nil {
+			return err
+		}
+		for _, b := range blocks {
+			if err := fn(b.Name, b.Hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) doPackBlocks(pack string, locs map[string]string) (int64, error) {
+	var refs int64
+	err := m.txn(func(s *xorm.Session) error {
+		refs = 0
+		for k, loc := range locs {
+			ok, err := s.Exist(&packedBlock{Name: k})
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+			if err = mustInsert(s, &packedBlock{k, loc}); err != nil {
+				return err
+			}
+			refs++
+		}
+		if refs > 0 {
+			return mustInsert(s, &packRef{pack, refs})
+		}
+		return nil
+	})
+	return refs, err
+}
+
+func (m *dbMeta) doGetPackedBlock(key string) (string, error) {
+	var b = packedBlock{Name: key}
+	var ok bool
+	err := m.roTxn(func(s *xorm.Session) (err error) {
+		ok, err = s.Get(&b)
+		return err
+	})
+	if err == nil && !ok {
+		err = os.ErrNotExist
+	}
+	return b.Loc, err
+}
+
+func (m *dbMeta) doUnpackBlock(key string) (string, int64, error) {
+	var b = packedBlock{Name: key}
+	var refs int64
+	err := m.txn(func(s *xorm.Session) error {
+		ok, err := s.ForUpdate().Get(&b)
+		if err != nil {
+			return err
+		} else if !ok {
+			return os.ErrNotExist
+		}
+		pack := packOf(b.Loc)
+		var r = packRef{Pack: pack}
+		if _, err = s.ForUpdate().Get(&r); err != nil {
+			return err
+		}
+		if _, err = s.Delete(&packedBlock{Name: key}); err != nil {
+			return err
+		}
+		refs = r.Refs - 1
+		if refs > 0 {
+			_, err = s.Cols("refs").Update(&packRef{Refs: refs}, &packRef{Pack: pack})
+		} else {
+			refs = 0
+			_, err = s.Delete(&packRef{Pack: pack})
+		}
+		return err
+	})
+	return b.Loc, refs, err
+}
+
+func (m *dbMeta) doScanPackedBlock(fn func(key, loc string) error) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var blocks []packedBlock
+		if err := s.Find(&blocks); err != nil {
+			return err
+		}
+		for _, b := range blocks {
+			if err := fn(b.Name, b.Loc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) doScanInline(fn func(key string, data []byte) error) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var blocks []inlineBlock
+		if err := s.Find(&blocks); err != nil {
+			return err
+		}
+		for _, b := range blocks {
+			if err := fn(b.Name, b.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (m *dbMeta) syncTable(beans ...interface{}) error {
 	err := m.db.Sync2(beans...)
 	if err != nil && strings.Contains(err.Error(), "Duplicate key") {
@@ -284,8 +650,8 @@ func (m *dbMeta) doInit(format *Format, force bool) error {
 	if err := m.syncTable(new(setting), new(counter)); err != nil {
 		return fmt.Errorf("create table setting, counter: %s", err)
 	}
-	if err := m.syncTable(new(edge)); err != nil {
-		return fmt.Errorf("create table edge: %s", err)
+	if err := m.syncTable(new(edge), new(foldedEdge)); err != nil {
+		return fmt.Errorf("create table edge, foldedEdge: %s", err)
 	}
 	if err := m.syncTable(new(node), new(symlink), new(xattr)); err != nil {
 		return fmt.Errorf("create table node, symlink, xattr: %s", err)
@@ -296,8 +662,8 @@ func (m *dbMeta) doInit(format *Format, force bool) error {
 	if err := m.syncTable(new(session2), new(sustained), new(delfile)); err != nil {
 		return fmt.Errorf("create table session2, sustaind, delfile: %s", err)
 	}
-	if err := m.syncTable(new(flock), new(plock), new(dirQuota)); err != nil {
-		return fmt.Errorf("create table flock, plock, dirQuota: %s", err)
+	if err := m.syncTable(new(flock), new(plock), new(dirQuota), new(changelog)); err != nil {
+		return fmt.Errorf("create table flock, plock, dirQuota, changelog: %s", err)
 	}
 	if err := m.syncTable(new(dirStats)); err != nil {
 		return fmt.Errorf("create table dirStats: %s", err)
@@ -305,6 +671,12 @@ func (m *dbMeta) doInit(format *Format, force bool) error {
 	if err := m.syncTable(new(detachedNode)); err != nil {
 		return fmt.Errorf("create table detachedNode: %s", err)
 	}
+	if err := m.syncTable(new(acl), new(invalidation), new(evictedSession)); err != nil {
+		return fmt.Errorf("create table acl, invalidation, evicted_session: %s", err)
+	}
+	if err := m.syncTable(new(inlineBlock), new(dedupeBlock), new(dedupeRef), new(packedBlock), new(packRef)); err != nil {
+		return fmt.Errorf("create table inline_block, dedupe_block, dedupe_ref, packed_block, pack_ref: %s", err)
+	}
 
 	var s = setting{Name: "format"}
 	var ok bool
@@ -354,7 +726,7 @@ func (m *dbMeta) doInit(format *Format, force bool) error {
 		Parent:    1,
 	}
 	return m.txn(func(s *xorm.Session) error {
-		if format.TrashDays > 0 {
+		if format.trashEnabled() {
 			ok2, err := s.ForUpdate().Get(&node{Inode: TrashInode})
 			if err != nil {
 				return err
@@ -398,7 +770,7 @@ func (m *dbMeta) Reset() error {
 		&node{}, &edge{}, &symlink{}, &xattr{},
 		&chunk{}, &sliceRef{}, &delslices{},
 		&session{}, &session2{}, &sustained{}, &delfile{},
-		&flock{}, &plock{}, &dirStats{}, &dirQuota{}, &detachedNode{})
+		&flock{}, &plock{}, &dirStats{}, &dirQuota{}, &detachedNode{}, &changelog{}, &foldedEdge{}, &acl{}, &invalidation{}, &evictedSession{}, &inlineBlock{}, &dedupeBlock{}, &dedupeRef{}, &packedBlock{}, &packRef{})
 }
 
 func (m *dbMeta) doLoad() (data []byte, err error) {
@@ -420,9 +792,9 @@ func (m *dbMeta) doLoad() (data []byte, err error) {
 
 func (m *dbMeta) doNewSession(sinfo []byte) error {
 	// add new table
-	err := m.syncTable(new(session2), new(delslices), new(dirStats), new(detachedNode), new(dirQuota))
+	err := m.syncTable(new(session2), new(delslices), new(dirStats), new(detachedNode), new(dirQuota), new(changelog), new(acl), new(invalidation), new(evictedSession), new(inlineBlock), new(dedupeBlock), new(dedupeRef), new(packedBlock), new(packRef))
 	if err != nil {
-		return fmt.Errorf("update table session2, delslices, dirstats, detachedNode, dirQuota: %s", err)
+		return fmt.Errorf("update table session2, delslices, dirstats, detachedNode, dirQuota, changelog, acl, inline_block, dedupe, pack: %s", err)
 	}
 	// add node table
 	if err = m.syncTable(new(node)); err != nil {
@@ -689,11 +1061,14 @@ func (m *dbMeta) shouldRetry(err error) bool {
 }
 
 func (m *dbMeta) txn(f func(s *xorm.Session) error, inodes ...Ino) error {
-	if m.conf.ReadOnly {
+	m.beginWrite()
+	defer m.endWrite()
+	if m.conf.ReadOnly || m.leaseExpired() || m.isFrozen() {
 		return syscall.EROFS
 	}
-	start := time.Now()
-	defer func() { m.txDist.Observe(time.Since(start).Seconds()) }()
+	method, start := txnMethod(), time.Now()
+	var restarts int
+	defer func() { m.observeTxn(method, start, restarts, inodes) }()
 
 	if m.Name() == "sqlite3" {
 		// sqlite only allow one writer at a time
@@ -709,11 +1084,14 @@ func (m *dbMeta) txn(f func(s *xorm.Session) error, inodes ...Ino) error {
 		_, err := m.db.Transaction(func(s *xorm.Session) (interface{}, error) {
 			return nil, f(s)
 		})
+		if m.replicas != nil {
+			m.replicas.wrote() // it may be changed even if failed
+		}
 		if eno, ok := err.(syscall.Errno); ok && eno == 0 {
 			err = nil
 		}
 		if err != nil && m.shouldRetry(err) {
-			m.txRestart.Add(1)
+			restarts++
 			logger.Debugf("Transaction failed, restart it (tried %d): %s", i+1, err)
 			lastErr = err
 			time.Sleep(time.Millisecond * time.Duration(i*i))
@@ -728,9 +1106,14 @@ func (m *dbMeta) txn(f func(s *xorm.Session) error, inodes ...Ino) error {
 }
 
 func (m *dbMeta) roTxn(f func(s *xorm.Session) error) error {
-	start := time.Now()
-	defer func() { m.txDist.Observe(time.Since(start).Seconds()) }()
-	s := m.db.NewSession()
+	return m.roTxnOn(m.db, f)
+}
+
+func (m *dbMeta) roTxnOn(db *xorm.Engine, f func(s *xorm.Session) error) error {
+	method, start := txnMethod(), time.Now()
+	var restarts int
+	defer func() { m.observeTxn(method, start, restarts, nil) }()
+	s := db.NewSession()
 	defer s.Close()
 	var opt sql.TxOptions
 	if !m.noReadOnlyTxn {
@@ -759,7 +1142,7 @@ func (m *dbMeta) roTxn(f func(s *xorm.Session) error) error {
 		}
 		_ = s.Rollback()
 		if err != nil && m.shouldRetry(err) {
-			m.txRestart.Add(1)
+			restarts++
 			logger.Debugf("Read transaction failed, restart it (tried %d): %s", i+1, err)
 			lastErr = err
 			time.Sleep(time.Millisecond * time.Duration(i*i))
@@ -788,10 +1171,14 @@ func (m *dbMeta) parseAttr(n *node, attr *Attr) {
 	attr.Mtimensec = uint32(n.Mtime%1e6*1000) + uint32(n.Mtimensec)
 	attr.Ctime = n.Ctime / 1e6
 	attr.Ctimensec = uint32(n.Ctime%1e6*1000) + uint32(n.Ctimensec)
+	attr.Btime = n.Btime / 1e6
+	attr.Btimensec = uint32(n.Btime%1e6*1000) + uint32(n.Btimensec)
 	attr.Nlink = n.Nlink
 	attr.Length = n.Length
 	attr.Rdev = n.Rdev
 	attr.Parent = n.Parent
+	attr.AccessACL = n.AccessACLId
+	attr.DefaultACL = n.DefaultACLId
 	attr.Full = true
 }
 
@@ -810,10 +1197,14 @@ func (m *dbMeta) parseNode(attr *Attr, n *node) {
 	n.Atimensec = int16(attr.Atimensec % 1000)
 	n.Mtimensec = int16(attr.Mtimensec % 1000)
 	n.Ctimensec = int16(attr.Ctimensec % 1000)
+	n.Btime = attr.Btime*1e6 + int64(attr.Btimensec)/1000
+	n.Btimensec = int16(attr.Btimensec % 1000)
 	n.Nlink = attr.Nlink
 	n.Length = attr.Length
 	n.Rdev = attr.Rdev
 	n.Parent = attr.Parent
+	n.AccessACLId = attr.AccessACL
+	n.DefaultACLId = attr.DefaultACL
 }
 
 func (m *dbMeta) updateStats(space int64, inodes int64) {
@@ -831,7 +1222,7 @@ func (m *dbMeta) flushStats() {
 		newInodes := atomic.LoadInt64(&m.newInodes)
 		if newSpace != 0 || newInodes != 0 {
 			err := m.txn(func(s *xorm.Session) error {
-				_, err := s.Exec(fmt.Sprintf("UPDATE jfs_counter SET value=value+ CAST((CASE name WHEN 'usedSpace' THEN %d ELSE %d END) AS %s) WHERE name='usedSpace' OR name='totalInodes' ", newSpace, newInodes, inttype))
+				_, err := s.Exec(m.sql(fmt.Sprintf("UPDATE jfs_counter SET value=value+ CAST((CASE name WHEN 'usedSpace' THEN %d ELSE %d END) AS %s) WHERE name='usedSpace' OR name='totalInodes' ", newSpace, newInodes, inttype)))
 				return err
 			})
 			if err != nil && !strings.Contains(err.Error(), "attempt to write a readonly database") {
@@ -848,15 +1239,49 @@ func (m *dbMeta) flushStats() {
 	}
 }
 
+// insertFolded and deleteFolded maintain the folded names of entries for case-insensitive volume.
+func (m *dbMeta) insertFolded(s *xorm.Session, parent Ino, name []byte) error {
+	if !m.caseFolded(parent) {
+		return nil
+	}
+	return mustInsert(s, &foldedEdge{Parent: parent, Folded: []byte(foldName(string(name))), Name: name})
+}
+
+func (m *dbMeta) deleteFolded(s *xorm.Session, parent Ino, name []byte) error {
+	if !m.caseFolded(parent) {
+		return nil
+	}
+	_, err := s.Delete(&foldedEdge{Parent: parent, Folded: []byte(foldName(string(name)))})
+	return err
+}
+
+func (m *dbMeta) doLookupFolded(ctx Context, parent Ino, name string) *Entry {
+	var e *Entry
+	_ = m.replicaTxn(func(s *xorm.Session) error {
+		e = nil
+		f := foldedEdge{Parent: parent, Folded: []byte(foldName(name))}
+		if ok, err := s.Get(&f); err != nil || !ok {
+			return err
+		}
+		de := edge{Parent: parent, Name: f.Name}
+		if ok, err := s.Get(&de); err != nil || !ok {
+			return err
+		}
+		e = &Entry{Inode: de.Inode, Name: de.Name, Attr: &Attr{Typ: de.Type}}
+		return nil
+	})
+	return e
+}
+
 func (m *dbMeta) doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
-	return errno(m.roTxn(func(s *xorm.Session) error {
+	return errno(m.replicaTxn(func(s *xorm.Session) error {
 		s = s.Table(&edge{})
 		nn := namedNode{node: node{Parent: parent}, Name: []byte(name)}
 		var exist bool
 		var err error
 		if attr != nil {
-			s = s.Join("INNER", &node{}, "jfs_edge.inode=jfs_node.inode")
-			exist, err = s.Select("jfs_node.*").Get(&nn)
+			s = s.Join("INNER", &node{}, m.sql("jfs_edge.inode=jfs_node.inode"))
+			exist, err = s.Select(m.sql("jfs_node.*")).Get(&nn)
 		} else {
 			exist, err = s.Select("*").Get(&nn)
 		}
@@ -873,7 +1298,7 @@ func (m *dbMeta) doLookup(ctx Context, parent Ino, name string, inode *Ino, attr
 }
 
 func (m *dbMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
-	return errno(m.roTxn(func(s *xorm.Session) error {
+	return errno(m.replicaTxn(func(s *xorm.Session) error {
 		var n = node{Inode: inode}
 		ok, err := s.Get(&n)
 		if ok {
@@ -888,8 +1313,14 @@ func (m *dbMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
 	defer m.timeit("SetAttr", time.Now())
 	inode = m.checkRoot(inode)
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	defer func() { m.of.InvalidateChunk(inode, invalidateAttrOnly) }()
-	return errno(m.txn(func(s *xorm.Session) error {
+	defer m.logChange(inode)
+	var curAttr Attr
+	st := errno(m.txn(func(s *xorm.Session) error {
 		var cur = node{Inode: inode}
 		ok, err := s.ForUpdate().Get(&cur)
 		if err != nil {
@@ -898,7 +1329,6 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 		if !ok {
 			return syscall.ENOENT
 		}
-		var curAttr Attr
 		m.parseAttr(&cur, &curAttr)
 		now := time.Now()
 		dirtyAttr, st := m.mergeAttr(ctx, inode, set, &curAttr, attr, now)
@@ -912,13 +1342,18 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 		m.parseNode(dirtyAttr, &dirtyNode)
 		dirtyNode.Ctime = now.UnixNano() / 1e3
 		dirtyNode.Ctimensec = int16(now.Nanosecond() % 1000)
-		_, err = s.Cols("flags", "mode", "uid", "gid", "atime", "mtime", "ctime", "atimensec", "mtimensec", "ctimensec").
+		_, err = s.Cols("flags", "mode", "uid", "gid", "atime", "mtime", "ctime", "atimensec", "mtimensec", "ctimensec", "access_acl_id").
 			Update(&dirtyNode, &node{Inode: inode})
 		if err == nil {
 			m.parseAttr(&dirtyNode, attr)
 		}
 		return err
 	}, inode))
+	if st == 0 {
+		m.moveOwnerQuota(&curAttr, attr)
+		m.notifyAttr(ctx, inode, attr)
+	}
+	return st
 }
 
 func (m *dbMeta) appendSlice(s *xorm.Session, inode Ino, indx uint32, buf []byte) error {
@@ -926,9 +1361,9 @@ func (m *dbMeta) appendSlice(s *xorm.Session, inode Ino, indx uint32, buf []byte
 	var err error
 	driver := m.Name()
 	if driver == "sqlite3" || driver == "postgres" {
-		r, err = s.Exec("update jfs_chunk set slices=slices || ? where inode=? AND indx=?", buf, inode, indx)
+		r, err = s.Exec(m.sql("update jfs_chunk set slices=slices || ? where inode=? AND indx=?"), buf, inode, indx)
 	} else {
-		r, err = s.Exec("update jfs_chunk set slices=concat(slices, ?) where inode=? AND indx=?", buf, inode, indx)
+		r, err = s.Exec(m.sql("update jfs_chunk set slices=concat(slices, ?) where inode=? AND indx=?"), buf, inode, indx)
 	}
 	if err == nil {
 		if n, _ := r.RowsAffected(); n == 0 {
@@ -940,6 +1375,10 @@ func (m *dbMeta) appendSlice(s *xorm.Session, inode Ino, indx uint32, buf []byte
 
 func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr, skipPermCheck bool) syscall.Errno {
 	defer m.timeit("Truncate", time.Now())
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -975,7 +1414,7 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		}
 		newLength = int64(length) - int64(nodeAttr.Length)
 		newSpace = align4K(length) - align4K(nodeAttr.Length)
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(s, inode, nodeAttr.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, nodeAttr.Uid, nodeAttr.Gid, m.getParents(s, inode, nodeAttr.Parent)...); err != 0 {
 			return err
 		}
 		var zeroChunks []chunk
@@ -1021,7 +1460,10 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		return nil
 	}, inode)
 	if err == nil {
+		m.logChange(inode)
+		m.notifyAttr(ctx, inode, attr)
 		m.updateParentStat(ctx, inode, nodeAttr.Parent, newLength, newSpace)
+		m.updateOwnerQuota(nodeAttr.Uid, nodeAttr.Gid, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -1043,6 +1485,10 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		return syscall.EINVAL
 	}
 	defer m.timeit("Fallocate", time.Now())
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -1083,7 +1529,7 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		old := nodeAttr.Length
 		newLength = int64(length) - int64(old)
 		newSpace = align4K(length) - align4K(old)
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(s, inode, nodeAttr.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, nodeAttr.Uid, nodeAttr.Gid, m.getParents(s, inode, nodeAttr.Parent)...); err != 0 {
 			return err
 		}
 		now := time.Now().UnixNano()
@@ -1118,7 +1564,12 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		return nil
 	}, inode)
 	if err == nil {
+		m.logChange(inode)
 		m.updateParentStat(ctx, inode, nodeAttr.Parent, newLength, newSpace)
+		m.updateOwnerQuota(nodeAttr.Uid, nodeAttr.Gid, newSpace, 0)
+		if mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			m.compactHoles(inode, off, size, nodeAttr.Length)
+		}
 	}
 	return errno(err)
 }
@@ -1257,6 +1708,11 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 			}
 			return syscall.EEXIST
 		}
+		var nattr = Attr{Typ: _type}
+		if st := m.inheritACL(&nattr, &pattr, mode, cumask); st != 0 {
+			return st
+		}
+		n.Mode, n.AccessACLId, n.DefaultACLId = nattr.Mode, nattr.AccessACL, nattr.DefaultACL
 
 		var updateParent bool
 		now := time.Now().UnixNano()
@@ -1274,9 +1730,11 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		n.Atime = now / 1e3
 		n.Mtime = now / 1e3
 		n.Ctime = now / 1e3
+		n.Btime = now / 1e3
 		n.Atimensec = int16(now % 1e3)
 		n.Mtimensec = int16(now % 1e3)
 		n.Ctimensec = int16(now % 1e3)
+		n.Btimensec = int16(now % 1e3)
 		if ctx.Value(CtxKey("behavior")) == "Hadoop" || runtime.GOOS == "darwin" {
 			n.Gid = pn.Gid
 		} else if runtime.GOOS == "linux" && pn.Mode&02000 != 0 {
@@ -1299,6 +1757,9 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		if err = mustInsert(s, &edge{Parent: parent, Name: []byte(name), Inode: ino, Type: _type}, &n); err != nil {
 			return err
 		}
+		if err = m.insertFolded(s, parent, []byte(name)); err != nil {
+			return err
+		}
 		if updateParent {
 			if _, err := s.Cols("nlink", "mtime", "ctime", "mtimensec", "ctimensec").Update(&pn, &node{Inode: pn.Inode}); err != nil {
 				return err
@@ -1417,6 +1878,9 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string, attr *Attr, skip
 		if _, err := s.Delete(&edge{Parent: parent, Name: e.Name}); err != nil {
 			return err
 		}
+		if err := m.deleteFolded(s, parent, e.Name); err != nil {
+			return err
+		}
 		if updateParent {
 			if _, err = s.Cols("mtime", "ctime", "mtimensec", "ctimensec").Update(&pn, &node{Inode: pn.Inode}); err != nil {
 				return err
@@ -1563,6 +2027,9 @@ func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string, pinode *Ino, skip
 		if _, err := s.Delete(&edge{Parent: parent, Name: e.Name}); err != nil {
 			return err
 		}
+		if err := m.deleteFolded(s, parent, e.Name); err != nil {
+			return err
+		}
 		if _, err := s.Delete(&dirStats{Inode: e.Inode}); err != nil {
 			logger.Warnf("remove dir usage of ino(%d): %s", e.Inode, err)
 		}
@@ -1617,6 +2084,13 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		return st
 	}
 	exchange := flags == RenameExchange
+	var wino Ino // inode of the whiteout
+	if flags&RenameWhiteout != 0 {
+		var err error
+		if wino, err = m.nextInode(); err != nil {
+			return errno(err)
+		}
+	}
 	var opened bool
 	var dino Ino
 	var dn node
@@ -1710,7 +2184,7 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		now := time.Now().UnixNano()
 		dn = node{Inode: de.Inode}
 		if ok {
-			if flags == RenameNoReplace {
+			if flags&RenameNoReplace != 0 {
 				return syscall.EEXIST
 			}
 			dino = de.Inode
@@ -1827,6 +2301,17 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			} else if n != 1 {
 				return fmt.Errorf("delete src failed")
 			}
+			if wino == 0 {
+				if err := m.deleteFolded(s, parentSrc, se.Name); err != nil {
+					return err
+				}
+			} else {
+				wn := node{Inode: wino}
+				m.parseNode(whiteoutAttr(ctx, parentSrc, time.Unix(0, now)), &wn)
+				if err = mustInsert(s, &edge{Parent: parentSrc, Name: se.Name, Inode: wino, Type: TypeCharDev}, &wn); err != nil {
+					return err
+				}
+			}
 			if dino > 0 {
 				if trash > 0 {
 					if _, err := s.Cols("ctime", "ctimensec", "parent").Update(dn, &node{Inode: dino}); err != nil {
@@ -1876,6 +2361,9 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 				if _, err := s.Delete(&edge{Parent: parentDst, Name: de.Name}); err != nil {
 					return err
 				}
+				if err := m.deleteFolded(s, parentDst, de.Name); err != nil {
+					return err
+				}
 				if de.Type == TypeDirectory {
 					if _, err = s.Delete(&dirQuota{Inode: dino}); err != nil {
 						return err
@@ -1885,6 +2373,9 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			if err = mustInsert(s, &edge{Parent: parentDst, Name: de.Name, Inode: se.Inode, Type: se.Type}); err != nil {
 				return err
 			}
+			if err = m.insertFolded(s, parentDst, de.Name); err != nil {
+				return err
+			}
 		}
 		if parentDst != parentSrc && !isTrash(parentSrc) && supdate {
 			if _, err := s.Cols("nlink", "mtime", "ctime", "mtimensec", "ctimensec").Update(&spn, &node{Inode: parentSrc}); err != nil {
@@ -1962,13 +2453,21 @@ func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 			pn.Ctime = now / 1e3
 			updateParent = true
 		}
-		n.Parent = 0
+		relink := n.Nlink == 0 // anonymous file (O_TMPFILE)
+		if relink {
+			n.Parent = parent
+		} else {
+			n.Parent = 0
+		}
 		n.Nlink++
 		n.Ctime = now / 1e3
 
 		if err = mustInsert(s, &edge{Parent: parent, Name: []byte(name), Inode: inode, Type: n.Type}); err != nil {
 			return err
 		}
+		if err = m.insertFolded(s, parent, []byte(name)); err != nil {
+			return err
+		}
 		if updateParent {
 			if _, err := s.Cols("mtime", "ctime", "mtimensec", "ctimensec").Update(&pn, &node{Inode: parent}); err != nil {
 				return err
@@ -1977,6 +2476,11 @@ func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 		if _, err := s.Cols("nlink", "ctime", "ctimensec", "parent").Update(&n, node{Inode: inode}); err != nil {
 			return err
 		}
+		if relink {
+			if _, err := s.Delete(&sustained{Sid: m.sid, Inode: inode}); err != nil {
+				return err
+			}
+		}
 		if err == nil {
 			m.parseAttr(&n, attr)
 		}
@@ -1985,16 +2489,23 @@ func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 }
 
 func (m *dbMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry, limit int) syscall.Errno {
-	return errno(m.roTxn(func(s *xorm.Session) error {
+	return m.readdirByPage(ctx, inode, plus, entries, limit)
+}
+
+func (m *dbMeta) doReaddirPage(ctx Context, inode Ino, plus uint8, after []byte, limit int, entries *[]*Entry) syscall.Errno {
+	return errno(m.replicaTxn(func(s *xorm.Session) error {
 		s = s.Table(&edge{})
 		if plus != 0 {
-			s = s.Join("INNER", &node{}, "jfs_edge.inode=jfs_node.inode")
+			s = s.Join("INNER", &node{}, m.sql("jfs_edge.inode=jfs_node.inode"))
+		}
+		if after != nil {
+			s = s.Where(m.sql("jfs_edge.name > ?"), after)
 		}
 		if limit > 0 {
 			s = s.Limit(limit, 0)
 		}
 		var nodes []namedNode
-		if err := s.Find(&nodes, &edge{Parent: inode}); err != nil {
+		if err := s.OrderBy(m.sql("jfs_edge.name")).Find(&nodes, &edge{Parent: inode}); err != nil {
 			return err
 		}
 		for _, n := range nodes {
@@ -2112,13 +2623,26 @@ func (m *dbMeta) doFindStaleSessions(limit int) ([]uint64, error) {
 }
 
 func (m *dbMeta) doRefreshSession() error {
-	return m.txn(func(ses *xorm.Session) error {
+	// not use m.txn, which refuses to write once the lease is expired
+	_, err := m.db.Transaction(func(ses *xorm.Session) (interface{}, error) {
+		if ok, err := ses.Exist(&evictedSession{Sid: m.sid}); err != nil {
+			return nil, err
+		} else if ok {
+			return nil, errSessionEvicted
+		}
 		n, err := ses.Cols("Expire").Update(&session2{Expire: m.expireTime()}, &session2{Sid: m.sid})
 		if err == nil && n == 0 {
 			logger.Warnf("Session %d was stale and cleaned up, but now it comes back again", m.sid)
 			err = mustInsert(ses, &session2{m.sid, m.expireTime(), m.newSessionInfo()})
 		}
-		return err
+		return nil, err
+	})
+	return err
+}
+
+func (m *dbMeta) doEvictSession(sid uint64) error {
+	return m.txn(func(s *xorm.Session) error {
+		return mustInsert(s, &evictedSession{sid, time.Now().Unix()})
 	})
 }
 
@@ -2192,6 +2716,10 @@ func (m *dbMeta) Read(ctx Context, inode Ino, indx uint32, slices *[]Slice) (rer
 
 func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice, mtime time.Time) syscall.Errno {
 	defer m.timeit("Write", time.Now())
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -2220,7 +2748,7 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 			newSpace = align4K(newleng) - align4K(nodeAttr.Length)
 			nodeAttr.Length = newleng
 		}
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(s, inode, nodeAttr.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, nodeAttr.Uid, nodeAttr.Gid, m.getParents(s, inode, nodeAttr.Parent)...); err != 0 {
 			return err
 		}
 		nodeAttr.Mtime = mtime.UnixNano() / 1e3
@@ -2257,13 +2785,19 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if needCompact {
 			go m.compactChunk(inode, indx, false)
 		}
+		m.logChange(inode)
 		m.updateParentStat(ctx, inode, nodeAttr.Parent, newLength, newSpace)
+		m.updateOwnerQuota(nodeAttr.Uid, nodeAttr.Gid, newSpace, 0)
 	}
 	return errno(err)
 }
 
 func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
 	defer m.timeit("CopyFileRange", time.Now())
+	if st := m.beginChangeOf(ctx, fout); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(fout)
 	if f != nil {
 		f.Lock()
@@ -2304,7 +2838,7 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 			newSpace = align4K(newleng) - align4K(nout.Length)
 			nout.Length = newleng
 		}
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(s, fout, nout.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, nout.Uid, nout.Gid, m.getParents(s, fout, nout.Parent)...); err != 0 {
 			return err
 		}
 		now := time.Now().UnixNano()
@@ -2332,7 +2866,7 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 				return err
 			}
 			if id > 0 {
-				if _, err := ses.Exec("update jfs_chunk_ref set refs=refs+1 where chunkid = ? AND size = ?", id, size); err != nil {
+				if _, err := ses.Exec(m.sql("update jfs_chunk_ref set refs=refs+1 where chunkid = ? AND size = ?"), id, size); err != nil {
 					return err
 				}
 			}
@@ -2386,7 +2920,9 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		return nil
 	}, fout)
 	if err == nil {
+		m.logChange(fout)
 		m.updateParentStat(ctx, fout, nout.Parent, newLength, newSpace)
+		m.updateOwnerQuota(nout.Uid, nout.Gid, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -2585,7 +3121,7 @@ func (m *dbMeta) deleteChunk(inode Ino, indx uint32) error {
 			if sc.id == 0 {
 				continue
 			}
-			_, err = s.Exec("update jfs_chunk_ref set refs=refs-1 where chunkid=? AND size=?", sc.id, sc.size)
+			_, err = s.Exec(m.sql("update jfs_chunk_ref set refs=refs-1 where chunkid=? AND size=?"), sc.id, sc.size)
 			if err != nil {
 				return err
 			}
@@ -2664,7 +3200,7 @@ func (m *dbMeta) doCleanupDelayedSlices(edge int64) (int, error) {
 					return fmt.Errorf("invalid value for delayed slices %d: %v", ds.Id, ds.Slices)
 				}
 				for _, s := range ss {
-					if _, e := ses.Exec("update jfs_chunk_ref set refs=refs-1 where chunkid=? and size=?", s.Id, s.Size); e != nil {
+					if _, e := ses.Exec(m.sql("update jfs_chunk_ref set refs=refs-1 where chunkid=? and size=?"), s.Id, s.Size); e != nil {
 						return e
 					}
 				}
@@ -2736,22 +3272,27 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	skipped := skipSome(ss)
 	ss = ss[skipped:]
 	pos, size, slices := compactChunk(ss)
-	if len(ss) < 2 || size == 0 {
+	if len(ss) < 2 {
 		return
 	}
 
+	// size is 0 when all the slices are covered by holes, they can be dropped directly
 	var id uint64
-	st := m.NewSlice(Background, &id)
-	if st != 0 {
-		return
-	}
-	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
-	err = m.newMsg(CompactChunk, slices, id)
-	if err != nil {
-		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
-			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+	if size > 0 {
+		st := m.NewSlice(Background, &id)
+		if st != 0 {
+			return
 		}
-		return
+		logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
+		err = m.newMsg(CompactChunk, slices, id, inode)
+		if err != nil {
+			if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
+				logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+			}
+			return
+		}
+	} else {
+		logger.Debugf("compact %d:%d: drop %d slices covered by holes", inode, indx, len(ss))
 	}
 	var buf []byte
 	trash := m.toTrash(0)
@@ -2773,14 +3314,24 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 			return syscall.EINVAL
 		}
 
-		c2.Slices = append(append(c2.Slices[:skipped*sliceBytes], marshalSlice(pos, id, size, 0, size)...), c2.Slices[len(c.Slices):]...)
-		if _, err := s.Where("Inode = ? AND indx = ?", inode, indx).Update(c2); err != nil {
-			return err
+		data := c2.Slices[:skipped*sliceBytes]
+		if id > 0 {
+			data = append(data, marshalSlice(pos, id, size, 0, size)...)
 		}
-		// create the key to tracking it
-		if err = mustInsert(s, sliceRef{id, size, 1}); err != nil {
+		c2.Slices = append(data, c2.Slices[len(c.Slices):]...)
+		if len(c2.Slices) == 0 {
+			if _, err := s.Exec(m.sql("delete from jfs_chunk where inode=? AND indx=?"), inode, indx); err != nil {
+				return err
+			}
+		} else if _, err := s.Where("Inode = ? AND indx = ?", inode, indx).Update(c2); err != nil {
 			return err
 		}
+		if id > 0 {
+			// create the key to tracking it
+			if err = mustInsert(s, sliceRef{id, size, 1}); err != nil {
+				return err
+			}
+		}
 		if trash {
 			if len(buf) > 0 {
 				if err = mustInsert(s, &delslices{id, time.Now().Unix(), buf}); err != nil {
@@ -2792,7 +3343,7 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 				if s_.id == 0 {
 					continue
 				}
-				if _, err := s.Exec("update jfs_chunk_ref set refs=refs-1 where chunkid=? and size=?", s_.id, s_.size); err != nil {
+				if _, err := s.Exec(m.sql("update jfs_chunk_ref set refs=refs-1 where chunkid=? and size=?"), s_.id, s_.size); err != nil {
 					return err
 				}
 			}
@@ -2800,7 +3351,7 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		return nil
 	})
 	// there could be false-negative that the compaction is successful, double-check
-	if err != nil {
+	if err != nil && id > 0 {
 		var c = sliceRef{Id: id}
 		var ok bool
 		e := m.roTxn(func(s *xorm.Session) error {
@@ -2819,10 +3370,13 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	}
 
 	if errno, ok := err.(syscall.Errno); ok && errno == syscall.EINVAL {
-		logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, id, size)
-		m.deleteSlice(id, size)
+		if id > 0 {
+			logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, id, size)
+			m.deleteSlice(id, size)
+		}
 	} else if err == nil {
 		m.of.InvalidateChunk(inode, indx)
+		m.logChange(inode)
 		if !trash {
 			for _, s := range ss {
 				if s.id == 0 {
@@ -2956,7 +3510,7 @@ func (m *dbMeta) scanTrashSlices(ctx Context, scan trashSliceScan) error {
 			}
 			if clean {
 				for _, s := range ss {
-					if _, e := tx.Exec("update jfs_chunk_ref set refs=refs-1 where chunkid=? and size=?", s.Id, s.Size); e != nil {
+					if _, e := tx.Exec(m.sql("update jfs_chunk_ref set refs=refs-1 where chunkid=? and size=?"), s.Id, s.Size); e != nil {
 						return e
 					}
 				}
@@ -3164,6 +3718,58 @@ func (m *dbMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errn
 	}))
 }
 
+func (m *dbMeta) doSetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno {
+	return errno(m.txn(func(s *xorm.Session) error {
+		var n = node{Inode: inode}
+		ok, err := s.ForUpdate().Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		var attr Attr
+		m.parseAttr(&n, &attr)
+		changed, st := m.applyFacl(ctx, &attr, aclType, rule)
+		if st != 0 {
+			return st
+		}
+		if !changed {
+			return nil
+		}
+		m.parseNode(&attr, &n)
+		now := time.Now()
+		n.Ctime = now.UnixNano() / 1e3
+		n.Ctimensec = int16(now.Nanosecond() % 1000)
+		_, err = s.Cols("mode", "ctime", "ctimensec", "access_acl_id", "default_acl_id").Update(&n, &node{Inode: inode})
+		return err
+	}, inode))
+}
+
+func (m *dbMeta) doGetACL(id uint32) (*ACLRule, error) {
+	var rule *ACLRule
+	err := m.roTxn(func(s *xorm.Session) error {
+		a := acl{Id: id}
+		ok, err := s.Get(&a)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		rule = &ACLRule{}
+		rule.Decode(a.Rule)
+		return nil
+	})
+	return rule, err
+}
+
+func (m *dbMeta) doInsertACL(id uint32, rule *ACLRule) error {
+	return m.txn(func(s *xorm.Session) error {
+		return mustInsert(s, &acl{Id: id, Rule: rule.Encode()})
+	})
+}
+
 func (m *dbMeta) doGetQuota(ctx Context, inode Ino) (*Quota, error) {
 	var quota *Quota
 	return quota, m.roTxn(func(s *xorm.Session) error {
@@ -3236,7 +3842,7 @@ func (m *dbMeta) doLoadQuotas(ctx Context) (map[Ino]*Quota, error) {
 func (m *dbMeta) doFlushQuotas(ctx Context, quotas map[Ino]*Quota) error {
 	return m.txn(func(s *xorm.Session) error {
 		for ino, q := range quotas {
-			_, err := s.Exec("update jfs_dir_quota set used_space=used_space+?, used_inodes=used_inodes+? where inode=?",
+			_, err := s.Exec(m.sql("update jfs_dir_quota set used_space=used_space+?, used_inodes=used_inodes+? where inode=?"),
 				q.newSpace, q.newInodes, ino)
 			if err != nil {
 				return err
@@ -3246,6 +3852,72 @@ func (m *dbMeta) doFlushQuotas(ctx Context, quotas map[Ino]*Quota) error {
 	})
 }
 
+func (m *dbMeta) doLogChanges(ts int64, inodes []Ino) error {
+	for len(inodes) > 0 {
+		n := len(inodes)
+		if n > 1000 {
+			n = 1000
+		}
+		err := m.txn(func(s *xorm.Session) error {
+			for _, inode := range inodes[:n] {
+				if _, err := s.Delete(&changelog{Inode: inode}); err != nil {
+					return err
+				}
+				if _, err := s.Insert(&changelog{Inode: inode, Ts: ts}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		inodes = inodes[n:]
+	}
+	return nil
+}
+
+func (m *dbMeta) doScanChanges(ctx Context, since, until int64, fn func(inode Ino)) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		return s.Where("ts >= ? AND ts < ?", since, until).Iterate(new(changelog), func(idx int, bean interface{}) error {
+			fn(bean.(*changelog).Inode)
+			return nil
+		})
+	})
+}
+
+func (m *dbMeta) doTrimChanges(before int64) error {
+	return m.txn(func(s *xorm.Session) error {
+		_, err := s.Where("ts < ?", before).Delete(&changelog{})
+		return err
+	})
+}
+
+func (m *dbMeta) doPublishInvalidation(ts int64, msg []byte) error {
+	return m.txn(func(s *xorm.Session) error {
+		return mustInsert(s, &invalidation{Ts: ts, Msg: msg})
+	})
+}
+
+func (m *dbMeta) doSubscribeInvalidation(fn func(msg []byte)) error {
+	return pollInvalidation(func(since int64, fn func(key string, msg []byte)) error {
+		return m.roTxn(func(s *xorm.Session) error {
+			return s.Where("ts >= ?", since).Iterate(new(invalidation), func(idx int, bean interface{}) error {
+				inv := bean.(*invalidation)
+				fn(strconv.FormatInt(inv.Id, 10), inv.Msg)
+				return nil
+			})
+		})
+	}, fn)
+}
+
+func (m *dbMeta) doCleanupInvalidation(before int64) error {
+	return m.txn(func(s *xorm.Session) error {
+		_, err := s.Where("ts < ?", before).Delete(&invalidation{})
+		return err
+	})
+}
+
 func (m *dbMeta) dumpEntry(s *xorm.Session, inode Ino, typ uint8) (*DumpedEntry, error) {
 	e := &DumpedEntry{}
 	n := &node{Inode: inode}
@@ -3579,6 +4251,36 @@ func (m *dbMeta) DumpMeta(w io.Writer, root Ino, keepSecret bool) (err error) {
 			DelFiles:  dels,
 			Quotas:    dumpedQuotas,
 		}
+		var blocks []inlineBlock
+		if err := s.Find(&blocks); err != nil {
+			return err
+		}
+		if len(blocks) > 0 {
+			dm.Inline = make(map[string][]byte, len(blocks))
+			for _, b := range blocks {
+				dm.Inline[b.Name] = b.Data
+			}
+		}
+		var hashes []dedupeBlock
+		if err := s.Find(&hashes); err != nil {
+			return err
+		}
+		if len(hashes) > 0 {
+			dm.Dedupe = make(map[string]string, len(hashes))
+			for _, b := range hashes {
+				dm.Dedupe[b.Name] = b.Hash
+			}
+		}
+		var packed []packedBlock
+		if err := s.Find(&packed); err != nil {
+			return err
+		}
+		if len(packed) > 0 {
+			dm.Packed = make(map[string]string, len(packed))
+			for _, b := range packed {
+				dm.Packed[b.Name] = b.Loc
+			}
+		}
 		if !keepSecret && dm.Setting.SecretKey != "" {
 			dm.Setting.SecretKey = "removed"
 			logger.Warnf("Secret key is removed for the sake of safety")
@@ -3640,6 +4342,8 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, chs []chan interface{}) {
 		Atimensec: int16(attr.Atimensec % 1e3),
 		Mtimensec: int16(attr.Mtimensec % 1e3),
 		Ctimensec: int16(attr.Ctimensec % 1e3),
+		Btime:     attr.Btime*1e6 + int64(attr.Btimensec)/1e3,
+		Btimensec: int16(attr.Btimensec % 1e3),
 		Nlink:     attr.Nlink,
 		Rdev:      attr.Rdev,
 		Parent:    e.Parents[0],
@@ -3676,6 +4380,9 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, chs []chan interface{}) {
 				Inode:  c.Attr.Inode,
 				Type:   typeFromString(c.Attr.Type),
 			}
+			if m.caseFolded(inode) {
+				chs[5] <- &foldedEdge{Parent: inode, Folded: []byte(foldName(string(unescape(name)))), Name: unescape(name)}
+			}
 		}
 		chs[5] <- stat
 	} else if n.Type == TypeSymlink {
@@ -3694,7 +4401,13 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	if len(tables) > 0 {
+	var owned int // tables of other namespaces are ignored
+	for _, t := range tables {
+		if strings.HasPrefix(t.Name, m.tablePrefix) {
+			owned++
+		}
+	}
+	if owned > 0 {
 		addr := m.addr
 		if !strings.Contains(addr, "://") {
 			addr = fmt.Sprintf("%s://%s", m.Name(), addr)
@@ -3704,8 +4417,8 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	if err = m.syncTable(new(setting), new(counter)); err != nil {
 		return fmt.Errorf("create table setting, counter: %s", err)
 	}
-	if err = m.syncTable(new(node), new(edge), new(symlink), new(xattr)); err != nil {
-		return fmt.Errorf("create table node, edge, symlink, xattr: %s", err)
+	if err = m.syncTable(new(node), new(edge), new(foldedEdge), new(symlink), new(xattr)); err != nil {
+		return fmt.Errorf("create table node, edge, foldedEdge, symlink, xattr: %s", err)
 	}
 	if err = m.syncTable(new(chunk), new(sliceRef), new(delslices)); err != nil {
 		return fmt.Errorf("create table chunk, chunk_ref, delslices: %s", err)
@@ -3713,8 +4426,8 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	if err = m.syncTable(new(session2), new(sustained), new(delfile)); err != nil {
 		return fmt.Errorf("create table session2, sustaind, delfile: %s", err)
 	}
-	if err = m.syncTable(new(flock), new(plock), new(dirQuota)); err != nil {
-		return fmt.Errorf("create table flock, plock, dirQuota: %s", err)
+	if err = m.syncTable(new(flock), new(plock), new(dirQuota), new(changelog)); err != nil {
+		return fmt.Errorf("create table flock, plock, dirQuota, changelog: %s", err)
 	}
 	if err := m.syncTable(new(dirStats)); err != nil {
 		return fmt.Errorf("create table dirStats: %s", err)
@@ -3722,6 +4435,9 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	if err := m.syncTable(new(detachedNode)); err != nil {
 		return fmt.Errorf("create table detachedNode: %s", err)
 	}
+	if err := m.syncTable(new(inlineBlock), new(dedupeBlock), new(dedupeRef), new(packedBlock), new(packRef)); err != nil {
+		return fmt.Errorf("create table inline_block, dedupe_block, dedupe_ref, packed_block, pack_ref: %s", err)
+	}
 	var batch int
 	switch m.Name() {
 	case "sqlite3":
@@ -3771,7 +4487,7 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 		}(i)
 	}
 
-	dm, counters, parents, refs, err := loadEntries(r,
+	dm, counters, parents, refs, err := m.loadEntries(r,
 		func(e *DumpedEntry) { m.loadEntry(e, chs) },
 		func(ck *chunkKey) { chs[3] <- &sliceRef{ck.id, ck.size, 1} })
 	if err != nil {
@@ -3789,6 +4505,21 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	for _, d := range dm.DelFiles {
 		chs[5] <- &delfile{d.Inode, d.Length, d.Expire}
 	}
+	for k, v := range dm.Inline {
+		chs[5] <- &inlineBlock{k, v}
+	}
+	for k, h := range dm.Dedupe {
+		chs[5] <- &dedupeBlock{k, h}
+	}
+	for h, n := range countBlockRefs(dm.Dedupe) {
+		chs[5] <- &dedupeRef{h, n}
+	}
+	for k, loc := range dm.Packed {
+		chs[5] <- &packedBlock{k, loc}
+	}
+	for pack, n := range countPackRefs(dm.Packed) {
+		chs[5] <- &packRef{pack, n}
+	}
 	for _, c := range chs {
 		close(c)
 	}
@@ -3855,14 +4586,17 @@ func (m *dbMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string,
 			n.Atime = now.UnixNano() / 1e3
 			n.Mtime = now.UnixNano() / 1e3
 			n.Ctime = now.UnixNano() / 1e3
+			n.Btime = now.UnixNano() / 1e3
 			n.Atimensec = int16(now.UnixNano() % 1e3)
 			n.Mtimensec = int16(now.UnixNano() % 1e3)
 			n.Ctimensec = int16(now.UnixNano() % 1e3)
+			n.Btimensec = int16(now.UnixNano() % 1e3)
 		}
 		// TODO: preserve hardlink
 		if n.Type == TypeFile && n.Nlink > 1 {
 			n.Nlink = 1
 		}
+		n.Flags = clonedFlags(n.Flags, cmode)
 		m.parseAttr(&n, attr)
 		if eno := m.Access(ctx, srcIno, MODE_MASK_R, attr); eno != 0 {
 			return eno
@@ -3904,6 +4638,9 @@ func (m *dbMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string,
 			if isDuplicateEntryErr(err) {
 				return syscall.EEXIST
 			}
+			if err == nil {
+				err = m.insertFolded(s, parent, []byte(name))
+			}
 		}
 		if err != nil {
 			return err
@@ -3950,7 +4687,7 @@ func (m *dbMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string,
 				for _, c := range cs {
 					for _, sli := range readSliceBuf(c.Slices) {
 						if sli.id > 0 {
-							if _, err := s.Exec("update jfs_chunk_ref set refs=refs+1 where chunkid = ? AND size = ?", sli.id, sli.size); err != nil {
+							if _, err := s.Exec(m.sql("update jfs_chunk_ref set refs=refs+1 where chunkid = ? AND size = ?"), sli.id, sli.size); err != nil {
 								return err
 							}
 						}
@@ -4038,6 +4775,9 @@ func (m *dbMeta) doAttachDirNode(ctx Context, parent Ino, inode Ino, name string
 			}
 			return err
 		}
+		if err := m.insertFolded(s, parent, []byte(name)); err != nil {
+			return err
+		}
 		_, err = s.Delete(&detachedNode{Inode: inode})
 		return err
 	}, parent))
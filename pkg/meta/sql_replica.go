@@ -0,0 +1,241 @@
+//go:build !nosqlite || !nomysql || !nopg
+// +build !nosqlite !nomysql !nopg
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+type sqlReplica struct {
+	addr     string
+	db       *xorm.Engine
+	syncedAt int64 // unix nano, the replica has all the changes before it
+}
+
+// sqlReplicas routes the lookups, getattrs and readdirs to the replicas of MySQL or the hot standbys
+// of PostgreSQL, whose lag is bounded by maxStaleness.
+//
+// The replication lag of each replica is checked periodically, a replica has all the changes made
+// before (check time - lag), so it's safe to read from the replica until maxStaleness after that.
+// The changes made by this client are always visible to itself, since a replica is only used after
+// it caught up with the last change.
+type sqlReplicas struct {
+	driver       string
+	replicas     []*sqlReplica
+	maxStaleness time.Duration
+	lastWrite    int64 // unix nano
+	done         chan struct{}
+}
+
+// popSQLOption removes an option from the query of a data source, returns the new one and the value.
+func popSQLOption(addr, key string) (string, string) {
+	p := strings.LastIndex(addr, "?")
+	if p < 0 {
+		return addr, ""
+	}
+	var value string
+	var kept []string
+	for _, kv := range strings.Split(addr[p+1:], "&") {
+		if k, v, _ := strings.Cut(kv, "="); k == key {
+			value, _ = url.QueryUnescape(v)
+		} else if kv != "" {
+			kept = append(kept, kv)
+		}
+	}
+	if len(kept) == 0 {
+		return addr[:p], value
+	}
+	return addr[:p+1] + strings.Join(kept, "&"), value
+}
+
+var mysqlHost = regexp.MustCompile(`@(\w*)\(([^)]*)\)`)
+
+// replicaAddr replaces the host of a data source with the one of replica, the port of primary is used if
+// it's not specified.
+func replicaAddr(driver, addr, host string) (string, error) {
+	withPort := func(primary string) string {
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			return host
+		}
+		if _, port, err := net.SplitHostPort(primary); err == nil {
+			return net.JoinHostPort(host, port)
+		}
+		return host
+	}
+	switch driver {
+	case "mysql":
+		m := mysqlHost.FindStringSubmatchIndex(addr)
+		if m == nil {
+			if p := strings.Index(addr, "@/"); p >= 0 { // localhost:3306 by default
+				return addr[:p+1] + "tcp(" + withPort("localhost:3306") + ")" + addr[p+1:], nil
+			}
+			return "", fmt.Errorf("no host found in %s", addr)
+		}
+		return addr[:m[4]] + withPort(addr[m[4]:m[5]]) + addr[m[5]:], nil
+	case "pgx":
+		u, err := url.Parse(addr)
+		if err != nil {
+			return "", err
+		}
+		u.Host = withPort(u.Host)
+		return u.String(), nil
+	default:
+		return "", fmt.Errorf("read-replicas is not supported for %s", driver)
+	}
+}
+
+func newSQLReplicas(driver, addr, hosts string, maxStaleness time.Duration, setup func(*xorm.Engine)) (*sqlReplicas, error) {
+	r := &sqlReplicas{driver: driver, maxStaleness: maxStaleness, done: make(chan struct{})}
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		raddr, err := replicaAddr(driver, addr, host)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		db, err := xorm.NewEngine(driver, raddr)
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("connect to replica %s: %s", host, err)
+		}
+		setup(db)
+		r.replicas = append(r.replicas, &sqlReplica{addr: host, db: db})
+	}
+	go r.refresh()
+	return r, nil
+}
+
+// lag returns the replication lag of a replica.
+func (r *sqlReplicas) lag(rep *sqlReplica) (time.Duration, error) {
+	var query, field string
+	switch r.driver {
+	case "mysql":
+		query, field = "SHOW SLAVE STATUS", "Seconds_Behind_Master"
+	case "pgx":
+		query, field = `SELECT CASE WHEN NOT pg_is_in_recovery() THEN NULL
+			WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END AS lag`, "lag"
+	}
+	rows, err := rep.db.QueryString(query)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 || rows[0][field] == "" || rows[0][field] == "NULL" {
+		return 0, fmt.Errorf("not replicating")
+	}
+	seconds, err := strconv.ParseFloat(rows[0][field], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lag %q: %s", rows[0][field], err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func (r *sqlReplicas) interval() time.Duration {
+	d := r.maxStaleness / 4
+	if d < time.Millisecond*100 {
+		d = time.Millisecond * 100
+	}
+	return d
+}
+
+func (r *sqlReplicas) refresh() {
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+	for {
+		r.check()
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check updates the time that each replica is synced to.
+func (r *sqlReplicas) check() {
+	for _, rep := range r.replicas {
+		now := time.Now()
+		lag, err := r.lag(rep)
+		if err != nil {
+			logger.Debugf("Check replication lag of replica %s: %s", rep.addr, err)
+			continue
+		}
+		if ts := now.Add(-lag).UnixNano(); ts > atomic.LoadInt64(&rep.syncedAt) {
+			atomic.StoreInt64(&rep.syncedAt, ts)
+		}
+	}
+}
+
+// wrote is called after this client changed something in primary.
+func (r *sqlReplicas) wrote() {
+	atomic.StoreInt64(&r.lastWrite, time.Now().UnixNano())
+}
+
+// pick returns a replica that is fresh enough, or nil if there is none.
+func (r *sqlReplicas) pick() *sqlReplica {
+	if len(r.replicas) == 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	lastWrite := atomic.LoadInt64(&r.lastWrite)
+	start := rand.Intn(len(r.replicas))
+	for i := range r.replicas {
+		rep := r.replicas[(start+i)%len(r.replicas)]
+		syncedAt := atomic.LoadInt64(&rep.syncedAt)
+		if syncedAt > lastWrite && now < syncedAt+int64(r.maxStaleness) {
+			return rep
+		}
+	}
+	return nil
+}
+
+func (r *sqlReplicas) close() {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	for _, rep := range r.replicas {
+		_ = rep.db.Close()
+	}
+}
+
+// replicaTxn runs a read-only transaction in a replica if there is one fresh enough, or in primary.
+func (m *dbMeta) replicaTxn(f func(s *xorm.Session) error) error {
+	if m.replicas != nil {
+		if rep := m.replicas.pick(); rep != nil {
+			return m.roTxnOn(rep.db, f)
+		}
+	}
+	return m.roTxn(f)
+}
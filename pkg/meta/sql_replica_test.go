@@ -0,0 +1,127 @@
+//go:build !nosqlite || !nomysql || !nopg
+// +build !nosqlite !nomysql !nopg
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//nolint:errcheck
+package meta
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPopSQLOption(t *testing.T) {
+	cases := []struct {
+		addr, key, left, value string
+	}{
+		{"root:@/dev", "read-replicas", "root:@/dev", ""},
+		{"root:@/dev?read-replicas=a,b", "read-replicas", "root:@/dev", "a,b"},
+		{"root:@(h:3306)/dev?tls=true&read-replicas=a&loc=Local", "read-replicas", "root:@(h:3306)/dev?tls=true&loc=Local", "a"},
+		{"postgres://h:5432/test?sslmode=disable&max-staleness=2s", "max-staleness", "postgres://h:5432/test?sslmode=disable", "2s"},
+	}
+	for _, c := range cases {
+		left, value := popSQLOption(c.addr, c.key)
+		if left != c.left || value != c.value {
+			t.Fatalf("pop %s from %s: expect %s %s, got %s %s", c.key, c.addr, c.left, c.value, left, value)
+		}
+	}
+}
+
+func TestReplicaAddr(t *testing.T) {
+	cases := []struct {
+		driver, addr, host, expect string
+	}{
+		{"mysql", "root:@/dev", "r1", "root:@tcp(r1:3306)/dev"},
+		{"mysql", "user:pass@(192.168.1.6:3306)/juicefs?tls=true", "192.168.1.7", "user:pass@(192.168.1.7:3306)/juicefs?tls=true"},
+		{"mysql", "user:pass@tcp(192.168.1.6:3306)/juicefs", "192.168.1.7:3307", "user:pass@tcp(192.168.1.7:3307)/juicefs"},
+		{"pgx", "postgres://user@192.168.1.6:5432/juicefs?sslmode=disable", "192.168.1.7", "postgres://user@192.168.1.7:5432/juicefs?sslmode=disable"},
+	}
+	for _, c := range cases {
+		addr, err := replicaAddr(c.driver, c.addr, c.host)
+		if err != nil || addr != c.expect {
+			t.Fatalf("replica %s of %s: expect %s, got %s %v", c.host, c.addr, c.expect, addr, err)
+		}
+	}
+	if _, err := replicaAddr("sqlite3", "/tmp/jfs.db", "r1"); err == nil {
+		t.Fatalf("replicas of sqlite3 should not be supported")
+	}
+}
+
+func TestSQLReplicaPick(t *testing.T) {
+	r := &sqlReplicas{maxStaleness: time.Second, done: make(chan struct{})}
+	if r.pick() != nil {
+		t.Fatalf("no replica")
+	}
+	r.replicas = []*sqlReplica{{addr: "r1"}, {addr: "r2"}}
+	if r.pick() != nil {
+		t.Fatalf("replicas are not synced yet")
+	}
+	atomic.StoreInt64(&r.replicas[0].syncedAt, time.Now().UnixNano())
+	for i := 0; i < 10; i++ {
+		if rep := r.pick(); rep != r.replicas[0] {
+			t.Fatalf("should pick the synced replica, got %+v", rep)
+		}
+	}
+	r.wrote()
+	if r.pick() != nil {
+		t.Fatalf("replicas are behind the last write")
+	}
+	atomic.StoreInt64(&r.replicas[1].syncedAt, time.Now().UnixNano())
+	if rep := r.pick(); rep != r.replicas[1] {
+		t.Fatalf("should pick the replica synced after the last write, got %+v", rep)
+	}
+	atomic.StoreInt64(&r.replicas[1].syncedAt, time.Now().Add(-time.Second*2).UnixNano())
+	if r.pick() != nil {
+		t.Fatalf("stale replica should not be used")
+	}
+}
+
+func TestMySQLReplicas(t *testing.T) { //skip mutate
+	// the primary itself is not replicating, so all the reads go to primary
+	m, err := newSQLMeta("mysql", "root:@/dev?read-replicas=127.0.0.1&max-staleness=2s", testConfig())
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	defer m.Shutdown()
+	db := m.(*dbMeta)
+	if db.replicas == nil || len(db.replicas.replicas) != 1 || db.replicas.maxStaleness != time.Second*2 {
+		t.Fatalf("replicas: %+v", db.replicas)
+	}
+	if err = m.Reset(); err != nil {
+		t.Fatalf("reset: %s", err)
+	}
+	if err = m.Init(testFormat(), true); err != nil {
+		t.Fatalf("initialize failed: %s", err)
+	}
+	if atomic.LoadInt64(&db.replicas.lastWrite) == 0 {
+		t.Fatalf("changes should be recorded")
+	}
+	db.replicas.check()
+	if db.replicas.pick() != nil {
+		t.Fatalf("primary should not be used as a replica")
+	}
+	var inode Ino
+	var attr Attr
+	if st := m.Mkdir(Background, RootInode, "d", 0755, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Lookup(Background, RootInode, "d", &inode, &attr, false); st != 0 {
+		t.Fatalf("lookup: %s", st)
+	}
+}
@@ -32,6 +32,37 @@ func TestSQLiteClient(t *testing.T) {
 	testMeta(t, m)
 }
 
+func TestSQLiteNamespace(t *testing.T) {
+	uri := "sqlite3://" + path.Join(t.TempDir(), "jfs-namespace-test.db")
+	m := NewClient(uri, nil)
+	if err := m.Init(&Format{Name: "default", Capacity: 1 << 30}, true); err != nil {
+		t.Fatalf("init default: %s", err)
+	}
+	m2 := NewClient(uri+"?namespace=vol2", nil)
+	if m2.getBase().conf.Namespace != "vol2" {
+		t.Fatalf("namespace: %s", m2.getBase().conf.Namespace)
+	}
+	if err := m2.Init(&Format{Name: "vol2", Capacity: 2 << 30}, true); err != nil {
+		t.Fatalf("init vol2: %s", err)
+	}
+	for _, c := range []struct {
+		m    Meta
+		name string
+		cap  uint64
+	}{{m, "default", 1 << 30}, {m2, "vol2", 2 << 30}} {
+		format, err := c.m.Load(true)
+		if err != nil || format.Name != c.name || format.Capacity != c.cap {
+			t.Fatalf("load format of %s: %+v %s", c.name, format, err)
+		}
+	}
+	if err := m2.Reset(); err != nil {
+		t.Fatalf("reset vol2: %s", err)
+	}
+	if format, err := m.Load(true); err != nil || format.Name != "default" {
+		t.Fatalf("default volume should not be affected: %+v %s", format, err)
+	}
+}
+
 func TestMySQLClient(t *testing.T) { //skip mutate
 	m, err := newSQLMeta("mysql", "root:@/dev", testConfig())
 	if err != nil || m.Name() != "mysql" {
@@ -25,6 +25,7 @@ import (
 	"io"
 	"math"
 	"math/rand"
+	"os"
 	"runtime"
 	"runtime/debug"
 	"sort"
@@ -90,10 +91,16 @@ func newTkvClient(driver, addr string) (tkvClient, error) {
 }
 
 func newKVMeta(driver, addr string, conf *Config) (Meta, error) {
+	if !conf.ReadOnly && strings.Contains(addr, "replica-read=") {
+		return nil, fmt.Errorf("replica-read is only allowed for read-only clients")
+	}
 	client, err := newTkvClient(driver, addr)
 	if err != nil {
 		return nil, fmt.Errorf("connect to addr %s: %s", addr, err)
 	}
+	if conf.Namespace != "" {
+		client = withPrefix(client, kvNamespacePrefix(conf.Namespace))
+	}
 	// TODO: ping server and check latency > Millisecond
 	// logger.Warnf("The latency to database is too high: %s", time.Since(start))
 	m := &kvMeta{
@@ -116,6 +123,194 @@ func (m *kvMeta) doDeleteSlice(id uint64, size uint32) error {
 	return m.deleteKeys(m.sliceKey(id, size))
 }
 
+func (m *kvMeta) inlineKey(key string) []byte {
+	return m.fmtKey("B", key)
+}
+
+func (m *kvMeta) doGetInline(key string) ([]byte, error) {
+	data, err := m.get(m.inlineKey(key))
+	if err == nil && data == nil {
+		err = os.ErrNotExist
+	}
+	return data, err
+}
+
+func (m *kvMeta) doSetInline(key string, data []byte) error {
+	return m.setValue(m.inlineKey(key), data)
+}
+
+func (m *kvMeta) doDeleteInline(key string) error {
+	return m.txn(func(tx *kvTxn) error {
+		k := m.inlineKey(key)
+		if tx.get(k) == nil {
+			return os.ErrNotExist
+		}
+		tx.delete(k)
+		return nil
+	})
+}
+
+func (m *kvMeta) blockHashKey(key string) []byte {
+	return m.fmtKey("H", key)
+}
+
+func (m *kvMeta) dedupeRefKey(hash string) []byte {
+	return m.fmtKey("O", hash)
+}
+
+func (m *kvMeta) packedBlockKey(key string) []byte {
+	return m.fmtKey("J", key)
+}
+
+func (m *kvMeta) packRefKey(pack string) []byte {
+	return m.fmtKey("Y", pack)
+}
+
+func (m *kvMeta) doRefBlock(key, hash string) (int64, error) {
+	var refs int64
+	err := m.txn(func(tx *kvTxn) error {
+		if old := tx.get(m.blockHashKey(key)); old != nil {
+			if string(old) != hash {
+				return errHashMismatch(key, string(old), hash)
+			}
+			refs = parseCounter(tx.get(m.dedupeRefKey(hash)))
+			return nil
+		}
+		if parseCounter(tx.get(m.dedupeRefKey(hash))) < 0 { // being deleted
+			refs = -1
+			return nil
+		}
+		tx.set(m.blockHashKey(key), []byte(hash))
+		refs = tx.incrBy(m.dedupeRefKey(hash), 1)
+		return nil
+	})
+	return refs, err
+}
+
+func (m *kvMeta) doUnrefBlock(key string) (string, int64, error) {
+	var hash string
+	var refs int64
+	err := m.txn(func(tx *kvTxn) error {
+		old := tx.get(m.blockHashKey(key))
+		if old == nil {
+			return os.ErrNotExist
+		}
+		hash = string(old)
+		tx.delete(m.blockHashKey(key))
+		if refs = tx.incrBy(m.dedupeRefKey(hash), -1); refs <= 0 {
+			refs = 0
+			tx.set(m.dedupeRefKey(hash), packCounter(-1)) // deleting
+		}
+		return nil
+	})
+	return hash, refs, err
+}
+
+func (m *kvMeta) doDropContent(hash string) error {
+	return m.txn(func(tx *kvTxn) error {
+		if parseCounter(tx.get(m.dedupeRefKey(hash))) < 0 {
+			tx.delete(m.dedupeRefKey(hash))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doGetBlockHash(key string) (string, error) {
+	hash, err := m.get(m.blockHashKey(key))
+	if err == nil && hash == nil {
+		err = os.ErrNotExist
+	}
+	return string(hash), err
+}
+
+func (m *kvMeta) doScanBlockHash(fn func(key, hash string) error) error {
+	prefix := m.fmtKey("H")
+	hashes, err := m.scanValues(prefix, -1, nil)
+	if err != nil {
+		return err
+	}
+	for k, hash := range hashes {
+		if err = fn(k[len(prefix):], string(hash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *kvMeta) doPackBlocks(pack string, locs map[string]string) (int64, error) {
+	var refs int64
+	err := m.txn(func(tx *kvTxn) error {
+		refs = 0
+		for k, loc := range locs {
+			if tx.get(m.packedBlockKey(k)) == nil {
+				tx.set(m.packedBlockKey(k), []byte(loc))
+				refs++
+			}
+		}
+		if refs > 0 {
+			tx.set(m.packRefKey(pack), packCounter(refs))
+		}
+		return nil
+	})
+	return refs, err
+}
+
+func (m *kvMeta) doGetPackedBlock(key string) (string, error) {
+	loc, err := m.get(m.packedBlockKey(key))
+	if err == nil && loc == nil {
+		err = os.ErrNotExist
+	}
+	return string(loc), err
+}
+
+func (m *kvMeta) doUnpackBlock(key string) (string, int64, error) {
+	var loc string
+	var refs int64
+	err := m.txn(func(tx *kvTxn) error {
+		old := tx.get(m.packedBlockKey(key))
+		if old == nil {
+			return os.ErrNotExist
+		}
+		loc = string(old)
+		pack := packOf(loc)
+		tx.delete(m.packedBlockKey(key))
+		if refs = tx.incrBy(m.packRefKey(pack), -1); refs <= 0 {
+			refs = 0
+			tx.delete(m.packRefKey(pack))
+		}
+		return nil
+	})
+	return loc, refs, err
+}
+
+func (m *kvMeta) doScanPackedBlock(fn func(key, loc string) error) error {
+	prefix := m.fmtKey("J")
+	locs, err := m.scanValues(prefix, -1, nil)
+	if err != nil {
+		return err
+	}
+	for k, loc := range locs {
+		if err = fn(k[len(prefix):], string(loc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *kvMeta) doScanInline(fn func(key string, data []byte) error) error {
+	prefix := m.fmtKey("B")
+	blocks, err := m.scanValues(prefix, -1, nil)
+	if err != nil {
+		return err
+	}
+	for k, data := range blocks {
+		if err = fn(k[len(prefix):], data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *kvMeta) keyLen(args ...interface{}) int {
 	var c int
 	for _, a := range args {
@@ -171,6 +366,7 @@ All keys:
   C...               counter
   AiiiiiiiiI         inode attribute
   AiiiiiiiiD...      dentry
+  AiiiiiiiiF...      folded name of dentry // for case-insensitive volume
   AiiiiiiiiPiiiiiiii parents // for hard links
   AiiiiiiiiCnnnn     file chunks
   AiiiiiiiiS         symlink target
@@ -184,9 +380,16 @@ All keys:
   SHssssssss         session heartbeat // for legacy client
   SIssssssss         session info
   SSssssssssiiiiiiii sustained inode
+  SVssssssss         evicted session
   Uiiiiiiii          data length, space and inodes usage in directory
   Niiiiiiii          detached inde
   QDiiiiiiii         directory quota
+  Gttttttttiiiiiiii  changelog
+  Raaaa              ACL rules
+  Vttttttttssssssss  invalidation
+  B...               inline blocks
+  H...               hash of deduplicated blocks
+  O...               refcount of deduplicated contents
 */
 
 func (m *kvMeta) inodeKey(inode Ino) []byte {
@@ -197,6 +400,29 @@ func (m *kvMeta) entryKey(parent Ino, name string) []byte {
 	return m.fmtKey("A", parent, "D", name)
 }
 
+func (m *kvMeta) aclKey(id uint32) []byte {
+	return m.fmtKey("R", id)
+}
+
+func (m *kvMeta) foldKey(parent Ino, name string) []byte {
+	return m.fmtKey("A", parent, "F", foldName(name))
+}
+
+// setEntry and deleteEntry also maintain the folded names of entries for case-insensitive volume.
+func (m *kvMeta) setEntry(tx *kvTxn, parent Ino, name string, buf []byte) {
+	tx.set(m.entryKey(parent, name), buf)
+	if m.caseFolded(parent) {
+		tx.set(m.foldKey(parent, name), []byte(name))
+	}
+}
+
+func (m *kvMeta) deleteEntry(tx *kvTxn, parent Ino, name string) {
+	tx.delete(m.entryKey(parent, name))
+	if m.caseFolded(parent) {
+		tx.delete(m.foldKey(parent, name))
+	}
+}
+
 func (m *kvMeta) parentKey(inode, parent Ino) []byte {
 	return m.fmtKey("A", inode, "P", parent)
 }
@@ -237,6 +463,14 @@ func (m *kvMeta) legacySessionKey(sid uint64) []byte {
 	return m.fmtKey("SH", sid)
 }
 
+func (m *kvMeta) changelogKey(ts int64, inode Ino) []byte {
+	return m.fmtKey("G", uint64(ts), inode)
+}
+
+func (m *kvMeta) invalidationKey(ts int64, sid uint64) []byte {
+	return m.fmtKey("V", uint64(ts), sid)
+}
+
 func (m *kvMeta) dirStatKey(inode Ino) []byte {
 	return m.fmtKey("U", inode)
 }
@@ -261,6 +495,10 @@ func (m *kvMeta) sessionInfoKey(sid uint64) []byte {
 	return m.fmtKey("SI", sid)
 }
 
+func (m *kvMeta) evictedSessionKey(sid uint64) []byte {
+	return m.fmtKey("SV", sid)
+}
+
 func (m *kvMeta) sustainedKey(sid uint64, inode Ino) []byte {
 	return m.fmtKey("SS", sid, inode)
 }
@@ -454,7 +692,7 @@ func (m *kvMeta) doInit(format *Format, force bool) error {
 		Parent: 1,
 	}
 	return m.txn(func(tx *kvTxn) error {
-		if format.TrashDays > 0 {
+		if format.trashEnabled() {
 			buf := tx.get(m.inodeKey(TrashInode))
 			if buf == nil {
 				attr.Mode = 0555
@@ -473,6 +711,18 @@ func (m *kvMeta) doInit(format *Format, force bool) error {
 }
 
 func (m *kvMeta) Reset() error {
+	if m.conf.Namespace == "" {
+		var exist bool
+		if err := m.txn(func(tx *kvTxn) error {
+			exist = tx.exist([]byte{namespaceMark})
+			return nil
+		}); err != nil {
+			return err
+		}
+		if exist {
+			return fmt.Errorf("found keys of namespaces, remove the namespaces first")
+		}
+	}
 	return m.client.reset(nil)
 }
 
@@ -518,7 +768,11 @@ func (m *kvMeta) doNewSession(sinfo []byte) error {
 }
 
 func (m *kvMeta) doRefreshSession() error {
-	return m.txn(func(tx *kvTxn) error {
+	// not use m.txn, which refuses to write once the lease is expired
+	return m.client.txn(func(tx *kvTxn) error {
+		if tx.get(m.evictedSessionKey(m.sid)) != nil {
+			return errSessionEvicted
+		}
 		buf := tx.get(m.sessionKey(m.sid))
 		if buf == nil {
 			logger.Warnf("Session %d was stale and cleaned up, but now it comes back again", m.sid)
@@ -526,6 +780,13 @@ func (m *kvMeta) doRefreshSession() error {
 		}
 		tx.set(m.sessionKey(m.sid), m.packInt64(m.expireTime()))
 		return nil
+	}, 0)
+}
+
+func (m *kvMeta) doEvictSession(sid uint64) error {
+	return m.txn(func(tx *kvTxn) error {
+		tx.set(m.evictedSessionKey(sid), m.packInt64(time.Now().Unix()))
+		return nil
 	})
 }
 
@@ -752,11 +1013,14 @@ func (m *kvMeta) shouldRetry(err error) bool {
 }
 
 func (m *kvMeta) txn(f func(tx *kvTxn) error, inodes ...Ino) error {
-	if m.conf.ReadOnly {
+	m.beginWrite()
+	defer m.endWrite()
+	if m.conf.ReadOnly || m.leaseExpired() || m.isFrozen() {
 		return syscall.EROFS
 	}
-	start := time.Now()
-	defer func() { m.txDist.Observe(time.Since(start).Seconds()) }()
+	method, start := txnMethod(), time.Now()
+	var restarts int
+	defer func() { m.observeTxn(method, start, restarts, inodes) }()
 	if len(inodes) > 0 {
 		m.txLock(uint(inodes[0]))
 		defer m.txUnlock(uint(inodes[0]))
@@ -768,7 +1032,7 @@ func (m *kvMeta) txn(f func(tx *kvTxn) error, inodes ...Ino) error {
 			err = nil
 		}
 		if err != nil && m.shouldRetry(err) {
-			m.txRestart.Add(1)
+			restarts++
 			logger.Debugf("Transaction failed, restart it (tried %d): %s", i+1, err)
 			lastErr = err
 			time.Sleep(time.Millisecond * time.Duration(rand.Int()%((i+1)*(i+1))))
@@ -866,9 +1130,14 @@ func (m *kvMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
 	defer m.timeit("SetAttr", time.Now())
 	inode = m.checkRoot(inode)
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	defer func() { m.of.InvalidateChunk(inode, invalidateAttrOnly) }()
-	return errno(m.txn(func(tx *kvTxn) error {
-		var cur Attr
+	defer m.logChange(inode)
+	var cur Attr
+	st := errno(m.txn(func(tx *kvTxn) error {
 		a := tx.get(m.inodeKey(inode))
 		if a == nil {
 			return syscall.ENOENT
@@ -888,10 +1157,19 @@ func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 		*attr = *dirtyAttr
 		return nil
 	}, inode))
+	if st == 0 {
+		m.moveOwnerQuota(&cur, attr)
+		m.notifyAttr(ctx, inode, attr)
+	}
+	return st
 }
 
 func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr, skipPermCheck bool) syscall.Errno {
 	defer m.timeit("Truncate", time.Now())
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -924,7 +1202,7 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		}
 		newLength = int64(length) - int64(t.Length)
 		newSpace = align4K(length) - align4K(t.Length)
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(tx, inode, t.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, t.Uid, t.Gid, m.getParents(tx, inode, t.Parent)...); err != 0 {
 			return err
 		}
 		var left, right = t.Length, length
@@ -960,7 +1238,10 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		return nil
 	}, inode)
 	if err == nil {
+		m.logChange(inode)
+		m.notifyAttr(ctx, inode, attr)
 		m.updateParentStat(ctx, inode, t.Parent, newLength, newSpace)
+		m.updateOwnerQuota(t.Uid, t.Gid, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -982,6 +1263,10 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		return syscall.EINVAL
 	}
 	defer m.timeit("Fallocate", time.Now())
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -1020,7 +1305,7 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		old := t.Length
 		newLength = int64(length) - int64(t.Length)
 		newSpace = align4K(length) - align4K(t.Length)
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(tx, inode, t.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, t.Uid, t.Gid, m.getParents(tx, inode, t.Parent)...); err != 0 {
 			return err
 		}
 		t.Length = length
@@ -1050,7 +1335,12 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		return nil
 	}, inode)
 	if err == nil {
+		m.logChange(inode)
 		m.updateParentStat(ctx, inode, t.Parent, newLength, newSpace)
+		m.updateOwnerQuota(t.Uid, t.Gid, newSpace, 0)
+		if mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			m.compactHoles(inode, off, size, t.Length)
+		}
 	}
 	return errno(err)
 }
@@ -1161,6 +1451,9 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 			}
 			return syscall.EEXIST
 		}
+		if st := m.inheritACL(attr, &pattr, mode, cumask); st != 0 {
+			return st
+		}
 
 		var updateParent bool
 		now := time.Now()
@@ -1187,6 +1480,8 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		attr.Mtimensec = uint32(now.Nanosecond())
 		attr.Ctime = now.Unix()
 		attr.Ctimensec = uint32(now.Nanosecond())
+		attr.Btime = now.Unix()
+		attr.Btimensec = uint32(now.Nanosecond())
 		if ctx.Value(CtxKey("behavior")) == "Hadoop" || runtime.GOOS == "darwin" {
 			attr.Gid = pattr.Gid
 		} else if runtime.GOOS == "linux" && pattr.Mode&02000 != 0 {
@@ -1206,7 +1501,7 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 			}
 		}
 
-		tx.set(m.entryKey(parent, name), m.packEntry(_type, ino))
+		m.setEntry(tx, parent, name, m.packEntry(_type, ino))
 		if updateParent {
 			tx.set(m.inodeKey(parent), m.marshal(&pattr))
 		}
@@ -1311,7 +1606,7 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string, attr *Attr, skip
 			updateParent = true
 		}
 
-		tx.delete(m.entryKey(parent, name))
+		m.deleteEntry(tx, parent, name)
 		if updateParent {
 			tx.set(m.inodeKey(parent), m.marshal(&pattr))
 		}
@@ -1437,7 +1732,7 @@ func (m *kvMeta) doRmdir(ctx Context, parent Ino, name string, pinode *Ino, skip
 		if !isTrash(parent) && updateParent {
 			tx.set(m.inodeKey(parent), m.marshal(&pattr))
 		}
-		tx.delete(m.entryKey(parent, name))
+		m.deleteEntry(tx, parent, name)
 		tx.delete(m.dirStatKey(inode))
 		tx.delete(m.dirQuotaKey(inode))
 		if trash > 0 {
@@ -1461,6 +1756,13 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		return st
 	}
 	exchange := flags == RenameExchange
+	var wino Ino // inode of the whiteout
+	if flags&RenameWhiteout != 0 {
+		var err error
+		if wino, err = m.nextInode(); err != nil {
+			return errno(err)
+		}
+	}
 	var opened bool
 	var dino Ino
 	var dtyp uint8
@@ -1530,7 +1832,7 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		var supdate, dupdate bool
 		now := time.Now()
 		if dbuf != nil {
-			if flags == RenameNoReplace {
+			if flags&RenameNoReplace != 0 {
 				return syscall.EEXIST
 			}
 			dtyp, dino = m.parseEntry(dbuf)
@@ -1642,8 +1944,13 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 				tx.incrBy(m.parentKey(dino, parentSrc), 1)
 				tx.incrBy(m.parentKey(dino, parentDst), -1)
 			}
+		} else if wino > 0 {
+			tx.set(m.entryKey(parentSrc, nameSrc), m.packEntry(TypeCharDev, wino))
+			tx.set(m.inodeKey(wino), m.marshal(whiteoutAttr(ctx, parentSrc, now)))
 		} else {
-			tx.delete(m.entryKey(parentSrc, nameSrc))
+			m.deleteEntry(tx, parentSrc, nameSrc)
+		}
+		if !exchange {
 			if dino > 0 {
 				if trash > 0 {
 					tx.set(m.inodeKey(dino), m.marshal(&tattr))
@@ -1694,7 +2001,7 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			}
 		}
 		tx.set(m.inodeKey(ino), m.marshal(&iattr))
-		tx.set(m.entryKey(parentDst, nameDst), buf)
+		m.setEntry(tx, parentDst, nameDst, buf)
 		if dupdate {
 			tx.set(m.inodeKey(parentDst), m.marshal(&dattr))
 		}
@@ -1748,19 +2055,28 @@ func (m *kvMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 			updateParent = true
 		}
 		oldParent := iattr.Parent
-		iattr.Parent = 0
+		relink := iattr.Nlink == 0 // anonymous file (O_TMPFILE)
+		if relink {
+			iattr.Parent = parent
+		} else {
+			iattr.Parent = 0
+		}
 		iattr.Ctime = now.Unix()
 		iattr.Ctimensec = uint32(now.Nanosecond())
 		iattr.Nlink++
-		tx.set(m.entryKey(parent, name), m.packEntry(iattr.Typ, inode))
+		m.setEntry(tx, parent, name, m.packEntry(iattr.Typ, inode))
 		if updateParent {
 			tx.set(m.inodeKey(parent), m.marshal(&pattr))
 		}
 		tx.set(m.inodeKey(inode), m.marshal(&iattr))
-		if oldParent > 0 {
-			tx.incrBy(m.parentKey(inode, oldParent), 1)
+		if relink {
+			tx.delete(m.sustainedKey(m.sid, inode))
+		} else {
+			if oldParent > 0 {
+				tx.incrBy(m.parentKey(inode, oldParent), 1)
+			}
+			tx.incrBy(m.parentKey(inode, parent), 1)
 		}
-		tx.incrBy(m.parentKey(inode, parent), 1)
 		if attr != nil {
 			*attr = iattr
 		}
@@ -1768,27 +2084,56 @@ func (m *kvMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 	}, parent))
 }
 
+func (m *kvMeta) doLookupFolded(ctx Context, parent Ino, name string) *Entry {
+	var e *Entry
+	_ = m.client.txn(func(tx *kvTxn) error {
+		e = nil
+		found := tx.get(m.foldKey(parent, name))
+		if found == nil {
+			return nil
+		}
+		if buf := tx.get(m.entryKey(parent, string(found))); buf != nil {
+			typ, inode := m.parseEntry(buf)
+			e = &Entry{Inode: inode, Name: found, Attr: &Attr{Typ: typ}}
+		}
+		return nil
+	}, 0)
+	return e
+}
+
 func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry, limit int) syscall.Errno {
-	// TODO: handle big directory
-	vals, err := m.scanValues(m.entryKey(inode, ""), limit, nil)
-	if err != nil {
-		return errno(err)
+	return m.readdirByPage(ctx, inode, plus, entries, limit)
+}
+
+func (m *kvMeta) doReaddirPage(ctx Context, inode Ino, plus uint8, after []byte, limit int, entries *[]*Entry) syscall.Errno {
+	prefix := m.entryKey(inode, "")
+	begin := prefix
+	if after != nil {
+		begin = append(m.entryKey(inode, string(after)), 0)
 	}
-	prefix := len(m.entryKey(inode, ""))
-	for name, buf := range vals {
-		typ, ino := m.parseEntry(buf)
-		if len(name) == prefix {
-			logger.Errorf("Corrupt entry with empty name: inode %d parent %d", ino, inode)
-			continue
-		}
-		*entries = append(*entries, &Entry{
-			Inode: ino,
-			Name:  []byte(name)[prefix:],
-			Attr:  &Attr{Typ: typ},
+	var page []*Entry
+	err := m.client.txn(func(tx *kvTxn) error {
+		page = page[:0]
+		tx.scan(begin, nextKey(prefix), false, func(k, v []byte) bool {
+			typ, ino := m.parseEntry(v)
+			if len(k) == len(prefix) {
+				logger.Errorf("Corrupt entry with empty name: inode %d parent %d", ino, inode)
+				return true
+			}
+			page = append(page, &Entry{
+				Inode: ino,
+				Name:  append([]byte{}, k[len(prefix):]...),
+				Attr:  &Attr{Typ: typ},
+			})
+			return limit <= 0 || len(page) < limit
 		})
+		return nil
+	}, 0)
+	if err != nil {
+		return errno(err)
 	}
 
-	if plus != 0 && len(*entries) != 0 {
+	if plus != 0 && len(page) != 0 {
 		fillAttr := func(es []*Entry) error {
 			var keys = make([][]byte, len(es))
 			for i, e := range es {
@@ -1810,9 +2155,9 @@ func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 			return nil
 		}
 		batchSize := 4096
-		nEntries := len(*entries)
+		nEntries := len(page)
 		if nEntries <= batchSize {
-			err = fillAttr(*entries)
+			err = fillAttr(page)
 		} else {
 			indexCh := make(chan []*Entry, 10)
 			var wg sync.WaitGroup
@@ -1830,9 +2175,9 @@ func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 			}
 			for i := 0; i < nEntries; i += batchSize {
 				if i+batchSize > nEntries {
-					indexCh <- (*entries)[i:]
+					indexCh <- page[i:]
 				} else {
-					indexCh <- (*entries)[i : i+batchSize]
+					indexCh <- page[i : i+batchSize]
 				}
 			}
 			close(indexCh)
@@ -1842,6 +2187,7 @@ func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 			return errno(err)
 		}
 	}
+	*entries = append(*entries, page...)
 	return 0
 }
 
@@ -1903,6 +2249,10 @@ func (m *kvMeta) Read(ctx Context, inode Ino, indx uint32, slices *[]Slice) (rer
 
 func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice, mtime time.Time) syscall.Errno {
 	defer m.timeit("Write", time.Now())
+	if st := m.beginChangeOf(ctx, inode); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -1933,7 +2283,7 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(tx, inode, attr.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, attr.Uid, attr.Gid, m.getParents(tx, inode, attr.Parent)...); err != 0 {
 			return err
 		}
 		now := time.Now()
@@ -1958,13 +2308,19 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if needCompact {
 			go m.compactChunk(inode, indx, false)
 		}
+		m.logChange(inode)
 		m.updateParentStat(ctx, inode, attr.Parent, newLength, newSpace)
+		m.updateOwnerQuota(attr.Uid, attr.Gid, newSpace, 0)
 	}
 	return errno(err)
 }
 
 func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
 	defer m.timeit("CopyFileRange", time.Now())
+	if st := m.beginChangeOf(ctx, fout); st != 0 {
+		return st
+	}
+	defer m.endChange(ctx)
 	var newLength, newSpace int64
 	f := m.of.find(fout)
 	if f != nil {
@@ -2007,7 +2363,7 @@ func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if err := m.checkQuota(ctx, newSpace, 0, m.getParents(tx, fout, attr.Parent)...); err != 0 {
+		if err := m.checkQuota(ctx, newSpace, 0, attr.Uid, attr.Gid, m.getParents(tx, fout, attr.Parent)...); err != 0 {
 			return err
 		}
 		now := time.Now()
@@ -2081,7 +2437,9 @@ func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		return nil
 	}, fout)
 	if err == nil {
+		m.logChange(fout)
 		m.updateParentStat(ctx, fout, attr.Parent, newLength, newSpace)
+		m.updateOwnerQuota(attr.Uid, attr.Gid, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -2384,22 +2742,27 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	skipped := skipSome(ss)
 	ss = ss[skipped:]
 	pos, size, slices := compactChunk(ss)
-	if len(ss) < 2 || size == 0 {
+	if len(ss) < 2 {
 		return
 	}
 
+	// size is 0 when all the slices are covered by holes, they can be dropped directly
 	var id uint64
-	st := m.NewSlice(Background, &id)
-	if st != 0 {
-		return
-	}
-	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
-	err = m.newMsg(CompactChunk, slices, id)
-	if err != nil {
-		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
-			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+	if size > 0 {
+		st := m.NewSlice(Background, &id)
+		if st != 0 {
+			return
 		}
-		return
+		logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
+		err = m.newMsg(CompactChunk, slices, id, inode)
+		if err != nil {
+			if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
+				logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+			}
+			return
+		}
+	} else {
+		logger.Debugf("compact %d:%d: drop %d slices covered by holes", inode, indx, len(ss))
 	}
 	var dsbuf []byte
 	trash := m.toTrash(0)
@@ -2417,10 +2780,20 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 			return syscall.EINVAL
 		}
 
-		buf2 = append(append(buf2[:skipped*sliceBytes], marshalSlice(pos, id, size, 0, size)...), buf2[len(buf):]...)
-		tx.set(m.chunkKey(inode, indx), buf2)
-		// create the key to tracking it
-		tx.set(m.sliceKey(id, size), make([]byte, 8))
+		data := buf2[:skipped*sliceBytes]
+		if id > 0 {
+			data = append(data, marshalSlice(pos, id, size, 0, size)...)
+		}
+		buf2 = append(data, buf2[len(buf):]...)
+		if len(buf2) == 0 {
+			tx.delete(m.chunkKey(inode, indx))
+		} else {
+			tx.set(m.chunkKey(inode, indx), buf2)
+		}
+		if id > 0 {
+			// create the key to tracking it
+			tx.set(m.sliceKey(id, size), make([]byte, 8))
+		}
 		if trash {
 			if len(dsbuf) > 0 {
 				tx.set(m.delSliceKey(time.Now().Unix(), id), dsbuf)
@@ -2435,7 +2808,7 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		return nil
 	})
 	// there could be false-negative that the compaction is successful, double-check
-	if err != nil {
+	if err != nil && id > 0 {
 		logger.Warnf("compact %d:%d failed: %s", inode, indx, err)
 		refs, e := m.get(m.sliceKey(id, size))
 		if e == nil {
@@ -2449,11 +2822,16 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	}
 
 	if errno, ok := err.(syscall.Errno); ok && errno == syscall.EINVAL {
-		logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, id, size)
-		m.deleteSlice(id, size)
+		if id > 0 {
+			logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, id, size)
+			m.deleteSlice(id, size)
+		}
 	} else if err == nil {
 		m.of.InvalidateChunk(inode, indx)
-		m.cleanupZeroRef(id, size)
+		m.logChange(inode)
+		if id > 0 {
+			m.cleanupZeroRef(id, size)
+		}
 		if !trash {
 			var refs int64
 			for _, s := range ss {
@@ -2736,6 +3114,48 @@ func (m *kvMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errn
 	}))
 }
 
+func (m *kvMeta) doSetFacl(ctx Context, inode Ino, aclType uint8, rule *ACLRule) syscall.Errno {
+	return errno(m.txn(func(tx *kvTxn) error {
+		var attr Attr
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		m.parseAttr(a, &attr)
+		changed, st := m.applyFacl(ctx, &attr, aclType, rule)
+		if st != 0 {
+			return st
+		}
+		if !changed {
+			return nil
+		}
+		now := time.Now()
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), m.marshal(&attr))
+		return nil
+	}, inode))
+}
+
+func (m *kvMeta) doGetACL(id uint32) (*ACLRule, error) {
+	buf, err := m.get(m.aclKey(id))
+	if err != nil {
+		return nil, err
+	} else if buf == nil {
+		return nil, syscall.ENOENT
+	}
+	rule := &ACLRule{}
+	rule.Decode(buf)
+	return rule, nil
+}
+
+func (m *kvMeta) doInsertACL(id uint32, rule *ACLRule) error {
+	return m.txn(func(tx *kvTxn) error {
+		tx.set(m.aclKey(id), rule.Encode())
+		return nil
+	})
+}
+
 func (m *kvMeta) doGetQuota(ctx Context, inode Ino) (*Quota, error) {
 	buf, err := m.get(m.dirQuotaKey(inode))
 	if err != nil {
@@ -2808,6 +3228,92 @@ func (m *kvMeta) doFlushQuotas(ctx Context, quotas map[Ino]*Quota) error {
 	})
 }
 
+func (m *kvMeta) doLogChanges(ts int64, inodes []Ino) error {
+	for len(inodes) > 0 {
+		n := len(inodes)
+		if n > 1000 {
+			n = 1000
+		}
+		err := m.txn(func(tx *kvTxn) error {
+			for _, inode := range inodes[:n] {
+				tx.set(m.changelogKey(ts, inode), []byte{1})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		inodes = inodes[n:]
+	}
+	return nil
+}
+
+func (m *kvMeta) doScanChanges(ctx Context, since, until int64, fn func(inode Ino)) error {
+	return m.client.txn(func(tx *kvTxn) error {
+		tx.scan(m.changelogKey(since, 0), m.changelogKey(until, 0), true, func(k, v []byte) bool {
+			if len(k) == 1+8+8 { // Gttttttttiiiiiiii
+				fn(m.decodeInode(k[9:]))
+			}
+			return true
+		})
+		return nil
+	}, 0)
+}
+
+func (m *kvMeta) doTrimChanges(before int64) error {
+	var keys [][]byte
+	for {
+		err := m.client.txn(func(tx *kvTxn) error {
+			keys = keys[:0]
+			tx.scan(m.changelogKey(0, 0), m.changelogKey(before, 0), true, func(k, v []byte) bool {
+				keys = append(keys, k)
+				return len(keys) < 1000
+			})
+			return nil
+		}, 0)
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		if err = m.deleteKeys(keys...); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *kvMeta) doPublishInvalidation(ts int64, msg []byte) error {
+	return m.txn(func(tx *kvTxn) error {
+		tx.set(m.invalidationKey(ts, m.sid), msg)
+		return nil
+	})
+}
+
+func (m *kvMeta) doSubscribeInvalidation(fn func(msg []byte)) error {
+	return pollInvalidation(func(since int64, fn func(key string, msg []byte)) error {
+		return m.client.txn(func(tx *kvTxn) error {
+			tx.scan(m.invalidationKey(since, 0), m.invalidationKey(math.MaxInt64, 0), false, func(k, v []byte) bool {
+				fn(string(k), v)
+				return true
+			})
+			return nil
+		}, 0)
+	}, fn)
+}
+
+func (m *kvMeta) doCleanupInvalidation(before int64) error {
+	keys, err := m.scanKeys(m.fmtKey("V"))
+	if err != nil {
+		return err
+	}
+	end := m.invalidationKey(before, 0)
+	var expired [][]byte
+	for _, k := range keys {
+		if bytes.Compare(k, end) < 0 {
+			expired = append(expired, k)
+		}
+	}
+	return m.deleteKeys(expired...)
+}
+
 func (m *kvMeta) dumpEntry(inode Ino, e *DumpedEntry) error {
 	if m.snap != nil {
 		return nil
@@ -3122,6 +3628,15 @@ func (m *kvMeta) DumpMeta(w io.Writer, root Ino, keepSecret bool) (err error) {
 		DelFiles:  dels,
 		Quotas:    quotas,
 	}
+	if dm.Inline, err = m.dumpInline(); err != nil {
+		return err
+	}
+	if dm.Dedupe, err = m.dumpBlockHashes(); err != nil {
+		return err
+	}
+	if dm.Packed, err = m.dumpPackedBlocks(); err != nil {
+		return err
+	}
 	if !keepSecret && dm.Setting.SecretKey != "" {
 		dm.Setting.SecretKey = "removed"
 		logger.Warnf("Secret key is removed for the sake of safety")
@@ -3200,6 +3715,9 @@ func (m *kvMeta) loadEntry(e *DumpedEntry, kv chan *pair) {
 			stat.inodes++
 
 			kv <- &pair{m.entryKey(inode, string(unescape(name))), m.packEntry(typeFromString(c.Attr.Type), c.Attr.Inode)}
+			if m.caseFolded(inode) {
+				kv <- &pair{m.foldKey(inode, string(unescape(name))), unescape(name)}
+			}
 		}
 		kv <- &pair{m.dirStatKey(inode), m.packDirStat(&stat)}
 	} else if attr.Typ == TypeSymlink {
@@ -3216,7 +3734,15 @@ func (m *kvMeta) loadEntry(e *DumpedEntry, kv chan *pair) {
 func (m *kvMeta) LoadMeta(r io.Reader) error {
 	var exist bool
 	err := m.txn(func(tx *kvTxn) error {
-		exist = tx.exist(m.fmtKey())
+		if m.conf.Namespace != "" {
+			exist = tx.exist(m.fmtKey())
+		} else {
+			// ignore the keys of namespaces
+			tx.scan(m.fmtKey(), []byte{namespaceMark}, true, func(k, v []byte) bool {
+				exist = true
+				return false
+			})
+		}
 		return nil
 	})
 	if err != nil {
@@ -3266,7 +3792,7 @@ func (m *kvMeta) LoadMeta(r io.Reader) error {
 		}()
 	}
 
-	dm, counters, parents, refs, err := loadEntries(r, func(e *DumpedEntry) { m.loadEntry(e, kv) }, nil)
+	dm, counters, parents, refs, err := m.loadEntries(r, func(e *DumpedEntry) { m.loadEntry(e, kv) }, nil)
 	if err != nil {
 		return err
 	}
@@ -3281,6 +3807,21 @@ func (m *kvMeta) LoadMeta(r io.Reader) error {
 	for _, d := range dm.DelFiles {
 		kv <- &pair{m.delfileKey(d.Inode, d.Length), m.packInt64(d.Expire)}
 	}
+	for k, v := range dm.Inline {
+		kv <- &pair{m.inlineKey(k), v}
+	}
+	for k, h := range dm.Dedupe {
+		kv <- &pair{m.blockHashKey(k), []byte(h)}
+	}
+	for h, n := range countBlockRefs(dm.Dedupe) {
+		kv <- &pair{m.dedupeRefKey(h), packCounter(n)}
+	}
+	for k, loc := range dm.Packed {
+		kv <- &pair{m.packedBlockKey(k), []byte(loc)}
+	}
+	for pack, n := range countPackRefs(dm.Packed) {
+		kv <- &pair{m.packRefKey(pack), packCounter(n)}
+	}
 	for k, v := range refs {
 		if v > 1 {
 			kv <- &pair{m.sliceKey(k.id, k.size), packCounter(v - 1)}
@@ -3334,14 +3875,17 @@ func (m *kvMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string,
 			attr.Atime = now.Unix()
 			attr.Mtime = now.Unix()
 			attr.Ctime = now.Unix()
+			attr.Btime = now.Unix()
 			attr.Atimensec = uint32(now.Nanosecond())
 			attr.Mtimensec = uint32(now.Nanosecond())
 			attr.Ctimensec = uint32(now.Nanosecond())
+			attr.Btimensec = uint32(now.Nanosecond())
 		}
 		// TODO: preserve hardlink
 		if attr.Typ == TypeFile && attr.Nlink > 1 {
 			attr.Nlink = 1
 		}
+		attr.Flags = clonedFlags(attr.Flags, cmode)
 
 		if top {
 			var pattr Attr
@@ -3381,7 +3925,7 @@ func (m *kvMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string,
 		if top && attr.Typ == TypeDirectory {
 			tx.set(m.detachedKey(ino), m.packInt64(time.Now().Unix()))
 		} else {
-			tx.set(m.entryKey(parent, name), m.packEntry(attr.Typ, ino))
+			m.setEntry(tx, parent, name, m.packEntry(attr.Typ, ino))
 		}
 
 		switch attr.Typ {
@@ -3479,7 +4023,7 @@ func (m *kvMeta) doAttachDirNode(ctx Context, parent Ino, inode Ino, name string
 		pattr.Ctime = now.Unix()
 		pattr.Ctimensec = uint32(now.Nanosecond())
 		tx.set(m.inodeKey(parent), m.marshal(&pattr))
-		tx.set(m.entryKey(parent, name), m.packEntry(TypeDirectory, inode))
+		m.setEntry(tx, parent, name, m.packEntry(TypeDirectory, inode))
 		tx.delete(m.detachedKey(inode))
 		return nil
 	}, parent))
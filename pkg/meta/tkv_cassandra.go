@@ -0,0 +1,750 @@
+//go:build !nocassandra
+// +build !nocassandra
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	Register("cassandra", newKVMeta)
+	Register("scylla", newKVMeta)
+	drivers["cassandra"] = newCassandraClient
+	drivers["scylla"] = newCassandraClient
+}
+
+// The keys are stored in the table <name>_kv, clustered by the partition of key: the keys of
+// an inode ("A" + inode) or a slice ("K" + id) are in the same partition, others are partitioned
+// by the first byte. The partitions of inodes and slices are indexed in <name>_part, so a range
+// across partitions is scanned partition by partition in order.
+//
+// Every key has a version, which is also the write timestamp of the row, it's larger than the
+// versions of all the keys touched by the transaction which writes it, so it increases
+// monotonically for a key even if the clocks of clients are skewed, and an old write could be
+// replayed safely (it's ignored by Cassandra).
+//
+// A transaction remembers the versions of keys it read, and commits by (optimistic locking):
+//  1. locking the keys it writes by LWT (INSERT ... IF NOT EXISTS) in <name>_lock concurrently,
+//     it's conflicted if any of them is locked by others, the locks expire after cqlLockTTL in
+//     case the client crashes;
+//  2. checking the versions of the keys it read (and the empty ranges), it's conflicted if any
+//     of them is changed or locked by others;
+//  3. applying the changes by a logged batch, which is atomic (but not isolated);
+//  4. releasing the locks.
+//
+// A big transaction which can't fit in a batch saves its changes in <name>_txn before locking,
+// and locks the keys without TTL. After it's committed (marked by LWT), the changes are applied by
+// multiple batches. If the client crashes, the transaction is recovered by the one who meets the
+// locks: the changes are applied again if it's committed, and then the locks are released.
+const (
+	cqlLockTTL      = 30 // seconds
+	cqlBatchLimit   = 128
+	cqlBatchBytes   = 32 << 10 // batch_size_fail_threshold is 50 KiB by default
+	cqlLockParallel = 16
+)
+
+var cqlConflicted = errors.New("conflicted transaction")
+
+func cqlPartition(key []byte) []byte {
+	if len(key) >= 9 && (key[0] == 'A' || key[0] == 'K') {
+		return key[:9]
+	}
+	if len(key) == 0 {
+		return key
+	}
+	return key[:1]
+}
+
+// inPartition returns the partition if all the keys in [begin, end) are in the same partition.
+func inPartition(begin, end []byte) ([]byte, bool) {
+	if len(begin) == 0 || len(end) == 0 || (begin[0] == 'A' || begin[0] == 'K') && len(begin) < 9 {
+		return nil, false
+	}
+	p := cqlPartition(begin)
+	return p, bytes.Compare(end, nextKey(p)) <= 0
+}
+
+type cqlTxn struct {
+	c        *cassandraClient
+	observed map[string]int64 // key -> version, 0 means not exist
+	empty    [][2][]byte      // ranges observed without any key
+	buffer   map[string][]byte
+}
+
+func (tx *cqlTxn) get(key []byte) []byte {
+	k := string(key)
+	if v, ok := tx.buffer[k]; ok {
+		return v
+	}
+	var value []byte
+	var ver int64
+	err := tx.c.session.Query(fmt.Sprintf("SELECT v, ver FROM %s WHERE p = ? AND k = ?", tx.c.kv), cqlPartition(key), key).Scan(&value, &ver)
+	if err == gocql.ErrNotFound {
+		tx.observed[k] = 0
+		return nil
+	}
+	if err != nil {
+		panic(fmt.Errorf("get %v: %s", k, err))
+	}
+	tx.observed[k] = ver
+	return value
+}
+
+func (tx *cqlTxn) gets(keys ...[]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = tx.get(key)
+	}
+	return values
+}
+
+func (tx *cqlTxn) scan(begin, end []byte, keysOnly bool, handler func(k, v []byte) bool) {
+	var keys [][]byte
+	var values [][]byte
+	err := tx.c.scanRange(begin, end, func(k, v []byte, ver int64) bool {
+		tx.observed[string(k)] = ver
+		keys = append(keys, k)
+		values = append(values, v)
+		return true
+	})
+	if err != nil {
+		panic(fmt.Errorf("scan range [%v-%v): %s", string(begin), string(end), err))
+	}
+	for i, k := range keys {
+		if !handler(k, values[i]) {
+			break
+		}
+	}
+}
+
+func (tx *cqlTxn) exist(prefix []byte) bool {
+	var found bool
+	end := nextKey(prefix)
+	err := tx.c.scanRange(prefix, end, func(k, v []byte, ver int64) bool {
+		tx.observed[string(k)] = ver
+		found = true
+		return false
+	})
+	if err != nil {
+		panic(fmt.Errorf("scan prefix %v: %s", string(prefix), err))
+	}
+	if !found {
+		tx.empty = append(tx.empty, [2][]byte{prefix, end})
+	}
+	return found
+}
+
+func (tx *cqlTxn) set(key, value []byte) {
+	tx.buffer[string(key)] = value
+}
+
+func (tx *cqlTxn) append(key []byte, value []byte) []byte {
+	new := append(tx.get(key), value...)
+	tx.set(key, new)
+	return new
+}
+
+func (tx *cqlTxn) incrBy(key []byte, value int64) int64 {
+	buf := tx.get(key)
+	new := parseCounter(buf)
+	if value != 0 {
+		new += value
+		tx.set(key, packCounter(new))
+	}
+	return new
+}
+
+func (tx *cqlTxn) delete(key []byte) {
+	tx.buffer[string(key)] = nil
+}
+
+// validate checks the observed keys and ranges, and returns the version for the changes.
+func (tx *cqlTxn) validate(owner []byte) (int64, error) {
+	byPart := make(map[string][][]byte)
+	for k := range tx.observed {
+		byPart[string(cqlPartition([]byte(k)))] = append(byPart[string(cqlPartition([]byte(k)))], []byte(k))
+	}
+	for k := range tx.buffer {
+		if _, ok := tx.observed[k]; !ok {
+			byPart[string(cqlPartition([]byte(k)))] = append(byPart[string(cqlPartition([]byte(k)))], []byte(k))
+		}
+	}
+	ver := time.Now().UnixMicro()
+	for p, keys := range byPart {
+		current := make(map[string]int64, len(keys))
+		iter := tx.c.session.Query(fmt.Sprintf("SELECT k, ver FROM %s WHERE p = ? AND k IN ?", tx.c.kv), []byte(p), keys).Iter()
+		var k []byte
+		var v int64
+		for iter.Scan(&k, &v) {
+			current[string(k)] = v
+			if v >= ver {
+				ver = v + 1
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return 0, err
+		}
+		for _, k := range keys {
+			if old, ok := tx.observed[string(k)]; ok && current[string(k)] != old {
+				return 0, cqlConflicted
+			}
+		}
+	}
+	for _, r := range tx.empty {
+		var found bool
+		if err := tx.c.scanRange(r[0], r[1], func(k, v []byte, ver int64) bool {
+			found = true
+			return false
+		}); err != nil {
+			return 0, err
+		}
+		if found {
+			return 0, cqlConflicted
+		}
+	}
+	// the keys which are read only should not be locked by others (being changed)
+	var readOnly [][]byte
+	for k := range tx.observed {
+		if _, ok := tx.buffer[k]; !ok {
+			readOnly = append(readOnly, []byte(k))
+		}
+	}
+	for i := 0; i < len(readOnly); i += cqlBatchLimit {
+		end := i + cqlBatchLimit
+		if end > len(readOnly) {
+			end = len(readOnly)
+		}
+		iter := tx.c.session.Query(fmt.Sprintf("SELECT owner FROM %s WHERE k IN ?", tx.c.lock), readOnly[i:end]).Iter()
+		var o []byte
+		for iter.Scan(&o) {
+			if !bytes.Equal(o, owner) {
+				_ = iter.Close()
+				return 0, cqlConflicted
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return ver, nil
+}
+
+func (tx *cqlTxn) commit() error {
+	start := time.Now()
+	keys := make([][]byte, 0, len(tx.buffer))
+	var size int
+	for k, v := range tx.buffer {
+		keys = append(keys, []byte(k))
+		size += 2*len(k) + len(v) + 32
+	}
+	owner := make([]byte, 16)
+	_, _ = rand.Read(owner)
+	big := len(keys) > cqlBatchLimit || size > cqlBatchBytes
+	if big {
+		// save the changes before locking, so the locks could be released by others after crashed
+		err := tx.c.session.Query(fmt.Sprintf("INSERT INTO %s (id, created, committed, ver, changes) VALUES (?, ?, false, 0, ?)", tx.c.txns),
+			owner, time.Now().Unix(), encodeCqlChanges(tx.buffer)).Exec()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = tx.c.session.Query(fmt.Sprintf("DELETE FROM %s WHERE id = ?", tx.c.txns), owner).Exec()
+		}()
+	}
+	locked, err := tx.c.lockKeys(keys, owner, !big)
+	defer func() {
+		tx.c.unlockKeys(locked, owner)
+		if time.Since(start) > time.Millisecond*10 {
+			logger.Debugf("txn with %d reads and %d changes took %s", len(tx.observed), len(tx.buffer), time.Since(start))
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	ver, err := tx.validate(owner)
+	if err != nil {
+		return err
+	}
+	if big {
+		applied, err := tx.c.session.Query(fmt.Sprintf("UPDATE %s SET committed = true, ver = ? WHERE id = ? IF EXISTS", tx.c.txns), ver, owner).
+			MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			return err
+		}
+		if !applied {
+			return cqlConflicted // aborted by others
+		}
+	}
+	return tx.c.apply(tx.buffer, ver, tx.newPartitions(), !big)
+}
+
+// newPartitions returns the partitions of inodes and slices which may be created by the transaction.
+func (tx *cqlTxn) newPartitions() [][]byte {
+	var parts [][]byte
+	seen := make(map[string]bool)
+	for k, v := range tx.buffer {
+		if v == nil || len(k) < 9 || k[0] != 'A' && k[0] != 'K' {
+			continue
+		}
+		if ver, ok := tx.observed[k]; ok && ver != 0 {
+			continue
+		}
+		if p := k[:9]; !seen[p] {
+			seen[p] = true
+			parts = append(parts, []byte(p))
+		}
+	}
+	return parts
+}
+
+func encodeCqlChanges(changes map[string][]byte) []byte {
+	size := 4
+	for k, v := range changes {
+		size += 9 + len(k) + len(v)
+	}
+	b := utils.NewBuffer(uint32(size))
+	b.Put32(uint32(len(changes)))
+	for k, v := range changes {
+		b.Put32(uint32(len(k)))
+		b.Put([]byte(k))
+		if v == nil {
+			b.Put8(1)
+		} else {
+			b.Put8(0)
+		}
+		b.Put32(uint32(len(v)))
+		b.Put(v)
+	}
+	return b.Bytes()
+}
+
+func decodeCqlChanges(buf []byte) (map[string][]byte, error) {
+	rb := utils.FromBuffer(buf)
+	if rb.Left() < 4 {
+		return nil, fmt.Errorf("invalid changes")
+	}
+	n := int(rb.Get32())
+	changes := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		if rb.Left() < 4 {
+			return nil, fmt.Errorf("invalid changes")
+		}
+		kl := int(rb.Get32())
+		if rb.Left() < kl+5 {
+			return nil, fmt.Errorf("invalid changes")
+		}
+		k := string(rb.Get(kl))
+		deleted := rb.Get8() == 1
+		vl := int(rb.Get32())
+		if rb.Left() < vl {
+			return nil, fmt.Errorf("invalid changes")
+		}
+		v := rb.Get(vl)
+		if deleted {
+			v = nil
+		} else if v == nil {
+			v = []byte{}
+		}
+		changes[k] = v
+	}
+	return changes, nil
+}
+
+type cassandraClient struct {
+	session *gocql.Session
+	kv      string // name of table for keys
+	lock    string // name of table for locks
+	part    string // name of table for the index of partitions
+	txns    string // name of table for big transactions
+}
+
+func (c *cassandraClient) name() string {
+	return "cassandra"
+}
+
+func (c *cassandraClient) shouldRetry(err error) bool {
+	return errors.Is(err, cqlConflicted) || errors.Is(err, gocql.ErrTimeoutNoResponse)
+}
+
+func (c *cassandraClient) txn(f func(*kvTxn) error, retry int) (err error) {
+	tx := &cqlTxn{
+		c:        c,
+		observed: make(map[string]int64),
+		buffer:   make(map[string][]byte),
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			fe, ok := r.(error)
+			if ok {
+				err = fe
+			} else {
+				panic(r)
+			}
+		}
+	}()
+	if err = f(&kvTxn{tx, retry}); err != nil {
+		return err
+	}
+	if len(tx.buffer) == 0 {
+		return nil // read only
+	}
+	return tx.commit()
+}
+
+// lockKeys locks the keys concurrently, the locked ones are released if any of them fails.
+func (c *cassandraClient) lockKeys(keys [][]byte, owner []byte, expire bool) ([][]byte, error) {
+	stmt := fmt.Sprintf("INSERT INTO %s (k, owner) VALUES (?, ?) IF NOT EXISTS", c.lock)
+	if expire {
+		stmt += fmt.Sprintf(" USING TTL %d", cqlLockTTL)
+	}
+	var mu sync.Mutex
+	var locked [][]byte
+	var lastErr error
+	var holders [][]byte
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, cqlLockParallel)
+	for _, key := range keys {
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(key []byte) {
+			defer func() { <-limit; wg.Done() }()
+			existing := make(map[string]interface{})
+			applied, err := c.session.Query(stmt, key, owner).MapScanCAS(existing)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+			} else if !applied {
+				if lastErr == nil {
+					lastErr = cqlConflicted
+				}
+				if o, ok := existing["owner"].([]byte); ok {
+					holders = append(holders, o)
+				}
+			} else {
+				locked = append(locked, key)
+			}
+		}(key)
+	}
+	wg.Wait()
+	if lastErr != nil {
+		c.unlockKeys(locked, owner)
+		for _, o := range holders {
+			c.recoverTxn(o)
+		}
+		return nil, lastErr
+	}
+	return locked, nil
+}
+
+func (c *cassandraClient) unlockKeys(keys [][]byte, owner []byte) {
+	for _, k := range keys {
+		if _, err := c.session.Query(fmt.Sprintf("DELETE FROM %s WHERE k = ? IF owner = ?", c.lock), k, owner).
+			MapScanCAS(make(map[string]interface{})); err != nil {
+			logger.Warnf("Unlock %v: %s", string(k), err)
+		}
+	}
+}
+
+// recoverTxn finishes a big transaction whose client may be crashed: the changes are applied again
+// if it's committed, or it's aborted otherwise, and then the locks are released.
+func (c *cassandraClient) recoverTxn(owner []byte) {
+	var created, ver int64
+	var committed bool
+	var data []byte
+	err := c.session.Query(fmt.Sprintf("SELECT created, committed, ver, changes FROM %s WHERE id = ?", c.txns), owner).
+		Scan(&created, &committed, &ver, &data)
+	if err != nil || time.Since(time.Unix(created, 0)) < time.Second*cqlLockTTL {
+		return // not a big transaction or it's still running
+	}
+	changes, err := decodeCqlChanges(data)
+	if err != nil {
+		logger.Errorf("Decode changes of transaction %x: %s", owner, err)
+		return
+	}
+	if committed {
+		var parts [][]byte
+		for k, v := range changes {
+			if v != nil && len(k) >= 9 && (k[0] == 'A' || k[0] == 'K') {
+				parts = append(parts, []byte(k[:9]))
+			}
+		}
+		if err = c.apply(changes, ver, parts, false); err != nil {
+			logger.Warnf("Apply transaction %x: %s", owner, err)
+			return
+		}
+	} else {
+		applied, err := c.session.Query(fmt.Sprintf("DELETE FROM %s WHERE id = ? IF committed = false", c.txns), owner).
+			MapScanCAS(make(map[string]interface{}))
+		if err != nil || !applied {
+			return // committed by the owner just now
+		}
+	}
+	logger.Infof("Recovered transaction %x (committed: %t) with %d changes", owner, committed, len(changes))
+	keys := make([][]byte, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, []byte(k))
+	}
+	c.unlockKeys(keys, owner)
+	_ = c.session.Query(fmt.Sprintf("DELETE FROM %s WHERE id = ?", c.txns), owner).Exec()
+}
+
+// apply writes the changes with version ver as timestamp, by a logged batch if atomic is true,
+// or multiple batches otherwise.
+func (c *cassandraClient) apply(changes map[string][]byte, ver int64, parts [][]byte, atomic bool) error {
+	typ := gocql.LoggedBatch
+	if !atomic {
+		typ = gocql.UnloggedBatch
+	}
+	keys := make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // group by partition
+	batch := c.session.NewBatch(typ)
+	var size int
+	flush := func() error {
+		if batch.Size() == 0 {
+			return nil
+		}
+		err := c.session.ExecuteBatch(batch)
+		batch, size = c.session.NewBatch(typ), 0
+		return err
+	}
+	for _, p := range parts {
+		batch.Query(fmt.Sprintf("INSERT INTO %s (b, p) VALUES (?, ?)", c.part), p[:1], p)
+		size += 2 * len(p)
+	}
+	for _, k := range keys {
+		if !atomic && (batch.Size() >= cqlBatchLimit || size >= cqlBatchBytes) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		key, v := []byte(k), changes[k]
+		if v == nil {
+			batch.Query(fmt.Sprintf("DELETE FROM %s USING TIMESTAMP ? WHERE p = ? AND k = ?", c.kv), ver, cqlPartition(key), key)
+		} else {
+			batch.Query(fmt.Sprintf("INSERT INTO %s (p, k, v, ver) VALUES (?, ?, ?, ?) USING TIMESTAMP ?", c.kv), cqlPartition(key), key, v, ver, ver)
+		}
+		size += 2*len(k) + len(v) + 32
+	}
+	return flush()
+}
+
+// partitions returns the partitions which may have keys in [begin, end), in order.
+func (c *cassandraClient) partitions(begin, end []byte) ([][]byte, error) {
+	first, last := 0, 255
+	if len(begin) > 0 {
+		first = int(begin[0])
+	}
+	if len(end) > 0 {
+		last = int(end[0])
+		if len(end) == 1 {
+			last--
+		}
+	}
+	var parts [][]byte
+	for b := first; b <= last; b++ {
+		parts = append(parts, []byte{byte(b)})
+		if b != 'A' && b != 'K' {
+			continue
+		}
+		lo, hi := []byte{byte(b)}, []byte{byte(b + 1)}
+		if len(begin) > 1 && int(begin[0]) == b {
+			lo = cqlPartition(begin)
+			if len(lo) < 9 {
+				lo = begin
+			}
+		}
+		if len(end) > 1 && int(end[0]) == b {
+			hi = end
+		}
+		iter := c.session.Query(fmt.Sprintf("SELECT p FROM %s WHERE b = ? AND p >= ? AND p < ?", c.part), []byte{byte(b)}, lo, hi).PageSize(1000).Iter()
+		var p []byte
+		for iter.Scan(&p) {
+			parts = append(parts, p)
+			p = nil
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// scanRange calls handler for the keys in [begin, end) in order until it returns false.
+func (c *cassandraClient) scanRange(begin, end []byte, handler func(k, v []byte, ver int64) bool) error {
+	parts := [][]byte{nil}
+	if p, ok := inPartition(begin, end); ok {
+		parts[0] = p
+	} else {
+		var err error
+		if parts, err = c.partitions(begin, end); err != nil {
+			return err
+		}
+	}
+	for _, p := range parts {
+		var iter *gocql.Iter
+		if len(end) > 0 {
+			iter = c.session.Query(fmt.Sprintf("SELECT k, v, ver FROM %s WHERE p = ? AND k >= ? AND k < ?", c.kv), p, begin, end).PageSize(1000).Iter()
+		} else {
+			iter = c.session.Query(fmt.Sprintf("SELECT k, v, ver FROM %s WHERE p = ? AND k >= ?", c.kv), p, begin).PageSize(1000).Iter()
+		}
+		var k, v []byte
+		var ver int64
+		for iter.Scan(&k, &v, &ver) {
+			if !handler(k, v, ver) {
+				return iter.Close()
+			}
+			k, v = nil, nil
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cassandraClient) scan(prefix []byte, handler func(key, value []byte)) error {
+	return c.scanRange(prefix, nextKey(prefix), func(k, v []byte, ver int64) bool {
+		handler(k, v)
+		return true
+	})
+}
+
+func (c *cassandraClient) reset(prefix []byte) error {
+	if len(prefix) == 0 {
+		for _, t := range []string{c.kv, c.lock, c.part, c.txns} {
+			if err := c.session.Query("TRUNCATE " + t).Exec(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// delete them with newer versions
+	changes := make(map[string][]byte)
+	ver := time.Now().UnixMicro()
+	err := c.scanRange(prefix, nextKey(prefix), func(k, v []byte, kver int64) bool {
+		changes[string(k)] = nil
+		if kver >= ver {
+			ver = kver + 1
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return c.apply(changes, ver, nil, false)
+}
+
+func (c *cassandraClient) close() error {
+	c.session.Close()
+	return nil
+}
+
+func (c *cassandraClient) gc() {}
+
+// newCassandraClient connects to cassandra://[user:password@]host1,host2[:port]/keyspace[/name][?options],
+// the keyspace should be created in advance.
+func newCassandraClient(addr string) (tkvClient, error) {
+	u, err := url.Parse("cassandra://" + addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", addr, err)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if parts[0] == "" {
+		return nil, fmt.Errorf("keyspace is required in %s", addr)
+	}
+	name := "jfs"
+	if len(parts) > 1 && parts[1] != "" {
+		name = parts[1]
+	}
+	var hosts []string
+	port := 9042
+	for _, h := range strings.Split(u.Host, ",") {
+		if i := strings.LastIndex(h, ":"); i > 0 && !strings.HasSuffix(h, "]") {
+			if port, err = strconv.Atoi(h[i+1:]); err != nil {
+				return nil, fmt.Errorf("invalid port in %s: %s", h, err)
+			}
+			h = h[:i]
+		}
+		hosts = append(hosts, h)
+	}
+	cluster := gocql.NewCluster(hosts...)
+	cluster.Port = port
+	cluster.Keyspace = parts[0]
+	cluster.Timeout = time.Second * 10
+	cluster.Consistency = gocql.Quorum
+	cluster.SerialConsistency = gocql.Serial
+	query := u.Query()
+	if v := query.Get("consistency"); v != "" {
+		if cluster.Consistency, err = gocql.ParseConsistencyWrapper(v); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(strings.ToLower(v), "local_") {
+			cluster.SerialConsistency = gocql.LocalSerial
+		}
+	}
+	if v := query.Get("dc"); v != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(v))
+	}
+	if u.User != nil {
+		passwd, _ := u.User.Password()
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: u.User.Username(), Password: passwd}
+	}
+	if query.Get("cacert") != "" || query.Get("cert") != "" {
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 query.Get("cacert"),
+			CertPath:               query.Get("cert"),
+			KeyPath:                query.Get("key"),
+			EnableHostVerification: query.Get("insecure-skip-verify") == "",
+		}
+	}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, err
+	}
+	c := &cassandraClient{session: session, kv: name + "_kv", lock: name + "_lock", part: name + "_part", txns: name + "_txn"}
+	for _, stmt := range []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (p blob, k blob, v blob, ver bigint, PRIMARY KEY (p, k)) WITH CLUSTERING ORDER BY (k ASC)", c.kv),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (k blob PRIMARY KEY, owner blob)", c.lock),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (b blob, p blob, PRIMARY KEY (b, p)) WITH CLUSTERING ORDER BY (p ASC)", c.part),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id blob PRIMARY KEY, created bigint, committed boolean, ver bigint, changes blob)", c.txns),
+	} {
+		if err = session.Query(stmt).Exec(); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("create table: %s", err)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,163 @@
+//go:build !nocassandra
+// +build !nocassandra
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//mutate:disable
+//nolint:errcheck
+package meta
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCqlPartition(t *testing.T) {
+	inode := []byte("A\x00\x00\x00\x00\x00\x00\x00\x01I")
+	if p := cqlPartition(inode); !bytes.Equal(p, inode[:9]) {
+		t.Fatalf("partition of inode: %v", p)
+	}
+	if p := cqlPartition([]byte("C:nextInode")); !bytes.Equal(p, []byte("C")) {
+		t.Fatalf("partition of counter: %v", p)
+	}
+	if p, ok := inPartition(inode[:9], nextKey(inode[:9])); !ok || !bytes.Equal(p, inode[:9]) {
+		t.Fatalf("range of an inode should be in one partition: %v %t", p, ok)
+	}
+	if _, ok := inPartition([]byte("A"), []byte("B")); ok {
+		t.Fatalf("range of all inodes should not be in one partition")
+	}
+	if _, ok := inPartition([]byte("C"), nil); ok {
+		t.Fatalf("range without end should not be in one partition")
+	}
+	if p, ok := inPartition([]byte("SE"), []byte("SF")); !ok || !bytes.Equal(p, []byte("S")) {
+		t.Fatalf("range of sessions should be in one partition: %v %t", p, ok)
+	}
+}
+
+func TestCqlChanges(t *testing.T) {
+	changes := map[string][]byte{
+		"A\x00\x00\x00\x00\x00\x00\x00\x01I": []byte("attr"),
+		"C:nextInode":                        nil,
+		"empty":                              {},
+	}
+	decoded, err := decodeCqlChanges(encodeCqlChanges(changes))
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if !reflect.DeepEqual(changes, decoded) {
+		t.Fatalf("expect %v, got %v", changes, decoded)
+	}
+	if decoded["C:nextInode"] != nil || decoded["empty"] == nil {
+		t.Fatalf("deleted and empty values should be different")
+	}
+	if _, err = decodeCqlChanges([]byte{0, 0, 0, 1, 0}); err == nil {
+		t.Fatalf("decode truncated changes should fail")
+	}
+}
+
+func TestCassandraTxn(t *testing.T) { //skip mutate
+	if os.Getenv("SKIP_NON_CORE") == "true" || os.Getenv("CASSANDRA_ADDR") == "" {
+		t.Skipf("skip non-core test")
+	}
+	tc, err := newCassandraClient(os.Getenv("CASSANDRA_ADDR") + "/txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := tc.(*cassandraClient)
+	defer c.close()
+	if err = c.reset(nil); err != nil {
+		t.Fatalf("reset: %s", err)
+	}
+
+	// concurrent increments should not be lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for {
+					err := c.txn(func(tx *kvTxn) error {
+						tx.incrBy([]byte("counter"), 1)
+						return nil
+					}, 0)
+					if err == nil {
+						break
+					} else if !c.shouldRetry(err) {
+						t.Errorf("incr: %s", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	_ = c.txn(func(tx *kvTxn) error {
+		if v := tx.incrBy([]byte("counter"), 0); v != 100 {
+			t.Fatalf("counter should be 100, got %d", v)
+		}
+		return nil
+	}, 0)
+
+	// a range observed as empty
+	err = c.txn(func(tx *kvTxn) error {
+		if tx.exist([]byte("A\x00\x00\x00\x00\x00\x00\x00\x02D")) {
+			t.Fatalf("should be empty")
+		}
+		// changed by another transaction before committed
+		if err := c.txn(func(tx2 *kvTxn) error {
+			tx2.set([]byte("A\x00\x00\x00\x00\x00\x00\x00\x02Dname"), []byte("v"))
+			return nil
+		}, 0); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		tx.set([]byte("A\x00\x00\x00\x00\x00\x00\x00\x02I"), []byte("attr"))
+		return nil
+	}, 0)
+	if err != cqlConflicted {
+		t.Fatalf("phantom should be conflicted, got %v", err)
+	}
+
+	// a big transaction is applied by multiple batches
+	err = c.txn(func(tx *kvTxn) error {
+		for i := 0; i < cqlBatchLimit*3; i++ {
+			tx.set([]byte{'K', 0, 0, 0, 0, 0, 0, byte(i >> 8), byte(i), 0, 0, 0, 1}, bytes.Repeat([]byte{'v'}, 512))
+		}
+		return nil
+	}, 0)
+	if err != nil {
+		t.Fatalf("big txn: %s", err)
+	}
+	var n int
+	_ = c.scan([]byte("K"), func(k, v []byte) { n++ })
+	if n != cqlBatchLimit*3 {
+		t.Fatalf("expect %d keys, got %d", cqlBatchLimit*3, n)
+	}
+	var locks int
+	iter := c.session.Query("SELECT k FROM " + c.lock).Iter()
+	var k []byte
+	for iter.Scan(&k) {
+		locks++
+	}
+	_ = iter.Close()
+	if locks != 0 {
+		t.Fatalf("all locks should be released, got %d", locks)
+	}
+}
@@ -100,5 +100,8 @@ func (c *prefixClient) reset(prefix []byte) error {
 }
 
 func withPrefix(client tkvClient, prefix []byte) tkvClient {
+	if c, ok := client.(*prefixClient); ok { // nested prefixes, e.g. namespace in TiKV
+		return &prefixClient{c.tkvClient, append(append([]byte{}, c.prefix...), prefix...)}
+	}
 	return &prefixClient{client, prefix}
 }
@@ -62,6 +62,17 @@ func TestEtcdClient(t *testing.T) { //skip mutate
 	testMeta(t, m)
 }
 
+func TestCassandraClient(t *testing.T) { //skip mutate
+	if os.Getenv("SKIP_NON_CORE") == "true" || os.Getenv("CASSANDRA_ADDR") == "" {
+		t.Skipf("skip non-core test")
+	}
+	m, err := newKVMeta("cassandra", os.Getenv("CASSANDRA_ADDR"), testConfig())
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	testMeta(t, m)
+}
+
 func testTKV(t *testing.T, c tkvClient) {
 	txn := func(f func(kt *kvTxn)) {
 		if err := c.txn(func(kt *kvTxn) error {
@@ -278,6 +289,17 @@ func TestEtcd(t *testing.T) { //skip mutate
 	testTKV(t, c)
 }
 
+func TestCassandra(t *testing.T) { //skip mutate
+	if os.Getenv("SKIP_NON_CORE") == "true" || os.Getenv("CASSANDRA_ADDR") == "" {
+		t.Skipf("skip non-core test")
+	}
+	c, err := newTkvClient("cassandra", os.Getenv("CASSANDRA_ADDR")+"/tkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTKV(t, c)
+}
+
 func TestMemKV(t *testing.T) {
 	c, _ := newTkvClient("memkv", "")
 	c = withPrefix(c, []byte("jfs"))
@@ -21,6 +21,7 @@ package meta
 
 import (
 	"context"
+	"fmt"
 	"net/url"
 	"os"
 	"strings"
@@ -31,6 +32,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/tikv/client-go/v2/config"
 	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/kv"
 	"github.com/tikv/client-go/v2/oracle"
 	"github.com/tikv/client-go/v2/tikv"
 	"github.com/tikv/client-go/v2/txnkv"
@@ -61,34 +63,89 @@ func newTikvClient(addr string) (tkvClient, error) {
 	l, prop, _ := plog.InitLogger(&plog.Config{Level: plvl}, zap.Fields(zap.String("component", "tikv"), zap.Int("pid", os.Getpid())))
 	plog.ReplaceGlobals(l, prop)
 
+	opt, err := parseTikvAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	config.UpdateGlobal(opt.update)
+	logger.Infof("TiKV gc interval is set to %s", opt.gcInterval)
+	client, err := txnkv.NewClient(opt.pds)
+	if err != nil {
+		return nil, err
+	}
+	return withPrefix(&tikvClient{client.KVStore, opt.gcInterval, opt.replicaRead}, append([]byte(opt.prefix), 0xFD)), nil
+}
+
+type tikvOptions struct {
+	pds         []string
+	prefix      string
+	gcInterval  time.Duration
+	replicaRead kv.ReplicaReadType
+	update      func(conf *config.Config) // TLS and timeouts
+}
+
+func parseTikvAddr(addr string) (*tikvOptions, error) {
 	tUrl, err := url.Parse("tikv://" + addr)
 	if err != nil {
 		return nil, err
 	}
 	query := tUrl.Query()
-	config.UpdateGlobal(func(conf *config.Config) {
+	if keyspace := query.Get("keyspace"); keyspace != "" {
+		return nil, fmt.Errorf("TiKV keyspace (%s) is not supported", keyspace)
+	}
+	var seconds = func(name string) uint {
+		if v := query.Get(name); v != "" {
+			if dur, err := time.ParseDuration(v); err == nil && dur >= time.Second {
+				return uint(dur / time.Second)
+			}
+			logger.Warnf("Invalid TiKV %s: %s, it should be a duration of at least 1s", name, v)
+		}
+		return 0
+	}
+	opt := &tikvOptions{
+		pds:        strings.Split(tUrl.Host, ","),
+		prefix:     strings.TrimLeft(tUrl.Path, "/"),
+		gcInterval: time.Hour * 3,
+	}
+	keepAliveTime, keepAliveTimeout, pdTimeout := seconds("keepalive-time"), seconds("keepalive-timeout"), seconds("pd-timeout")
+	commitTimeout := query.Get("commit-timeout")
+	opt.update = func(conf *config.Config) {
 		conf.Security = config.NewSecurity(
 			query.Get("ca"),
 			query.Get("cert"),
 			query.Get("key"),
 			strings.Split(query.Get("verify-cn"), ","))
-	})
-	interval := time.Hour * 3
+		if keepAliveTime > 0 {
+			conf.TiKVClient.GrpcKeepAliveTime = keepAliveTime
+		}
+		if keepAliveTimeout > 0 {
+			conf.TiKVClient.GrpcKeepAliveTimeout = keepAliveTimeout
+		}
+		if pdTimeout > 0 {
+			conf.PDClient.PDServerTimeout = pdTimeout
+		}
+		if commitTimeout != "" {
+			conf.TiKVClient.CommitTimeout = commitTimeout
+		}
+	}
 	if dur, err := time.ParseDuration(query.Get("gc-interval")); err == nil {
 		if dur != 0 && dur < time.Hour {
 			logger.Warnf("TiKV gc-interval (%s) is too short, and is reset to 1h", dur)
 			dur = time.Hour
 		}
-		interval = dur
+		opt.gcInterval = dur
 	}
-	logger.Infof("TiKV gc interval is set to %s", interval)
-
-	client, err := txnkv.NewClient(strings.Split(tUrl.Host, ","))
-	if err != nil {
-		return nil, err
+	switch rr := query.Get("replica-read"); rr {
+	case "", "leader":
+		opt.replicaRead = kv.ReplicaReadLeader
+	case "follower":
+		opt.replicaRead = kv.ReplicaReadFollower
+	case "mixed": // leader and followers
+		opt.replicaRead = kv.ReplicaReadMixed
+	default:
+		return nil, fmt.Errorf("invalid replica-read: %s", rr)
 	}
-	prefix := strings.TrimLeft(tUrl.Path, "/")
-	return withPrefix(&tikvClient{client.KVStore, interval}, append([]byte(prefix), 0xFD)), nil
+	return opt, nil
 }
 
 type tikvTxn struct {
@@ -169,8 +226,9 @@ func (tx *tikvTxn) delete(key []byte) {
 }
 
 type tikvClient struct {
-	client     *tikv.KVStore
-	gcInterval time.Duration
+	client      *tikv.KVStore
+	gcInterval  time.Duration
+	replicaRead kv.ReplicaReadType
 }
 
 func (c *tikvClient) name() string {
@@ -186,6 +244,9 @@ func (c *tikvClient) txn(f func(*kvTxn) error, retry int) (err error) {
 	if err != nil {
 		return err
 	}
+	if c.replicaRead != kv.ReplicaReadLeader {
+		tx.GetSnapshot().SetReplicaRead(c.replicaRead)
+	}
 	defer func() {
 		if r := recover(); r != nil {
 			fe, ok := r.(error)
@@ -216,6 +277,7 @@ func (c *tikvClient) scan(prefix []byte, handler func(key, value []byte)) error
 	snap.SetScanBatchSize(10240)
 	snap.SetNotFillCache(true)
 	snap.SetPriority(txnutil.PriorityLow)
+	snap.SetReplicaRead(c.replicaRead)
 	it, err := snap.Iter(prefix, nextKey(prefix))
 	if err != nil {
 		return err
@@ -0,0 +1,76 @@
+//go:build !notikv
+// +build !notikv
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tikv/client-go/v2/config"
+	"github.com/tikv/client-go/v2/kv"
+)
+
+func TestParseTikvAddr(t *testing.T) {
+	opt, err := parseTikvAddr("pd1:2379,pd2:2379/jfs?ca=/ca.pem&cert=/cert.pem&key=/key.pem&verify-cn=a,b" +
+		"&keepalive-time=10s&keepalive-timeout=3s&pd-timeout=5s&commit-timeout=41s&gc-interval=2h&replica-read=follower")
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if !reflect.DeepEqual(opt.pds, []string{"pd1:2379", "pd2:2379"}) || opt.prefix != "jfs" {
+		t.Fatalf("pds %v prefix %s", opt.pds, opt.prefix)
+	}
+	if opt.gcInterval != time.Hour*2 || opt.replicaRead != kv.ReplicaReadFollower {
+		t.Fatalf("gc interval %s replica read %d", opt.gcInterval, opt.replicaRead)
+	}
+	conf := config.DefaultConfig()
+	opt.update(&conf)
+	if !reflect.DeepEqual(conf.Security, config.NewSecurity("/ca.pem", "/cert.pem", "/key.pem", []string{"a", "b"})) {
+		t.Fatalf("security %+v", conf.Security)
+	}
+	if conf.TiKVClient.GrpcKeepAliveTime != 10 || conf.TiKVClient.GrpcKeepAliveTimeout != 3 {
+		t.Fatalf("keepalive %d %d", conf.TiKVClient.GrpcKeepAliveTime, conf.TiKVClient.GrpcKeepAliveTimeout)
+	}
+	if conf.PDClient.PDServerTimeout != 5 || conf.TiKVClient.CommitTimeout != "41s" {
+		t.Fatalf("pd timeout %d commit timeout %s", conf.PDClient.PDServerTimeout, conf.TiKVClient.CommitTimeout)
+	}
+
+	// invalid or short durations keep the defaults
+	opt, err = parseTikvAddr("pd1:2379?keepalive-time=500ms&keepalive-timeout=abc&gc-interval=10m")
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if opt.prefix != "" || opt.gcInterval != time.Hour || opt.replicaRead != kv.ReplicaReadLeader {
+		t.Fatalf("prefix %s gc interval %s replica read %d", opt.prefix, opt.gcInterval, opt.replicaRead)
+	}
+	conf, def := config.DefaultConfig(), config.DefaultConfig()
+	opt.update(&conf)
+	if conf.TiKVClient.GrpcKeepAliveTime != def.TiKVClient.GrpcKeepAliveTime ||
+		conf.TiKVClient.GrpcKeepAliveTimeout != def.TiKVClient.GrpcKeepAliveTimeout {
+		t.Fatalf("keepalive %d %d", conf.TiKVClient.GrpcKeepAliveTime, conf.TiKVClient.GrpcKeepAliveTimeout)
+	}
+
+	if _, err = parseTikvAddr("pd1:2379/jfs?keyspace=tenant1"); err == nil {
+		t.Fatalf("keyspace should not be supported")
+	}
+	if _, err = parseTikvAddr("pd1:2379/jfs?replica-read=any"); err == nil {
+		t.Fatalf("replica-read any should be invalid")
+	}
+}
@@ -53,6 +53,7 @@ const (
 	CLONE_MODE_CAN_OVERWRITE      = 0x01
 	CLONE_MODE_PRESERVE_ATTR      = 0x02
 	CLONE_MODE_PRESERVE_HARDLINKS = 0x08
+	CLONE_MODE_SNAPSHOT           = 0x10 // clone into a snapshot, the entries are immutable
 
 	// atime mode
 	NoAtime     = "noatime"
@@ -541,12 +542,17 @@ func (m *baseMeta) getTreeSummary(ctx Context, tree *TreeSummary, depth, topN ui
 	default:
 	}
 
-	// pick top N
 	for _, c := range tree.Children {
 		tree.Dirs += c.Dirs
 		tree.Files += c.Files
 		tree.Size += c.Size
 	}
+	pickTopN(tree, topN)
+	return 0
+}
+
+// pickTopN keeps the biggest N children of a tree, and merges the others into one.
+func pickTopN(tree *TreeSummary, topN uint8) {
 	sort.Slice(tree.Children, func(i, j int) bool {
 		return tree.Children[i].Size > tree.Children[j].Size
 	})
@@ -562,7 +568,6 @@ func (m *baseMeta) getTreeSummary(ctx Context, tree *TreeSummary, depth, topN ui
 		}
 		tree.Children = append(tree.Children[:topN], omitChild)
 	}
-	return 0
 }
 
 func (m *baseMeta) atimeNeedsUpdate(attr *Attr, now time.Time) bool {
@@ -17,6 +17,7 @@
 package meta
 
 import (
+	"syscall"
 	"testing"
 	"time"
 )
@@ -87,3 +88,74 @@ func TestAtimeNeedsUpdate(t *testing.T) {
 		t.Fatal("atime updated for strictatime when < 1s")
 	}
 }
+
+func TestInvalidationMsg(t *testing.T) {
+	sid, inodes := decodeInvalidation(encodeInvalidation(3, []Ino{1, 2, 100}))
+	if sid != 3 || len(inodes) != 3 || inodes[0] != 1 || inodes[2] != 100 {
+		t.Fatalf("decode invalidation: sid %d, inodes %v", sid, inodes)
+	}
+	if sid, inodes = decodeInvalidation([]byte{1, 2, 3}); sid != 0 || inodes != nil {
+		t.Fatalf("decode bad invalidation: sid %d, inodes %v", sid, inodes)
+	}
+}
+
+func TestTxnMethod(t *testing.T) {
+	var name string
+	txn := func() { name = txnMethod() }
+	txn()
+	if name != "TestTxnMethod" {
+		t.Fatalf("method of transaction: %s", name)
+	}
+}
+
+func TestPopNamespace(t *testing.T) {
+	cases := []struct{ uri, addr, ns string }{
+		{"localhost/1", "localhost/1", ""},
+		{"localhost/1?namespace=vol2", "localhost/1", "vol2"},
+		{"root:@(127.0.0.1:3306)/jfs?charset=utf8&namespace=a1", "root:@(127.0.0.1:3306)/jfs?charset=utf8", "a1"},
+	}
+	for _, c := range cases {
+		addr, ns, err := popNamespace(c.uri)
+		if err != nil || addr != c.addr || ns != c.ns {
+			t.Fatalf("pop namespace from %s: %s %s %v", c.uri, addr, ns, err)
+		}
+	}
+	for _, uri := range []string{"localhost/1?namespace=", "localhost/1?namespace=Vol", "localhost/1?namespace=a_b"} {
+		if _, _, err := popNamespace(uri); err == nil {
+			t.Fatalf("namespace of %s should be invalid", uri)
+		}
+	}
+}
+
+func TestCloneUsage(t *testing.T) {
+	u := &cloneUsage{owners: make(map[[2]uint32]*[2]int64)}
+	u.add(&Attr{Typ: TypeDirectory, Length: 4096, Uid: 1, Gid: 1})
+	u.add(&Attr{Typ: TypeFile, Length: 5000, Uid: 1, Gid: 1})
+	u.add(&Attr{Typ: TypeFile, Length: 0, Uid: 2, Gid: 1})
+	if u.space != 4096*4 || u.inodes != 3 {
+		t.Fatalf("usage: space %d, inodes %d", u.space, u.inodes)
+	}
+	if o := u.owners[[2]uint32{1, 1}]; o == nil || o[0] != 4096*3 || o[1] != 2 {
+		t.Fatalf("usage of 1:1: %v", o)
+	}
+	if o := u.owners[[2]uint32{2, 1}]; o == nil || o[0] != 4096 || o[1] != 1 {
+		t.Fatalf("usage of 2:1: %v", o)
+	}
+
+	m := &baseMeta{ownerQuotas: map[Ino]*Quota{
+		userQuotaIno(1):  {MaxInodes: 3, UsedInodes: 1},
+		userQuotaIno(2):  {MaxSpace: 4096, UsedSpace: 4096},
+		groupQuotaIno(1): {MaxInodes: 10, MaxSpace: 4096 * 4},
+	}}
+	if st := u.checkOwners(m); st != syscall.EDQUOT {
+		t.Fatalf("user 2 should be out of quota: %s", st)
+	}
+	m.ownerQuotas[userQuotaIno(2)].UsedSpace = 0
+	if st := u.checkOwners(m); st != 0 {
+		t.Fatalf("check owners: %s", st)
+	}
+	m.ownerQuotas[groupQuotaIno(1)].UsedSpace = 1
+	if st := u.checkOwners(m); st != syscall.EDQUOT {
+		t.Fatalf("group 1 should be out of quota: %s", st)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type EventType uint8
+
+const (
+	EventCreate EventType = iota + 1 // a file or directory is created (or hard linked)
+	EventDelete                      // an entry is removed
+	EventRename                      // an entry is renamed
+	EventAttr                        // attributes or extended attributes are changed
+	EventChange                      // an inode is changed by another client (the entries of it for a directory)
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCreate:
+		return "create"
+	case EventDelete:
+		return "delete"
+	case EventRename:
+		return "rename"
+	case EventAttr:
+		return "attr"
+	case EventChange:
+		return "change"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a change of the namespace. The changes made by other clients are received from the
+// published invalidations as EventChange, which have no details but the changed inode.
+type Event struct {
+	Type      EventType
+	Inode     Ino
+	Parent    Ino    // parent of the entry (may be zero for EventAttr and EventChange of hard links)
+	Name      string // name of the entry (empty for EventAttr and EventChange)
+	NewParent Ino    // new parent for EventRename
+	NewName   string // new name for EventRename
+	Time      int64  // unix nano
+}
+
+// Watcher receives the events of a subtree.
+type Watcher struct {
+	m       *baseMeta
+	root    Ino
+	ch      chan *Event
+	dropped uint64
+	once    sync.Once
+}
+
+// Events returns the channel of events, which is closed after the watcher is closed.
+func (w *Watcher) Events() <-chan *Event {
+	return w.ch
+}
+
+// Dropped returns the number of events dropped because the channel is full.
+func (w *Watcher) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+func (w *Watcher) Close() {
+	w.once.Do(func() {
+		m := w.m
+		m.watchMu.Lock()
+		delete(m.watchers, w)
+		atomic.StoreInt32(&m.watching, int32(len(m.watchers)))
+		close(w.ch)
+		m.watchMu.Unlock()
+	})
+}
+
+func (m *baseMeta) Watch(ctx Context, root Ino, size int) (*Watcher, syscall.Errno) {
+	root = m.checkRoot(root)
+	var attr Attr
+	if st := m.GetAttr(ctx, root, &attr); st != 0 {
+		return nil, st
+	}
+	if attr.Typ != TypeDirectory {
+		return nil, syscall.ENOTDIR
+	}
+	if size <= 0 {
+		size = 1024
+	}
+	w := &Watcher{m: m, root: root, ch: make(chan *Event, size)}
+	m.subscribe.Do(func() { go m.subscribeInvalidation() }) // changes of other clients
+	m.watchMu.Lock()
+	m.watchers[w] = struct{}{}
+	atomic.StoreInt32(&m.watching, int32(len(m.watchers)))
+	m.watchMu.Unlock()
+	return w, 0
+}
+
+func (m *baseMeta) hasWatchers() bool {
+	return atomic.LoadInt32(&m.watching) > 0
+}
+
+// ancestors adds the directories and all the ancestors of them into dirs.
+func (m *baseMeta) ancestors(dirs map[Ino]bool, inodes ...Ino) {
+	for _, inode := range inodes {
+		for i := 0; i < 1000 && inode > 0 && !dirs[inode]; i++ { // avoid loop of corrupted parents
+			dirs[inode] = true
+			if inode == RootInode {
+				break
+			}
+			var st syscall.Errno
+			if inode, st = m.getDirParent(Background, inode); st != 0 {
+				break
+			}
+		}
+	}
+}
+
+// watchedRoots checks whether any of the watchers is watching a subtree rather than the whole tree.
+func (m *baseMeta) watchedRoots() bool {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	for w := range m.watchers {
+		if w.root != RootInode {
+			return true
+		}
+	}
+	return false
+}
+
+// notify sends the event to the watchers of the subtrees containing it, without blocking.
+func (m *baseMeta) notify(typ EventType, inode, parent Ino, name string, newParent Ino, newName string) {
+	if !m.hasWatchers() {
+		return
+	}
+	dirs := make(map[Ino]bool)
+	if m.watchedRoots() { // resolve the ancestors without lock, which may need a few round trips
+		m.ancestors(dirs, parent)
+		if typ == EventRename {
+			m.ancestors(dirs, newParent)
+		}
+		if typ == EventAttr {
+			dirs[inode] = true
+		}
+	}
+	m.send(&Event{typ, inode, parent, name, newParent, newName, time.Now().UnixNano()}, dirs)
+}
+
+func (m *baseMeta) send(e *Event, dirs map[Ino]bool) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	for w := range m.watchers {
+		if w.root != RootInode && !dirs[w.root] {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+			atomic.AddUint64(&w.dropped, 1)
+		}
+	}
+}
+
+// notifyChanges sends the inodes changed by other clients to the watchers.
+func (m *baseMeta) notifyChanges(inodes []Ino) {
+	if !m.hasWatchers() {
+		return
+	}
+	partial := m.watchedRoots()
+	now := time.Now().UnixNano()
+	for _, inode := range inodes {
+		var attr Attr
+		dirs := make(map[Ino]bool)
+		if partial && m.en.doGetAttr(Background, inode, &attr) == 0 {
+			if attr.Typ == TypeDirectory {
+				m.ancestors(dirs, inode)
+			} else if attr.Parent > 0 {
+				m.ancestors(dirs, attr.Parent)
+			} else if parents := m.en.doGetParents(Background, inode); len(parents) > 0 {
+				for p := range parents {
+					m.ancestors(dirs, p)
+				}
+			}
+		}
+		m.send(&Event{Type: EventChange, Inode: inode, Parent: attr.Parent, Time: now}, dirs)
+	}
+}
+
+func (m *baseMeta) notifyAttr(ctx Context, inode Ino, attr *Attr) {
+	if !m.hasWatchers() {
+		return
+	}
+	if attr == nil {
+		attr = &Attr{}
+		if st := m.en.doGetAttr(ctx, inode, attr); st != 0 {
+			return
+		}
+	}
+	m.notify(EventAttr, inode, attr.Parent, "", 0, "")
+}
+
+// EventPaths returns the paths of the entry (and the new one for EventRename) of an event.
+func EventPaths(ctx Context, m Meta, e *Event) (p, np string) {
+	join := func(parent Ino, name string) string {
+		if parent == 0 {
+			return ""
+		}
+		ps := m.GetPaths(ctx, parent)
+		if len(ps) == 0 {
+			return ""
+		}
+		return path.Join(ps[0], name)
+	}
+	if e.Name == "" { // EventAttr or EventChange
+		ps := m.GetPaths(ctx, e.Inode)
+		if len(ps) > 0 {
+			p = ps[0]
+		}
+	} else {
+		p = join(e.Parent, e.Name)
+	}
+	if e.Type == EventRename {
+		np = join(e.NewParent, e.NewName)
+	}
+	return
+}
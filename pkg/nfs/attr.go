@@ -0,0 +1,359 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nfs
+
+import (
+	"math"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"golang.org/x/sys/unix"
+)
+
+// file types
+const (
+	nf4Reg  = 1
+	nf4Dir  = 2
+	nf4Blk  = 3
+	nf4Chr  = 4
+	nf4Lnk  = 5
+	nf4Sock = 6
+	nf4Fifo = 7
+)
+
+// attributes
+const (
+	attrSupportedAttrs  = 0
+	attrType            = 1
+	attrFhExpireType    = 2
+	attrChange          = 3
+	attrSize            = 4
+	attrLinkSupport     = 5
+	attrSymlinkSupport  = 6
+	attrNamedAttr       = 7
+	attrFsid            = 8
+	attrUniqueHandles   = 9
+	attrLeaseTime       = 10
+	attrRdattrError     = 11
+	attrCansettime      = 15
+	attrCaseInsensitive = 16
+	attrCasePreserving  = 17
+	attrChownRestricted = 18
+	attrFilehandle      = 19
+	attrFileid          = 20
+	attrFilesAvail      = 21
+	attrFilesFree       = 22
+	attrFilesTotal      = 23
+	attrHomogeneous     = 26
+	attrMaxfilesize     = 27
+	attrMaxlink         = 28
+	attrMaxname         = 29
+	attrMaxread         = 30
+	attrMaxwrite        = 31
+	attrMode            = 33
+	attrNoTrunc         = 34
+	attrNumlinks        = 35
+	attrOwner           = 36
+	attrOwnerGroup      = 37
+	attrRawdev          = 41
+	attrSpaceAvail      = 42
+	attrSpaceFree       = 43
+	attrSpaceTotal      = 44
+	attrSpaceUsed       = 45
+	attrTimeAccess      = 47
+	attrTimeAccessSet   = 48
+	attrTimeDelta       = 51
+	attrTimeMetadata    = 52
+	attrTimeModify      = 53
+	attrTimeModifySet   = 54
+	attrMountedOnFileid = 55
+
+	setToServerTime = 0
+	setToClientTime = 1
+)
+
+type bitmap []uint32
+
+func newBitmap(attrs ...int) bitmap {
+	var b bitmap
+	for _, a := range attrs {
+		b.set(a)
+	}
+	return b
+}
+
+func (b bitmap) has(n int) bool {
+	return n/32 < len(b) && b[n/32]&(1<<(n%32)) != 0
+}
+
+func (b *bitmap) set(n int) {
+	for len(*b) <= n/32 {
+		*b = append(*b, 0)
+	}
+	(*b)[n/32] |= 1 << (n % 32)
+}
+
+func readBitmap(r *xdrReader) bitmap {
+	n := r.uint32()
+	if n > 8 {
+		r.err = errBadXDR
+		return nil
+	}
+	b := make(bitmap, n)
+	for i := range b {
+		b[i] = r.uint32()
+	}
+	return b
+}
+
+func writeBitmap(w *xdrWriter, b bitmap) {
+	w.uint32(uint32(len(b)))
+	for _, v := range b {
+		w.uint32(v)
+	}
+}
+
+var supportedAttrs = newBitmap(attrSupportedAttrs, attrType, attrFhExpireType, attrChange, attrSize,
+	attrLinkSupport, attrSymlinkSupport, attrNamedAttr, attrFsid, attrUniqueHandles, attrLeaseTime,
+	attrRdattrError, attrCansettime, attrCaseInsensitive, attrCasePreserving, attrChownRestricted,
+	attrFilehandle, attrFileid, attrFilesAvail, attrFilesFree, attrFilesTotal, attrHomogeneous,
+	attrMaxfilesize, attrMaxlink, attrMaxname, attrMaxread, attrMaxwrite, attrMode, attrNoTrunc,
+	attrNumlinks, attrOwner, attrOwnerGroup, attrRawdev, attrSpaceAvail, attrSpaceFree, attrSpaceTotal,
+	attrSpaceUsed, attrTimeAccess, attrTimeAccessSet, attrTimeDelta, attrTimeMetadata, attrTimeModify,
+	attrTimeModifySet, attrMountedOnFileid)
+
+// writeOnlyAttrs can be set but not read.
+var writeOnlyAttrs = newBitmap(attrTimeAccessSet, attrTimeModifySet)
+
+func fileType(typ uint8) uint32 {
+	switch typ {
+	case meta.TypeDirectory:
+		return nf4Dir
+	case meta.TypeSymlink:
+		return nf4Lnk
+	case meta.TypeBlockDev:
+		return nf4Blk
+	case meta.TypeCharDev:
+		return nf4Chr
+	case meta.TypeSocket:
+		return nf4Sock
+	case meta.TypeFIFO:
+		return nf4Fifo
+	default:
+		return nf4Reg
+	}
+}
+
+func writeTime(w *xdrWriter, sec int64, nsec uint32) {
+	w.uint64(uint64(sec))
+	w.uint32(nsec)
+}
+
+// encodeAttrs writes fattr4 with the requested attributes of the file, the unsupported ones are
+// left out of the returned bitmap.
+func (c *compound) encodeAttrs(w *xdrWriter, req bitmap, ino meta.Ino, attr *meta.Attr) {
+	var mask bitmap
+	vals := &xdrWriter{}
+	var st *vfs.Statfs
+	statfs := func() *vfs.Statfs {
+		if st == nil {
+			st, _ = c.s.v.StatFS(c.ctx, meta.RootInode)
+		}
+		return st
+	}
+	for n := 0; n < len(req)*32; n++ {
+		if !req.has(n) || !supportedAttrs.has(n) || writeOnlyAttrs.has(n) {
+			continue
+		}
+		mask.set(n)
+		switch n {
+		case attrSupportedAttrs:
+			writeBitmap(vals, supportedAttrs)
+		case attrType:
+			vals.uint32(fileType(attr.Typ))
+		case attrFhExpireType:
+			vals.uint32(0) // FH4_PERSISTENT
+		case attrChange:
+			vals.uint64(changeOf(attr))
+		case attrSize:
+			vals.uint64(attr.Length)
+		case attrLinkSupport, attrSymlinkSupport, attrUniqueHandles, attrCansettime, attrCasePreserving,
+			attrChownRestricted, attrHomogeneous, attrNoTrunc:
+			vals.bool(true)
+		case attrNamedAttr:
+			vals.bool(false)
+		case attrCaseInsensitive:
+			vals.bool(c.s.v.Conf.CaseInsensitive)
+		case attrFsid:
+			vals.uint64(c.s.fsid)
+			vals.uint64(0)
+		case attrLeaseTime:
+			vals.uint32(leaseTime)
+		case attrRdattrError:
+			vals.uint32(nfs4OK)
+		case attrFilehandle:
+			vals.opaque(c.s.handle(ino))
+		case attrFileid, attrMountedOnFileid:
+			vals.uint64(uint64(ino))
+		case attrFilesAvail, attrFilesFree:
+			vals.uint64(statfs().Favail)
+		case attrFilesTotal:
+			vals.uint64(statfs().Files)
+		case attrMaxfilesize:
+			vals.uint64(meta.ChunkSize << 31)
+		case attrMaxlink:
+			vals.uint32(math.MaxInt32)
+		case attrMaxname:
+			vals.uint32(meta.MaxName)
+		case attrMaxread:
+			vals.uint64(maxRead)
+		case attrMaxwrite:
+			vals.uint64(maxWrite)
+		case attrMode:
+			vals.uint32(uint32(attr.Mode & 07777))
+		case attrNumlinks:
+			vals.uint32(attr.Nlink)
+		case attrOwner:
+			vals.string(strconv.FormatUint(uint64(attr.Uid), 10))
+		case attrOwnerGroup:
+			vals.string(strconv.FormatUint(uint64(attr.Gid), 10))
+		case attrRawdev:
+			vals.uint32(unix.Major(uint64(attr.Rdev)))
+			vals.uint32(unix.Minor(uint64(attr.Rdev)))
+		case attrSpaceAvail, attrSpaceFree:
+			vals.uint64(statfs().Avail)
+		case attrSpaceTotal:
+			vals.uint64(statfs().Total)
+		case attrSpaceUsed:
+			vals.uint64((attr.Length + 4095) / 4096 * 4096)
+		case attrTimeAccess:
+			writeTime(vals, attr.Atime, attr.Atimensec)
+		case attrTimeDelta:
+			writeTime(vals, 0, 1)
+		case attrTimeMetadata:
+			writeTime(vals, attr.Ctime, attr.Ctimensec)
+		case attrTimeModify:
+			writeTime(vals, attr.Mtime, attr.Mtimensec)
+		}
+	}
+	writeBitmap(w, mask)
+	w.opaque(vals.buf)
+}
+
+// setAttrs are the attributes to be set, with the flags of meta.SetAttr*.
+type setAttrs struct {
+	mask                 bitmap
+	set                  int
+	mode, uid, gid       uint32
+	size                 uint64
+	atime, mtime         int64
+	atimensec, mtimensec uint32
+}
+
+// parseOwner parses the owner in the form of "uid", "uid@domain" or "name@domain".
+func parseOwner(s string, group bool) (uint32, bool) {
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		s = s[:i]
+	}
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), true
+	}
+	var id string
+	if group {
+		g, err := user.LookupGroup(s)
+		if err != nil {
+			return 0, false
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(s)
+		if err != nil {
+			return 0, false
+		}
+		id = u.Uid
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err == nil
+}
+
+// decodeAttrs reads fattr4 of the attributes to be set.
+func decodeAttrs(r *xdrReader) (*setAttrs, uint32) {
+	a := &setAttrs{mask: readBitmap(r)}
+	vals := &xdrReader{buf: r.opaque(maxRecord)}
+	if r.err != nil {
+		return a, nfs4errBadXDR
+	}
+	readTime := func(sec *int64, nsec *uint32, flag, now int) uint32 {
+		if vals.uint32() == setToServerTime {
+			a.set |= now
+			return nfs4OK
+		}
+		*sec, *nsec = int64(vals.uint64()), vals.uint32()
+		if *nsec >= 1e9 {
+			return nfs4errInval
+		}
+		a.set |= flag
+		return nfs4OK
+	}
+	for n := 0; n < len(a.mask)*32; n++ {
+		if !a.mask.has(n) {
+			continue
+		}
+		st := uint32(nfs4OK)
+		switch n {
+		case attrSize:
+			a.size = vals.uint64()
+			a.set |= meta.SetAttrSize
+		case attrMode:
+			a.mode = vals.uint32() & 07777
+			a.set |= meta.SetAttrMode
+		case attrOwner, attrOwnerGroup:
+			id, ok := parseOwner(vals.string(maxComponent), n == attrOwnerGroup)
+			if !ok {
+				st = nfs4errBadOwner
+			} else if n == attrOwner {
+				a.uid = id
+				a.set |= meta.SetAttrUID
+			} else {
+				a.gid = id
+				a.set |= meta.SetAttrGID
+			}
+		case attrTimeAccessSet:
+			st = readTime(&a.atime, &a.atimensec, meta.SetAttrAtime, meta.SetAttrAtimeNow)
+		case attrTimeModifySet:
+			st = readTime(&a.mtime, &a.mtimensec, meta.SetAttrMtime, meta.SetAttrMtimeNow)
+		default:
+			if supportedAttrs.has(n) {
+				return a, nfs4errInval // read-only
+			}
+			return a, nfs4errAttrNotSupp
+		}
+		if vals.err != nil {
+			return a, nfs4errBadXDR
+		}
+		if st != nfs4OK {
+			return a, st
+		}
+	}
+	return a, nfs4OK
+}
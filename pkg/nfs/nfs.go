@@ -0,0 +1,331 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package nfs serves a volume by an NFSv4.0 server (RFC 7530), which is mounted by the NFS client of
+// the kernel on the machines without FUSE (e.g. macOS without macFUSE).
+package nfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+var logger = utils.GetLogger("juicefs")
+
+const (
+	leaseTime = 90 // seconds
+	fhSize    = 16
+)
+
+// Serve serves the volume on the listener until it's closed. The requests are done as the users in
+// their AUTH_SYS credentials, so only the connections from privileged ports of loopback addresses
+// are accepted.
+func Serve(v *vfs.VFS, l net.Listener) error {
+	s := newServer(v)
+	done := make(chan struct{})
+	defer close(done)
+	go s.expire(done)
+	logger.Infof("Serve NFS at %s", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if !trusted(conn.RemoteAddr()) {
+			logger.Warnf("Reject NFS connection from %s: not a privileged port of loopback address", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+type nfsClient struct {
+	id        []byte  // nfs_client_id4.id
+	verifier  [8]byte // changed when the client reboots
+	confirm   [8]byte
+	confirmed bool
+	renewed   time.Time
+}
+
+type openKey struct {
+	client uint64
+	owner  string
+	ino    meta.Ino
+}
+
+// openState is a file opened by an open owner, it keeps a handle of vfs until CLOSE or the lease of
+// client is expired.
+type openState struct {
+	openKey
+	other  [12]byte
+	seqid  uint32
+	access uint32
+	fh     uint64
+}
+
+type server struct {
+	v     *vfs.VFS
+	fsid  uint64
+	boot  uint32  // in the client ids and stateids, to tell the ones from previous instances
+	wverf [8]byte // write verifier, changed after restart since unstable writes could be lost
+
+	sync.Mutex
+	nextID  uint64
+	clients map[uint64]*nfsClient
+	opens   map[openKey]*openState
+	states  map[[12]byte]*openState
+}
+
+func newServer(v *vfs.VFS) *server {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(v.Conf.Format.UUID))
+	now := time.Now()
+	s := &server{
+		v:       v,
+		fsid:    h.Sum64(),
+		boot:    uint32(now.Unix()),
+		clients: make(map[uint64]*nfsClient),
+		opens:   make(map[openKey]*openState),
+		states:  make(map[[12]byte]*openState),
+	}
+	binary.BigEndian.PutUint64(s.wverf[:], uint64(now.UnixNano()))
+	return s
+}
+
+// handle returns the file handle of inode, which is valid as long as the file exists, because the
+// inodes are never reused.
+func (s *server) handle(ino meta.Ino) []byte {
+	b := make([]byte, fhSize)
+	binary.BigEndian.PutUint64(b, s.fsid)
+	binary.BigEndian.PutUint64(b[8:], uint64(ino))
+	return b
+}
+
+func (s *server) inodeOf(fh []byte) meta.Ino {
+	if len(fh) != fhSize || binary.BigEndian.Uint64(fh) != s.fsid {
+		return 0
+	}
+	return meta.Ino(binary.BigEndian.Uint64(fh[8:]))
+}
+
+func (s *server) newClientID() uint64 {
+	s.nextID++
+	return uint64(s.boot)<<32 | s.nextID&0xffffffff
+}
+
+// checkClient renews the lease of a confirmed client.
+func (s *server) checkClient(clientid uint64) uint32 {
+	s.Lock()
+	defer s.Unlock()
+	c := s.clients[clientid]
+	if c == nil || !c.confirmed {
+		if uint32(clientid>>32) != s.boot {
+			return nfs4errStaleClientID
+		}
+		return nfs4errExpired
+	}
+	c.renewed = time.Now()
+	return nfs4OK
+}
+
+var (
+	anonymousStateid = stateid{}
+	bypassStateid    = stateid{0xffffffff, [12]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}
+)
+
+type stateid struct {
+	seqid uint32
+	other [12]byte
+}
+
+func readStateid(r *xdrReader) stateid {
+	var sid stateid
+	sid.seqid = r.uint32()
+	copy(sid.other[:], r.fixed(12))
+	return sid
+}
+
+func writeStateid(w *xdrWriter, sid stateid) {
+	w.uint32(sid.seqid)
+	w.fixed(sid.other[:])
+}
+
+func (st *openState) stateid() stateid {
+	return stateid{st.seqid, st.other}
+}
+
+// findState returns the open state of stateid for inode, or nil for the special stateids, which are
+// served by opening the file for the request.
+func (s *server) findState(sid stateid, ino meta.Ino) (*openState, uint32) {
+	if sid == anonymousStateid || sid == bypassStateid {
+		return nil, nfs4OK
+	}
+	s.Lock()
+	defer s.Unlock()
+	st := s.states[sid.other]
+	switch {
+	case st == nil && binary.BigEndian.Uint32(sid.other[:]) != s.boot:
+		return nil, nfs4errStaleStateid
+	case st == nil || st.ino != ino || sid.seqid > st.seqid:
+		return nil, nfs4errBadStateid
+	case sid.seqid < st.seqid:
+		return nil, nfs4errOldStateid
+	}
+	if c := s.clients[st.client]; c != nil {
+		c.renewed = time.Now()
+	}
+	return st, nfs4OK
+}
+
+// addOpen registers the file opened by the owner, or merges it into the existing state of the owner.
+// It returns the state and the handles which should be released.
+func (s *server) addOpen(key openKey, access uint32, fh uint64) (*openState, uint64) {
+	s.Lock()
+	defer s.Unlock()
+	if st := s.opens[key]; st != nil {
+		st.seqid++
+		if st.access|access == st.access {
+			return st, fh
+		}
+		old := st.fh
+		st.access |= access
+		st.fh = fh
+		return st, old
+	}
+	st := &openState{openKey: key, seqid: 1, access: access, fh: fh}
+	s.nextID++
+	binary.BigEndian.PutUint32(st.other[:], s.boot)
+	binary.BigEndian.PutUint64(st.other[4:], s.nextID)
+	s.opens[key] = st
+	s.states[st.other] = st
+	return st, 0
+}
+
+func (s *server) removeOpen(st *openState) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.opens, st.openKey)
+	delete(s.states, st.other)
+}
+
+// writable returns a handle of the inode opened for writing by any owner.
+func (s *server) writable(ino meta.Ino) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	for _, st := range s.states {
+		if st.ino == ino && st.access&shareAccessWrite != 0 {
+			return st.fh
+		}
+	}
+	return 0
+}
+
+func (s *server) release(ctx vfs.LogContext, ino meta.Ino, fh uint64) syscall.Errno {
+	err := s.v.Flush(ctx, ino, fh, 0)
+	s.v.Release(ctx, ino, fh)
+	return err
+}
+
+// expire releases the files opened by the clients which have not renewed their leases for two
+// periods, since they are gone without closing them.
+func (s *server) expire(done chan struct{}) {
+	ticker := time.NewTicker(time.Second * leaseTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var expired []*openState
+		s.Lock()
+		for id, c := range s.clients {
+			if time.Since(c.renewed) > time.Second*leaseTime*2 {
+				logger.Infof("Lease of NFS client %q (%x) is expired", c.id, id)
+				delete(s.clients, id)
+			}
+		}
+		for _, st := range s.states {
+			if s.clients[st.client] == nil {
+				expired = append(expired, st)
+				delete(s.opens, st.openKey)
+				delete(s.states, st.other)
+			}
+		}
+		s.Unlock()
+		ctx := vfs.NewLogContext(meta.Background)
+		for _, st := range expired {
+			_ = s.release(ctx, st.ino, st.fh)
+		}
+	}
+}
+
+// setClientID records a client, which should be confirmed by SETCLIENTID_CONFIRM.
+func (s *server) setClientID(id []byte, verifier [8]byte) (uint64, [8]byte) {
+	s.Lock()
+	defer s.Unlock()
+	for clientid, c := range s.clients {
+		if bytes.Equal(c.id, id) && c.verifier == verifier && c.confirmed {
+			// update of callback, which is not used
+			c.renewed = time.Now()
+			return clientid, c.confirm
+		}
+	}
+	clientid := s.newClientID()
+	c := &nfsClient{id: id, verifier: verifier, renewed: time.Now()}
+	binary.BigEndian.PutUint64(c.confirm[:], uint64(time.Now().UnixNano()))
+	s.clients[clientid] = c
+	return clientid, c.confirm
+}
+
+// confirmClientID confirms a client, and drops the states of its previous instance.
+func (s *server) confirmClientID(clientid uint64, confirm [8]byte) (uint32, []*openState) {
+	s.Lock()
+	defer s.Unlock()
+	c := s.clients[clientid]
+	if c == nil || c.confirm != confirm {
+		return nfs4errStaleClientID, nil
+	}
+	c.confirmed = true
+	c.renewed = time.Now()
+	var dropped []*openState
+	for id, o := range s.clients {
+		if id != clientid && bytes.Equal(o.id, c.id) {
+			delete(s.clients, id)
+			for _, st := range s.states {
+				if st.client == id {
+					dropped = append(dropped, st)
+					delete(s.opens, st.openKey)
+					delete(s.states, st.other)
+				}
+			}
+		}
+	}
+	return nfs4OK, dropped
+}
@@ -0,0 +1,1187 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"golang.org/x/sys/unix"
+)
+
+// operations of NFSv4.0
+const (
+	opAccess            = 3
+	opClose             = 4
+	opCommit            = 5
+	opCreate            = 6
+	opDelegPurge        = 7
+	opDelegReturn       = 8
+	opGetattr           = 9
+	opGetFH             = 10
+	opLink              = 11
+	opLock              = 12
+	opLockT             = 13
+	opLockU             = 14
+	opLookup            = 15
+	opLookupP           = 16
+	opNVerify           = 17
+	opOpen              = 18
+	opOpenAttr          = 19
+	opOpenConfirm       = 20
+	opOpenDowngrade     = 21
+	opPutFH             = 22
+	opPutPubFH          = 23
+	opPutRootFH         = 24
+	opRead              = 25
+	opReaddir           = 26
+	opReadlink          = 27
+	opRemove            = 28
+	opRename            = 29
+	opRenew             = 30
+	opRestoreFH         = 31
+	opSaveFH            = 32
+	opSecInfo           = 33
+	opSetattr           = 34
+	opSetClientID       = 35
+	opSetClientIDConfim = 36
+	opVerify            = 37
+	opWrite             = 38
+	opReleaseLockOwner  = 39
+	opIllegal           = 10044
+)
+
+// status of NFSv4.0
+const (
+	nfs4OK                  = 0
+	nfs4errPerm             = 1
+	nfs4errNoent            = 2
+	nfs4errIO               = 5
+	nfs4errNXIO             = 6
+	nfs4errAccess           = 13
+	nfs4errExist            = 17
+	nfs4errXdev             = 18
+	nfs4errNotdir           = 20
+	nfs4errIsdir            = 21
+	nfs4errInval            = 22
+	nfs4errFbig             = 27
+	nfs4errNospc            = 28
+	nfs4errRofs             = 30
+	nfs4errMlink            = 31
+	nfs4errNameTooLong      = 63
+	nfs4errNotEmpty         = 66
+	nfs4errDquot            = 69
+	nfs4errStale            = 70
+	nfs4errBadHandle        = 10001
+	nfs4errBadCookie        = 10003
+	nfs4errNotSupp          = 10004
+	nfs4errTooSmall         = 10005
+	nfs4errServerFault      = 10006
+	nfs4errBadType          = 10007
+	nfs4errDelay            = 10008
+	nfs4errSame             = 10009
+	nfs4errExpired          = 10011
+	nfs4errResource         = 10018
+	nfs4errNoFileHandle     = 10020
+	nfs4errMinorVersMismach = 10021
+	nfs4errStaleClientID    = 10022
+	nfs4errStaleStateid     = 10023
+	nfs4errOldStateid       = 10024
+	nfs4errBadStateid       = 10025
+	nfs4errNotSame          = 10027
+	nfs4errSymlink          = 10029
+	nfs4errRestoreFH        = 10030
+	nfs4errAttrNotSupp      = 10032
+	nfs4errBadXDR           = 10036
+	nfs4errOpenMode         = 10038
+	nfs4errBadOwner         = 10039
+	nfs4errBadChar          = 10040
+	nfs4errBadName          = 10041
+	nfs4errOpIllegal        = 10044
+)
+
+const (
+	access4Read    = 0x01
+	access4Lookup  = 0x02
+	access4Modify  = 0x04
+	access4Extend  = 0x08
+	access4Delete  = 0x10
+	access4Execute = 0x20
+
+	shareAccessRead  = 1
+	shareAccessWrite = 2
+	shareAccessBoth  = 3
+
+	open4NoCreate           = 0
+	open4Create             = 1
+	createUnchecked         = 0
+	createGuarded           = 1
+	createExclusive         = 2
+	claimNull               = 0
+	claimPrevious           = 1
+	openResultLocktypePosix = 4
+	openDelegateNone        = 0
+
+	unstable4 = 0
+	fileSync4 = 2
+
+	maxOps       = 128
+	maxComponent = 1024
+	maxRead      = 1 << 20
+	maxWrite     = 1 << 20
+)
+
+var errStatus = map[syscall.Errno]uint32{
+	syscall.EPERM:        nfs4errPerm,
+	syscall.ENOENT:       nfs4errNoent,
+	syscall.EIO:          nfs4errIO,
+	syscall.ENXIO:        nfs4errNXIO,
+	syscall.EACCES:       nfs4errAccess,
+	syscall.EEXIST:       nfs4errExist,
+	syscall.EXDEV:        nfs4errXdev,
+	syscall.ENOTDIR:      nfs4errNotdir,
+	syscall.EISDIR:       nfs4errIsdir,
+	syscall.EINVAL:       nfs4errInval,
+	syscall.EFBIG:        nfs4errFbig,
+	syscall.ENOSPC:       nfs4errNospc,
+	syscall.EROFS:        nfs4errRofs,
+	syscall.EMLINK:       nfs4errMlink,
+	syscall.ENAMETOOLONG: nfs4errNameTooLong,
+	syscall.ENOTEMPTY:    nfs4errNotEmpty,
+	syscall.EDQUOT:       nfs4errDquot,
+	syscall.ENOTSUP:      nfs4errNotSupp,
+	syscall.EBADF:        nfs4errBadStateid,
+	syscall.EINTR:        nfs4errDelay,
+	syscall.EAGAIN:       nfs4errDelay,
+}
+
+func status(err syscall.Errno) uint32 {
+	if err == 0 {
+		return nfs4OK
+	}
+	if st, ok := errStatus[err]; ok {
+		return st
+	}
+	return nfs4errIO
+}
+
+func checkName(name []byte) uint32 {
+	switch {
+	case len(name) == 0:
+		return nfs4errInval
+	case len(name) > meta.MaxName:
+		return nfs4errNameTooLong
+	case string(name) == "." || string(name) == "..":
+		return nfs4errBadName
+	case bytes.IndexByte(name, '/') >= 0 || bytes.IndexByte(name, 0) >= 0:
+		return nfs4errBadChar
+	}
+	return nfs4OK
+}
+
+// compound is the state of a COMPOUND request: the current and saved file handles.
+type compound struct {
+	s          *server
+	ctx        vfs.LogContext
+	cur, saved meta.Ino
+}
+
+// newContext returns the context of the user in credential, the root is squashed as FUSE does.
+func (s *server) newContext(parent context.Context, cred *credential) vfs.LogContext {
+	uid, gids := cred.uid, append([]uint32{cred.gid}, cred.gids...)
+	if uid == 0 && s.v.Conf.RootSquash != nil {
+		uid, gids = s.v.Conf.RootSquash.Uid, []uint32{s.v.Conf.RootSquash.Gid}
+	}
+	return vfs.NewLogContext(meta.NewContextFrom(parent, 0, uid, gids))
+}
+
+// compound serves a COMPOUND request, it returns false if the arguments can't be decoded.
+func (s *server) compound(ctx context.Context, cred *credential, r *xdrReader, w *xdrWriter) bool {
+	tag := r.opaque(maxComponent)
+	minor := r.uint32()
+	n := r.uint32()
+	if r.err != nil {
+		return false
+	}
+	pos := len(w.buf)
+	w.uint32(nfs4OK)
+	w.opaque(tag)
+	cnt := len(w.buf)
+	w.uint32(0)
+	if minor != 0 {
+		binary.BigEndian.PutUint32(w.buf[pos:], nfs4errMinorVersMismach)
+		return true
+	}
+	if n > maxOps {
+		binary.BigEndian.PutUint32(w.buf[pos:], nfs4errResource)
+		return true
+	}
+	c := &compound{s: s, ctx: s.newContext(ctx, cred)}
+	var st uint32
+	for i := uint32(0); i < n; i++ {
+		op := r.uint32()
+		if r.err != nil {
+			return false
+		}
+		start := len(w.buf)
+		w.uint32(op)
+		w.uint32(nfs4OK)
+		st = c.exec(op, r, w)
+		if r.err != nil {
+			st = nfs4errBadXDR
+		}
+		if st == nfs4errOpIllegal {
+			binary.BigEndian.PutUint32(w.buf[start:], opIllegal)
+		}
+		if st != nfs4OK && op != opSetattr {
+			w.buf = w.buf[:start+8]
+		}
+		binary.BigEndian.PutUint32(w.buf[start+4:], st)
+		binary.BigEndian.PutUint32(w.buf[cnt:], i+1)
+		if st != nfs4OK {
+			break
+		}
+	}
+	binary.BigEndian.PutUint32(w.buf[pos:], st)
+	return true
+}
+
+func (c *compound) exec(op uint32, r *xdrReader, w *xdrWriter) uint32 {
+	switch op {
+	case opAccess:
+		return c.access(r, w)
+	case opClose:
+		return c.close(r, w)
+	case opCommit:
+		return c.commit(r, w)
+	case opCreate:
+		return c.create(r, w)
+	case opDelegPurge:
+		r.uint64()
+		return nfs4errNotSupp
+	case opDelegReturn:
+		readStateid(r)
+		return nfs4errBadStateid // never delegated
+	case opGetattr:
+		return c.getattr(r, w)
+	case opGetFH:
+		if c.cur == 0 {
+			return nfs4errNoFileHandle
+		}
+		w.opaque(c.s.handle(c.cur))
+		return nfs4OK
+	case opLink:
+		return c.link(r, w)
+	case opLock, opLockT, opLockU, opOpenAttr:
+		// byte-range locks are kept by the client (locallocks), named attributes are not supported
+		return nfs4errNotSupp
+	case opLookup:
+		return c.lookup(r)
+	case opLookupP:
+		return c.lookupp()
+	case opNVerify, opVerify:
+		return c.verify(r, op == opNVerify)
+	case opOpen:
+		return c.open(r, w)
+	case opOpenConfirm:
+		return c.openConfirm(r, w)
+	case opOpenDowngrade:
+		return c.openDowngrade(r, w)
+	case opPutFH:
+		return c.putfh(r)
+	case opPutPubFH, opPutRootFH:
+		c.cur = meta.RootInode
+		return nfs4OK
+	case opRead:
+		return c.read(r, w)
+	case opReaddir:
+		return c.readdir(r, w)
+	case opReadlink:
+		return c.readlink(w)
+	case opRemove:
+		return c.remove(r, w)
+	case opRename:
+		return c.rename(r, w)
+	case opRenew:
+		return c.s.checkClient(r.uint64())
+	case opRestoreFH:
+		if c.saved == 0 {
+			return nfs4errRestoreFH
+		}
+		c.cur = c.saved
+		return nfs4OK
+	case opSaveFH:
+		if c.cur == 0 {
+			return nfs4errNoFileHandle
+		}
+		c.saved = c.cur
+		return nfs4OK
+	case opSecInfo:
+		return c.secinfo(r, w)
+	case opSetattr:
+		return c.setattr(r, w)
+	case opSetClientID:
+		return c.setClientID(r, w)
+	case opSetClientIDConfim:
+		return c.confirmClientID(r)
+	case opWrite:
+		return c.write(r, w)
+	case opReleaseLockOwner:
+		r.uint64()
+		r.opaque(maxComponent)
+		return nfs4OK
+	default:
+		logger.Debugf("Unsupported NFS operation %d", op)
+		return nfs4errOpIllegal
+	}
+}
+
+// attr returns the attributes of inode, the missing files are reported as stale handles.
+func (c *compound) attr(ino meta.Ino) (*meta.Attr, uint32) {
+	entry, err := c.s.v.GetAttr(c.ctx, ino, 0)
+	if err == syscall.ENOENT {
+		return nil, nfs4errStale
+	}
+	if err != 0 {
+		return nil, status(err)
+	}
+	c.s.v.UpdateLength(ino, entry.Attr)
+	return entry.Attr, nfs4OK
+}
+
+func (c *compound) current() (meta.Ino, *meta.Attr, uint32) {
+	if c.cur == 0 {
+		return 0, nil, nfs4errNoFileHandle
+	}
+	attr, st := c.attr(c.cur)
+	return c.cur, attr, st
+}
+
+func (c *compound) currentDir() (meta.Ino, *meta.Attr, uint32) {
+	ino, attr, st := c.current()
+	if st == nfs4OK && attr.Typ != meta.TypeDirectory {
+		st = nfs4errNotdir
+	}
+	return ino, attr, st
+}
+
+func changeOf(attr *meta.Attr) uint64 {
+	return uint64(attr.Ctime)*1e9 + uint64(attr.Ctimensec)
+}
+
+// changeInfo writes change_info4 of the directory.
+func (c *compound) changeInfo(w *xdrWriter, dir meta.Ino, before *meta.Attr) {
+	w.bool(false)
+	w.uint64(changeOf(before))
+	if after, st := c.attr(dir); st == nfs4OK {
+		w.uint64(changeOf(after))
+	} else {
+		w.uint64(changeOf(before) + 1)
+	}
+}
+
+func (c *compound) access(r *xdrReader, w *xdrWriter) uint32 {
+	req := r.uint32()
+	ino, attr, st := c.current()
+	if st != nfs4OK {
+		return st
+	}
+	var supported, allowed uint32
+	if attr.Typ == meta.TypeDirectory {
+		supported = req & (access4Read | access4Lookup | access4Modify | access4Extend | access4Delete)
+	} else {
+		supported = req & (access4Read | access4Modify | access4Extend | access4Execute)
+	}
+	check := func(mask int, bits uint32) {
+		if bits != 0 && c.s.v.Access(c.ctx, ino, mask) == 0 {
+			allowed |= bits
+		}
+	}
+	check(unix.R_OK, supported&access4Read)
+	check(unix.W_OK, supported&(access4Modify|access4Extend|access4Delete))
+	check(unix.X_OK, supported&(access4Lookup|access4Execute))
+	w.uint32(supported)
+	w.uint32(allowed)
+	return nfs4OK
+}
+
+func (c *compound) getattr(r *xdrReader, w *xdrWriter) uint32 {
+	req := readBitmap(r)
+	ino, attr, st := c.current()
+	if st != nfs4OK {
+		return st
+	}
+	c.encodeAttrs(w, req, ino, attr)
+	return nfs4OK
+}
+
+func (c *compound) verify(r *xdrReader, negative bool) uint32 {
+	req := readBitmap(r)
+	vals := r.opaque(maxRecord)
+	ino, attr, st := c.current()
+	if st != nfs4OK || r.err != nil {
+		return st
+	}
+	if req.has(attrRdattrError) {
+		return nfs4errInval
+	}
+	for n := 0; n < len(req)*32; n++ {
+		if req.has(n) && (!supportedAttrs.has(n) || writeOnlyAttrs.has(n)) {
+			return nfs4errAttrNotSupp
+		}
+	}
+	ours := &xdrWriter{}
+	c.encodeAttrs(ours, req, ino, attr)
+	or := &xdrReader{buf: ours.buf}
+	readBitmap(or)
+	same := bytes.Equal(or.opaque(maxRecord), vals)
+	switch {
+	case negative && same:
+		return nfs4errSame
+	case !negative && !same:
+		return nfs4errNotSame
+	}
+	return nfs4OK
+}
+
+func (c *compound) putfh(r *xdrReader) uint32 {
+	ino := c.s.inodeOf(r.opaque(128))
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	if ino == 0 {
+		return nfs4errBadHandle
+	}
+	if vfs.IsSpecialNode(ino) {
+		return nfs4errStale // internal files can't be served by NFS
+	}
+	if _, st := c.attr(ino); st != nfs4OK {
+		return st
+	}
+	c.cur = ino
+	return nfs4OK
+}
+
+func (c *compound) lookup(r *xdrReader) uint32 {
+	name := r.opaque(maxComponent)
+	ino, attr, st := c.current()
+	if st != nfs4OK || r.err != nil {
+		return st
+	}
+	switch attr.Typ {
+	case meta.TypeDirectory:
+	case meta.TypeSymlink:
+		return nfs4errSymlink
+	default:
+		return nfs4errNotdir
+	}
+	if st = checkName(name); st != nfs4OK {
+		return st
+	}
+	entry, err := c.s.v.Lookup(c.ctx, ino, string(name))
+	if err != 0 {
+		return status(err)
+	}
+	if vfs.IsSpecialNode(entry.Inode) {
+		return nfs4errNoent // internal files can't be served by NFS
+	}
+	c.cur = entry.Inode
+	return nfs4OK
+}
+
+func (c *compound) lookupp() uint32 {
+	ino, _, st := c.currentDir()
+	if st != nfs4OK {
+		return st
+	}
+	if ino == meta.RootInode {
+		return nfs4errNoent
+	}
+	entry, err := c.s.v.Lookup(c.ctx, ino, "..")
+	if err != 0 {
+		return status(err)
+	}
+	c.cur = entry.Inode
+	return nfs4OK
+}
+
+func (c *compound) secinfo(r *xdrReader, w *xdrWriter) uint32 {
+	if st := c.lookup(r); st != nfs4OK {
+		return st
+	}
+	c.cur = 0 // consumed
+	w.uint32(1)
+	w.uint32(authSys)
+	return nfs4OK
+}
+
+func (c *compound) readlink(w *xdrWriter) uint32 {
+	ino, attr, st := c.current()
+	if st != nfs4OK {
+		return st
+	}
+	if attr.Typ != meta.TypeSymlink {
+		return nfs4errInval
+	}
+	path, err := c.s.v.Readlink(c.ctx, ino)
+	if err != 0 {
+		return status(err)
+	}
+	w.opaque(path)
+	return nfs4OK
+}
+
+func (c *compound) setattr(r *xdrReader, w *xdrWriter) uint32 {
+	sid := readStateid(r)
+	attrs, st := decodeAttrs(r)
+	ino, attr, cst := c.current()
+	if st == nfs4OK {
+		st = cst
+	}
+	if st == nfs4OK && attrs.set&meta.SetAttrSize != 0 && attr.Typ != meta.TypeFile {
+		st = nfs4errInval
+		if attr.Typ == meta.TypeDirectory {
+			st = nfs4errIsdir
+		}
+	}
+	var fh uint64
+	if st == nfs4OK && attrs.set&meta.SetAttrSize != 0 {
+		var open *openState
+		if open, st = c.s.findState(sid, ino); open != nil {
+			if open.access&shareAccessWrite == 0 {
+				st = nfs4errOpenMode
+			}
+			fh = open.fh
+		}
+	}
+	if st == nfs4OK {
+		st = c.apply(ino, attrs, fh)
+	}
+	if st == nfs4OK {
+		writeBitmap(w, attrs.mask)
+	} else {
+		writeBitmap(w, nil)
+	}
+	return st
+}
+
+// apply sets the attributes of inode.
+func (c *compound) apply(ino meta.Ino, a *setAttrs, fh uint64) uint32 {
+	if a.set == 0 {
+		return nfs4OK
+	}
+	_, err := c.s.v.SetAttr(c.ctx, ino, a.set, fh, a.mode, a.uid, a.gid, a.atime, a.mtime, a.atimensec, a.mtimensec, a.size)
+	return status(err)
+}
+
+func (c *compound) create(r *xdrReader, w *xdrWriter) uint32 {
+	typ := r.uint32()
+	var target []byte
+	var rdev uint32
+	var mode uint16
+	switch typ {
+	case nf4Lnk:
+		target = r.opaque(4096)
+	case nf4Blk, nf4Chr:
+		major, minor := r.uint32(), r.uint32()
+		rdev = uint32(unix.Mkdev(major, minor))
+		mode = syscall.S_IFBLK
+		if typ == nf4Chr {
+			mode = syscall.S_IFCHR
+		}
+	case nf4Sock:
+		mode = syscall.S_IFSOCK
+	case nf4Fifo:
+		mode = syscall.S_IFIFO
+	case nf4Dir:
+	default:
+		return nfs4errBadType
+	}
+	name := r.opaque(maxComponent)
+	attrs, st := decodeAttrs(r)
+	if r.err != nil || st != nfs4OK {
+		return st
+	}
+	dir, before, st := c.currentDir()
+	if st != nfs4OK {
+		return st
+	}
+	if st = checkName(name); st != nfs4OK {
+		return st
+	}
+	perm := uint16(0777)
+	if attrs.set&meta.SetAttrMode != 0 {
+		perm = uint16(attrs.mode)
+	}
+	var entry *meta.Entry
+	var err syscall.Errno
+	switch typ {
+	case nf4Dir:
+		entry, err = c.s.v.Mkdir(c.ctx, dir, string(name), perm, 0)
+	case nf4Lnk:
+		entry, err = c.s.v.Symlink(c.ctx, string(target), dir, string(name))
+	default:
+		entry, err = c.s.v.Mknod(c.ctx, dir, string(name), mode|perm, 0, rdev)
+	}
+	if err != 0 {
+		return status(err)
+	}
+	attrs.set &^= meta.SetAttrMode
+	if st = c.apply(entry.Inode, attrs, 0); st != nfs4OK {
+		return st
+	}
+	c.changeInfo(w, dir, before)
+	writeBitmap(w, attrs.mask)
+	c.cur = entry.Inode
+	return nfs4OK
+}
+
+func (c *compound) remove(r *xdrReader, w *xdrWriter) uint32 {
+	name := r.opaque(maxComponent)
+	dir, before, st := c.currentDir()
+	if st != nfs4OK || r.err != nil {
+		return st
+	}
+	if st = checkName(name); st != nfs4OK {
+		return st
+	}
+	entry, err := c.s.v.Lookup(c.ctx, dir, string(name))
+	if err == 0 && vfs.IsSpecialNode(entry.Inode) {
+		err = syscall.ENOENT
+	}
+	if err == 0 {
+		if entry.Attr.Typ == meta.TypeDirectory {
+			err = c.s.v.Rmdir(c.ctx, dir, string(name))
+		} else {
+			err = c.s.v.Unlink(c.ctx, dir, string(name))
+		}
+	}
+	if err != 0 {
+		return status(err)
+	}
+	c.changeInfo(w, dir, before)
+	return nfs4OK
+}
+
+func (c *compound) rename(r *xdrReader, w *xdrWriter) uint32 {
+	oldname, newname := r.opaque(maxComponent), r.opaque(maxComponent)
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	if c.saved == 0 {
+		return nfs4errNoFileHandle
+	}
+	dst, dstBefore, st := c.currentDir()
+	if st != nfs4OK {
+		return st
+	}
+	src := c.saved
+	srcBefore, st := c.attr(src)
+	if st != nfs4OK {
+		return st
+	}
+	if srcBefore.Typ != meta.TypeDirectory {
+		return nfs4errNotdir
+	}
+	if st = checkName(oldname); st == nfs4OK {
+		st = checkName(newname)
+	}
+	if st != nfs4OK {
+		return st
+	}
+	if err := c.s.v.Rename(c.ctx, src, string(oldname), dst, string(newname), 0); err != 0 {
+		return status(err)
+	}
+	c.changeInfo(w, src, srcBefore)
+	c.changeInfo(w, dst, dstBefore)
+	return nfs4OK
+}
+
+func (c *compound) link(r *xdrReader, w *xdrWriter) uint32 {
+	name := r.opaque(maxComponent)
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	if c.saved == 0 {
+		return nfs4errNoFileHandle
+	}
+	dir, before, st := c.currentDir()
+	if st != nfs4OK {
+		return st
+	}
+	if st = checkName(name); st != nfs4OK {
+		return st
+	}
+	if _, err := c.s.v.Link(c.ctx, c.saved, dir, string(name)); err != 0 {
+		return status(err)
+	}
+	c.changeInfo(w, dir, before)
+	return nfs4OK
+}
+
+func (c *compound) readdir(r *xdrReader, w *xdrWriter) uint32 {
+	cookie := r.uint64()
+	r.fixed(8) // cookieverf
+	r.uint32() // dircount
+	maxcount := r.uint32()
+	req := readBitmap(r)
+	ino, _, st := c.currentDir()
+	if st != nfs4OK || r.err != nil {
+		return st
+	}
+	if cookie == 1 || cookie == 2 {
+		return nfs4errBadCookie
+	}
+	if maxcount > maxRead {
+		maxcount = maxRead
+	}
+	// the cookie of an entry is its offset in directory + 3, since 1 and 2 are reserved
+	off := 0
+	if cookie > 2 {
+		off = int(cookie - 2)
+	}
+	fh, err := c.s.v.Opendir(c.ctx, ino, 0)
+	if err != 0 {
+		return status(err)
+	}
+	defer c.s.v.Releasedir(c.ctx, ino, fh)
+	entries, _, err := c.s.v.Readdir(c.ctx, ino, 0, off, fh, true)
+	if err != 0 {
+		return status(err)
+	}
+	list := &xdrWriter{}
+	eof := true
+	for i, e := range entries {
+		name := string(e.Name)
+		if name == "." || name == ".." || vfs.IsSpecialNode(e.Inode) {
+			continue
+		}
+		attr := e.Attr
+		if !attr.Full {
+			var st uint32
+			if attr, st = c.attr(e.Inode); st != nfs4OK {
+				continue // removed
+			}
+		} else {
+			c.s.v.UpdateLength(e.Inode, attr)
+		}
+		n := len(list.buf)
+		list.bool(true)
+		list.uint64(uint64(off+i) + 3)
+		list.opaque(e.Name)
+		c.encodeAttrs(list, req, e.Inode, attr)
+		if len(list.buf)+16 > int(maxcount) {
+			list.buf = list.buf[:n]
+			eof = false
+			break
+		}
+	}
+	if len(list.buf) == 0 && !eof {
+		return nfs4errTooSmall
+	}
+	w.fixed(make([]byte, 8)) // cookieverf
+	w.fixed(list.buf)
+	w.bool(false)
+	w.bool(eof)
+	return nfs4OK
+}
+
+func (c *compound) setClientID(r *xdrReader, w *xdrWriter) uint32 {
+	var verifier [8]byte
+	copy(verifier[:], r.fixed(8))
+	id := r.opaque(1024)
+	r.uint32()             // cb_program
+	r.string(maxComponent) // r_netid
+	r.string(maxComponent) // r_addr
+	r.uint32()             // callback_ident
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	clientid, confirm := c.s.setClientID(id, verifier)
+	w.uint64(clientid)
+	w.fixed(confirm[:])
+	return nfs4OK
+}
+
+func (c *compound) confirmClientID(r *xdrReader) uint32 {
+	clientid := r.uint64()
+	var confirm [8]byte
+	copy(confirm[:], r.fixed(8))
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	st, dropped := c.s.confirmClientID(clientid, confirm)
+	for _, o := range dropped {
+		_ = c.s.release(c.ctx, o.ino, o.fh)
+	}
+	return st
+}
+
+func openFlags(access uint32) uint32 {
+	switch access {
+	case shareAccessRead:
+		return syscall.O_RDONLY
+	case shareAccessWrite:
+		return syscall.O_WRONLY
+	default:
+		return syscall.O_RDWR
+	}
+}
+
+func (c *compound) open(r *xdrReader, w *xdrWriter) uint32 {
+	r.uint32() // seqid, the requests of an owner are not replayed
+	access := r.uint32()
+	r.uint32() // share_deny is not enforced
+	key := openKey{client: r.uint64(), owner: string(r.opaque(maxComponent))}
+	how, opentype := uint32(0), r.uint32()
+	attrs := &setAttrs{}
+	var verf []byte
+	var st uint32
+	if opentype == open4Create {
+		switch how = r.uint32(); how {
+		case createUnchecked, createGuarded:
+			if attrs, st = decodeAttrs(r); st != nfs4OK {
+				return st
+			}
+		case createExclusive:
+			verf = r.fixed(8)
+		default:
+			return nfs4errInval
+		}
+	}
+	var name []byte
+	claim := r.uint32()
+	switch claim {
+	case claimNull:
+		name = r.opaque(maxComponent)
+	case claimPrevious:
+		r.uint32() // delegate_type
+	default:
+		return nfs4errNotSupp
+	}
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	if st = c.s.checkClient(key.client); st != nfs4OK {
+		return st
+	}
+	if access == 0 || access > shareAccessBoth {
+		return nfs4errInval
+	}
+	dir, before, st := c.current()
+	if st != nfs4OK {
+		return st
+	}
+	flags := openFlags(access)
+	ino, typ := dir, before.Typ // the current file is the opened one for CLAIM_PREVIOUS
+	var entry *meta.Entry
+	var fh uint64
+	var err syscall.Errno
+	var attrset bitmap
+	if claim == claimNull {
+		if before.Typ != meta.TypeDirectory {
+			return nfs4errNotdir
+		}
+		if st = checkName(name); st != nfs4OK {
+			return st
+		}
+		entry, err = c.s.v.Lookup(c.ctx, dir, string(name))
+		if err == 0 && vfs.IsSpecialNode(entry.Inode) {
+			err = syscall.ENOENT
+		}
+		if opentype == open4Create && err == syscall.ENOENT {
+			if entry, fh, err = c.createFile(dir, string(name), flags, attrs, verf); err == 0 {
+				attrset = attrs.mask
+			} else if err == syscall.EEXIST {
+				entry, err = c.s.v.Lookup(c.ctx, dir, string(name))
+			}
+		}
+		if err != 0 {
+			return status(err)
+		}
+		ino, typ = entry.Inode, entry.Attr.Typ
+		if fh == 0 && opentype == open4Create {
+			switch how {
+			case createGuarded:
+				return nfs4errExist
+			case createExclusive:
+				if atime, mtime := verifierTimes(verf); entry.Attr.Atime != atime || entry.Attr.Mtime != mtime {
+					return nfs4errExist
+				}
+				attrset = newBitmap(attrTimeAccess, attrTimeModify) // retransmission
+			}
+		}
+	}
+	if fh == 0 {
+		switch typ {
+		case meta.TypeFile:
+		case meta.TypeDirectory:
+			return nfs4errIsdir
+		case meta.TypeSymlink:
+			return nfs4errSymlink
+		default:
+			return nfs4errInval
+		}
+		if entry, fh, err = c.s.v.Open(c.ctx, ino, flags); err != 0 {
+			return status(err)
+		}
+		if how == createUnchecked && attrs.set&meta.SetAttrSize != 0 {
+			// only the size is set for the existing file
+			trunc := &setAttrs{mask: newBitmap(attrSize), set: meta.SetAttrSize, size: attrs.size}
+			if st = c.apply(ino, trunc, fh); st != nfs4OK {
+				_ = c.s.release(c.ctx, ino, fh)
+				return st
+			}
+			attrset = trunc.mask
+		}
+	}
+	key.ino = entry.Inode
+	o, old := c.s.addOpen(key, access, fh)
+	if old != 0 {
+		_ = c.s.release(c.ctx, key.ino, old)
+	}
+	writeStateid(w, o.stateid())
+	c.changeInfo(w, dir, before)
+	w.uint32(openResultLocktypePosix)
+	writeBitmap(w, attrset)
+	w.uint32(openDelegateNone)
+	c.cur = entry.Inode
+	return nfs4OK
+}
+
+func verifierTimes(verf []byte) (int64, int64) {
+	return int64(binary.BigEndian.Uint32(verf)), int64(binary.BigEndian.Uint32(verf[4:]))
+}
+
+// createFile creates the file for OPEN, the verifier of exclusive creation is kept as atime and mtime,
+// which are set by the client later.
+func (c *compound) createFile(dir meta.Ino, name string, flags uint32, attrs *setAttrs, verf []byte) (*meta.Entry, uint64, syscall.Errno) {
+	perm := uint16(0666)
+	if attrs.set&meta.SetAttrMode != 0 {
+		perm = uint16(attrs.mode)
+	}
+	entry, fh, err := c.s.v.Create(c.ctx, dir, name, perm, 0, flags|syscall.O_EXCL)
+	if err != 0 {
+		return nil, 0, err
+	}
+	if verf != nil {
+		atime, mtime := verifierTimes(verf)
+		*attrs = setAttrs{mask: newBitmap(attrTimeAccess, attrTimeModify), set: meta.SetAttrAtime | meta.SetAttrMtime, atime: atime, mtime: mtime}
+	}
+	rest := *attrs
+	rest.set &^= meta.SetAttrMode | meta.SetAttrSize
+	if rest.set != 0 {
+		if _, err = c.s.v.SetAttr(c.ctx, entry.Inode, rest.set, fh, rest.mode, rest.uid, rest.gid, rest.atime, rest.mtime, rest.atimensec, rest.mtimensec, rest.size); err != 0 {
+			_ = c.s.release(c.ctx, entry.Inode, fh)
+			return nil, 0, err
+		}
+	}
+	return entry, fh, 0
+}
+
+func (c *compound) openConfirm(r *xdrReader, w *xdrWriter) uint32 {
+	sid := readStateid(r)
+	r.uint32() // seqid
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	if c.cur == 0 {
+		return nfs4errNoFileHandle
+	}
+	o, st := c.s.findState(sid, c.cur)
+	if o == nil && st == nfs4OK {
+		st = nfs4errBadStateid
+	}
+	if st != nfs4OK {
+		return st
+	}
+	writeStateid(w, o.stateid())
+	return nfs4OK
+}
+
+func (c *compound) openDowngrade(r *xdrReader, w *xdrWriter) uint32 {
+	sid := readStateid(r)
+	r.uint32() // seqid
+	access := r.uint32()
+	r.uint32() // share_deny
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	if c.cur == 0 {
+		return nfs4errNoFileHandle
+	}
+	o, st := c.s.findState(sid, c.cur)
+	if o == nil && st == nfs4OK {
+		st = nfs4errBadStateid
+	}
+	if st != nfs4OK {
+		return st
+	}
+	c.s.Lock()
+	if access == 0 || access|o.access != o.access {
+		c.s.Unlock()
+		return nfs4errInval
+	}
+	// the handle of vfs is kept, which allows more than the access
+	o.access = access
+	o.seqid++
+	sid = o.stateid()
+	c.s.Unlock()
+	writeStateid(w, sid)
+	return nfs4OK
+}
+
+func (c *compound) close(r *xdrReader, w *xdrWriter) uint32 {
+	r.uint32() // seqid
+	sid := readStateid(r)
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	if c.cur == 0 {
+		return nfs4errNoFileHandle
+	}
+	o, st := c.s.findState(sid, c.cur)
+	if o == nil && st == nfs4OK {
+		st = nfs4errBadStateid
+	}
+	if st != nfs4OK {
+		return st
+	}
+	c.s.removeOpen(o)
+	if err := c.s.release(c.ctx, o.ino, o.fh); err != 0 {
+		return status(err)
+	}
+	sid.seqid++
+	writeStateid(w, sid)
+	return nfs4OK
+}
+
+// handleOf returns the handle of vfs to read or write the current file with the stateid, the handle
+// opened for special stateids should be released by the returned function.
+func (c *compound) handleOf(sid stateid, access uint32) (meta.Ino, uint64, func(), uint32) {
+	ino, attr, st := c.current()
+	if st != nfs4OK {
+		return 0, 0, nil, st
+	}
+	switch attr.Typ {
+	case meta.TypeFile:
+	case meta.TypeDirectory:
+		return 0, 0, nil, nfs4errIsdir
+	default:
+		return 0, 0, nil, nfs4errInval
+	}
+	o, st := c.s.findState(sid, ino)
+	if st != nfs4OK {
+		return 0, 0, nil, st
+	}
+	if o != nil {
+		if access == shareAccessWrite && o.access&shareAccessWrite == 0 {
+			return 0, 0, nil, nfs4errOpenMode
+		}
+		return ino, o.fh, func() {}, nfs4OK
+	}
+	_, fh, err := c.s.v.Open(c.ctx, ino, openFlags(access))
+	if err != 0 {
+		return 0, 0, nil, status(err)
+	}
+	return ino, fh, func() { _ = c.s.release(c.ctx, ino, fh) }, nfs4OK
+}
+
+func (c *compound) read(r *xdrReader, w *xdrWriter) uint32 {
+	sid := readStateid(r)
+	off, count := r.uint64(), r.uint32()
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	ino, fh, done, st := c.handleOf(sid, shareAccessRead)
+	if st != nfs4OK {
+		return st
+	}
+	defer done()
+	if count > maxRead {
+		count = maxRead
+	}
+	buf := make([]byte, count)
+	n, err := c.s.v.Read(c.ctx, ino, buf, off, fh)
+	if err != 0 {
+		return status(err)
+	}
+	eof := n < len(buf)
+	if count == 0 {
+		if attr, st := c.attr(ino); st == nfs4OK {
+			eof = off >= attr.Length
+		}
+	}
+	w.bool(eof)
+	w.opaque(buf[:n])
+	return nfs4OK
+}
+
+func (c *compound) write(r *xdrReader, w *xdrWriter) uint32 {
+	sid := readStateid(r)
+	off, stable := r.uint64(), r.uint32()
+	data := r.opaque(maxWrite)
+	if r.err != nil {
+		return nfs4errBadXDR
+	}
+	ino, fh, done, st := c.handleOf(sid, shareAccessWrite)
+	if st != nfs4OK {
+		return st
+	}
+	defer done()
+	if err := c.s.v.Write(c.ctx, ino, data, off, fh); err != 0 {
+		return status(err)
+	}
+	committed := uint32(unstable4)
+	if stable != unstable4 {
+		if err := c.s.v.Fsync(c.ctx, ino, 0, fh); err != 0 {
+			return status(err)
+		}
+		committed = fileSync4
+	}
+	w.uint32(uint32(len(data)))
+	w.uint32(committed)
+	w.fixed(c.s.wverf[:])
+	return nfs4OK
+}
+
+func (c *compound) commit(r *xdrReader, w *xdrWriter) uint32 {
+	r.uint64() // offset
+	r.uint32() // count
+	ino, attr, st := c.current()
+	if st != nfs4OK || r.err != nil {
+		return st
+	}
+	if attr.Typ != meta.TypeFile {
+		return nfs4errInval
+	}
+	// the data written by closed files are flushed in CLOSE
+	if fh := c.s.writable(ino); fh != 0 {
+		if err := c.s.v.Fsync(c.ctx, ino, 0, fh); err != 0 {
+			return status(err)
+		}
+	}
+	w.fixed(c.s.wverf[:])
+	return nfs4OK
+}
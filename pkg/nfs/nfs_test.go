@@ -0,0 +1,545 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func createTestVFS(t *testing.T) *vfs.VFS {
+	metaConf := meta.DefaultConf()
+	metaConf.MountPoint = "/jfs"
+	m := meta.NewClient("memkv://", metaConf)
+	format := &meta.Format{Name: "test", UUID: uuid.New().String(), Storage: "mem", BlockSize: 4096}
+	if err := m.Init(format, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	conf := &vfs.Config{
+		Meta:   metaConf,
+		Format: *format,
+		Chunk:  &chunk.Config{BlockSize: format.BlockSize << 10, MaxUpload: 1, BufferSize: 100 << 20, CacheDir: "memory"},
+	}
+	blob, _ := object.CreateStorage("mem", "", "", "", "")
+	registry := prometheus.NewRegistry()
+	store := chunk.NewCachedStore(blob, *conf.Chunk, registry)
+	return vfs.NewVFS(conf, m, store, registry, registry)
+}
+
+// testClient sends the requests of a user to the server as the NFS client of kernel does.
+type testClient struct {
+	t        *testing.T
+	s        *server
+	uid, gid uint32
+	xid      uint32
+	clientid uint64
+}
+
+// ops are the operations of a COMPOUND request.
+type ops struct {
+	xdrWriter
+	n uint32
+}
+
+func (o *ops) op(code uint32) *ops {
+	o.n++
+	o.uint32(code)
+	return o
+}
+
+func (c *testClient) call(proc, flavor uint32, args []byte) *xdrReader {
+	c.xid++
+	w := &xdrWriter{}
+	w.uint32(c.xid)
+	w.uint32(rpcCall)
+	w.uint32(rpcVersion)
+	w.uint32(nfsProgram)
+	w.uint32(nfsVersion)
+	w.uint32(proc)
+	cred := &xdrWriter{}
+	cred.uint32(0)
+	cred.string("localhost")
+	cred.uint32(c.uid)
+	cred.uint32(c.gid)
+	cred.uint32(0)
+	w.uint32(flavor)
+	w.opaque(cred.buf)
+	w.uint32(authNone)
+	w.opaque(nil)
+	w.fixed(args)
+	return &xdrReader{buf: c.s.handleCall(context.Background(), w.buf)}
+}
+
+// run sends the operations in a COMPOUND request, it returns the status and the results.
+func (c *testClient) run(o *ops) (uint32, *xdrReader) {
+	args := &xdrWriter{}
+	args.opaque(nil)
+	args.uint32(0)
+	args.uint32(o.n)
+	args.fixed(o.buf)
+	r := c.call(procCompound, authSys, args.buf)
+	if r.uint32() != c.xid || r.uint32() != rpcReply || r.uint32() != msgAccepted {
+		c.t.Fatalf("bad reply of COMPOUND")
+	}
+	r.uint32()
+	r.opaque(400)
+	if st := r.uint32(); st != acceptSuccess {
+		c.t.Fatalf("COMPOUND is not accepted: %d", st)
+	}
+	st := r.uint32()
+	r.opaque(maxComponent)
+	r.uint32()
+	return st, r
+}
+
+// result returns the status of the next operation in results.
+func (c *testClient) result(r *xdrReader, op uint32) uint32 {
+	if got := r.uint32(); got != op {
+		c.t.Fatalf("expect result of op %d, but got %d", op, got)
+	}
+	return r.uint32()
+}
+
+func (c *testClient) setClientID() {
+	o := &ops{}
+	o.op(opSetClientID)
+	o.fixed([]byte("verifier"))
+	o.opaque([]byte("test client"))
+	o.uint32(0)
+	o.string("tcp")
+	o.string("127.0.0.1.0.0")
+	o.uint32(0)
+	st, r := c.run(o)
+	if st != nfs4OK || c.result(r, opSetClientID) != nfs4OK {
+		c.t.Fatalf("setclientid: %d", st)
+	}
+	c.clientid = r.uint64()
+	confirm := r.fixed(8)
+	o = &ops{}
+	o.op(opSetClientIDConfim)
+	o.uint64(c.clientid)
+	o.fixed(confirm)
+	if st, _ := c.run(o); st != nfs4OK {
+		c.t.Fatalf("setclientid_confirm: %d", st)
+	}
+}
+
+func putfh(o *ops, fh []byte) *ops {
+	if fh == nil {
+		return o.op(opPutRootFH)
+	}
+	o.op(opPutFH)
+	o.opaque(fh)
+	return o
+}
+
+// open opens (or creates with mode) the file in the directory, it returns the handle and stateid.
+func (c *testClient) open(dir []byte, name string, access uint32, create bool, mode uint32) ([]byte, stateid, uint32) {
+	o := putfh(&ops{}, dir)
+	o.op(opOpen)
+	o.uint32(0)
+	o.uint32(access)
+	o.uint32(0)
+	o.uint64(c.clientid)
+	o.string("owner")
+	if create {
+		o.uint32(open4Create)
+		o.uint32(createUnchecked)
+		writeBitmap(&o.xdrWriter, newBitmap(attrMode))
+		vals := &xdrWriter{}
+		vals.uint32(mode)
+		o.opaque(vals.buf)
+	} else {
+		o.uint32(open4NoCreate)
+	}
+	o.uint32(claimNull)
+	o.string(name)
+	o.op(opGetFH)
+	st, r := c.run(o)
+	if st != nfs4OK {
+		return nil, stateid{}, st
+	}
+	c.result(r, o.firstOp())
+	c.result(r, opOpen)
+	sid := readStateid(r)
+	r.fixed(20) // cinfo
+	r.uint32()  // rflags
+	readBitmap(r)
+	r.uint32() // delegation
+	c.result(r, opGetFH)
+	return r.opaque(fhSize), sid, nfs4OK
+}
+
+func (o *ops) firstOp() uint32 {
+	return binary.BigEndian.Uint32(o.buf)
+}
+
+func (c *testClient) write(fh []byte, sid stateid, off uint64, data []byte) uint32 {
+	o := putfh(&ops{}, fh)
+	o.op(opWrite)
+	writeStateid(&o.xdrWriter, sid)
+	o.uint64(off)
+	o.uint32(unstable4)
+	o.opaque(data)
+	st, _ := c.run(o)
+	return st
+}
+
+func (c *testClient) read(fh []byte, sid stateid, off uint64, count uint32) ([]byte, bool, uint32) {
+	o := putfh(&ops{}, fh)
+	o.op(opRead)
+	writeStateid(&o.xdrWriter, sid)
+	o.uint64(off)
+	o.uint32(count)
+	st, r := c.run(o)
+	if st != nfs4OK {
+		return nil, false, st
+	}
+	c.result(r, opPutFH)
+	c.result(r, opRead)
+	eof := r.bool()
+	return r.opaque(maxRead), eof, nfs4OK
+}
+
+func (c *testClient) close(fh []byte, sid stateid) uint32 {
+	o := putfh(&ops{}, fh)
+	o.op(opClose)
+	o.uint32(0)
+	writeStateid(&o.xdrWriter, sid)
+	st, _ := c.run(o)
+	return st
+}
+
+// getattr returns the raw values of attributes.
+func (c *testClient) getattr(fh []byte, attrs ...int) (*xdrReader, uint32) {
+	o := putfh(&ops{}, fh)
+	o.op(opGetattr)
+	writeBitmap(&o.xdrWriter, newBitmap(attrs...))
+	st, r := c.run(o)
+	if st != nfs4OK {
+		return nil, st
+	}
+	c.result(r, o.firstOp())
+	c.result(r, opGetattr)
+	readBitmap(r)
+	return &xdrReader{buf: r.opaque(maxRecord)}, nfs4OK
+}
+
+func (c *testClient) lookup(dir []byte, name string) ([]byte, uint32) {
+	o := putfh(&ops{}, dir)
+	o.op(opLookup)
+	o.string(name)
+	o.op(opGetFH)
+	st, r := c.run(o)
+	if st != nfs4OK {
+		return nil, st
+	}
+	c.result(r, o.firstOp())
+	c.result(r, opLookup)
+	c.result(r, opGetFH)
+	return r.opaque(fhSize), nfs4OK
+}
+
+func (c *testClient) mkdir(dir []byte, name string, mode uint32) uint32 {
+	o := putfh(&ops{}, dir)
+	o.op(opCreate)
+	o.uint32(nf4Dir)
+	o.string(name)
+	writeBitmap(&o.xdrWriter, newBitmap(attrMode))
+	vals := &xdrWriter{}
+	vals.uint32(mode)
+	o.opaque(vals.buf)
+	st, _ := c.run(o)
+	return st
+}
+
+func (c *testClient) readdir(dir []byte) []string {
+	var names []string
+	var cookie uint64
+	for {
+		o := putfh(&ops{}, dir)
+		o.op(opReaddir)
+		o.uint64(cookie)
+		o.fixed(make([]byte, 8))
+		o.uint32(4096)
+		o.uint32(256) // a few entries in a reply
+		writeBitmap(&o.xdrWriter, newBitmap(attrType, attrFileid))
+		st, r := c.run(o)
+		if st != nfs4OK {
+			c.t.Fatalf("readdir: %d", st)
+		}
+		c.result(r, o.firstOp())
+		c.result(r, opReaddir)
+		r.fixed(8)
+		for r.bool() {
+			cookie = r.uint64()
+			names = append(names, r.string(maxComponent))
+			readBitmap(r)
+			r.opaque(maxRecord)
+		}
+		if r.bool() {
+			return names
+		}
+	}
+}
+
+func newTestClient(t *testing.T, s *server, uid, gid uint32) *testClient {
+	c := &testClient{t: t, s: s, uid: uid, gid: gid}
+	c.setClientID()
+	return c
+}
+
+func TestNFS(t *testing.T) {
+	s := newServer(createTestVFS(t))
+	root := newTestClient(t, s, 0, 0)
+	if st := root.mkdir(nil, "d", 0777); st != nfs4OK {
+		t.Fatalf("mkdir: %d", st)
+	}
+	d, st := root.lookup(nil, "d")
+	if st != nfs4OK {
+		t.Fatalf("lookup d: %d", st)
+	}
+
+	c := newTestClient(t, s, 1000, 1000)
+	fh, sid, st := c.open(d, "f", shareAccessWrite, true, 0640)
+	if st != nfs4OK {
+		t.Fatalf("create f: %d", st)
+	}
+	if st = c.write(fh, sid, 0, []byte("hello")); st != nfs4OK {
+		t.Fatalf("write: %d", st)
+	}
+	o := putfh(&ops{}, fh)
+	o.op(opCommit)
+	o.uint64(0)
+	o.uint32(0)
+	if st, _ = c.run(o); st != nfs4OK {
+		t.Fatalf("commit: %d", st)
+	}
+	if st = c.close(fh, sid); st != nfs4OK {
+		t.Fatalf("close: %d", st)
+	}
+	if st = c.close(fh, sid); st != nfs4errBadStateid {
+		t.Fatalf("close twice: %d", st)
+	}
+
+	fh, sid, st = c.open(d, "f", shareAccessRead, false, 0)
+	if st != nfs4OK {
+		t.Fatalf("open f: %d", st)
+	}
+	if data, eof, st := c.read(fh, sid, 0, 100); st != nfs4OK || string(data) != "hello" || !eof {
+		t.Fatalf("read: %q %v %d", data, eof, st)
+	}
+	if st = c.write(fh, sid, 0, []byte("x")); st != nfs4errOpenMode {
+		t.Fatalf("write into file opened for reading: %d", st)
+	}
+	_ = c.close(fh, sid)
+	// READ with the anonymous stateid
+	if data, _, st := c.read(fh, stateid{}, 1, 100); st != nfs4OK || string(data) != "ello" {
+		t.Fatalf("read with anonymous stateid: %q %d", data, st)
+	}
+
+	vals, st := c.getattr(fh, attrType, attrSize, attrMode, attrOwner, attrOwnerGroup)
+	if st != nfs4OK {
+		t.Fatalf("getattr: %d", st)
+	}
+	if typ, size, mode, owner, group := vals.uint32(), vals.uint64(), vals.uint32(), vals.string(100), vals.string(100); typ != nf4Reg ||
+		size != 5 || mode != 0640 || owner != "1000" || group != "1000" {
+		t.Fatalf("attributes: type %d size %d mode %o owner %s group %s", typ, size, mode, owner, group)
+	}
+
+	for i := 0; i < 20; i++ {
+		if st = root.mkdir(d, "sub"+string(rune('a'+i)), 0755); st != nfs4OK {
+			t.Fatalf("mkdir: %d", st)
+		}
+	}
+	if names := c.readdir(d); len(names) != 21 || names[0] != "f" {
+		t.Fatalf("readdir: %v", names)
+	}
+	for _, name := range c.readdir(nil) {
+		if name != "d" {
+			t.Fatalf("internal file %s should not be listed", name)
+		}
+	}
+	if _, st = c.lookup(nil, ".stats"); st != nfs4errNoent {
+		t.Fatalf("lookup internal file: %d", st)
+	}
+
+	o = putfh(&ops{}, d)
+	o.op(opSaveFH)
+	o.op(opRename)
+	o.string("f")
+	o.string("g")
+	if st, _ = c.run(o); st != nfs4OK {
+		t.Fatalf("rename: %d", st)
+	}
+	if _, st = c.lookup(d, "f"); st != nfs4errNoent {
+		t.Fatalf("lookup f after rename: %d", st)
+	}
+	o = putfh(&ops{}, d)
+	o.op(opRemove)
+	o.string("g")
+	if st, _ = c.run(o); st != nfs4OK {
+		t.Fatalf("remove: %d", st)
+	}
+	// the handle of removed file is stale
+	if _, st = c.getattr(fh, attrSize); st != nfs4errStale {
+		t.Fatalf("getattr of removed file: %d", st)
+	}
+}
+
+func TestAuthSys(t *testing.T) {
+	v := createTestVFS(t)
+	s := newServer(v)
+	root := newTestClient(t, s, 0, 0)
+	if st := root.mkdir(nil, "private", 0700); st != nfs4OK {
+		t.Fatalf("mkdir: %d", st)
+	}
+	private, _ := root.lookup(nil, "private")
+	if _, _, st := root.open(private, "f", shareAccessBoth, true, 0644); st != nfs4OK {
+		t.Fatalf("create by root: %d", st)
+	}
+
+	c := newTestClient(t, s, 1000, 1000)
+	if _, _, st := c.open(private, "g", shareAccessBoth, true, 0644); st != nfs4errAccess {
+		t.Fatalf("create in private directory of root: %d", st)
+	}
+	if _, st := c.lookup(private, "f"); st != nfs4errAccess {
+		t.Fatalf("lookup in private directory of root: %d", st)
+	}
+
+	v.Conf.RootSquash = &vfs.RootSquash{Uid: 65534, Gid: 65534}
+	if _, _, st := root.open(private, "g", shareAccessBoth, true, 0644); st != nfs4errAccess {
+		t.Fatalf("create by squashed root: %d", st)
+	}
+	fh, _, st := root.open(nil, "squashed", shareAccessBoth, true, 0644)
+	if st != nfs4OK {
+		t.Fatalf("create by squashed root: %d", st)
+	}
+	vals, _ := root.getattr(fh, attrOwner)
+	if owner := vals.string(100); owner != "65534" {
+		t.Fatalf("owner of file created by squashed root: %s", owner)
+	}
+
+	// only AUTH_SYS is accepted
+	args := &xdrWriter{}
+	args.opaque(nil)
+	args.uint32(0)
+	args.uint32(0)
+	r := c.call(procCompound, authNone, args.buf)
+	r.uint32() // xid
+	if r.uint32() != rpcReply || r.uint32() != msgDenied || r.uint32() != rejectAuthError || r.uint32() != authTooWeak {
+		t.Fatalf("COMPOUND with AUTH_NONE should be rejected")
+	}
+	r = c.call(procNull, authNone, nil)
+	r.uint32() // xid
+	if r.uint32() != rpcReply || r.uint32() != msgAccepted {
+		t.Fatalf("NULL with AUTH_NONE should be accepted")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	v := createTestVFS(t)
+	c := newTestClient(t, newServer(v), 0, 0)
+	fh, sid, st := c.open(nil, "f", shareAccessWrite, true, 0644)
+	if st != nfs4OK {
+		t.Fatalf("create: %d", st)
+	}
+	_ = c.close(fh, sid)
+	vals, _ := c.getattr(fh, attrFileid)
+	ino := vals.uint64()
+
+	// the handles are valid after restart
+	c2 := newTestClient(t, newServer(v), 0, 0)
+	if vals, st = c2.getattr(fh, attrFileid); st != nfs4OK || vals.uint64() != ino {
+		t.Fatalf("handle after restart: %d", st)
+	}
+	if _, st = c2.getattr([]byte("bad handle")); st != nfs4errBadHandle {
+		t.Fatalf("bad handle: %d", st)
+	}
+	other := newServer(createTestVFS(t)).handle(meta.RootInode)
+	if _, st = c2.getattr(other); st != nfs4errBadHandle {
+		t.Fatalf("handle of other volume: %d", st)
+	}
+	if _, st = c2.getattr(c2.s.handle(1 << 40)); st != nfs4errStale {
+		t.Fatalf("handle of missing file: %d", st)
+	}
+	if _, st = c2.getattr(c2.s.handle(0x7FFFFFFF00000003)); st != nfs4errStale {
+		t.Fatalf("handle of internal file: %d", st)
+	}
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	v := createTestVFS(t)
+	go func() { _ = Serve(v, l) }()
+
+	null := []byte{0x80, 0, 0, 40, 0, 0, 0, 1, 0, 0, 0, rpcCall, 0, 0, 0, rpcVersion, 0, 0x01, 0x86, 0xa3,
+		0, 0, 0, nfsVersion, 0, 0, 0, procNull, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, _ = conn.Write(null)
+	if _, err = conn.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("connection from unprivileged port should be closed: %v", err)
+	}
+	_ = conn.Close()
+
+	if os.Geteuid() != 0 {
+		t.Skip("privileged port can't be bound by non-root user")
+	}
+	for port := 1023; port > 600; port-- {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+		if conn, err = d.Dial("tcp", l.Addr().String()); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("dial from privileged port: %s", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, _ = conn.Write(null)
+	rec, err := readRecord(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("read reply: %s", err)
+	}
+	r := &xdrReader{buf: rec}
+	if r.uint32() != 1 || r.uint32() != rpcReply || r.uint32() != msgAccepted {
+		t.Fatalf("bad reply of NULL: %x", rec)
+	}
+}
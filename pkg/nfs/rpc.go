@@ -0,0 +1,228 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// ONC RPC (RFC 5531)
+const (
+	rpcCall    = 0
+	rpcReply   = 1
+	rpcVersion = 2
+
+	msgAccepted = 0
+	msgDenied   = 1
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+
+	rejectRPCMismatch = 0
+	rejectAuthError   = 1
+
+	authNone = 0
+	authSys  = 1
+
+	authBadCred = 1
+	authTooWeak = 5
+
+	nfsProgram = 100003
+	nfsVersion = 4
+
+	procNull     = 0
+	procCompound = 1
+
+	maxRecord   = 4 << 20 // enough for WRITE of maxWrite bytes
+	maxInflight = 128     // requests served concurrently for a connection
+)
+
+// credential is the AUTH_SYS credential of a request, which is sent by the NFS client of kernel.
+type credential struct {
+	uid, gid uint32
+	gids     []uint32
+}
+
+func parseAuthSys(body []byte) (*credential, error) {
+	r := &xdrReader{buf: body}
+	r.uint32()    // stamp
+	r.string(255) // machine name
+	c := &credential{uid: r.uint32(), gid: r.uint32()}
+	n := r.uint32()
+	if n > 16 {
+		return nil, errBadXDR
+	}
+	for i := uint32(0); i < n; i++ {
+		c.gids = append(c.gids, r.uint32())
+	}
+	return c, r.err
+}
+
+// trusted returns whether the connection comes from the NFS client of kernel: the credentials in
+// AUTH_SYS are chosen by the client, so only the privileged ports of loopback addresses are accepted,
+// which can't be bound by normal users.
+func trusted(addr net.Addr) bool {
+	a, ok := addr.(*net.TCPAddr)
+	return ok && a.IP.IsLoopback() && a.Port > 0 && a.Port < 1024
+}
+
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	var rec []byte
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(hdr[:])
+		n := int(h & 0x7fffffff)
+		if len(rec)+n > maxRecord {
+			return nil, fmt.Errorf("record is too large: %d", len(rec)+n)
+		}
+		off := len(rec)
+		rec = append(rec, make([]byte, n)...)
+		if _, err := io.ReadFull(r, rec[off:]); err != nil {
+			return nil, err
+		}
+		if h&0x80000000 != 0 {
+			return rec, nil
+		}
+	}
+}
+
+func (s *server) serveConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		cancel()
+		_ = conn.Close()
+	}()
+	var wm sync.Mutex
+	limit := make(chan struct{}, maxInflight)
+	r := bufio.NewReaderSize(conn, 1<<16)
+	for {
+		rec, err := readRecord(r)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("Read NFS request from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		limit <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			reply := s.handleCall(ctx, rec)
+			if reply == nil {
+				return
+			}
+			var hdr [4]byte
+			binary.BigEndian.PutUint32(hdr[:], uint32(len(reply))|0x80000000)
+			bufs := net.Buffers{hdr[:], reply}
+			wm.Lock()
+			_, err := bufs.WriteTo(conn)
+			wm.Unlock()
+			if err != nil {
+				logger.Debugf("Reply NFS request to %s: %s", conn.RemoteAddr(), err)
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+// handleCall serves one RPC call and returns the reply, or nil if it should be dropped.
+func (s *server) handleCall(ctx context.Context, rec []byte) []byte {
+	r := &xdrReader{buf: rec}
+	xid := r.uint32()
+	if r.uint32() != rpcCall {
+		return nil
+	}
+	rpcvers, prog, vers, proc := r.uint32(), r.uint32(), r.uint32(), r.uint32()
+	flavor, body := r.uint32(), r.opaque(400)
+	r.uint32()
+	r.opaque(400) // verifier
+	if r.err != nil {
+		return nil
+	}
+	w := &xdrWriter{buf: make([]byte, 0, 256)}
+	w.uint32(xid)
+	w.uint32(rpcReply)
+	if rpcvers != rpcVersion {
+		w.uint32(msgDenied)
+		w.uint32(rejectRPCMismatch)
+		w.uint32(rpcVersion)
+		w.uint32(rpcVersion)
+		return w.buf
+	}
+	var cred *credential
+	if proc != procNull {
+		var err error
+		if flavor != authSys {
+			err = fmt.Errorf("flavor %d", flavor)
+		} else {
+			cred, err = parseAuthSys(body)
+		}
+		if err != nil {
+			w.uint32(msgDenied)
+			w.uint32(rejectAuthError)
+			if flavor != authSys {
+				w.uint32(authTooWeak)
+			} else {
+				w.uint32(authBadCred)
+			}
+			return w.buf
+		}
+	}
+	w.uint32(msgAccepted)
+	w.uint32(authNone)
+	w.opaque(nil)
+	switch {
+	case prog != nfsProgram:
+		w.uint32(acceptProgUnavail)
+	case vers != nfsVersion:
+		w.uint32(acceptProgMismatch)
+		w.uint32(nfsVersion)
+		w.uint32(nfsVersion)
+	case proc == procNull:
+		w.uint32(acceptSuccess)
+	case proc == procCompound:
+		pos := len(w.buf)
+		w.uint32(acceptSuccess)
+		if !s.compound(ctx, cred, r, w) {
+			w.buf = w.buf[:pos]
+			w.uint32(acceptGarbageArgs)
+		}
+	default:
+		w.uint32(acceptProcUnavail)
+	}
+	return w.buf
+}
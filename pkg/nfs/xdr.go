@@ -0,0 +1,121 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errBadXDR = errors.New("bad XDR")
+
+func pad(n int) int { return (4 - n&3) & 3 }
+
+// xdrWriter encodes the values in XDR (RFC 4506), the buffer grows as needed.
+type xdrWriter struct {
+	buf []byte
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	w.buf = append(w.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	w.uint32(uint32(v >> 32))
+	w.uint32(uint32(v))
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+// fixed writes opaque data of fixed length.
+func (w *xdrWriter) fixed(b []byte) {
+	w.buf = append(w.buf, b...)
+	w.buf = append(w.buf, make([]byte, pad(len(b)))...)
+}
+
+// opaque writes opaque data of variable length.
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.fixed(b)
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
+
+// xdrReader decodes the values in XDR, it returns zero values after the first error.
+type xdrReader struct {
+	buf []byte
+	err error
+}
+
+func (r *xdrReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.buf) {
+		r.err = errBadXDR
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *xdrReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *xdrReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+func (r *xdrReader) fixed(n int) []byte {
+	b := r.next(n)
+	r.next(pad(n))
+	return b
+}
+
+// opaque reads opaque data of variable length up to max bytes.
+func (r *xdrReader) opaque(max int) []byte {
+	n := r.uint32()
+	if n > uint32(max) {
+		r.err = errBadXDR
+		return nil
+	}
+	return r.fixed(int(n))
+}
+
+func (r *xdrReader) string(max int) string {
+	return string(r.opaque(max))
+}
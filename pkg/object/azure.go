@@ -20,18 +20,26 @@
 package object
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	blob2 "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
 )
@@ -42,7 +50,7 @@ type wasb struct {
 	azblobCli *azblob.Client
 	sc        string
 	cName     string
-	marker    string
+	identity  *azureIdentity // nil if authorized by shared key
 }
 
 func (b *wasb) String() string {
@@ -85,6 +93,46 @@ func (b *wasb) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	return download.Body, err
 }
 
+// ListVersions lists the previous versions of the blob, which are kept when blob versioning is enabled.
+func (b *wasb) ListVersions(key string) ([]*ObjectVersion, error) {
+	pager := b.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &key, Include: container.ListBlobsInclude{Versions: true}})
+	var versions []*ObjectVersion
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if page.Segment == nil {
+			continue
+		}
+		for _, item := range page.Segment.BlobItems {
+			if *item.Name != key || item.VersionID == nil {
+				continue
+			}
+			var sc string
+			if item.Properties.AccessTier != nil {
+				sc = string(*item.Properties.AccessTier)
+			}
+			o := &obj{key, *item.Properties.ContentLength, *item.Properties.LastModified, strings.HasSuffix(key, "/"), sc}
+			versions = append(versions, &ObjectVersion{o, *item.VersionID, item.IsCurrentVersion != nil && *item.IsCurrentVersion, false})
+		}
+	}
+	sortVersions(versions)
+	return versions, nil
+}
+
+func (b *wasb) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	cli, err := b.container.NewBlobClient(key).WithVersionID(versionID)
+	if err != nil {
+		return nil, err
+	}
+	download, err := cli.DownloadStream(ctx, &blob2.DownloadStreamOptions{Range: blob2.HTTPRange{Offset: off, Count: limit}})
+	if err != nil {
+		return nil, err
+	}
+	return download.Body, nil
+}
+
 func str2Tier(tier string) *blob2.AccessTier {
 	for _, v := range blob2.PossibleAccessTierValues() {
 		if string(v) == tier {
@@ -110,14 +158,29 @@ func (b *wasb) Copy(dst, src string) error {
 	if b.sc != "" {
 		options.Tier = str2Tier(b.sc)
 	}
-	srcSASUrl, err := srcCli.GetSASURL(sas.BlobPermissions{Read: true}, time.Now().Add(10*time.Second), nil)
+	srcURL, auth, err := b.copySource(srcCli, 10*time.Second)
 	if err != nil {
 		return err
 	}
-	_, err = dstCli.CopyFromURL(ctx, srcSASUrl, options)
+	options.CopySourceAuthorization = auth
+	_, err = dstCli.CopyFromURL(ctx, srcURL, options)
 	return err
 }
 
+// copySource returns the URL of source blob to copy from, which is authorized by the SAS when
+// using shared key, or the bearer token when using managed identity.
+func (b *wasb) copySource(src *blob2.Client, ttl time.Duration) (string, *string, error) {
+	if b.identity == nil {
+		u, err := src.GetSASURL(sas.BlobPermissions{Read: true}, time.Now().Add(ttl), nil)
+		return u, nil, err
+	}
+	auth, err := b.identity.bearer()
+	if err != nil {
+		return "", nil, err
+	}
+	return src.URL(), &auth, nil
+}
+
 func (b *wasb) Delete(key string) error {
 	_, err := b.container.NewBlobClient(key).Delete(ctx, nil)
 	if err != nil {
@@ -128,48 +191,121 @@ func (b *wasb) Delete(key string) error {
 	return err
 }
 
-func (b *wasb) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (b *wasb) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if delimiter != "" {
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
-	// todo
-	if marker != "" {
-		if b.marker == "" {
-			// last page
-			return nil, nil
+	limit32 := int32(limit)
+	for {
+		pager := b.azblobCli.NewListBlobsFlatPager(b.cName, &azblob.ListBlobsFlatOptions{Prefix: &prefix, Marker: &token, MaxResults: &(limit32)})
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, false, "", err
+		}
+		var objs []Object
+		if page.Segment != nil {
+			for _, blob := range page.Segment.BlobItems {
+				if *blob.Name <= startAfter {
+					continue
+				}
+				mtime := blob.Properties.LastModified
+				objs = append(objs, &obj{
+					*blob.Name,
+					*blob.Properties.ContentLength,
+					*mtime,
+					strings.HasSuffix(*blob.Name, "/"),
+					string(*blob.Properties.AccessTier),
+				})
+			}
+		}
+		token = ""
+		if page.NextMarker != nil {
+			token = *page.NextMarker
+		}
+		// Azure can't start listing after a key, skip the pages before it
+		if len(objs) > 0 || token == "" {
+			return objs, token != "", token, nil
 		}
-		marker = b.marker
 	}
+}
 
-	limit32 := int32(limit)
+func (b *wasb) Limits() Limits {
+	return Limits{
+		IsSupportMultipartUpload: true,
+		IsSupportUploadPartCopy:  true,
+		MinPartSize:              5 << 20,
+		MaxPartSize:              4000 << 20,
+		MaxPartCount:             50000,
+	}
+}
 
-	pager := b.azblobCli.NewListBlobsFlatPager(b.cName, &azblob.ListBlobsFlatOptions{Prefix: &prefix, Marker: &marker, MaxResults: &(limit32)})
-	page, err := pager.NextPage(ctx)
+// The parts are staged as uncommitted blocks of the blob, which are committed by CompleteUpload
+// or garbage collected by Azure after 7 days. The upload ID is a random prefix of the block IDs,
+// so the blocks of different uploads will not be mixed up.
+func (b *wasb) blockID(uploadID string, num int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%05d", uploadID, num)))
+}
+
+func (b *wasb) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	return &MultipartUpload{UploadID: hex.EncodeToString(id[:]), MinPartSize: 5 << 20, MaxCount: 50000}, nil
+}
+
+func (b *wasb) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	id := b.blockID(uploadID, num)
+	_, err := b.container.NewBlockBlobClient(key).StageBlock(ctx, id, streaming.NopCloser(bytes.NewReader(body)), nil)
 	if err != nil {
 		return nil, err
 	}
-	if pager.More() {
-		b.marker = *page.NextMarker
-	} else {
-		b.marker = ""
+	return &Part{Num: num, Size: len(body), ETag: id}, nil
+}
+
+func (b *wasb) UploadPartCopy(key string, uploadID string, num int, srcKey string, off, size int64) (*Part, error) {
+	srcURL, auth, err := b.copySource(b.container.NewBlobClient(srcKey), time.Minute)
+	if err == nil {
+		id := b.blockID(uploadID, num)
+		_, err = b.container.NewBlockBlobClient(key).StageBlockFromURL(ctx, id, srcURL,
+			&blockblob.StageBlockFromURLOptions{Range: blob2.HTTPRange{Offset: off, Count: size}, CopySourceAuthorization: auth})
+		if err == nil {
+			return &Part{Num: num, Size: int(size), ETag: id}, nil
+		}
+		if e, ok := err.(*azcore.ResponseError); !ok || e.StatusCode != http.StatusUnauthorized && e.StatusCode != http.StatusForbidden {
+			return nil, err
+		}
 	}
-	var n int
-	if page.Segment != nil {
-		n = len(page.Segment.BlobItems)
+	// the source can't be authorized for server-side copy (e.g. no account key to sign the SAS)
+	logger.Debugf("Copy %s to part %d of %s by downloading it: %s", srcKey, num, key, err)
+	in, err := b.Get(srcKey, off, size)
+	if err != nil {
+		return nil, err
 	}
-	objs := make([]Object, n)
-	for i := 0; i < n; i++ {
-		blob := page.Segment.BlobItems[i]
-		mtime := blob.Properties.LastModified
-		objs[i] = &obj{
-			*blob.Name,
-			*blob.Properties.ContentLength,
-			*mtime,
-			strings.HasSuffix(*blob.Name, "/"),
-			string(*blob.Properties.AccessTier),
-		}
+	defer in.Close()
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
 	}
-	return objs, nil
+	return b.UploadPart(key, uploadID, num, data)
+}
+
+func (b *wasb) AbortUpload(key string, uploadID string) {
+	// the uncommitted blocks can't be deleted, they will be garbage collected by Azure
+}
+
+func (b *wasb) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Num < parts[j].Num })
+	ids := make([]string, len(parts))
+	for i, p := range parts {
+		ids[i] = p.ETag
+	}
+	options := &blockblob.CommitBlockListOptions{}
+	if b.sc != "" {
+		options.Tier = str2Tier(b.sc)
+	}
+	_, err := b.container.NewBlockBlobClient(key).CommitBlockList(ctx, ids, options)
+	return err
 }
 
 func (b *wasb) SetStorageClass(sc string) {
@@ -221,6 +357,27 @@ func newWasb(endpoint, accountName, accountKey, token string) (ObjectStorage, er
 		return &wasb{container: client.ServiceClient().NewContainerClient(containerName), azblobCli: client, cName: containerName}, nil
 	}
 
+	if accountKey == "" {
+		// no account key, authorized by the workload identity or managed identity of Azure AD
+		if accountName == "" {
+			return nil, fmt.Errorf("name of storage account is required for managed identity")
+		}
+		domain := "blob.core.windows.net"
+		if len(hostParts) > 1 {
+			domain = hostParts[1]
+			if !strings.HasPrefix(hostParts[1], "blob") {
+				domain = fmt.Sprintf("blob.%s", hostParts[1])
+			}
+		}
+		identity := newAzureIdentity(uri.Query().Get("client-id"))
+		client, err := azblob.NewClient(fmt.Sprintf("%s://%s.%s", uri.Scheme, accountName, domain), identity, nil)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("Access container %s with %s", containerName, identity)
+		return &wasb{container: client.ServiceClient().NewContainerClient(containerName), azblobCli: client, cName: containerName, identity: identity}, nil
+	}
+
 	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
 	if err != nil {
 		return nil, err
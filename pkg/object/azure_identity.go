@@ -0,0 +1,199 @@
+//go:build !noazure
+// +build !noazure
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const (
+	azureStorageScope     = "https://storage.azure.com/.default"
+	azureIMDSEndpoint     = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureDefaultAuthority = "https://login.microsoftonline.com/"
+)
+
+type azureToken struct {
+	token  string
+	expire time.Time
+}
+
+// azureIdentity gets the OAuth tokens of Azure AD from the workload identity (federated token
+// of Kubernetes service account) or the managed identity of VM, and caches them until 5 minutes
+// before expiration.
+type azureIdentity struct {
+	clientID  string
+	tenantID  string
+	tokenFile string // AZURE_FEDERATED_TOKEN_FILE, empty for managed identity
+	authority string
+
+	sync.Mutex
+	tokens map[string]azureToken
+}
+
+// newAzureIdentity returns the credential of workload identity if AZURE_FEDERATED_TOKEN_FILE,
+// AZURE_CLIENT_ID and AZURE_TENANT_ID are set, otherwise the credential of managed identity,
+// where clientID selects one of the user-assigned identities.
+func newAzureIdentity(clientID string) *azureIdentity {
+	if clientID == "" {
+		clientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	id := &azureIdentity{clientID: clientID, tokens: make(map[string]azureToken)}
+	tokenFile, tenantID := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"), os.Getenv("AZURE_TENANT_ID")
+	if tokenFile != "" && tenantID != "" && clientID != "" {
+		id.tokenFile, id.tenantID = tokenFile, tenantID
+		id.authority = os.Getenv("AZURE_AUTHORITY_HOST")
+		if id.authority == "" {
+			id.authority = azureDefaultAuthority
+		}
+		if !strings.HasSuffix(id.authority, "/") {
+			id.authority += "/"
+		}
+	}
+	return id
+}
+
+func (id *azureIdentity) String() string {
+	if id.tokenFile != "" {
+		return fmt.Sprintf("workload identity (client %s)", id.clientID)
+	}
+	if id.clientID != "" {
+		return fmt.Sprintf("managed identity (client %s)", id.clientID)
+	}
+	return "managed identity"
+}
+
+func (id *azureIdentity) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	scope := azureStorageScope
+	if len(options.Scopes) > 0 {
+		scope = options.Scopes[0]
+	}
+	id.Lock()
+	defer id.Unlock()
+	if t, ok := id.tokens[scope]; ok && time.Until(t.expire) > time.Minute*5 {
+		return azcore.AccessToken{Token: t.token, ExpiresOn: t.expire}, nil
+	}
+	var t *azureToken
+	var err error
+	if id.tokenFile != "" {
+		t, err = id.federatedToken(ctx, scope)
+	} else {
+		t, err = id.managedToken(ctx, scope)
+	}
+	if err != nil {
+		return azcore.AccessToken{}, fmt.Errorf("get token of %s: %s", id, err)
+	}
+	id.tokens[scope] = *t
+	logger.Debugf("Got token of %s for %s, will be expired at %s", id, scope, t.expire)
+	return azcore.AccessToken{Token: t.token, ExpiresOn: t.expire}, nil
+}
+
+// bearer returns the Authorization header to read the blobs as copy source.
+func (id *azureIdentity) bearer() (string, error) {
+	t, err := id.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureStorageScope}})
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + t.Token, nil
+}
+
+// managedToken gets the token from the instance metadata service.
+func (id *azureIdentity) managedToken(ctx context.Context, scope string) (*azureToken, error) {
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", strings.TrimSuffix(scope, "/.default"))
+	if id.clientID != "" {
+		query.Set("client_id", id.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureIMDSEndpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"` // seconds since epoch
+	}
+	if err = doTokenRequest(req, &result); err != nil {
+		return nil, err
+	}
+	secs, err := strconv.ParseInt(result.ExpiresOn, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expires_on: %s", result.ExpiresOn)
+	}
+	return &azureToken{result.AccessToken, time.Unix(secs, 0)}, nil
+}
+
+// federatedToken exchanges the federated token of service account for the token of Azure AD.
+// The token file is read every time since it's rotated by kubelet.
+func (id *azureIdentity) federatedToken(ctx context.Context, scope string) (*azureToken, error) {
+	assertion, err := os.ReadFile(id.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("client_id", id.clientID)
+	form.Set("scope", scope)
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	endpoint := id.authority + id.tenantID + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = doTokenRequest(req, &result); err != nil {
+		return nil, err
+	}
+	return &azureToken{result.AccessToken, time.Now().Add(time.Second * time.Duration(result.ExpiresIn))}, nil
+}
+
+func doTokenRequest(req *http.Request, result interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer cleanup(resp)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, data)
+	}
+	return json.Unmarshal(data, result)
+}
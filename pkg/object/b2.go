@@ -20,12 +20,18 @@
 package object
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/kothar/go-backblaze.v0"
@@ -33,8 +39,8 @@ import (
 
 type b2client struct {
 	DefaultObjectStorage
-	bucket     *backblaze.Bucket
-	nextMarker string
+	bucket *backblaze.Bucket
+	api    *b2api
 }
 
 func (c *b2client) String() string {
@@ -96,8 +102,41 @@ func (c *b2client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (c *b2client) Put(key string, data io.Reader) error {
-	_, err := c.bucket.UploadFile(key, nil, data)
-	return err
+	var body io.ReadSeeker
+	var vlen int64
+	var hash string
+	if b, ok := data.(io.ReadSeeker); ok {
+		var err error
+		h := sha1.New()
+		buf := bufPool.Get().(*[]byte)
+		defer bufPool.Put(buf)
+		vlen, err = io.CopyBuffer(h, data, *buf)
+		if err != nil {
+			return err
+		}
+		if _, err = b.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		hash = hex.EncodeToString(h.Sum(nil))
+		body = b
+	} else {
+		d, err := io.ReadAll(data)
+		if err != nil {
+			return err
+		}
+		vlen = int64(len(d))
+		sum := sha1.Sum(d)
+		hash = hex.EncodeToString(sum[:])
+		body = bytes.NewReader(d)
+	}
+	f, err := c.bucket.UploadHashedFile(key, nil, body, hash, vlen)
+	if err != nil {
+		return err
+	}
+	if f.ContentSha1 != hash {
+		return fmt.Errorf("sha1 of %s mismatch: %s != %s", key, f.ContentSha1, hash)
+	}
+	return nil
 }
 
 func (c *b2client) Copy(dst, src string) error {
@@ -122,36 +161,245 @@ func (c *b2client) Delete(key string) error {
 	return err
 }
 
-func (c *b2client) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (c *b2client) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if limit > 1000 {
 		limit = 1000
 	}
-	if marker == "" && c.nextMarker != "" {
-		marker = c.nextMarker
-		c.nextMarker = ""
+	// the start file name is inclusive, which is continued from NextFileName of last page
+	start := startAfter
+	if token != "" {
+		start = token
 	}
-	resp, err := c.bucket.ListFileNamesWithPrefix(marker, int(limit), prefix, delimiter)
+	resp, err := c.bucket.ListFileNamesWithPrefix(start, int(limit), prefix, delimiter)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 
-	n := len(resp.Files)
-	objs := make([]Object, n)
-	for i := 0; i < n; i++ {
-		f := resp.Files[i]
-		objs[i] = &obj{
+	objs := make([]Object, 0, len(resp.Files))
+	for _, f := range resp.Files {
+		if startAfter != "" && f.Name <= startAfter {
+			continue
+		}
+		objs = append(objs, &obj{
 			f.Name,
 			f.ContentLength,
 			time.Unix(f.UploadTimestamp/1000, 0),
 			strings.HasSuffix(f.Name, "/"),
 			"",
+		})
+	}
+	return objs, resp.NextFileName != "", resp.NextFileName, nil
+}
+
+// b2api calls the native B2 API directly for large files, which are not
+// supported by the B2 client.
+type b2api struct {
+	keyID  string
+	appKey string
+
+	sync.Mutex
+	token         string
+	apiURL        string
+	allowedBucket string
+}
+
+type b2Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("%s: %s (%d)", e.Code, e.Message, e.Status)
+}
+
+func (a *b2api) authorize() error {
+	req, _ := http.NewRequest("GET", "https://api.backblazeb2.com/b2api/v2/b2_authorize_account", nil)
+	req.SetBasicAuth(a.keyID, a.appKey)
+	var auth struct {
+		Token   string `json:"authorizationToken"`
+		APIURL  string `json:"apiUrl"`
+		Allowed struct {
+			BucketName *string `json:"bucketName"`
+		} `json:"allowed"`
+	}
+	if err := a.do(req, &auth); err != nil {
+		return fmt.Errorf("authorize account: %s", err)
+	}
+	a.Lock()
+	a.token, a.apiURL = auth.Token, auth.APIURL
+	if auth.Allowed.BucketName != nil {
+		a.allowedBucket = *auth.Allowed.BucketName
+	}
+	a.Unlock()
+	return nil
+}
+
+func (a *b2api) do(req *http.Request, result interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer cleanup(resp)
+	if resp.StatusCode != http.StatusOK {
+		var e b2Error
+		if err = json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Code == "" {
+			return fmt.Errorf("status code %d", resp.StatusCode)
 		}
+		return &e
 	}
-	c.nextMarker = resp.NextFileName
-	return objs, nil
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
 }
 
-// TODO: support multipart upload using S3 client
+// call posts the request to the API, the account will be authorized again
+// when the token is expired.
+func (a *b2api) call(name string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		a.Lock()
+		token, apiURL := a.token, a.apiURL
+		a.Unlock()
+		if token == "" {
+			if err = a.authorize(); err != nil {
+				return err
+			}
+			continue
+		}
+		req, _ := http.NewRequest("POST", apiURL+"/b2api/v2/"+name, bytes.NewReader(body))
+		req.Header.Set("Authorization", token)
+		err = a.do(req, result)
+		if e, ok := err.(*b2Error); ok && e.Status == http.StatusUnauthorized && i == 0 {
+			a.Lock()
+			a.token = ""
+			a.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+func (c *b2client) Limits() Limits {
+	return Limits{
+		IsSupportMultipartUpload: true,
+		IsSupportUploadPartCopy:  true,
+		MinPartSize:              5 << 20,
+		MaxPartSize:              5 << 30,
+		MaxPartCount:             10000,
+	}
+}
+
+func (c *b2client) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	var result struct {
+		FileID string `json:"fileId"`
+	}
+	err := c.api.call("b2_start_large_file", map[string]string{
+		"bucketId":    c.bucket.ID,
+		"fileName":    key,
+		"contentType": "b2/x-auto",
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &MultipartUpload{UploadID: result.FileID, MinPartSize: 5 << 20, MaxCount: 10000}, nil
+}
+
+func (c *b2client) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	var upload struct {
+		UploadURL string `json:"uploadUrl"`
+		Token     string `json:"authorizationToken"`
+	}
+	if err := c.api.call("b2_get_upload_part_url", map[string]string{"fileId": uploadID}, &upload); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(body)
+	etag := hex.EncodeToString(sum[:])
+	req, _ := http.NewRequest("POST", upload.UploadURL, bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Authorization", upload.Token)
+	req.Header.Set("X-Bz-Part-Number", strconv.Itoa(num))
+	req.Header.Set("X-Bz-Content-Sha1", etag)
+	var result struct {
+		ContentSha1 string `json:"contentSha1"`
+	}
+	if err := c.api.do(req, &result); err != nil {
+		return nil, err
+	}
+	if result.ContentSha1 != etag {
+		return nil, fmt.Errorf("sha1 of part %d mismatch: %s != %s", num, result.ContentSha1, etag)
+	}
+	return &Part{Num: num, Size: len(body), ETag: etag}, nil
+}
+
+func (c *b2client) UploadPartCopy(key string, uploadID string, num int, srcKey string, off, size int64) (*Part, error) {
+	f, err := c.getFileInfo(srcKey)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		ContentSha1 string `json:"contentSha1"`
+	}
+	err = c.api.call("b2_copy_part", map[string]interface{}{
+		"sourceFileId": f.ID,
+		"largeFileId":  uploadID,
+		"partNumber":   num,
+		"range":        fmt.Sprintf("bytes=%d-%d", off, off+size-1),
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &Part{Num: num, Size: int(size), ETag: result.ContentSha1}, nil
+}
+
+func (c *b2client) AbortUpload(key string, uploadID string) {
+	_ = c.api.call("b2_cancel_large_file", map[string]string{"fileId": uploadID}, nil)
+}
+
+func (c *b2client) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	sha1s := make([]string, len(parts))
+	for i, p := range parts {
+		sha1s[i] = p.ETag
+	}
+	return c.api.call("b2_finish_large_file", map[string]interface{}{
+		"fileId":        uploadID,
+		"partSha1Array": sha1s,
+	}, nil)
+}
+
+func (c *b2client) ListUploads(marker string) ([]*PendingPart, string, error) {
+	request := map[string]interface{}{
+		"bucketId":     c.bucket.ID,
+		"maxFileCount": 1000,
+	}
+	if marker != "" {
+		request["startFileId"] = marker
+	}
+	var result struct {
+		Files []struct {
+			FileID          string `json:"fileId"`
+			FileName        string `json:"fileName"`
+			UploadTimestamp int64  `json:"uploadTimestamp"`
+		} `json:"files"`
+		NextFileID *string `json:"nextFileId"`
+	}
+	if err := c.api.call("b2_list_unfinished_large_files", request, &result); err != nil {
+		return nil, "", err
+	}
+	parts := make([]*PendingPart, len(result.Files))
+	for i, f := range result.Files {
+		parts[i] = &PendingPart{f.FileName, f.FileID, time.UnixMilli(f.UploadTimestamp)}
+	}
+	var next string
+	if result.NextFileID != nil {
+		next = *result.NextFileID
+	}
+	return parts, next, nil
+}
 
 func newB2(endpoint, keyID, applicationKey, token string) (ObjectStorage, error) {
 	if !strings.Contains(endpoint, "://") {
@@ -171,6 +419,13 @@ func newB2(endpoint, keyID, applicationKey, token string) (ObjectStorage, error)
 		return nil, fmt.Errorf("create B2 client: %s", err)
 	}
 	client.MaxIdleUploads = 20
+	api := &b2api{keyID: keyID, appKey: applicationKey}
+	if err = api.authorize(); err != nil {
+		return nil, err
+	}
+	if api.allowedBucket != "" && api.allowedBucket != name {
+		return nil, fmt.Errorf("the application key is restricted to bucket %s", api.allowedBucket)
+	}
 	bucket, err := client.Bucket(name)
 	if err != nil {
 		logger.Warnf("access bucket %s: %s", name, err)
@@ -184,7 +439,7 @@ func newB2(endpoint, keyID, applicationKey, token string) (ObjectStorage, error)
 	if bucket == nil {
 		return nil, fmt.Errorf("can't find bucket %s with provided Key ID", name)
 	}
-	return &b2client{bucket: bucket}, nil
+	return &b2client{bucket: bucket, api: api}, nil
 }
 
 func init() {
@@ -0,0 +1,116 @@
+//go:build !nob2
+// +build !nob2
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestB2LargeFile(t *testing.T) {
+	var finished []string
+	var canceled string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		switch r.URL.Path {
+		case "/upload":
+			if r.Header.Get("Authorization") != "upload-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			sum := sha1.Sum(body)
+			if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(sum[:]) {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"status":400,"code":"bad_request","message":"checksum did not match data received"}`))
+				return
+			}
+			if r.Header.Get("X-Bz-Part-Number") == "3" { // corrupted in transit
+				sum = sha1.Sum(nil)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"contentSha1": hex.EncodeToString(sum[:])})
+			return
+		}
+		if r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/b2api/v2/b2_get_upload_part_url":
+			if req["fileId"] != "large" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"status":400,"code":"bad_request","message":"invalid fileId"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"uploadUrl": srv.URL + "/upload", "authorizationToken": "upload-token"})
+		case "/b2api/v2/b2_finish_large_file":
+			for _, s := range req["partSha1Array"].([]interface{}) {
+				finished = append(finished, s.(string))
+			}
+			_, _ = w.Write([]byte(`{}`))
+		case "/b2api/v2/b2_cancel_large_file":
+			canceled = req["fileId"].(string)
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c := &b2client{api: &b2api{token: "token", apiURL: srv.URL}}
+	p1, err := c.UploadPart("key", "large", 1, []byte("part1"))
+	if err != nil {
+		t.Fatalf("upload part 1: %s", err)
+	}
+	if sum := sha1.Sum([]byte("part1")); p1.Num != 1 || p1.Size != 5 || p1.ETag != hex.EncodeToString(sum[:]) {
+		t.Fatalf("part 1: %+v", p1)
+	}
+	p2, err := c.UploadPart("key", "large", 2, []byte("part2"))
+	if err != nil {
+		t.Fatalf("upload part 2: %s", err)
+	}
+	if _, err = c.UploadPart("key", "large", 3, []byte("part3")); err == nil {
+		t.Fatalf("mismatched sha1 of part 3 should fail")
+	}
+	if _, err = c.UploadPart("key", "unknown", 1, []byte("part1")); err == nil {
+		t.Fatalf("upload part of unknown file should fail")
+	} else if e, ok := err.(*b2Error); !ok || e.Code != "bad_request" || e.Status != http.StatusBadRequest {
+		t.Fatalf("expect bad_request, but got %v", err)
+	}
+
+	if err = c.CompleteUpload("key", "large", []*Part{p1, p2}); err != nil {
+		t.Fatalf("complete: %s", err)
+	}
+	if !reflect.DeepEqual(finished, []string{p1.ETag, p2.ETag}) {
+		t.Fatalf("sha1 of parts %v", finished)
+	}
+	c.AbortUpload("key", "large")
+	if canceled != "large" {
+		t.Fatalf("canceled %q", canceled)
+	}
+}
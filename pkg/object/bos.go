@@ -138,14 +138,14 @@ func (q *bosclient) Delete(key string) error {
 	return err
 }
 
-func (q *bosclient) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (q *bosclient) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if limit > 1000 {
 		limit = 1000
 	}
 	limit_ := int(limit)
-	out, err := q.c.SimpleListObjects(q.bucket, prefix, limit_, marker, delimiter)
+	out, err := q.c.SimpleListObjects(q.bucket, prefix, limit_, startAfter, delimiter)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	n := len(out.Contents)
 	objs := make([]Object, n)
@@ -160,7 +160,7 @@ func (q *bosclient) List(prefix, marker, delimiter string, limit int64) ([]Objec
 		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func (q *bosclient) CreateMultipartUpload(key string) (*MultipartUpload, error) {
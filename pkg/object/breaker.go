@@ -0,0 +1,304 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errCircuitOpen is returned without sending the request when the endpoint is unhealthy.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+const breakerProbeKey = "juicefs-health-probe"
+
+var (
+	breakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "object_circuit_breaker_open",
+		Help: "whether the circuit breaker of object store is open (1) or closed (0)",
+	}, []string{"endpoint"})
+	breakerRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "object_circuit_breaker_rejected",
+		Help: "requests to object store rejected by the open circuit breaker",
+	}, []string{"endpoint"})
+)
+
+// BreakerPolicy controls when the circuit breaker trips and recovers.
+type BreakerPolicy struct {
+	MaxFailures   int           // trip after this number of consecutive failed or slow requests
+	SlowThreshold time.Duration // requests slower than this are counted as failed, zero means no limit
+	ProbeInterval time.Duration // interval of probing the endpoint after tripped
+}
+
+// DefaultBreakerPolicy returns the policy used when some of the parameters are not specified.
+func DefaultBreakerPolicy() *BreakerPolicy {
+	return &BreakerPolicy{
+		MaxFailures:   10,
+		ProbeInterval: time.Second * 5,
+	}
+}
+
+// ParseBreakerPolicy parses the policy of circuit breaker from the query of bucket, for example:
+//
+//	breaker-max-failures=5&breaker-slow-threshold=10s&breaker-probe-interval=3s
+//
+// It returns nil if none of them is specified, and the parsed parameters are removed from the query.
+func ParseBreakerPolicy(query url.Values) (*BreakerPolicy, error) {
+	var found bool
+	p := DefaultBreakerPolicy()
+	if v := query.Get("breaker-max-failures"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid breaker-max-failures: %s", v)
+		}
+		p.MaxFailures = n
+		found = true
+	}
+	for name, d := range map[string]*time.Duration{
+		"breaker-slow-threshold": &p.SlowThreshold,
+		"breaker-probe-interval": &p.ProbeInterval,
+	} {
+		if v := query.Get(name); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil || *d < 0 {
+				return nil, fmt.Errorf("invalid %s: %s", name, v)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	if p.ProbeInterval == 0 {
+		p.ProbeInterval = DefaultBreakerPolicy().ProbeInterval
+	}
+	for _, name := range []string{"breaker-max-failures", "breaker-slow-threshold", "breaker-probe-interval"} {
+		query.Del(name)
+	}
+	return p, nil
+}
+
+type breaker struct {
+	ObjectStorage
+	policy   *BreakerPolicy
+	endpoint string
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+}
+
+// NewBreaker returns an object storage that stops sending requests to the endpoint after
+// sustained errors or high latency, and resumes once a background probe succeeds.
+func NewBreaker(s ObjectStorage, policy *BreakerPolicy) ObjectStorage {
+	b := &breaker{ObjectStorage: s, policy: policy, endpoint: s.String()}
+	breakerState.WithLabelValues(b.endpoint).Set(0)
+	return b
+}
+
+func (b *breaker) String() string {
+	return b.ObjectStorage.String()
+}
+
+func (b *breaker) SetStorageClass(sc string) {
+	if o, ok := b.ObjectStorage.(SupportStorageClass); ok {
+		o.SetStorageClass(sc)
+	}
+}
+
+func (b *breaker) healthy(err error, used time.Duration) bool {
+	return errorClass(err) == "" && (b.policy.SlowThreshold == 0 || used < b.policy.SlowThreshold)
+}
+
+func (b *breaker) do(f func() error) error {
+	b.mu.Lock()
+	open := b.open
+	b.mu.Unlock()
+	if open {
+		breakerRejected.WithLabelValues(b.endpoint).Inc()
+		return errCircuitOpen
+	}
+	start := time.Now()
+	err := f()
+	used := time.Since(start)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.healthy(err, used) {
+		b.failures = 0
+		return err
+	}
+	b.failures++
+	if b.failures >= b.policy.MaxFailures && !b.open {
+		b.open = true
+		breakerState.WithLabelValues(b.endpoint).Set(1)
+		logger.Warnf("Circuit breaker of %s is open after %d failed or slow requests, last one: %v (%s)", b.endpoint, b.failures, err, used)
+		go b.probe()
+	}
+	return err
+}
+
+// probe checks the endpoint periodically until it's healthy again.
+func (b *breaker) probe() {
+	for {
+		time.Sleep(b.policy.ProbeInterval)
+		start := time.Now()
+		_, err := b.ObjectStorage.Head(breakerProbeKey)
+		if used := time.Since(start); !b.healthy(err, used) {
+			logger.Debugf("Probe %s: %v (%s)", b.endpoint, err, used)
+			continue
+		}
+		b.mu.Lock()
+		b.open = false
+		b.failures = 0
+		b.mu.Unlock()
+		breakerState.WithLabelValues(b.endpoint).Set(0)
+		logger.Infof("Circuit breaker of %s is closed", b.endpoint)
+		return
+	}
+}
+
+func (b *breaker) Head(key string) (o Object, err error) {
+	err = b.do(func() error {
+		o, err = b.ObjectStorage.Head(key)
+		return err
+	})
+	return
+}
+
+func (b *breaker) Get(key string, off, limit int64) (in io.ReadCloser, err error) {
+	err = b.do(func() error {
+		in, err = b.ObjectStorage.Get(key, off, limit)
+		return err
+	})
+	return
+}
+
+func (b *breaker) Put(key string, in io.Reader) error {
+	return b.do(func() error { return b.ObjectStorage.Put(key, in) })
+}
+
+func (b *breaker) PutIfNotExists(key string, in io.Reader) error {
+	return b.do(func() error { return PutIfNotExists(b.ObjectStorage, key, in) })
+}
+
+func (b *breaker) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	return b.do(func() error { return PutWithTags(b.ObjectStorage, key, in, tags) })
+}
+
+func (b *breaker) SetTags(key string, tags map[string]string) error {
+	o, ok := b.ObjectStorage.(SupportTagging)
+	if !ok {
+		return notSupported
+	}
+	return b.do(func() error { return o.SetTags(key, tags) })
+}
+
+func (b *breaker) GetTags(key string) (tags map[string]string, err error) {
+	o, ok := b.ObjectStorage.(SupportTagging)
+	if !ok {
+		return nil, notSupported
+	}
+	err = b.do(func() error {
+		tags, err = o.GetTags(key)
+		return err
+	})
+	return
+}
+
+func (b *breaker) Restore(key string, days int, tier string) error {
+	o, ok := b.ObjectStorage.(SupportRestore)
+	if !ok {
+		return notSupported
+	}
+	return b.do(func() error { return o.Restore(key, days, tier) })
+}
+
+func (b *breaker) ListVersions(key string) (versions []*ObjectVersion, err error) {
+	o, ok := b.ObjectStorage.(SupportVersioning)
+	if !ok {
+		return nil, notSupported
+	}
+	err = b.do(func() error {
+		versions, err = o.ListVersions(key)
+		return err
+	})
+	return
+}
+
+func (b *breaker) GetVersion(key, versionID string, off, limit int64) (in io.ReadCloser, err error) {
+	o, ok := b.ObjectStorage.(SupportVersioning)
+	if !ok {
+		return nil, notSupported
+	}
+	err = b.do(func() error {
+		in, err = o.GetVersion(key, versionID, off, limit)
+		return err
+	})
+	return
+}
+
+func (b *breaker) Copy(dst, src string) error {
+	return b.do(func() error { return b.ObjectStorage.Copy(dst, src) })
+}
+
+func (b *breaker) Delete(key string) error {
+	return b.do(func() error { return b.ObjectStorage.Delete(key) })
+}
+
+func (b *breaker) List(prefix, startAfter, token, delimiter string, limit int64) (objs []Object, hasMore bool, nextToken string, err error) {
+	err = b.do(func() error {
+		objs, hasMore, nextToken, err = b.ObjectStorage.List(prefix, startAfter, token, delimiter, limit)
+		return err
+	})
+	return
+}
+
+func (b *breaker) CreateMultipartUpload(key string) (upload *MultipartUpload, err error) {
+	err = b.do(func() error {
+		upload, err = b.ObjectStorage.CreateMultipartUpload(key)
+		return err
+	})
+	return
+}
+
+func (b *breaker) UploadPart(key string, uploadID string, num int, body []byte) (part *Part, err error) {
+	err = b.do(func() error {
+		part, err = b.ObjectStorage.UploadPart(key, uploadID, num, body)
+		return err
+	})
+	return
+}
+
+func (b *breaker) UploadPartCopy(key string, uploadID string, num int, srcKey string, off, size int64) (part *Part, err error) {
+	err = b.do(func() error {
+		part, err = b.ObjectStorage.UploadPartCopy(key, uploadID, num, srcKey, off, size)
+		return err
+	})
+	return
+}
+
+func (b *breaker) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	return b.do(func() error { return b.ObjectStorage.CompleteUpload(key, uploadID, parts) })
+}
@@ -28,20 +28,28 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/ceph/go-ceph/rados"
+	"github.com/dustin/go-humanize"
 )
 
 type ceph struct {
 	DefaultObjectStorage
-	name string
-	conn *rados.Conn
-	free chan *rados.IOContext
+	name       string
+	namespace  string
+	stripeUnit int64 // the size of stripes, zero means not striped
+	conn       *rados.Conn
+	free       chan *rados.IOContext
 }
 
 func (c *ceph) String() string {
+	if c.namespace != "" {
+		return fmt.Sprintf("ceph://%s/?namespace=%s", c.name, c.namespace)
+	}
 	return fmt.Sprintf("ceph://%s/", c.name)
 }
 
@@ -63,7 +71,11 @@ func (c *ceph) newContext() (*rados.IOContext, error) {
 	case ctx := <-c.free:
 		return ctx, nil
 	default:
-		return c.conn.OpenIOContext(c.name)
+		ctx, err := c.conn.OpenIOContext(c.name)
+		if err == nil && c.namespace != "" {
+			ctx.SetNamespace(c.namespace)
+		}
+		return ctx, err
 	}
 }
 
@@ -120,12 +132,77 @@ func (r *cephReader) Close() error {
 	return nil
 }
 
+// The layout of striped objects is compatible with libradosstriper (stripe count is 1),
+// the stripes are named as <key>.%016x, and the size is saved in the xattr of the first one.
+const (
+	striperSize        = "striper.size"
+	striperStripeUnit  = "striper.layout.stripe_unit"
+	striperStripeCount = "striper.layout.stripe_count"
+	striperObjectSize  = "striper.layout.object_size"
+	firstStripeSuffix  = ".0000000000000000"
+)
+
+func stripeName(key string, i int64) string {
+	return fmt.Sprintf("%s.%016x", key, i)
+}
+
+type cephStripedReader struct {
+	c   *ceph
+	ctx *rados.IOContext
+	key string
+	off int64
+	end int64
+}
+
+func (r *cephStripedReader) Read(buf []byte) (n int, err error) {
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+	unit := r.c.stripeUnit
+	inner := r.off % unit
+	if left := unit - inner; int64(len(buf)) > left {
+		buf = buf[:left]
+	}
+	if left := r.end - r.off; int64(len(buf)) > left {
+		buf = buf[:left]
+	}
+	n, err = r.ctx.Read(stripeName(r.key, r.off/unit), buf, uint64(inner))
+	r.off += int64(n)
+	if err == nil && n == 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (r *cephStripedReader) Close() error {
+	if r.ctx != nil {
+		r.c.release(r.ctx)
+		r.ctx = nil
+	}
+	return nil
+}
+
 func (c *ceph) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	ctx, err := c.newContext()
 	if err != nil {
 		return nil, err
 	}
-	return &cephReader{c, ctx, key, off, limit}, nil
+	if c.stripeUnit == 0 {
+		return &cephReader{c, ctx, key, off, limit}, nil
+	}
+	o, err := c.head(ctx, key)
+	if err != nil {
+		ctx.Destroy()
+		if err == rados.ErrNotFound {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+	end := o.size
+	if limit > 0 && off+limit < end {
+		end = off + limit
+	}
+	return &cephStripedReader{c, ctx, key, off, end}, nil
 }
 
 var cephPool = sync.Pool{
@@ -134,8 +211,50 @@ var cephPool = sync.Pool{
 	},
 }
 
+func (c *ceph) putStriped(ctx *rados.IOContext, key string, in io.Reader) error {
+	buf := make([]byte, c.stripeUnit)
+	var size, count int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 || count == 0 {
+			if err := ctx.WriteFull(stripeName(key, count), buf[:n]); err != nil {
+				return err
+			}
+			size += int64(n)
+			count++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	// remove the stale stripes of old object
+	for i := count; ; i++ {
+		if err := ctx.Delete(stripeName(key, i)); err != nil {
+			break
+		}
+	}
+	first := stripeName(key, 0)
+	unit := []byte(strconv.FormatInt(c.stripeUnit, 10))
+	for name, value := range map[string][]byte{
+		striperStripeUnit:  unit,
+		striperStripeCount: []byte("1"),
+		striperObjectSize:  unit,
+		striperSize:        []byte(strconv.FormatInt(size, 10)),
+	} {
+		if err := ctx.SetXattr(first, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *ceph) Put(key string, in io.Reader) error {
 	return c.do(func(ctx *rados.IOContext) error {
+		if c.stripeUnit > 0 {
+			return c.putStriped(ctx, key, in)
+		}
 		if b, ok := in.(*bytes.Reader); ok {
 			v := reflect.ValueOf(b)
 			data := v.Elem().Field(0).Bytes()
@@ -163,7 +282,20 @@ func (c *ceph) Put(key string, in io.Reader) error {
 
 func (c *ceph) Delete(key string) error {
 	err := c.do(func(ctx *rados.IOContext) error {
-		return ctx.Delete(key)
+		if c.stripeUnit == 0 {
+			return ctx.Delete(key)
+		}
+		o, err := c.head(ctx, key)
+		if err != nil {
+			return err
+		}
+		// delete the first stripe at last, so it can be retried if failed
+		for i := (o.size - 1) / c.stripeUnit; i >= 0; i-- {
+			if err = ctx.Delete(stripeName(key, i)); err != nil && (err != rados.ErrNotFound || i == 0) {
+				return err
+			}
+		}
+		return nil
 	})
 	if err == rados.ErrNotFound {
 		err = nil
@@ -171,15 +303,37 @@ func (c *ceph) Delete(key string) error {
 	return err
 }
 
-func (c *ceph) Head(key string) (Object, error) {
-	var o *obj
-	err := c.do(func(ctx *rados.IOContext) error {
+func (c *ceph) head(ctx *rados.IOContext, key string) (*obj, error) {
+	if c.stripeUnit == 0 {
 		stat, err := ctx.Stat(key)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		o = &obj{key, int64(stat.Size), stat.ModTime, strings.HasSuffix(key, "/"), ""}
-		return nil
+		return &obj{key, int64(stat.Size), stat.ModTime, strings.HasSuffix(key, "/"), ""}, nil
+	}
+	first := stripeName(key, 0)
+	stat, err := ctx.Stat(first)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 32)
+	n, err := ctx.GetXattr(first, striperSize, buf)
+	if err != nil {
+		return nil, fmt.Errorf("get size of striped object %s: %s", key, err)
+	}
+	size, err := strconv.ParseInt(string(buf[:n]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size of striped object %s: %q", key, buf[:n])
+	}
+	return &obj{key, size, stat.ModTime, strings.HasSuffix(key, "/"), ""}, nil
+}
+
+func (c *ceph) Head(key string) (Object, error) {
+	var o *obj
+	err := c.do(func(ctx *rados.IOContext) error {
+		var err error
+		o, err = c.head(ctx, key)
+		return err
 	})
 	if err == rados.ErrNotFound {
 		err = os.ErrNotExist
@@ -201,6 +355,12 @@ func (c *ceph) ListAll(prefix, marker string) (<-chan Object, error) {
 		keys := make([]string, 0, 1000)
 		for iter.Next() {
 			key := iter.Value()
+			if c.stripeUnit > 0 {
+				if !strings.HasSuffix(key, firstStripeSuffix) {
+					continue
+				}
+				key = strings.TrimSuffix(key, firstStripeSuffix)
+			}
 			if key <= marker || !strings.HasPrefix(key, prefix) {
 				continue
 			}
@@ -212,7 +372,7 @@ func (c *ceph) ListAll(prefix, marker string) (<-chan Object, error) {
 		go func() {
 			defer close(objs)
 			for _, key := range keys {
-				st, err := ctx.Stat(key)
+				o, err := c.head(ctx, key)
 				if err != nil {
 					if errors.Is(err, rados.ErrNotFound) {
 						logger.Warnf("Skip non-existent key: %s", key)
@@ -222,7 +382,7 @@ func (c *ceph) ListAll(prefix, marker string) (<-chan Object, error) {
 					logger.Errorf("Stat key %s: %s", key, err)
 					return
 				}
-				objs <- &obj{key, int64(st.Size), st.ModTime, strings.HasSuffix(key, "/"), ""}
+				objs <- o
 			}
 		}()
 		return nil
@@ -239,22 +399,55 @@ func newCeph(endpoint, cluster, user, token string) (ObjectStorage, error) {
 		return nil, fmt.Errorf("Invalid endpoint %s: %s", endpoint, err)
 	}
 	name := uri.Host
+	query := uri.Query()
+	var stripeUnit int64
+	if v := query.Get("stripe-unit"); v != "" {
+		unit, err := humanize.ParseBytes(v)
+		if err != nil || unit == 0 {
+			return nil, fmt.Errorf("Invalid stripe-unit %s: %v", v, err)
+		}
+		stripeUnit = int64(unit)
+	}
+	// multiple monitors separated by comma, librados will fail over among them
+	monHost := query.Get("mon")
 	conn, err := rados.NewConnWithClusterAndUser(cluster, user)
 	if err != nil {
 		return nil, fmt.Errorf("Can't create connection to cluster %s for user %s: %s", cluster, user, err)
 	}
 	if os.Getenv("JFS_NO_CHECK_OBJECT_STORAGE") == "" {
 		if err := conn.ReadDefaultConfigFile(); err != nil {
-			return nil, fmt.Errorf("Can't read default config file: %s", err)
+			if monHost == "" {
+				return nil, fmt.Errorf("Can't read default config file: %s", err)
+			}
+			logger.Debugf("Can't read default config file: %s", err)
+		}
+		if monHost != "" {
+			if err := conn.SetConfigOption("mon_host", monHost); err != nil {
+				return nil, fmt.Errorf("Can't set monitors %s: %s", monHost, err)
+			}
+		}
+		if v := query.Get("mon-timeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid mon-timeout %s: %s", v, err)
+			}
+			secs := strconv.Itoa(int(d.Seconds()))
+			for _, opt := range []string{"client_mount_timeout", "rados_mon_op_timeout"} {
+				if err := conn.SetConfigOption(opt, secs); err != nil {
+					return nil, fmt.Errorf("Can't set %s: %s", opt, err)
+				}
+			}
 		}
 		if err := conn.Connect(); err != nil {
 			return nil, fmt.Errorf("Can't connect to cluster %s: %s", cluster, err)
 		}
 	}
 	return &ceph{
-		name: name,
-		conn: conn,
-		free: make(chan *rados.IOContext, 50),
+		name:       name,
+		namespace:  query.Get("namespace"),
+		stripeUnit: stripeUnit,
+		conn:       conn,
+		free:       make(chan *rados.IOContext, 50),
 	}, nil
 }
 
@@ -0,0 +1,133 @@
+//go:build ceph
+// +build ceph
+
+/*
+ * JuiceFS, Copyright 2024 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ceph/go-ceph/rados"
+)
+
+func TestCephStripeName(t *testing.T) {
+	if n := stripeName("a/b", 0); n != "a/b"+firstStripeSuffix {
+		t.Fatalf("name of the first stripe: %s", n)
+	}
+	if n := stripeName("a/b", 255); n != "a/b.00000000000000ff" {
+		t.Fatalf("name of stripe 255: %s", n)
+	}
+}
+
+func TestCeph(t *testing.T) { //skip mutate
+	if os.Getenv("CEPH_ENDPOINT") == "" {
+		t.SkipNow()
+	}
+	s, err := newCeph(os.Getenv("CEPH_ENDPOINT"), os.Getenv("CEPH_CLUSTER"), os.Getenv("CEPH_USER"), "")
+	if err != nil {
+		t.Fatalf("create ceph: %s", err)
+	}
+	testStorage(t, s)
+}
+
+func TestCephStriped(t *testing.T) { //skip mutate
+	if os.Getenv("CEPH_ENDPOINT") == "" {
+		t.SkipNow()
+	}
+	s, err := newCeph(os.Getenv("CEPH_ENDPOINT")+"?namespace=jfs-unit-test&stripe-unit=4KiB",
+		os.Getenv("CEPH_CLUSTER"), os.Getenv("CEPH_USER"), "")
+	if err != nil {
+		t.Fatalf("create ceph: %s", err)
+	}
+	c := s.(*ceph)
+	if c.stripeUnit != 4096 || c.namespace != "jfs-unit-test" {
+		t.Fatalf("stripe unit %d namespace %s", c.stripeUnit, c.namespace)
+	}
+
+	key := "striped"
+	defer s.Delete(key)
+	data := make([]byte, 10000)
+	_, _ = rand.Read(data)
+	if err = s.Put(key, bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if o, err := s.Head(key); err != nil || o.Size() != int64(len(data)) {
+		t.Fatalf("head: %+v %v", o, err)
+	}
+	get := func(off, limit int64) []byte {
+		r, err := s.Get(key, off, limit)
+		if err != nil {
+			t.Fatalf("get %d-%d: %s", off, limit, err)
+		}
+		defer r.Close()
+		d, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read %d-%d: %s", off, limit, err)
+		}
+		return d
+	}
+	if d := get(0, -1); !bytes.Equal(d, data) {
+		t.Fatalf("read the whole object: %d bytes", len(d))
+	}
+	if d := get(4000, 200); !bytes.Equal(d, data[4000:4200]) { // across the first two stripes
+		t.Fatalf("read across stripes: %d bytes", len(d))
+	}
+	if d := get(9000, 2000); !bytes.Equal(d, data[9000:]) {
+		t.Fatalf("read beyond the end: %d bytes", len(d))
+	}
+	if objs, err := listAll(s, key, "", 10); err != nil || len(objs) != 1 || objs[0].Key() != key || objs[0].Size() != int64(len(data)) {
+		t.Fatalf("list should return the striped object only: %+v %v", objs, err)
+	}
+
+	// the stale stripes are removed after overwritten by a smaller object
+	if err = s.Put(key, bytes.NewReader(data[:100])); err != nil {
+		t.Fatalf("overwrite: %s", err)
+	}
+	if d := get(0, -1); !bytes.Equal(d, data[:100]) {
+		t.Fatalf("read the overwritten object: %d bytes", len(d))
+	}
+	err = c.do(func(ctx *rados.IOContext) error {
+		_, err := ctx.Stat(stripeName(key, 1))
+		return err
+	})
+	if err != rados.ErrNotFound {
+		t.Fatalf("stale stripe should be removed: %v", err)
+	}
+
+	if err = s.Delete(key); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err = s.Head(key); !os.IsNotExist(err) {
+		t.Fatalf("head of deleted object: %v", err)
+	}
+	// the namespace is isolated from the default one
+	plain, err := newCeph(os.Getenv("CEPH_ENDPOINT"), os.Getenv("CEPH_CLUSTER"), os.Getenv("CEPH_USER"), "")
+	if err != nil {
+		t.Fatalf("create ceph: %s", err)
+	}
+	if err = s.Put(key, bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if _, err = plain.Head(stripeName(key, 0)); !os.IsNotExist(err) {
+		t.Fatalf("striped object should not be visible out of namespace: %v", err)
+	}
+}
@@ -18,7 +18,10 @@ package object
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
 	"reflect"
@@ -67,6 +70,43 @@ func (c *checksumReader) Read(buf []byte) (n int, err error) {
 	return
 }
 
+type md5Reader struct {
+	io.ReadCloser
+	expected string
+	hash     hash.Hash
+}
+
+func (c *md5Reader) Read(buf []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(buf)
+	c.hash.Write(buf[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(c.hash.Sum(nil)); sum != c.expected {
+			return 0, fmt.Errorf("verify md5 failed: %s != %s", sum, c.expected)
+		}
+	}
+	return
+}
+
+// verifyMD5 verifies the data against the MD5 in hex (e.g. ETag of object), the
+// checksum error is returned at EOF.
+func verifyMD5(in io.ReadCloser, expected string) io.ReadCloser {
+	return &md5Reader{in, expected, md5.New()}
+}
+
+// contentMD5 returns the MD5 of data, which is rewound after reading.
+func contentMD5(in io.ReadSeeker) ([]byte, error) {
+	h := md5.New()
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	if _, err := io.CopyBuffer(h, in, *buf); err != nil {
+		return nil, err
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
 func verifyChecksum(in io.ReadCloser, checksum string) io.ReadCloser {
 	if checksum == "" {
 		return in
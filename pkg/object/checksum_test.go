@@ -18,9 +18,15 @@ package object
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"hash/crc32"
+	"io"
 	"strconv"
 	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 func TestChecksum(t *testing.T) {
@@ -38,3 +44,33 @@ func TestChecksum(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestVerifyMD5(t *testing.T) {
+	b := []byte("hello")
+	sum, err := contentMD5(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("content md5: %s", err)
+	}
+	etag := hex.EncodeToString(sum)
+	if etag != "5d41402abc4b2a76b9719d911017c592" {
+		t.Fatalf("unexpected md5: %s", etag)
+	}
+	if data, err := io.ReadAll(verifyMD5(io.NopCloser(bytes.NewReader(b)), etag)); err != nil || string(data) != "hello" {
+		t.Fatalf("verify md5: %s %s", data, err)
+	}
+	if _, err := io.ReadAll(verifyMD5(io.NopCloser(bytes.NewReader([]byte("hellO"))), etag)); err == nil {
+		t.Fatalf("corrupted data should fail")
+	}
+
+	s := &s3client{verifyChecksum: true}
+	if s.plainETag(aws.String(`"`+etag+`"`)) != etag || s.plainETag(aws.String(`"`+etag[:28]+`-2"`)) != "" {
+		t.Fatalf("plainETag is wrong")
+	}
+	params := &s3.PutObjectInput{ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum))}
+	if err = s.checkETag("k", params, &s3.PutObjectOutput{ETag: aws.String(etag)}); err != nil {
+		t.Fatalf("check etag: %s", err)
+	}
+	if err = s.checkETag("k", params, &s3.PutObjectOutput{ETag: aws.String("0123456789abcdef0123456789abcdef")}); err == nil {
+		t.Fatalf("mismatched etag should fail")
+	}
+}
@@ -21,6 +21,12 @@ package object
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -145,10 +151,10 @@ func (c *COS) Delete(key string) error {
 	return err
 }
 
-func (c *COS) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (c *COS) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	param := cos.BucketGetOptions{
 		Prefix:       prefix,
-		Marker:       marker,
+		Marker:       startAfter,
 		MaxKeys:      int(limit),
 		Delimiter:    delimiter,
 		EncodingType: "url",
@@ -156,12 +162,12 @@ func (c *COS) List(prefix, marker, delimiter string, limit int64) ([]Object, err
 	resp, _, err := c.c.Bucket.Get(ctx, &param)
 	for err == nil && len(resp.Contents) == 0 && resp.IsTruncated {
 		if param.Marker, err = cos.DecodeURIComponent(resp.NextMarker); err != nil {
-			return nil, errors.WithMessagef(err, "failed to decode nextMarker %s", resp.NextMarker)
+			return nil, false, "", errors.WithMessagef(err, "failed to decode nextMarker %s", resp.NextMarker)
 		}
 		resp, _, err = c.c.Bucket.Get(ctx, &param)
 	}
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	n := len(resp.Contents)
 	objs := make([]Object, n)
@@ -170,7 +176,7 @@ func (c *COS) List(prefix, marker, delimiter string, limit int64) ([]Object, err
 		t, _ := time.Parse(time.RFC3339, o.LastModified)
 		key, err := cos.DecodeURIComponent(o.Key)
 		if err != nil {
-			return nil, errors.WithMessagef(err, "failed to decode key %s", o.Key)
+			return nil, false, "", errors.WithMessagef(err, "failed to decode key %s", o.Key)
 		}
 		objs[i] = &obj{key, int64(o.Size), t, strings.HasSuffix(key, "/"), o.StorageClass}
 	}
@@ -178,13 +184,13 @@ func (c *COS) List(prefix, marker, delimiter string, limit int64) ([]Object, err
 		for _, p := range resp.CommonPrefixes {
 			key, err := cos.DecodeURIComponent(p)
 			if err != nil {
-				return nil, errors.WithMessagef(err, "failed to decode commonPrefixes %s", p)
+				return nil, false, "", errors.WithMessagef(err, "failed to decode commonPrefixes %s", p)
 			}
 			objs = append(objs, &obj{key, 0, time.Unix(0, 0), true, ""})
 		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func (c *COS) ListAll(prefix, marker string) (<-chan Object, error) {
@@ -287,14 +293,28 @@ func newCOS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		return nil, fmt.Errorf("Invalid endpoint %s: %s", endpoint, err)
 	}
 	hostParts := strings.SplitN(uri.Host, ".", 2)
+	role, err := parseAssumeRole(uri.Query())
+	if err != nil {
+		return nil, err
+	}
+	uri.RawQuery = ""
 
 	if accessKey == "" {
 		accessKey = os.Getenv("COS_SECRETID")
 		secretKey = os.Getenv("COS_SECRETKEY")
 	}
 
+	var roleCred *tempCred
+	cred := &tempCred{accessKey: accessKey, secretKey: secretKey, token: token}
+	if role != nil {
+		if roleCred, err = tencentAssumeRole(accessKey, secretKey, token, cosRegion(uri.Host), role); err != nil {
+			return nil, err
+		}
+		cred = roleCred
+	}
+
 	if len(hostParts) == 1 {
-		if endpoint, err = autoCOSEndpoint(hostParts[0], accessKey, secretKey, token); err != nil {
+		if endpoint, err = autoCOSEndpoint(hostParts[0], cred.accessKey, cred.secretKey, cred.token); err != nil {
 			return nil, fmt.Errorf("Unable to get endpoint of bucket %s: %s", hostParts[0], err)
 		}
 		if uri, err = url.ParseRequestURI(endpoint); err != nil {
@@ -304,18 +324,100 @@ func newCOS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 	}
 
 	b := &cos.BaseURL{BucketURL: uri}
-	client := cos.NewClient(b, &http.Client{
-		Transport: &cos.AuthorizationTransport{
-			SecretID:     accessKey,
-			SecretKey:    secretKey,
-			SessionToken: token,
-			Transport:    httpClient.Transport,
-		},
-	})
+	auth := &cos.AuthorizationTransport{
+		SecretID:     cred.accessKey,
+		SecretKey:    cred.secretKey,
+		SessionToken: cred.token,
+		Transport:    httpClient.Transport,
+	}
+	client := cos.NewClient(b, &http.Client{Transport: auth})
 	client.UserAgent = UserAgent
+	if roleCred != nil {
+		keepRefreshing(role.roleArn, roleCred.expire, func() (*tempCred, error) {
+			return tencentAssumeRole(accessKey, secretKey, token, cosRegion(uri.Host), role)
+		}, func(c *tempCred) {
+			auth.SetCredential(c.accessKey, c.secretKey, c.token)
+		})
+	}
 	return &COS{c: client, endpoint: uri.Host}, nil
 }
 
+// cosRegion returns the region in endpoint <bucket>-<appid>.cos.<region>.myqcloud.com
+func cosRegion(host string) string {
+	parts := strings.Split(host, ".")
+	if len(parts) > 3 && parts[1] == "cos" {
+		return parts[2]
+	}
+	return "ap-guangzhou"
+}
+
+// tencentAssumeRole gets temporary credentials of the role from Tencent Cloud STS.
+func tencentAssumeRole(secretID, secretKey, token, region string, role *assumeRole) (*tempCred, error) {
+	const host = "sts.tencentcloudapi.com"
+	var nonce [4]byte
+	_, _ = rand.Read(nonce[:])
+	params := url.Values{}
+	params.Set("Action", "AssumeRole")
+	params.Set("Version", "2018-08-13")
+	params.Set("Region", region)
+	params.Set("Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	params.Set("Nonce", strconv.FormatUint(uint64(binary.BigEndian.Uint32(nonce[:])), 10))
+	params.Set("SecretId", secretID)
+	params.Set("RoleArn", role.roleArn)
+	params.Set("RoleSessionName", role.sessionName)
+	params.Set("DurationSeconds", strconv.Itoa(int(role.duration/time.Second)))
+	if role.externalID != "" {
+		params.Set("ExternalId", role.externalID)
+	}
+	if token != "" {
+		params.Set("Token", token)
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(k + "=" + params.Get(k))
+	}
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write([]byte("GET" + host + "/?" + buf.String()))
+	params.Set("Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	resp, err := httpClient.Get("https://" + host + "/?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup(resp)
+	var result struct {
+		Response struct {
+			Credentials struct {
+				Token        string
+				TmpSecretId  string
+				TmpSecretKey string
+			}
+			ExpiredTime int64
+			Error       *struct {
+				Code    string
+				Message string
+			}
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode response of AssumeRole: %s", err)
+	}
+	r := result.Response
+	if r.Error != nil {
+		return nil, fmt.Errorf("AssumeRole %s: %s: %s", role.roleArn, r.Error.Code, r.Error.Message)
+	}
+	c := r.Credentials
+	return &tempCred{c.TmpSecretId, c.TmpSecretKey, c.Token, time.Unix(r.ExpiredTime, 0)}, nil
+}
+
 func init() {
 	Register("cos", newCOS)
 }
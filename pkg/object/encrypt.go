@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -40,6 +41,26 @@ type Encryptor interface {
 	Decrypt(ciphertext []byte) ([]byte, error)
 }
 
+// KeyDeriver derives keys from the secret of an Encryptor, the same key is
+// returned for the same info, so it could be used to encrypt local data.
+type KeyDeriver interface {
+	DeriveKey(info string) ([]byte, error)
+}
+
+// DeriveKey derives a 32 bytes key for info from the secret of enc.
+func DeriveKey(enc Encryptor, info string) ([]byte, error) {
+	if d, ok := enc.(KeyDeriver); ok {
+		return d.DeriveKey(info)
+	}
+	return nil, errors.New("keys can't be derived from the encryption key, only RSA private key and master key in file are supported")
+}
+
+func hmacKey(secret []byte, info string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(info))
+	return h.Sum(nil)
+}
+
 type rsaEncryptor struct {
 	privKey *rsa.PrivateKey
 	label   []byte
@@ -133,6 +154,11 @@ func (e *rsaEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
 	return rsa.DecryptOAEP(sha256.New(), rand.Reader, e.privKey, ciphertext, e.label)
 }
 
+func (e *rsaEncryptor) DeriveKey(info string) ([]byte, error) {
+	secret := sha256.Sum256(x509.MarshalPKCS1PrivateKey(e.privKey))
+	return hmacKey(secret[:], info), nil
+}
+
 type dataEncryptor struct {
 	keyEncryptor Encryptor
 	keyLen       int
@@ -161,6 +187,10 @@ func NewDataEncryptor(keyEncryptor Encryptor, algo string) (Encryptor, error) {
 	return nil, fmt.Errorf("unsupport cipher: %s", algo)
 }
 
+func (e *dataEncryptor) DeriveKey(info string) ([]byte, error) {
+	return DeriveKey(e.keyEncryptor, info)
+}
+
 func (e *dataEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
 	key := make([]byte, e.keyLen)
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
@@ -234,6 +264,10 @@ func (e *encrypted) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
+	return e.decrypt(r, off, limit)
+}
+
+func (e *encrypted) decrypt(r io.ReadCloser, off, limit int64) (io.ReadCloser, error) {
 	defer r.Close()
 	ciphertext, err := io.ReadAll(r)
 	if err != nil {
@@ -255,6 +289,25 @@ func (e *encrypted) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (e *encrypted) Put(key string, in io.Reader) error {
+	return e.PutWithTags(key, in, nil)
+}
+
+func (e *encrypted) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	plain, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := e.enc.Encrypt(plain)
+	if err != nil {
+		return err
+	}
+	if tags == nil {
+		return e.ObjectStorage.Put(key, bytes.NewReader(ciphertext))
+	}
+	return PutWithTags(e.ObjectStorage, key, bytes.NewReader(ciphertext), tags)
+}
+
+func (e *encrypted) PutIfNotExists(key string, in io.Reader) error {
 	plain, err := io.ReadAll(in)
 	if err != nil {
 		return err
@@ -263,7 +316,47 @@ func (e *encrypted) Put(key string, in io.Reader) error {
 	if err != nil {
 		return err
 	}
-	return e.ObjectStorage.Put(key, bytes.NewReader(ciphertext))
+	return PutIfNotExists(e.ObjectStorage, key, bytes.NewReader(ciphertext))
+}
+
+func (e *encrypted) SetTags(key string, tags map[string]string) error {
+	if o, ok := e.ObjectStorage.(SupportTagging); ok {
+		return o.SetTags(key, tags)
+	}
+	return notSupported
+}
+
+func (e *encrypted) GetTags(key string) (map[string]string, error) {
+	if o, ok := e.ObjectStorage.(SupportTagging); ok {
+		return o.GetTags(key)
+	}
+	return nil, notSupported
+}
+
+func (e *encrypted) Restore(key string, days int, tier string) error {
+	if o, ok := e.ObjectStorage.(SupportRestore); ok {
+		return o.Restore(key, days, tier)
+	}
+	return notSupported
+}
+
+func (e *encrypted) ListVersions(key string) ([]*ObjectVersion, error) {
+	if o, ok := e.ObjectStorage.(SupportVersioning); ok {
+		return o.ListVersions(key)
+	}
+	return nil, notSupported
+}
+
+func (e *encrypted) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	o, ok := e.ObjectStorage.(SupportVersioning)
+	if !ok {
+		return nil, notSupported
+	}
+	r, err := o.GetVersion(key, versionID, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	return e.decrypt(r, off, limit)
 }
 
 var _ ObjectStorage = &encrypted{}
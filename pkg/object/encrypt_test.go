@@ -21,6 +21,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"io"
 	"os"
@@ -225,3 +226,37 @@ func TestEncryptedStore(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestMasterKey(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	path := filepath.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatalf("write key: %s", err)
+	}
+	kc, err := NewMasterKeyEncryptor("file://" + path)
+	if err != nil {
+		t.Fatalf("create master key encryptor: %s", err)
+	}
+	dc, _ := NewDataEncryptor(kc, AES256GCM_RSA)
+	ciphertext, err := dc.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatalf("encrypt: %s", err)
+	}
+	kc2, _ := NewAESEncryptor(key)
+	dc2, _ := NewDataEncryptor(kc2, AES256GCM_RSA)
+	plaintext, err := dc2.Decrypt(ciphertext)
+	if err != nil || string(plaintext) != "hello" {
+		t.Fatalf("decrypt: %q %s", plaintext, err)
+	}
+
+	key[0]++
+	kc3, _ := NewAESEncryptor(key)
+	dc3, _ := NewDataEncryptor(kc3, AES256GCM_RSA)
+	if _, err = dc3.Decrypt(ciphertext); err == nil {
+		t.Fatalf("decrypt with wrong master key should fail")
+	}
+	if _, err = NewMasterKeyEncryptor("vault://abc"); err == nil {
+		t.Fatalf("unsupported master key should fail")
+	}
+}
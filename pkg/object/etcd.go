@@ -111,12 +111,12 @@ func genNextKey(key string) string {
 	return string(next)
 }
 
-func (c *etcdClient) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (c *etcdClient) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if delimiter != "" {
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
-	if marker == "" {
-		marker = prefix
+	if startAfter == "" {
+		startAfter = prefix
 	}
 	var opts = []etcd.OpOption{etcd.WithLimit(limit), etcd.WithSort(etcd.SortByKey, etcd.SortAscend)}
 	if len(prefix) > 0 && prefix[0] != 0xFF {
@@ -124,9 +124,9 @@ func (c *etcdClient) List(prefix, marker, delimiter string, limit int64) ([]Obje
 	} else {
 		opts = append(opts, etcd.WithFromKey())
 	}
-	resp, err := c.client.Get(context.Background(), marker, opts...)
+	resp, err := c.client.Get(context.Background(), startAfter, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("get start %v: %s", marker, err)
+		return nil, false, "", fmt.Errorf("get start %v: %s", startAfter, err)
 	}
 	var objs []Object
 	for _, kv := range resp.Kvs {
@@ -142,7 +142,7 @@ func (c *etcdClient) List(prefix, marker, delimiter string, limit int64) ([]Obje
 			"",
 		})
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func buildTlsConfig(u *url.URL) (*tls.Config, error) {
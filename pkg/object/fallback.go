@@ -0,0 +1,179 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var fallbacksCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "object_request_fallbacks",
+	Help: "requests to object store served by the replicas",
+}, []string{"method"})
+
+// fallback reads from the replicas (e.g. buckets replicated by the tools of provider) in order
+// when the object is missing or the primary is unavailable, all the writes go to the primary.
+type fallback struct {
+	ObjectStorage // the primary
+	replicas      []ObjectStorage
+}
+
+// NewFallback returns an object storage that reads from the replicas if the primary failed.
+func NewFallback(primary ObjectStorage, replicas ...ObjectStorage) ObjectStorage {
+	return &fallback{primary, replicas}
+}
+
+func (f *fallback) String() string {
+	return f.ObjectStorage.String()
+}
+
+func (f *fallback) Replicas() []ObjectStorage {
+	return f.replicas
+}
+
+func (f *fallback) SetStorageClass(sc string) {
+	if o, ok := f.ObjectStorage.(SupportStorageClass); ok {
+		o.SetStorageClass(sc)
+	}
+}
+
+func (f *fallback) PutIfNotExists(key string, in io.Reader) error {
+	return PutIfNotExists(f.ObjectStorage, key, in)
+}
+
+// shouldFallback returns true if the object is not found (404), the server failed (5xx)
+// or the circuit breaker is open.
+func shouldFallback(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, errCircuitOpen) {
+		return true
+	}
+	var code int
+	if e, ok := err.(interface{ StatusCode() int }); ok {
+		code = e.StatusCode()
+	}
+	if code == 404 || code >= 500 && code < 600 {
+		return true
+	}
+	return strings.Contains(err.Error(), "NoSuchKey") || errorClass(err) == ErrClassUnavailable
+}
+
+func (f *fallback) Head(key string) (Object, error) {
+	o, err := f.ObjectStorage.Head(key)
+	if !shouldFallback(err) {
+		return o, err
+	}
+	for _, r := range f.replicas {
+		if ro, rerr := r.Head(key); rerr == nil {
+			logger.Debugf("HEAD %s from replica %s: %s", key, r, err)
+			fallbacksCounter.WithLabelValues("HEAD").Inc()
+			return ro, nil
+		}
+	}
+	return o, err
+}
+
+func (f *fallback) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	in, err := f.ObjectStorage.Get(key, off, limit)
+	if !shouldFallback(err) {
+		return in, err
+	}
+	for _, r := range f.replicas {
+		if rin, rerr := r.Get(key, off, limit); rerr == nil {
+			logger.Debugf("GET %s from replica %s: %s", key, r, err)
+			fallbacksCounter.WithLabelValues("GET").Inc()
+			return rin, nil
+		}
+	}
+	return in, err
+}
+
+// PutWithTags creates the object in primary only, like Put.
+func (f *fallback) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	return PutWithTags(f.ObjectStorage, key, in, tags)
+}
+
+func (f *fallback) SetTags(key string, tags map[string]string) error {
+	if o, ok := f.ObjectStorage.(SupportTagging); ok {
+		return o.SetTags(key, tags)
+	}
+	return notSupported
+}
+
+func (f *fallback) GetTags(key string) (map[string]string, error) {
+	o, ok := f.ObjectStorage.(SupportTagging)
+	if !ok {
+		return nil, notSupported
+	}
+	tags, err := o.GetTags(key)
+	if !shouldFallback(err) {
+		return tags, err
+	}
+	for _, r := range f.replicas {
+		if ro, ok := r.(SupportTagging); ok {
+			if rtags, rerr := ro.GetTags(key); rerr == nil {
+				fallbacksCounter.WithLabelValues("GetTags").Inc()
+				return rtags, nil
+			}
+		}
+	}
+	return tags, err
+}
+
+// Restore restores the object in primary, or the replica it will be read from if it's missing
+// in primary.
+func (f *fallback) Restore(key string, days int, tier string) error {
+	o, ok := f.ObjectStorage.(SupportRestore)
+	if !ok {
+		return notSupported
+	}
+	err := o.Restore(key, days, tier)
+	if !shouldFallback(err) {
+		return err
+	}
+	for _, r := range f.replicas {
+		if ro, ok := r.(SupportRestore); ok {
+			if rerr := ro.Restore(key, days, tier); rerr == nil {
+				fallbacksCounter.WithLabelValues("Restore").Inc()
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// ListVersions and GetVersion work on the primary only, the versions of replicas are different.
+func (f *fallback) ListVersions(key string) ([]*ObjectVersion, error) {
+	if o, ok := f.ObjectStorage.(SupportVersioning); ok {
+		return o.ListVersions(key)
+	}
+	return nil, notSupported
+}
+
+func (f *fallback) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	if o, ok := f.ObjectStorage.(SupportVersioning); ok {
+		return o.GetVersion(key, versionID, off, limit)
+	}
+	return nil, notSupported
+}
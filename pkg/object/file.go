@@ -138,9 +138,22 @@ func (d *filestore) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (d *filestore) Put(key string, in io.Reader) error {
+	return d.put(key, in, false)
+}
+
+func (d *filestore) PutIfNotExists(key string, in io.Reader) error {
+	return d.put(key, in, true)
+}
+
+func (d *filestore) put(key string, in io.Reader, exclusive bool) error {
 	p := d.path(key)
 
 	if strings.HasSuffix(key, dirSuffix) || key == "" && strings.HasSuffix(d.root, dirSuffix) {
+		if exclusive {
+			if _, err := os.Stat(p); err == nil {
+				return os.ErrExist
+			}
+		}
 		return os.MkdirAll(p, os.FileMode(0755))
 	}
 
@@ -176,6 +189,15 @@ func (d *filestore) Put(key string, in io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if exclusive {
+		// link fails if the target exists, so it's atomic
+		err = os.Link(tmp, p)
+		_ = os.Remove(tmp)
+		if os.IsExist(err) {
+			err = os.ErrExist
+		}
+		return err
+	}
 	err = os.Rename(tmp, p)
 	return err
 }
@@ -320,30 +342,30 @@ func readDirSorted(dirname string) ([]*mEntry, error) {
 	return mEntries, err
 }
 
-func (d *filestore) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (d *filestore) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if delimiter != "/" {
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
 	var dir string = d.root + prefix
 	var objs []Object
 	if !strings.HasSuffix(dir, dirSuffix) {
 		dir = path.Dir(dir) + dirSuffix
-	} else if marker == "" {
+	} else if startAfter == "" {
 		obj, err := d.Head(prefix)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return nil, nil
+				return nil, false, "", nil
 			}
-			return nil, err
+			return nil, false, "", err
 		}
 		objs = append(objs, obj)
 	}
 	entries, err := readDirSorted(dir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil
+			return nil, false, "", nil
 		}
-		return nil, err
+		return nil, false, "", err
 	}
 	for _, e := range entries {
 		p := filepath.Join(dir, e.Name())
@@ -354,7 +376,7 @@ func (d *filestore) List(prefix, marker, delimiter string, limit int64) ([]Objec
 			continue
 		}
 		key := p[len(d.root):]
-		if !strings.HasPrefix(key, prefix) || (marker != "" && key <= marker) {
+		if !strings.HasPrefix(key, prefix) || (startAfter != "" && key <= startAfter) {
 			continue
 		}
 		info, err := e.Info()
@@ -368,7 +390,7 @@ func (d *filestore) List(prefix, marker, delimiter string, limit int64) ([]Objec
 			break
 		}
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 type WalkFunc func(path string, info fs.FileInfo, isSymlink bool, err error) error
@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func lgetxattr(p, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(p, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(p, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// GetXattrs returns the extended attributes of the file, POSIX ACLs are kept in the extended
+// attributes of system namespace by Linux.
+func (d *filestore) GetXattrs(key string) (map[string][]byte, error) {
+	p := d.path(key)
+	size, err := unix.Llistxattr(p, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		v, err := lgetxattr(p, name)
+		if err == unix.ENODATA {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		xattrs[name] = v
+	}
+	return xattrs, nil
+}
+
+func (d *filestore) SetXattrs(key string, xattrs map[string][]byte) error {
+	p := d.path(key)
+	var lastErr error
+	for name, value := range xattrs {
+		if err := unix.Lsetxattr(p, name, value, 0); err != nil {
+			lastErr = err
+			logger.Debugf("Set xattr %s of %s: %s", name, p, err)
+		}
+	}
+	return lastErr
+}
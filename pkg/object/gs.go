@@ -20,12 +20,18 @@
 package object
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,6 +40,7 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 type gs struct {
@@ -41,8 +48,9 @@ type gs struct {
 	client    *storage.Client
 	bucket    string
 	region    string
-	pageToken string
+	projectID string
 	sc        string
+	verify    bool // send CRC32C with uploads
 }
 
 func (g *gs) String() string {
@@ -51,11 +59,14 @@ func (g *gs) String() string {
 
 func (g *gs) Create() error {
 	// check if the bucket is already exists
-	if objs, err := g.List("", "", "", 1); err == nil && len(objs) > 0 {
+	if objs, _, _, err := g.List("", "", "", "", 1); err == nil && len(objs) > 0 {
 		return nil
 	}
 
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		projectID = g.projectID
+	}
 	if projectID == "" {
 		projectID, _ = metadata.ProjectID()
 	}
@@ -105,6 +116,24 @@ func (g *gs) Head(key string) (Object, error) {
 	}, nil
 }
 
+// Checksum returns the MD5 (not available for composite objects) or CRC32C of the object.
+func (g *gs) Checksum(key, algo string) (string, error) {
+	attrs, err := g.client.Bucket(g.bucket).Object(key).Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			err = os.ErrNotExist
+		}
+		return "", err
+	}
+	switch algo {
+	case "md5":
+		return hex.EncodeToString(attrs.MD5), nil
+	case "crc32c":
+		return fmt.Sprintf("%08x", attrs.CRC32C), nil
+	}
+	return "", nil
+}
+
 func (g *gs) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	reader, err := g.client.Bucket(g.bucket).Object(key).NewRangeReader(ctx, off, limit)
 	if err != nil {
@@ -116,6 +145,17 @@ func (g *gs) Get(key string, off, limit int64) (io.ReadCloser, error) {
 func (g *gs) Put(key string, data io.Reader) error {
 	writer := g.client.Bucket(g.bucket).Object(key).NewWriter(ctx)
 	writer.StorageClass = g.sc
+	if g.verify {
+		// GCS will reject the upload if the data does not match the CRC32C,
+		// and the downloads of full object are verified by the client.
+		buf, err := io.ReadAll(data)
+		if err != nil {
+			return err
+		}
+		writer.CRC32C = crc32.Checksum(buf, crc32c)
+		writer.SendCRC32C = true
+		data = bytes.NewReader(buf)
+	}
 	_, err := io.Copy(writer, data)
 	if err != nil {
 		return err
@@ -123,6 +163,14 @@ func (g *gs) Put(key string, data io.Reader) error {
 	return writer.Close()
 }
 
+func (g *gs) SetVerifyChecksum(verify bool) {
+	g.verify = verify
+}
+
+func (g *gs) DisableRetries() {
+	g.client.SetRetry(storage.WithPolicy(storage.RetryNever))
+}
+
 func (g *gs) Copy(dst, src string) error {
 	srcObj := g.client.Bucket(g.bucket).Object(src)
 	dstObj := g.client.Bucket(g.bucket).Object(dst)
@@ -141,33 +189,209 @@ func (g *gs) Delete(key string) error {
 	return nil
 }
 
-func (g *gs) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
-	if marker != "" && g.pageToken == "" {
-		// last page
-		return nil, nil
-	}
-	objectIterator := g.client.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: delimiter})
-	pager := iterator.NewPager(objectIterator, int(limit), g.pageToken)
+func (g *gs) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	objectIterator := g.client.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: delimiter, StartOffset: startAfter})
+	pager := iterator.NewPager(objectIterator, int(limit), token)
 	var entries []*storage.ObjectAttrs
 	nextPageToken, err := pager.NextPage(&entries)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
-	g.pageToken = nextPageToken
-	n := len(entries)
-	objs := make([]Object, n)
-	for i := 0; i < n; i++ {
-		item := entries[i]
+	objs := make([]Object, 0, len(entries))
+	for _, item := range entries {
+		if strings.HasPrefix(item.Name+item.Prefix, gsMultipartPrefix) && !strings.HasPrefix(prefix, gsMultipartPrefix) {
+			continue // the parts of multipart uploads
+		}
 		if delimiter != "" && item.Prefix != "" {
-			objs[i] = &obj{item.Prefix, 0, time.Unix(0, 0), true, item.StorageClass}
-		} else {
-			objs[i] = &obj{item.Name, item.Size, item.Updated, strings.HasSuffix(item.Name, "/"), item.StorageClass}
+			objs = append(objs, &obj{item.Prefix, 0, time.Unix(0, 0), true, item.StorageClass})
+		} else if item.Name != startAfter { // StartOffset is inclusive
+			objs = append(objs, &obj{item.Name, item.Size, item.Updated, strings.HasSuffix(item.Name, "/"), item.StorageClass})
 		}
 	}
 	if delimiter != "" {
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return objs, nextPageToken != "", nextPageToken, nil
+}
+
+// ListVersions lists the generations of the object, the noncurrent ones are kept in
+// the buckets with Object Versioning enabled.
+func (g *gs) ListVersions(key string) ([]*ObjectVersion, error) {
+	it := g.client.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: key, StartOffset: key, EndOffset: key + "\x00", Versions: true})
+	var versions []*ObjectVersion
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Name != key {
+			continue
+		}
+		o := &obj{key, attrs.Size, attrs.Updated, strings.HasSuffix(key, "/"), attrs.StorageClass}
+		versions = append(versions, &ObjectVersion{o, strconv.FormatInt(attrs.Generation, 10), attrs.Deleted.IsZero(), false})
+	}
+	sortVersions(versions)
+	return versions, nil
+}
+
+func (g *gs) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	gen, err := strconv.ParseInt(versionID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generation: %s", versionID)
+	}
+	return g.client.Bucket(g.bucket).Object(key).Generation(gen).NewRangeReader(ctx, off, limit)
+}
+
+// GCS has no native multipart upload, it's emulated by uploading the parts as temporary
+// objects under `.multipart/<uploadID>/` and composing them into the final object. The
+// temporary objects are hidden from List.
+const (
+	gsMultipartPrefix = ".multipart/"
+	gsMaxCompose      = 32 // max number of source objects in one compose request
+)
+
+func (g *gs) Limits() Limits {
+	return Limits{
+		IsSupportMultipartUpload: true,
+		IsSupportUploadPartCopy:  true,
+		MinPartSize:              5 << 20,
+		MaxPartSize:              5 << 30,
+		MaxPartCount:             10000,
+	}
+}
+
+func (g *gs) partName(uploadID string, num int) string {
+	return fmt.Sprintf("%s%s/%05d", gsMultipartPrefix, uploadID, num)
+}
+
+func (g *gs) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	uploadID := hex.EncodeToString(id[:])
+	// the info object records the key of upload, so it can be found by ListUploads
+	writer := g.client.Bucket(g.bucket).Object(gsMultipartPrefix + uploadID + "/info").NewWriter(ctx)
+	writer.Metadata = map[string]string{"key": key}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return &MultipartUpload{UploadID: uploadID, MinPartSize: 5 << 20, MaxCount: 10000}, nil
+}
+
+func (g *gs) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	writer := g.client.Bucket(g.bucket).Object(g.partName(uploadID, num)).NewWriter(ctx)
+	writer.ChunkSize = 0 // upload in a single request
+	if _, err := writer.Write(body); err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return &Part{Num: num, Size: len(body), ETag: g.partName(uploadID, num)}, nil
+}
+
+func (g *gs) UploadPartCopy(key string, uploadID string, num int, srcKey string, off, size int64) (*Part, error) {
+	reader, err := g.client.Bucket(g.bucket).Object(srcKey).NewRangeReader(ctx, off, size)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	writer := g.client.Bucket(g.bucket).Object(g.partName(uploadID, num)).NewWriter(ctx)
+	n, err := io.Copy(writer, reader)
+	if err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return &Part{Num: num, Size: int(n), ETag: g.partName(uploadID, num)}, nil
+}
+
+func (g *gs) AbortUpload(key string, uploadID string) {
+	it := g.client.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: gsMultipartPrefix + uploadID + "/"})
+	for {
+		attrs, err := it.Next()
+		if err != nil {
+			if err != iterator.Done {
+				logger.Warnf("list parts of upload %s: %s", uploadID, err)
+			}
+			return
+		}
+		if err = g.Delete(attrs.Name); err != nil {
+			logger.Warnf("delete part %s: %s", attrs.Name, err)
+		}
+	}
+}
+
+func (g *gs) compose(dst string, srcs []string) error {
+	bucket := g.client.Bucket(g.bucket)
+	objs := make([]*storage.ObjectHandle, len(srcs))
+	for i, name := range srcs {
+		objs[i] = bucket.Object(name)
+	}
+	composer := bucket.Object(dst).ComposerFrom(objs...)
+	if g.sc != "" {
+		composer.StorageClass = g.sc
+	}
+	_, err := composer.Run(ctx)
+	return err
+}
+
+func (g *gs) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Num < parts[j].Num })
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = p.ETag
+	}
+	// compose the parts level by level, since one request can only take 32 sources
+	for level := 0; len(names) > gsMaxCompose; level++ {
+		var next []string
+		for i := 0; i < len(names); i += gsMaxCompose {
+			end := i + gsMaxCompose
+			if end > len(names) {
+				end = len(names)
+			}
+			name := fmt.Sprintf("%s%s/compose-%d-%05d", gsMultipartPrefix, uploadID, level, i/gsMaxCompose)
+			if err := g.compose(name, names[i:end]); err != nil {
+				return err
+			}
+			next = append(next, name)
+		}
+		names = next
+	}
+	if err := g.compose(key, names); err != nil {
+		return err
+	}
+	g.AbortUpload(key, uploadID)
+	return nil
+}
+
+func (g *gs) ListUploads(marker string) ([]*PendingPart, string, error) {
+	it := g.client.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: gsMultipartPrefix, StartOffset: marker})
+	var parts []*PendingPart
+	var nextMarker string
+	for len(parts) < 1000 {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return parts, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if attrs.Name <= marker || !strings.HasSuffix(attrs.Name, "/info") {
+			continue
+		}
+		uploadID := strings.TrimSuffix(strings.TrimPrefix(attrs.Name, gsMultipartPrefix), "/info")
+		parts = append(parts, &PendingPart{Key: attrs.Metadata["key"], UploadID: uploadID, Created: attrs.Created})
+		nextMarker = attrs.Name
+	}
+	return parts, nextMarker, nil
 }
 
 func (g *gs) SetStorageClass(sc string) {
@@ -189,11 +413,44 @@ func newGS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		region = hostParts[1]
 	}
 
-	client, err := storage.NewClient(ctx)
+	var opts []option.ClientOption
+	var projectID string
+	if path := uri.Query().Get("credentials-file"); path != "" {
+		creds, err := gsCredentials(path)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithCredentials(creds))
+		projectID = creds.ProjectID
+	}
+	client, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
-	return &gs{client: client, bucket: bucket, region: region}, nil
+	return &gs{client: client, bucket: bucket, region: region, projectID: projectID}, nil
+}
+
+// gsCredentials loads the credentials from a JSON file, which could be the key of service account, or
+// the configuration of workload identity federation (type `external_account`) generated by
+// `gcloud iam workload-identity-pools create-cred-config`, to exchange the credentials of AWS or
+// OIDC tokens for the access token of Google Cloud without keys of service account.
+func gsCredentials(path string) (*google.Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials file: %s", err)
+	}
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %s", path, err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, storage.ScopeFullControl)
+	if err != nil {
+		return nil, fmt.Errorf("load credentials from %s: %s", path, err)
+	}
+	logger.Debugf("Use credentials of %s from %s", f.Type, path)
+	return creds, nil
 }
 
 func init() {
@@ -175,21 +175,21 @@ func (h *hdfsclient) Delete(key string) error {
 	return err
 }
 
-func (h *hdfsclient) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (h *hdfsclient) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if delimiter != "/" {
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
 	dir := h.path(prefix)
 	var objs []Object
 	if !strings.HasSuffix(dir, "/") {
 		dir = filepath.Dir(dir) + dirSuffix
-	} else if marker == "" {
+	} else if startAfter == "" {
 		obj, err := h.Head(prefix)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return nil, nil
+				return nil, false, "", nil
 			}
-			return nil, err
+			return nil, false, "", err
 		}
 		objs = append(objs, obj)
 	}
@@ -201,9 +201,9 @@ func (h *hdfsclient) List(prefix, marker, delimiter string, limit int64) ([]Obje
 	}
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil
+			return nil, false, "", nil
 		}
-		return nil, err
+		return nil, false, "", err
 	}
 
 	// make sure they are ordered in full path
@@ -225,7 +225,7 @@ func (h *hdfsclient) List(prefix, marker, delimiter string, limit int64) ([]Obje
 			continue
 		}
 		key := p[len(h.basePath):]
-		if !strings.HasPrefix(key, prefix) || (marker != "" && key <= marker) {
+		if !strings.HasPrefix(key, prefix) || (startAfter != "" && key <= startAfter) {
 			continue
 		}
 		f := h.toFile(key, entryMap[name])
@@ -234,7 +234,7 @@ func (h *hdfsclient) List(prefix, marker, delimiter string, limit int64) ([]Obje
 			break
 		}
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func (h *hdfsclient) walk(path string, walkFn filepath.WalkFunc) error {
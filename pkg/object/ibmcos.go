@@ -159,11 +159,11 @@ func (s *ibmcos) Delete(key string) error {
 	return err
 }
 
-func (s *ibmcos) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (s *ibmcos) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	param := s3.ListObjectsInput{
 		Bucket:       &s.bucket,
 		Prefix:       &prefix,
-		Marker:       &marker,
+		Marker:       &startAfter,
 		MaxKeys:      &limit,
 		EncodingType: aws.String("url"),
 	}
@@ -172,7 +172,7 @@ func (s *ibmcos) List(prefix, marker, delimiter string, limit int64) ([]Object,
 	}
 	resp, err := s.s3.ListObjects(&param)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	n := len(resp.Contents)
 	objs := make([]Object, n)
@@ -180,7 +180,7 @@ func (s *ibmcos) List(prefix, marker, delimiter string, limit int64) ([]Object,
 		o := resp.Contents[i]
 		oKey, err := url.QueryUnescape(*o.Key)
 		if err != nil {
-			return nil, errors.WithMessagef(err, "failed to decode key %s", *o.Key)
+			return nil, false, "", errors.WithMessagef(err, "failed to decode key %s", *o.Key)
 		}
 		objs[i] = &obj{oKey, *o.Size, *o.LastModified, strings.HasSuffix(oKey, "/"), *o.StorageClass}
 	}
@@ -188,13 +188,13 @@ func (s *ibmcos) List(prefix, marker, delimiter string, limit int64) ([]Object,
 		for _, p := range resp.CommonPrefixes {
 			prefix, err := url.QueryUnescape(*p.Prefix)
 			if err != nil {
-				return nil, errors.WithMessagef(err, "failed to decode commonPrefixes %s", *p.Prefix)
+				return nil, false, "", errors.WithMessagef(err, "failed to decode commonPrefixes %s", *p.Prefix)
 			}
 			objs = append(objs, &obj{prefix, 0, time.Unix(0, 0), true, ""})
 		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func (s *ibmcos) ListAll(prefix, marker string) (<-chan Object, error) {
@@ -91,8 +91,10 @@ type ObjectStorage interface {
 
 	// Head returns some information about the object or an error if not found.
 	Head(key string) (Object, error)
-	// List returns a list of objects.
-	List(prefix, marker, delimiter string, limit int64) ([]Object, error)
+	// List returns a list of objects with the prefix after startAfter, which are continued from
+	// the token returned by previous call if the storage supports continuation token, or startAfter
+	// otherwise. It also returns whether there are more objects, and the token for next call.
+	List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error)
 	// ListAll returns all the objects as an channel.
 	ListAll(prefix, marker string) (<-chan Object, error)
 
@@ -0,0 +1,184 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// aesEncryptor wraps the data keys with a symmetric master key using AES-256-GCM.
+type aesEncryptor struct {
+	aead   cipher.AEAD
+	secret []byte
+}
+
+// NewAESEncryptor returns an Encryptor using the 32 bytes master key.
+func NewAESEncryptor(masterKey []byte) (Encryptor, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("invalid length of master key: %d, should be 32 bytes", len(masterKey))
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	secret := sha256.Sum256(masterKey)
+	return &aesEncryptor{aead, secret[:]}, nil
+}
+
+func (e *aesEncryptor) DeriveKey(info string) ([]byte, error) {
+	return hmacKey(e.secret, info), nil
+}
+
+func (e *aesEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plaintext)+e.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (e *aesEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	ns := e.aead.NonceSize()
+	if len(ciphertext) < ns+e.aead.Overhead() {
+		return nil, fmt.Errorf("misformed ciphertext: %d", len(ciphertext))
+	}
+	return e.aead.Open(nil, ciphertext[:ns], ciphertext[ns:], nil)
+}
+
+// kmsEncryptor wraps the data keys with a key managed by AWS KMS, the master
+// key never leaves KMS.
+type kmsEncryptor struct {
+	keyID  string
+	client *kms.KMS
+
+	sync.Mutex
+	cache map[string][]byte // ciphertext -> plaintext
+}
+
+const kmsCacheSize = 10000
+
+func newKMSEncryptor(keyID string) (Encryptor, error) {
+	config := aws.NewConfig()
+	if a, err := arn.Parse(keyID); err == nil {
+		config = config.WithRegion(a.Region)
+	}
+	ses, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create session: %s", err)
+	}
+	return &kmsEncryptor{keyID: keyID, client: kms.New(ses), cache: make(map[string][]byte)}, nil
+}
+
+func (e *kmsEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	out, err := e.client.Encrypt(&kms.EncryptInput{
+		KeyId:     aws.String(e.keyID),
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+func (e *kmsEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	e.Lock()
+	plain, ok := e.cache[string(ciphertext)]
+	e.Unlock()
+	if ok {
+		return plain, nil
+	}
+	out, err := e.client.Decrypt(&kms.DecryptInput{
+		KeyId:          aws.String(e.keyID),
+		CiphertextBlob: ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.Lock()
+	if len(e.cache) >= kmsCacheSize {
+		for k := range e.cache {
+			delete(e.cache, k)
+			break
+		}
+	}
+	e.cache[string(ciphertext)] = out.Plaintext
+	e.Unlock()
+	return out.Plaintext, nil
+}
+
+func loadMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	s := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s does not contain a 32 bytes key (raw, hex or base64)", path)
+}
+
+// NewMasterKeyEncryptor returns an Encryptor to wrap the data keys with the master key specified by uri:
+//
+//	awskms://<key-id or ARN>: a key in AWS KMS
+//	file://<path>: a file containing 32 bytes key (raw, hex or base64 encoded)
+func NewMasterKeyEncryptor(uri string) (Encryptor, error) {
+	p := strings.Index(uri, "://")
+	if p < 0 {
+		return nil, fmt.Errorf("invalid master key: %s", uri)
+	}
+	switch scheme, name := strings.ToLower(uri[:p]), uri[p+3:]; scheme {
+	case "awskms":
+		return newKMSEncryptor(name)
+	case "file":
+		key, err := loadMasterKey(name)
+		if err != nil {
+			return nil, fmt.Errorf("load master key: %s", err)
+		}
+		return NewAESEncryptor(key)
+	default:
+		return nil, fmt.Errorf("unsupported master key: %s", scheme)
+	}
+}
@@ -0,0 +1,321 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/juju/ratelimit"
+)
+
+// The classes of operations to be limited.
+const (
+	OpGet    = "get"    // Head, Get
+	OpPut    = "put"    // Put, Copy and multipart uploads
+	OpList   = "list"   // List, ListAll, ListUploads
+	OpDelete = "delete" // Delete, AbortUpload
+)
+
+var limitedOps = []string{OpGet, OpPut, OpList, OpDelete}
+
+// OpLimit is the limit for a class of operations, zero means unlimited.
+type OpLimit struct {
+	QPS      float64 // max number of requests per second
+	Inflight int     // max number of concurrent requests
+}
+
+type opLimiter struct {
+	bucket *ratelimit.Bucket
+	slots  chan struct{}
+}
+
+func (l *opLimiter) acquire() {
+	if l == nil {
+		return
+	}
+	if l.bucket != nil {
+		l.bucket.Wait(1)
+	}
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+func (l *opLimiter) release() {
+	if l != nil && l.slots != nil {
+		<-l.slots
+	}
+}
+
+type limited struct {
+	ObjectStorage
+	ops map[string]*opLimiter
+}
+
+// NewLimited returns an object storage that limits the QPS and concurrent requests
+// for each class of operations.
+func NewLimited(s ObjectStorage, limits map[string]OpLimit) ObjectStorage {
+	l := &limited{ObjectStorage: s, ops: make(map[string]*opLimiter)}
+	for op, limit := range limits {
+		var ol opLimiter
+		if limit.QPS > 0 {
+			capacity := int64(limit.QPS)
+			if capacity < 1 {
+				capacity = 1
+			}
+			ol.bucket = ratelimit.NewBucketWithRate(limit.QPS, capacity)
+		}
+		if limit.Inflight > 0 {
+			ol.slots = make(chan struct{}, limit.Inflight)
+		}
+		if ol.bucket != nil || ol.slots != nil {
+			l.ops[op] = &ol
+		}
+	}
+	if len(l.ops) == 0 {
+		return s
+	}
+	return l
+}
+
+// ParseOpLimits parses the limits from the query of bucket, for example:
+//
+//	max-get-qps=1000&max-get-inflight=100&max-put-qps=500
+//
+// The parsed parameters are removed from the query.
+func ParseOpLimits(query url.Values) (map[string]OpLimit, error) {
+	limits := make(map[string]OpLimit)
+	for _, op := range limitedOps {
+		var limit OpLimit
+		name := fmt.Sprintf("max-%s-qps", op)
+		if v := query.Get(name); v != "" {
+			qps, err := strconv.ParseFloat(v, 64)
+			if err != nil || qps < 0 {
+				return nil, fmt.Errorf("invalid %s: %s", name, v)
+			}
+			limit.QPS = qps
+			query.Del(name)
+		}
+		name = fmt.Sprintf("max-%s-inflight", op)
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s: %s", name, v)
+			}
+			limit.Inflight = n
+			query.Del(name)
+		}
+		if limit.QPS > 0 || limit.Inflight > 0 {
+			limits[op] = limit
+		}
+	}
+	return limits, nil
+}
+
+func (l *limited) String() string {
+	return l.ObjectStorage.String()
+}
+
+func (l *limited) SetStorageClass(sc string) {
+	if o, ok := l.ObjectStorage.(SupportStorageClass); ok {
+		o.SetStorageClass(sc)
+	}
+}
+
+func (l *limited) Head(key string) (Object, error) {
+	o := l.ops[OpGet]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.Head(key)
+}
+
+// releaseReader releases the slot of Get once the body is closed.
+type releaseReader struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseReader) Close() error {
+	r.once.Do(r.release)
+	return r.ReadCloser.Close()
+}
+
+func (l *limited) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	o := l.ops[OpGet]
+	o.acquire()
+	in, err := l.ObjectStorage.Get(key, off, limit)
+	if err != nil {
+		o.release()
+		return nil, err
+	}
+	return &releaseReader{ReadCloser: in, release: o.release}, nil
+}
+
+func (l *limited) Put(key string, in io.Reader) error {
+	o := l.ops[OpPut]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.Put(key, in)
+}
+
+func (l *limited) PutIfNotExists(key string, in io.Reader) error {
+	o := l.ops[OpPut]
+	o.acquire()
+	defer o.release()
+	return PutIfNotExists(l.ObjectStorage, key, in)
+}
+
+func (l *limited) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	o := l.ops[OpPut]
+	o.acquire()
+	defer o.release()
+	return PutWithTags(l.ObjectStorage, key, in, tags)
+}
+
+func (l *limited) SetTags(key string, tags map[string]string) error {
+	o, ok := l.ObjectStorage.(SupportTagging)
+	if !ok {
+		return notSupported
+	}
+	ol := l.ops[OpPut]
+	ol.acquire()
+	defer ol.release()
+	return o.SetTags(key, tags)
+}
+
+func (l *limited) GetTags(key string) (map[string]string, error) {
+	o, ok := l.ObjectStorage.(SupportTagging)
+	if !ok {
+		return nil, notSupported
+	}
+	ol := l.ops[OpGet]
+	ol.acquire()
+	defer ol.release()
+	return o.GetTags(key)
+}
+
+func (l *limited) Restore(key string, days int, tier string) error {
+	o, ok := l.ObjectStorage.(SupportRestore)
+	if !ok {
+		return notSupported
+	}
+	ol := l.ops[OpPut]
+	ol.acquire()
+	defer ol.release()
+	return o.Restore(key, days, tier)
+}
+
+func (l *limited) ListVersions(key string) ([]*ObjectVersion, error) {
+	o, ok := l.ObjectStorage.(SupportVersioning)
+	if !ok {
+		return nil, notSupported
+	}
+	ol := l.ops[OpList]
+	ol.acquire()
+	defer ol.release()
+	return o.ListVersions(key)
+}
+
+func (l *limited) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	o, ok := l.ObjectStorage.(SupportVersioning)
+	if !ok {
+		return nil, notSupported
+	}
+	ol := l.ops[OpGet]
+	ol.acquire()
+	in, err := o.GetVersion(key, versionID, off, limit)
+	if err != nil {
+		ol.release()
+		return nil, err
+	}
+	return &releaseReader{ReadCloser: in, release: ol.release}, nil
+}
+
+func (l *limited) Copy(dst, src string) error {
+	o := l.ops[OpPut]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.Copy(dst, src)
+}
+
+func (l *limited) Delete(key string) error {
+	o := l.ops[OpDelete]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.Delete(key)
+}
+
+func (l *limited) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	o := l.ops[OpList]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.List(prefix, startAfter, token, delimiter, limit)
+}
+
+func (l *limited) ListAll(prefix, marker string) (<-chan Object, error) {
+	o := l.ops[OpList]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.ListAll(prefix, marker)
+}
+
+func (l *limited) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	o := l.ops[OpPut]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.CreateMultipartUpload(key)
+}
+
+func (l *limited) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	o := l.ops[OpPut]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.UploadPart(key, uploadID, num, body)
+}
+
+func (l *limited) UploadPartCopy(key string, uploadID string, num int, srcKey string, off, size int64) (*Part, error) {
+	o := l.ops[OpPut]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.UploadPartCopy(key, uploadID, num, srcKey, off, size)
+}
+
+func (l *limited) AbortUpload(key string, uploadID string) {
+	o := l.ops[OpDelete]
+	o.acquire()
+	defer o.release()
+	l.ObjectStorage.AbortUpload(key, uploadID)
+}
+
+func (l *limited) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	o := l.ops[OpPut]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.CompleteUpload(key, uploadID, parts)
+}
+
+func (l *limited) ListUploads(marker string) ([]*PendingPart, string, error) {
+	o := l.ops[OpList]
+	o.acquire()
+	defer o.release()
+	return l.ObjectStorage.ListUploads(marker)
+}
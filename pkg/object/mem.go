@@ -34,6 +34,7 @@ type mobj struct {
 	mode  os.FileMode
 	owner string
 	group string
+	tags  map[string]string
 }
 
 type memStore struct {
@@ -114,6 +115,58 @@ func (m *memStore) Put(key string, in io.Reader) error {
 	return nil
 }
 
+func (m *memStore) PutIfNotExists(key string, in io.Reader) error {
+	m.Lock()
+	defer m.Unlock()
+	if key == "" {
+		return errors.New("object key cannot be empty")
+	}
+	if _, ok := m.objects[key]; ok {
+		return os.ErrExist
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	m.objects[key] = &mobj{data: data, mtime: time.Now()}
+	return nil
+}
+
+func (m *memStore) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	if err := m.Put(key, in); err != nil {
+		return err
+	}
+	return m.SetTags(key, tags)
+}
+
+func (m *memStore) SetTags(key string, tags map[string]string) error {
+	m.Lock()
+	defer m.Unlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return os.ErrNotExist
+	}
+	o.tags = make(map[string]string, len(tags))
+	for k, v := range tags {
+		o.tags[k] = v
+	}
+	return nil
+}
+
+func (m *memStore) GetTags(key string) (map[string]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	tags := make(map[string]string, len(o.tags))
+	for k, v := range o.tags {
+		tags[k] = v
+	}
+	return tags, nil
+}
+
 func (m *memStore) Copy(dst, src string) error {
 	d, err := m.Get(src, 0, -1)
 	if err != nil {
@@ -129,14 +182,14 @@ func (m *memStore) Delete(key string) error {
 	return nil
 }
 
-func (m *memStore) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (m *memStore) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	m.Lock()
 	defer m.Unlock()
 
 	objs := make([]Object, 0)
 	commonPrefixsMap := make(map[string]bool, 0)
 	for k := range m.objects {
-		if strings.HasPrefix(k, prefix) && k > marker {
+		if strings.HasPrefix(k, prefix) && k > startAfter {
 			o := m.objects[k]
 			if delimiter != "" {
 				remainString := strings.TrimPrefix(k, prefix)
@@ -186,7 +239,7 @@ func (m *memStore) List(prefix, marker, delimiter string, limit int64) ([]Object
 	if int64(len(objs)) > limit {
 		objs = objs[:limit]
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func (m *memStore) ListAll(prefix, marker string) (<-chan Object, error) {
@@ -0,0 +1,409 @@
+//go:build !nonfs
+// +build !nonfs
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/vmware/go-nfs-client/nfs"
+	"github.com/vmware/go-nfs-client/nfs/rpc"
+)
+
+type nfsStore struct {
+	DefaultObjectStorage
+	host   string
+	export string
+	root   string
+	auth   rpc.Auth
+
+	mu     sync.Mutex
+	mount  *nfs.Mount
+	target *nfs.Target
+}
+
+func (n *nfsStore) String() string {
+	return fmt.Sprintf("nfs://%s:%s/%s", n.host, n.export, n.root)
+}
+
+// connect (re)mounts the export if the current target is not usable
+func (n *nfsStore) connect() (*nfs.Target, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.target != nil {
+		return n.target, nil
+	}
+	mount, err := nfs.DialMount(n.host)
+	if err != nil {
+		return nil, fmt.Errorf("dial MOUNT service on %s: %s", n.host, err)
+	}
+	target, err := mount.Mount(n.export, n.auth)
+	if err != nil {
+		mount.Close()
+		return nil, fmt.Errorf("mount %s:%s: %s", n.host, n.export, err)
+	}
+	n.mount, n.target = mount, target
+	return target, nil
+}
+
+// check drops the target when the connection to server is broken,
+// so the export will be mounted again by next request.
+func (n *nfsStore) check(t *nfs.Target, err error) {
+	var ne net.Error
+	if err == nil || !errors.As(err, &ne) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return
+	}
+	n.mu.Lock()
+	if n.target == t {
+		logger.Warnf("reconnect to NFS server %s: %s", n.host, err)
+		_ = t.Close()
+		_ = n.mount.Close()
+		n.target, n.mount = nil, nil
+	}
+	n.mu.Unlock()
+}
+
+func (n *nfsStore) path(key string) string {
+	if p := strings.TrimSuffix(n.root+key, dirSuffix); p != "" {
+		return p
+	}
+	return "."
+}
+
+func (n *nfsStore) fileInfo(key string, fi os.FileInfo) Object {
+	o := &obj{key, fi.Size(), fi.ModTime(), fi.IsDir(), ""}
+	if fi.IsDir() {
+		if key != "" && !strings.HasSuffix(key, dirSuffix) {
+			o.key += dirSuffix
+		}
+		o.size = 0
+	}
+	return o
+}
+
+func (n *nfsStore) mkdirAll(t *nfs.Target, p string) error {
+	if p == "" || p == "." || p == "/" {
+		return nil
+	}
+	fi, _, err := t.Lookup(p)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not directory", p)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if err = n.mkdirAll(t, path.Dir(p)); err != nil {
+		return err
+	}
+	_, err = t.Mkdir(p, 0755)
+	if err != nil && os.IsExist(err) {
+		err = nil
+	}
+	return err
+}
+
+func (n *nfsStore) Create() error {
+	t, err := n.connect()
+	if err != nil {
+		return err
+	}
+	err = n.mkdirAll(t, n.path(""))
+	n.check(t, err)
+	return err
+}
+
+func (n *nfsStore) Head(key string) (Object, error) {
+	t, err := n.connect()
+	if err != nil {
+		return nil, err
+	}
+	fi, _, err := t.Lookup(n.path(key))
+	n.check(t, err)
+	if err != nil {
+		return nil, err
+	}
+	return n.fileInfo(key, fi), nil
+}
+
+func (n *nfsStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	t, err := n.connect()
+	if err != nil {
+		return nil, err
+	}
+	p := n.path(key)
+	fi, _, err := t.Lookup(p)
+	if err != nil {
+		n.check(t, err)
+		return nil, err
+	}
+	if fi.IsDir() || off > fi.Size() {
+		return io.NopCloser(bytes.NewBuffer([]byte{})), nil
+	}
+	f, err := t.Open(p)
+	if err != nil {
+		n.check(t, err)
+		return nil, err
+	}
+	if off > 0 {
+		if _, err = f.Seek(off, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	if limit > 0 {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, limit), f}, nil
+	}
+	return f, nil
+}
+
+func (n *nfsStore) Put(key string, in io.Reader) error {
+	t, err := n.connect()
+	if err != nil {
+		return err
+	}
+	defer func() { n.check(t, err) }()
+
+	p := n.path(key)
+	if strings.HasSuffix(key, dirSuffix) {
+		err = n.mkdirAll(t, p)
+		return err
+	}
+	// there is no rename in the client, so the object is written in place
+	// and removed if anything goes wrong
+	_ = t.Remove(p)
+	f, err := t.OpenFile(p, 0644)
+	if err != nil && os.IsNotExist(err) {
+		if err = n.mkdirAll(t, path.Dir(p)); err != nil {
+			return err
+		}
+		f, err = t.OpenFile(p, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	_, err = io.CopyBuffer(f, in, *buf)
+	if err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err != nil {
+		_ = t.Remove(p)
+	}
+	return err
+}
+
+func (n *nfsStore) Delete(key string) error {
+	t, err := n.connect()
+	if err != nil {
+		return err
+	}
+	p := n.path(key)
+	if strings.HasSuffix(key, dirSuffix) {
+		err = t.RmDir(p)
+	} else {
+		err = t.Remove(p)
+	}
+	if err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	n.check(t, err)
+	return err
+}
+
+func (n *nfsStore) readDir(t *nfs.Target, dir string) ([]Object, error) {
+	entries, err := t.ReadDirPlus(n.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]Object, 0, len(entries))
+	for _, e := range entries {
+		if e.FileName == "." || e.FileName == ".." {
+			continue
+		}
+		objs = append(objs, n.fileInfo(dir+e.FileName, e))
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
+	return objs, nil
+}
+
+func (n *nfsStore) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	if delimiter != "/" {
+		return nil, false, "", notSupported
+	}
+	var objs []Object
+	dir := prefix
+	if !strings.HasSuffix(dir, dirSuffix) {
+		dir = path.Dir(dir) + dirSuffix
+		if dir == "./" {
+			dir = ""
+		}
+	} else if startAfter == "" {
+		o, err := n.Head(prefix)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, false, "", nil
+			}
+			return nil, false, "", err
+		}
+		objs = append(objs, o)
+	}
+
+	t, err := n.connect()
+	if err != nil {
+		return nil, false, "", err
+	}
+	entries, err := n.readDir(t, dir)
+	if err != nil {
+		n.check(t, err)
+		if os.IsNotExist(err) {
+			return nil, false, "", nil
+		}
+		return nil, false, "", err
+	}
+	for _, o := range entries {
+		key := o.Key()
+		if !strings.HasPrefix(key, prefix) || (startAfter != "" && key <= startAfter) {
+			continue
+		}
+		objs = append(objs, o)
+		if len(objs) == int(limit) {
+			break
+		}
+	}
+	return generateListResult(objs, limit)
+}
+
+func (n *nfsStore) walk(t *nfs.Target, dir, prefix, marker string, out chan<- Object) error {
+	entries, err := n.readDir(t, dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, o := range entries {
+		key := o.Key()
+		if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) && key > marker {
+			out <- o
+		}
+		if o.IsDir() && (key > marker || strings.HasPrefix(marker, key)) {
+			if err = n.walk(t, key, prefix, marker, out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (n *nfsStore) ListAll(prefix, marker string) (<-chan Object, error) {
+	t, err := n.connect()
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Object, 10240)
+	go func() {
+		defer close(out)
+		if prefix == "" && marker == "" {
+			if o, err := n.Head(""); err == nil {
+				out <- o
+			}
+		}
+		if err := n.walk(t, "", prefix, marker, out); err != nil {
+			logger.Errorf("list %s: %s", n.path(prefix), err)
+			n.check(t, err)
+			out <- nil
+		}
+	}()
+	return out, nil
+}
+
+// newNFSStore creates a storage on NFS export, the endpoint should be in the
+// format of `host:/export/path/`. The access key could be used to specify the
+// user (name or uid) to access the export, current user is used by default.
+func newNFSStore(endpoint, username, pass, token string) (ObjectStorage, error) {
+	endpoint = strings.TrimPrefix(endpoint, "nfs://")
+	idx := strings.Index(endpoint, ":")
+	if idx <= 0 {
+		return nil, fmt.Errorf("invalid endpoint %s, expected host:/export/path", endpoint)
+	}
+	host, p := endpoint[:idx], path.Clean("/"+endpoint[idx+1:])
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if username != "" {
+		if uid = utils.LookupUser(username); uid < 0 {
+			return nil, fmt.Errorf("invalid user: %s", username)
+		}
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if uid < 0 { // windows
+		uid, gid = 65534, 65534
+	}
+	hostname, _ := os.Hostname()
+	n := &nfsStore{
+		host: host,
+		auth: rpc.NewAuthUnix(hostname, uint32(uid), uint32(gid)).Auth(),
+	}
+
+	// find the export by trying the parent directories, the rest of path
+	// is used as the root inside the export
+	var err error
+	for n.export = p; ; n.export = path.Dir(n.export) {
+		if _, err = n.connect(); err == nil || n.export == "/" {
+			break
+		}
+		logger.Debugf("mount %s:%s: %s", host, n.export, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n.root = strings.TrimPrefix(p[len(n.export):], "/"); n.root != "" {
+		n.root += dirSuffix
+	}
+	return n, nil
+}
+
+func init() {
+	Register("nfs", newNFSStore)
+}
@@ -18,6 +18,7 @@ package object
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -47,6 +48,116 @@ type SupportStorageClass interface {
 	SetStorageClass(sc string)
 }
 
+// SupportReplicas is implemented by the storages which have replicas of the data.
+type SupportReplicas interface {
+	Replicas() []ObjectStorage
+}
+
+type SupportTagging interface {
+	// PutWithTags creates the object with the tags in one request.
+	PutWithTags(key string, in io.Reader, tags map[string]string) error
+	// SetTags replaces the tags of the object.
+	SetTags(key string, tags map[string]string) error
+	// GetTags returns the tags of the object.
+	GetTags(key string) (map[string]string, error)
+}
+
+type SupportChecksum interface {
+	// SetVerifyChecksum enables verifying the data against the checksum calculated
+	// by object storage (e.g. ETag or CRC32C) on upload and download.
+	SetVerifyChecksum(verify bool)
+}
+
+// SupportRetries is implemented by the storages whose SDK retries the failed requests.
+type SupportRetries interface {
+	// DisableRetries turns off the retries of SDK.
+	DisableRetries()
+}
+
+type SupportObjectChecksum interface {
+	// Checksum returns the checksum (in hex) of the whole object calculated by object storage
+	// in the algorithm (md5 or crc32c), or an empty string if it's not available.
+	Checksum(key, algo string) (string, error)
+}
+
+type SupportXattr interface {
+	// GetXattrs returns the extended attributes of an object, POSIX ACLs are included as
+	// system.posix_acl_access and system.posix_acl_default in the format of Linux.
+	GetXattrs(key string) (map[string][]byte, error)
+	// SetXattrs sets the extended attributes (and POSIX ACLs) of an object.
+	SetXattrs(key string, xattrs map[string][]byte) error
+}
+
+// SupportFingerprint is implemented by the file systems (JuiceFS) which could tell whether a range of
+// a file is changed from the metadata, so only the changed ranges are synced.
+type SupportFingerprint interface {
+	// Fingerprints returns the size of ranges and the fingerprints of all the ranges of a file,
+	// the fingerprint of a range is changed once its data is changed.
+	Fingerprints(key string) (rangeSize int64, fps []string, err error)
+	// SourceFingerprints returns the fingerprints of the source saved by SetSourceFingerprints,
+	// or nil if they are not saved or the file is changed after saved.
+	SourceFingerprints(key string) ([]string, error)
+	// SetSourceFingerprints saves the fingerprints of the source which the file is synced from.
+	SetSourceFingerprints(key string, fps []string) error
+	// WriteAt overwrites a range of an existing file.
+	WriteAt(key string, in io.Reader, off int64) error
+	// Truncate changes the size of an existing file.
+	Truncate(key string, size int64) error
+}
+
+// SupportClone is implemented by the file systems (JuiceFS) which could copy a file by metadata.
+type SupportClone interface {
+	// Locate returns the identity of the volume and the path of key in it.
+	Locate(key string) (volume, path string, err error)
+	// CloneFrom clones the file at path of the same volume to key, the existing one is replaced.
+	CloneFrom(path, key string) error
+}
+
+type SupportRestore interface {
+	// Restore requests to restore an archived object (e.g. in Glacier, Archive or Cold Archive)
+	// for some days with the tier of retrieval. It returns immediately and the object will be
+	// readable after minutes or hours, nil is returned if it's being restored already.
+	Restore(key string, days int, tier string) error
+}
+
+type SupportVersioning interface {
+	// ListVersions returns all the versions of the object (including delete markers) in the
+	// buckets with versioning enabled, the latest one comes first.
+	ListVersions(key string) ([]*ObjectVersion, error)
+	// GetVersion reads a version of the object, which may be noncurrent.
+	GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error)
+}
+
+type SupportConditionalPut interface {
+	// PutIfNotExists creates the object only if the key does not exist,
+	// os.ErrExist is returned if it exists already.
+	PutIfNotExists(key string, in io.Reader) error
+}
+
+// PutIfNotExists creates the object only if the key does not exist. It's atomic
+// for the storages that support conditional put, otherwise the object is checked
+// before put and it could be overwritten by concurrent writers.
+func PutIfNotExists(s ObjectStorage, key string, in io.Reader) error {
+	if c, ok := s.(SupportConditionalPut); ok {
+		return c.PutIfNotExists(key, in)
+	}
+	if _, err := s.Head(key); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) && !errors.Is(err, notSupported) {
+		return err
+	}
+	return s.Put(key, in)
+}
+
+// PutWithTags creates the object with the tags, the tags are dropped if the storage does not
+// support tagging.
+func PutWithTags(s ObjectStorage, key string, in io.Reader, tags map[string]string) error {
+	if t, ok := s.(SupportTagging); ok {
+		return t.PutWithTags(key, in, tags)
+	}
+	return s.Put(key, in)
+}
+
 type File interface {
 	Object
 	Owner() string
@@ -148,8 +259,18 @@ func (s DefaultObjectStorage) ListUploads(marker string) ([]*PendingPart, string
 	return nil, "", nil
 }
 
-func (s DefaultObjectStorage) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
-	return nil, notSupported
+func (s DefaultObjectStorage) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	return nil, false, "", notSupported
+}
+
+// generateListResult returns the result of List for the storages which don't support continuation
+// token, the last key is returned as the token.
+func generateListResult(objs []Object, limit int64) ([]Object, bool, string, error) {
+	var next string
+	if len(objs) > 0 {
+		next = objs[len(objs)-1].Key()
+	}
+	return objs, int64(len(objs)) >= limit, next, nil
 }
 
 func (s DefaultObjectStorage) ListAll(prefix, marker string) (<-chan Object, error) {
@@ -167,6 +288,10 @@ func Register(name string, register Creator) {
 func CreateStorage(name, endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
 	f, ok := storages[name]
 	if ok {
+		var err error
+		if endpoint, err = extractProxy(endpoint); err != nil {
+			return nil, err
+		}
 		logger.Debugf("Creating %s storage at endpoint %s", name, endpoint)
 		return f(endpoint, accessKey, secretKey, token)
 	}
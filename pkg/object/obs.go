@@ -21,8 +21,12 @@ package object
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -36,7 +40,6 @@ import (
 
 	"github.com/huaweicloud/huaweicloud-sdk-go-obs/obs"
 	"github.com/juicedata/juicefs/pkg/utils"
-	"golang.org/x/net/http/httpproxy"
 )
 
 const obsDefaultRegion = "cn-north-1"
@@ -183,10 +186,10 @@ func (s *obsClient) Delete(key string) error {
 	return err
 }
 
-func (s *obsClient) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (s *obsClient) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	input := &obs.ListObjectsInput{
 		Bucket: s.bucket,
-		Marker: marker,
+		Marker: startAfter,
 	}
 	input.Prefix = prefix
 	input.MaxKeys = int(limit)
@@ -194,7 +197,7 @@ func (s *obsClient) List(prefix, marker, delimiter string, limit int64) ([]Objec
 	input.EncodingType = "url"
 	resp, err := s.c.ListObjects(input)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	n := len(resp.Contents)
 	objs := make([]Object, n)
@@ -202,7 +205,7 @@ func (s *obsClient) List(prefix, marker, delimiter string, limit int64) ([]Objec
 		o := resp.Contents[i]
 		key, err := obs.UrlDecode(o.Key)
 		if err != nil {
-			return nil, errors.WithMessagef(err, "failed to decode key %s", o.Key)
+			return nil, false, "", errors.WithMessagef(err, "failed to decode key %s", o.Key)
 		}
 		objs[i] = &obj{key, o.Size, o.LastModified, strings.HasSuffix(key, "/"), string(o.StorageClass)}
 	}
@@ -210,13 +213,13 @@ func (s *obsClient) List(prefix, marker, delimiter string, limit int64) ([]Objec
 		for _, p := range resp.CommonPrefixes {
 			prefix, err := obs.UrlDecode(p)
 			if err != nil {
-				return nil, errors.WithMessagef(err, "failed to decode commonPrefixes %s", p)
+				return nil, false, "", errors.WithMessagef(err, "failed to decode commonPrefixes %s", p)
 			}
 			objs = append(objs, &obj{prefix, 0, time.Unix(0, 0), true, ""})
 		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func (s *obsClient) ListAll(prefix, marker string) (<-chan Object, error) {
@@ -357,14 +360,28 @@ func newOBS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		endpoint = fmt.Sprintf("%s://%s", uri.Scheme, hostParts[1])
 	}
 
+	role, err := parseAssumeRole(uri.Query())
+	if err != nil {
+		return nil, err
+	}
 	if accessKey == "" {
 		accessKey = os.Getenv("HWCLOUD_ACCESS_KEY")
 		secretKey = os.Getenv("HWCLOUD_SECRET_KEY")
 	}
 
+	// the credentials of IAM user are kept to assume the role again before it expires
+	var roleCred *tempCred
+	cred := &tempCred{accessKey: accessKey, secretKey: secretKey, token: token}
+	if role != nil {
+		if roleCred, err = huaweiAssumeRole(accessKey, secretKey, token, role); err != nil {
+			return nil, err
+		}
+		cred = roleCred
+	}
+
 	var region string
 	if len(hostParts) == 1 {
-		if endpoint, err = autoOBSEndpoint(bucketName, accessKey, secretKey, token); err != nil {
+		if endpoint, err = autoOBSEndpoint(bucketName, cred.accessKey, cred.secretKey, cred.token); err != nil {
 			return nil, fmt.Errorf("cannot get location of bucket %s: %q", bucketName, err)
 		}
 		if !strings.HasPrefix(endpoint, "http") {
@@ -374,11 +391,11 @@ func newOBS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		region = strings.Split(hostParts[1], ".")[1]
 	}
 
-	// Use proxy setting from environment variables: HTTP_PROXY, HTTPS_PROXY, NO_PROXY
+	// Use proxy set for the endpoint or from environment variables: HTTP_PROXY, HTTPS_PROXY, NO_PROXY
 	if uri, err = url.ParseRequestURI(endpoint); err != nil {
 		return nil, fmt.Errorf("invalid endpoint %s: %q", endpoint, err)
 	}
-	proxyURL, err := httpproxy.FromEnvironment().ProxyFunc()(uri)
+	proxyURL, err := proxyForURL(uri)
 	if err != nil {
 		return nil, fmt.Errorf("get proxy url for endpoint: %s error: %q", endpoint, err)
 	}
@@ -389,7 +406,7 @@ func newOBS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 
 	// Empty proxy url string has no effect
 	// there is a bug in the retry of PUT (did not call Seek(0,0) before retry), so disable the retry here
-	c, err := obs.New(accessKey, secretKey, endpoint, obs.WithSecurityToken(token),
+	c, err := obs.New(cred.accessKey, cred.secretKey, endpoint, obs.WithSecurityToken(cred.token),
 		obs.WithProxyUrl(urlString), obs.WithMaxRetryCount(0), obs.WithHttpTransport(httpClient.Transport.(*http.Transport)))
 	if err != nil {
 		return nil, fmt.Errorf("fail to initialize OBS: %q", err)
@@ -402,9 +419,117 @@ func newOBS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 			logger.Warnf("get bucket encryption: %q", err)
 		}
 	}
+	if roleCred != nil {
+		keepRefreshing(role.roleArn, roleCred.expire, func() (*tempCred, error) {
+			return huaweiAssumeRole(accessKey, secretKey, token, role)
+		}, func(cred *tempCred) {
+			c.Refresh(cred.accessKey, cred.secretKey, cred.token)
+		})
+	}
 	return &obsClient{bucket: bucketName, region: region, checkEtag: checkEtag, c: c}, nil
 }
 
+var huaweiIAMEndpoint = "https://iam.myhuaweicloud.com"
+
+// huaweiAssumeRole gets temporary credentials of the agency from Huawei Cloud IAM, the role is
+// specified as iam::<account-id>:agency:<agency-name>.
+func huaweiAssumeRole(accessKey, secretKey, token string, role *assumeRole) (*tempCred, error) {
+	ps := strings.Split(role.roleArn, ":")
+	if len(ps) != 5 || ps[0] != "iam" || ps[3] != "agency" || ps[2] == "" || ps[4] == "" {
+		return nil, fmt.Errorf("invalid agency %s, should be iam::<account-id>:agency:<agency-name>", role.roleArn)
+	}
+	if role.externalID != "" {
+		return nil, fmt.Errorf("external-id is not supported by Huawei Cloud")
+	}
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Methods    []string `json:"methods"`
+				AssumeRole struct {
+					DomainID        string `json:"domain_id"`
+					AgencyName      string `json:"agency_name"`
+					DurationSeconds int    `json:"duration_seconds"`
+					SessionUser     struct {
+						Name string `json:"name"`
+					} `json:"session_user"`
+				} `json:"assume_role"`
+			} `json:"identity"`
+		} `json:"auth"`
+	}
+	id := &req.Auth.Identity
+	id.Methods = []string{"assume_role"}
+	id.AssumeRole.DomainID, id.AssumeRole.AgencyName = ps[2], ps[4]
+	id.AssumeRole.DurationSeconds = int(role.duration / time.Second)
+	id.AssumeRole.SessionUser.Name = role.sessionName
+	body, _ := json.Marshal(&req)
+
+	r, err := http.NewRequest("POST", huaweiIAMEndpoint+"/v3.0/OS-CREDENTIAL/securitytokens", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json;charset=utf8")
+	if token != "" {
+		r.Header.Set("X-Security-Token", token)
+	}
+	huaweiSign(r, accessKey, secretKey, body, time.Now())
+	resp, err := httpClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup(resp)
+	var result struct {
+		Credential struct {
+			Access        string `json:"access"`
+			Secret        string `json:"secret"`
+			SecurityToken string `json:"securitytoken"`
+			ExpiresAt     string `json:"expires_at"`
+		} `json:"credential"`
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode response of AssumeRole: %s", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("AssumeRole %s: %d %s: %s", role.roleArn, resp.StatusCode, result.Error.Code, result.Error.Message)
+	}
+	c := result.Credential
+	expire, err := time.Parse(time.RFC3339Nano, c.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiration: %s, %s", c.ExpiresAt, err)
+	}
+	return &tempCred{c.Access, c.Secret, c.SecurityToken, expire}, nil
+}
+
+// huaweiSign signs the request of Huawei Cloud API with AK/SK (SDK-HMAC-SHA256).
+func huaweiSign(r *http.Request, accessKey, secretKey string, body []byte, now time.Time) {
+	r.Header.Set("X-Sdk-Date", now.UTC().Format("20060102T150405Z"))
+	r.Header.Set("Host", r.URL.Host)
+	var names []string
+	for k := range r.Header {
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, k := range names {
+		headers.WriteString(k + ":" + strings.TrimSpace(r.Header.Get(k)) + "\n")
+	}
+	uri := r.URL.EscapedPath()
+	if !strings.HasSuffix(uri, "/") {
+		uri += "/"
+	}
+	signed := strings.Join(names, ";")
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{r.Method, uri, r.URL.RawQuery, headers.String(), signed, hex.EncodeToString(bodyHash[:])}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "SDK-HMAC-SHA256\n" + r.Header.Get("X-Sdk-Date") + "\n" + hex.EncodeToString(canonicalHash[:])
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac.Write([]byte(toSign))
+	r.Header.Set("Authorization", fmt.Sprintf("SDK-HMAC-SHA256 Access=%s, SignedHeaders=%s, Signature=%s", accessKey, signed, hex.EncodeToString(mac.Sum(nil))))
+}
+
 func init() {
 	Register("obs", newOBS)
 }
@@ -46,22 +46,22 @@ func (s *oos) Limits() Limits {
 }
 
 func (s *oos) Create() error {
-	_, err := s.List("", "", "", 1)
+	_, _, _, err := s.List("", "", "", "", 1)
 	if err != nil {
 		return fmt.Errorf("please create bucket %s manually", s.s3client.bucket)
 	}
 	return err
 }
 
-func (s *oos) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (s *oos) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if limit > 1000 {
 		limit = 1000
 	}
-	objs, err := s.s3client.List(prefix, marker, delimiter, limit)
-	if marker != "" && len(objs) > 0 && objs[0].Key() == marker {
+	objs, hasMore, next, err := s.s3client.List(prefix, startAfter, token, delimiter, limit)
+	if startAfter != "" && len(objs) > 0 && objs[0].Key() == startAfter {
 		objs = objs[1:]
 	}
-	return objs, err
+	return objs, hasMore, next, err
 }
 
 func newOOS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
@@ -21,6 +21,11 @@ package object
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -39,9 +44,10 @@ import (
 const ossDefaultRegionID = "cn-hangzhou"
 
 type ossClient struct {
-	client *oss.Client
-	bucket *oss.Bucket
-	sc     string
+	client  *oss.Client
+	bucket  *oss.Bucket
+	sc      string
+	restore *restoreOptions
 }
 
 func (o *ossClient) String() string {
@@ -129,10 +135,28 @@ func (o *ossClient) Get(key string, off, limit int64) (resp io.ReadCloser, err e
 				resp.(*oss.Response).Headers.Get(oss.HTTPHeaderOssMetaPrefix+checksumAlgr))
 		}
 	}
+	if e, ok := err.(oss.ServiceError); ok && e.Code == "InvalidObjectState" {
+		return nil, restoreArchived(o, key, o.restore)
+	}
 	err = o.checkError(err)
 	return
 }
 
+func (o *ossClient) Restore(key string, days int, tier string) error {
+	conf := oss.RestoreConfiguration{Days: int32(days)}
+	// the tier of retrieval is only applicable to Cold Archive and Deep Cold Archive
+	if r, err := o.bucket.GetObjectDetailedMeta(key); err == nil {
+		if sc := r.Get(oss.HTTPHeaderOssStorageClass); sc == string(oss.StorageColdArchive) || sc == "DeepColdArchive" {
+			conf.Tier = tier
+		}
+	}
+	err := o.bucket.RestoreObjectDetail(key, conf)
+	if e, ok := err.(oss.ServiceError); ok && e.Code == "RestoreAlreadyInProgress" {
+		err = nil
+	}
+	return o.checkError(err)
+}
+
 func (o *ossClient) Put(key string, in io.Reader) error {
 	var option []oss.Option
 	if ins, ok := in.(io.ReadSeeker); ok {
@@ -157,14 +181,17 @@ func (o *ossClient) Delete(key string) error {
 	return o.checkError(o.bucket.DeleteObject(key))
 }
 
-func (o *ossClient) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (o *ossClient) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if limit > 1000 {
 		limit = 1000
 	}
+	if token != "" {
+		startAfter = token
+	}
 	result, err := o.bucket.ListObjects(oss.Prefix(prefix),
-		oss.Marker(marker), oss.Delimiter(delimiter), oss.MaxKeys(int(limit)))
+		oss.Marker(startAfter), oss.Delimiter(delimiter), oss.MaxKeys(int(limit)))
 	if o.checkError(err) != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	n := len(result.Objects)
 	objs := make([]Object, n)
@@ -178,7 +205,7 @@ func (o *ossClient) List(prefix, marker, delimiter string, limit int64) ([]Objec
 		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return objs, result.IsTruncated, result.NextMarker, nil
 }
 
 func (o *ossClient) ListAll(prefix, marker string) (<-chan Object, error) {
@@ -337,6 +364,74 @@ func (o *ossClient) refreshToken() time.Time {
 	return expire
 }
 
+// percentEncode encodes the string following the RPC signature of Alibaba Cloud.
+func percentEncode(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.ReplaceAll(s, "+", "%20")
+	s = strings.ReplaceAll(s, "*", "%2A")
+	return strings.ReplaceAll(s, "%7E", "~")
+}
+
+// aliyunAssumeRole gets temporary credentials of the role from Alibaba Cloud STS.
+func aliyunAssumeRole(accessKey, secretKey, token string, role *assumeRole) (*tempCred, error) {
+	var nonce [8]byte
+	_, _ = rand.Read(nonce[:])
+	params := map[string]string{
+		"Format":           "JSON",
+		"Version":          "2015-04-01",
+		"AccessKeyId":      accessKey,
+		"SignatureMethod":  "HMAC-SHA1",
+		"SignatureVersion": "1.0",
+		"SignatureNonce":   hex.EncodeToString(nonce[:]),
+		"Timestamp":        time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		"Action":           "AssumeRole",
+		"RoleArn":          role.roleArn,
+		"RoleSessionName":  role.sessionName,
+		"DurationSeconds":  strconv.Itoa(int(role.duration / time.Second)),
+	}
+	if role.externalID != "" {
+		params["ExternalId"] = role.externalID
+	}
+	if token != "" {
+		params["SecurityToken"] = token
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = percentEncode(k) + "=" + percentEncode(params[k])
+	}
+	query := strings.Join(pairs, "&")
+	mac := hmac.New(sha1.New, []byte(secretKey+"&"))
+	mac.Write([]byte("GET&" + percentEncode("/") + "&" + percentEncode(query)))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	data, err := fetch("https://sts.aliyuncs.com/?" + query + "&Signature=" + percentEncode(signature))
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Code        string
+		Message     string
+		Credentials stsCred
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("decode response of AssumeRole: %s", err)
+	}
+	if result.Code != "" {
+		return nil, fmt.Errorf("AssumeRole %s: %s: %s", role.roleArn, result.Code, result.Message)
+	}
+	c := result.Credentials
+	expire, err := time.Parse("2006-01-02T15:04:05Z", c.Expiration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiration: %s, %s", c.Expiration, err)
+	}
+	return &tempCred{c.AccessKeyId, c.AccessKeySecret, c.SecurityToken, expire}, nil
+}
+
 func autoOSSEndpoint(bucketName, accessKey, secretKey, securityToken string) (string, error) {
 	var client *oss.Client
 	var err error
@@ -393,6 +488,10 @@ func newOSS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		domain = uri.Scheme + "://" + hostParts[1]
 	}
 
+	role, err := parseAssumeRole(uri.Query())
+	if err != nil {
+		return nil, err
+	}
 	var refresh bool
 	if accessKey == "" {
 		// try environment variable
@@ -412,14 +511,27 @@ func newOSS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		}
 	}
 
+	// the credentials of RAM user are kept to assume the role again before it expires
+	var roleCred *tempCred
+	cred := &tempCred{accessKey: accessKey, secretKey: secretKey, token: token}
+	if role != nil {
+		if refresh {
+			return nil, fmt.Errorf("assuming role requires access key of RAM user")
+		}
+		if roleCred, err = aliyunAssumeRole(accessKey, secretKey, token, role); err != nil {
+			return nil, err
+		}
+		cred = roleCred
+	}
+
 	if domain == "" {
-		if domain, err = autoOSSEndpoint(bucketName, accessKey, secretKey, token); err != nil {
+		if domain, err = autoOSSEndpoint(bucketName, cred.accessKey, cred.secretKey, cred.token); err != nil {
 			return nil, fmt.Errorf("Unable to get endpoint of bucket %s: %s", bucketName, err)
 		}
 		logger.Debugf("Use endpoint %q", domain)
 	}
 
-	client, err := oss.New(domain, accessKey, secretKey, oss.SecurityToken(token), oss.HTTPClient(httpClient))
+	client, err := oss.New(domain, cred.accessKey, cred.secretKey, oss.SecurityToken(cred.token), oss.HTTPClient(httpClient))
 	if err != nil {
 		return nil, fmt.Errorf("Cannot create OSS client with endpoint %s: %s", endpoint, err)
 	}
@@ -439,6 +551,18 @@ func newOSS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 	}
 
 	o := &ossClient{client: client, bucket: bucket}
+	if o.restore, err = parseRestoreOptions(uri.Query()); err != nil {
+		return nil, err
+	}
+	if roleCred != nil {
+		keepRefreshing(role.roleArn, roleCred.expire, func() (*tempCred, error) {
+			return aliyunAssumeRole(accessKey, secretKey, token, role)
+		}, func(c *tempCred) {
+			o.client.Config.AccessKeyID = c.accessKey
+			o.client.Config.AccessKeySecret = c.secretKey
+			o.client.Config.SecurityToken = c.token
+		})
+	}
 	if token != "" && refresh {
 		go func() {
 			for {
@@ -0,0 +1,173 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// maxPartitionDepth is the max levels of directories to split the keyspace.
+const maxPartitionDepth = 3
+
+// partition is a range of keyspace, which is either a single object or all the objects with the prefix.
+type partition struct {
+	obj    Object
+	prefix string
+}
+
+// listDir lists the objects and common prefixes directly under prefix.
+func listDir(store ObjectStorage, prefix string) ([]partition, error) {
+	var parts []partition
+	var last, token string
+	for {
+		objs, hasMore, nextToken, err := store.List(prefix, last, token, "/", maxResults)
+		if err != nil {
+			return nil, err
+		}
+		var progress bool
+		for _, o := range objs {
+			key := o.Key()
+			if len(parts) > 0 && key <= last {
+				continue // the common prefix could be returned again in the next page
+			}
+			if o.IsDir() && strings.HasSuffix(key, "/") && key != prefix {
+				parts = append(parts, partition{prefix: key})
+			} else {
+				parts = append(parts, partition{obj: o})
+			}
+			last = key
+			progress = true
+		}
+		if !hasMore || !progress {
+			return parts, nil
+		}
+		token = nextToken
+	}
+}
+
+// splitKeyspace splits the keyspace under prefix into ordered partitions by directories,
+// until there are enough partitions or reaching the max depth.
+func splitKeyspace(store ObjectStorage, prefix string, want int) ([]partition, error) {
+	parts, err := listDir(store, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for depth := 1; depth < maxPartitionDepth && len(parts) < want; depth++ {
+		var expanded []partition
+		var changed bool
+		for _, p := range parts {
+			if p.prefix == "" {
+				expanded = append(expanded, p)
+				continue
+			}
+			sub, err := listDir(store, p.prefix)
+			if err != nil {
+				logger.Warnf("Split keyspace under %s: %s", p.prefix, err)
+				expanded = append(expanded, p)
+				continue
+			}
+			expanded = append(expanded, sub...)
+			changed = true
+		}
+		parts = expanded
+		if !changed {
+			break
+		}
+	}
+	return parts, nil
+}
+
+// ListAllParallel returns all the objects after marker in order like ListAll, but the keyspace is split
+// into partitions by directories, which are listed concurrently by the threads. It's much faster for the
+// buckets with huge number of objects, and falls back to ListAll if listing with delimiter is not supported.
+func ListAllParallel(store ObjectStorage, prefix, marker string, threads int) (<-chan Object, error) {
+	if threads <= 1 {
+		return ListAll(store, prefix, marker)
+	}
+	start := time.Now()
+	parts, err := splitKeyspace(store, prefix, threads*4)
+	if err != nil {
+		if errors.Is(err, notSupported) {
+			return ListAll(store, prefix, marker)
+		}
+		return nil, err
+	}
+	logger.Debugf("Split keyspace of %s%s into %d partitions in %s", store, prefix, len(parts), time.Since(start))
+
+	chs := make(chan chan Object, threads)
+	go func() {
+		defer close(chs)
+		sem := make(chan struct{}, threads)
+		for _, p := range parts {
+			ch := make(chan Object, maxResults)
+			if p.prefix == "" {
+				if p.obj.Key() > marker {
+					ch <- p.obj
+				}
+				close(ch)
+				chs <- ch
+				continue
+			}
+			var mk string
+			if strings.HasPrefix(marker, p.prefix) {
+				mk = marker
+			} else if p.prefix < marker {
+				continue // all the keys in this partition are before marker
+			}
+			sem <- struct{}{}
+			chs <- ch
+			go func(p string) {
+				defer func() { <-sem }()
+				defer close(ch)
+				objs, err := ListAll(store, p, mk)
+				if err != nil {
+					logger.Errorf("List partition %s: %s", p, err)
+					ch <- nil
+					return
+				}
+				for o := range objs {
+					ch <- o
+				}
+			}(p.prefix)
+		}
+	}()
+
+	out := make(chan Object, maxResults)
+	go func() {
+		defer close(out)
+		for ch := range chs {
+			for o := range ch {
+				out <- o
+				if o == nil {
+					// failed listing, drain the rest in background
+					go func() {
+						for ch := range chs {
+							for range ch {
+							}
+						}
+					}()
+					for range ch {
+					}
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
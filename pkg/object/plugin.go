@@ -0,0 +1,552 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+)
+
+// A plugin is an executable that serves an object storage out of tree, which is started by
+// JuiceFS with the bucket of `plugin://<path of executable>?<endpoint of plugin>`. It's served by
+// go-plugin with net/rpc, and the data of Get and Put is streamed over separated connections. The
+// plugin is usually built with ServePlugin:
+//
+//	func main() {
+//		object.ServePlugin(newMyStorage)
+//	}
+//
+// The version of protocol is checked in the handshake, it should be increased when the RPC
+// interface is changed incompatibly.
+var pluginHandshake = plugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "JUICEFS_PLUGIN_COOKIE",
+	MagicCookieValue: "juicefs-object-storage",
+}
+
+const (
+	pluginName    = "storage"
+	pluginService = "Plugin" // the name of service registered by go-plugin
+)
+
+// PluginArgs is the arguments of the calls to plugin, only the fields needed by the method are set.
+type PluginArgs struct {
+	Endpoint, AccessKey, SecretKey, Token string // for Init
+
+	Key, Src, UploadID string
+	Prefix, StartAfter string
+	ContinuationToken  string
+	Delimiter          string
+	Off, Limit         int64
+	Num                int
+	Data               []byte
+	Stream             uint32 // the id of connection to send the data of Put
+	Parts              []*Part
+}
+
+// PluginObject is an object returned by plugin.
+type PluginObject struct {
+	Key          string
+	Size         int64
+	Mtime        time.Time
+	IsDir        bool
+	StorageClass string
+}
+
+// PluginReply is the result of the calls to plugin.
+type PluginReply struct {
+	Desc      string
+	Limits    Limits
+	Objects   []PluginObject
+	HasMore   bool
+	NextToken string
+	Stream    uint32 // the id of connection to receive the data of Get
+	Upload    *MultipartUpload
+	Part      *Part
+	Pending   []*PendingPart
+}
+
+// storagePlugin creates the both sides of plugin for go-plugin.
+type storagePlugin struct {
+	create Creator
+}
+
+func (s *storagePlugin) Server(b *plugin.MuxBroker) (interface{}, error) {
+	return &pluginServer{create: s.create, broker: b}, nil
+}
+
+func (s *storagePlugin) Client(b *plugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &pluginClient{broker: b, client: c}, nil
+}
+
+// sendStream writes the data in frames prefixed by their length, the last one is empty and
+// followed by the error of reading, so the receiver can tell a broken stream from the end.
+func sendStream(conn net.Conn, r io.Reader) error {
+	defer conn.Close()
+	bufp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bufp)
+	buf := *bufp
+	var head [4]byte
+	var err error
+	for {
+		var n int
+		n, err = r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(head[:], uint32(n))
+			if _, werr := conn.Write(head[:]); werr != nil {
+				return werr
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	var msg string
+	if err != io.EOF {
+		msg = toPluginError(err).Error()
+	} else {
+		err = nil
+	}
+	end := make([]byte, 8+len(msg))
+	binary.BigEndian.PutUint32(end[4:], uint32(len(msg)))
+	copy(end[8:], msg)
+	if _, werr := conn.Write(end); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// streamReader reads the frames written by sendStream.
+type streamReader struct {
+	conn net.Conn
+	r    *bufio.Reader
+	left uint32
+	err  error
+}
+
+func newStreamReader(conn net.Conn) *streamReader {
+	return &streamReader{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (s *streamReader) readLength() (uint32, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(s.r, head[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(head[:]), nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for s.left == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.left, s.err = s.readLength(); s.err != nil || s.left > 0 {
+			continue
+		}
+		// the end of stream
+		var n uint32
+		if n, s.err = s.readLength(); s.err != nil {
+			continue
+		}
+		msg := make([]byte, n)
+		if _, s.err = io.ReadFull(s.r, msg); s.err != nil {
+			continue
+		}
+		if n == 0 {
+			s.err = io.EOF
+		} else {
+			s.err = fromPluginMessage(string(msg))
+		}
+	}
+	if uint32(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.Read(p)
+	s.left -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		s.err, s.left = err, 0
+	}
+	return n, nil
+}
+
+func (s *streamReader) Close() error {
+	return s.conn.Close()
+}
+
+func toPluginObject(o Object) PluginObject {
+	return PluginObject{o.Key(), o.Size(), o.Mtime(), o.IsDir(), o.StorageClass()}
+}
+
+// toPluginError keeps the errors which have special meaning to the callers.
+func toPluginError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		return os.ErrNotExist
+	case errors.Is(err, os.ErrExist):
+		return os.ErrExist
+	case errors.Is(err, notSupported):
+		return notSupported
+	}
+	return err
+}
+
+func fromPluginMessage(msg string) error {
+	switch msg {
+	case os.ErrNotExist.Error():
+		return os.ErrNotExist
+	case os.ErrExist.Error():
+		return os.ErrExist
+	case notSupported.Error():
+		return notSupported
+	}
+	return errors.New(msg)
+}
+
+func fromPluginError(err error) error {
+	if e, ok := err.(rpc.ServerError); ok {
+		return fromPluginMessage(string(e))
+	}
+	return err
+}
+
+// pluginServer runs in the plugin and serves the calls with the object storage.
+type pluginServer struct {
+	create Creator
+	broker *plugin.MuxBroker
+	store  ObjectStorage
+}
+
+func (p *pluginServer) Init(args *PluginArgs, reply *PluginReply) (err error) {
+	if p.store, err = p.create(args.Endpoint, args.AccessKey, args.SecretKey, args.Token); err != nil {
+		return err
+	}
+	reply.Desc = p.store.String()
+	reply.Limits = p.store.Limits()
+	return nil
+}
+
+func (p *pluginServer) Create(args *PluginArgs, reply *PluginReply) error {
+	return toPluginError(p.store.Create())
+}
+
+func (p *pluginServer) Head(args *PluginArgs, reply *PluginReply) error {
+	o, err := p.store.Head(args.Key)
+	if err != nil {
+		return toPluginError(err)
+	}
+	reply.Objects = []PluginObject{toPluginObject(o)}
+	return nil
+}
+
+func (p *pluginServer) Get(args *PluginArgs, reply *PluginReply) error {
+	in, err := p.store.Get(args.Key, args.Off, args.Limit)
+	if err != nil {
+		return toPluginError(err)
+	}
+	id := p.broker.NextId()
+	go func() {
+		defer in.Close()
+		conn, err := p.broker.Accept(id)
+		if err != nil {
+			logger.Warnf("Accept the stream of %s: %s", args.Key, err)
+			return
+		}
+		if err = sendStream(conn, in); err != nil {
+			logger.Debugf("Send %s: %s", args.Key, err) // could be closed by JuiceFS
+		}
+	}()
+	reply.Stream = id
+	return nil
+}
+
+func (p *pluginServer) Put(args *PluginArgs, reply *PluginReply) error {
+	conn, err := p.broker.Dial(args.Stream)
+	if err != nil {
+		return fmt.Errorf("dial the stream of %s: %s", args.Key, err)
+	}
+	in := newStreamReader(conn)
+	defer in.Close()
+	return toPluginError(p.store.Put(args.Key, in))
+}
+
+func (p *pluginServer) Copy(args *PluginArgs, reply *PluginReply) error {
+	return toPluginError(p.store.Copy(args.Key, args.Src))
+}
+
+func (p *pluginServer) Delete(args *PluginArgs, reply *PluginReply) error {
+	return toPluginError(p.store.Delete(args.Key))
+}
+
+func (p *pluginServer) List(args *PluginArgs, reply *PluginReply) error {
+	objs, hasMore, next, err := p.store.List(args.Prefix, args.StartAfter, args.ContinuationToken, args.Delimiter, args.Limit)
+	if err != nil {
+		return toPluginError(err)
+	}
+	reply.Objects = make([]PluginObject, len(objs))
+	for i, o := range objs {
+		reply.Objects[i] = toPluginObject(o)
+	}
+	reply.HasMore, reply.NextToken = hasMore, next
+	return nil
+}
+
+func (p *pluginServer) CreateMultipartUpload(args *PluginArgs, reply *PluginReply) (err error) {
+	reply.Upload, err = p.store.CreateMultipartUpload(args.Key)
+	return toPluginError(err)
+}
+
+func (p *pluginServer) UploadPart(args *PluginArgs, reply *PluginReply) (err error) {
+	reply.Part, err = p.store.UploadPart(args.Key, args.UploadID, args.Num, args.Data)
+	return toPluginError(err)
+}
+
+func (p *pluginServer) UploadPartCopy(args *PluginArgs, reply *PluginReply) (err error) {
+	reply.Part, err = p.store.UploadPartCopy(args.Key, args.UploadID, args.Num, args.Src, args.Off, args.Limit)
+	return toPluginError(err)
+}
+
+func (p *pluginServer) AbortUpload(args *PluginArgs, reply *PluginReply) error {
+	p.store.AbortUpload(args.Key, args.UploadID)
+	return nil
+}
+
+func (p *pluginServer) CompleteUpload(args *PluginArgs, reply *PluginReply) error {
+	return toPluginError(p.store.CompleteUpload(args.Key, args.UploadID, args.Parts))
+}
+
+func (p *pluginServer) ListUploads(args *PluginArgs, reply *PluginReply) (err error) {
+	reply.Pending, reply.NextToken, err = p.store.ListUploads(args.Key)
+	return toPluginError(err)
+}
+
+// ServePlugin serves the object storage created by create as a plugin of JuiceFS, it should be
+// called by the main function of plugin and returns when JuiceFS closes the connection.
+func ServePlugin(create Creator) {
+	plugin.Serve(&plugin.ServeConfig{
+		HandshakeConfig: pluginHandshake,
+		Plugins:         plugin.PluginSet{pluginName: &storagePlugin{create: create}},
+	})
+}
+
+// pluginClient is the object storage in JuiceFS that forwards the calls to plugin.
+type pluginClient struct {
+	DefaultObjectStorage
+	path   string
+	desc   string
+	limits Limits
+	broker *plugin.MuxBroker
+	client *rpc.Client
+}
+
+func (p *pluginClient) call(method string, args *PluginArgs) (*PluginReply, error) {
+	var reply PluginReply
+	err := p.client.Call(pluginService+"."+method, args, &reply)
+	return &reply, fromPluginError(err)
+}
+
+func (p *pluginClient) String() string {
+	return fmt.Sprintf("plugin://%s(%s)/", p.path, p.desc)
+}
+
+func (p *pluginClient) Limits() Limits {
+	return p.limits
+}
+
+func (p *pluginClient) Create() error {
+	_, err := p.call("Create", &PluginArgs{})
+	return err
+}
+
+func (p *pluginClient) Head(key string) (Object, error) {
+	reply, err := p.call("Head", &PluginArgs{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Objects) != 1 {
+		return nil, fmt.Errorf("invalid reply of head %s: %d objects", key, len(reply.Objects))
+	}
+	o := reply.Objects[0]
+	return &obj{o.Key, o.Size, o.Mtime, o.IsDir, o.StorageClass}, nil
+}
+
+func (p *pluginClient) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	reply, err := p.call("Get", &PluginArgs{Key: key, Off: off, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.broker.Dial(reply.Stream)
+	if err != nil {
+		return nil, fmt.Errorf("dial the stream of %s: %s", key, err)
+	}
+	return newStreamReader(conn), nil
+}
+
+func (p *pluginClient) Put(key string, in io.Reader) error {
+	id := p.broker.NextId()
+	sent := make(chan error, 1)
+	go func() {
+		conn, err := p.broker.Accept(id)
+		if err != nil {
+			sent <- err
+			return
+		}
+		sent <- sendStream(conn, in)
+	}()
+	_, err := p.call("Put", &PluginArgs{Key: key, Stream: id})
+	if serr := <-sent; err == nil && serr != nil {
+		err = fmt.Errorf("send %s: %s", key, serr)
+	}
+	return err
+}
+
+func (p *pluginClient) Copy(dst, src string) error {
+	_, err := p.call("Copy", &PluginArgs{Key: dst, Src: src})
+	return err
+}
+
+func (p *pluginClient) Delete(key string) error {
+	_, err := p.call("Delete", &PluginArgs{Key: key})
+	return err
+}
+
+func (p *pluginClient) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	reply, err := p.call("List", &PluginArgs{Prefix: prefix, StartAfter: startAfter, ContinuationToken: token, Delimiter: delimiter, Limit: limit})
+	if err != nil {
+		return nil, false, "", err
+	}
+	objs := make([]Object, len(reply.Objects))
+	for i, o := range reply.Objects {
+		objs[i] = &obj{o.Key, o.Size, o.Mtime, o.IsDir, o.StorageClass}
+	}
+	return objs, reply.HasMore, reply.NextToken, nil
+}
+
+func (p *pluginClient) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	reply, err := p.call("CreateMultipartUpload", &PluginArgs{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Upload, nil
+}
+
+func (p *pluginClient) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	reply, err := p.call("UploadPart", &PluginArgs{Key: key, UploadID: uploadID, Num: num, Data: body})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Part, nil
+}
+
+func (p *pluginClient) UploadPartCopy(key string, uploadID string, num int, srcKey string, off, size int64) (*Part, error) {
+	reply, err := p.call("UploadPartCopy", &PluginArgs{Key: key, UploadID: uploadID, Num: num, Src: srcKey, Off: off, Limit: size})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Part, nil
+}
+
+func (p *pluginClient) AbortUpload(key string, uploadID string) {
+	_, _ = p.call("AbortUpload", &PluginArgs{Key: key, UploadID: uploadID})
+}
+
+func (p *pluginClient) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	_, err := p.call("CompleteUpload", &PluginArgs{Key: key, UploadID: uploadID, Parts: parts})
+	return err
+}
+
+func (p *pluginClient) ListUploads(marker string) ([]*PendingPart, string, error) {
+	reply, err := p.call("ListUploads", &PluginArgs{Key: marker})
+	if err != nil {
+		return nil, "", err
+	}
+	return reply.Pending, reply.NextToken, nil
+}
+
+func (p *pluginClient) init(endpoint, accessKey, secretKey, token string) error {
+	reply, err := p.call("Init", &PluginArgs{Endpoint: endpoint, AccessKey: accessKey, SecretKey: secretKey, Token: token})
+	if err != nil {
+		return fmt.Errorf("init plugin %s: %s", p.path, err)
+	}
+	p.desc, p.limits = reply.Desc, reply.Limits
+	return nil
+}
+
+// newPlugin starts the plugin of `plugin://<path of executable>?<endpoint of plugin>`.
+func newPlugin(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %s: %s", endpoint, err)
+	}
+	path := u.Host + u.Path
+	if path == "" {
+		return nil, fmt.Errorf("no executable of plugin in %s", endpoint)
+	}
+	client := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig:  pluginHandshake,
+		Plugins:          plugin.PluginSet{pluginName: &storagePlugin{}},
+		Cmd:              exec.Command(path),
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolNetRPC},
+		StartTimeout:     time.Second * 30,
+		Stderr:           os.Stderr, // the logs of plugin
+		Logger:           hclog.New(&hclog.LoggerOptions{Name: "plugin", Output: os.Stderr, Level: hclog.Warn}),
+	})
+	rpcClient, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, fmt.Errorf("start plugin %s: %s", path, err)
+	}
+	raw, err := rpcClient.Dispense(pluginName)
+	if err != nil {
+		client.Kill()
+		return nil, fmt.Errorf("dispense plugin %s: %s", path, err)
+	}
+	p := raw.(*pluginClient)
+	p.path = path
+	if err = p.init(u.RawQuery, accessKey, secretKey, token); err != nil {
+		client.Kill()
+		return nil, err
+	}
+	return p, nil
+}
+
+func init() {
+	Register("plugin", newPlugin)
+}
@@ -53,6 +53,124 @@ func (s *withPrefix) Readlink(name string) (string, error) {
 	return "", notSupported
 }
 
+func (p *withPrefix) PutIfNotExists(key string, in io.Reader) error {
+	return PutIfNotExists(p.os, p.prefix+key, in)
+}
+
+func (p *withPrefix) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	return PutWithTags(p.os, p.prefix+key, in, tags)
+}
+
+func (p *withPrefix) SetTags(key string, tags map[string]string) error {
+	if o, ok := p.os.(SupportTagging); ok {
+		return o.SetTags(p.prefix+key, tags)
+	}
+	return notSupported
+}
+
+func (p *withPrefix) GetTags(key string) (map[string]string, error) {
+	if o, ok := p.os.(SupportTagging); ok {
+		return o.GetTags(p.prefix + key)
+	}
+	return nil, notSupported
+}
+
+func (p *withPrefix) Restore(key string, days int, tier string) error {
+	if o, ok := p.os.(SupportRestore); ok {
+		return o.Restore(p.prefix+key, days, tier)
+	}
+	return notSupported
+}
+
+func (p *withPrefix) Checksum(key, algo string) (string, error) {
+	if o, ok := p.os.(SupportObjectChecksum); ok {
+		return o.Checksum(p.prefix+key, algo)
+	}
+	return "", nil
+}
+
+func (p *withPrefix) GetXattrs(key string) (map[string][]byte, error) {
+	if o, ok := p.os.(SupportXattr); ok {
+		return o.GetXattrs(p.prefix + key)
+	}
+	return nil, notSupported
+}
+
+func (p *withPrefix) SetXattrs(key string, xattrs map[string][]byte) error {
+	if o, ok := p.os.(SupportXattr); ok {
+		return o.SetXattrs(p.prefix+key, xattrs)
+	}
+	return notSupported
+}
+
+func (p *withPrefix) Fingerprints(key string) (int64, []string, error) {
+	if o, ok := p.os.(SupportFingerprint); ok {
+		return o.Fingerprints(p.prefix + key)
+	}
+	return 0, nil, notSupported
+}
+
+func (p *withPrefix) SourceFingerprints(key string) ([]string, error) {
+	if o, ok := p.os.(SupportFingerprint); ok {
+		return o.SourceFingerprints(p.prefix + key)
+	}
+	return nil, notSupported
+}
+
+func (p *withPrefix) SetSourceFingerprints(key string, fps []string) error {
+	if o, ok := p.os.(SupportFingerprint); ok {
+		return o.SetSourceFingerprints(p.prefix+key, fps)
+	}
+	return notSupported
+}
+
+func (p *withPrefix) WriteAt(key string, in io.Reader, off int64) error {
+	if o, ok := p.os.(SupportFingerprint); ok {
+		return o.WriteAt(p.prefix+key, in, off)
+	}
+	return notSupported
+}
+
+func (p *withPrefix) Truncate(key string, size int64) error {
+	if o, ok := p.os.(SupportFingerprint); ok {
+		return o.Truncate(p.prefix+key, size)
+	}
+	return notSupported
+}
+
+func (p *withPrefix) Locate(key string) (string, string, error) {
+	if o, ok := p.os.(SupportClone); ok {
+		return o.Locate(p.prefix + key)
+	}
+	return "", "", notSupported
+}
+
+func (p *withPrefix) CloneFrom(path, key string) error {
+	if o, ok := p.os.(SupportClone); ok {
+		return o.CloneFrom(path, p.prefix+key)
+	}
+	return notSupported
+}
+
+func (p *withPrefix) ListVersions(key string) ([]*ObjectVersion, error) {
+	o, ok := p.os.(SupportVersioning)
+	if !ok {
+		return nil, notSupported
+	}
+	versions, err := o.ListVersions(p.prefix + key)
+	for _, v := range versions {
+		v.Object = p.updateKey(v.Object)
+	}
+	return versions, err
+}
+
+func (p *withPrefix) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	if o, ok := p.os.(SupportVersioning); ok {
+		return o.GetVersion(p.prefix+key, versionID, off, limit)
+	}
+	return nil, notSupported
+}
+
 func (p *withPrefix) String() string {
 	return fmt.Sprintf("%s%s", p.os, p.prefix)
 }
@@ -125,15 +243,15 @@ func (p *withPrefix) Delete(key string) error {
 	return p.os.Delete(p.prefix + key)
 }
 
-func (p *withPrefix) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
-	if marker != "" {
-		marker = p.prefix + marker
+func (p *withPrefix) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	if startAfter != "" {
+		startAfter = p.prefix + startAfter
 	}
-	objs, err := p.os.List(p.prefix+prefix, marker, delimiter, limit)
+	objs, hasMore, nextToken, err := p.os.List(p.prefix+prefix, startAfter, token, delimiter, limit)
 	for i, o := range objs {
 		objs[i] = p.updateKey(o)
 	}
-	return objs, err
+	return objs, hasMore, nextToken, err
 }
 
 func (p *withPrefix) ListAll(prefix, marker string) (<-chan Object, error) {
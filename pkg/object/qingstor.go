@@ -180,14 +180,14 @@ func (q *qingstor) Delete(key string) error {
 	return err
 }
 
-func (q *qingstor) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (q *qingstor) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if limit > 1000 {
 		limit = 1000
 	}
 	limit_ := int(limit)
 	input := &qs.ListObjectsInput{
 		Prefix: &prefix,
-		Marker: &marker,
+		Marker: &startAfter,
 		Limit:  &limit_,
 	}
 	if delimiter != "" {
@@ -195,7 +195,7 @@ func (q *qingstor) List(prefix, marker, delimiter string, limit int64) ([]Object
 	}
 	out, err := q.bucket.ListObjects(input)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	n := len(out.Keys)
 	objs := make([]Object, n)
@@ -215,7 +215,7 @@ func (q *qingstor) List(prefix, marker, delimiter string, limit int64) ([]Object
 		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func (q *qingstor) ListAll(prefix, marker string) (<-chan Object, error) {
@@ -39,10 +39,9 @@ import (
 
 type qiniu struct {
 	s3client
-	bm     *storage.BucketManager
-	cred   *auth.Credentials
-	cfg    *storage.Config
-	marker string
+	bm   *storage.BucketManager
+	cred *auth.Credentials
+	cfg  *storage.Config
 }
 
 func (q *qiniu) String() string {
@@ -145,42 +144,44 @@ func (q *qiniu) Delete(key string) error {
 	return err
 }
 
-func (q *qiniu) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (q *qiniu) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if limit > 1000 {
 		limit = 1000
 	}
-	if marker == "" {
-		q.marker = ""
-	} else if q.marker == "" {
-		// last page
-		return nil, nil
-	}
-	entries, prefixes, markerOut, hasNext, err := q.bm.ListFiles(q.bucket, prefix, delimiter, q.marker, int(limit))
-	for err == nil && len(entries) == 0 && hasNext {
-		entries, prefixes, markerOut, hasNext, err = q.bm.ListFiles(q.bucket, prefix, delimiter, markerOut, int(limit))
-	}
-	q.marker = markerOut
-	if len(entries) > 0 || err == io.EOF {
+	var objs []Object
+	for {
+		entries, prefixes, markerOut, hasNext, err := q.bm.ListFiles(q.bucket, prefix, delimiter, token, int(limit))
 		// ignore error if returned something
-		err = nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	n := len(entries)
-	objs := make([]Object, n)
-	for i := 0; i < n; i++ {
-		entry := entries[i]
-		mtime := entry.PutTime / 10000000
-		objs[i] = &obj{entry.Key, entry.Fsize, time.Unix(mtime, 0), strings.HasSuffix(entry.Key, "/"), ""}
+		if err != nil && err != io.EOF && len(entries) == 0 {
+			return nil, false, "", err
+		}
+		for _, entry := range entries {
+			if startAfter != "" && entry.Key <= startAfter {
+				continue
+			}
+			mtime := entry.PutTime / 10000000
+			objs = append(objs, &obj{entry.Key, entry.Fsize, time.Unix(mtime, 0), strings.HasSuffix(entry.Key, "/"), ""})
+		}
+		if delimiter != "" {
+			for _, p := range prefixes {
+				if p > startAfter {
+					objs = append(objs, &obj{p, 0, time.Unix(0, 0), true, ""})
+				}
+			}
+		}
+		token = ""
+		if hasNext {
+			token = markerOut
+		}
+		// the marker of qiniu is opaque, skip the pages before startAfter
+		if len(objs) > 0 || token == "" {
+			break
+		}
 	}
 	if delimiter != "" {
-		for _, p := range prefixes {
-			objs = append(objs, &obj{p, 0, time.Unix(0, 0), true, ""})
-		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return objs, token != "", token, nil
 }
 
 func newQiniu(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
@@ -241,7 +242,7 @@ func newQiniu(endpoint, accessKey, secretKey, token string) (ObjectStorage, erro
 	cfg.Zone = zone
 	cred := auth.New(accessKey, secretKey)
 	bucketManager := storage.NewBucketManager(cred, &cfg)
-	return &qiniu{s3client, bucketManager, cred, &cfg, ""}, nil
+	return &qiniu{s3client, bucketManager, cred, &cfg}, nil
 }
 
 func init() {
@@ -0,0 +1,230 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package object
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// modes to read from the replicas
+const (
+	ReplicaReadPrimary = "primary" // read from the primary, and the replicas only if it fails
+	ReplicaReadFastest = "fastest" // race the reads to all of them, and use the first response
+	ReplicaReadBalance = "balance" // read from the one with lowest latency recently
+)
+
+const (
+	replicaLatencyDecay = 0.2              // weight of new sample in the moving average of latency
+	replicaErrorPenalty = 10 * time.Second // latency for a failed request
+	replicaExploreRatio = 16               // read from a random one for every N requests
+)
+
+var replicaReadsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "object_replica_reads",
+	Help: "reads served by the primary (0) or the replicas (1, 2, ...)",
+}, []string{"replica"})
+
+// replicaReader reads from the primary and its replicas to reduce the latency (e.g. across regions),
+// by racing the reads or balancing them by the moving average of latency. The writes and other
+// requests still go to the primary.
+type replicaReader struct {
+	ObjectStorage // the primary
+	stores        []ObjectStorage
+	mode          string
+
+	sync.Mutex
+	latency  []float64 // moving average of latency in seconds
+	requests uint64
+}
+
+// NewReplicaReader returns an object storage that reads from the primary and the replicas by mode.
+func NewReplicaReader(primary ObjectStorage, replicas []ObjectStorage, mode string) (ObjectStorage, error) {
+	switch mode {
+	case "", ReplicaReadPrimary:
+		return primary, nil
+	case ReplicaReadFastest, ReplicaReadBalance:
+	default:
+		return nil, fmt.Errorf("invalid mode to read from replicas: %s", mode)
+	}
+	if len(replicas) == 0 {
+		return primary, nil
+	}
+	stores := append([]ObjectStorage{primary}, replicas...)
+	return &replicaReader{ObjectStorage: primary, stores: stores, mode: mode, latency: make([]float64, len(stores))}, nil
+}
+
+func (r *replicaReader) String() string {
+	return r.ObjectStorage.String()
+}
+
+func (r *replicaReader) SetStorageClass(sc string) {
+	if o, ok := r.ObjectStorage.(SupportStorageClass); ok {
+		o.SetStorageClass(sc)
+	}
+}
+
+func (r *replicaReader) PutIfNotExists(key string, in io.Reader) error {
+	return PutIfNotExists(r.ObjectStorage, key, in)
+}
+
+func (r *replicaReader) observe(i int, used time.Duration, err error) {
+	if err != nil {
+		used = replicaErrorPenalty
+	}
+	r.Lock()
+	if r.latency[i] == 0 {
+		r.latency[i] = used.Seconds()
+	} else {
+		r.latency[i] = (1-replicaLatencyDecay)*r.latency[i] + replicaLatencyDecay*used.Seconds()
+	}
+	r.Unlock()
+}
+
+// order returns the stores sorted by latency, the ones never used go first, and a random one
+// goes first periodically to keep the latency of others up to date.
+func (r *replicaReader) order() []int {
+	r.Lock()
+	defer r.Unlock()
+	idx := make([]int, len(r.stores))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return r.latency[idx[a]] < r.latency[idx[b]] })
+	r.requests++
+	if r.requests%replicaExploreRatio == 0 {
+		j := rand.Intn(len(idx))
+		idx[0], idx[j] = idx[j], idx[0]
+	}
+	return idx
+}
+
+func (r *replicaReader) get(i int, key string, off, limit int64) (io.ReadCloser, error) {
+	start := time.Now()
+	in, err := r.stores[i].Get(key, off, limit)
+	r.observe(i, time.Since(start), err)
+	if err == nil {
+		replicaReadsCounter.WithLabelValues(fmt.Sprint(i)).Inc()
+	}
+	return in, err
+}
+
+func (r *replicaReader) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if r.mode == ReplicaReadFastest {
+		return r.race(key, off, limit)
+	}
+	var firstErr error
+	for _, i := range r.order() {
+		in, err := r.get(i, key, off, limit)
+		if err == nil {
+			return in, nil
+		}
+		logger.Debugf("GET %s from %s: %s", key, r.stores[i], err)
+		if firstErr == nil || i == 0 {
+			firstErr = err // prefer the error from primary
+		}
+	}
+	return nil, firstErr
+}
+
+// race sends the read to all of them, the first successful response is returned and others are closed.
+func (r *replicaReader) race(key string, off, limit int64) (io.ReadCloser, error) {
+	type result struct {
+		i   int
+		in  io.ReadCloser
+		err error
+	}
+	results := make(chan result, len(r.stores))
+	for i := range r.stores {
+		go func(i int) {
+			in, err := r.get(i, key, off, limit)
+			results <- result{i, in, err}
+		}(i)
+	}
+	var firstErr error
+	for n := len(r.stores); n > 0; n-- {
+		res := <-results
+		if res.err == nil {
+			go func(left int) {
+				for ; left > 0; left-- {
+					if o := <-results; o.err == nil {
+						_ = o.in.Close()
+					}
+				}
+			}(n - 1)
+			return res.in, nil
+		}
+		if firstErr == nil || res.i == 0 {
+			firstErr = res.err
+		}
+	}
+	return nil, firstErr
+}
+
+func (r *replicaReader) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	return PutWithTags(r.ObjectStorage, key, in, tags)
+}
+
+func (r *replicaReader) SetTags(key string, tags map[string]string) error {
+	if o, ok := r.ObjectStorage.(SupportTagging); ok {
+		return o.SetTags(key, tags)
+	}
+	return notSupported
+}
+
+func (r *replicaReader) GetTags(key string) (map[string]string, error) {
+	if o, ok := r.ObjectStorage.(SupportTagging); ok {
+		return o.GetTags(key)
+	}
+	return nil, notSupported
+}
+
+// Restore restores the object in all of them since it could be read from any one, the error of
+// primary is returned.
+func (r *replicaReader) Restore(key string, days int, tier string) error {
+	o, ok := r.ObjectStorage.(SupportRestore)
+	if !ok {
+		return notSupported
+	}
+	for _, s := range r.stores[1:] {
+		if ro, ok := s.(SupportRestore); ok {
+			if err := ro.Restore(key, days, tier); err != nil {
+				logger.Warnf("Restore %s in replica %s: %s", key, s, err)
+			}
+		}
+	}
+	return o.Restore(key, days, tier)
+}
+
+func (r *replicaReader) ListVersions(key string) ([]*ObjectVersion, error) {
+	if o, ok := r.ObjectStorage.(SupportVersioning); ok {
+		return o.ListVersions(key)
+	}
+	return nil, notSupported
+}
+
+func (r *replicaReader) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	if o, ok := r.ObjectStorage.(SupportVersioning); ok {
+		return o.GetVersion(key, versionID, off, limit)
+	}
+	return nil, notSupported
+}
@@ -0,0 +1,341 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	replicateThreads   = 10
+	replicateRescan    = time.Minute * 5 // rescan the queue to retry the failed ones
+	replicateQueueSize = 10240           // size of the in-memory queue
+)
+
+// replicated writes the objects to both the primary and the mirror, and reads from the primary.
+// The mirror is updated before returning in sync mode, or in background by the persistent queue
+// in async mode, where the keys of pending objects are saved as files under the directory of queue,
+// so they can be replicated after restarted.
+type replicated struct {
+	ObjectStorage // the primary
+	mirror        ObjectStorage
+
+	queue   string // directory of queue, empty for sync mode
+	pending chan string
+	mu      sync.Mutex
+	queued  map[string]bool // key -> changed again after queued
+}
+
+// NewReplicated returns an object storage that replicates all the changes of primary to the mirror,
+// asynchronously if queueDir is not empty.
+func NewReplicated(primary, mirror ObjectStorage, queueDir string) (ObjectStorage, error) {
+	r := &replicated{ObjectStorage: primary, mirror: mirror, queue: queueDir}
+	if queueDir != "" {
+		if err := os.MkdirAll(queueDir, 0700); err != nil {
+			return nil, fmt.Errorf("create queue of replication %s: %s", queueDir, err)
+		}
+		r.pending = make(chan string, replicateQueueSize)
+		r.queued = make(map[string]bool)
+		for i := 0; i < replicateThreads; i++ {
+			go r.replicator()
+		}
+		go func() {
+			for {
+				r.rescan()
+				time.Sleep(replicateRescan)
+			}
+		}()
+	}
+	return r, nil
+}
+
+func (r *replicated) String() string {
+	return r.ObjectStorage.String()
+}
+
+func (r *replicated) Replicas() []ObjectStorage {
+	replicas := []ObjectStorage{r.mirror}
+	if o, ok := r.ObjectStorage.(SupportReplicas); ok {
+		replicas = append(replicas, o.Replicas()...)
+	}
+	return replicas
+}
+
+func (r *replicated) SetStorageClass(sc string) {
+	if o, ok := r.ObjectStorage.(SupportStorageClass); ok {
+		o.SetStorageClass(sc)
+	}
+	if o, ok := r.mirror.(SupportStorageClass); ok {
+		o.SetStorageClass(sc)
+	}
+}
+
+func (r *replicated) Create() error {
+	if err := r.ObjectStorage.Create(); err != nil {
+		return err
+	}
+	return r.mirror.Create()
+}
+
+func (r *replicated) queueFile(key string) string {
+	h := sha1.Sum([]byte(key))
+	return filepath.Join(r.queue, hex.EncodeToString(h[:]))
+}
+
+// persist saves the key in the queue before changing the primary, so it will be replicated
+// even if the process exits before that.
+func (r *replicated) persist(key string) error {
+	if err := os.WriteFile(r.queueFile(key), []byte(key), 0600); err != nil {
+		return fmt.Errorf("enqueue %s for replication: %s", key, err)
+	}
+	return nil
+}
+
+// async changes the primary by f and replicates the key in background.
+func (r *replicated) async(key string, f func() error) error {
+	if err := r.persist(key); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	r.push(key)
+	return nil
+}
+
+func (r *replicated) push(key string) {
+	r.mu.Lock()
+	if _, ok := r.queued[key]; ok {
+		r.queued[key] = true
+		r.mu.Unlock()
+		return
+	}
+	r.queued[key] = false
+	r.mu.Unlock()
+	r.pending <- key
+}
+
+// rescan loads the keys left in the queue, which were failed or not replicated before exit.
+func (r *replicated) rescan() {
+	entries, err := os.ReadDir(r.queue)
+	if err != nil {
+		logger.Warnf("Scan queue of replication %s: %s", r.queue, err)
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		key, err := os.ReadFile(filepath.Join(r.queue, e.Name()))
+		if err != nil {
+			logger.Warnf("Read queue of replication %s: %s", e.Name(), err)
+			continue
+		}
+		r.push(string(key))
+	}
+}
+
+func (r *replicated) replicator() {
+	for key := range r.pending {
+		err := r.replicate(key)
+		r.mu.Lock()
+		again := r.queued[key]
+		delete(r.queued, key)
+		r.mu.Unlock()
+		if again {
+			go r.push(key) // changed during replication
+			continue
+		}
+		if err != nil {
+			logger.Warnf("Replicate %s to %s: %s, will retry later", key, r.mirror, err)
+			continue
+		}
+		if err = os.Remove(r.queueFile(key)); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("Remove %s from queue of replication: %s", key, err)
+		}
+	}
+}
+
+// replicate copies the object from primary to mirror, or deletes it from mirror if it's not in primary.
+func (r *replicated) replicate(key string) error {
+	if _, err := r.ObjectStorage.Head(key); err != nil {
+		if os.IsNotExist(err) {
+			return r.mirror.Delete(key)
+		}
+		return err
+	}
+	in, err := r.ObjectStorage.Get(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	return r.mirror.Put(key, bytes.NewReader(data))
+}
+
+func (r *replicated) Put(key string, in io.Reader) error {
+	return r.PutWithTags(key, in, nil)
+}
+
+// PutWithTags creates the object in both, the tags are not replicated in async mode.
+func (r *replicated) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	put := func(s ObjectStorage, in io.Reader) error {
+		if tags == nil {
+			return s.Put(key, in)
+		}
+		return PutWithTags(s, key, in, tags)
+	}
+	if r.queue != "" {
+		return r.async(key, func() error { return put(r.ObjectStorage, in) })
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	var merr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		merr = put(r.mirror, bytes.NewReader(data))
+	}()
+	err = put(r.ObjectStorage, bytes.NewReader(data))
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if merr != nil {
+		return fmt.Errorf("put %s to mirror %s: %s", key, r.mirror, merr)
+	}
+	return nil
+}
+
+// PutIfNotExists creates the object in primary only if it does not exist there, the mirror is
+// overwritten as the primary is the authority.
+func (r *replicated) PutIfNotExists(key string, in io.Reader) error {
+	if r.queue != "" {
+		return r.async(key, func() error { return PutIfNotExists(r.ObjectStorage, key, in) })
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if err = PutIfNotExists(r.ObjectStorage, key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err = r.mirror.Put(key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("put %s to mirror %s: %s", key, r.mirror, err)
+	}
+	return nil
+}
+
+func (r *replicated) Copy(dst, src string) error {
+	if r.queue != "" {
+		return r.async(dst, func() error { return r.ObjectStorage.Copy(dst, src) })
+	}
+	if err := r.ObjectStorage.Copy(dst, src); err != nil {
+		return err
+	}
+	if err := r.mirror.Copy(dst, src); err != nil {
+		return r.replicate(dst)
+	}
+	return nil
+}
+
+func (r *replicated) Delete(key string) error {
+	if r.queue != "" {
+		return r.async(key, func() error { return r.ObjectStorage.Delete(key) })
+	}
+	if err := r.ObjectStorage.Delete(key); err != nil {
+		return err
+	}
+	if err := r.mirror.Delete(key); err != nil {
+		return fmt.Errorf("delete %s from mirror %s: %s", key, r.mirror, err)
+	}
+	return nil
+}
+
+func (r *replicated) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if r.queue != "" {
+		return r.async(key, func() error { return r.ObjectStorage.CompleteUpload(key, uploadID, parts) })
+	}
+	if err := r.ObjectStorage.CompleteUpload(key, uploadID, parts); err != nil {
+		return err
+	}
+	return r.replicate(key)
+}
+
+// SetTags tags the object in both, the mirror may not have the object yet in async mode,
+// then it's tagged in primary only.
+func (r *replicated) SetTags(key string, tags map[string]string) error {
+	o, ok := r.ObjectStorage.(SupportTagging)
+	if !ok {
+		return notSupported
+	}
+	if err := o.SetTags(key, tags); err != nil {
+		return err
+	}
+	if m, ok := r.mirror.(SupportTagging); ok {
+		if err := m.SetTags(key, tags); err != nil {
+			if r.queue != "" {
+				logger.Debugf("Set tags of %s in mirror %s: %s", key, r.mirror, err)
+				return nil
+			}
+			return fmt.Errorf("set tags of %s in mirror %s: %s", key, r.mirror, err)
+		}
+	}
+	return nil
+}
+
+func (r *replicated) GetTags(key string) (map[string]string, error) {
+	if o, ok := r.ObjectStorage.(SupportTagging); ok {
+		return o.GetTags(key)
+	}
+	return nil, notSupported
+}
+
+func (r *replicated) Restore(key string, days int, tier string) error {
+	if o, ok := r.ObjectStorage.(SupportRestore); ok {
+		return o.Restore(key, days, tier)
+	}
+	return notSupported
+}
+
+func (r *replicated) ListVersions(key string) ([]*ObjectVersion, error) {
+	if o, ok := r.ObjectStorage.(SupportVersioning); ok {
+		return o.ListVersions(key)
+	}
+	return nil, notSupported
+}
+
+func (r *replicated) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	if o, ok := r.ObjectStorage.(SupportVersioning); ok {
+		return o.GetVersion(key, versionID, off, limit)
+	}
+	return nil, notSupported
+}
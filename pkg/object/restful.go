@@ -41,7 +41,7 @@ func init() {
 	rand.Seed(time.Now().Unix())
 	httpClient = &http.Client{
 		Transport: &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
+			Proxy:                 proxyForRequest,
 			TLSHandshakeTimeout:   time.Second * 20,
 			ResponseHeaderTimeout: time.Second * 30,
 			IdleConnTimeout:       time.Second * 300,
@@ -261,8 +261,8 @@ func (s *RestfulStorage) Delete(key string) error {
 	return nil
 }
 
-func (s *RestfulStorage) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
-	return nil, notSupported
+func (s *RestfulStorage) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	return nil, false, "", notSupported
 }
 
 var _ ObjectStorage = &RestfulStorage{}
@@ -0,0 +1,71 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ErrRestoring is returned when reading an archived object, the restore request
+// is issued and the object will be readable after it's restored.
+var ErrRestoring = errors.New("object is archived and being restored, please retry later")
+
+// restoreOptions is how the archived objects are restored when they are read, which are
+// specified in the query of bucket:
+//
+//	restore-days=1&restore-tier=Standard
+type restoreOptions struct {
+	days int    // how long the restored copy is kept
+	tier string // tier of retrieval: Expedited, Standard or Bulk
+}
+
+var defaultRestoreOptions = restoreOptions{days: 1, tier: "Standard"}
+
+func parseRestoreOptions(query url.Values) (*restoreOptions, error) {
+	opt := defaultRestoreOptions
+	if v := query.Get("restore-days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("invalid restore-days: %s", v)
+		}
+		opt.days = days
+	}
+	switch v := query.Get("restore-tier"); v {
+	case "":
+	case "Expedited", "Standard", "Bulk":
+		opt.tier = v
+	default:
+		return nil, fmt.Errorf("invalid restore-tier: %s, should be one of Expedited, Standard and Bulk", v)
+	}
+	return &opt, nil
+}
+
+// restoreArchived issues the restore request for the archived object, and returns ErrRestoring
+// to tell the caller to retry later.
+func restoreArchived(s SupportRestore, key string, opt *restoreOptions) error {
+	if opt == nil {
+		opt = &defaultRestoreOptions
+	}
+	if err := s.Restore(key, opt.days, opt.tier); err != nil {
+		return fmt.Errorf("restore archived object %s: %s", key, err)
+	}
+	logger.Infof("Restoring archived object %s (%d days, tier %s)", key, opt.days, opt.tier)
+	return fmt.Errorf("%s: %w", key, ErrRestoring)
+}
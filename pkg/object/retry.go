@@ -0,0 +1,399 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The classes of retryable errors.
+const (
+	ErrClassThrottle    = "throttle"    // 429, SlowDown, TooManyRequests
+	ErrClassUnavailable = "unavailable" // 500, 502, 503, 504
+	ErrClassTimeout     = "timeout"     // timeout of network or request
+	ErrClassNetwork     = "network"     // other network errors, e.g. connection reset
+)
+
+var allErrClasses = []string{ErrClassThrottle, ErrClassUnavailable, ErrClassTimeout, ErrClassNetwork}
+
+var retriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "object_request_retries",
+	Help: "retried requests to object store by error class",
+}, []string{"method", "class"})
+
+// InitMetrics registers the metrics of object storage.
+func InitMetrics(reg prometheus.Registerer) {
+	if reg != nil {
+		reg.MustRegister(retriesCounter)
+		reg.MustRegister(fallbacksCounter)
+		reg.MustRegister(replicaReadsCounter)
+		reg.MustRegister(breakerState)
+		reg.MustRegister(breakerRejected)
+	}
+}
+
+// RetryPolicy controls how the failed requests are retried.
+type RetryPolicy struct {
+	MaxAttempts int           // max number of attempts, including the first one
+	MinBackoff  time.Duration // backoff before the first retry, doubled for every retry
+	MaxBackoff  time.Duration // max backoff between retries
+	MaxElapsed  time.Duration // stop retrying after this duration since the first attempt, zero means no limit
+	RetryOn     []string      // the classes of errors to be retried
+}
+
+// DefaultRetryPolicy returns the policy used when some of the parameters are not specified.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		MinBackoff:  time.Millisecond * 100,
+		MaxBackoff:  time.Second * 10,
+		RetryOn:     allErrClasses,
+	}
+}
+
+// ParseRetryPolicy parses the retry policy from the query of bucket, for example:
+//
+//	retry-max-attempts=5&retry-min-backoff=200ms&retry-max-backoff=30s&retry-max-elapsed=2m&retry-on=throttle,unavailable
+//
+// It returns nil if none of them is specified, and the parsed parameters are removed from the query.
+func ParseRetryPolicy(query url.Values) (*RetryPolicy, error) {
+	var found bool
+	p := DefaultRetryPolicy()
+	if v := query.Get("retry-max-attempts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid retry-max-attempts: %s", v)
+		}
+		p.MaxAttempts = n
+		found = true
+	}
+	for name, d := range map[string]*time.Duration{
+		"retry-min-backoff": &p.MinBackoff,
+		"retry-max-backoff": &p.MaxBackoff,
+		"retry-max-elapsed": &p.MaxElapsed,
+	} {
+		if v := query.Get(name); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil || *d < 0 {
+				return nil, fmt.Errorf("invalid %s: %s", name, v)
+			}
+			found = true
+		}
+	}
+	if v := query.Get("retry-on"); v != "" {
+		p.RetryOn = nil
+		for _, c := range strings.Split(v, ",") {
+			c = strings.TrimSpace(c)
+			var valid bool
+			for _, ec := range allErrClasses {
+				valid = valid || c == ec
+			}
+			if !valid {
+				return nil, fmt.Errorf("invalid class of errors in retry-on: %s", c)
+			}
+			p.RetryOn = append(p.RetryOn, c)
+		}
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	for _, name := range []string{"retry-max-attempts", "retry-min-backoff", "retry-max-backoff", "retry-max-elapsed", "retry-on"} {
+		query.Del(name)
+	}
+	return p, nil
+}
+
+// errorClass returns the class of err, or empty string if it should not be retried.
+func errorClass(err error) string {
+	if err == nil || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrExist) || errors.Is(err, notSupported) ||
+		errors.Is(err, errCircuitOpen) {
+		return ""
+	}
+	var code int
+	if e, ok := err.(interface{ StatusCode() int }); ok {
+		code = e.StatusCode()
+	}
+	msg := err.Error()
+	switch {
+	case code == 429 || strings.Contains(msg, "SlowDown") || strings.Contains(msg, "TooManyRequests") ||
+		strings.Contains(msg, "Too Many Requests") || strings.Contains(msg, "RequestLimitExceeded"):
+		return ErrClassThrottle
+	case code == 500 || code == 502 || code == 503 || code == 504 || strings.Contains(msg, "ServiceUnavailable") ||
+		strings.Contains(msg, "Service Unavailable") || strings.Contains(msg, "InternalError"):
+		return ErrClassUnavailable
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return ErrClassTimeout
+	}
+	if ne != nil || errors.Is(err, io.ErrUnexpectedEOF) || strings.Contains(msg, "connection reset") ||
+		strings.Contains(msg, "broken pipe") || strings.Contains(msg, "connection refused") {
+		return ErrClassNetwork
+	}
+	return ""
+}
+
+func (p *RetryPolicy) retryable(class string) bool {
+	for _, c := range p.RetryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d > 0 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) // jitter
+	}
+	return d
+}
+
+// retriedError is the error of a request which is given up by the retry policy.
+type retriedError struct {
+	error
+}
+
+func (e *retriedError) Unwrap() error { return e.error }
+
+// IsRetried returns whether the request has been retried by the retry policy, which should not be
+// retried again by the caller.
+func IsRetried(err error) bool {
+	var e *retriedError
+	return errors.As(err, &e)
+}
+
+// DisableRetries turns off the retries of SDK in the object storage (and its replicas), when the
+// failed requests are retried by the retry policy.
+func DisableRetries(s ObjectStorage) {
+	if r, ok := s.(SupportRetries); ok {
+		r.DisableRetries()
+	}
+	if rs, ok := s.(SupportReplicas); ok {
+		for _, o := range rs.Replicas() {
+			DisableRetries(o)
+		}
+	}
+}
+
+type retried struct {
+	ObjectStorage
+	policy *RetryPolicy
+}
+
+// NewRetried returns an object storage that retries the failed requests following the policy,
+// the retries of SDK should be turned off by DisableRetries, and the errors given up by the
+// policy are reported by IsRetried, so they are not retried by another layer.
+func NewRetried(s ObjectStorage, policy *RetryPolicy) ObjectStorage {
+	return &retried{s, policy}
+}
+
+func (r *retried) String() string {
+	return r.ObjectStorage.String()
+}
+
+func (r *retried) SetStorageClass(sc string) {
+	if o, ok := r.ObjectStorage.(SupportStorageClass); ok {
+		o.SetStorageClass(sc)
+	}
+}
+
+func (r *retried) do(method, key string, f func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := f()
+		class := errorClass(err)
+		if class == "" || !r.policy.retryable(class) {
+			return err
+		}
+		if attempt >= r.policy.MaxAttempts {
+			return &retriedError{err}
+		}
+		d := r.policy.backoff(attempt)
+		if r.policy.MaxElapsed > 0 && time.Since(start)+d > r.policy.MaxElapsed {
+			return &retriedError{err}
+		}
+		retriesCounter.WithLabelValues(method, class).Inc()
+		logger.Debugf("%s %s: %s (%s), retry after %s (attempt %d)", method, key, err, class, d, attempt)
+		time.Sleep(d)
+	}
+}
+
+func (r *retried) Head(key string) (o Object, err error) {
+	err = r.do("HEAD", key, func() error {
+		o, err = r.ObjectStorage.Head(key)
+		return err
+	})
+	return
+}
+
+func (r *retried) Get(key string, off, limit int64) (in io.ReadCloser, err error) {
+	err = r.do("GET", key, func() error {
+		in, err = r.ObjectStorage.Get(key, off, limit)
+		return err
+	})
+	return
+}
+
+// Put is retried only when the body could be rewound.
+func (r *retried) Put(key string, in io.Reader) error {
+	return r.put(key, in, r.ObjectStorage.Put)
+}
+
+// put retries the upload only if the data could be read again.
+func (r *retried) put(key string, in io.Reader, put func(key string, in io.Reader) error) error {
+	rs, ok := in.(io.ReadSeeker)
+	if !ok {
+		return put(key, in)
+	}
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return put(key, in)
+	}
+	return r.do("PUT", key, func() error {
+		if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		return put(key, rs)
+	})
+}
+
+func (r *retried) PutIfNotExists(key string, in io.Reader) error {
+	return PutIfNotExists(r.ObjectStorage, key, in)
+}
+
+func (r *retried) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	return r.put(key, in, func(key string, in io.Reader) error {
+		return PutWithTags(r.ObjectStorage, key, in, tags)
+	})
+}
+
+func (r *retried) SetTags(key string, tags map[string]string) error {
+	o, ok := r.ObjectStorage.(SupportTagging)
+	if !ok {
+		return notSupported
+	}
+	return r.do("SetTags", key, func() error { return o.SetTags(key, tags) })
+}
+
+func (r *retried) GetTags(key string) (tags map[string]string, err error) {
+	o, ok := r.ObjectStorage.(SupportTagging)
+	if !ok {
+		return nil, notSupported
+	}
+	err = r.do("GetTags", key, func() error {
+		tags, err = o.GetTags(key)
+		return err
+	})
+	return
+}
+
+func (r *retried) Restore(key string, days int, tier string) error {
+	o, ok := r.ObjectStorage.(SupportRestore)
+	if !ok {
+		return notSupported
+	}
+	return r.do("Restore", key, func() error { return o.Restore(key, days, tier) })
+}
+
+func (r *retried) ListVersions(key string) (versions []*ObjectVersion, err error) {
+	o, ok := r.ObjectStorage.(SupportVersioning)
+	if !ok {
+		return nil, notSupported
+	}
+	err = r.do("ListVersions", key, func() error {
+		versions, err = o.ListVersions(key)
+		return err
+	})
+	return
+}
+
+func (r *retried) GetVersion(key, versionID string, off, limit int64) (in io.ReadCloser, err error) {
+	o, ok := r.ObjectStorage.(SupportVersioning)
+	if !ok {
+		return nil, notSupported
+	}
+	err = r.do("GetVersion", key, func() error {
+		in, err = o.GetVersion(key, versionID, off, limit)
+		return err
+	})
+	return
+}
+
+func (r *retried) Copy(dst, src string) error {
+	return r.do("COPY", dst, func() error { return r.ObjectStorage.Copy(dst, src) })
+}
+
+func (r *retried) Delete(key string) error {
+	return r.do("DELETE", key, func() error { return r.ObjectStorage.Delete(key) })
+}
+
+func (r *retried) List(prefix, startAfter, token, delimiter string, limit int64) (objs []Object, hasMore bool, nextToken string, err error) {
+	err = r.do("LIST", prefix, func() error {
+		objs, hasMore, nextToken, err = r.ObjectStorage.List(prefix, startAfter, token, delimiter, limit)
+		return err
+	})
+	return
+}
+
+func (r *retried) CreateMultipartUpload(key string) (upload *MultipartUpload, err error) {
+	err = r.do("CreateMultipartUpload", key, func() error {
+		upload, err = r.ObjectStorage.CreateMultipartUpload(key)
+		return err
+	})
+	return
+}
+
+func (r *retried) UploadPart(key string, uploadID string, num int, body []byte) (part *Part, err error) {
+	err = r.do("UploadPart", key, func() error {
+		part, err = r.ObjectStorage.UploadPart(key, uploadID, num, body)
+		return err
+	})
+	return
+}
+
+func (r *retried) UploadPartCopy(key string, uploadID string, num int, srcKey string, off, size int64) (part *Part, err error) {
+	err = r.do("UploadPartCopy", key, func() error {
+		part, err = r.ObjectStorage.UploadPartCopy(key, uploadID, num, srcKey, off, size)
+		return err
+	})
+	return
+}
+
+func (r *retried) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	return r.do("CompleteUpload", key, func() error { return r.ObjectStorage.CompleteUpload(key, uploadID, parts) })
+}
@@ -21,6 +21,8 @@ package object
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
@@ -35,7 +37,9 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -59,6 +63,16 @@ type s3client struct {
 	sc     string
 	s3     *s3.S3
 	ses    *session.Session
+
+	sse      string // AES256 or aws:kms
+	sseKeyID string // KMS key for aws:kms
+	sseCKey  string // customer provided key for SSE-C
+
+	conditionalPut bool // support `If-None-Match: *`
+	express        bool // directory bucket of S3 Express One Zone
+	verifyChecksum bool // verify data against Content-MD5 and ETag
+
+	restore *restoreOptions // how to restore the archived objects
 }
 
 func (s *s3client) String() string {
@@ -81,9 +95,12 @@ func isExists(err error) bool {
 }
 
 func (s *s3client) Create() error {
-	if _, err := s.List("", "", "", 1); err == nil {
+	if _, _, _, err := s.List("", "", "", "", 1); err == nil {
 		return nil
 	}
+	if s.express {
+		return fmt.Errorf("directory bucket %s should be created in advance", s.bucket)
+	}
 	_, err := s.s3.CreateBucket(&s3.CreateBucketInput{Bucket: &s.bucket})
 	if err != nil && isExists(err) {
 		err = nil
@@ -96,6 +113,10 @@ func (s *s3client) Head(key string) (Object, error) {
 		Bucket: &s.bucket,
 		Key:    &key,
 	}
+	if s.sseCKey != "" {
+		param.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		param.SSECustomerKey = &s.sseCKey
+	}
 	r, err := s.s3.HeadObject(&param)
 	if err != nil {
 		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
@@ -118,6 +139,39 @@ func (s *s3client) Head(key string) (Object, error) {
 	}, nil
 }
 
+// Checksum returns the MD5 from ETag for objects uploaded in single part, or the CRC32C if
+// it's provided when uploaded.
+func (s *s3client) Checksum(key, algo string) (string, error) {
+	param := s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}
+	if s.sseCKey != "" {
+		param.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		param.SSECustomerKey = &s.sseCKey
+	}
+	if algo == "crc32c" {
+		param.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+	}
+	r, err := s.s3.HeadObject(&param)
+	if err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+			err = os.ErrNotExist
+		}
+		return "", err
+	}
+	switch algo {
+	case "md5":
+		return s.plainETag(r.ETag), nil
+	case "crc32c":
+		// the checksum of multipart upload is a checksum of checksums, like "xxx-3"
+		if v, err := base64.StdEncoding.DecodeString(aws.StringValue(r.ChecksumCRC32C)); err == nil && len(v) == 4 {
+			return hex.EncodeToString(v), nil
+		}
+	}
+	return "", nil
+}
+
 func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	params := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key}
 	if off > 0 || limit > 0 {
@@ -129,27 +183,111 @@ func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 		}
 		params.Range = &r
 	}
+	if s.sseCKey != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = &s.sseCKey
+	}
 	resp, err := s.s3.GetObject(params)
 	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == "InvalidObjectState" {
+			return nil, restoreArchived(s, key, s.restore)
+		}
 		return nil, err
 	}
 	if off == 0 && limit == -1 {
 		cs := resp.Metadata[checksumAlgr]
 		if cs != nil {
 			resp.Body = verifyChecksum(resp.Body, *cs)
+		} else if etag := s.plainETag(resp.ETag); s.verifyChecksum && etag != "" {
+			resp.Body = verifyMD5(resp.Body, etag)
 		}
 	}
 	return resp.Body, nil
 }
 
+func (s *s3client) SetVerifyChecksum(verify bool) {
+	s.verifyChecksum = verify
+}
+
+func (s *s3client) DisableRetries() {
+	s.s3.Retryer = client.NoOpRetryer{}
+}
+
+// plainETag returns the ETag if it's the MD5 of object, which is not true for
+// multipart uploads or encrypted objects with SSE-KMS or SSE-C.
+func (s *s3client) plainETag(etag *string) string {
+	if s.sse == s3.ServerSideEncryptionAwsKms || s.sseCKey != "" {
+		return ""
+	}
+	v := strings.ToLower(strings.Trim(aws.StringValue(etag), "\""))
+	if len(v) != 32 || strings.Contains(v, "-") {
+		return ""
+	}
+	return v
+}
+
+// checkETag makes sure the uploaded data matches the Content-MD5 of request,
+// in case the storage does not check it.
+func (s *s3client) checkETag(key string, params *s3.PutObjectInput, out *s3.PutObjectOutput) error {
+	if !s.verifyChecksum || params.ContentMD5 == nil || out == nil {
+		return nil
+	}
+	etag := s.plainETag(out.ETag)
+	if etag == "" {
+		return nil
+	}
+	sum, _ := base64.StdEncoding.DecodeString(*params.ContentMD5)
+	if expected := hex.EncodeToString(sum); etag != expected {
+		return fmt.Errorf("checksum mismatch for %s: ETag %s != %s", key, etag, expected)
+	}
+	return nil
+}
+
 func (s *s3client) Put(key string, in io.Reader) error {
+	params, err := s.putInput(key, in)
+	if err != nil {
+		return err
+	}
+	out, err := s.s3.PutObject(params)
+	if err != nil {
+		return err
+	}
+	return s.checkETag(key, params, out)
+}
+
+func (s *s3client) PutIfNotExists(key string, in io.Reader) error {
+	if !s.conditionalPut {
+		if _, err := s.Head(key); err == nil {
+			return os.ErrExist
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return s.Put(key, in)
+	}
+	params, err := s.putInput(key, in)
+	if err != nil {
+		return err
+	}
+	req, out := s.s3.PutObjectRequest(params)
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+	err = req.Send()
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusPreconditionFailed {
+		err = os.ErrExist
+	}
+	if err != nil {
+		return err
+	}
+	return s.checkETag(key, params, out)
+}
+
+func (s *s3client) putInput(key string, in io.Reader) (*s3.PutObjectInput, error) {
 	var body io.ReadSeeker
 	if b, ok := in.(io.ReadSeeker); ok {
 		body = b
 	} else {
 		data, err := io.ReadAll(in)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		body = bytes.NewReader(data)
 	}
@@ -165,10 +303,139 @@ func (s *s3client) Put(key string, in io.Reader) error {
 	if s.sc != "" {
 		params.SetStorageClass(s.sc)
 	}
-	_, err := s.s3.PutObject(params)
+	if s.verifyChecksum {
+		// the storage will reject the request if the data does not match
+		sum, err := contentMD5(body)
+		if err != nil {
+			return nil, err
+		}
+		params.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum))
+	}
+	if s.sseCKey != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = &s.sseCKey
+	} else if s.sse != "" {
+		params.ServerSideEncryption = &s.sse
+		if s.sseKeyID != "" {
+			params.SSEKMSKeyId = &s.sseKeyID
+		}
+	}
+	return params, nil
+}
+
+func (s *s3client) PutWithTags(key string, in io.Reader, tags map[string]string) error {
+	params, err := s.putInput(key, in)
+	if err != nil {
+		return err
+	}
+	v := make(url.Values, len(tags))
+	for k, t := range tags {
+		v.Set(k, t)
+	}
+	params.Tagging = aws.String(v.Encode()) // sent as x-amz-tagging
+	out, err := s.s3.PutObject(params)
+	if err != nil {
+		return err
+	}
+	return s.checkETag(key, params, out)
+}
+
+func (s *s3client) SetTags(key string, tags map[string]string) error {
+	tagging := &s3.Tagging{}
+	for k, v := range tags {
+		tagging.TagSet = append(tagging.TagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	_, err := s.s3.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  &s.bucket,
+		Key:     &key,
+		Tagging: tagging,
+	})
 	return err
 }
 
+func (s *s3client) Restore(key string, days int, tier string) error {
+	_, err := s.s3.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(int64(days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+		},
+	})
+	if e, ok := err.(awserr.Error); ok && e.Code() == "RestoreAlreadyInProgress" {
+		err = nil
+	}
+	return err
+}
+
+func (s *s3client) ListVersions(key string) ([]*ObjectVersion, error) {
+	var versions []*ObjectVersion
+	param := &s3.ListObjectVersionsInput{Bucket: &s.bucket, Prefix: &key}
+	err := s.s3.ListObjectVersionsPages(param, func(page *s3.ListObjectVersionsOutput, last bool) bool {
+		for _, v := range page.Versions {
+			if aws.StringValue(v.Key) != key {
+				continue
+			}
+			o := &obj{key, aws.Int64Value(v.Size), aws.TimeValue(v.LastModified), strings.HasSuffix(key, "/"), aws.StringValue(v.StorageClass)}
+			versions = append(versions, &ObjectVersion{o, aws.StringValue(v.VersionId), aws.BoolValue(v.IsLatest), false})
+		}
+		for _, d := range page.DeleteMarkers {
+			if aws.StringValue(d.Key) != key {
+				continue
+			}
+			o := &obj{key, 0, aws.TimeValue(d.LastModified), strings.HasSuffix(key, "/"), ""}
+			versions = append(versions, &ObjectVersion{o, aws.StringValue(d.VersionId), aws.BoolValue(d.IsLatest), true})
+		}
+		// the keys are sorted, stop once passing it
+		return len(page.Versions) == 0 || aws.StringValue(page.Versions[len(page.Versions)-1].Key) <= key
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortVersions(versions)
+	return versions, nil
+}
+
+func (s *s3client) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	params := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key, VersionId: &versionID}
+	if off > 0 || limit > 0 {
+		var r string
+		if limit > 0 {
+			r = fmt.Sprintf("bytes=%d-%d", off, off+limit-1)
+		} else {
+			r = fmt.Sprintf("bytes=%d-", off)
+		}
+		params.Range = &r
+	}
+	if s.sseCKey != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = &s.sseCKey
+	}
+	resp, err := s.s3.GetObject(params)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3client) GetTags(key string) (map[string]string, error) {
+	resp, err := s.s3.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+	tags := make(map[string]string, len(resp.TagSet))
+	for _, t := range resp.TagSet {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags, nil
+}
+
 func (s *s3client) Copy(dst, src string) error {
 	src = s.bucket + "/" + src
 	params := &s3.CopyObjectInput{
@@ -179,6 +446,17 @@ func (s *s3client) Copy(dst, src string) error {
 	if s.sc != "" {
 		params.SetStorageClass(s.sc)
 	}
+	if s.sseCKey != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = &s.sseCKey
+		params.CopySourceSSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.CopySourceSSECustomerKey = &s.sseCKey
+	} else if s.sse != "" {
+		params.ServerSideEncryption = &s.sse
+		if s.sseKeyID != "" {
+			params.SSEKMSKeyId = &s.sseKeyID
+		}
+	}
 	_, err := s.s3.CopyObject(params)
 	return err
 }
@@ -195,20 +473,26 @@ func (s *s3client) Delete(key string) error {
 	return err
 }
 
-func (s *s3client) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (s *s3client) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	if s.express {
+		return s.listSorted(prefix, startAfter, token, delimiter, limit)
+	}
 	param := s3.ListObjectsInput{
 		Bucket:       &s.bucket,
 		Prefix:       &prefix,
-		Marker:       &marker,
+		Marker:       &startAfter,
 		MaxKeys:      &limit,
 		EncodingType: aws.String("url"),
 	}
+	if token != "" {
+		param.Marker = &token
+	}
 	if delimiter != "" {
 		param.Delimiter = &delimiter
 	}
 	resp, err := s.s3.ListObjects(&param)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	n := len(resp.Contents)
 	objs := make([]Object, n)
@@ -216,10 +500,10 @@ func (s *s3client) List(prefix, marker, delimiter string, limit int64) ([]Object
 		o := resp.Contents[i]
 		oKey, err := url.QueryUnescape(*o.Key)
 		if err != nil {
-			return nil, errors.WithMessagef(err, "failed to decode key %s", *o.Key)
+			return nil, false, "", errors.WithMessagef(err, "failed to decode key %s", *o.Key)
 		}
-		if !strings.HasPrefix(oKey, prefix) || oKey < marker {
-			return nil, fmt.Errorf("found invalid key %s from List, prefix: %s, marker: %s", oKey, prefix, marker)
+		if !strings.HasPrefix(oKey, prefix) || oKey < startAfter {
+			return nil, false, "", fmt.Errorf("found invalid key %s from List, prefix: %s, marker: %s", oKey, prefix, startAfter)
 		}
 		objs[i] = &obj{
 			oKey,
@@ -233,17 +517,107 @@ func (s *s3client) List(prefix, marker, delimiter string, limit int64) ([]Object
 		for _, p := range resp.CommonPrefixes {
 			prefix, err := url.QueryUnescape(*p.Prefix)
 			if err != nil {
-				return nil, errors.WithMessagef(err, "failed to decode commonPrefixes %s", *p.Prefix)
+				return nil, false, "", errors.WithMessagef(err, "failed to decode commonPrefixes %s", *p.Prefix)
 			}
 			objs = append(objs, &obj{prefix, 0, time.Unix(0, 0), true, ""})
 		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
+	var next string
+	if aws.BoolValue(resp.IsTruncated) {
+		// NextMarker is returned only when delimiter is specified
+		if next = aws.StringValue(resp.NextMarker); next == "" && len(objs) > 0 {
+			next = objs[len(objs)-1].Key()
+		} else if next != "" {
+			if next, err = url.QueryUnescape(next); err != nil {
+				return nil, false, "", errors.WithMessagef(err, "failed to decode marker %s", *resp.NextMarker)
+			}
+		}
+	}
+	return objs, aws.BoolValue(resp.IsTruncated), next, nil
+}
+
+// listSorted lists a page of directory bucket after startAfter (or token, which is the last key of
+// previous page). ListObjectsV2 of directory bucket does not support StartAfter and does not return
+// the objects in lexicographical order, so all the objects under prefix are listed and sorted.
+func (s *s3client) listSorted(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	objs, err := s.listV2(prefix, delimiter)
+	if err != nil {
+		return nil, false, "", err
+	}
+	if token > startAfter {
+		startAfter = token
+	}
+	i := sort.Search(len(objs), func(i int) bool { return objs[i].Key() > startAfter })
+	objs = objs[i:]
+	if limit <= 0 || int64(len(objs)) <= limit {
+		return objs, false, "", nil
+	}
+	objs = objs[:limit]
+	return objs, true, objs[limit-1].Key(), nil
+}
+
+// listV2 lists all the objects (and common prefixes) under prefix of directory bucket using
+// ListObjectsV2, and sorts them by key.
+func (s *s3client) listV2(prefix, delimiter string) ([]Object, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:       &s.bucket,
+		Prefix:       &prefix,
+		EncodingType: aws.String("url"),
+	}
+	if delimiter != "" {
+		input.Delimiter = &delimiter
+	}
+	var objs []Object
+	for {
+		resp, err := s.s3.ListObjectsV2(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range resp.Contents {
+			oKey, err := url.QueryUnescape(*o.Key)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "failed to decode key %s", *o.Key)
+			}
+			if !strings.HasPrefix(oKey, prefix) {
+				return nil, fmt.Errorf("found invalid key %s from List, prefix: %s", oKey, prefix)
+			}
+			objs = append(objs, &obj{oKey, *o.Size, *o.LastModified, strings.HasSuffix(oKey, "/"), aws.StringValue(o.StorageClass)})
+		}
+		for _, p := range resp.CommonPrefixes {
+			prefix, err := url.QueryUnescape(*p.Prefix)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "failed to decode commonPrefixes %s", *p.Prefix)
+			}
+			objs = append(objs, &obj{prefix, 0, time.Unix(0, 0), true, ""})
+		}
+		if !aws.BoolValue(resp.IsTruncated) || aws.StringValue(resp.NextContinuationToken) == "" {
+			break
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	return objs, nil
 }
 
 func (s *s3client) ListAll(prefix, marker string) (<-chan Object, error) {
-	return nil, notSupported
+	if !s.express {
+		return nil, notSupported
+	}
+	// list the directory bucket only once, instead of once per page
+	objs, err := s.listV2(prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(objs), func(i int) bool { return objs[i].Key() > marker })
+	out := make(chan Object, maxResults)
+	go func() {
+		defer close(out)
+		for _, o := range objs[i:] {
+			out <- o
+		}
+	}()
+	return out, nil
 }
 
 func (s *s3client) CreateMultipartUpload(key string) (*MultipartUpload, error) {
@@ -254,6 +628,15 @@ func (s *s3client) CreateMultipartUpload(key string) (*MultipartUpload, error) {
 	if s.sc != "" {
 		params.SetStorageClass(s.sc)
 	}
+	if s.sseCKey != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = &s.sseCKey
+	} else if s.sse != "" {
+		params.ServerSideEncryption = &s.sse
+		if s.sseKeyID != "" {
+			params.SSEKMSKeyId = &s.sseKeyID
+		}
+	}
 	resp, err := s.s3.CreateMultipartUpload(params)
 	if err != nil {
 		return nil, err
@@ -270,6 +653,10 @@ func (s *s3client) UploadPart(key string, uploadID string, num int, body []byte)
 		Body:       bytes.NewReader(body),
 		PartNumber: &n,
 	}
+	if s.sseCKey != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = &s.sseCKey
+	}
 	resp, err := s.s3.UploadPart(params)
 	if err != nil {
 		return nil, err
@@ -278,14 +665,21 @@ func (s *s3client) UploadPart(key string, uploadID string, num int, body []byte)
 }
 
 func (s *s3client) UploadPartCopy(key string, uploadID string, num int, srcKey string, off, size int64) (*Part, error) {
-	resp, err := s.s3.UploadPartCopy(&s3.UploadPartCopyInput{
+	params := &s3.UploadPartCopyInput{
 		Bucket:          aws.String(s.bucket),
 		CopySource:      aws.String(s.bucket + "/" + srcKey),
 		CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", off, off+size-1)),
 		Key:             aws.String(key),
 		PartNumber:      aws.Int64(int64(num)),
 		UploadId:        aws.String(uploadID),
-	})
+	}
+	if s.sseCKey != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = &s.sseCKey
+		params.CopySourceSSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.CopySourceSSECustomerKey = &s.sseCKey
+	}
+	resp, err := s.s3.UploadPartCopy(params)
 	if err != nil {
 		return nil, err
 	}
@@ -343,12 +737,78 @@ func (s *s3client) SetStorageClass(sc string) {
 	s.sc = sc
 }
 
-func autoS3Region(bucketName, accessKey, secretKey string) (string, error) {
+// setSSE configures the server side encryption from the query of endpoint:
+//
+//	sse=AES256: SSE-S3
+//	sse=aws:kms[&sse-kms-key-id=<key>]: SSE-KMS with default or specified key
+//	sse=customer: SSE-C, the base64 encoded 256-bit key is read from env S3_SSE_C_KEY
+func (s *s3client) setSSE(query url.Values) error {
+	switch sse := query.Get("sse"); sse {
+	case "":
+	case s3.ServerSideEncryptionAes256:
+		s.sse = sse
+	case s3.ServerSideEncryptionAwsKms:
+		s.sse = sse
+		s.sseKeyID = query.Get("sse-kms-key-id")
+	case "customer":
+		key, err := base64.StdEncoding.DecodeString(os.Getenv("S3_SSE_C_KEY"))
+		if err != nil {
+			return fmt.Errorf("decode S3_SSE_C_KEY: %s", err)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("invalid length of S3_SSE_C_KEY: %d, should be 32 bytes", len(key))
+		}
+		s.sseCKey = string(key)
+	default:
+		return fmt.Errorf("unsupported server side encryption: %s", sse)
+	}
+	return nil
+}
+
+// imdsV2Only returns whether the instance metadata service should be accessed with IMDSv2 only,
+// which could be enabled by option `imdsv2-only=true` of bucket or environment variable AWS_EC2_METADATA_V1_DISABLED.
+func imdsV2Only(query url.Values) bool {
+	return strings.EqualFold(query.Get("imdsv2-only"), "true") || strings.EqualFold(os.Getenv("AWS_EC2_METADATA_V1_DISABLED"), "true")
+}
+
+// setDefaultCredentials sets the credentials when no access key is provided: the role is assumed with
+// the web identity token if AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN are set (IRSA on EKS),
+// otherwise the default credential chain of SDK is used.
+func setDefaultCredentials(awsConfig *aws.Config, strictIMDS bool) error {
+	if strictIMDS {
+		// no fallback to IMDSv1 if the token could not be fetched
+		awsConfig.EC2MetadataEnableFallback = aws.Bool(false)
+	}
+	tokenFile, roleArn := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleArn == "" {
+		return nil
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = awsDefaultRegion
+	}
+	// the endpoint of object storage should not be used for STS
+	ses, err := session.NewSession(&aws.Config{Region: aws.String(region), HTTPClient: httpClient})
+	if err != nil {
+		return fmt.Errorf("fail to create aws session for STS: %s", err)
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "juicefs"
+	}
+	awsConfig.Credentials = stscreds.NewWebIdentityCredentials(ses, roleArn, sessionName, tokenFile)
+	logger.Debugf("Assume role %s with web identity token in %s", roleArn, tokenFile)
+	return nil
+}
+
+func autoS3Region(bucketName, accessKey, secretKey string, strictIMDS bool) (string, error) {
 	awsConfig := &aws.Config{
 		HTTPClient: httpClient,
 	}
 	if accessKey != "" {
 		awsConfig.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
+	} else if err := setDefaultCredentials(awsConfig, strictIMDS); err != nil {
+		return "", err
 	}
 
 	var regions []string
@@ -413,6 +873,10 @@ var oracleCompileRegexp = `.*\.compat.objectstorage\.(.*)\.oraclecloud\.com`
 var OVHCompileRegexp = `^s3\.(\w*)(\.\w*)?\.cloud\.ovh\.net$`
 
 func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	endpoint, err := parseMRAP(endpoint)
+	if err != nil {
+		return nil, err
+	}
 	if !strings.Contains(endpoint, "://") {
 		if len(strings.Split(endpoint, ".")) > 1 && !strings.HasSuffix(endpoint, ".amazonaws.com") {
 			endpoint = fmt.Sprintf("http://%s", endpoint)
@@ -430,9 +894,16 @@ func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		bucketName string
 		region     string
 		ep         string
+		accelerate bool
 	)
 
-	if uri.Path != "" {
+	mrap := isMRAP(uri.Host)
+	if mrap {
+		// Multi-Region Access Point
+		// [ALIAS].accesspoint.s3-global.amazonaws.com
+		bucketName = strings.TrimSuffix(uri.Host, "."+mrapDomain)
+		ep = uri.Host
+	} else if uri.Path != "" {
 		// [ENDPOINT]/[BUCKET]
 		pathParts := strings.Split(uri.Path, "/")
 		bucketName = pathParts[1]
@@ -452,7 +923,7 @@ func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		if len(hostParts) == 1 {
 			// take endpoint as bucketname
 			bucketName = hostParts[0]
-			if region, err = autoS3Region(bucketName, accessKey, secretKey); err != nil {
+			if region, err = autoS3Region(bucketName, accessKey, secretKey, imdsV2Only(uri.Query())); err != nil {
 				return nil, fmt.Errorf("Can't guess your region for bucket %s: %s", bucketName, err)
 			}
 		} else {
@@ -473,7 +944,15 @@ func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 					hostParts = strings.SplitN(uri.Host, ".s3", 2)
 					bucketName = hostParts[0]
 					endpoint = "s3" + hostParts[1]
-					region = parseRegion(endpoint)
+					if strings.HasPrefix(endpoint, "s3-accelerate.") {
+						// [BUCKET].s3-accelerate[.dualstack].amazonaws.com
+						accelerate = true
+						if region, err = autoS3Region(bucketName, accessKey, secretKey, imdsV2Only(uri.Query())); err != nil {
+							return nil, fmt.Errorf("Can't guess your region for bucket %s: %s", bucketName, err)
+						}
+					} else {
+						region = parseRegion(endpoint)
+					}
 				}
 			} else {
 				// compatible s3
@@ -492,6 +971,16 @@ func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 			}
 		}
 	}
+	express := isDirectoryBucket(bucketName) && strings.Contains(uri.Host, ".amazonaws.com")
+	if express {
+		// S3 Express One Zone
+		// [BUCKET].s3express-[AZ_ID].[REGION].amazonaws.com
+		// s3express-[AZ_ID].[REGION].amazonaws.com/[BUCKET]
+		if region = parseExpressRegion(uri.Host); region == "" {
+			return nil, fmt.Errorf("invalid zonal endpoint %s for directory bucket %s", uri.Host, bucketName)
+		}
+		ep = fmt.Sprintf("s3express-%s.%s.amazonaws.com", s3ExpressZone(bucketName), region)
+	}
 	if region == "" {
 		region = os.Getenv("AWS_REGION")
 	}
@@ -509,6 +998,15 @@ func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		HTTPClient: httpClient,
 	}
 
+	// Transfer Acceleration is enabled by the accelerate endpoint or option `accelerate=true`
+	if accelerate || strings.EqualFold(uri.Query().Get("accelerate"), "true") {
+		if ep != "" {
+			return nil, fmt.Errorf("transfer acceleration is only supported by AWS S3")
+		}
+		awsConfig.S3UseAccelerate = aws.Bool(true)
+		awsConfig.UseDualStack = aws.Bool(strings.Contains(uri.Host, ".dualstack."))
+	}
+
 	disable100Continue := strings.EqualFold(uri.Query().Get("disable-100-continue"), "true")
 	if disable100Continue {
 		awsConfig.S3Disable100Continue = aws.Bool(true)
@@ -518,10 +1016,13 @@ func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		awsConfig.Credentials = credentials.AnonymousCredentials
 	} else if accessKey != "" {
 		awsConfig.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, token)
+	} else if err = setDefaultCredentials(awsConfig, imdsV2Only(uri.Query())); err != nil {
+		return nil, err
 	}
 	if ep != "" {
 		awsConfig.Endpoint = aws.String(ep)
-		awsConfig.S3ForcePathStyle = aws.Bool(true)
+		// directory buckets only support virtual-hosted-style requests
+		awsConfig.S3ForcePathStyle = aws.Bool(!express)
 	}
 
 	ses, err := session.NewSession(awsConfig)
@@ -529,7 +1030,54 @@ func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		return nil, fmt.Errorf("Fail to create aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &s3client{bucket: bucketName, s3: s3.New(ses), ses: ses}, nil
+	role, err := parseAssumeRole(uri.Query())
+	if err != nil {
+		return nil, err
+	}
+	if role != nil {
+		// the credentials are refreshed by SDK before they expire
+		ses = ses.Copy(&aws.Config{Credentials: stscreds.NewCredentials(ses, role.roleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = role.sessionName
+			p.Duration = role.duration
+			p.ExpiryWindow = role.duration / 5
+			if role.externalID != "" {
+				p.ExternalID = aws.String(role.externalID)
+			}
+		})})
+	}
+	client := &s3client{bucket: bucketName, s3: s3.New(ses), ses: ses, express: express}
+	if mrap {
+		useMRAP(client.s3, bucketName)
+	}
+	// sign the payload in chunks for the compatible storages that don't accept UNSIGNED-PAYLOAD
+	if strings.EqualFold(uri.Query().Get("streaming-signature"), "true") {
+		if mrap {
+			return nil, fmt.Errorf("streaming signature is not supported by multi-region access points")
+		}
+		client.s3.Handlers.Sign.PushFront(prepareStreaming)
+		client.s3.Handlers.Sign.PushBack(signStreaming)
+	}
+	if err = client.setSSE(uri.Query()); err != nil {
+		return nil, err
+	}
+	if client.restore, err = parseRestoreOptions(uri.Query()); err != nil {
+		return nil, err
+	}
+	// conditional write is supported by AWS S3, and could be enabled for compatible storages explicitly
+	client.conditionalPut = ep == "" || express || strings.EqualFold(uri.Query().Get("conditional-put"), "true")
+	if express {
+		scheme := "https"
+		if !ssl {
+			scheme = "http"
+		}
+		sessCreds := credentials.NewCredentials(&s3ExpressProvider{
+			endpoint: fmt.Sprintf("%s://%s.%s", scheme, bucketName, ep),
+			region:   region,
+			base:     ses.Config.Credentials,
+		})
+		client.s3.Handlers.Sign.PushFront(signWithSession(sessCreds))
+	}
+	return client, nil
 }
 
 func init() {
@@ -0,0 +1,134 @@
+//go:build !nos3
+// +build !nos3
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// Directory buckets of S3 Express One Zone are named as `<name>--<az-id>--x-s3`
+// and served by the zonal endpoint `s3express-<az-id>.<region>.amazonaws.com`.
+const (
+	s3ExpressSuffix      = "--x-s3"
+	s3ExpressSigningName = "s3express"
+	emptySha256          = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func isDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, s3ExpressSuffix)
+}
+
+// s3ExpressZone returns the availability zone ID in the name of directory bucket.
+func s3ExpressZone(bucket string) string {
+	name := strings.TrimSuffix(bucket, s3ExpressSuffix)
+	if p := strings.LastIndex(name, "--"); p > 0 {
+		return name[p+2:]
+	}
+	return ""
+}
+
+// parseExpressRegion returns the region from zonal endpoint s3express-[AZ_ID].[REGION].amazonaws.com
+func parseExpressRegion(host string) string {
+	if p := strings.Index(host, "s3express-"); p >= 0 {
+		if parts := strings.Split(host[p:], "."); len(parts) > 2 {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+type createSessionResult struct {
+	Credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      time.Time
+	}
+}
+
+// s3ExpressProvider retrieves the session credentials of directory bucket by CreateSession,
+// which are valid for 5 minutes and refreshed one minute before expiration.
+type s3ExpressProvider struct {
+	credentials.Expiry
+	endpoint string // https://[BUCKET].s3express-[AZ_ID].[REGION].amazonaws.com
+	region   string
+	base     *credentials.Credentials
+}
+
+func (p *s3ExpressProvider) Retrieve() (credentials.Value, error) {
+	req, err := http.NewRequest(http.MethodGet, p.endpoint+"/?session", nil)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	req.Header.Set("X-Amz-Content-Sha256", emptySha256)
+	req.Header.Set("X-Amz-Create-Session-Mode", "ReadWrite")
+	if _, err = v4.NewSigner(p.base).Sign(req, nil, s3ExpressSigningName, p.region, time.Now()); err != nil {
+		return credentials.Value{}, fmt.Errorf("sign CreateSession: %s", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer cleanup(resp)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return credentials.Value{}, fmt.Errorf("CreateSession: status %d: %s", resp.StatusCode, data)
+	}
+	var result createSessionResult
+	if err = xml.Unmarshal(data, &result); err != nil {
+		return credentials.Value{}, fmt.Errorf("decode CreateSession result: %s", err)
+	}
+	c := result.Credentials
+	p.SetExpiration(c.Expiration, time.Minute)
+	logger.Debugf("Created session for %s, expire at %s", p.endpoint, c.Expiration)
+	return credentials.Value{
+		AccessKeyID:     c.AccessKeyId,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		ProviderName:    "S3ExpressSessionProvider",
+	}, nil
+}
+
+// signWithSession returns a handler to sign the requests with the session credentials,
+// the session token is sent with `x-amz-s3session-token` instead of `x-amz-security-token`.
+func signWithSession(session *credentials.Credentials) func(r *request.Request) {
+	return func(r *request.Request) {
+		v, err := session.Get()
+		if err != nil {
+			r.Error = fmt.Errorf("get session of directory bucket: %s", err)
+			return
+		}
+		r.Config.Credentials = credentials.NewStaticCredentials(v.AccessKeyID, v.SecretAccessKey, "")
+		r.ClientInfo.SigningName = s3ExpressSigningName
+		r.HTTPRequest.Header.Set("X-Amz-S3session-Token", v.SessionToken)
+	}
+}
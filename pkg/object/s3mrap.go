@@ -0,0 +1,243 @@
+//go:build !nos3
+// +build !nos3
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Multi-Region Access Points are served by the global endpoint `<alias>.accesspoint.s3-global.amazonaws.com`,
+// and the requests should be signed with SigV4A (ECDSA P-256) for all the regions.
+const (
+	mrapDomain    = "accesspoint.s3-global.amazonaws.com"
+	v4aAlgorithm  = "AWS4-ECDSA-P256-SHA256"
+	v4aTimeFormat = "20060102T150405Z"
+	v4aDateFormat = "20060102"
+)
+
+// parseMRAP converts the ARN of Multi-Region Access Point (arn:aws:s3::<account>:accesspoint/<alias>)
+// into the URL of global endpoint, other endpoints are returned as is.
+func parseMRAP(endpoint string) (string, error) {
+	if !strings.HasPrefix(endpoint, "arn:") {
+		return endpoint, nil
+	}
+	arn, query, _ := strings.Cut(endpoint, "?")
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[2] != "s3" || parts[3] != "" || !strings.HasPrefix(parts[5], "accesspoint/") {
+		return "", fmt.Errorf("invalid ARN of Multi-Region Access Point: %s", arn)
+	}
+	u := fmt.Sprintf("https://%s.%s", strings.TrimPrefix(parts[5], "accesspoint/"), mrapDomain)
+	if query != "" {
+		u += "?" + query
+	}
+	return u, nil
+}
+
+func isMRAP(host string) bool {
+	return strings.HasSuffix(host, "."+mrapDomain)
+}
+
+// trimBucket removes the bucket from the path of requests, since the access point is addressed by the host.
+func trimBucket(bucket string) func(r *request.Request) {
+	return func(r *request.Request) {
+		u := r.HTTPRequest.URL
+		u.Path = strings.TrimPrefix(u.Path, "/"+bucket)
+		u.RawPath = strings.TrimPrefix(u.RawPath, "/"+bucket)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+}
+
+// useMRAP sends the requests to the access point without bucket in path, and signs them with SigV4A.
+func useMRAP(client *s3.S3, alias string) {
+	signer := &v4aSigner{}
+	client.Handlers.Build.PushBack(trimBucket(alias))
+	client.Handlers.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{Name: "v4a.SignRequestHandler", Fn: signer.sign})
+}
+
+var nMinusTwoP256 = new(big.Int).Sub(elliptic.P256().Params().N, big.NewInt(2))
+
+// deriveV4AKey derives the ECDSA key from the secret key by the KDF in counter mode (NIST SP 800-108),
+// as other SDKs do.
+func deriveV4AKey(accessKey, secretKey string) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	inputKey := []byte("AWS4A" + secretKey)
+	for counter := 1; counter <= 0xFF; counter++ {
+		var fixed bytes.Buffer
+		fixed.Write([]byte{0, 0, 0, 1}) // i = 1, only one round is needed for 256 bits
+		fixed.WriteString(v4aAlgorithm)
+		fixed.WriteByte(0)
+		fixed.WriteString(accessKey)
+		fixed.WriteByte(byte(counter))
+		_ = binary.Write(&fixed, binary.BigEndian, int32(curve.Params().BitSize))
+		mac := hmac.New(sha256.New, inputKey)
+		mac.Write(fixed.Bytes())
+		c := new(big.Int).SetBytes(mac.Sum(nil))
+		if c.Cmp(nMinusTwoP256) < 0 {
+			d := c.Add(c, big.NewInt(1))
+			priv := &ecdsa.PrivateKey{D: d}
+			priv.PublicKey.Curve = curve
+			priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+			return priv, nil
+		}
+	}
+	return nil, fmt.Errorf("exhausted the counter to derive the key")
+}
+
+// v4aSigner signs the requests with SigV4A, the derived key is cached for the access key.
+type v4aSigner struct {
+	sync.Mutex
+	accessKey string
+	key       *ecdsa.PrivateKey
+}
+
+func (s *v4aSigner) privateKey(v credentials.Value) (*ecdsa.PrivateKey, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.key == nil || s.accessKey != v.AccessKeyID {
+		key, err := deriveV4AKey(v.AccessKeyID, v.SecretAccessKey)
+		if err != nil {
+			return nil, err
+		}
+		s.accessKey, s.key = v.AccessKeyID, key
+	}
+	return s.key, nil
+}
+
+func (s *v4aSigner) sign(r *request.Request) {
+	if r.Config.Credentials == credentials.AnonymousCredentials {
+		return
+	}
+	v, err := r.Config.Credentials.Get()
+	if err != nil {
+		r.Error = err
+		return
+	}
+	key, err := s.privateKey(v)
+	if err != nil {
+		r.Error = err
+		return
+	}
+	req := r.HTTPRequest
+	now := time.Now().UTC()
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", now.Format(v4aTimeFormat))
+	req.Header.Set("X-Amz-Region-Set", "*")
+	if v.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", v.SessionToken)
+	}
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = emptySha256
+		if body := r.GetBody(); body != nil {
+			start, err := body.Seek(0, io.SeekCurrent)
+			if err != nil {
+				r.Error = err
+				return
+			}
+			h := sha256.New()
+			if _, err = io.Copy(h, body); err != nil {
+				r.Error = err
+				return
+			}
+			if _, err = body.Seek(start, io.SeekStart); err != nil {
+				r.Error = err
+				return
+			}
+			payload = hex.EncodeToString(h.Sum(nil))
+		}
+		req.Header.Set("X-Amz-Content-Sha256", payload)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-md5" || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := req.URL.Query()
+	for k := range query {
+		sort.Strings(query[k])
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Replace(query.Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	service := r.ClientInfo.SigningName
+	if service == "" {
+		service = r.ClientInfo.ServiceName
+	}
+	// no region in the scope, it's in X-Amz-Region-Set
+	scope := fmt.Sprintf("%s/%s/aws4_request", now.Format(v4aDateFormat), service)
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{v4aAlgorithm, now.Format(v4aTimeFormat), scope, hex.EncodeToString(hash[:])}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		r.Error = fmt.Errorf("sign with SigV4A: %s", err)
+		return
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		v4aAlgorithm, v.AccessKeyID, scope, signedHeaders, hex.EncodeToString(sig)))
+}
@@ -0,0 +1,166 @@
+//go:build !nos3
+// +build !nos3
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The payload is signed chunk by chunk with the aws-chunked encoding, each chunk is signed with
+// the signature of previous one, and the seed is the signature of headers.
+const (
+	streamingPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingChunkSize = 64 << 10
+	sigLen             = 64 // hex of SHA-256
+)
+
+func chunkLength(size int64) int64 {
+	return int64(len(strconv.FormatInt(size, 16))+len(";chunk-signature=")+sigLen+2) + size + 2
+}
+
+// streamingLength returns the length of body after encoded.
+func streamingLength(size int64) int64 {
+	n := size / streamingChunkSize * chunkLength(streamingChunkSize)
+	if rem := size % streamingChunkSize; rem > 0 {
+		n += chunkLength(rem)
+	}
+	return n + chunkLength(0)
+}
+
+func isStreamingOp(r *request.Request) bool {
+	op := r.Operation.Name
+	return r.ClientInfo.ServiceID == s3.ServiceID && (op == "PutObject" || op == "UploadPart") &&
+		r.HTTPRequest.ContentLength > 0 && r.Config.Credentials != credentials.AnonymousCredentials
+}
+
+// prepareStreaming sets the headers before signed, the length of encoded body is signed too.
+func prepareStreaming(r *request.Request) {
+	if !isStreamingOp(r) {
+		return
+	}
+	size := r.HTTPRequest.ContentLength
+	if r.HTTPRequest.Header.Get("X-Amz-Decoded-Content-Length") != "" {
+		size, _ = strconv.ParseInt(r.HTTPRequest.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	}
+	r.HTTPRequest.Header.Set("X-Amz-Content-Sha256", streamingPayload)
+	r.HTTPRequest.Header.Set("Content-Encoding", "aws-chunked")
+	r.HTTPRequest.Header.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(size, 10))
+	r.HTTPRequest.ContentLength = streamingLength(size)
+	r.HTTPRequest.Header.Set("Content-Length", strconv.FormatInt(r.HTTPRequest.ContentLength, 10))
+}
+
+// signStreaming wraps the body to sign the chunks with the seed signature of request.
+func signStreaming(r *request.Request) {
+	if r.Error != nil || !isStreamingOp(r) || r.HTTPRequest.Header.Get("X-Amz-Content-Sha256") != streamingPayload {
+		return
+	}
+	auth := r.HTTPRequest.Header.Get("Authorization")
+	var credential, seed string
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		if strings.HasPrefix(field, "Credential=") {
+			credential = strings.TrimPrefix(field, "Credential=")
+		} else if strings.HasPrefix(field, "Signature=") {
+			seed = strings.TrimPrefix(field, "Signature=")
+		}
+	}
+	// Credential=<access key>/<date>/<region>/<service>/aws4_request
+	parts := strings.SplitN(credential, "/", 2)
+	if len(parts) != 2 || seed == "" {
+		r.Error = fmt.Errorf("unexpected authorization for streaming payload: %s", auth)
+		return
+	}
+	scope := parts[1]
+	v, err := r.Config.Credentials.Get()
+	if err != nil {
+		r.Error = err
+		return
+	}
+	key := []byte("AWS4" + v.SecretAccessKey)
+	for _, s := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, s)
+	}
+	r.HTTPRequest.Body = io.NopCloser(&chunkSigner{
+		src:       r.HTTPRequest.Body,
+		key:       key,
+		timestamp: r.HTTPRequest.Header.Get("X-Amz-Date"),
+		scope:     scope,
+		prev:      seed,
+		buf:       make([]byte, streamingChunkSize),
+	})
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+type chunkSigner struct {
+	src       io.Reader
+	key       []byte
+	timestamp string
+	scope     string
+	prev      string // signature of previous chunk
+	buf       []byte
+	out       bytes.Buffer
+	done      bool
+}
+
+func (c *chunkSigner) Read(p []byte) (int, error) {
+	if c.out.Len() == 0 && !c.done {
+		n, err := io.ReadFull(c.src, c.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		c.writeChunk(c.buf[:n])
+		c.done = n == 0
+	}
+	if c.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.out.Read(p)
+}
+
+func (c *chunkSigner) writeChunk(data []byte) {
+	hash := sha256.Sum256(data)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256-PAYLOAD",
+		c.timestamp,
+		c.scope,
+		c.prev,
+		emptySha256,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	c.prev = hex.EncodeToString(hmacSHA256(c.key, stringToSign))
+	fmt.Fprintf(&c.out, "%x;chunk-signature=%s\r\n", len(data), c.prev)
+	c.out.Write(data)
+	c.out.WriteString("\r\n")
+}
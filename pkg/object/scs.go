@@ -39,7 +39,6 @@ type scsClient struct {
 	bucket string
 	c      *scs.SCS
 	b      scs.Bucket
-	marker string
 }
 
 func (s *scsClient) String() string {
@@ -97,20 +96,14 @@ func (s *scsClient) Delete(key string) error {
 	return s.b.Delete(key)
 }
 
-func (s *scsClient) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
-	if marker != "" {
-		if s.marker == "" {
-			// last page
-			return nil, nil
-		}
-		marker = s.marker
+func (s *scsClient) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	if token != "" {
+		startAfter = token
 	}
-	list, err := s.b.List(delimiter, prefix, marker, limit)
+	list, err := s.b.List(delimiter, prefix, startAfter, limit)
 	if err != nil {
-		s.marker = ""
-		return nil, err
+		return nil, false, "", err
 	}
-	s.marker = list.NextMarker
 	n := len(list.Contents)
 	// Message from scs technical support, the api not guarantee contents is ordered, but marker is work.
 	// So we sort contents at here, can work both contents is ordered or not ordered.
@@ -133,7 +126,7 @@ func (s *scsClient) List(prefix, marker, delimiter string, limit int64) ([]Objec
 		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return objs, list.NextMarker != "", list.NextMarker, nil
 }
 
 func (s *scsClient) ListAll(prefix, marker string) (<-chan Object, error) {
@@ -203,7 +196,7 @@ func newSCS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 	if err != nil {
 		return nil, err
 	}
-	return &scsClient{bucket: bucketName, c: c, b: b, marker: ""}, nil
+	return &scsClient{bucket: bucketName, c: c, b: b}, nil
 }
 
 func init() {
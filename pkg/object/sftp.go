@@ -400,14 +400,14 @@ func (f *sftpStore) find(c *sftp.Client, path, marker string, out chan Object) {
 	}
 }
 
-func (f *sftpStore) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (f *sftpStore) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if delimiter != "/" {
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
 
 	c, err := f.getSftpConnection()
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	defer f.putSftpConnection(&c, nil)
 
@@ -415,28 +415,28 @@ func (f *sftpStore) List(prefix, marker, delimiter string, limit int64) ([]Objec
 	dir := f.path(prefix)
 	if !strings.HasSuffix(dir, "/") {
 		dir = filepath.Dir(dir) + dirSuffix
-	} else if marker == "" {
+	} else if startAfter == "" {
 		obj, err := f.Head(prefix)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return nil, nil
+				return nil, false, "", nil
 			}
-			return nil, err
+			return nil, false, "", err
 		}
 		objs = append(objs, obj)
 	}
 	infos, err := c.sftpClient.ReadDir(dir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil
+			return nil, false, "", nil
 		}
-		return nil, err
+		return nil, false, "", err
 	}
 
 	entries := f.sortByName(c.sftpClient, dir, infos)
 	for _, o := range entries {
 		key := o.Key()
-		if !strings.HasPrefix(key, prefix) || (marker != "" && key <= marker) {
+		if !strings.HasPrefix(key, prefix) || (startAfter != "" && key <= startAfter) {
 			continue
 		}
 		objs = append(objs, o)
@@ -444,7 +444,7 @@ func (f *sftpStore) List(prefix, marker, delimiter string, limit int64) ([]Objec
 			break
 		}
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func (f *sftpStore) ListAll(prefix, marker string) (<-chan Object, error) {
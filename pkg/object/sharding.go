@@ -22,6 +22,8 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -69,6 +71,63 @@ func (s *sharded) Put(key string, body io.Reader) error {
 	return s.pick(key).Put(key, body)
 }
 
+func (s *sharded) PutIfNotExists(key string, body io.Reader) error {
+	return PutIfNotExists(s.pick(key), key, body)
+}
+
+func (s *sharded) SetVerifyChecksum(verify bool) {
+	for _, o := range s.stores {
+		if cs, ok := o.(SupportChecksum); ok {
+			cs.SetVerifyChecksum(verify)
+		}
+	}
+}
+
+func (s *sharded) DisableRetries() {
+	for _, o := range s.stores {
+		DisableRetries(o)
+	}
+}
+
+func (s *sharded) PutWithTags(key string, body io.Reader, tags map[string]string) error {
+	return PutWithTags(s.pick(key), key, body, tags)
+}
+
+func (s *sharded) SetTags(key string, tags map[string]string) error {
+	if o, ok := s.pick(key).(SupportTagging); ok {
+		return o.SetTags(key, tags)
+	}
+	return notSupported
+}
+
+func (s *sharded) GetTags(key string) (map[string]string, error) {
+	if o, ok := s.pick(key).(SupportTagging); ok {
+		return o.GetTags(key)
+	}
+	return nil, notSupported
+}
+
+func (s *sharded) Restore(key string, days int, tier string) error {
+	if o, ok := s.pick(key).(SupportRestore); ok {
+		return o.Restore(key, days, tier)
+	}
+	return notSupported
+}
+
+func (s *sharded) ListVersions(key string) ([]*ObjectVersion, error) {
+	if o, ok := s.pick(key).(SupportVersioning); ok {
+		return o.ListVersions(key)
+	}
+	return nil, notSupported
+}
+
+func (s *sharded) GetVersion(key, versionID string, off, limit int64) (io.ReadCloser, error) {
+	if o, ok := s.pick(key).(SupportVersioning); ok {
+		return o.GetVersion(key, versionID, off, limit)
+	}
+	return nil, notSupported
+}
+
 func (s *sharded) Copy(dst, src string) error {
 	return notSupported
 }
@@ -98,7 +157,7 @@ func ListAll(store ObjectStorage, prefix, marker string) (<-chan Object, error)
 	startTime := time.Now()
 	out := make(chan Object, maxResults)
 	logger.Debugf("Listing objects from %s marker %q", store, marker)
-	objs, err := store.List(prefix, marker, "", maxResults)
+	objs, hasMore, token, err := store.List(prefix, marker, "", "", maxResults)
 	if err != nil {
 		logger.Errorf("Can't list %s: %s", store, err.Error())
 		return nil, err
@@ -123,20 +182,22 @@ func ListAll(store ObjectStorage, prefix, marker string) (<-chan Object, error)
 			}
 			// Corner case: the func parameter `marker` is an empty string("") and exactly
 			// one object which key is an empty string("") returned by the List() method.
-			if lastkey == "" {
+			if lastkey == "" || !hasMore {
 				break END
 			}
 
 			marker = lastkey
 			startTime = time.Now()
 			logger.Debugf("Continue listing objects from %s marker %q", store, marker)
-			objs, err = store.List(prefix, marker, "", maxResults)
+			var nextToken string
+			objs, hasMore, nextToken, err = store.List(prefix, marker, token, "", maxResults)
 			for err != nil {
 				logger.Warnf("Fail to list: %s, retry again", err.Error())
 				// slow down
 				time.Sleep(time.Millisecond * 100)
-				objs, err = store.List(prefix, marker, "", maxResults)
+				objs, hasMore, nextToken, err = store.List(prefix, marker, token, "", maxResults)
 			}
+			token = nextToken
 			logger.Debugf("Found %d object from %s in %s", len(objs), store, time.Since(startTime))
 		}
 		close(out)
@@ -208,14 +269,53 @@ func (s *sharded) CompleteUpload(key string, uploadID string, parts []*Part) err
 	return s.pick(key).CompleteUpload(key, uploadID, parts)
 }
 
-func NewSharded(name, endpoint, ak, sk, token string, shards int) (ObjectStorage, error) {
-	stores := make([]ObjectStorage, shards)
-	var err error
-	for i := range stores {
-		ep := fmt.Sprintf(endpoint, i)
-		if strings.HasSuffix(ep, "%!(EXTRA int=0)") {
-			return nil, fmt.Errorf("can not generate different endpoint using %s", endpoint)
+var shardRange = regexp.MustCompile(`(%d)?\{(\d+)\.\.(\d+)\}`)
+
+// ShardEndpoints returns the endpoints of all the shards. The endpoint could contain a range of
+// numbers as "{0..15}" (optionally after "%d", e.g. "jfs-%d{0..15}"), which is expanded in order
+// and zero-padded as the start (e.g. "{00..15}"), otherwise "%d" is replaced by 0 to shards-1.
+func ShardEndpoints(endpoint string, shards int) ([]string, error) {
+	m := shardRange.FindStringSubmatchIndex(endpoint)
+	if m == nil {
+		if shards <= 1 {
+			return []string{endpoint}, nil
+		}
+		eps := make([]string, shards)
+		for i := range eps {
+			eps[i] = fmt.Sprintf(endpoint, i)
+			if strings.HasSuffix(eps[i], "%!(EXTRA int=0)") {
+				return nil, fmt.Errorf("can not generate different endpoint using %s", endpoint)
+			}
 		}
+		return eps, nil
+	}
+	first, last := endpoint[m[4]:m[5]], endpoint[m[6]:m[7]]
+	start, _ := strconv.Atoi(first)
+	end, _ := strconv.Atoi(last)
+	if end < start {
+		return nil, fmt.Errorf("invalid range of shards in %s", endpoint)
+	}
+	if shards > 0 && shards != end-start+1 {
+		return nil, fmt.Errorf("%d shards do not match the range in %s", shards, endpoint)
+	}
+	var width int
+	if len(first) > 1 && first[0] == '0' {
+		width = len(first)
+	}
+	eps := make([]string, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		eps = append(eps, fmt.Sprintf("%s%0*d%s", endpoint[:m[0]], width, i, endpoint[m[1]:]))
+	}
+	return eps, nil
+}
+
+func NewSharded(name, endpoint, ak, sk, token string, shards int) (ObjectStorage, error) {
+	eps, err := ShardEndpoints(endpoint, shards)
+	if err != nil {
+		return nil, err
+	}
+	stores := make([]ObjectStorage, len(eps))
+	for i, ep := range eps {
 		stores[i], err = CreateStorage(name, ep, ak, sk, token)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,484 @@
+//go:build !nosmb
+// +build !nosmb
+
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+const (
+	smbStatusObjectNameNotFound = 0xC0000034
+	smbStatusObjectPathNotFound = 0xC000003A
+	// idle sessions are usually closed by the server after 15 minutes
+	smbMaxIdle = time.Minute * 10
+)
+
+// smbConn encapsulates an authenticated SMB session and the mounted share
+type smbConn struct {
+	conn     net.Conn
+	session  *smb2.Session
+	share    *smb2.Share
+	lastUsed time.Time
+}
+
+func (c *smbConn) close() {
+	_ = c.share.Umount()
+	_ = c.session.Logoff()
+	_ = c.conn.Close()
+}
+
+type smbStore struct {
+	DefaultObjectStorage
+	addr   string
+	share  string
+	root   string
+	dialer *smb2.Dialer
+	poolMu sync.Mutex
+	pool   []*smbConn
+}
+
+func (s *smbStore) String() string {
+	return fmt.Sprintf("smb://%s/%s/%s", s.addr, s.share, s.root)
+}
+
+// Open a new session to the SMB server and mount the share.
+func (s *smbStore) connect() (*smbConn, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.dialer.Dial(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("smb session to %s: %s", s.addr, err)
+	}
+	share, err := session.Mount(s.share)
+	if err != nil {
+		_ = session.Logoff()
+		_ = conn.Close()
+		return nil, fmt.Errorf("mount share %s: %s", s.share, err)
+	}
+	return &smbConn{conn: conn, session: session, share: share}, nil
+}
+
+// Get a connection from the pool, or open a new one
+func (s *smbStore) getConn() (*smbConn, error) {
+	var c *smbConn
+	now := time.Now()
+	s.poolMu.Lock()
+	for len(s.pool) > 0 {
+		c = s.pool[len(s.pool)-1]
+		s.pool = s.pool[:len(s.pool)-1]
+		if now.Sub(c.lastUsed) < smbMaxIdle {
+			break
+		}
+		go c.close()
+		c = nil
+	}
+	s.poolMu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	return s.connect()
+}
+
+// Return a connection to the pool.
+//
+// If err is not nil and is not an expected error from the server, the
+// connection is checked and dropped when it's broken.
+func (s *smbStore) putConn(c *smbConn, err error) {
+	if err != nil && !isSmbRegularError(err) {
+		if _, e := c.share.Stat(""); e != nil {
+			c.close()
+			return
+		}
+	}
+	c.lastUsed = time.Now()
+	s.poolMu.Lock()
+	s.pool = append(s.pool, c)
+	s.poolMu.Unlock()
+}
+
+func isSmbRegularError(err error) bool {
+	if os.IsNotExist(err) || os.IsExist(err) || os.IsPermission(err) {
+		return true
+	}
+	var re *smb2.ResponseError
+	return errors.As(err, &re)
+}
+
+func isSmbNotExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	var re *smb2.ResponseError
+	if errors.As(err, &re) {
+		return re.Code == smbStatusObjectNameNotFound || re.Code == smbStatusObjectPathNotFound
+	}
+	return false
+}
+
+// SMB uses backslash as separator, paths are relative to the share
+func toSmbPath(p string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(p, dirSuffix), "/", `\`)
+}
+
+func (s *smbStore) path(key string) string {
+	return toSmbPath(s.root + key)
+}
+
+func (s *smbStore) fileInfo(key string, fi os.FileInfo) Object {
+	o := &obj{key, fi.Size(), fi.ModTime(), fi.IsDir(), ""}
+	if fi.IsDir() {
+		if key != "" && !strings.HasSuffix(key, dirSuffix) {
+			o.key += dirSuffix
+		}
+		o.size = 0
+	}
+	return o
+}
+
+func (s *smbStore) Create() error {
+	if s.root == "" {
+		return nil
+	}
+	c, err := s.getConn()
+	if err != nil {
+		return err
+	}
+	err = c.share.MkdirAll(s.path(""), 0755)
+	s.putConn(c, err)
+	return err
+}
+
+func (s *smbStore) Head(key string) (Object, error) {
+	c, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := c.share.Stat(s.path(key))
+	s.putConn(c, err)
+	if err != nil {
+		if isSmbNotExist(err) {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+	return s.fileInfo(key, fi), nil
+}
+
+type smbReader struct {
+	io.Reader
+	f *smb2.File
+	c *smbConn
+	s *smbStore
+}
+
+func (r *smbReader) Close() error {
+	err := r.f.Close()
+	r.s.putConn(r.c, err)
+	return err
+}
+
+func (s *smbStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	c, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.share.Open(s.path(key))
+	if err != nil {
+		s.putConn(c, err)
+		if isSmbNotExist(err) {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		s.putConn(c, err)
+		return nil, err
+	}
+	if fi.IsDir() {
+		_ = f.Close()
+		s.putConn(c, nil)
+		return io.NopCloser(bytes.NewBuffer([]byte{})), nil
+	}
+	if limit < 0 {
+		limit = fi.Size() - off
+	}
+	return &smbReader{io.NewSectionReader(f, off, limit), f, c, s}, nil
+}
+
+func (s *smbStore) Put(key string, in io.Reader) error {
+	c, err := s.getConn()
+	if err != nil {
+		return err
+	}
+	defer func() { s.putConn(c, err) }()
+
+	p := s.path(key)
+	if strings.HasSuffix(key, dirSuffix) {
+		err = c.share.MkdirAll(p, 0755)
+		return err
+	}
+	dir, name := path.Split(s.root + key)
+	tmp := toSmbPath(fmt.Sprintf("%s.%s.tmp%d", dir, name, time.Now().UnixNano()))
+	f, err := c.share.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil && isSmbNotExist(err) && dir != "" {
+		if err = c.share.MkdirAll(toSmbPath(dir), 0755); err != nil {
+			return err
+		}
+		f, err = c.share.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	_, err = io.CopyBuffer(f, in, *buf)
+	if err != nil {
+		_ = f.Close()
+		_ = c.share.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = c.share.Remove(tmp)
+		return err
+	}
+	// rename does not replace existing file in SMB
+	_ = c.share.Remove(p)
+	if err = c.share.Rename(tmp, p); err != nil {
+		_ = c.share.Remove(tmp)
+	}
+	return err
+}
+
+func (s *smbStore) Delete(key string) error {
+	c, err := s.getConn()
+	if err != nil {
+		return err
+	}
+	err = c.share.Remove(s.path(key))
+	if err != nil && isSmbNotExist(err) {
+		err = nil
+	}
+	s.putConn(c, err)
+	return err
+}
+
+func (s *smbStore) Chtimes(key string, mtime time.Time) error {
+	c, err := s.getConn()
+	if err != nil {
+		return err
+	}
+	err = c.share.Chtimes(s.path(key), mtime, mtime)
+	s.putConn(c, err)
+	return err
+}
+
+func (s *smbStore) readDir(c *smbConn, dir string) ([]Object, error) {
+	infos, err := c.share.ReadDir(s.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]Object, 0, len(infos))
+	for _, fi := range infos {
+		objs = append(objs, s.fileInfo(dir+fi.Name(), fi))
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
+	return objs, nil
+}
+
+func (s *smbStore) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	if delimiter != "/" {
+		return nil, false, "", notSupported
+	}
+	var objs []Object
+	dir := prefix
+	if !strings.HasSuffix(dir, dirSuffix) {
+		dir = path.Dir(dir) + dirSuffix
+		if dir == "./" {
+			dir = ""
+		}
+	} else if startAfter == "" {
+		o, err := s.Head(prefix)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, false, "", nil
+			}
+			return nil, false, "", err
+		}
+		objs = append(objs, o)
+	}
+
+	c, err := s.getConn()
+	if err != nil {
+		return nil, false, "", err
+	}
+	entries, err := s.readDir(c, dir)
+	s.putConn(c, err)
+	if err != nil {
+		if isSmbNotExist(err) {
+			return nil, false, "", nil
+		}
+		return nil, false, "", err
+	}
+	for _, o := range entries {
+		key := o.Key()
+		if !strings.HasPrefix(key, prefix) || (startAfter != "" && key <= startAfter) {
+			continue
+		}
+		objs = append(objs, o)
+		if len(objs) == int(limit) {
+			break
+		}
+	}
+	return generateListResult(objs, limit)
+}
+
+func (s *smbStore) walk(c *smbConn, dir, prefix, marker string, out chan<- Object) error {
+	entries, err := s.readDir(c, dir)
+	if err != nil {
+		if isSmbNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, o := range entries {
+		key := o.Key()
+		if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) && key > marker {
+			out <- o
+		}
+		if o.IsDir() && (key > marker || strings.HasPrefix(marker, key)) {
+			if err = s.walk(c, key, prefix, marker, out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *smbStore) ListAll(prefix, marker string) (<-chan Object, error) {
+	c, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Object, 10240)
+	go func() {
+		defer close(out)
+		if prefix == "" && marker == "" {
+			out <- &obj{"", 0, time.Now(), true, ""}
+		}
+		err := s.walk(c, "", prefix, marker, out)
+		if err != nil {
+			logger.Errorf("list %s: %s", s.path(prefix), err)
+			out <- nil
+		}
+		s.putConn(c, err)
+	}()
+	return out, nil
+}
+
+// newSmb creates a storage on SMB/CIFS share, the endpoint should be in
+// the format of `host[:port]/share/path/`, and access key could be
+// `DOMAIN\user` for domain accounts.
+func newSmb(endpoint, username, password, token string) (ObjectStorage, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "smb://" + endpoint
+	}
+	uri, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %s: %s", endpoint, err)
+	}
+	addr := uri.Host
+	if uri.Port() == "" {
+		addr = net.JoinHostPort(uri.Hostname(), "445")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("no share name in endpoint: %s", endpoint)
+	}
+	var root string
+	if len(parts) == 2 {
+		root = parts[1]
+		if root != "" && !strings.HasSuffix(root, dirSuffix) {
+			root += dirSuffix
+		}
+	}
+
+	if uri.User != nil {
+		if username == "" {
+			username = uri.User.Username()
+		}
+		if password == "" {
+			password, _ = uri.User.Password()
+		}
+	}
+	if username == "" {
+		username = os.Getenv("SMB_USER")
+	}
+	if password == "" {
+		password = os.Getenv("SMB_PASSWORD")
+	}
+	var domain string
+	if i := strings.Index(username, `\`); i > 0 {
+		domain, username = username[:i], username[i+1:]
+	}
+
+	s := &smbStore{
+		addr:  addr,
+		share: parts[0],
+		root:  root,
+		dialer: &smb2.Dialer{
+			Initiator: &smb2.NTLMInitiator{
+				User:     username,
+				Password: password,
+				Domain:   domain,
+			},
+		},
+	}
+	c, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	s.putConn(c, nil)
+	return s, nil
+}
+
+func init() {
+	Register("smb", newSmb)
+}
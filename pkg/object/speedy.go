@@ -53,15 +53,15 @@ func (s *speedy) String() string {
 	return fmt.Sprintf("speedy://%s/", uri.Host)
 }
 
-func (s *speedy) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (s *speedy) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if delimiter != "" {
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
 	uri, _ := url.ParseRequestURI(s.endpoint)
 
 	query := url.Values{}
 	query.Add("prefix", prefix)
-	query.Add("marker", marker)
+	query.Add("marker", startAfter)
 	if limit > 100000 {
 		limit = 100000
 	}
@@ -70,30 +70,30 @@ func (s *speedy) List(prefix, marker, delimiter string, limit int64) ([]Object,
 	uri.Path = "/"
 	req, err := http.NewRequest("GET", uri.String(), nil)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	now := time.Now().UTC().Format(http.TimeFormat)
 	req.Header.Add("Date", now)
 	s.signer(req, s.accessKey, s.secretKey, s.signName)
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	defer cleanup(resp)
 	if resp.StatusCode != 200 {
-		return nil, parseError(resp)
+		return nil, false, "", parseError(resp)
 	}
 	if resp.ContentLength <= 0 || resp.ContentLength > (1<<31) {
-		return nil, fmt.Errorf("invalid content length: %d", resp.ContentLength)
+		return nil, false, "", fmt.Errorf("invalid content length: %d", resp.ContentLength)
 	}
 	data := make([]byte, resp.ContentLength)
 	if _, err := io.ReadFull(resp.Body, data); err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	var out ListBucketResult
 	err = xml.Unmarshal(data, &out)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	objs := make([]Object, 0)
 	for _, item := range out.Contents {
@@ -102,7 +102,7 @@ func (s *speedy) List(prefix, marker, delimiter string, limit int64) ([]Object,
 		}
 		objs = append(objs, &obj{item.Key, item.Size, item.LastModified, strings.HasSuffix(item.Key, "/"), ""})
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func newSpeedy(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
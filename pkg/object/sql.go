@@ -128,18 +128,18 @@ func (s *sqlStore) Delete(key string) error {
 	return err
 }
 
-func (s *sqlStore) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
-	if marker == "" {
-		marker = prefix
+func (s *sqlStore) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
+	if startAfter == "" {
+		startAfter = prefix
 	}
 	// todo
 	if delimiter != "" {
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
 	var bs []blob
-	err := s.db.Where("`key` >= ?", []byte(marker)).Limit(int(limit)).Cols("`key`", "size", "modified").OrderBy("`key`").Find(&bs)
+	err := s.db.Where("`key` >= ?", []byte(startAfter)).Limit(int(limit)).Cols("`key`", "size", "modified").OrderBy("`key`").Find(&bs)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	var objs []Object
 	for _, b := range bs {
@@ -154,7 +154,7 @@ func (s *sqlStore) List(prefix, marker, delimiter string, limit int64) ([]Object
 			break
 		}
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func newSQLStore(driver, addr, user, password string) (ObjectStorage, error) {
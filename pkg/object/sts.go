@@ -0,0 +1,83 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// assumeRole is the options to get temporary credentials of a role from STS,
+// which are specified in the query of bucket:
+//
+//	role-arn=<arn>[&external-id=<id>][&role-session-name=<name>][&role-session-duration=1h]
+type assumeRole struct {
+	roleArn     string
+	externalID  string
+	sessionName string
+	duration    time.Duration
+}
+
+func parseAssumeRole(query url.Values) (*assumeRole, error) {
+	r := &assumeRole{
+		roleArn:     query.Get("role-arn"),
+		externalID:  query.Get("external-id"),
+		sessionName: query.Get("role-session-name"),
+		duration:    time.Hour,
+	}
+	if r.roleArn == "" {
+		return nil, nil
+	}
+	if r.sessionName == "" {
+		r.sessionName = "juicefs"
+	}
+	if v := query.Get("role-session-duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute*15 {
+			return nil, fmt.Errorf("invalid role-session-duration: %s, should be at least 15m", v)
+		}
+		r.duration = d
+	}
+	return r, nil
+}
+
+// tempCred is the temporary credentials got from STS.
+type tempCred struct {
+	accessKey string
+	secretKey string
+	token     string
+	expire    time.Time
+}
+
+// keepRefreshing refreshes the temporary credentials before they expire.
+func keepRefreshing(name string, expire time.Time, fetch func() (*tempCred, error), apply func(*tempCred)) {
+	go func() {
+		for {
+			time.Sleep(time.Until(expire) / 2)
+			cred, err := fetch()
+			if err != nil {
+				logger.Errorf("refresh credentials of %s: %s", name, err)
+				expire = time.Now().Add(time.Minute * 2) // retry after a minute
+				continue
+			}
+			apply(cred)
+			expire = cred.expire
+			logger.Debugf("Refreshed credentials of %s, will be expired at %s", name, expire)
+		}
+	}()
+}
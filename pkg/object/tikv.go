@@ -89,20 +89,20 @@ func (t *tikv) Delete(key string) error {
 	return t.c.Delete(context.TODO(), []byte(key))
 }
 
-func (t *tikv) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (t *tikv) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if delimiter != "" {
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
-	if marker == "" {
-		marker = prefix
+	if startAfter == "" {
+		startAfter = prefix
 	}
 	if limit > int64(rawkv.MaxRawKVScanLimit) {
 		limit = int64(rawkv.MaxRawKVScanLimit)
 	}
 	// TODO: key only
-	keys, vs, err := t.c.Scan(context.TODO(), []byte(marker), nil, int(limit))
+	keys, vs, err := t.c.Scan(context.TODO(), []byte(startAfter), nil, int(limit))
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	var objs = make([]Object, len(keys))
 	mtime := time.Now()
@@ -110,7 +110,7 @@ func (t *tikv) List(prefix, marker, delimiter string, limit int64) ([]Object, er
 		// FIXME: mtime
 		objs[i] = &obj{string(k), int64(len(vs[i])), mtime, strings.HasSuffix(string(k), "/"), ""}
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func newTiKV(endpoint, accesskey, secretkey, token string) (ObjectStorage, error) {
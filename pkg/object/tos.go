@@ -122,25 +122,25 @@ func (t *tosClient) Head(key string) (Object, error) {
 	}, err
 }
 
-func (t *tosClient) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (t *tosClient) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	resp, err := t.client.ListObjectsV2(context.Background(), &tos.ListObjectsV2Input{
 		Bucket: t.bucket,
 		ListObjectsInput: tos.ListObjectsInput{
 			Delimiter: delimiter,
 			Prefix:    prefix,
-			Marker:    marker,
+			Marker:    startAfter,
 			MaxKeys:   int(limit),
 		},
 	})
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	n := len(resp.Contents)
 	objs := make([]Object, n)
 	for i := 0; i < n; i++ {
 		o := resp.Contents[i]
-		if !strings.HasPrefix(o.Key, prefix) || o.Key < marker {
-			return nil, fmt.Errorf("found invalid key %s from List, prefix: %s, marker: %s", o.Key, prefix, marker)
+		if !strings.HasPrefix(o.Key, prefix) || o.Key < startAfter {
+			return nil, false, "", fmt.Errorf("found invalid key %s from List, prefix: %s, startAfter: %s", o.Key, prefix, startAfter)
 		}
 		objs[i] = &obj{
 			o.Key,
@@ -156,7 +156,7 @@ func (t *tosClient) List(prefix, marker, delimiter string, limit int64) ([]Objec
 		}
 		sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 func (t *tosClient) ListAll(prefix, marker string) (<-chan Object, error) {
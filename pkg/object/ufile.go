@@ -199,33 +199,33 @@ type uFileListObjectsOutput struct {
 	DataSet []*DataItem `json:"DataSet,omitempty"`
 }
 
-func (u *ufile) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (u *ufile) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if delimiter != "" {
 		// TODO: or US3?
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
 	query := url.Values{}
 	query.Add("list", "")
 	query.Add("prefix", prefix)
-	query.Add("marker", marker)
+	query.Add("marker", startAfter)
 	if limit > 1000 {
 		limit = 1000
 	}
 	query.Add("limit", strconv.Itoa(int(limit)))
 	resp, err := u.request("GET", "?"+query.Encode(), nil, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 
 	var out uFileListObjectsOutput
 	if err := u.parseResp(resp, &out); err != nil {
-		return nil, err
+		return nil, false, "", err
 	}
 	objs := make([]Object, len(out.DataSet))
 	for i, item := range out.DataSet {
 		objs[i] = &obj{item.FileName, item.Size, time.Unix(int64(item.ModifyTime), 0), strings.HasSuffix(item.FileName, "/"), ""}
 	}
-	return objs, nil
+	return generateListResult(objs, limit)
 }
 
 type ufileCreateMultipartUploadResult struct {
@@ -98,9 +98,9 @@ func (u *up) Copy(dst, src string) error {
 	})
 }
 
-func (u *up) List(prefix, marker, delimiter string, limit int64) ([]Object, error) {
+func (u *up) List(prefix, startAfter, token, delimiter string, limit int64) ([]Object, bool, string, error) {
 	if delimiter != "" {
-		return nil, notSupported
+		return nil, false, "", notSupported
 	}
 	if u.listing == nil {
 		listing := make(chan *upyun.FileInfo, limit)
@@ -121,15 +121,15 @@ func (u *up) List(prefix, marker, delimiter string, limit int64) ([]Object, erro
 			break
 		}
 		key := prefix + "/" + fi.Name
-		if !fi.IsDir && key > marker {
+		if !fi.IsDir && key > startAfter {
 			objs = append(objs, &obj{key, fi.Size, fi.Time, strings.HasSuffix(key, "/"), ""})
 		}
 	}
 	if len(objs) > 0 {
-		return objs, nil
+		return generateListResult(objs, limit)
 	}
 	u.listing = nil
-	return nil, u.err
+	return nil, false, "", u.err
 }
 
 func newUpyun(endpoint, user, passwd, token string) (ObjectStorage, error) {
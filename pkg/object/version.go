@@ -0,0 +1,80 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// ObjectVersion is a version of object in the buckets with versioning enabled.
+type ObjectVersion struct {
+	Object
+	VersionID    string
+	IsLatest     bool
+	DeleteMarker bool // the object was deleted in this version
+}
+
+// sortVersions puts the latest version first, and then the others from newer to older.
+func sortVersions(versions []*ObjectVersion) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].IsLatest != versions[j].IsLatest {
+			return versions[i].IsLatest
+		}
+		return versions[i].Mtime().After(versions[j].Mtime())
+	})
+}
+
+// RecoverVersion puts back the newest noncurrent version of a deleted or overwritten object.
+// It returns the recovered version, or the latest one if it's not deleted. os.ErrNotExist is
+// returned if there is no version to recover from.
+func RecoverVersion(store ObjectStorage, key string) (*ObjectVersion, error) {
+	vs, ok := store.(SupportVersioning)
+	if !ok {
+		return nil, notSupported
+	}
+	versions, err := vs.ListVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.DeleteMarker {
+			continue
+		}
+		if v.IsLatest {
+			return v, nil
+		}
+		in, err := vs.GetVersion(key, v.VersionID, 0, -1)
+		if err != nil {
+			return nil, fmt.Errorf("get version %s of %s: %s", v.VersionID, key, err)
+		}
+		data, err := io.ReadAll(in)
+		_ = in.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read version %s of %s: %s", v.VersionID, key, err)
+		}
+		if err = store.Put(key, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		logger.Infof("Recovered %s from version %s (%s)", key, v.VersionID, v.Mtime())
+		return v, nil
+	}
+	return nil, os.ErrNotExist
+}
@@ -20,6 +20,9 @@
 package object
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
@@ -28,15 +31,95 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/studio-b12/gowebdav"
 )
 
+const webdavLockTimeout = time.Minute * 2
+
 type webdav struct {
 	DefaultObjectStorage
 	endpoint *url.URL
 	c        *gowebdav.Client
+	uploads  *url.URL // directory for chunked uploads of Nextcloud/ownCloud, nil if not supported
+	lock     bool     // lock the file while writing it
+}
+
+// webdavError is the error of requests sent without gowebdav.
+type webdavError struct {
+	op   string
+	key  string
+	code int
+}
+
+func (e *webdavError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.op, e.key, e.code, http.StatusText(e.code))
+}
+
+func (e *webdavError) StatusCode() int {
+	return e.code
+}
+
+// convertError returns ENOSPC for 507 Insufficient Storage (e.g. exceeding the quota of user).
+func convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*webdavError); ok && e.code == http.StatusInsufficientStorage ||
+		gowebdav.IsErrCode(err, http.StatusInsufficientStorage) {
+		return fmt.Errorf("%s: %w", err, syscall.ENOSPC)
+	}
+	return err
+}
+
+func (w *webdav) url(key string) string {
+	u := &url.URL{
+		Scheme: w.endpoint.Scheme,
+		Host:   w.endpoint.Host,
+		Path:   path.Join(w.endpoint.Path, key),
+	}
+	return u.String()
+}
+
+// request sends a request to u, the response is returned only if it succeeded.
+func (w *webdav) request(method, u, key string, body io.Reader, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if w.endpoint.User != nil {
+		passwd, _ := w.endpoint.User.Password()
+		req.SetBasicAuth(w.endpoint.User.Username(), passwd)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		return nil, &webdavError{method, key, resp.StatusCode}
+	}
+	return resp, nil
+}
+
+func (w *webdav) do(method, u, key string, body io.Reader, header map[string]string) error {
+	resp, err := w.request(method, u, key, body, header)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
 }
 
 func (w *webdav) String() string {
@@ -137,7 +220,127 @@ func (w *webdav) Put(key string, in io.Reader) error {
 	if strings.HasSuffix(key, dirSuffix) {
 		return w.c.MkdirAll(key, 0)
 	}
-	return w.c.WriteStream(key, in, 0)
+	if w.lock {
+		return convertError(w.putLocked(key, in))
+	}
+	return convertError(w.c.WriteStream(key, in, 0))
+}
+
+// lockFile takes an exclusive write lock of the file, which is created if not exists.
+func (w *webdav) lockFile(key string) (string, error) {
+	body := `<?xml version="1.0" encoding="utf-8"?>` +
+		`<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:locktype><D:write/></D:locktype><D:owner>juicefs</D:owner></D:lockinfo>`
+	header := map[string]string{
+		"Content-Type": "application/xml; charset=utf-8",
+		"Depth":        "0",
+		"Timeout":      fmt.Sprintf("Second-%d", int(webdavLockTimeout.Seconds())),
+	}
+	resp, err := w.request("LOCK", w.url(key), key, strings.NewReader(body), header)
+	if e, ok := err.(*webdavError); ok && e.code == http.StatusConflict {
+		// the parent does not exist
+		if err = w.c.MkdirAll(path.Dir(key), 0); err != nil {
+			return "", err
+		}
+		resp, err = w.request("LOCK", w.url(key), key, strings.NewReader(body), header)
+	}
+	if err != nil {
+		return "", err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	token := resp.Header.Get("Lock-Token")
+	if token == "" {
+		return "", fmt.Errorf("no lock token in response of LOCK %s", key)
+	}
+	return token, nil
+}
+
+func (w *webdav) putLocked(key string, in io.Reader) error {
+	token, err := w.lockFile(key)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := w.do("UNLOCK", w.url(key), key, nil, map[string]string{"Lock-Token": token}); err != nil {
+			logger.Warnf("Unlock %s: %s", key, err)
+		}
+	}()
+	return w.do("PUT", w.url(key), key, in, map[string]string{"If": "(" + token + ")"})
+}
+
+func (w *webdav) Limits() Limits {
+	if w.uploads == nil {
+		return Limits{}
+	}
+	return Limits{
+		IsSupportMultipartUpload: true,
+		MinPartSize:              5 << 20,
+		MaxPartSize:              5 << 30,
+		MaxPartCount:             10000,
+	}
+}
+
+func (w *webdav) uploadURL(uploadID string, name string) string {
+	u := *w.uploads
+	u.Path = path.Join(u.Path, uploadID, name)
+	return u.String()
+}
+
+// CreateMultipartUpload starts a chunked upload of Nextcloud (v2) or ownCloud, the chunks are kept
+// in the directory of uploads on server until they're assembled, so the upload can be resumed.
+func (w *webdav) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	if w.uploads == nil {
+		return nil, notSupported
+	}
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	uploadID := "juicefs-" + hex.EncodeToString(id[:])
+	if err := w.do("MKCOL", w.uploadURL(uploadID, ""), key, nil, map[string]string{"Destination": w.url(key)}); err != nil {
+		return nil, convertError(err)
+	}
+	return &MultipartUpload{MinPartSize: 5 << 20, MaxCount: 10000, UploadID: uploadID}, nil
+}
+
+func (w *webdav) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	if w.uploads == nil {
+		return nil, notSupported
+	}
+	err := w.do("PUT", w.uploadURL(uploadID, fmt.Sprintf("%05d", num)), key, bytes.NewReader(body), map[string]string{"Destination": w.url(key)})
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return &Part{Num: num, Size: len(body)}, nil
+}
+
+func (w *webdav) AbortUpload(key string, uploadID string) {
+	if w.uploads == nil {
+		return
+	}
+	if err := w.do("DELETE", w.uploadURL(uploadID, ""), key, nil, nil); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("Abort upload %s of %s: %s", uploadID, key, err)
+	}
+}
+
+func (w *webdav) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if w.uploads == nil {
+		return notSupported
+	}
+	var total int
+	for _, p := range parts {
+		total += p.Size
+	}
+	if dir := path.Dir(key); dir != "." {
+		if err := w.c.MkdirAll(dir, 0); err != nil {
+			return err
+		}
+	}
+	header := map[string]string{
+		"Destination":     w.url(key),
+		"Overwrite":       "T",
+		"OC-Total-Length": strconv.Itoa(total),
+	}
+	return convertError(w.do("MOVE", w.uploadURL(uploadID, ".file"), key, nil, header))
 }
 
 func (w *webdav) Delete(key string) error {
@@ -164,7 +367,7 @@ func (w *webdav) Delete(key string) error {
 }
 
 func (w *webdav) Copy(dst, src string) error {
-	return w.c.Copy(src, dst, true)
+	return convertError(w.c.Copy(src, dst, true))
 }
 
 type WebDAVWalkFunc func(path string, info fs.FileInfo, err error) error
@@ -282,10 +485,23 @@ func newWebDAV(endpoint, user, passwd, token string) (ObjectStorage, error) {
 	if uri.Path == "" {
 		uri.Path = "/"
 	}
+	w := &webdav{endpoint: uri}
+	query := uri.Query()
+	if v := query.Get("lock"); v != "" {
+		if w.lock, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid lock %s: %s", v, err)
+		}
+	}
+	uri.RawQuery = ""
 	uri.User = url.UserPassword(user, passwd)
-	c := gowebdav.NewClient(uri.String(), user, passwd)
-	c.SetTransport(httpClient.Transport)
-	return &webdav{endpoint: uri, c: c}, nil
+	// Nextcloud and ownCloud support chunked uploads in the directory of uploads for the user
+	if i := strings.Index(uri.Path, "/remote.php/dav/files/"); i >= 0 {
+		owner := strings.SplitN(uri.Path[i+len("/remote.php/dav/files/"):], "/", 2)[0]
+		w.uploads = &url.URL{Scheme: uri.Scheme, Host: uri.Host, Path: uri.Path[:i] + "/remote.php/dav/uploads/" + owner + "/"}
+	}
+	w.c = gowebdav.NewClient(uri.String(), user, passwd)
+	w.c.SetTransport(httpClient.Transport)
+	return w, nil
 }
 
 func init() {
@@ -0,0 +1,160 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// BWWindow is a daily time window with its own bandwidth limit, the window wraps around midnight
+// when End is not after Start.
+type BWWindow struct {
+	Start time.Duration // since midnight
+	End   time.Duration
+	Limit int // in Mbps, 0 means unlimited
+}
+
+func (w BWWindow) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.Start < w.End {
+		return d >= w.Start && d < w.End
+	}
+	return d >= w.Start || d < w.End
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, should be like 08:00", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseMbps(s string) (int, error) {
+	unit := 1
+	switch {
+	case strings.HasSuffix(s, "M") || strings.HasSuffix(s, "m"):
+		s = s[:len(s)-1]
+	case strings.HasSuffix(s, "G") || strings.HasSuffix(s, "g"):
+		s, unit = s[:len(s)-1], 1000
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, should be like 100 or 100M (Mbps)", s)
+	}
+	return v * unit, nil
+}
+
+// parseBWLimit parses the value of --bwlimit, which is a limit in Mbps like 100, or a list of time
+// windows with their limits like "08:00-20:00=100M,20:00-08:00=0". An item without time window is
+// the limit outside of all the windows.
+func parseBWLimit(s string) (limit int, windows []BWWindow, err error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if !strings.Contains(item, "=") {
+			if limit, err = parseMbps(item); err != nil {
+				return
+			}
+			continue
+		}
+		ps := strings.SplitN(item, "=", 2)
+		se := strings.SplitN(ps[0], "-", 2)
+		if len(se) != 2 {
+			return 0, nil, fmt.Errorf("invalid time window %q, should be like 08:00-20:00", ps[0])
+		}
+		var w BWWindow
+		if w.Start, err = parseClock(strings.TrimSpace(se[0])); err != nil {
+			return
+		}
+		if w.End, err = parseClock(strings.TrimSpace(se[1])); err != nil {
+			return
+		}
+		if w.Limit, err = parseMbps(strings.TrimSpace(ps[1])); err != nil {
+			return
+		}
+		windows = append(windows, w)
+	}
+	return
+}
+
+// bwLimiter limits the bandwidth according to the window of current time.
+type bwLimiter struct {
+	sync.Mutex
+	limit   int
+	windows []BWWindow
+	current int
+	bucket  *ratelimit.Bucket
+}
+
+func newBWLimiter(limit int, windows []BWWindow) *bwLimiter {
+	l := &bwLimiter{limit: limit, windows: windows, current: -1}
+	l.update(time.Now())
+	return l
+}
+
+// limitAt returns the limit in Mbps at t, the first matched window wins.
+func (l *bwLimiter) limitAt(t time.Time) int {
+	for _, w := range l.windows {
+		if w.contains(t) {
+			return w.Limit
+		}
+	}
+	return l.limit
+}
+
+func (l *bwLimiter) update(now time.Time) {
+	limit := l.limitAt(now)
+	l.Lock()
+	defer l.Unlock()
+	if limit == l.current {
+		return
+	}
+	if l.current >= 0 {
+		logger.Infof("Bandwidth limit is changed to %d Mbps (0 means unlimited)", limit)
+	}
+	l.current = limit
+	if limit > 0 {
+		bps := float64(limit*(1<<20)/8) * 0.85 // 15% overhead
+		l.bucket = ratelimit.NewBucketWithRate(bps, int64(bps)*3)
+	} else {
+		l.bucket = nil
+	}
+}
+
+func (l *bwLimiter) run() {
+	for now := range time.Tick(time.Second * 10) {
+		l.update(now)
+	}
+}
+
+func (l *bwLimiter) Wait(size int64) {
+	l.Lock()
+	b := l.bucket
+	l.Unlock()
+	if b != nil {
+		b.Wait(size)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// The keys are listed and handled in order, so the progress of a sync can be represented by the
+// first key which is not handled yet: all the keys before it are copied, skipped, deleted or failed.
+// The failed keys before it are saved in the checkpoint and retried after resumed. When there are
+// too many of them, the progress stops at the first one which can't be saved, so it will be listed
+// again after resumed.
+
+const maxCheckpointFailed = 10000
+
+type checkpoint struct {
+	Src     string
+	Dst     string
+	Next    string   // the first key to resume from
+	Failed  []string `json:",omitempty"` // the failed keys, which are retried after resumed
+	Stat    Stat     // the progress before the checkpoint, for information only
+	Updated time.Time
+}
+
+type tracker struct {
+	sync.Mutex
+	path    string
+	src     string
+	dst     string
+	seen    string              // the last key reached by the producer
+	pending []string            // the dispatched keys in order
+	done    map[string]struct{} // the finished keys in pending
+	failed  []string            // the failed keys before pending[0]
+	stuck   string              // the first failed key which can't be saved, nothing is tracked after it
+
+	interrupted bool // the listing is not finished
+}
+
+func newTracker(path string, src, dst object.ObjectStorage) *tracker {
+	return &tracker{path: path, src: src.String(), dst: dst.String(), done: make(map[string]struct{})}
+}
+
+// load returns the key to resume from and the failed keys before it, or an empty string if there is
+// no checkpoint.
+func (t *tracker) load() (string, []string, error) {
+	d, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	var cp checkpoint
+	if err = json.Unmarshal(d, &cp); err != nil {
+		return "", nil, fmt.Errorf("decode checkpoint %s: %s", t.path, err)
+	}
+	if cp.Src != t.src || cp.Dst != t.dst {
+		return "", nil, fmt.Errorf("checkpoint %s is for %s -> %s", t.path, cp.Src, cp.Dst)
+	}
+	return cp.Next, cp.Failed, nil
+}
+
+func (t *tracker) reach(key string) {
+	t.Lock()
+	if t.stuck == "" {
+		t.seen = key
+	}
+	t.Unlock()
+}
+
+func (t *tracker) dispatch(key string) {
+	t.Lock()
+	if t.stuck == "" {
+		t.seen = key
+		t.pending = append(t.pending, key)
+	}
+	t.Unlock()
+}
+
+// fail records a failed key, it returns false if there are too many of them.
+func (t *tracker) fail(key string) bool {
+	if len(t.failed) >= maxCheckpointFailed {
+		return false
+	}
+	t.failed = append(t.failed, key)
+	return true
+}
+
+// retried records the result of a failed key saved in checkpoint, which is retried before the listing.
+func (t *tracker) retried(key string, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	if !ok && !t.fail(key) && (t.stuck == "" || key < t.stuck) {
+		t.stuck, t.seen, t.pending = key, key, nil
+		t.done = make(map[string]struct{})
+	}
+}
+
+func (t *tracker) finish(key string, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	if t.stuck != "" {
+		return
+	}
+	if !ok && !t.fail(key) {
+		// stop tracking, the keys after it will be listed again after resumed
+		t.stuck, t.seen, t.pending = key, key, nil
+		t.done = make(map[string]struct{})
+		return
+	}
+	t.done[key] = struct{}{}
+	for len(t.pending) > 0 {
+		if _, finished := t.done[t.pending[0]]; !finished {
+			break
+		}
+		delete(t.done, t.pending[0])
+		t.pending = t.pending[1:]
+	}
+}
+
+// setInterrupted marks the listing as not finished, so the checkpoint is kept.
+func (t *tracker) setInterrupted() {
+	t.Lock()
+	t.interrupted = true
+	t.Unlock()
+}
+
+// completed returns true if all the keys are listed and none of them failed.
+func (t *tracker) completed() bool {
+	t.Lock()
+	defer t.Unlock()
+	return !t.interrupted && len(t.failed) == 0 && t.stuck == ""
+}
+
+func (t *tracker) next() (string, []string) {
+	t.Lock()
+	defer t.Unlock()
+	failed := append([]string(nil), t.failed...)
+	if t.stuck != "" {
+		return t.stuck, failed
+	}
+	if len(t.pending) > 0 {
+		return t.pending[0], failed
+	}
+	return t.seen, failed
+}
+
+func (t *tracker) save() error {
+	cp := checkpoint{Src: t.src, Dst: t.dst, Updated: time.Now()}
+	cp.Next, cp.Failed = t.next()
+	cp.Stat = Stat{
+		Copied:       copied.Current(),
+		CopiedBytes:  copiedBytes.Current(),
+		CheckedBytes: checkedBytes.Current(),
+		Deleted:      deleted.Current(),
+		Skipped:      skipped.Current(),
+		Failed:       failed.Current(),
+	}
+	d, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err = os.WriteFile(tmp, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+func (t *tracker) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := t.save(); err != nil {
+				logger.Warnf("Save checkpoint %s: %s", t.path, err)
+			}
+		}
+	}
+}
+
+// retryFailed syncs the failed keys saved in checkpoint, the ones failed again are saved again.
+func retryFailed(src, dst object.ObjectStorage, keys []string, config *Config) {
+	todo := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < config.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range todo {
+				err := applyChange(src, dst, key, config)
+				if err != nil {
+					logger.Errorf("Retry %s: %s", key, err)
+				}
+				config.tracker.retried(key, err == nil)
+			}
+		}()
+	}
+	for _, key := range keys {
+		todo <- key
+	}
+	close(todo)
+	wg.Wait()
+}
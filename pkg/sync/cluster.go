@@ -24,6 +24,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -75,8 +76,21 @@ func httpRequest(url string, body []byte) (ans []byte, err error) {
 	return io.ReadAll(resp.Body)
 }
 
-func sendStats(addr string) {
-	var r Stat
+// workerID identifies a worker in the manager.
+var workerID = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}()
+
+// leaseTimeout is how long a batch could be held without renewal before it is given to other workers.
+var leaseTimeout = time.Second * 30
+
+// sendStats reports the progress to manager, and renews the leases of the batches held by the worker.
+func sendStats(addr string, batches *batchTracker) {
+	var r statsReport
+	if batches != nil {
+		r.Held = batches.held()
+	}
 	r.Copied = copied.Current()
 	r.CopiedBytes = copiedBytes.Current()
 	r.CheckedBytes = checkedBytes.Current()
@@ -84,7 +98,7 @@ func sendStats(addr string) {
 	r.Skipped = skipped.Current()
 	r.Failed = failed.Current()
 	d, _ := json.Marshal(r)
-	ans, err := httpRequest(fmt.Sprintf("http://%s/stats", addr), d)
+	ans, err := httpRequest(fmt.Sprintf("http://%s/stats?id=%s", addr, url.QueryEscape(workerID)), d)
 	if err != nil || string(ans) != "OK" {
 		logger.Errorf("update stats: %s %s", string(ans), err)
 	} else {
@@ -97,61 +111,290 @@ func sendStats(addr string) {
 	}
 }
 
-func startManager(tasks <-chan object.Object) (string, error) {
-	http.HandleFunc("/fetch", func(w http.ResponseWriter, req *http.Request) {
-		var objs []object.Object
-		obj, ok := <-tasks
-		if !ok {
-			_, _ = w.Write([]byte("[]"))
-			return
+// The jobs are sent to workers in batches, every batch is leased to a worker until it's finished.
+// A worker renews the leases of the batches it holds by reporting their IDs in the heartbeats (stats)
+// and fetches, the batches which are not renewed for leaseTimeout are stolen by other workers, so
+// workers could join or leave at any time, and the batches lost in the responses are not leaked.
+
+type jobBatch struct {
+	id      string
+	objs    []object.Object
+	worker  string
+	expires time.Time
+}
+
+type fetchResult struct {
+	ID      string          `json:"id"`
+	Objects json.RawMessage `json:"objects"`
+	Wait    bool            `json:"wait"` // no jobs for now, fetch again later
+}
+
+type batchResult struct {
+	ID     string   `json:"id"`
+	Failed []string `json:"failed"`
+}
+
+type fetchRequest struct {
+	Done []batchResult `json:"done"`
+	Held []string      `json:"held"` // the batches being processed by the worker
+}
+
+type statsReport struct {
+	Stat
+	Held []string `json:",omitempty"` // the batches being processed by the worker
+}
+
+type dispatcher struct {
+	sync.Mutex
+	tasks   <-chan object.Object
+	epoch   int64 // to ignore the results of batches from previous run of manager
+	seq     int64
+	closed  bool
+	leases  map[string]*jobBatch
+	stolen  []*jobBatch
+	seen    map[string]time.Time // the last heartbeat of workers
+	tracker *tracker
+}
+
+func newDispatcher(tasks <-chan object.Object, config *Config) *dispatcher {
+	return &dispatcher{
+		tasks:   tasks,
+		epoch:   time.Now().UnixNano(),
+		leases:  make(map[string]*jobBatch),
+		seen:    make(map[string]time.Time),
+		tracker: config.tracker,
+	}
+}
+
+// heartbeat renews the leases of the batches held by worker.
+func (d *dispatcher) heartbeat(worker string, held []string) {
+	d.Lock()
+	d.renew(worker, held)
+	d.Unlock()
+}
+
+func (d *dispatcher) renew(worker string, held []string) {
+	now := time.Now()
+	d.seen[worker] = now
+	for _, id := range held {
+		if b := d.leases[id]; b != nil && b.worker == worker {
+			b.expires = now.Add(leaseTimeout)
 		}
-		objs = append(objs, obj)
-	LOOP:
-		for {
-			select {
-			case obj = <-tasks:
-				if obj == nil {
-					break LOOP
-				}
+	}
+}
+
+func (d *dispatcher) lease(b *jobBatch, worker string) *jobBatch {
+	b.worker = worker
+	b.expires = time.Now().Add(leaseTimeout)
+	d.leases[b.id] = b
+	return b
+}
+
+// fetch returns a batch of jobs for worker, or nil with wait=false when all the jobs are finished.
+// The leases of the batches held by the worker are renewed.
+func (d *dispatcher) fetch(worker string, held []string) (b *jobBatch, wait bool) {
+	d.Lock()
+	d.renew(worker, held)
+	if len(d.stolen) > 0 {
+		b = d.stolen[0]
+		d.stolen = d.stolen[1:]
+		logger.Infof("%d jobs of %s are taken by %s", len(b.objs), b.worker, worker)
+		defer d.Unlock()
+		return d.lease(b, worker), false
+	}
+	closed := d.closed
+	d.Unlock()
+
+	var objs []object.Object
+	if !closed {
+		select {
+		case obj, ok := <-d.tasks:
+			if ok {
 				objs = append(objs, obj)
-				if len(objs) > 100 {
-					break LOOP
-				}
-			default:
+			} else {
+				closed = true
+			}
+		case <-time.After(time.Second):
+			return nil, true
+		}
+	}
+LOOP:
+	for len(objs) > 0 && len(objs) <= 100 {
+		select {
+		case obj := <-d.tasks:
+			if obj == nil {
 				break LOOP
 			}
+			objs = append(objs, obj)
+		default:
+			break LOOP
 		}
-		d, err := marshalObjects(objs)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if closed {
+		d.closed = true
+	}
+	if len(objs) == 0 {
+		return nil, len(d.leases) > 0 || len(d.stolen) > 0
+	}
+	d.seq++
+	return d.lease(&jobBatch{id: fmt.Sprintf("%x-%d", d.epoch, d.seq), objs: objs}, worker), false
+}
+
+// complete marks the batches as finished, no matter which worker they are leased to. The results
+// of unknown batches (from previous run of manager) are ignored.
+func (d *dispatcher) complete(results []batchResult) {
+	d.Lock()
+	defer d.Unlock()
+	for _, r := range results {
+		b := d.leases[r.ID]
+		if b != nil {
+			delete(d.leases, r.ID)
+		} else {
+			for i, s := range d.stolen {
+				if s.id == r.ID {
+					b = s
+					d.stolen = append(d.stolen[:i], d.stolen[i+1:]...)
+					break
+				}
+			}
+			if b == nil {
+				continue
+			}
+		}
+		if d.tracker != nil {
+			failed := make(map[string]bool)
+			for _, k := range r.Failed {
+				failed[k] = true
+			}
+			for _, o := range b.objs {
+				d.tracker.finish(o.Key(), !failed[o.Key()])
+			}
+		}
+	}
+}
+
+// expire takes back the batches which are not renewed in time, because the worker is lost or it
+// never received them.
+func (d *dispatcher) expire(now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	for w, last := range d.seen {
+		if now.Sub(last) >= leaseTimeout {
+			delete(d.seen, w)
+		}
+	}
+	for id, b := range d.leases {
+		if now.Before(b.expires) {
+			continue
+		}
+		delete(d.leases, id)
+		d.stolen = append(d.stolen, b)
+		logger.Warnf("Batch %s of %s is not renewed in time, %d unfinished jobs will be given to other workers", id, b.worker, len(b.objs))
+	}
+}
+
+func (d *dispatcher) run() {
+	for now := range time.Tick(time.Second) {
+		d.expire(now)
+	}
+}
+
+// drain waits for the batches leased to workers, and runs the stolen ones locally if there is no
+// worker alive.
+func (d *dispatcher) drain(src, dst object.ObjectStorage, config *Config) {
+	for {
+		d.Lock()
+		if len(d.leases) == 0 && len(d.stolen) == 0 {
+			d.Unlock()
 			return
 		}
-		logger.Debugf("send %d objects to %s", len(objs), req.RemoteAddr)
-		_, _ = w.Write(d)
+		var b *jobBatch
+		if len(d.stolen) > 0 && len(d.seen) == 0 {
+			b = d.stolen[0]
+			d.stolen = d.stolen[1:]
+		}
+		d.Unlock()
+		if b == nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		logger.Infof("No worker is alive, run %d jobs of %s locally", len(b.objs), b.worker)
+		tasks := make(chan object.Object, len(b.objs))
+		for _, o := range b.objs {
+			tasks <- o
+		}
+		close(tasks)
+		worker(tasks, src, dst, config)
+	}
+}
+
+// startManager serves the jobs for workers at config.ManagerAddr (or a random port of local IP),
+// and returns the address for workers to connect.
+func startManager(config *Config, tasks <-chan object.Object) (*dispatcher, string, error) {
+	d := newDispatcher(tasks, config)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fetch", func(w http.ResponseWriter, req *http.Request) {
+		worker := req.URL.Query().Get("id")
+		if worker == "" {
+			http.Error(w, "id of worker is required", http.StatusBadRequest)
+			return
+		}
+		var fr fetchRequest
+		if req.Method == "POST" {
+			if err := json.NewDecoder(req.Body).Decode(&fr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			d.complete(fr.Done)
+		}
+		var r fetchResult
+		b, wait := d.fetch(worker, fr.Held)
+		if b != nil {
+			data, err := marshalObjects(b.objs)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			r.ID, r.Objects = b.id, data
+			logger.Debugf("send %d objects to %s", len(b.objs), worker)
+		} else {
+			r.Objects, r.Wait = json.RawMessage("[]"), wait
+		}
+		data, _ := json.Marshal(r)
+		_, _ = w.Write(data)
 	})
-	http.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != "POST" {
 			http.Error(w, "POST required", http.StatusBadRequest)
 			return
 		}
-		d, err := io.ReadAll(req.Body)
+		data, err := io.ReadAll(req.Body)
 		if err != nil {
 			logger.Errorf("read: %s", err)
 			return
 		}
-		var r Stat
-		err = json.Unmarshal(d, &r)
+		id := req.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "id of worker is required", http.StatusBadRequest)
+			return
+		}
+		var r statsReport
+		err = json.Unmarshal(data, &r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		updateStats(&r)
+		d.heartbeat(id, r.Held)
+		updateStats(&r.Stat)
 		logger.Debugf("receive stats %+v from %s", r, req.RemoteAddr)
 		_, _ = w.Write([]byte("OK"))
 	})
 	ips, err := utils.FindLocalIPs()
 	if err != nil {
-		return "", fmt.Errorf("find local ips: %s", err)
+		return nil, "", fmt.Errorf("find local ips: %s", err)
 	}
 	var ip string
 	for _, i := range ips {
@@ -161,17 +404,24 @@ func startManager(tasks <-chan object.Object) (string, error) {
 		}
 	}
 	if ip == "" {
-		return "", fmt.Errorf("no local ip found")
+		return nil, "", fmt.Errorf("no local ip found")
+	}
+	listenAddr := ip + ":"
+	if config.ManagerAddr != "" {
+		listenAddr = config.ManagerAddr
 	}
-	l, err := net.Listen("tcp", ip+":")
+	l, err := net.Listen("tcp", listenAddr)
 	if err != nil {
-		return "", fmt.Errorf("listen: %s", err)
+		return nil, "", fmt.Errorf("listen: %s", err)
 	}
 	logger.Infof("Listen at %s", l.Addr())
-	go func() { _ = http.Serve(l, nil) }()
-	ps := strings.Split(l.Addr().String(), ":")
-	port := ps[len(ps)-1]
-	return fmt.Sprintf("%s:%s", ip, port), nil
+	go func() { _ = http.Serve(l, mux) }()
+	go d.run()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	if parsed := net.ParseIP(host); parsed == nil || parsed.IsUnspecified() {
+		host = ip
+	}
+	return d, net.JoinHostPort(host, port), nil
 }
 
 func findSelfPath() (string, error) {
@@ -301,26 +551,114 @@ func unmarshalObjects(d []byte) ([]object.Object, error) {
 	return objs, nil
 }
 
+// batchTracker tracks the jobs of batches in a worker, and reports the finished batches to manager.
+type batchTracker struct {
+	sync.Mutex
+	batch  map[string]string // key -> id of batch
+	remain map[string]int    // id -> the number of unfinished jobs
+	failed map[string][]string
+	done   []batchResult
+}
+
+func newBatchTracker() *batchTracker {
+	return &batchTracker{batch: make(map[string]string), remain: make(map[string]int), failed: make(map[string][]string)}
+}
+
+func (t *batchTracker) add(id string, objs []object.Object) {
+	t.Lock()
+	defer t.Unlock()
+	for _, o := range objs {
+		t.batch[o.Key()] = id
+	}
+	t.remain[id] += len(objs)
+}
+
+func (t *batchTracker) finish(key string, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	id, found := t.batch[key]
+	if !found {
+		return
+	}
+	delete(t.batch, key)
+	if !ok {
+		t.failed[id] = append(t.failed[id], key)
+	}
+	if t.remain[id]--; t.remain[id] <= 0 {
+		t.done = append(t.done, batchResult{id, t.failed[id]})
+		delete(t.remain, id)
+		delete(t.failed, id)
+	}
+}
+
+// held returns the IDs of batches which are not finished or not reported yet.
+func (t *batchTracker) held() []string {
+	t.Lock()
+	defer t.Unlock()
+	ids := make([]string, 0, len(t.remain)+len(t.done))
+	for id := range t.remain {
+		ids = append(ids, id)
+	}
+	for _, r := range t.done {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+// results returns the finished batches which are not reported yet.
+func (t *batchTracker) results() []batchResult {
+	t.Lock()
+	defer t.Unlock()
+	r := t.done
+	t.done = nil
+	return r
+}
+
+// putBack keeps the results which failed to report, to be reported again.
+func (t *batchTracker) putBack(r []batchResult) {
+	t.Lock()
+	t.done = append(r, t.done...)
+	t.Unlock()
+}
+
+// fetchJobs fetches jobs from manager until all the jobs are finished, it keeps retrying if the manager
+// is not available (restarted), and reports the finished batches in the next fetch.
 func fetchJobs(tasks chan<- object.Object, config *Config) {
+	if config.batches == nil {
+		config.batches = newBatchTracker()
+	}
 	for {
-		url := fmt.Sprintf("http://%s/fetch", config.Manager)
-		ans, err := httpRequest(url, nil)
+		uri := fmt.Sprintf("http://%s/fetch?id=%s", config.Manager, url.QueryEscape(workerID))
+		held := config.batches.held()
+		results := config.batches.results()
+		body, _ := json.Marshal(fetchRequest{Done: results, Held: held})
+		ans, err := httpRequest(uri, body)
 		if err != nil {
+			config.batches.putBack(results)
 			logger.Errorf("fetch jobs: %s", err)
 			time.Sleep(time.Second)
 			continue
 		}
+		var r fetchResult
 		var jobs []object.Object
-		jobs, err = unmarshalObjects(ans)
+		if err = json.Unmarshal(ans, &r); err == nil {
+			jobs, err = unmarshalObjects(r.Objects)
+		}
 		if err != nil {
+			config.batches.putBack(results)
 			logger.Errorf("Unmarshal %s: %s", string(ans), err)
 			time.Sleep(time.Second)
 			continue
 		}
 		logger.Debugf("got %d jobs", len(jobs))
 		if len(jobs) == 0 {
+			if r.Wait {
+				time.Sleep(time.Second)
+				continue
+			}
 			break
 		}
+		config.batches.add(r.ID, jobs)
 		for _, obj := range jobs {
 			tasks <- obj
 		}
@@ -40,7 +40,7 @@ func (o *obj) StorageClass() string { return "" }
 func TestCluster(t *testing.T) {
 	// manager
 	todo := make(chan object.Object, 100)
-	addr, err := startManager(todo)
+	_, addr, err := startManager(&Config{}, todo)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,6 +48,7 @@ func TestCluster(t *testing.T) {
 	// worker
 	var conf Config
 	conf.Manager = addr
+	conf.batches = newBatchTracker()
 	mytodo := make(chan object.Object, 100)
 	go fetchJobs(mytodo, &conf)
 
@@ -58,7 +59,85 @@ func TestCluster(t *testing.T) {
 	if obj.Key() != "test" {
 		t.Fatalf("expect test but got %s", obj.Key())
 	}
+	// it should wait for the unfinished job
+	select {
+	case <-mytodo:
+		t.Fatalf("should wait for the unfinished job")
+	case <-time.After(time.Millisecond * 1500):
+	}
+	conf.batches.finish("test", true)
 	if _, ok := <-mytodo; ok {
 		t.Fatalf("should end")
 	}
 }
+
+func TestDispatcher(t *testing.T) {
+	todo := make(chan object.Object, 10)
+	tr := &tracker{done: make(map[string]struct{})}
+	d := newDispatcher(todo, &Config{tracker: tr})
+	for _, k := range []string{"a", "b"} {
+		tr.dispatch(k)
+		todo <- &obj{key: k}
+	}
+	close(todo)
+
+	b, wait := d.fetch("w1", nil)
+	if b == nil || len(b.objs) != 2 || wait {
+		t.Fatalf("fetch: %+v %v", b, wait)
+	}
+	if b2, wait := d.fetch("w2", nil); b2 != nil || !wait {
+		t.Fatalf("w2 should wait for w1: %+v %v", b2, wait)
+	}
+	// w1 renews the lease of the batch it holds
+	b.expires = time.Now().Add(time.Second)
+	d.heartbeat("w1", []string{b.id})
+	d.heartbeat("w2", []string{b.id}) // not leased to w2
+	d.expire(time.Now().Add(leaseTimeout / 2))
+	if len(d.stolen) != 0 {
+		t.Fatalf("the lease of w1 is renewed")
+	}
+	// w1 is alive but does not hold the batch (e.g. the response is lost), the jobs are stolen by w2
+	d.heartbeat("w1", nil)
+	d.expire(time.Now().Add(leaseTimeout))
+	b2, _ := d.fetch("w2", nil)
+	if b2 == nil || b2.id != b.id || b2.worker != "w2" {
+		t.Fatalf("w2 should take the jobs of w1: %+v", b2)
+	}
+	d.complete([]batchResult{{ID: "unknown"}, {ID: b.id, Failed: []string{"b"}}})
+	if len(d.leases) != 0 {
+		t.Fatalf("leases: %+v", d.leases)
+	}
+	if _, failed := tr.next(); len(failed) != 1 || failed[0] != "b" {
+		t.Fatalf("failed job should be saved in checkpoint: %v", failed)
+	}
+	if b, wait := d.fetch("w2", nil); b != nil || wait {
+		t.Fatalf("all the jobs are finished: %+v %v", b, wait)
+	}
+}
+
+func TestBatchTracker(t *testing.T) {
+	bt := newBatchTracker()
+	bt.add("1", []object.Object{&obj{key: "a"}, &obj{key: "b"}})
+	bt.add("2", []object.Object{&obj{key: "c"}})
+	bt.finish("a", true)
+	bt.finish("c", false)
+	bt.finish("x", true)
+	r := bt.results()
+	if len(r) != 1 || r[0].ID != "2" || len(r[0].Failed) != 1 || r[0].Failed[0] != "c" {
+		t.Fatalf("results: %+v", r)
+	}
+	if h := bt.held(); len(h) != 1 || h[0] != "1" {
+		t.Fatalf("held: %+v", h)
+	}
+	bt.putBack(r)
+	if h := bt.held(); len(h) != 2 {
+		t.Fatalf("the unreported batch should be held: %+v", h)
+	}
+	bt.finish("b", true)
+	if r = bt.results(); len(r) != 2 || r[0].ID != "2" || r[1].ID != "1" || len(r[1].Failed) != 0 {
+		t.Fatalf("results: %+v", r)
+	}
+	if r = bt.results(); len(r) != 0 {
+		t.Fatalf("results should be drained: %+v", r)
+	}
+}
@@ -17,9 +17,13 @@
 package sync
 
 import (
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/urfave/cli/v2"
 )
 
@@ -32,30 +36,52 @@ type Config struct {
 	Update         bool
 	ForceUpdate    bool
 	Perms          bool
+	Xattrs         bool
 	Dry            bool
 	DeleteSrc      bool
 	DeleteDst      bool
 	Dirs           bool
 	Exclude        []string
 	Include        []string
+	ExcludeRegex   []string
+	IncludeRegex   []string
+	MinSize        int64
+	MaxSize        int64 // 0 means unlimited
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
 	Existing       bool
 	IgnoreExisting bool
 	Links          bool
 	Limit          int64
 	Manager        string
+	ManagerAddr    string // the address for workers to join
 	Workers        []string
 	ListThreads    int
 	ListDepth      int
-	BWLimit        int
+	BWLimit        int // in Mbps, outside of BWWindows
+	BWWindows      []BWWindow
 	NoHTTPS        bool
 	Verbose        bool
 	Quiet          bool
 	CheckAll       bool
 	CheckNew       bool
+	ChecksumAlgo   string
+	Verify         bool
+	VerifyReport   string
+	Checkpoint     string
+	Inventory      *Inventory
+	DryReport      string
+	Clone          bool
+	Events         string // the URI of bucket notifications
+	EventPrefix    string // the prefix of source in the keys of notifications
 	Env            map[string]string
 
 	rules          []rule
 	concurrentList chan int
+	tracker        *tracker
+	dryReport      *planReport
+	batches        *batchTracker
+	metaDiff       bool // both are JuiceFS
 }
 
 func envList() []string {
@@ -123,6 +149,35 @@ func envList() []string {
 	}
 }
 
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	size, err := humanize.ParseBytes(s)
+	return int64(size), err
+}
+
+// parseTime parses an absolute time in local timezone, or an age like 90d or 12h before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.ParseFloat(s[:len(s)-1], 64); err == nil {
+			return now.Add(-time.Duration(days * float64(24*time.Hour))), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q should be like \"2006-01-02 15:04:05\", 2006-01-02 or 90d", s)
+}
+
 func NewConfigFromCli(c *cli.Context) *Config {
 	if c.Int64("limit") < -1 {
 		logger.Fatal("limit should not be less than -1")
@@ -138,26 +193,58 @@ func NewConfigFromCli(c *cli.Context) *Config {
 		Update:         c.Bool("update"),
 		ForceUpdate:    c.Bool("force-update"),
 		Perms:          c.Bool("perms"),
+		Xattrs:         c.Bool("xattrs"),
 		Dirs:           c.Bool("dirs"),
-		Dry:            c.Bool("dry"),
+		Dry:            c.Bool("dry") || c.IsSet("dry-report"),
+		DryReport:      c.String("dry-report"),
 		DeleteSrc:      c.Bool("delete-src"),
 		DeleteDst:      c.Bool("delete-dst"),
 		Exclude:        c.StringSlice("exclude"),
 		Include:        c.StringSlice("include"),
+		ExcludeRegex:   c.StringSlice("exclude-regex"),
+		IncludeRegex:   c.StringSlice("include-regex"),
 		Existing:       c.Bool("existing"),
 		IgnoreExisting: c.Bool("ignore-existing"),
 		Links:          c.Bool("links"),
 		Limit:          c.Int64("limit"),
 		Workers:        c.StringSlice("worker"),
 		Manager:        c.String("manager"),
-		BWLimit:        c.Int("bwlimit"),
+		ManagerAddr:    c.String("manager-addr"),
 		NoHTTPS:        c.Bool("no-https"),
 		Verbose:        c.Bool("verbose"),
 		Quiet:          c.Bool("quiet"),
 		CheckAll:       c.Bool("check-all"),
 		CheckNew:       c.Bool("check-new"),
+		ChecksumAlgo:   c.String("checksum-algo"),
+		Verify:         c.Bool("verify") || c.IsSet("verify-report"),
+		VerifyReport:   c.String("verify-report"),
+		Checkpoint:     c.String("checkpoint"),
+		Clone:          c.Bool("clone"),
+		Events:         c.String("events"),
 		Env:            make(map[string]string),
 	}
+	var err error
+	if cfg.MinSize, err = parseSize(c.String("min-size")); err != nil {
+		logger.Fatalf("invalid min-size: %s", err)
+	}
+	if cfg.MaxSize, err = parseSize(c.String("max-size")); err != nil {
+		logger.Fatalf("invalid max-size: %s", err)
+	}
+	now := time.Now()
+	if cfg.ModifiedAfter, err = parseTime(c.String("modified-after"), now); err != nil {
+		logger.Fatalf("invalid modified-after: %s", err)
+	}
+	if cfg.ModifiedBefore, err = parseTime(c.String("modified-before"), now); err != nil {
+		logger.Fatalf("invalid modified-before: %s", err)
+	}
+	if cfg.ChecksumAlgo != "" {
+		if _, err = newHash(cfg.ChecksumAlgo); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if cfg.BWLimit, cfg.BWWindows, err = parseBWLimit(c.String("bwlimit")); err != nil {
+		logger.Fatalf("invalid bwlimit: %s", err)
+	}
 	if cfg.Threads <= 0 {
 		logger.Warnf("threads should be larger than 0, reset it to 1")
 		cfg.Threads = 1
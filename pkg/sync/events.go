@@ -0,0 +1,451 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/segmentio/kafka-go"
+)
+
+// The notifications of bucket (from S3, OSS or MinIO) only tell which keys are changed, so the
+// current state of the key in source is applied to destination: copy it if it exists, or delete it
+// from destination (with --delete-dst) otherwise. It's idempotent, so the notifications could be
+// delivered more than once or out of order.
+
+type s3Notification struct {
+	// SNS
+	Type             string `json:"Type"`
+	MessageId        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	SubscribeURL     string `json:"SubscribeURL"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	// S3 and MinIO
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+	// OSS
+	Events []struct {
+		EventName string `json:"eventName"`
+		OSS       struct {
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"oss"`
+	} `json:"events"`
+}
+
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// isSNSURL checks that the URL is served by SNS, which is the only one a message of SNS could
+// point to, otherwise anyone could make us request any URL by posting a message.
+func isSNSURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.User == nil && u.Port() == "" && snsHost.MatchString(u.Hostname())
+}
+
+var snsCerts sync.Map // url -> *x509.Certificate
+
+// fetchSNSCert downloads the certificate to verify the signature of SNS messages.
+var fetchSNSCert = func(certURL string) (*x509.Certificate, error) {
+	if c, ok := snsCerts.Load(certURL); ok {
+		return c.(*x509.Certificate), nil
+	}
+	resp, err := http.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s: %s", certURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate in %s", certURL)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	snsCerts.Store(certURL, cert)
+	return cert, nil
+}
+
+// verifySNS checks the signature of a message from SNS, see
+// https://docs.aws.amazon.com/sns/latest/dg/sns-verify-signature-of-message.html
+func verifySNS(n *s3Notification) error {
+	if !isSNSURL(n.SigningCertURL) || !strings.HasSuffix(n.SigningCertURL, ".pem") {
+		return fmt.Errorf("invalid SigningCertURL: %q", n.SigningCertURL)
+	}
+	fields := []string{"Message", n.Message, "MessageId", n.MessageId}
+	if n.Type == "Notification" {
+		if n.Subject != "" {
+			fields = append(fields, "Subject", n.Subject)
+		}
+	} else {
+		fields = append(fields, "SubscribeURL", n.SubscribeURL)
+	}
+	fields = append(fields, "Timestamp", n.Timestamp)
+	if n.Type != "Notification" {
+		fields = append(fields, "Token", n.Token)
+	}
+	fields = append(fields, "TopicArn", n.TopicArn, "Type", n.Type)
+	toSign := []byte(strings.Join(fields, "\n") + "\n")
+
+	sig, err := base64.StdEncoding.DecodeString(n.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	cert, err := fetchSNSCert(n.SigningCertURL)
+	if err != nil {
+		return fmt.Errorf("get certificate of SNS: %s", err)
+	}
+	var algo x509.SignatureAlgorithm
+	switch n.SignatureVersion {
+	case "1":
+		algo = x509.SHA1WithRSA
+	case "2":
+		algo = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported SignatureVersion: %q", n.SignatureVersion)
+	}
+	if err = cert.CheckSignature(algo, toSign, sig); err != nil {
+		return fmt.Errorf("verify signature of SNS message %s: %s", n.MessageId, err)
+	}
+	return nil
+}
+
+// parseNotification returns the changed keys in a notification, and the URL to confirm the
+// subscription of SNS. The messages of SNS are verified by their signatures.
+func parseNotification(body []byte) (keys []string, confirm string, err error) {
+	var n s3Notification
+	if err = json.Unmarshal(body, &n); err != nil {
+		return nil, "", fmt.Errorf("decode notification: %s", err)
+	}
+	switch n.Type {
+	case "SubscriptionConfirmation", "Notification":
+		if err = verifySNS(&n); err != nil {
+			return nil, "", err
+		}
+		if n.Type == "Notification" {
+			return parseNotification([]byte(n.Message))
+		}
+		if !isSNSURL(n.SubscribeURL) {
+			return nil, "", fmt.Errorf("invalid SubscribeURL: %q", n.SubscribeURL)
+		}
+		return nil, n.SubscribeURL, nil
+	case "":
+	default:
+		return nil, "", nil // UnsubscribeConfirmation
+	}
+	var raw []string
+	for _, r := range n.Records {
+		raw = append(raw, r.S3.Object.Key)
+	}
+	for _, e := range n.Events {
+		raw = append(raw, e.OSS.Object.Key)
+	}
+	for _, k := range raw {
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid key %q: %s", k, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, "", nil
+}
+
+// applyChange makes the key in destination the same as the one in source.
+func applyChange(src, dst object.ObjectStorage, key string, config *Config) error {
+	if len(config.rules) > 0 && !matchKey(config.rules, key) {
+		return nil
+	}
+	obj, err := src.Head(key)
+	if os.IsNotExist(err) || errors.Is(err, os.ErrNotExist) {
+		if config.DeleteDst && !deleteObj(dst, key, config.Dry) {
+			return fmt.Errorf("delete %s from %s failed", key, dst)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("head %s from %s: %s", key, src, err)
+	}
+	if !config.Dirs && obj.IsDir() || !matchAttrs(config, obj) {
+		return nil
+	}
+	if d, err := dst.Head(key); err == nil && !config.ForceUpdate && d.Size() == obj.Size() && !d.Mtime().Before(obj.Mtime()) {
+		skipped.Increment()
+		return nil
+	}
+	if config.Dry {
+		logger.Infof("Will copy %s (%d bytes)", key, obj.Size())
+		return nil
+	}
+	if !copyObject(src, dst, obj, config) {
+		return fmt.Errorf("copy %s failed", key)
+	}
+	return nil
+}
+
+type eventHandler func(body []byte) error
+
+func newEventHandler(src, dst object.ObjectStorage, config *Config) eventHandler {
+	return func(body []byte) error {
+		keys, confirm, err := parseNotification(body)
+		if err != nil {
+			return err
+		}
+		if confirm != "" {
+			logger.Infof("Confirm subscription of SNS: %s", confirm)
+			resp, err := http.Get(confirm)
+			if err != nil {
+				return err
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("confirm subscription: %s", resp.Status)
+			}
+			return nil
+		}
+		var lastErr error
+		for _, key := range keys {
+			if !strings.HasPrefix(key, config.EventPrefix) {
+				continue
+			}
+			if err = applyChange(src, dst, key[len(config.EventPrefix):], config); err != nil {
+				logger.Errorf("Apply change of %s: %s", key, err)
+				lastErr = err
+			}
+		}
+		return lastErr
+	}
+}
+
+// consumeSQS receives notifications from an SQS queue, the messages are deleted after applied.
+func consumeSQS(queue string, threads int, handle eventHandler) error {
+	u, err := url.Parse(queue)
+	if err != nil {
+		return err
+	}
+	region := "us-east-1"
+	if ps := strings.Split(u.Host, "."); len(ps) > 2 && ps[0] == "sqs" {
+		region = ps[1]
+	}
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return err
+	}
+	client := sqs.New(sess)
+	queueURL := "https://" + u.Host + u.Path
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				out, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+					QueueUrl:            &queueURL,
+					MaxNumberOfMessages: aws.Int64(10),
+					WaitTimeSeconds:     aws.Int64(20),
+				})
+				if err != nil {
+					logger.Warnf("Receive messages from %s: %s", queueURL, err)
+					time.Sleep(time.Second * 5)
+					continue
+				}
+				for _, m := range out.Messages {
+					if err := handle([]byte(aws.StringValue(m.Body))); err != nil {
+						continue // will be received again after visibility timeout
+					}
+					if _, err := client.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: &queueURL, ReceiptHandle: m.ReceiptHandle}); err != nil {
+						logger.Warnf("Delete message %s: %s", aws.StringValue(m.MessageId), err)
+					}
+				}
+			}
+		}()
+	}
+	logger.Infof("Consuming notifications from SQS queue %s", queueURL)
+	wg.Wait()
+	return nil
+}
+
+// consumeKafka reads notifications from a topic of Kafka, the offsets are committed after a batch
+// of messages are applied. A message which still can't be applied after retries is sent to the
+// dead-letter topic (if any) or skipped, so it will not block the following ones forever.
+func consumeKafka(uri string, threads int, handle eventHandler) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	group := u.Query().Get("group")
+	if group == "" {
+		group = "juicefs-sync"
+	}
+	topic := strings.Trim(u.Path, "/")
+	if topic == "" {
+		return fmt.Errorf("no topic in %s", uri)
+	}
+	brokers := strings.Split(u.Host, ",")
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: brokers,
+		GroupID: group,
+		Topic:   topic,
+	})
+	defer r.Close()
+	var dlq *kafka.Writer
+	if dl := u.Query().Get("dead-letter"); dl != "" {
+		dlq = &kafka.Writer{Addr: kafka.TCP(brokers...), Topic: dl}
+		defer dlq.Close()
+	}
+	logger.Infof("Consuming notifications from topic %s of Kafka %s (group %s)", topic, u.Host, group)
+	ctx := context.Background()
+	for {
+		m, err := r.FetchMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("fetch message: %s", err)
+		}
+		batch := []kafka.Message{m}
+		// fetch more messages which are ready to process them concurrently
+		for len(batch) < threads {
+			fctx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+			m, err = r.FetchMessage(fctx)
+			cancel()
+			if err != nil {
+				break
+			}
+			batch = append(batch, m)
+		}
+		var wg sync.WaitGroup
+		errs := make([]error, len(batch))
+		for i, m := range batch {
+			wg.Add(1)
+			go func(i int, m kafka.Message) {
+				defer wg.Done()
+				for try := 0; ; try++ {
+					if errs[i] = handle(m.Value); errs[i] == nil || try == 3 {
+						return
+					}
+					time.Sleep(time.Second * time.Duration(try+1))
+				}
+			}(i, m)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err == nil {
+				continue
+			}
+			m := batch[i]
+			if dlq == nil {
+				logger.Errorf("Skip message at offset %d of partition %d: %s", m.Offset, m.Partition, err)
+				continue
+			}
+			// the batch is not committed if it fails to send, so it will be consumed again after restarted
+			if err = dlq.WriteMessages(ctx, kafka.Message{Key: m.Key, Value: m.Value}); err != nil {
+				return fmt.Errorf("send message at offset %d of partition %d to %s: %s", m.Offset, m.Partition, dlq.Topic, err)
+			}
+			logger.Warnf("Sent message at offset %d of partition %d to %s", m.Offset, m.Partition, dlq.Topic)
+		}
+		if err = r.CommitMessages(ctx, batch...); err != nil {
+			logger.Warnf("Commit messages: %s", err)
+		}
+	}
+}
+
+// serveWebhook receives notifications by HTTP POST, a failed one is responded with 500 to be retried.
+func serveWebhook(uri string, handle eventHandler) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+		if err == nil {
+			err = handle(body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	logger.Infof("Listening on %s for notifications", uri)
+	return http.ListenAndServe(u.Host, mux)
+}
+
+// watch applies the changes of source to destination according to the notifications, until
+// the consumer of notifications fails.
+func watch(src, dst object.ObjectStorage, config *Config) error {
+	handle := newEventHandler(src, dst, config)
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			logger.Infof("Copied: %d (%s), deleted: %d, skipped: %d, failed: %d", copied.Current(),
+				formatSize(copiedBytes.Current()), deleted.Current(), skipped.Current(), failed.Current())
+		}
+	}()
+	switch scheme := strings.SplitN(config.Events, "://", 2)[0]; scheme {
+	case "sqs":
+		return consumeSQS(config.Events, config.Threads, handle)
+	case "kafka":
+		return consumeKafka(config.Events, config.Threads, handle)
+	case "http":
+		return serveWebhook(config.Events, handle)
+	default:
+		return fmt.Errorf("unsupported notifications %s, should be sqs://, kafka:// or http://", config.Events)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// manifest of S3 Inventory, see https://docs.aws.amazon.com/AmazonS3/latest/userguide/storage-inventory-location.html
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	CreationTimestamp string `json:"creationTimestamp"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key         string `json:"key"`
+		Size        int64  `json:"size"`
+		MD5checksum string `json:"MD5checksum"`
+	} `json:"files"`
+}
+
+// Inventory is a point-in-time listing of the source, which is used instead of LIST calls.
+type Inventory struct {
+	Store    object.ObjectStorage // the bucket where the inventory is kept
+	Manifest string               // the key of manifest.json in Store
+	Prefix   string               // the prefix of source in the inventory
+}
+
+func loadManifest(store object.ObjectStorage, key string) (*inventoryManifest, error) {
+	in, err := store.Get(key, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("get manifest %s: %s", key, err)
+	}
+	defer in.Close()
+	var m inventoryManifest
+	if err = json.NewDecoder(in).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decode manifest %s: %s", key, err)
+	}
+	if !strings.EqualFold(m.FileFormat, "CSV") {
+		return nil, fmt.Errorf("format %s of inventory is not supported, only CSV is supported", m.FileFormat)
+	}
+	return &m, nil
+}
+
+type invObject struct {
+	key   string
+	size  int64
+	mtime time.Time
+	sc    string
+}
+
+func (o *invObject) Key() string          { return o.key }
+func (o *invObject) Size() int64          { return o.size }
+func (o *invObject) Mtime() time.Time     { return o.mtime }
+func (o *invObject) IsDir() bool          { return strings.HasSuffix(o.key, "/") }
+func (o *invObject) IsSymlink() bool      { return false }
+func (o *invObject) StorageClass() string { return o.sc }
+
+// inventoryReader parses the rows of a data file of inventory.
+type inventoryReader struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func newInventoryReader(in io.Reader, schema string) *inventoryReader {
+	columns := make(map[string]int)
+	for i, c := range strings.Split(schema, ",") {
+		columns[strings.TrimSpace(c)] = i
+	}
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	return &inventoryReader{r, columns}
+}
+
+func (r *inventoryReader) field(row []string, name string) string {
+	if i, ok := r.columns[name]; ok && i < len(row) {
+		return row[i]
+	}
+	return ""
+}
+
+// next returns the next object, or nil for the old versions and delete markers.
+func (r *inventoryReader) next() (*invObject, error) {
+	row, err := r.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if r.field(row, "IsLatest") == "false" || r.field(row, "IsDeleteMarker") == "true" {
+		return nil, nil
+	}
+	key, err := url.QueryUnescape(r.field(row, "Key"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %q: %s", r.field(row, "Key"), err)
+	}
+	o := &invObject{key: key, sc: r.field(row, "StorageClass")}
+	if s := r.field(row, "Size"); s != "" {
+		if o.size, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid size of %s: %s", key, s)
+		}
+	}
+	if t := r.field(row, "LastModifiedDate"); t != "" {
+		if o.mtime, err = time.Parse(time.RFC3339, t); err != nil {
+			return nil, fmt.Errorf("invalid last modified date of %s: %s", key, t)
+		}
+	}
+	return o, nil
+}
+
+// listInventory lists the objects with prefix in range [start, end] of the inventory, in the same way
+// as ListAll. The data files are read one by one, and the keys in them should be sorted.
+func listInventory(inv *Inventory, prefix, start, end string) (<-chan object.Object, error) {
+	m, err := loadManifest(inv.Store, inv.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Listing %s%s from inventory %s created at %s with %d files", m.SourceBucket, inv.Prefix, inv.Manifest, m.CreationTimestamp, len(m.Files))
+	prefix = inv.Prefix + prefix
+	if start != "" {
+		start = inv.Prefix + start
+	}
+	if end != "" {
+		end = inv.Prefix + end
+	}
+	out := make(chan object.Object, maxResults*10)
+	go func() {
+		defer close(out)
+		var last string
+		for _, f := range m.Files {
+			err := readInventoryFile(inv.Store, f.Key, f.MD5checksum, m.FileSchema, func(o *invObject) error {
+				if o.key < last {
+					return fmt.Errorf("keys are not sorted: %q after %q", o.key, last)
+				}
+				last = o.key
+				if !strings.HasPrefix(o.key, prefix) || o.key < start {
+					return nil
+				}
+				if end != "" && o.key > end {
+					return errStopInventory
+				}
+				o.key = o.key[len(inv.Prefix):]
+				out <- o
+				return nil
+			})
+			if err == errStopInventory {
+				return
+			} else if err != nil {
+				logger.Errorf("Read inventory file %s: %s", f.Key, err)
+				out <- nil
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+var errStopInventory = fmt.Errorf("stop reading inventory")
+
+// readInventoryFile calls fn for every object in a data file, until fn returns an error.
+func readInventoryFile(store object.ObjectStorage, key, checksum, schema string, fn func(o *invObject) error) error {
+	in, err := store.Get(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	h := md5.New()
+	tee := io.TeeReader(in, h)
+	var r = tee
+	if strings.HasSuffix(key, ".gz") {
+		gz, err := gzip.NewReader(tee)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	ir := newInventoryReader(r, schema)
+	for {
+		o, err := ir.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if o != nil {
+			if err = fn(o); err != nil {
+				return err
+			}
+		}
+	}
+	_, _ = io.Copy(io.Discard, tee)
+	if checksum != "" && hex.EncodeToString(h.Sum(nil)) != checksum {
+		return fmt.Errorf("checksum mismatch: %x != %s", h.Sum(nil), checksum)
+	}
+	return nil
+}
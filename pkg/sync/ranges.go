@@ -0,0 +1,140 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// Between two JuiceFS volumes, the fingerprints of the chunks (from the slices in metadata) of the
+// source are saved in the destination after a file is synced, so the next time only the chunks
+// whose fingerprints are changed need to be copied.
+
+// copyFile copies the data of a file, it clones the file when both are in the same volume (with
+// --clone), or copies only the changed ranges if the destination is synced from the same source.
+func copyFile(src, dst object.ObjectStorage, obj object.Object, config *Config) error {
+	key, size := obj.Key(), obj.Size()
+	s, ok := src.(object.SupportFingerprint)
+	d, ok2 := dst.(object.SupportFingerprint)
+	if !ok || !ok2 {
+		return copyData(src, dst, key, size)
+	}
+	rangeSize, fps, err := s.Fingerprints(key)
+	if err != nil {
+		if !errors.Is(err, utils.ENOTSUP) {
+			logger.Debugf("Fingerprints of %s: %s", key, err)
+		}
+		return copyData(src, dst, key, size)
+	}
+
+	if config.Clone && cloneFile(src, dst, key) == nil {
+		logger.Debugf("Cloned %s (%d bytes)", key, size)
+	} else if old, _ := d.SourceFingerprints(key); old != nil {
+		if err = copyRanges(src, d, key, size, rangeSize, fps, old); err != nil {
+			return err
+		}
+	} else if err = copyData(src, dst, key, size); err != nil {
+		return err
+	}
+	if err = d.SetSourceFingerprints(key, fps); err != nil {
+		logger.Warnf("Save fingerprints of %s: %s", key, err)
+	}
+	return nil
+}
+
+// compareFile compares the fingerprints of source and the ones saved in destination, or the
+// checksums if the fingerprints are not available.
+func compareFile(src, dst object.ObjectStorage, key string, size int64) (bool, error) {
+	s, ok := src.(object.SupportFingerprint)
+	d, ok2 := dst.(object.SupportFingerprint)
+	if ok && ok2 {
+		if _, fps, err := s.Fingerprints(key); err == nil {
+			if old, err := d.SourceFingerprints(key); err == nil && old != nil {
+				equal := strings.Join(fps, ",") == strings.Join(old, ",")
+				logger.Debugf("Compared the fingerprints of %s: equal=%t", key, equal)
+				return equal, nil
+			}
+		}
+	}
+	return checkSum(src, dst, key, size)
+}
+
+func cloneFile(src, dst object.ObjectStorage, key string) error {
+	s, ok := src.(object.SupportClone)
+	d, ok2 := dst.(object.SupportClone)
+	if !ok || !ok2 {
+		return utils.ENOTSUP
+	}
+	sv, sp, err := s.Locate(key)
+	if err != nil {
+		return err
+	}
+	if dv, _, err := d.Locate(key); err != nil {
+		return err
+	} else if sv != dv {
+		return utils.ENOTSUP
+	}
+	if err = d.CloneFrom(sp, key); err != nil {
+		logger.Warnf("Clone %s: %s", key, err)
+	}
+	return err
+}
+
+// copyRanges copies the ranges whose fingerprints are different from the old ones.
+func copyRanges(src object.ObjectStorage, dst object.SupportFingerprint, key string, size, rangeSize int64, fps, old []string) error {
+	start := time.Now()
+	var changed int
+	for i, fp := range fps {
+		if i < len(old) && old[i] == fp {
+			continue
+		}
+		off := int64(i) * rangeSize
+		n := rangeSize
+		if off+n > size {
+			n = size - off
+		}
+		if n <= 0 {
+			break
+		}
+		if limiter != nil {
+			limiter.Wait(n)
+		}
+		err := try(3, func() error {
+			in, err := src.Get(key, off, n)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			return dst.WriteAt(key, in, off)
+		})
+		if err != nil {
+			return err
+		}
+		copiedBytes.IncrInt64(n)
+		changed++
+	}
+	if err := dst.Truncate(key, size); err != nil {
+		return err
+	}
+	logger.Debugf("Copied %d of %d changed ranges of %s in %s", changed, len(fps), key, time.Since(start))
+	return nil
+}
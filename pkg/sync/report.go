@@ -0,0 +1,162 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// actions in the report of dry run
+const (
+	planAdd       = "add"
+	planUpdate    = "update"
+	planCheck     = "check" // compare the checksums, and update it if they are different
+	planDelete    = "delete"
+	planDeleteSrc = "delete-src"
+)
+
+type planEntry struct {
+	Action   string     `json:"action"`
+	Key      string     `json:"key"`
+	Size     int64      `json:"size"`
+	Mtime    time.Time  `json:"mtime"`
+	DstSize  int64      `json:"dst_size"` // -1 if it's not in destination
+	DstMtime *time.Time `json:"dst_mtime,omitempty"`
+	Reason   string     `json:"reason"`
+}
+
+type planSummary struct {
+	Objects map[string]int64 `json:"objects"` // by action
+	Bytes   map[string]int64 `json:"bytes"`
+}
+
+// planReport writes what will be done in a dry run into a file, as CSV if the name ends with
+// .csv, or JSON otherwise.
+type planReport struct {
+	sync.Mutex
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	csv     *csv.Writer
+	entries int
+	summary planSummary
+}
+
+func newPlanReport(path string) (*planReport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create report %s: %s", path, err)
+	}
+	r := &planReport{path: path, f: f, w: bufio.NewWriter(f),
+		summary: planSummary{Objects: make(map[string]int64), Bytes: make(map[string]int64)}}
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		r.csv = csv.NewWriter(r.w)
+		_ = r.csv.Write([]string{"action", "key", "size", "mtime", "dst_size", "dst_mtime", "reason"})
+	} else {
+		_, _ = r.w.WriteString("{\"entries\":[")
+	}
+	return r, nil
+}
+
+// add records an action on obj, dstobj is the one in destination (or nil).
+func (r *planReport) add(action string, obj, dstobj object.Object, reason string) {
+	e := planEntry{Action: action, Key: obj.Key(), Size: obj.Size(), Mtime: obj.Mtime(), DstSize: -1, Reason: reason}
+	if dstobj != nil {
+		mtime := dstobj.Mtime()
+		e.DstSize, e.DstMtime = dstobj.Size(), &mtime
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.summary.Objects[action]++
+	if action != planDelete && action != planDeleteSrc {
+		r.summary.Bytes[action] += e.Size
+	}
+	if r.csv != nil {
+		var dstSize, dstMtime string
+		if dstobj != nil {
+			dstSize, dstMtime = strconv.FormatInt(e.DstSize, 10), e.DstMtime.Format(time.RFC3339)
+		}
+		_ = r.csv.Write([]string{action, e.Key, strconv.FormatInt(e.Size, 10), e.Mtime.Format(time.RFC3339), dstSize, dstMtime, reason})
+		return
+	}
+	d, _ := json.Marshal(e)
+	if r.entries > 0 {
+		_ = r.w.WriteByte(',')
+	}
+	_ = r.w.WriteByte('\n')
+	_, _ = r.w.Write(d)
+	r.entries++
+}
+
+func (r *planReport) close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.csv != nil {
+		r.csv.Flush()
+	} else {
+		d, _ := json.Marshal(r.summary)
+		_, _ = fmt.Fprintf(r.w, "\n],\"summary\":%s}\n", d)
+	}
+	err := r.w.Flush()
+	if e := r.f.Close(); err == nil {
+		err = e
+	}
+	var add, update, check, del int64
+	for a, n := range r.summary.Objects {
+		switch a {
+		case planAdd:
+			add = n
+		case planUpdate:
+			update = n
+		case planCheck:
+			check = n
+		default:
+			del += n
+		}
+	}
+	logger.Infof("Dry run report is written into %s: %d to add, %d to update, %d to check, %d to delete", r.path, add, update, check, del)
+	return err
+}
+
+// plan records the action into the report of dry run if enabled.
+func plan(config *Config, action string, obj, dstobj object.Object, reason string) {
+	if config.dryReport != nil {
+		config.dryReport.add(action, obj, dstobj, reason)
+	}
+}
+
+// updateReason explains why the object in destination should be overwritten.
+func updateReason(config *Config) string {
+	switch {
+	case config.ForceUpdate:
+		return "forced update"
+	case config.Update:
+		return "source is newer"
+	default:
+		return "size differs"
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
@@ -30,7 +31,6 @@ import (
 
 	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/utils"
-	"github.com/juju/ratelimit"
 )
 
 // The max number of key per listing request
@@ -52,7 +52,8 @@ var (
 	checkedBytes             *utils.Bar
 	deleted, skipped, failed *utils.Bar
 	concurrent               chan int
-	limiter                  *ratelimit.Bucket
+	limiter                  *bwLimiter
+	checksumAlgo             string // compare the checksums instead of bytes
 )
 
 var logger = utils.GetLogger("juicefs")
@@ -115,7 +116,7 @@ func ListAll(store object.ObjectStorage, prefix, start, end string) (<-chan obje
 
 	marker := start
 	logger.Debugf("Listing objects from %s marker %q", store, marker)
-	objs, err := store.List(prefix, marker, "", maxResults)
+	objs, hasMore, token, err := store.List(prefix, marker, "", "", maxResults)
 	if err != nil {
 		logger.Errorf("Can't list %s: %s", store, err.Error())
 		return nil, err
@@ -143,22 +144,24 @@ func ListAll(store object.ObjectStorage, prefix, start, end string) (<-chan obje
 			}
 			// Corner case: the func parameter `marker` is an empty string("") and exactly
 			// one object which key is an empty string("") returned by the List() method.
-			if lastkey == "" {
+			if lastkey == "" || !hasMore {
 				break END
 			}
 
 			marker = lastkey
 			startTime = time.Now()
 			logger.Debugf("Continue listing objects from %s marker %q", store, marker)
-			objs, err = store.List(prefix, marker, "", maxResults)
+			var nextToken string
+			objs, hasMore, nextToken, err = store.List(prefix, marker, token, "", maxResults)
 			count := 0
 			for err != nil && count < 3 {
 				logger.Warnf("Fail to list: %s, retry again", err.Error())
 				// slow down
 				time.Sleep(time.Millisecond * 100)
-				objs, err = store.List(prefix, marker, "", maxResults)
+				objs, hasMore, nextToken, err = store.List(prefix, marker, token, "", maxResults)
 				count++
 			}
+			token = nextToken
 			logger.Debugf("Found %d object from %s in %s", len(objs), store, time.Since(startTime))
 			if err != nil {
 				// Telling that the listing has failed
@@ -195,18 +198,20 @@ func try(n int, f func() error) (err error) {
 	return
 }
 
-func deleteObj(storage object.ObjectStorage, key string, dry bool) {
+func deleteObj(storage object.ObjectStorage, key string, dry bool) bool {
 	if dry {
 		logger.Infof("Will delete %s from %s", key, storage)
-		return
+		return true
 	}
 	start := time.Now()
 	if err := try(3, func() error { return storage.Delete(key) }); err == nil {
 		deleted.Increment()
 		logger.Debugf("Deleted %s from %s in %s", key, storage, time.Since(start))
+		return true
 	} else {
 		failed.Increment()
 		logger.Errorf("Failed to delete %s from %s in %s: %s", key, storage, time.Since(start), err)
+		return false
 	}
 }
 
@@ -229,6 +234,33 @@ func copyPerms(dst object.ObjectStorage, obj object.Object) {
 	logger.Debugf("Copied permissions (%s:%s:%s) for %s in %s", fi.Owner(), fi.Group(), fi.Mode(), key, time.Since(start))
 }
 
+var xattrNotSupported sync.Once
+
+// copyXattrs copies the extended attributes and POSIX ACLs of a file when both ends support them.
+func copyXattrs(src, dst object.ObjectStorage, obj object.Object) {
+	if obj.IsSymlink() {
+		return
+	}
+	s, ok := src.(object.SupportXattr)
+	d, ok2 := dst.(object.SupportXattr)
+	if !ok || !ok2 {
+		xattrNotSupported.Do(func() { logger.Warnf("Extended attributes are not supported between %s and %s", src, dst) })
+		return
+	}
+	key := obj.Key()
+	xattrs, err := s.GetXattrs(key)
+	if err == nil && len(xattrs) > 0 {
+		err = d.SetXattrs(key, xattrs)
+	}
+	if errors.Is(err, utils.ENOTSUP) {
+		xattrNotSupported.Do(func() { logger.Warnf("Extended attributes are not supported between %s and %s", src, dst) })
+	} else if err != nil {
+		logger.Warnf("Copy extended attributes of %s: %s", key, err)
+	} else {
+		logger.Debugf("Copied %d extended attributes for %s", len(xattrs), key)
+	}
+}
+
 func doCheckSum(src, dst object.ObjectStorage, key string, size int64, equal *bool) error {
 	abort := make(chan struct{})
 	checkPart := func(offset, length int64) error {
@@ -313,7 +345,12 @@ func doCheckSum(src, dst object.ObjectStorage, key string, size int64, equal *bo
 func checkSum(src, dst object.ObjectStorage, key string, size int64) (bool, error) {
 	start := time.Now()
 	var equal bool
-	err := try(3, func() error { return doCheckSum(src, dst, key, size, &equal) })
+	err := try(3, func() error {
+		if checksumAlgo != "" {
+			return compareDigest(src, dst, key, size, checksumAlgo, &equal)
+		}
+		return doCheckSum(src, dst, key, size, &equal)
+	})
 	if err == nil {
 		checkedBytes.IncrInt64(size)
 		if equal {
@@ -508,17 +545,21 @@ func copyData(src, dst object.ObjectStorage, key string, size int64) error {
 func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *Config) {
 	for obj := range tasks {
 		key := obj.Key()
+		ok := true
 		switch obj.Size() {
 		case markDeleteSrc:
-			deleteObj(src, key, config.Dry)
+			ok = deleteObj(src, key, config.Dry)
 		case markDeleteDst:
-			deleteObj(dst, key, config.Dry)
+			ok = deleteObj(dst, key, config.Dry)
 		case markCopyPerms:
 			if config.Dry {
 				logger.Infof("Will copy permissions for %s", key)
 				break
 			}
 			copyPerms(dst, obj)
+			if config.Xattrs {
+				copyXattrs(src, dst, obj)
+			}
 			copied.Increment()
 		case markChecksum:
 			if config.Dry {
@@ -526,12 +567,13 @@ func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *C
 				break
 			}
 			obj = obj.(*withSize).Object
-			if equal, err := checkSum(src, dst, key, obj.Size()); err != nil {
+			if equal, err := compareFile(src, dst, key, obj.Size()); err != nil {
 				failed.Increment()
+				ok = false
 				break
 			} else if equal {
 				if config.DeleteSrc {
-					deleteObj(src, key, false)
+					ok = deleteObj(src, key, false)
 				} else if config.Perms {
 					if o, e := dst.Head(key); e == nil {
 						if needCopyPerms(obj, o) {
@@ -543,6 +585,7 @@ func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *C
 					} else {
 						logger.Warnf("Failed to head object %s: %s", key, e)
 						failed.Increment()
+						ok = false
 					}
 				} else {
 					skipped.Increment()
@@ -556,41 +599,57 @@ func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *C
 				logger.Infof("Will copy %s (%d bytes)", obj.Key(), obj.Size())
 				break
 			}
-			var err error
-			if config.Links && obj.IsSymlink() {
-				if err = copyLink(src, dst, key); err == nil {
-					copied.Increment()
-					handled.Increment()
-					break
-				}
-				logger.Errorf("copy link failed: %s", err)
-			} else {
-				err = copyData(src, dst, key, obj.Size())
-			}
-
-			if err == nil && (config.CheckAll || config.CheckNew) {
-				var equal bool
-				if equal, err = checkSum(src, dst, key, obj.Size()); err == nil && !equal {
-					err = fmt.Errorf("checksums of copied object %s don't match", key)
-				}
-			}
-			if err == nil {
-				if mc, ok := dst.(object.MtimeChanger); ok {
-					if err = mc.Chtimes(obj.Key(), obj.Mtime()); err != nil && !errors.Is(err, utils.ENOTSUP) {
-						logger.Warnf("Update mtime of %s: %s", key, err)
-					}
-				}
-				if config.Perms {
-					copyPerms(dst, obj)
-				}
-				copied.Increment()
-			} else {
-				failed.Increment()
-				logger.Errorf("Failed to copy object %s: %s", key, err)
-			}
+			ok = copyObject(src, dst, obj, config)
 		}
 		handled.Increment()
+		if config.tracker != nil {
+			config.tracker.finish(key, ok)
+		}
+		if config.batches != nil {
+			config.batches.finish(key, ok)
+		}
+	}
+}
+
+// copyObject copies the data (or symlink) and attributes of an object, and verifies it if required.
+func copyObject(src, dst object.ObjectStorage, obj object.Object, config *Config) bool {
+	key := obj.Key()
+	var err error
+	if config.Links && obj.IsSymlink() {
+		if err = copyLink(src, dst, key); err == nil {
+			copied.Increment()
+			handled.Increment()
+			return true
+		}
+		logger.Errorf("copy link failed: %s", err)
+	} else {
+		err = copyFile(src, dst, obj, config)
+	}
+
+	if err == nil && (config.CheckAll || config.CheckNew) {
+		var equal bool
+		if equal, err = checkSum(src, dst, key, obj.Size()); err == nil && !equal {
+			err = fmt.Errorf("checksums of copied object %s don't match", key)
+		}
 	}
+	if err != nil {
+		failed.Increment()
+		logger.Errorf("Failed to copy object %s: %s", key, err)
+		return false
+	}
+	if mc, ok := dst.(object.MtimeChanger); ok {
+		if err = mc.Chtimes(obj.Key(), obj.Mtime()); err != nil && !errors.Is(err, utils.ENOTSUP) {
+			logger.Warnf("Update mtime of %s: %s", key, err)
+		}
+	}
+	if config.Perms {
+		copyPerms(dst, obj)
+	}
+	if config.Xattrs {
+		copyXattrs(src, dst, obj)
+	}
+	copied.Increment()
+	return true
 }
 
 func copyLink(src object.ObjectStorage, dst object.ObjectStorage, key string) error {
@@ -624,27 +683,62 @@ func (o *withFSize) Size() int64 {
 	return o.nsize
 }
 
+// matchAttrs checks the size and modification time of a file against the filters.
+func matchAttrs(config *Config, o object.Object) bool {
+	if o.IsDir() {
+		return true
+	}
+	if o.Size() < config.MinSize || config.MaxSize > 0 && o.Size() > config.MaxSize {
+		return false
+	}
+	if !config.ModifiedAfter.IsZero() && o.Mtime().Before(config.ModifiedAfter) ||
+		!config.ModifiedBefore.IsZero() && o.Mtime().After(config.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
 func deleteFromDst(tasks chan<- object.Object, dstobj object.Object, config *Config) bool {
 	if !config.Dirs && dstobj.IsDir() {
 		logger.Debug("Ignore deleting dst directory ", dstobj.Key())
 		return false
 	}
+	if !matchAttrs(config, dstobj) {
+		logger.Debug("Ignore deleting dst object ", dstobj.Key())
+		return false
+	}
 	if config.Limit >= 0 {
 		if config.Limit == 0 {
 			return true
 		}
 		config.Limit--
 	}
-	tasks <- &withSize{dstobj, markDeleteDst}
+	plan(config, planDelete, dstobj, dstobj, "missing in source")
+	dispatch(tasks, &withSize{dstobj, markDeleteDst}, config)
 	handled.IncrTotal(1)
 	return false
 }
 
+func dispatch(tasks chan<- object.Object, obj object.Object, config *Config) {
+	if config.tracker != nil {
+		config.tracker.dispatch(obj.Key())
+	}
+	tasks <- obj
+}
+
+// listSource lists the source from the inventory if provided.
+func listSource(src object.ObjectStorage, prefix, start, end string, config *Config) (<-chan object.Object, error) {
+	if config.Inventory != nil {
+		return listInventory(config.Inventory, prefix, start, end)
+	}
+	return ListAll(src, prefix, start, end)
+}
+
 func startSingleProducer(tasks chan<- object.Object, src, dst object.ObjectStorage, prefix string, config *Config) error {
 	start, end := config.Start, config.End
 	logger.Debugf("maxResults: %d, defaultPartSize: %d, maxBlock: %d", maxResults, defaultPartSize, maxBlock)
 
-	srckeys, err := ListAll(src, prefix, start, end)
+	srckeys, err := listSource(src, prefix, start, end, config)
 	if err != nil {
 		return fmt.Errorf("list %s: %s", src, err)
 	}
@@ -667,19 +761,25 @@ func produce(tasks chan<- object.Object, src, dst object.ObjectStorage, srckeys,
 	for obj := range srckeys {
 		if obj == nil {
 			logger.Errorf("Listing failed, stop syncing, waiting for pending ones")
+			if config.tracker != nil {
+				config.tracker.setInterrupted()
+			}
 			return
 		}
 		if !config.Dirs && obj.IsDir() {
 			logger.Debug("Ignore directory ", obj.Key())
 			continue
 		}
-		if config.Limit >= 0 {
-			if config.Limit == 0 {
-				return
+		selected := matchAttrs(config, obj)
+		if selected {
+			if config.Limit >= 0 {
+				if config.Limit == 0 {
+					return
+				}
+				config.Limit--
 			}
-			config.Limit--
+			handled.IncrTotal(1)
 		}
-		handled.IncrTotal(1)
 
 		if dstobj != nil && obj.Key() > dstobj.Key() {
 			if config.DeleteDst {
@@ -693,6 +793,9 @@ func produce(tasks chan<- object.Object, src, dst object.ObjectStorage, srckeys,
 			for dstobj = range dstkeys {
 				if dstobj == nil {
 					logger.Errorf("Listing failed, stop syncing, waiting for pending ones")
+					if config.tracker != nil {
+						config.tracker.setInterrupted()
+					}
 					return
 				}
 				if obj.Key() <= dstobj.Key() {
@@ -707,6 +810,17 @@ func produce(tasks chan<- object.Object, src, dst object.ObjectStorage, srckeys,
 			}
 		}
 
+		if config.tracker != nil {
+			config.tracker.reach(obj.Key()) // all the keys before it are dispatched
+		}
+		if !selected {
+			logger.Debugf("Ignore %s (size %d, mtime %s)", obj.Key(), obj.Size(), obj.Mtime())
+			if dstobj != nil && obj.Key() == dstobj.Key() {
+				dstobj = nil // keep it in destination
+			}
+			continue
+		}
+
 		// FIXME: there is a race when source is modified during coping
 		if dstobj == nil || obj.Key() < dstobj.Key() {
 			if config.Existing {
@@ -714,7 +828,8 @@ func produce(tasks chan<- object.Object, src, dst object.ObjectStorage, srckeys,
 				handled.Increment()
 				continue
 			}
-			tasks <- obj
+			plan(config, planAdd, obj, nil, "missing in destination")
+			dispatch(tasks, obj, config)
 		} else { // obj.key == dstobj.key
 			if config.IgnoreExisting {
 				skipped.Increment()
@@ -725,16 +840,23 @@ func produce(tasks chan<- object.Object, src, dst object.ObjectStorage, srckeys,
 			if config.ForceUpdate ||
 				(config.Update && obj.Mtime().Unix() > dstobj.Mtime().Unix()) ||
 				(!config.Update && obj.Size() != dstobj.Size()) {
-				tasks <- obj
+				plan(config, planUpdate, obj, dstobj, updateReason(config))
+				dispatch(tasks, obj, config)
 			} else if config.Update && obj.Mtime().Unix() < dstobj.Mtime().Unix() {
 				skipped.Increment()
 				handled.Increment()
 			} else if config.CheckAll { // two objects are likely the same
-				tasks <- &withSize{obj, markChecksum}
+				plan(config, planCheck, obj, dstobj, "same size, compare checksums")
+				dispatch(tasks, &withSize{obj, markChecksum}, config)
+			} else if config.metaDiff && obj.Mtime().Unix() != dstobj.Mtime().Unix() {
+				plan(config, planCheck, obj, dstobj, "mtime differs, compare fingerprints")
+				dispatch(tasks, &withSize{obj, markChecksum}, config)
 			} else if config.DeleteSrc {
-				tasks <- &withSize{obj, markDeleteSrc}
+				plan(config, planDeleteSrc, obj, dstobj, "already in destination")
+				dispatch(tasks, &withSize{obj, markDeleteSrc}, config)
 			} else if config.Perms && needCopyPerms(obj, dstobj) {
-				tasks <- &withFSize{obj.(object.File), markCopyPerms}
+				plan(config, planUpdate, obj, dstobj, "permissions differ")
+				dispatch(tasks, &withFSize{obj.(object.File), markCopyPerms}, config)
 			} else {
 				skipped.Increment()
 				handled.Increment()
@@ -761,28 +883,46 @@ func produce(tasks chan<- object.Object, src, dst object.ObjectStorage, srckeys,
 type rule struct {
 	pattern string
 	include bool
+	re      *regexp.Regexp // for --include-regex and --exclude-regex
+}
+
+func parseRule(opt, pattern string) (rule, error) {
+	r := rule{pattern: pattern, include: strings.HasPrefix(opt, "-include")}
+	var err error
+	if strings.HasSuffix(opt, "-regex") {
+		r.re, err = regexp.Compile(pattern)
+	} else {
+		_, err = path.Match(pattern, "xxxx")
+	}
+	return r, err
 }
 
 func parseIncludeRules(args []string) (rules []rule) {
 	l := len(args)
+	isRuleOpt := func(a string) bool {
+		return a == "-include" || a == "-exclude" || a == "-include-regex" || a == "-exclude-regex"
+	}
 	for i, a := range args {
 		if strings.HasPrefix(a, "--") {
 			a = a[1:]
 		}
-		if l-1 > i && (a == "-include" || a == "-exclude") {
-			if _, err := path.Match(args[i+1], "xxxx"); err != nil {
+		if l-1 > i && isRuleOpt(a) {
+			r, err := parseRule(a, args[i+1])
+			if err != nil {
 				logger.Warnf("ignore invalid pattern: %s %s", a, args[i+1])
 				continue
 			}
-			rules = append(rules, rule{pattern: args[i+1], include: a == "-include"})
-		} else if strings.HasPrefix(a, "-include=") || strings.HasPrefix(a, "-exclude=") {
-			if s := strings.Split(a, "="); len(s) == 2 && s[1] != "" {
-				if _, err := path.Match(s[1], "xxxx"); err != nil {
-					logger.Warnf("ignore invalid pattern: %s", a)
-					continue
-				}
-				rules = append(rules, rule{pattern: s[1], include: strings.HasPrefix(a, "-include=")})
+			rules = append(rules, r)
+		} else if s := strings.SplitN(a, "=", 2); len(s) == 2 && isRuleOpt(s[0]) {
+			if s[1] == "" {
+				continue
 			}
+			r, err := parseRule(s[0], s[1])
+			if err != nil {
+				logger.Warnf("ignore invalid pattern: %s", a)
+				continue
+			}
+			rules = append(rules, r)
 		}
 	}
 	return
@@ -830,6 +970,19 @@ func matchKey(rules []rule, key string) bool {
 		}
 		prefix := strings.Join(parts[:i+1], "/")
 		for _, rule := range rules {
+			if rule.re != nil {
+				// regular expressions are matched against the whole key
+				if prefix != strings.TrimSuffix(key, "/") {
+					continue
+				}
+				if rule.re.MatchString(key) {
+					if rule.include {
+						break
+					}
+					return false
+				}
+				continue
+			}
 			var s string
 			if i < len(parts)-1 && strings.HasSuffix(rule.pattern, "/") {
 				s = "/"
@@ -853,9 +1006,9 @@ func matchKey(rules []rule, key string) bool {
 
 func listCommonPrefix(store object.ObjectStorage, prefix string, cp chan object.Object) (chan object.Object, error) {
 	var total []object.Object
-	var marker string
+	var marker, token string
 	for {
-		objs, err := store.List(prefix, marker, "/", maxResults)
+		objs, hasMore, nextToken, err := store.List(prefix, marker, token, "/", maxResults)
 		if err != nil {
 			return nil, err
 		}
@@ -863,8 +1016,8 @@ func listCommonPrefix(store object.ObjectStorage, prefix string, cp chan object.
 			break
 		}
 		total = append(total, objs...)
-		marker = objs[len(objs)-1].Key()
-		if marker == "" {
+		marker, token = objs[len(objs)-1].Key(), nextToken
+		if marker == "" || !hasMore {
 			break
 		}
 	}
@@ -885,7 +1038,7 @@ func listCommonPrefix(store object.ObjectStorage, prefix string, cp chan object.
 }
 
 func startProducer(tasks chan<- object.Object, src, dst object.ObjectStorage, prefix string, config *Config) error {
-	if config.ListThreads <= 1 || strings.Count(prefix, "/") >= config.ListDepth {
+	if config.ListThreads <= 1 || strings.Count(prefix, "/") >= config.ListDepth || config.Inventory != nil {
 		return startSingleProducer(tasks, src, dst, prefix, config)
 	}
 
@@ -982,6 +1135,7 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 		}
 	}
 
+	config.metaDiff = strings.HasPrefix(src.String(), "jfs://") && strings.HasPrefix(dst.String(), "jfs://")
 	var bufferSize = 10240
 	if config.Manager != "" {
 		bufferSize = 100
@@ -989,12 +1143,15 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 	tasks := make(chan object.Object, bufferSize)
 	wg := sync.WaitGroup{}
 	concurrent = make(chan int, config.Threads)
-	if config.BWLimit > 0 {
-		bps := float64(config.BWLimit*(1<<20)/8) * 0.85 // 15% overhead
-		limiter = ratelimit.NewBucketWithRate(bps, int64(bps)*3)
+	checksumAlgo = config.ChecksumAlgo
+	if config.BWLimit > 0 || len(config.BWWindows) > 0 {
+		limiter = newBWLimiter(config.BWLimit, config.BWWindows)
+		if len(config.BWWindows) > 0 {
+			go limiter.run()
+		}
 	}
 
-	progress := utils.NewProgress(config.Verbose || config.Quiet || config.Manager != "")
+	progress := utils.NewProgress(config.Verbose || config.Quiet || config.Manager != "" || config.Events != "")
 	handled = progress.AddCountBar("Scanned objects", 0)
 	pending = progress.AddCountSpinner("Pending objects")
 	copied = progress.AddCountSpinner("Copied objects")
@@ -1010,15 +1167,32 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 		}
 	}()
 
-	for i := 0; i < config.Threads; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			worker(tasks, src, dst, config)
-		}()
+	var stopCheckpoint chan struct{}
+	var retryKeys []string
+	if config.Checkpoint != "" && config.Manager == "" && config.Events == "" {
+		if config.Dry {
+			logger.Warnf("Checkpoint is not supported with --dry, ignore it")
+		} else {
+			config.tracker = newTracker(config.Checkpoint, src, dst)
+			next, failedKeys, err := config.tracker.load()
+			if err != nil {
+				return err
+			}
+			if next > config.Start {
+				logger.Infof("Resume from checkpoint %s, first key: %q", config.Checkpoint, next)
+				config.Start = next
+			}
+			retryKeys = failedKeys
+			if config.ListThreads > 1 {
+				logger.Warnf("Checkpoint requires listing in order, ignore --list-threads")
+				config.ListThreads = 1
+			}
+			stopCheckpoint = make(chan struct{})
+			go config.tracker.run(time.Second*10, stopCheckpoint)
+		}
 	}
 
-	if len(config.Exclude) > 0 {
+	if len(config.Exclude) > 0 || len(config.ExcludeRegex) > 0 {
 		rules := parseIncludeRules(os.Args)
 		if runtime.GOOS == "windows" && (strings.HasPrefix(src.String(), "file:") || strings.HasPrefix(dst.String(), "file:")) {
 			for _, r := range rules {
@@ -1028,13 +1202,29 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 		config.rules = rules
 	}
 
+	if config.Events != "" {
+		return watch(src, dst, config)
+	}
+
+	for i := 0; i < config.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(tasks, src, dst, config)
+		}()
+	}
+
+	var jobs *dispatcher
 	if config.Manager == "" {
-		if len(config.Workers) > 0 {
-			addr, err := startManager(tasks)
-			if err != nil {
+		if len(config.Workers) > 0 || config.ManagerAddr != "" {
+			var addr string
+			var err error
+			if jobs, addr, err = startManager(config, tasks); err != nil {
 				return err
 			}
-			launchWorker(addr, config, &wg)
+			if len(config.Workers) > 0 {
+				launchWorker(addr, config, &wg)
+			}
 		}
 		logger.Infof("Syncing from %s to %s", src, dst)
 		if config.Start != "" {
@@ -1043,6 +1233,16 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 		if config.End != "" {
 			logger.Infof("last key: %q", config.End)
 		}
+		if config.Dry && config.DryReport != "" {
+			var err error
+			if config.dryReport, err = newPlanReport(config.DryReport); err != nil {
+				return err
+			}
+		}
+		if len(retryKeys) > 0 {
+			logger.Infof("Retry %d failed keys in checkpoint %s", len(retryKeys), config.Checkpoint)
+			retryFailed(src, dst, retryKeys, config)
+		}
 		config.concurrentList = make(chan int, config.ListThreads)
 		err := startProducer(tasks, src, dst, "", config)
 		if err != nil {
@@ -1050,28 +1250,54 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 		}
 		close(tasks)
 	} else {
+		config.batches = newBatchTracker()
 		go fetchJobs(tasks, config)
 		go func() {
 			for {
-				sendStats(config.Manager)
+				sendStats(config.Manager, config.batches)
 				time.Sleep(time.Second)
 			}
 		}()
 	}
 
 	wg.Wait()
+	if jobs != nil {
+		jobs.drain(src, dst, config)
+	}
 	pending.SetCurrent(0)
 	progress.Done()
+	if config.dryReport != nil {
+		if err := config.dryReport.close(); err != nil {
+			return fmt.Errorf("write report %s: %s", config.DryReport, err)
+		}
+	}
+	if config.tracker != nil {
+		close(stopCheckpoint)
+		if failed.Current() == 0 && config.tracker.completed() {
+			_ = os.Remove(config.Checkpoint)
+		} else if err := config.tracker.save(); err != nil {
+			logger.Errorf("Save checkpoint %s: %s", config.Checkpoint, err)
+		} else {
+			logger.Infof("Saved checkpoint to %s, run the same command again to resume", config.Checkpoint)
+		}
+	}
 
 	if config.Manager == "" {
 		logger.Infof("Found: %d, copied: %d (%s), checked: %s, deleted: %d, skipped: %d, failed: %d",
 			handled.Current(), copied.Current(), formatSize(copiedBytes.Current()), formatSize(checkedBytes.Current()),
 			deleted.Current(), skipped.Current(), failed.Current())
 	} else {
-		sendStats(config.Manager)
+		sendStats(config.Manager, config.batches)
 	}
 	if n := failed.Current(); n > 0 {
 		return fmt.Errorf("Failed to handle %d objects", n)
 	}
+	if config.Verify && config.Manager == "" {
+		if config.Dry || config.DeleteSrc {
+			logger.Warnf("Verification is skipped with --dry or --delete-src")
+		} else {
+			return verify(src, dst, config)
+		}
+	}
 	return nil
 }
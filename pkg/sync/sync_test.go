@@ -17,15 +17,26 @@ package sync
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
+	"math/big"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
 )
 
 func collectAll(c <-chan object.Object) []string {
@@ -572,3 +583,583 @@ func TestMatchObjects(t *testing.T) {
 		}
 	}
 }
+
+func TestRegexRules(t *testing.T) {
+	rules := parseIncludeRules([]string{"--include-regex", `\.go$`, "--exclude-regex=^vendor/", "--exclude-regex", "(", "--exclude", "*.txt"})
+	if len(rules) != 3 || rules[0].re == nil || !rules[0].include || rules[1].re == nil || rules[1].include || rules[2].re != nil {
+		t.Fatalf("parse rules: %+v", rules)
+	}
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"main.go", true},
+		{"vendor/a.go", true},
+		{"vendor/a.c", false},
+		{"vendor/", true}, // directories are matched by the whole key, which has the trailing slash
+		{"a/b.txt", false},
+		{"a/b.go.txt", false},
+		{"a/b.c", true},
+	}
+	for _, c := range tests {
+		if got := matchKey(rules, c.key); got != c.want {
+			t.Errorf("matchKey(%s) = %v, want %v", c.key, got, c.want)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.Local)
+	tests := map[string]time.Time{
+		"":                    {},
+		"90d":                 now.Add(-90 * 24 * time.Hour),
+		"12h":                 now.Add(-12 * time.Hour),
+		"2023-01-02":          time.Date(2023, 1, 2, 0, 0, 0, 0, time.Local),
+		"2023-01-02 08:00:00": time.Date(2023, 1, 2, 8, 0, 0, 0, time.Local),
+	}
+	for s, want := range tests {
+		if got, err := parseTime(s, now); err != nil || !got.Equal(want) {
+			t.Errorf("parseTime(%q) = %s %v, want %s", s, got, err, want)
+		}
+	}
+	if _, err := parseTime("yesterday", now); err == nil {
+		t.Errorf("parseTime(yesterday) should fail")
+	}
+}
+
+// nolint:errcheck
+func TestSyncFilters(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll("/tmp/a/")
+		_ = os.RemoveAll("/tmp/b/")
+	}()
+	a, _ := object.CreateStorage("file", "/tmp/a/", "", "", "")
+	b, _ := object.CreateStorage("file", "/tmp/b/", "", "", "")
+	old := time.Now().Add(-time.Hour * 24 * 100)
+	a.Put("small-old", bytes.NewReader([]byte("a")))
+	a.(object.MtimeChanger).Chtimes("small-old", old)
+	a.Put("large-old", bytes.NewReader(make([]byte, 1000)))
+	a.(object.MtimeChanger).Chtimes("large-old", old)
+	a.Put("large-new", bytes.NewReader(make([]byte, 1000)))
+	b.Put("small-new", bytes.NewReader([]byte("b")))
+	b.Put("large-old", bytes.NewReader(make([]byte, 10)))
+	b.(object.MtimeChanger).Chtimes("large-old", old)
+
+	config := &Config{
+		Threads:        10,
+		Limit:          -1,
+		Quiet:          true,
+		DeleteDst:      true,
+		MinSize:        100,
+		ModifiedBefore: time.Now().Add(-time.Hour * 24 * 90),
+	}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	all, _ := b.ListAll("", "")
+	// small-new is out of the filters, so it's not deleted
+	if err := testKeysEqual(all, []string{"", "large-old", "small-new"}); err != nil {
+		t.Fatal(err)
+	}
+	if o, err := b.Head("large-old"); err != nil || o.Size() != 1000 {
+		t.Fatalf("large-old should be copied: %v %v", o, err)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tr := &tracker{done: make(map[string]struct{})}
+	tr.reach("a")
+	if n, _ := tr.next(); n != "a" {
+		t.Fatalf("next should be a, but got %q", n)
+	}
+	tr.dispatch("b")
+	tr.dispatch("c")
+	tr.dispatch("d")
+	tr.finish("c", true)
+	if n, _ := tr.next(); n != "b" {
+		t.Fatalf("next should be b, but got %q", n)
+	}
+	tr.finish("b", false)
+	tr.finish("d", true)
+	if n, failed := tr.next(); n != "d" || len(failed) != 1 || failed[0] != "b" {
+		t.Fatalf("failed key b should be saved and the progress should move past it, but got %q %v", n, failed)
+	}
+	if len(tr.pending) != 0 || len(tr.done) != 0 {
+		t.Fatalf("finished keys should be removed: %v %v", tr.pending, tr.done)
+	}
+	if tr.completed() {
+		t.Fatalf("sync with failed keys should not be completed")
+	}
+
+	// too many failed keys
+	tr = &tracker{done: make(map[string]struct{})}
+	for i := 0; i < maxCheckpointFailed+2; i++ {
+		key := fmt.Sprintf("k%06d", i)
+		tr.dispatch(key)
+		tr.finish(key, false)
+	}
+	stuck := fmt.Sprintf("k%06d", maxCheckpointFailed)
+	tr.dispatch("z")
+	if n, failed := tr.next(); n != stuck || len(failed) != maxCheckpointFailed || len(tr.pending) != 0 {
+		t.Fatalf("progress should stop at %s, but got %q (%d failed, %d pending)", stuck, n, len(failed), len(tr.pending))
+	}
+}
+
+// nolint:errcheck
+func TestSyncCheckpoint(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll("/tmp/a/")
+		_ = os.RemoveAll("/tmp/b/")
+	}()
+	a, _ := object.CreateStorage("file", "/tmp/a/", "", "", "")
+	b, _ := object.CreateStorage("file", "/tmp/b/", "", "", "")
+	for _, k := range []string{"k1", "k2", "k3", "k4"} {
+		a.Put(k, bytes.NewReader([]byte(k)))
+	}
+	cpath := "/tmp/sync-checkpoint.json"
+	defer os.Remove(cpath)
+	tr := newTracker(cpath, a, b)
+	tr.dispatch("k1")
+	tr.finish("k1", false)
+	tr.reach("k3")
+	if err := tr.save(); err != nil {
+		t.Fatalf("save checkpoint: %s", err)
+	}
+
+	config := &Config{Threads: 10, Limit: -1, Quiet: true, Checkpoint: cpath}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	all, _ := b.ListAll("", "")
+	// k1 failed before, it's retried
+	if err := testKeysEqual(all, []string{"", "k1", "k3", "k4"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cpath); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint should be removed after finished: %v", err)
+	}
+
+	other, _ := object.CreateStorage("file", "/tmp/b/other/", "", "", "")
+	if err := newTracker(cpath, a, other).save(); err != nil {
+		t.Fatalf("save checkpoint: %s", err)
+	}
+	if _, _, err := tr.load(); err == nil {
+		t.Fatalf("checkpoint of other destination should not be used")
+	}
+}
+
+func TestParseBWLimit(t *testing.T) {
+	if limit, windows, err := parseBWLimit("100"); err != nil || limit != 100 || len(windows) != 0 {
+		t.Fatalf("parse 100: %d %v %v", limit, windows, err)
+	}
+	limit, windows, err := parseBWLimit("08:00-20:00=100M, 20:00-08:00=0, 1G")
+	if err != nil || limit != 1000 || len(windows) != 2 {
+		t.Fatalf("parse windows: %d %v %v", limit, windows, err)
+	}
+	l := &bwLimiter{limit: limit, windows: windows, current: -1}
+	day := time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local)
+	for clock, expected := range map[time.Duration]int{
+		8 * time.Hour:                100,
+		20*time.Hour - time.Second:   100,
+		20 * time.Hour:               0,
+		3 * time.Hour:                0,
+		7*time.Hour + 59*time.Minute: 0,
+	} {
+		if got := l.limitAt(day.Add(clock)); got != expected {
+			t.Fatalf("limit at %s should be %d, but got %d", clock, expected, got)
+		}
+	}
+	l.windows = windows[:1]
+	if got := l.limitAt(day.Add(time.Hour)); got != 1000 {
+		t.Fatalf("limit outside of windows should be 1000, but got %d", got)
+	}
+	l.update(day.Add(time.Hour * 10))
+	if l.current != 100 || l.bucket == nil {
+		t.Fatalf("limiter should be updated to 100 Mbps: %d", l.current)
+	}
+
+	for _, s := range []string{"abc", "08:00=100", "8-20=100", "08:00-20:00=-1"} {
+		if _, _, err := parseBWLimit(s); err == nil {
+			t.Fatalf("%q should be invalid", s)
+		}
+	}
+}
+
+// nolint:errcheck
+func TestVerify(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll("/tmp/a/")
+		_ = os.RemoveAll("/tmp/b/")
+	}()
+	a, _ := object.CreateStorage("file", "/tmp/a/", "", "", "")
+	b, _ := object.CreateStorage("file", "/tmp/b/", "", "", "")
+	a.Put("k1", bytes.NewReader([]byte("hello")))
+	a.Put("k2", bytes.NewReader([]byte("world")))
+
+	for _, algo := range checksumAlgos {
+		h, _ := newHash(algo)
+		_, _ = h.Write([]byte("hello"))
+		if d, err := digest(a, "k1", 5, algo); err != nil || d != fmt.Sprintf("%x", h.Sum(nil)) {
+			t.Fatalf("%s of k1: %s %v", algo, d, err)
+		}
+	}
+	if _, err := newHash("sha1"); err == nil {
+		t.Fatalf("sha1 should not be supported")
+	}
+
+	report := "/tmp/verify-report.csv"
+	defer os.Remove(report)
+	config := &Config{Threads: 10, Limit: -1, Quiet: true, CheckAll: true, ChecksumAlgo: "xxh64", Verify: true, VerifyReport: report}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	d, _ := os.ReadFile(report)
+	if lines := strings.Split(strings.TrimSpace(string(d)), "\n"); len(lines) != 3 || !strings.HasSuffix(lines[1], ",ok") {
+		t.Fatalf("report: %s", d)
+	}
+
+	b.Put("k2", bytes.NewReader([]byte("WORLD")))
+	b.Delete("k1")
+	config = &Config{Threads: 10, Limit: -1, Quiet: true, ChecksumAlgo: "crc32c", VerifyReport: report}
+	if err := verify(a, b, config); err == nil {
+		t.Fatalf("verification should fail")
+	}
+	d, _ = os.ReadFile(report)
+	if !strings.Contains(string(d), "k1,5,crc32c,,,missing") || !strings.Contains(string(d), ",mismatch") {
+		t.Fatalf("report: %s", d)
+	}
+}
+
+// nolint:errcheck
+func TestSyncXattrs(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll("/tmp/a/")
+		_ = os.RemoveAll("/tmp/b/")
+	}()
+	a, _ := object.CreateStorage("file", "/tmp/a/", "", "", "")
+	b, _ := object.CreateStorage("file", "/tmp/b/", "", "", "")
+	a.Put("k1", bytes.NewReader([]byte("hello")))
+	xa, ok := a.(object.SupportXattr)
+	if !ok {
+		t.Skip("xattrs are not supported")
+	}
+	if err := xa.SetXattrs("k1", map[string][]byte{"user.k": []byte("v")}); err != nil {
+		t.Skipf("xattrs are not supported: %s", err)
+	}
+
+	config := &Config{Threads: 10, Limit: -1, Quiet: true, Xattrs: true}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	xattrs, err := b.(object.SupportXattr).GetXattrs("k1")
+	if err != nil || string(xattrs["user.k"]) != "v" {
+		t.Fatalf("xattrs of k1: %v %s", xattrs, err)
+	}
+}
+
+// nolint:errcheck
+func TestSyncInventory(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll("/tmp/a/")
+		_ = os.RemoveAll("/tmp/b/")
+		_ = os.RemoveAll("/tmp/inventory/")
+	}()
+	a, _ := object.CreateStorage("file", "/tmp/a/", "", "", "")
+	b, _ := object.CreateStorage("file", "/tmp/b/", "", "", "")
+	inv, _ := object.CreateStorage("file", "/tmp/inventory/", "", "", "")
+	for _, k := range []string{"k1", "k2", "k3", "k 4"} {
+		a.Put(k, bytes.NewReader([]byte(k)))
+	}
+	putData := func(key string, rows ...string) {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(strings.Join(rows, "\n") + "\n"))
+		w.Close()
+		inv.Put(key, &buf)
+	}
+	putData("data/1.csv.gz", `"mybucket","src/k+4","3","2023-06-01T00:00:00.000Z","STANDARD"`,
+		`"mybucket","src/k1","2","2023-06-01T00:00:00.000Z","STANDARD"`,
+		`"mybucket","src/k1","2","2023-05-01T00:00:00.000Z","STANDARD","false"`)
+	putData("data/2.csv.gz", `"mybucket","src/k3","2","2023-06-01T00:00:00.000Z","STANDARD"`,
+		`"mybucket","zzz","1","2023-06-01T00:00:00.000Z","STANDARD"`)
+	manifest := `{"sourceBucket":"mybucket","fileFormat":"CSV","fileSchema":"Bucket, Key, Size, LastModifiedDate, StorageClass, IsLatest",
+		"files":[{"key":"data/1.csv.gz"},{"key":"data/2.csv.gz"}]}`
+	inv.Put("manifest.json", bytes.NewReader([]byte(manifest)))
+
+	config := &Config{Threads: 10, Limit: -1, Quiet: true, Inventory: &Inventory{inv, "manifest.json", "src/"}}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	all, _ := b.ListAll("", "")
+	// k2 is not in the inventory, and the old version of k1 is ignored
+	if err := testKeysEqual(all, []string{"", "k 4", "k1", "k3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	putData("data/2.csv.gz", `"mybucket","src/k0","2","2023-06-01T00:00:00.000Z","STANDARD"`)
+	keys, err := listInventory(config.Inventory, "", "", "")
+	if err != nil {
+		t.Fatalf("list inventory: %s", err)
+	}
+	var last object.Object = &invObject{}
+	for o := range keys {
+		last = o
+	}
+	if last != nil {
+		t.Fatalf("unsorted inventory should fail")
+	}
+}
+
+// resetBars sets up the counters for the tests which don't run Sync.
+func resetBars() {
+	progress := utils.NewProgress(true)
+	handled = progress.AddCountBar("Scanned objects", 0)
+	copied = progress.AddCountSpinner("Copied objects")
+	copiedBytes = progress.AddByteSpinner("Copied objects")
+	checkedBytes = progress.AddByteSpinner("Checked objects")
+	deleted = progress.AddCountSpinner("Deleted objects")
+	skipped = progress.AddCountSpinner("Skipped objects")
+	failed = progress.AddCountSpinner("Failed objects")
+}
+
+func TestSyncEvents(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll("/tmp/a/")
+		_ = os.RemoveAll("/tmp/b/")
+	}()
+	a, _ := object.CreateStorage("file", "/tmp/a/", "", "", "")
+	b, _ := object.CreateStorage("file", "/tmp/b/", "", "", "")
+	a.Put("k1", bytes.NewReader([]byte("k1")))
+	a.Put("k 2", bytes.NewReader([]byte("k2")))
+	b.Put("k3", bytes.NewReader([]byte("k3")))
+	b.Put("k4", bytes.NewReader([]byte("k4")))
+
+	resetBars()
+
+	s3Event := `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"src/k1"}}},
+		{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"src/k+2"}}},
+		{"eventName":"ObjectRemoved:Delete","s3":{"object":{"key":"src/k3"}}},
+		{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"other/k4"}}}]}`
+	keys, confirm, err := parseNotification([]byte(s3Event))
+	if err != nil || confirm != "" || !reflect.DeepEqual(keys, []string{"src/k1", "src/k 2", "src/k3", "other/k4"}) {
+		t.Fatalf("parse S3 event: %v %q %s", keys, confirm, err)
+	}
+
+	// messages of SNS signed by a fake certificate
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	defer func(f func(string) (*x509.Certificate, error)) { fetchSNSCert = f }(fetchSNSCert)
+	fetchSNSCert = func(u string) (*x509.Certificate, error) { return cert, nil }
+	certURL := "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-1.pem"
+	sign := func(m map[string]string, fields ...string) []byte {
+		m["SignatureVersion"], m["SigningCertURL"], m["MessageId"], m["Timestamp"], m["TopicArn"] = "2", certURL, "1", "2024-01-01T00:00:00.000Z", "arn"
+		var toSign string
+		for _, f := range fields {
+			toSign += f + "\n" + m[f] + "\n"
+		}
+		h := sha256.Sum256([]byte(toSign))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+		m["Signature"] = base64.StdEncoding.EncodeToString(sig)
+		msg, _ := json.Marshal(m)
+		return msg
+	}
+	notification := map[string]string{"Type": "Notification", "Message": `{"events":[{"oss":{"object":{"key":"src/k1"}}}]}`}
+	msg := sign(notification, "Message", "MessageId", "Timestamp", "TopicArn", "Type")
+	if keys, _, err = parseNotification(msg); err != nil || !reflect.DeepEqual(keys, []string{"src/k1"}) {
+		t.Fatalf("parse OSS event in SNS: %v %s", keys, err)
+	}
+	notification["Message"] = `{"events":[{"oss":{"object":{"key":"src/k2"}}}]}`
+	msg, _ = json.Marshal(notification)
+	if _, _, err = parseNotification(msg); err == nil {
+		t.Fatalf("tampered message of SNS should fail")
+	}
+	confirmFields := []string{"Message", "MessageId", "SubscribeURL", "Timestamp", "Token", "TopicArn", "Type"}
+	subscribe := map[string]string{"Type": "SubscriptionConfirmation", "Token": "t",
+		"SubscribeURL": "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&Token=t"}
+	if _, confirm, err = parseNotification(sign(subscribe, confirmFields...)); err != nil || confirm != subscribe["SubscribeURL"] {
+		t.Fatalf("subscribe url: %q %s", confirm, err)
+	}
+	subscribe["SubscribeURL"] = "http://169.254.169.254/latest/meta-data/"
+	if _, confirm, err = parseNotification(sign(subscribe, confirmFields...)); err == nil || confirm != "" {
+		t.Fatalf("SubscribeURL out of SNS should fail: %q", confirm)
+	}
+	subscribe["SubscribeURL"] = "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&Token=t"
+	_ = sign(subscribe, confirmFields...)
+	subscribe["SigningCertURL"] = "https://attacker.com/SimpleNotificationService-1.pem"
+	msg, _ = json.Marshal(subscribe)
+	if _, _, err = parseNotification(msg); err == nil {
+		t.Fatalf("SigningCertURL out of SNS should fail")
+	}
+	if _, _, err = parseNotification([]byte("bad")); err == nil {
+		t.Fatalf("parse invalid event should fail")
+	}
+
+	config := &Config{Threads: 1, Limit: -1, DeleteDst: true, EventPrefix: "src/"}
+	handle := newEventHandler(a, b, config)
+	if err = handle([]byte(s3Event)); err != nil {
+		t.Fatalf("handle: %s", err)
+	}
+	all, _ := b.ListAll("", "")
+	// k3 is removed from source, k4 is out of the prefix
+	if err = testKeysEqual(all, []string{"", "k 2", "k1", "k4"}); err != nil {
+		t.Fatal(err)
+	}
+	// unchanged key is skipped
+	if err = handle([]byte(s3Event)); err != nil || skipped.Current() != 2 {
+		t.Fatalf("handle again: %s, skipped %d", err, skipped.Current())
+	}
+}
+
+func TestSyncDryReport(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll("/tmp/a/")
+		_ = os.RemoveAll("/tmp/b/")
+		_ = os.Remove("/tmp/plan.json")
+		_ = os.Remove("/tmp/plan.csv")
+	}()
+	a, _ := object.CreateStorage("file", "/tmp/a/", "", "", "")
+	b, _ := object.CreateStorage("file", "/tmp/b/", "", "", "")
+	a.Put("k1", bytes.NewReader([]byte("k1")))
+	a.Put("k2", bytes.NewReader([]byte("k2-new")))
+	a.Put("k3", bytes.NewReader([]byte("k3")))
+	b.Put("k2", bytes.NewReader([]byte("k2")))
+	b.Put("k3", bytes.NewReader([]byte("k3")))
+	b.Put("k4", bytes.NewReader([]byte("k4")))
+
+	config := &Config{Threads: 10, Limit: -1, Quiet: true, Dry: true, DeleteDst: true, DryReport: "/tmp/plan.json"}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	all, _ := b.ListAll("", "")
+	if err := testKeysEqual(all, []string{"", "k2", "k3", "k4"}); err != nil {
+		t.Fatalf("dry run should not change destination: %s", err)
+	}
+	d, err := os.ReadFile("/tmp/plan.json")
+	if err != nil {
+		t.Fatalf("read report: %s", err)
+	}
+	var report struct {
+		Entries []planEntry
+		Summary planSummary
+	}
+	if err = json.Unmarshal(d, &report); err != nil {
+		t.Fatalf("decode report: %s\n%s", err, d)
+	}
+	var actions []string
+	for _, e := range report.Entries {
+		actions = append(actions, e.Action+" "+e.Key)
+	}
+	if !reflect.DeepEqual(actions, []string{"add k1", "update k2", "delete k4"}) {
+		t.Fatalf("actions: %v", actions)
+	}
+	if e := report.Entries[1]; e.Size != 6 || e.DstSize != 2 || e.Reason != "size differs" {
+		t.Fatalf("update entry: %+v", e)
+	}
+	if report.Summary.Objects[planAdd] != 1 || report.Summary.Bytes[planUpdate] != 6 || report.Summary.Objects[planDelete] != 1 {
+		t.Fatalf("summary: %+v", report.Summary)
+	}
+
+	config = &Config{Threads: 10, Limit: -1, Quiet: true, Dry: true, DryReport: "/tmp/plan.csv"}
+	if err = Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	d, _ = os.ReadFile("/tmp/plan.csv")
+	lines := strings.Split(strings.TrimSpace(string(d)), "\n")
+	if len(lines) != 3 || lines[0] != "action,key,size,mtime,dst_size,dst_mtime,reason" || !strings.HasPrefix(lines[1], "add,k1,2,") {
+		t.Fatalf("csv report: %s", d)
+	}
+}
+
+// fpStore uses the content of every 4 bytes as fingerprints.
+type fpStore struct {
+	object.ObjectStorage
+	saved  map[string][]string
+	writes []int64
+}
+
+func (s *fpStore) read(key string) []byte {
+	in, err := s.Get(key, 0, -1)
+	if err != nil {
+		return nil
+	}
+	defer in.Close()
+	d, _ := io.ReadAll(in)
+	return d
+}
+
+func (s *fpStore) Fingerprints(key string) (int64, []string, error) {
+	var fps []string
+	for d := s.read(key); len(d) > 0; d = d[4:] {
+		if len(d) < 4 {
+			d = append(d, make([]byte, 4-len(d))...)
+		}
+		fps = append(fps, string(d[:4]))
+	}
+	return 4, fps, nil
+}
+
+func (s *fpStore) SourceFingerprints(key string) ([]string, error) { return s.saved[key], nil }
+
+func (s *fpStore) SetSourceFingerprints(key string, fps []string) error {
+	s.saved[key] = fps
+	return nil
+}
+
+func (s *fpStore) WriteAt(key string, in io.Reader, off int64) error {
+	s.writes = append(s.writes, off)
+	d := s.read(key)
+	p, _ := io.ReadAll(in)
+	if int(off)+len(p) > len(d) {
+		d = append(d, make([]byte, int(off)+len(p)-len(d))...)
+	}
+	copy(d[off:], p)
+	return s.Put(key, bytes.NewReader(d))
+}
+
+func (s *fpStore) Truncate(key string, size int64) error {
+	d := s.read(key)
+	if int(size) > len(d) {
+		d = append(d, make([]byte, int(size)-len(d))...)
+	}
+	return s.Put(key, bytes.NewReader(d[:size]))
+}
+
+func TestCopyRanges(t *testing.T) {
+	resetBars()
+	concurrent = make(chan int, 10)
+	a, _ := object.CreateStorage("mem", "a", "", "", "")
+	b, _ := object.CreateStorage("mem", "b", "", "", "")
+	src := &fpStore{ObjectStorage: a, saved: make(map[string][]string)}
+	dst := &fpStore{ObjectStorage: b, saved: make(map[string][]string)}
+	config := &Config{}
+
+	_ = src.Put("f", bytes.NewReader([]byte("aaaabbbbcccc")))
+	obj, _ := src.Head("f")
+	if err := copyFile(src, dst, obj, config); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if len(dst.writes) != 0 || string(dst.read("f")) != "aaaabbbbcccc" || len(dst.saved["f"]) != 3 {
+		t.Fatalf("the first copy should copy the whole file: %v %q %v", dst.writes, dst.read("f"), dst.saved["f"])
+	}
+	if equal, err := compareFile(src, dst, "f", 12); err != nil || !equal {
+		t.Fatalf("compare: %t %s", equal, err)
+	}
+
+	_ = src.Put("f", bytes.NewReader([]byte("aaaaXXXXcc")))
+	obj, _ = src.Head("f")
+	if equal, _ := compareFile(src, dst, "f", obj.Size()); equal {
+		t.Fatalf("changed file should not be equal")
+	}
+	before := copiedBytes.Current()
+	if err := copyFile(src, dst, obj, config); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if !reflect.DeepEqual(dst.writes, []int64{4, 8}) || string(dst.read("f")) != "aaaaXXXXcc" {
+		t.Fatalf("only the changed ranges should be copied: %v %q", dst.writes, dst.read("f"))
+	}
+	if n := copiedBytes.Current() - before; n != 6 {
+		t.Fatalf("copied %d bytes, expect 6", n)
+	}
+}
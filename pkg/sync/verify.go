@@ -0,0 +1,245 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+var checksumAlgos = []string{"md5", "crc32c", "xxh64"}
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "md5":
+		return md5.New(), nil
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case "xxh64":
+		return xxhash.New(), nil
+	}
+	return nil, fmt.Errorf("unknown checksum algorithm %q, should be one of %v", algo, checksumAlgos)
+}
+
+// digest returns the checksum of an object in hex, the one calculated by object storage is used
+// if available, otherwise the object is read to calculate it.
+func digest(store object.ObjectStorage, key string, size int64, algo string) (string, error) {
+	if cs, ok := store.(object.SupportObjectChecksum); ok {
+		if v, err := cs.Checksum(key, algo); err != nil {
+			return "", err
+		} else if v != "" {
+			return v, nil
+		}
+	}
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	if limiter != nil {
+		limiter.Wait(size)
+	}
+	in, err := store.Get(key, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	n, err := io.CopyBuffer(h, in, *buf)
+	if err != nil {
+		return "", err
+	}
+	if n != size {
+		return "", fmt.Errorf("read %d bytes of %s, expect %d", n, key, size)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func compareDigest(src, dst object.ObjectStorage, key string, size int64, algo string, equal *bool) error {
+	s, err := digest(src, key, size, algo)
+	if err != nil {
+		return fmt.Errorf("src %s: %s", algo, err)
+	}
+	d, err := digest(dst, key, size, algo)
+	if err != nil {
+		return fmt.Errorf("dest %s: %s", algo, err)
+	}
+	*equal = s == d
+	return nil
+}
+
+const (
+	verifyOK       = "ok"
+	verifyMismatch = "mismatch"
+	verifyMissing  = "missing"
+	verifyError    = "error"
+)
+
+type verifyTask struct {
+	src, dst object.Object // dst is nil if it's missing
+}
+
+type verifier struct {
+	sync.Mutex
+	algo   string
+	report *csv.Writer
+	counts map[string]int64
+}
+
+func (v *verifier) record(key string, size int64, s, d, result string) {
+	v.Lock()
+	defer v.Unlock()
+	v.counts[result]++
+	if v.report != nil {
+		_ = v.report.Write([]string{key, strconv.FormatInt(size, 10), v.algo, s, d, result})
+	}
+	if result != verifyOK {
+		logger.Warnf("Verify %s: %s (%s: %q vs %q)", key, result, v.algo, s, d)
+	}
+}
+
+func (v *verifier) check(src, dst object.ObjectStorage, t verifyTask) {
+	key, size := t.src.Key(), t.src.Size()
+	if t.dst == nil {
+		v.record(key, size, "", "", verifyMissing)
+		return
+	}
+	if t.dst.Size() != size {
+		v.record(key, size, fmt.Sprintf("size=%d", size), fmt.Sprintf("size=%d", t.dst.Size()), verifyMismatch)
+		return
+	}
+	var s, d string
+	err := try(3, func() (err error) {
+		if s, err = digest(src, key, size, v.algo); err != nil {
+			return
+		}
+		d, err = digest(dst, key, size, v.algo)
+		return
+	})
+	if err != nil {
+		logger.Errorf("Failed to verify %s: %s", key, err)
+		v.record(key, size, s, d, verifyError)
+	} else if s != d {
+		v.record(key, size, s, d, verifyMismatch)
+	} else {
+		v.record(key, size, s, d, verifyOK)
+	}
+}
+
+// verify lists the source and destination again after synced, and compares the checksums of all
+// the selected files, the result of every file is written into the report (CSV) if specified.
+func verify(src, dst object.ObjectStorage, config *Config) error {
+	v := &verifier{algo: config.ChecksumAlgo, counts: make(map[string]int64)}
+	if v.algo == "" {
+		v.algo = "md5"
+	}
+	if config.VerifyReport != "" {
+		f, err := os.Create(config.VerifyReport)
+		if err != nil {
+			return fmt.Errorf("create verification report: %s", err)
+		}
+		defer f.Close()
+		v.report = csv.NewWriter(f)
+		defer v.report.Flush()
+		_ = v.report.Write([]string{"key", "size", "algorithm", "source", "destination", "result"})
+	}
+
+	start := time.Now()
+	logger.Infof("Verifying the %s checksums of %s and %s", v.algo, src, dst)
+	srckeys, err := listSource(src, "", config.Start, config.End, config)
+	if err != nil {
+		return fmt.Errorf("list %s: %s", src, err)
+	}
+	dstkeys, err := ListAll(dst, "", config.Start, config.End)
+	if err != nil {
+		return fmt.Errorf("list %s: %s", dst, err)
+	}
+	if len(config.rules) > 0 {
+		srckeys = filter(srckeys, config.rules)
+		dstkeys = filter(dstkeys, config.rules)
+	}
+
+	tasks := make(chan verifyTask, 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < config.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tasks {
+				v.check(src, dst, t)
+			}
+		}()
+	}
+
+	var listErr error
+	var dstobj object.Object
+	var dstDone bool
+	for obj := range srckeys {
+		if obj == nil {
+			listErr = fmt.Errorf("list %s failed", src)
+			break
+		}
+		if obj.IsDir() || config.Links && obj.IsSymlink() || !matchAttrs(config, obj) {
+			continue
+		}
+		for !dstDone && (dstobj == nil || dstobj.Key() < obj.Key()) {
+			var ok bool
+			if dstobj, ok = <-dstkeys; !ok {
+				dstDone = true
+			} else if dstobj == nil {
+				listErr = fmt.Errorf("list %s failed", dst)
+				dstDone = true
+			}
+		}
+		if listErr != nil {
+			break
+		}
+		t := verifyTask{src: obj}
+		if dstobj != nil && dstobj.Key() == obj.Key() {
+			t.dst = dstobj
+		}
+		tasks <- t
+	}
+	close(tasks)
+	wg.Wait()
+
+	var total int64
+	for _, n := range v.counts {
+		total += n
+	}
+	logger.Infof("Verified %d objects in %s: ok: %d, mismatched: %d, missing: %d, failed: %d", total, time.Since(start),
+		v.counts[verifyOK], v.counts[verifyMismatch], v.counts[verifyMissing], v.counts[verifyError])
+	if listErr != nil {
+		return listErr
+	}
+	if n := total - v.counts[verifyOK]; n > 0 {
+		return fmt.Errorf("verification failed for %d objects", n)
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
@@ -29,6 +30,10 @@ import (
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
+// fullBackupInterval is the interval of full backups when changelog is enabled,
+// only the changes are backed up in between.
+const fullBackupInterval = time.Hour * 24
+
 // Backup metadata periodically in the object storage
 func Backup(m meta.Meta, blob object.ObjectStorage, interval time.Duration) {
 	ctx := meta.Background
@@ -50,6 +55,25 @@ func Backup(m meta.Meta, blob object.ObjectStorage, interval time.Duration) {
 			continue
 		}
 		if now := time.Now(); now.Sub(last) >= interval {
+			if m.GetFormat().Changelog && !last.IsZero() && !needFullBackup(m, now) {
+				if st := m.SetXattr(ctx, 0, key, []byte(now.Format(time.RFC3339)), meta.XattrCreateOrReplace); st != 0 {
+					logger.Warnf("setxattr inode 1 key %s: %s", key, st)
+					continue
+				}
+				go cleanupBackups(blob, now)
+				logger.Debugf("backup changes of metadata since %s started", last)
+				if err = backupChanges(m, blob, last, now); err == nil {
+					logger.Infof("backup changes of metadata succeed, used %s", time.Since(now))
+					if err = m.TrimChanges(last); err != nil {
+						logger.Warnf("trim changelog before %s: %s", last, err)
+					}
+				} else {
+					logger.Warnf("backup changes of metadata failed: %s", err)
+					// backup the changes since the last time again in the next round
+					_ = m.SetXattr(ctx, 0, key, value, meta.XattrCreateOrReplace)
+				}
+				continue
+			}
 			if interval <= time.Hour {
 				var iused, dummy uint64
 				_ = m.StatFS(ctx, meta.RootInode, &dummy, &dummy, &iused, &dummy)
@@ -67,6 +91,14 @@ func Backup(m meta.Meta, blob object.ObjectStorage, interval time.Duration) {
 			logger.Debugf("backup metadata started")
 			if err = backup(m, blob, now); err == nil {
 				logger.Infof("backup metadata succeed, used %s", time.Since(now))
+				if m.GetFormat().Changelog {
+					_ = m.SetXattr(ctx, 0, "lastFullBackup", []byte(now.Format(time.RFC3339)), meta.XattrCreateOrReplace)
+					if !last.IsZero() {
+						if err = m.TrimChanges(last); err != nil {
+							logger.Warnf("trim changelog before %s: %s", last, err)
+						}
+					}
+				}
 			} else {
 				logger.Warnf("backup metadata failed: %s", err)
 			}
@@ -91,7 +123,47 @@ func backup(m meta.Meta, blob object.ObjectStorage, now time.Time) error {
 	if _, err = fp.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	return blob.Put("meta/"+name, fp)
+	// another client may backup at the same time
+	if err = object.PutIfNotExists(blob, "meta/"+name, fp); os.IsExist(err) {
+		logger.Infof("backup %s exists already, skip it", name)
+		err = nil
+	}
+	return err
+}
+
+func needFullBackup(m meta.Meta, now time.Time) bool {
+	var value []byte
+	if st := m.GetXattr(meta.Background, 0, "lastFullBackup", &value); st != 0 {
+		return true
+	}
+	last, err := time.Parse(time.RFC3339, string(value))
+	return err != nil || now.Sub(last) >= fullBackupInterval
+}
+
+// backupChanges saves the changes of metadata since the last backup, which should be loaded
+// together with the full backup before it.
+func backupChanges(m meta.Meta, blob object.ObjectStorage, since, now time.Time) error {
+	name := "inc-" + now.UTC().Format("2006-01-02-150405") + ".json.gz"
+	fp, err := os.CreateTemp("", "juicefs-meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	zw := gzip.NewWriter(fp)
+	err = m.DumpChanges(zw, since, now, false)
+	_ = zw.Close()
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = object.PutIfNotExists(blob, "meta/"+name, fp); os.IsExist(err) {
+		logger.Infof("backup %s exists already, skip it", name)
+		err = nil
+	}
+	return err
 }
 
 func cleanupBackups(blob object.ObjectStorage, now time.Time) {
@@ -101,18 +173,24 @@ func cleanupBackups(blob object.ObjectStorage, now time.Time) {
 		logger.Warnf("listAll prefix meta/: %s", err)
 		return
 	}
-	var objs []string
+	var objs, incs []string
 	for o := range ch {
 		if o == nil {
 			logger.Warnf("list failed, skip cleanup")
 			return
 		}
-		if !o.IsDir() {
+		if o.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(o.Key(), "inc-") {
+			incs = append(incs, o.Key())
+		} else {
 			objs = append(objs, o.Key())
 		}
 	}
 
 	toDel := rotate(objs, now)
+	toDel = append(toDel, rotateChanges(incs, now)...)
 	for _, o := range toDel {
 		if err = blob.Delete(o); err != nil {
 			logger.Warnf("delete object %s: %s", o, err)
@@ -171,3 +249,24 @@ func rotate(objs []string, now time.Time) []string {
 	}
 	return toDel
 }
+
+// The backups of changes are kept within 2 days, when all the full backups are kept.
+func rotateChanges(objs []string, now time.Time) []string {
+	edge := now.UTC().AddDate(0, 0, -2)
+	var toDel []string
+	for _, o := range objs {
+		if len(o) != 29 { // len("inc-2006-01-02-150405.json.gz")
+			logger.Warnf("bad object for metadata backup %s: length %d", o, len(o))
+			continue
+		}
+		ts, err := time.Parse("2006-01-02-150405", o[4:21])
+		if err != nil {
+			logger.Warnf("bad object for metadata backup %s: %s", o, err)
+			continue
+		}
+		if ts.Before(edge) {
+			toDel = append(toDel, o)
+		}
+	}
+	return toDel
+}
@@ -67,6 +67,21 @@ func TestRotate(t *testing.T) {
 	}
 }
 
+func TestRotateChanges(t *testing.T) {
+	now := time.Now()
+	var objs []string
+	for i := 0; i < 96; i++ { // one backup for every hour
+		objs = append(objs, "inc-"+now.Add(-time.Duration(i)*time.Hour).UTC().Format("2006-01-02-150405")+".json.gz")
+	}
+	toDel := rotateChanges(objs, now)
+	if len(toDel) != 47 {
+		t.Fatalf("expect 47 objects to delete, but got %d", len(toDel))
+	}
+	if toDel[0] != objs[49] {
+		t.Fatalf("first deleted %s != expect %s", toDel[0], objs[49])
+	}
+}
+
 func TestBackup(t *testing.T) {
 	v, blob := createTestVFS()
 	go Backup(v.Meta, blob, time.Millisecond*100)
@@ -0,0 +1,106 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+const (
+	cachePolicyXattr = "user.juicefs.cache"
+	cachePolicyTTL   = time.Minute
+	maxPolicyDepth   = 256
+	maxPolicyEntries = 100000
+)
+
+type policyEntry struct {
+	parent Ino
+	policy chunk.CachePolicy
+	set    bool
+	expire time.Time
+}
+
+// cachePolicies resolves the cache policy of files from the xattr "user.juicefs.cache" ("pin",
+// "exclude", "direct" or "normal") of themselves or their nearest ancestor, so the hot datasets
+// can be pinned in local cache and the scratch data could be kept out of it.
+type cachePolicies struct {
+	sync.Mutex
+	m       meta.Meta
+	enabled bool
+	entries map[Ino]policyEntry
+}
+
+func newCachePolicies(conf *Config, m meta.Meta) *cachePolicies {
+	return &cachePolicies{
+		m:       m,
+		enabled: conf.Chunk.CacheSize > 0,
+		entries: make(map[Ino]policyEntry),
+	}
+}
+
+// get returns the cache policy of a file, hard links (without parent) are always normal.
+func (c *cachePolicies) get(inode Ino) chunk.CachePolicy {
+	if !c.enabled {
+		return chunk.CacheNormal
+	}
+	for i := 0; i < maxPolicyDepth && inode > 0; i++ {
+		e := c.lookup(inode)
+		if e.set {
+			return e.policy
+		}
+		if inode == meta.RootInode {
+			break
+		}
+		inode = e.parent
+	}
+	return chunk.CacheNormal
+}
+
+func (c *cachePolicies) lookup(inode Ino) policyEntry {
+	now := time.Now()
+	c.Lock()
+	e, ok := c.entries[inode]
+	c.Unlock()
+	if ok && now.Before(e.expire) {
+		return e
+	}
+
+	e = policyEntry{expire: now.Add(cachePolicyTTL)}
+	var attr Attr
+	if st := c.m.GetAttr(meta.Background, inode, &attr); st == 0 {
+		e.parent = attr.Parent
+	}
+	var value []byte
+	if st := c.m.GetXattr(meta.Background, inode, cachePolicyXattr, &value); st == 0 {
+		if p, err := chunk.ParseCachePolicy(string(value)); err == nil {
+			e.policy, e.set = p, true
+		} else {
+			logger.Warnf("Ignore cache policy of inode %d: %s", inode, err)
+		}
+	}
+	c.Lock()
+	if len(c.entries) >= maxPolicyEntries { // forget all to bound the memory
+		c.entries = make(map[Ino]policyEntry)
+	}
+	c.entries[inode] = e
+	c.Unlock()
+	return e
+}
@@ -34,13 +34,14 @@ var (
 	})
 )
 
-func readSlice(store chunk.ChunkStore, s *meta.Slice, page *chunk.Page, off int) error {
+func readSlice(store chunk.ChunkStore, s *meta.Slice, page *chunk.Page, off int, key string) error {
 	buf := page.Data
 	read := 0
 	reader := store.NewReader(s.Id, int(s.Size))
 	for read < len(buf) {
 		p := page.Slice(read, len(buf)-read)
-		n, err := reader.ReadAt(context.Background(), p, off+int(s.Off))
+		ctx := chunk.WithDataKey(chunk.WithIOClass(context.Background(), chunk.ClassCompaction), key)
+		n, err := reader.ReadAt(ctx, p, off+int(s.Off))
 		p.Release()
 		if n == 0 && err != nil {
 			return err
@@ -52,6 +53,15 @@ func readSlice(store chunk.ChunkStore, s *meta.Slice, page *chunk.Page, off int)
 }
 
 func Compact(conf chunk.Config, store chunk.ChunkStore, slices []meta.Slice, id uint64) error {
+	return compact(conf, store, slices, id, "")
+}
+
+// CompactFile compacts the slices of a file, the new slice is encrypted by the data key bound to it.
+func CompactFile(conf chunk.Config, store chunk.ChunkStore, m meta.Meta, inode Ino, slices []meta.Slice, id uint64) error {
+	return compact(conf, store, slices, id, dataKeysOf(m).get(inode))
+}
+
+func compact(conf chunk.Config, store chunk.ChunkStore, slices []meta.Slice, id uint64, key string) error {
 	for utils.AllocMemory()-store.UsedMemory() > int64(conf.BufferSize)*3/2 {
 		time.Sleep(time.Millisecond * 100)
 	}
@@ -63,6 +73,8 @@ func Compact(conf chunk.Config, store chunk.ChunkStore, slices []meta.Slice, id
 	logger.Debugf("compact %d slices (%d bytes) to new slice %d", len(slices), size, id)
 
 	writer := store.NewWriter(id)
+	writer.SetIOClass(chunk.ClassCompaction)
+	writer.SetDataKey(key)
 
 	var pos int
 	for i, s := range slices {
@@ -79,7 +91,7 @@ func Compact(conf chunk.Config, store chunk.ChunkStore, slices []meta.Slice, id
 		for read < int(s.Len) {
 			l := utils.Min(conf.BlockSize, int(s.Len)-read)
 			p := chunk.NewOffPage(l)
-			if err := readSlice(store, &slices[i], p, read); err != nil {
+			if err := readSlice(store, &slices[i], p, read, key); err != nil {
 				logger.Debugf("can't compact to slice %d, retry later, read %d: %s", id, i, err)
 				p.Release()
 				writer.Abort()
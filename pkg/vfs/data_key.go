@@ -0,0 +1,148 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+const dataKeyXattr = "user.juicefs.key"
+
+type keyEntry struct {
+	parent Ino
+	id     string
+	expire time.Time
+}
+
+// dataKeys resolves the data key of files from the xattr "user.juicefs.key" of their nearest
+// ancestor, so the data of different tenants in one volume can be encrypted by different keys.
+// It's shared by the reader, writer and VFS of the same meta, so a key bound by this client
+// takes effect immediately, and the ones bound by other clients within cachePolicyTTL.
+type dataKeys struct {
+	sync.Mutex
+	m       meta.Meta
+	entries map[Ino]keyEntry
+}
+
+var (
+	dataKeysLock sync.Mutex
+	dataKeysOfM  = make(map[meta.Meta]*dataKeys)
+)
+
+func dataKeysOf(m meta.Meta) *dataKeys {
+	dataKeysLock.Lock()
+	defer dataKeysLock.Unlock()
+	d := dataKeysOfM[m]
+	if d == nil {
+		d = &dataKeys{m: m, entries: make(map[Ino]keyEntry)}
+		dataKeysOfM[m] = d
+	}
+	return d
+}
+
+// get returns the id of data key bound to the file or its nearest ancestor, empty if there is none.
+func (d *dataKeys) get(inode Ino) string {
+	for i := 0; i < maxPolicyDepth && inode > 0; i++ {
+		e := d.lookup(inode)
+		if e.id != "" {
+			return e.id
+		}
+		if inode == meta.RootInode {
+			break
+		}
+		if e.parent == 0 { // hard links, which can't be linked across keys
+			for parent := range d.m.GetParents(meta.Background, inode) {
+				return d.get(parent)
+			}
+			break
+		}
+		inode = e.parent
+	}
+	return ""
+}
+
+func (d *dataKeys) lookup(inode Ino) keyEntry {
+	now := time.Now()
+	d.Lock()
+	e, ok := d.entries[inode]
+	d.Unlock()
+	if ok && now.Before(e.expire) {
+		return e
+	}
+
+	e = keyEntry{expire: now.Add(cachePolicyTTL)}
+	var attr Attr
+	if st := d.m.GetAttr(meta.Background, inode, &attr); st == 0 {
+		e.parent = attr.Parent
+	}
+	var value []byte
+	if st := d.m.GetXattr(meta.Background, inode, dataKeyXattr, &value); st == 0 {
+		if chunk.ValidDataKeyID(string(value)) {
+			e.id = string(value)
+		} else {
+			logger.Warnf("Ignore invalid data key %q of inode %d", value, inode)
+		}
+	}
+	d.Lock()
+	if len(d.entries) >= maxPolicyEntries { // forget all to bound the memory
+		d.entries = make(map[Ino]keyEntry)
+	}
+	d.entries[inode] = e
+	d.Unlock()
+	return e
+}
+
+func (d *dataKeys) forget(inode Ino) {
+	d.Lock()
+	delete(d.entries, inode)
+	d.Unlock()
+}
+
+// checkDataKey returns EACCES if the file is bound to a data key which is not loaded (or revoked).
+func (v *VFS) checkDataKey(inode Ino) syscall.Errno {
+	id := v.dataKeys.get(inode)
+	if id == "" {
+		return 0
+	}
+	if s, ok := v.Store.(interface{ HasDataKey(id string) bool }); ok && s.HasDataKey(id) {
+		return 0
+	}
+	return syscall.EACCES
+}
+
+// setDataKey validates the data key to be bound to a directory.
+func (v *VFS) setDataKey(ctx Context, ino Ino, value []byte) syscall.Errno {
+	var attr Attr
+	if st := v.Meta.GetAttr(ctx, ino, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ != meta.TypeDirectory {
+		return syscall.ENOTDIR
+	}
+	if !chunk.ValidDataKeyID(string(value)) {
+		return syscall.EINVAL
+	}
+	if s, ok := v.Store.(interface{ HasDataKey(id string) bool }); !ok || !s.HasDataKey(string(value)) {
+		return syscall.EACCES
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// eventReader streams the events of the mount into an opened .events file, one JSON per line.
+type eventReader struct {
+	sync.Mutex
+	watcher  *meta.Watcher    // namespace changes
+	buffer   chan *WatchEvent // closed files
+	dropped  uint64           // events dropped from buffer
+	reported uint64           // dropped events which are reported as overflow
+	pending  []*WatchEvent
+	last     []byte
+}
+
+var (
+	eventLock    sync.Mutex
+	eventReaders map[uint64]*eventReader
+)
+
+func init() {
+	eventReaders = make(map[uint64]*eventReader)
+}
+
+func (v *VFS) openEvents(ctx Context, fh uint64) syscall.Errno {
+	w, st := v.Meta.Watch(ctx, meta.RootInode, 10240)
+	if st != 0 {
+		return st
+	}
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	eventReaders[fh] = &eventReader{watcher: w, buffer: make(chan *WatchEvent, 10240)}
+	return 0
+}
+
+func closeEvents(fh uint64) {
+	eventLock.Lock()
+	r, ok := eventReaders[fh]
+	delete(eventReaders, fh)
+	eventLock.Unlock()
+	if ok {
+		r.watcher.Close()
+	}
+}
+
+// sendEvent passes the event to all the readers of .events without blocking.
+func sendEvent(typ string, inode Ino) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if len(eventReaders) == 0 {
+		return
+	}
+	e := &WatchEvent{Type: typ, Inode: inode, Time: time.Now().UnixNano()}
+	for _, r := range eventReaders {
+		select {
+		case r.buffer <- e:
+		default:
+			atomic.AddUint64(&r.dropped, 1)
+		}
+	}
+}
+
+func (v *VFS) eventLine(e *WatchEvent) []byte {
+	if e.Path == "" && e.Inode > 0 {
+		if ps := v.Meta.GetPaths(meta.Background, e.Inode); len(ps) > 0 {
+			e.Path = ps[0]
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("marshal event: %s", err)
+		return nil
+	}
+	return append(data, '\n')
+}
+
+// collect moves the queued events into pending, ordered by time as they come from two channels.
+func (r *eventReader) collect(ctx meta.Context, m meta.Meta) {
+	for {
+		select {
+		case e, ok := <-r.watcher.Events():
+			if !ok {
+				return
+			}
+			p, np := meta.EventPaths(ctx, m, e)
+			r.pending = append(r.pending, &WatchEvent{e.Type.String(), e.Inode, p, np, e.Time})
+			continue
+		case e := <-r.buffer:
+			r.pending = append(r.pending, e)
+			continue
+		default:
+		}
+		break
+	}
+	sort.SliceStable(r.pending, func(i, j int) bool { return r.pending[i].Time < r.pending[j].Time })
+}
+
+func (v *VFS) readEvents(fh uint64, buf []byte) int {
+	eventLock.Lock()
+	r, ok := eventReaders[fh]
+	eventLock.Unlock()
+	if !ok {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	var n int
+	if len(r.last) > 0 {
+		n = copy(buf, r.last)
+		r.last = r.last[n:]
+	}
+	if d := r.watcher.Dropped() + atomic.LoadUint64(&r.dropped); d > r.reported {
+		logger.Warnf("%d events are dropped by the reader of .events", d-r.reported)
+		r.reported = d
+		r.pending = append(r.pending, &WatchEvent{Type: "overflow", Time: time.Now().UnixNano()})
+	}
+	var t = time.NewTimer(time.Second)
+	defer t.Stop()
+	for n < len(buf) {
+		r.collect(meta.Background, v.Meta)
+		if len(r.pending) == 0 {
+			if n > 0 {
+				return n
+			}
+			select {
+			case e, ok := <-r.watcher.Events():
+				if !ok {
+					return n
+				}
+				p, np := meta.EventPaths(meta.Background, v.Meta, e)
+				r.pending = append(r.pending, &WatchEvent{e.Type.String(), e.Inode, p, np, e.Time})
+				time.Sleep(time.Millisecond * 10) // wait for the events of the same operation
+			case e := <-r.buffer:
+				r.pending = append(r.pending, e)
+				time.Sleep(time.Millisecond * 10)
+			case <-t.C:
+				return copy(buf, "#\n")
+			}
+			continue
+		}
+		for len(r.pending) > 0 && n < len(buf) {
+			line := v.eventLine(r.pending[0])
+			r.pending = r.pending[1:]
+			l := copy(buf[n:], line)
+			n += l
+			if l < len(line) {
+				r.last = line[l:]
+			}
+		}
+	}
+	return n
+}
@@ -21,6 +21,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
@@ -31,12 +32,15 @@ type handle struct {
 	fh    uint64
 
 	// for dir
-	children []*meta.Entry
+	children []*meta.Entry // current page of entries
+	skipped  int           // number of entries before current page
+	eof      bool          // current page is the last one
 	readAt   time.Time
 
 	// for file
 	locks      uint8
 	flockOwner uint64 // kernel 3.1- does not pass lock_owner in release()
+	shareOwner uint64 // owner of share mode
 	reader     FileReader
 	writer     FileWriter
 	ops        []Context
@@ -206,7 +210,8 @@ func (v *VFS) releaseHandle(inode Ino, fh uint64) {
 	}
 }
 
-func (v *VFS) newFileHandle(inode Ino, length uint64, flags uint32) uint64 {
+// newFileHandle returns the handle, and whether the page cache of kernel should be bypassed.
+func (v *VFS) newFileHandle(inode Ino, length uint64, flags uint32) (uint64, bool) {
 	h := v.newHandle(inode)
 	h.Lock()
 	defer h.Unlock()
@@ -219,7 +224,13 @@ func (v *VFS) newFileHandle(inode Ino, length uint64, flags uint32) uint64 {
 		h.reader = v.reader.Open(inode, length)
 		h.writer = v.writer.Open(inode, length)
 	}
-	return h.fh
+	if h.reader == nil {
+		return h.fh, false
+	}
+	if flags&oDirect != 0 {
+		h.reader.SetCachePolicy(chunk.CacheDirect)
+	}
+	return h.fh, h.reader.CachePolicy() == chunk.CacheDirect
 }
 
 func (v *VFS) releaseFileHandle(ino Ino, fh uint64) {
@@ -232,5 +243,6 @@ func (v *VFS) releaseFileHandle(ino Ino, fh uint64) {
 		}
 		h.Unlock()
 		h.Close()
+		v.writebackReleased(ino)
 	}
 }
@@ -41,6 +41,7 @@ const (
 	controlInode    = minInternalNode + 2
 	statsInode      = minInternalNode + 3
 	configInode     = minInternalNode + 4
+	eventsInode     = minInternalNode + 5
 	trashInode      = meta.TrashInode
 )
 
@@ -80,6 +81,7 @@ var internalNodes = []*internalNode{
 	{logInode, ".accesslog", &Attr{Mode: 0400}},
 	{statsInode, ".stats", &Attr{Mode: 0444}},
 	{configInode, ".config", &Attr{Mode: 0400}},
+	{eventsInode, ".events", &Attr{Mode: 0400}},
 	{trashInode, meta.TrashName, &Attr{Mode: 0555}},
 }
 
@@ -164,12 +166,21 @@ func collectMetrics(registry *prometheus.Registry) []byte {
 	}
 	for _, mf := range mfs {
 		var name = *mf.Name
-		if name == "juicefs_meta_ops_durations_histogram_seconds" && *mf.Type == io_prometheus_client.MetricType_HISTOGRAM {
+		if (name == "juicefs_meta_ops_durations_histogram_seconds" || name == "juicefs_transaction_durations_histogram_seconds") &&
+			*mf.Type == io_prometheus_client.MetricType_HISTOGRAM {
 			total, sum := mergeHistogramMetrics(mf)
 			_, _ = fmt.Fprintf(w, "%s_total %d\n", name, total)
 			_, _ = fmt.Fprintf(w, "%s_sum %s\n", name, format(sum))
 			continue
 		}
+		if name == "juicefs_transaction_restart" && *mf.Type == io_prometheus_client.MetricType_COUNTER {
+			var total float64
+			for _, m := range mf.Metric {
+				total += m.Counter.GetValue()
+			}
+			_, _ = fmt.Fprintf(w, "%s %s\n", name, format(total))
+			continue
+		}
 		for _, m := range mf.Metric {
 			for _, l := range m.Label {
 				if *l.Name != "mp" && *l.Name != "vol_name" {
@@ -282,6 +293,16 @@ type SummaryReponse struct {
 	Tree  meta.TreeSummary
 }
 
+// WatchEvent is an event sent to the watcher of a directory, the type "overflow" means
+// some events are dropped, so the watcher should rescan the directory.
+type WatchEvent struct {
+	Type    string `json:"type"`
+	Inode   Ino    `json:"inode,omitempty"`
+	Path    string `json:"path,omitempty"`
+	NewPath string `json:"newPath,omitempty"`
+	Time    int64  `json:"time"`
+}
+
 type chunkSlice struct {
 	ChunkIndex uint64
 	meta.Slice
@@ -299,6 +320,9 @@ func (v *VFS) handleInternalMsg(ctx meta.Context, cmd uint32, r *utils.Buffer, o
 		done := make(chan struct{})
 		inode := Ino(r.Get64())
 		name := string(r.Get(int(r.Get8())))
+		if !v.inRoot(ctx, out, inode) {
+			return
+		}
 		var count uint64
 		var st syscall.Errno
 		go func() {
@@ -322,6 +346,9 @@ func (v *VFS) handleInternalMsg(ctx meta.Context, cmd uint32, r *utils.Buffer, o
 		dstName := string(r.Get(int(r.Get8())))
 		umask := r.Get16()
 		cmode := r.Get8()
+		if !v.inRoot(ctx, out, srcIno, dstParentIno) {
+			return
+		}
 		var count, total uint64
 		var eno syscall.Errno
 		go func() {
@@ -347,7 +374,10 @@ func (v *VFS) handleInternalMsg(ctx meta.Context, cmd uint32, r *utils.Buffer, o
 		}
 
 		wb := utils.NewBuffer(4)
-		r := v.Meta.GetSummary(ctx, inode, &summary, recursive != 0, true)
+		r := syscall.EPERM
+		if v.Meta.InRoot(ctx, inode) {
+			r = v.Meta.GetSummary(ctx, inode, &summary, recursive != 0, true)
+		}
 		if r != 0 {
 			msg := r.Error()
 			wb.Put32(uint32(len(msg)))
@@ -412,6 +442,9 @@ func (v *VFS) handleInternalMsg(ctx meta.Context, cmd uint32, r *utils.Buffer, o
 		if r.HasMore() {
 			strict = r.Get8() != 0
 		}
+		if !v.inRoot(ctx, out, inode) {
+			return
+		}
 
 		done := make(chan struct{})
 		var r syscall.Errno
@@ -478,6 +511,9 @@ func (v *VFS) handleInternalMsg(ctx meta.Context, cmd uint32, r *utils.Buffer, o
 		if r.HasMore() {
 			strict = r.Get8() != 0
 		}
+		if !v.inRoot(ctx, out, inode) {
+			return
+		}
 
 		done := make(chan struct{})
 		var files, size uint64
@@ -518,8 +554,81 @@ func (v *VFS) handleInternalMsg(ctx meta.Context, cmd uint32, r *utils.Buffer, o
 			go v.fillCache(meta.NewContext(ctx.Pid(), ctx.Uid(), ctx.Gids()), paths, int(concurrent), nil, nil)
 		}
 		_, _ = out.Write([]byte{0})
+	case meta.UpdateCache:
+		dirs := string(r.Get(int(r.Get32())))
+		size := int64(r.Get64())
+		if ctx.Uid() != 0 {
+			_, _ = out.Write([]byte{byte(syscall.EPERM & 0xff)})
+			return
+		}
+		if err := v.Store.UpdateCache(dirs, size); err != nil {
+			logger.Warnf("Update cache (dirs %q, size %d MiB): %s", dirs, size, err)
+			_, _ = out.Write([]byte{byte(syscall.EINVAL & 0xff)})
+			return
+		}
+		_, _ = out.Write([]byte{0})
+	case meta.OpWatch:
+		inode := Ino(r.Get64())
+		if !v.inRoot(ctx, out, inode) {
+			return
+		}
+		w, st := v.Meta.Watch(ctx, inode, 10000)
+		if st != 0 {
+			_, _ = out.Write([]byte{uint8(st)})
+			return
+		}
+		v.watch(ctx, w, out)
+		_, _ = out.Write([]byte{0})
 	default:
 		logger.Warnf("unknown message type: %d", cmd)
 		_, _ = out.Write([]byte{byte(syscall.EINVAL & 0xff)})
 	}
 }
+
+// inRoot checks the inodes in a control message, which can't be outside of the mounted root.
+func (v *VFS) inRoot(ctx meta.Context, out io.Writer, inodes ...Ino) bool {
+	for _, inode := range inodes {
+		if !v.Meta.InRoot(ctx, inode) {
+			logger.Warnf("Inode %d is outside of the mounted root", inode)
+			_, _ = out.Write([]byte{byte(syscall.EPERM & 0xff)})
+			return false
+		}
+	}
+	return true
+}
+
+// watch sends the events to out until the control file is closed.
+func (v *VFS) watch(ctx meta.Context, w *meta.Watcher, out io.Writer) {
+	defer w.Close()
+	send := func(e *WatchEvent) {
+		data, err := json.Marshal(e)
+		if err != nil {
+			logger.Errorf("marshal watch event: %v", err)
+			return
+		}
+		wb := utils.NewBuffer(uint32(1 + 4 + len(data)))
+		wb.Put8(meta.CDATA)
+		wb.Put32(uint32(len(data)))
+		wb.Put(data)
+		_, _ = out.Write(wb.Bytes())
+	}
+	var dropped uint64
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-w.Events():
+			p, np := meta.EventPaths(ctx, v.Meta, e)
+			send(&WatchEvent{e.Type.String(), e.Inode, p, np, e.Time})
+		case <-ticker.C:
+			if ctx.Canceled() {
+				return
+			}
+			if d := w.Dropped(); d > dropped {
+				logger.Warnf("%d events are dropped by the watcher", d-dropped)
+				dropped = d
+				send(&WatchEvent{Type: "overflow", Time: time.Now().UnixNano()})
+			}
+		}
+	}
+}
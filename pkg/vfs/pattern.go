@@ -0,0 +1,98 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+type accessPattern uint8
+
+const (
+	patternUnknown accessPattern = iota
+	patternSequential
+	patternStrided
+	patternRandom
+)
+
+var patternNames = []string{"unknown", "sequential", "strided", "random"}
+
+func (p accessPattern) String() string { return patternNames[p] }
+
+const (
+	patternConfirms = 3 // number of continuous requests to confirm a strided or random pattern
+	maxStrideAhead  = 8 // max number of requests to read ahead for strided pattern
+)
+
+// patternDetector classifies the requests of a file handle into sequential, strided or random.
+// Sequential requests (including interleaved streams) are detected by the read sessions, so the
+// readahead window grows as before; strided requests are read ahead by the stride, and no data is
+// read ahead for random requests to avoid polluting the buffer and cache.
+type patternDetector struct {
+	lastOff   uint64
+	lastLen   uint64
+	stride    int64
+	requests  uint64
+	candidate accessPattern
+	hits      int // continuous requests of candidate
+	pattern   accessPattern
+}
+
+// observe updates the pattern with a new request, seq tells whether it follows a read session.
+func (d *patternDetector) observe(block *frange, seq bool) accessPattern {
+	var p accessPattern
+	stride := int64(block.off) - int64(d.lastOff)
+	switch {
+	case seq:
+		p = patternSequential
+	case d.requests > 1 && stride == d.stride && stride != 0:
+		p = patternStrided
+	case d.requests > 0:
+		p = patternRandom
+	}
+	d.lastOff, d.lastLen = block.off, block.len
+	d.stride = stride
+	d.requests++
+	if p == d.candidate {
+		d.hits++
+	} else {
+		d.candidate, d.hits = p, 1
+	}
+	if p == patternSequential || d.hits >= patternConfirms {
+		d.pattern = p
+	}
+	return d.pattern
+}
+
+// predicted tells whether the block would be requested by the strided pattern.
+func (d *patternDetector) predicted(block *frange) bool {
+	if d.pattern != patternStrided {
+		return false
+	}
+	for i := 1; i <= maxStrideAhead; i++ {
+		if off := int64(d.lastOff) + d.stride*int64(i); off >= 0 && block.overlap(&frange{uint64(off), d.lastLen}) {
+			return true
+		}
+	}
+	return false
+}
+
+// aheads returns the number of requests to read ahead for strided pattern, which grows with the
+// confidence of the pattern.
+func (d *patternDetector) aheads() int {
+	n := d.hits - patternConfirms + 1
+	if n > maxStrideAhead {
+		n = maxStrideAhead
+	}
+	return n
+}
@@ -0,0 +1,53 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import "testing"
+
+func TestPatternDetector(t *testing.T) {
+	var d patternDetector
+	for i := uint64(0); i < 5; i++ {
+		if p := d.observe(&frange{i << 20, 4 << 10}, i > 0); i > 0 && p != patternSequential {
+			t.Fatalf("request %d: expect sequential, but got %s", i, p)
+		}
+	}
+
+	d = patternDetector{}
+	for i := uint64(0); i < 6; i++ {
+		p := d.observe(&frange{i * (16 << 20), 4 << 10}, false)
+		if i >= patternConfirms+1 && p != patternStrided {
+			t.Fatalf("request %d: expect strided, but got %s", i, p)
+		}
+	}
+	if n := d.aheads(); n != 2 {
+		t.Fatalf("expect 2 requests to read ahead, but got %d", n)
+	}
+	if !d.predicted(&frange{7 * (16 << 20), 4 << 10}) || d.predicted(&frange{3 * (16 << 20), 4 << 10}) {
+		t.Fatalf("predicted requests of strided pattern are wrong")
+	}
+
+	d = patternDetector{}
+	for i, off := range []uint64{100 << 20, 3 << 20, 70 << 20, 9 << 20, 51 << 20} {
+		p := d.observe(&frange{off, 4 << 10}, false)
+		if i >= patternConfirms && p != patternRandom {
+			t.Fatalf("request %d: expect random, but got %s", i, p)
+		}
+	}
+	if p := d.observe(&frange{51<<20 + 4<<10, 4 << 10}, true); p != patternSequential {
+		t.Fatalf("expect sequential after random, but got %s", p)
+	}
+}
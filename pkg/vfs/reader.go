@@ -69,6 +69,8 @@ func (m sstate) String() string {
 type FileReader interface {
 	Read(ctx meta.Context, off uint64, buf []byte) (int, syscall.Errno)
 	Close(ctx meta.Context)
+	CachePolicy() chunk.CachePolicy
+	SetCachePolicy(policy chunk.CachePolicy)
 }
 
 type DataReader interface {
@@ -198,12 +200,20 @@ func (s *sliceReader) run() {
 		s.block.len = length - s.block.off
 	}
 	need := s.block.len
+	// fetching the whole block for random reads only brings read amplification
+	prefetch := f.detector.pattern != patternRandom
+	// nobody is waiting for the slices of readahead
+	class := chunk.ClassForeground
+	if s.refs == 0 {
+		class = chunk.ClassPrefetch
+	}
 	f.Unlock()
 
 	p := s.page.Slice(0, int(need))
 	defer p.Release()
 	var n int
-	ctx := context.TODO()
+	ctx := chunk.WithCachePolicy(chunk.WithPrefetch(context.TODO(), prefetch), f.policy)
+	ctx = chunk.WithDataKey(chunk.WithIOClass(ctx, class), f.dataKey)
 	n = f.r.Read(ctx, p, slices, (uint32(s.block.off))%meta.ChunkSize)
 
 	f.Lock()
@@ -286,6 +296,9 @@ type fileReader struct {
 	err      syscall.Errno
 	tried    uint32
 	sessions [readSessions]session
+	detector patternDetector
+	policy   chunk.CachePolicy
+	dataKey  string
 	slices   *sliceReader
 	last     **sliceReader
 
@@ -360,7 +373,8 @@ func (f *fileReader) release() {
 	}
 }
 
-func (f *fileReader) guessSession(block *frange) int {
+// guessSession returns the session of the request, and whether it follows an existing one.
+func (f *fileReader) guessSession(block *frange) (int, bool) {
 	idx := -1
 	var closestOff uint64
 	for i, ses := range f.sessions {
@@ -385,6 +399,7 @@ func (f *fileReader) guessSession(block *frange) int {
 			}
 		}
 	}
+	matched := idx != -1
 	if idx == -1 {
 		for i, ses := range f.sessions {
 			if ses.total == 0 {
@@ -404,15 +419,23 @@ func (f *fileReader) guessSession(block *frange) int {
 		}
 	}
 	f.sessions[idx].atime = time.Now()
-	return idx
+	return idx, matched
 }
 
 func (f *fileReader) checkReadahead(block *frange) int {
-	idx := f.guessSession(block)
+	idx, matched := f.guessSession(block)
 	ses := &f.sessions[idx]
 	seqdata := ses.total
 	readahead := ses.readahead
 	used := uint64(atomic.LoadInt64(&readBufferUsed))
+	switch f.detector.observe(block, matched) {
+	case patternStrided:
+		f.readAheadStrided(block, f.detector.stride, f.detector.aheads())
+		return idx
+	case patternRandom:
+		ses.readahead = 0
+		return idx
+	}
 	if readahead == 0 && (block.off == 0 || seqdata > block.len) { // begin with read-ahead turned on
 		ses.readahead = f.r.blockSize
 	} else if readahead < f.r.readAheadMax && seqdata >= readahead && f.r.readAheadTotal-used > readahead*4 {
@@ -431,6 +454,9 @@ func (f *fileReader) checkReadahead(block *frange) int {
 }
 
 func (f *fileReader) need(block *frange) bool {
+	if f.detector.predicted(block) {
+		return true
+	}
 	for _, ses := range f.sessions {
 		if ses.total == 0 {
 			break
@@ -539,6 +565,27 @@ func (f *fileReader) readAhead(block *frange) {
 	}
 }
 
+// readAheadStrided reads ahead the next n requests of the same size by stride.
+func (f *fileReader) readAheadStrided(block *frange, stride int64, n int) {
+	if max := int(f.r.readAheadMax / block.len); n > max {
+		n = max
+	}
+	for i := 1; i <= n; i++ {
+		off := int64(block.off) + stride*int64(i)
+		if off < 0 || uint64(off) >= f.length || uint64(atomic.LoadInt64(&readBufferUsed)) >= f.r.readAheadTotal {
+			break
+		}
+		ahead := frange{uint64(off), block.len}
+		var covered bool
+		f.visit(func(s *sliceReader) {
+			covered = covered || s.state.valid() && s.block.include(&ahead)
+		})
+		for !covered && ahead.len > 0 && ahead.off < f.length {
+			f.newSlice(&ahead)
+		}
+	}
+}
+
 type req struct {
 	frange
 	s *sliceReader
@@ -658,6 +705,19 @@ func (f *fileReader) visit(fn func(s *sliceReader)) {
 	}
 }
 
+func (f *fileReader) CachePolicy() chunk.CachePolicy {
+	f.Lock()
+	defer f.Unlock()
+	return f.policy
+}
+
+// SetCachePolicy overrides the cache policy resolved from the path, e.g. for O_DIRECT.
+func (f *fileReader) SetCachePolicy(policy chunk.CachePolicy) {
+	f.Lock()
+	f.policy = policy
+	f.Unlock()
+}
+
 func (f *fileReader) Close(ctx meta.Context) {
 	f.Lock()
 	f.closing = true
@@ -678,6 +738,8 @@ type dataReader struct {
 	readAheadTotal uint64
 	maxRequests    int
 	maxRetries     uint32
+	policies       *cachePolicies
+	keys           *dataKeys
 }
 
 func NewDataReader(conf *Config, m meta.Meta, store chunk.ChunkStore) DataReader {
@@ -698,6 +760,8 @@ func NewDataReader(conf *Config, m meta.Meta, store chunk.ChunkStore) DataReader
 		readAheadMax:   uint64(readAheadMax),
 		maxRequests:    readAheadMax/conf.Chunk.BlockSize*readSessions + 1,
 		maxRetries:     uint32(conf.Meta.Retries),
+		policies:       newCachePolicies(conf, m),
+		keys:           dataKeysOf(m),
 	}
 	go r.checkReadBuffer()
 	return r
@@ -726,9 +790,11 @@ func (r *dataReader) checkReadBuffer() {
 
 func (r *dataReader) Open(inode Ino, length uint64) FileReader {
 	f := &fileReader{
-		r:      r,
-		inode:  inode,
-		length: length,
+		r:       r,
+		inode:   inode,
+		length:  length,
+		policy:  r.policies.get(inode),
+		dataKey: r.keys.get(inode),
 	}
 	f.last = &(f.slices)
 
@@ -0,0 +1,142 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+const readOnlyTTL = time.Minute
+
+// readOnlyPrefixes checks whether an inode is inside one of the read-only paths of the mount.
+// The paths are resolved into directories periodically, so the directories created or renamed
+// later are protected after at most one minute.
+type readOnlyPrefixes struct {
+	sync.Mutex
+	m        meta.Meta
+	paths    []string
+	root     Ino // the real inode of mounted root
+	dirs     map[Ino]struct{}
+	resolved time.Time
+}
+
+func newReadOnlyPrefixes(conf *Config, m meta.Meta) *readOnlyPrefixes {
+	r := &readOnlyPrefixes{m: m}
+	for _, p := range strings.Split(conf.ReadOnlyPrefixes, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			r.paths = append(r.paths, p)
+		}
+	}
+	return r
+}
+
+func (r *readOnlyPrefixes) resolve() (map[Ino]struct{}, Ino) {
+	r.Lock()
+	defer r.Unlock()
+	if r.dirs != nil && time.Since(r.resolved) < readOnlyTTL {
+		return r.dirs, r.root
+	}
+	ctx := meta.Background
+	var attr Attr
+	if st := r.m.Lookup(ctx, rootID, ".", &r.root, &attr, false); st != 0 {
+		logger.Warnf("Lookup mounted root: %s", st)
+		r.root = rootID
+	}
+	dirs := make(map[Ino]struct{})
+	for _, p := range r.paths {
+		inode := r.root
+		var st syscall.Errno
+		for _, name := range strings.Split(p, "/") {
+			if name == "" {
+				continue
+			}
+			if st = r.m.Lookup(ctx, inode, name, &inode, &attr, false); st != 0 {
+				break
+			}
+		}
+		if st == 0 {
+			dirs[inode] = struct{}{}
+		} else if st != syscall.ENOENT {
+			logger.Warnf("Resolve read-only path %s: %s", p, st)
+		}
+	}
+	r.dirs, r.resolved = dirs, time.Now()
+	return dirs, r.root
+}
+
+// contains checks whether the inode is one of the read-only directories or inside them.
+func (r *readOnlyPrefixes) contains(ctx Context, inode Ino) bool {
+	if len(r.paths) == 0 {
+		return false
+	}
+	dirs, root := r.resolve()
+	if inode == rootID {
+		inode = root
+	}
+	var attr Attr
+	for i := 0; i < maxPolicyDepth && inode > 0; i++ {
+		if _, ok := dirs[inode]; ok {
+			return true
+		}
+		if inode == root || inode == rootID {
+			return false
+		}
+		if st := r.m.GetAttr(ctx, inode, &attr); st != 0 {
+			return false
+		}
+		if attr.Parent == 0 { // hard links
+			for parent := range r.m.GetParents(ctx, inode) {
+				if r.contains(ctx, parent) {
+					return true
+				}
+			}
+			return false
+		}
+		inode = attr.Parent
+	}
+	return false
+}
+
+// containsEntry checks whether the entry is a read-only directory, which can't be removed or renamed.
+func (r *readOnlyPrefixes) containsEntry(ctx Context, parent Ino, name string) bool {
+	if len(r.paths) == 0 {
+		return false
+	}
+	var inode Ino
+	var attr Attr
+	if st := r.m.Lookup(ctx, parent, name, &inode, &attr, false); st != 0 || attr.Typ != meta.TypeDirectory {
+		return false
+	}
+	dirs, _ := r.resolve()
+	_, ok := dirs[inode]
+	return ok
+}
+
+// checkReadOnly returns EROFS if any of the inodes is inside the read-only paths of the mount.
+func (v *VFS) checkReadOnly(ctx Context, inodes ...Ino) syscall.Errno {
+	for _, inode := range inodes {
+		if v.readOnly.contains(ctx, inode) {
+			return syscall.EROFS
+		}
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// Share modes of Windows are emulated by POSIX locks on reserved bytes beyond the largest offset
+// which can be locked by fcntl(2), so they are enforced across clients by the meta engine, and
+// cleaned up together with other locks when a client is gone.
+//
+// An opened file holds a shared lock on the access byte of each mode it's opened for, and on the
+// deny byte of each mode it denies. A new open conflicts with the others if it asks for a mode
+// which is denied by them, or denies a mode which is accessed by them. The locks are taken before
+// the checks, so two conflicting opens can't both succeed, and the adjacent bytes are locked or
+// checked together to save round trips.
+const (
+	ShareRead  = 1 << iota // read access, or deny-read
+	ShareWrite             // write access, or deny-write
+)
+
+// the bytes are ordered as access-write, access-read, deny-write and deny-read, so the common
+// modes (e.g. read access with deny-write) are held by one range.
+const (
+	shareAccessBase = uint64(1) << 63
+	shareDenyBase   = shareAccessBase + 2
+	shareLast       = shareDenyBase + 1
+)
+
+var shareOwner = uint64(1) << 63
+
+// shareRanges returns the ranges of the bytes for the modes in access and deny, the adjacent
+// ones are merged.
+func shareRanges(access, deny uint8) [][2]uint64 {
+	var offs []uint64
+	for i, mask := range []uint8{access, deny} {
+		base := shareAccessBase + uint64(i)*2
+		if mask&ShareWrite != 0 {
+			offs = append(offs, base)
+		}
+		if mask&ShareRead != 0 {
+			offs = append(offs, base+1)
+		}
+	}
+	var ranges [][2]uint64
+	for _, off := range offs {
+		if n := len(ranges); n > 0 && ranges[n-1][1]+1 == off {
+			ranges[n-1][1] = off
+		} else {
+			ranges = append(ranges, [2]uint64{off, off})
+		}
+	}
+	return ranges
+}
+
+// AcquireShareMode checks and records the share mode of a newly opened file, it returns EBUSY
+// (sharing violation) if it conflicts with the files opened by this or other clients. The returned
+// owner should be passed to ReleaseShareMode after the file is closed.
+func AcquireShareMode(ctx meta.Context, m meta.Meta, inode Ino, access, deny uint8) (owner uint64, st syscall.Errno) {
+	owner = atomic.AddUint64(&shareOwner, 1)
+	holds := shareRanges(access, deny)
+	checks := shareRanges(deny, access) // the accesses denied by others, and the denies accessed by others
+	for i := 1; ; i++ {
+		if st = tryShareMode(ctx, m, inode, owner, holds, checks); st != syscall.EBUSY || i == 3 {
+			break
+		}
+		// both of two conflicting opens fail if they check at the same time, so try again later
+		time.Sleep(time.Millisecond * time.Duration(1+rand.Intn(10*i)))
+	}
+	if st != 0 {
+		return 0, st
+	}
+	return owner, 0
+}
+
+func tryShareMode(ctx meta.Context, m meta.Meta, inode Ino, owner uint64, holds, checks [][2]uint64) (st syscall.Errno) {
+	for i := 0; st == 0 && i < len(holds); i++ {
+		st = m.Setlk(ctx, inode, owner, false, meta.F_RDLCK, holds[i][0], holds[i][1], 0)
+	}
+	for i := 0; st == 0 && i < len(checks); i++ {
+		var typ, pid uint32 = meta.F_WRLCK, 0
+		start, end := checks[i][0], checks[i][1]
+		if st = m.Getlk(ctx, inode, owner, &typ, &start, &end, &pid); st == 0 && typ != meta.F_UNLCK {
+			st = syscall.EBUSY
+		}
+	}
+	if st != 0 && len(holds) > 0 {
+		ReleaseShareMode(ctx, m, inode, owner)
+	}
+	return
+}
+
+// ReleaseShareMode releases the share mode acquired by AcquireShareMode.
+func ReleaseShareMode(ctx meta.Context, m meta.Meta, inode Ino, owner uint64) {
+	if st := m.Setlk(ctx, inode, owner, false, meta.F_UNLCK, shareAccessBase, shareLast, 0); st != 0 {
+		logger.Warnf("release share mode of inode %d: %s", inode, st)
+	}
+}
+
+// SetShareMode sets the share mode of an opened file for SMB servers layered on JuiceFS, the access and
+// deny are combinations of ShareRead and ShareWrite. It's released when the file is closed.
+func (v *VFS) SetShareMode(ctx Context, ino Ino, fh uint64, access, deny uint8) (err syscall.Errno) {
+	defer func() { logit(ctx, "sharemode (%d,%d,%d,%d): %s", ino, fh, access, deny, strerr(err)) }()
+	if IsSpecialNode(ino) {
+		return syscall.EPERM
+	}
+	h := v.findHandle(ino, fh)
+	if h == nil {
+		return syscall.EBADF
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.shareOwner != 0 {
+		return syscall.EINVAL // it can be set only once
+	}
+	h.shareOwner, err = AcquireShareMode(ctx, v.Meta, ino, access, deny)
+	return
+}
@@ -0,0 +1,127 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestShareRanges(t *testing.T) {
+	cases := []struct {
+		access, deny uint8
+		ranges       [][2]uint64
+	}{
+		{0, 0, nil},
+		{ShareRead, ShareWrite, [][2]uint64{{shareAccessBase + 1, shareDenyBase}}},
+		{ShareRead | ShareWrite, ShareWrite, [][2]uint64{{shareAccessBase, shareDenyBase}}},
+		{ShareWrite, ShareRead, [][2]uint64{{shareAccessBase, shareAccessBase}, {shareLast, shareLast}}},
+		{ShareRead | ShareWrite, ShareRead | ShareWrite, [][2]uint64{{shareAccessBase, shareLast}}},
+	}
+	for _, c := range cases {
+		if r := shareRanges(c.access, c.deny); !reflect.DeepEqual(r, c.ranges) {
+			t.Fatalf("ranges of access %d deny %d: expect %v, got %v", c.access, c.deny, c.ranges, r)
+		}
+	}
+}
+
+func TestShareModeClients(t *testing.T) {
+	addr := "sqlite3://" + filepath.Join(t.TempDir(), "share-mode.db")
+	format := &meta.Format{Name: "test", UUID: uuid.New().String(), Storage: "mem", BlockSize: 4096}
+	var clients []meta.Meta
+	for i := 0; i < 2; i++ {
+		m := meta.NewClient(addr, meta.DefaultConf())
+		if i == 0 {
+			if err := m.Init(format, true); err != nil {
+				t.Fatalf("init: %s", err)
+			}
+		}
+		if _, err := m.Load(true); err != nil {
+			t.Fatalf("load: %s", err)
+		}
+		if err := m.NewSession(); err != nil {
+			t.Fatalf("new session: %s", err)
+		}
+		defer m.CloseSession() // nolint:errcheck
+		clients = append(clients, m)
+	}
+	m1, m2 := clients[0], clients[1]
+	ctx := meta.Background
+	var inode Ino
+	var attr Attr
+	if st := m1.Create(ctx, meta.RootInode, "shared", 0644, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create shared: %s", st)
+	}
+
+	o1, st := AcquireShareMode(ctx, m1, inode, ShareRead|ShareWrite, ShareWrite)
+	if st != 0 {
+		t.Fatalf("open for write with deny-write: %s", st)
+	}
+	if _, st = AcquireShareMode(ctx, m2, inode, ShareWrite, 0); st != syscall.EBUSY {
+		t.Fatalf("write is denied by another client: %s", st)
+	}
+	o2, st := AcquireShareMode(ctx, m2, inode, ShareRead, 0)
+	if st != 0 {
+		t.Fatalf("read is shared with another client: %s", st)
+	}
+	if _, st = AcquireShareMode(ctx, m1, inode, 0, ShareRead); st != syscall.EBUSY {
+		t.Fatalf("deny read while it's read by another client: %s", st)
+	}
+	ReleaseShareMode(ctx, m1, inode, o1)
+	o3, st := AcquireShareMode(ctx, m2, inode, ShareWrite, ShareWrite)
+	if st != 0 {
+		t.Fatalf("write after deny-write is released by another client: %s", st)
+	}
+	ReleaseShareMode(ctx, m2, inode, o3)
+	ReleaseShareMode(ctx, m2, inode, o2)
+
+	// exclusive opens from both clients at the same time
+	var holders, acquired int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(m meta.Meta) {
+			defer wg.Done()
+			owner, st := AcquireShareMode(ctx, m, inode, ShareRead|ShareWrite, ShareRead|ShareWrite)
+			if st == syscall.EBUSY {
+				return
+			} else if st != 0 {
+				t.Errorf("exclusive open: %s", st)
+				return
+			}
+			atomic.AddInt32(&acquired, 1)
+			if n := atomic.AddInt32(&holders, 1); n > 1 {
+				t.Errorf("%d exclusive holders", n)
+			}
+			time.Sleep(time.Millisecond * 5)
+			atomic.AddInt32(&holders, -1)
+			ReleaseShareMode(ctx, m, inode, owner)
+		}(clients[i%2])
+	}
+	wg.Wait()
+	if acquired == 0 {
+		t.Fatalf("no one gets the exclusive share mode")
+	}
+}
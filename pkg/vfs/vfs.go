@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -35,10 +36,11 @@ type Attr = meta.Attr
 type Context = LogContext
 
 const (
-	rootID      = 1
-	maxName     = meta.MaxName
-	maxSymlink  = 4096
-	maxFileSize = meta.ChunkSize << 31
+	rootID          = 1
+	maxName         = meta.MaxName
+	maxSymlink      = 4096
+	maxFileSize     = meta.ChunkSize << 31
+	readdirPageSize = 10000
 )
 
 type Port struct {
@@ -58,12 +60,19 @@ type Config struct {
 	DirEntryTimeout      time.Duration
 	EntryTimeout         time.Duration
 	BackupMeta           time.Duration
-	FastResolve          bool   `json:",omitempty"`
-	AccessLog            string `json:",omitempty"`
+	FastResolve          bool    `json:",omitempty"`
+	AccessLog            string  `json:",omitempty"`
+	AccessLogFormat      string  `json:",omitempty"` // text or json
+	AccessLogSample      float64 `json:",omitempty"` // ratio of successful operations to log
+	AccessLogRotate      int64   `json:",omitempty"` // in MiB
 	PrefixInternal       bool
 	HideInternal         bool
 	RootSquash           *RootSquash `json:",omitempty"`
 	NonDefaultPermission bool        `json:",omitempty"`
+	ReadOnlyPrefixes     string      `json:",omitempty"` // comma separated paths which are read-only in this mount
+	StrictXattrs         bool        `json:",omitempty"` // reject setting the extended attributes out of the supported namespaces
+	WritebackCache       bool        `json:",omitempty"` // FUSE writeback_cache mode, in which the kernel owns the length of files
+	CaseInsensitive      bool        `json:",omitempty"` // resolve names in case-insensitive way (Windows only)
 }
 
 type RootSquash struct {
@@ -166,6 +175,9 @@ func (v *VFS) Mknod(ctx Context, parent Ino, name string, mode uint16, cumask ui
 		err = syscall.EPERM
 		return
 	}
+	if err = v.checkReadOnly(ctx, parent); err != 0 {
+		return
+	}
 
 	var inode Ino
 	var attr = &Attr{}
@@ -186,6 +198,9 @@ func (v *VFS) Unlink(ctx Context, parent Ino, name string) (err syscall.Errno) {
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = v.checkReadOnly(ctx, parent); err != 0 {
+		return
+	}
 	err = v.Meta.Unlink(ctx, parent, name)
 	return
 }
@@ -203,6 +218,10 @@ func (v *VFS) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask ui
 		return
 	}
 
+	if err = v.checkReadOnly(ctx, parent); err != 0 {
+		return
+	}
+
 	var inode Ino
 	var attr = &Attr{}
 	err = v.Meta.Mkdir(ctx, parent, name, mode, cumask, 0, &inode, attr)
@@ -218,6 +237,13 @@ func (v *VFS) Rmdir(ctx Context, parent Ino, name string) (err syscall.Errno) {
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = v.checkReadOnly(ctx, parent); err != 0 {
+		return
+	}
+	if v.readOnly.containsEntry(ctx, parent, name) {
+		err = syscall.EROFS
+		return
+	}
 	err = v.Meta.Rmdir(ctx, parent, name)
 	return
 }
@@ -235,6 +261,10 @@ func (v *VFS) Symlink(ctx Context, path string, parent Ino, name string) (entry
 		return
 	}
 
+	if err = v.checkReadOnly(ctx, parent); err != 0 {
+		return
+	}
+
 	var inode Ino
 	var attr = &Attr{}
 	err = v.Meta.Symlink(ctx, parent, name, path, &inode, attr)
@@ -266,6 +296,18 @@ func (v *VFS) Rename(ctx Context, parent Ino, name string, newparent Ino, newnam
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = v.checkReadOnly(ctx, parent, newparent); err != 0 {
+		return
+	}
+	if v.readOnly.containsEntry(ctx, parent, name) || v.readOnly.containsEntry(ctx, newparent, newname) {
+		err = syscall.EROFS
+		return
+	}
+	// files can't be moved across data keys, they should be copied to be encrypted by the new key
+	if parent != newparent && v.dataKeys.get(parent) != v.dataKeys.get(newparent) {
+		err = syscall.EXDEV
+		return
+	}
 
 	err = v.Meta.Rename(ctx, parent, name, newparent, newname, flags, nil, nil)
 	return
@@ -287,6 +329,13 @@ func (v *VFS) Link(ctx Context, ino Ino, newparent Ino, newname string) (entry *
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = v.checkReadOnly(ctx, newparent); err != 0 {
+		return
+	}
+	if v.dataKeys.get(ino) != v.dataKeys.get(newparent) {
+		err = syscall.EXDEV
+		return
+	}
 
 	var attr = &Attr{}
 	err = v.Meta.Link(ctx, ino, newparent, newname, attr)
@@ -336,35 +385,57 @@ func (v *VFS) Readdir(ctx Context, ino Ino, size uint32, off int, fh uint64, plu
 	h.Lock()
 	defer h.Unlock()
 
-	if h.children == nil || off == 0 {
-		var inodes []*meta.Entry
-		h.readAt = time.Now()
-		err = v.Meta.Readdir(ctx, ino, 1, &inodes)
-		if err == syscall.EACCES {
-			err = v.Meta.Readdir(ctx, ino, 0, &inodes)
-		}
-		if err != 0 {
+	if h.children == nil || off == 0 || off < h.skipped {
+		h.skipped = 0
+		if err = v.readdirPage(ctx, h, ino, nil); err != 0 {
 			return
 		}
-		h.children = inodes
-		if ino == rootID && !v.Conf.HideInternal {
-			// add internal nodes
-			for _, node := range internalNodes[1:] {
-				h.children = append(h.children, &meta.Entry{
-					Inode: node.inode,
-					Name:  []byte(node.name),
-					Attr:  node.attr,
-				})
-			}
+	}
+	for off >= h.skipped+len(h.children) && !h.eof {
+		h.skipped += len(h.children)
+		if err = v.readdirPage(ctx, h, ino, h.children[len(h.children)-1].Name); err != 0 {
+			h.children = nil
+			return
 		}
 	}
-	if off < len(h.children) {
-		entries = h.children[off:]
+	if off-h.skipped < len(h.children) {
+		entries = h.children[off-h.skipped:]
 	}
 	readAt = h.readAt
 	return
 }
 
+// readdirPage fetches the page of entries after the given name, so a big directory is listed without
+// loading all the entries into memory.
+func (v *VFS) readdirPage(ctx Context, h *handle, ino Ino, after []byte) (err syscall.Errno) {
+	var inodes []*meta.Entry
+	h.readAt = time.Now()
+	err = v.Meta.ReaddirPage(ctx, ino, 1, after, readdirPageSize, &inodes)
+	if err == syscall.EACCES {
+		err = v.Meta.ReaddirPage(ctx, ino, 0, after, readdirPageSize, &inodes)
+	}
+	if err != 0 {
+		return
+	}
+	n := len(inodes)
+	if after == nil {
+		n -= 2 // "." and ".."
+	}
+	h.children = inodes
+	h.eof = n < readdirPageSize
+	if h.eof && ino == rootID && !v.Conf.HideInternal {
+		// add internal nodes
+		for _, node := range internalNodes[1:] {
+			h.children = append(h.children, &meta.Entry{
+				Inode: node.inode,
+				Name:  []byte(node.name),
+				Attr:  node.attr,
+			})
+		}
+	}
+	return
+}
+
 func (v *VFS) Releasedir(ctx Context, ino Ino, fh uint64) int {
 	h := v.findHandle(ino, fh)
 	if h == nil {
@@ -388,6 +459,13 @@ func (v *VFS) Create(ctx Context, parent Ino, name string, mode uint16, cumask u
 		return
 	}
 
+	if err = v.checkReadOnly(ctx, parent); err != 0 {
+		return
+	}
+	if err = v.checkDataKey(parent); err != 0 {
+		return
+	}
+
 	var inode Ino
 	var attr = &Attr{}
 	err = v.Meta.Create(ctx, parent, name, mode&07777, cumask, flags, &inode, attr)
@@ -396,7 +474,30 @@ func (v *VFS) Create(ctx Context, parent Ino, name string, mode uint16, cumask u
 	}
 	if err == 0 {
 		v.UpdateLength(inode, attr)
-		fh = v.newFileHandle(inode, attr.Length, flags)
+		fh, attr.DirectIO = v.newFileHandle(inode, attr.Length, flags)
+		entry = &meta.Entry{Inode: inode, Attr: attr}
+	}
+	return
+}
+
+// TmpFile creates an anonymous file (O_TMPFILE) in parent, which could be linked into a directory later.
+func (v *VFS) TmpFile(ctx Context, parent Ino, mode uint16, cumask uint16, flags uint32) (entry *meta.Entry, fh uint64, err syscall.Errno) {
+	defer func() {
+		logit(ctx, "tmpfile (%d,%s:0%04o): %s%s [fh:%d]", parent, smode(mode), mode, strerr(err), (*Entry)(entry), fh)
+	}()
+	if err = v.checkReadOnly(ctx, parent); err != 0 {
+		return
+	}
+	if err = v.checkDataKey(parent); err != 0 {
+		return
+	}
+
+	var inode Ino
+	var attr = &Attr{}
+	err = v.Meta.TmpFile(ctx, parent, mode&07777, cumask, &inode, attr)
+	if err == 0 {
+		v.UpdateLength(inode, attr)
+		fh, attr.DirectIO = v.newFileHandle(inode, attr.Length, flags)
 		entry = &meta.Entry{Inode: inode, Attr: attr}
 	}
 	return
@@ -426,6 +527,12 @@ func (v *VFS) Open(ctx Context, ino Ino, flags uint32) (entry *meta.Entry, fh ui
 		switch ino {
 		case logInode:
 			openAccessLog(fh)
+		case eventsInode:
+			if err = v.openEvents(ctx, fh); err != 0 {
+				v.releaseHandle(ino, fh)
+				fh = 0
+				entry = nil
+			}
 		case statsInode:
 			h.data = collectMetrics(v.registry)
 		case configInode:
@@ -440,10 +547,18 @@ func (v *VFS) Open(ctx Context, ino Ino, flags uint32) (entry *meta.Entry, fh ui
 		return
 	}
 
+	if (flags&O_ACCMODE) != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		if err = v.checkReadOnly(ctx, ino); err != 0 {
+			return
+		}
+	}
+	if err = v.checkDataKey(ino); err != 0 {
+		return
+	}
 	err = v.Meta.Open(ctx, ino, flags, attr)
 	if err == 0 {
 		v.UpdateLength(ino, attr)
-		fh = v.newFileHandle(ino, attr.Length, flags)
+		fh, attr.DirectIO = v.newFileHandle(ino, attr.Length, flags)
 		entry = &meta.Entry{Inode: ino, Attr: attr}
 	}
 	return
@@ -463,6 +578,9 @@ func (v *VFS) Truncate(ctx Context, ino Ino, size int64, fh uint64, attr *Attr)
 		err = syscall.EFBIG
 		return
 	}
+	if err = v.checkReadOnly(ctx, ino); err != 0 {
+		return
+	}
 	hs := v.findAllHandles(ino)
 	sort.Slice(hs, func(i, j int) bool { return hs[i].fh < hs[j].fh })
 	for _, h := range hs {
@@ -505,6 +623,8 @@ func (v *VFS) Release(ctx Context, ino Ino, fh uint64) {
 	if IsSpecialNode(ino) {
 		if ino == logInode {
 			closeAccessLog(fh)
+		} else if ino == eventsInode {
+			closeEvents(fh)
 		}
 		v.releaseHandle(ino, fh)
 		return
@@ -523,14 +643,20 @@ func (v *VFS) Release(ctx Context, ino Ino, fh uint64) {
 			}
 			locks := f.locks
 			owner := f.flockOwner
+			shareOwner := f.shareOwner
+			f.shareOwner = 0
 			f.Unlock()
 			if f.writer != nil {
 				_ = f.writer.Flush(ctx)
 				v.invalidateLength(ino)
+				sendEvent("close_write", ino)
 			}
 			if locks&1 != 0 {
 				_ = v.Meta.Flock(ctx, ino, owner, F_UNLCK, false)
 			}
+			if shareOwner != 0 {
+				ReleaseShareMode(ctx, v.Meta, ino, shareOwner)
+			}
 		}
 		_ = v.Meta.Close(ctx, ino)
 		go v.releaseFileHandle(ino, fh) // after writes it waits for data sync, so do it after everything
@@ -542,6 +668,8 @@ func (v *VFS) Read(ctx Context, ino Ino, buf []byte, off uint64, fh uint64) (n i
 	if IsSpecialNode(ino) {
 		if ino == logInode {
 			n = readAccessLog(fh, buf)
+		} else if ino == eventsInode {
+			n = v.readEvents(fh, buf)
 		} else {
 			defer func() { logit(ctx, "read (%d,%d,%d,%d): %s (%d)", ino, size, off, fh, strerr(err), n) }()
 			if ino == controlInode && runtime.GOOS == "darwin" {
@@ -679,6 +807,9 @@ func (v *VFS) Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh
 		err = syscall.EPERM
 		return
 	}
+	if err = v.checkReadOnly(ctx, ino); err != 0 {
+		return
+	}
 	h := v.findHandle(ino, fh)
 	if h == nil {
 		err = syscall.EBADF
@@ -699,7 +830,33 @@ func (v *VFS) Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh
 	defer h.Wunlock()
 	defer h.removeOp(ctx)
 
-	err = v.Meta.Fallocate(ctx, ino, mode, uint64(off), uint64(length))
+	const (
+		fallocKeepSize  = 0x01
+		fallocPunchHole = 0x02
+		fallocZeroRange = 0x10
+	)
+	if mode&(fallocPunchHole|fallocZeroRange) == 0 {
+		err = v.Meta.Fallocate(ctx, ino, mode, uint64(off), uint64(length))
+		return
+	}
+	// buffered data must be committed before the holes, or it will show up again
+	if err = v.writer.Flush(ctx, ino); err != 0 {
+		return
+	}
+	var attr Attr
+	if err = v.Meta.GetAttr(ctx, ino, &attr); err != 0 {
+		return
+	}
+	if err = v.Meta.Fallocate(ctx, ino, mode, uint64(off), uint64(length)); err != 0 {
+		return
+	}
+	end := uint64(off + length)
+	if mode&fallocKeepSize != 0 && end > attr.Length {
+		end = attr.Length
+	}
+	if uint64(off) < end {
+		v.reader.Invalidate(ino, uint64(off), end-uint64(off))
+	}
 	return
 }
 
@@ -715,6 +872,9 @@ func (v *VFS) CopyFileRange(ctx Context, nodeIn Ino, fhIn, offIn uint64, nodeOut
 		err = syscall.EPERM
 		return
 	}
+	if err = v.checkReadOnly(ctx, nodeOut); err != 0 {
+		return
+	}
 	hi := v.findHandle(nodeIn, fhIn)
 	if fhIn == 0 || hi == nil || hi.inode != nodeIn {
 		err = syscall.EBADF
@@ -761,6 +921,12 @@ func (v *VFS) CopyFileRange(ctx Context, nodeIn Ino, fhIn, offIn uint64, nodeOut
 		defer hi.removeOp(ctx)
 	}
 
+	// the source could have buffered data too
+	if nodeIn != nodeOut {
+		if err = v.writer.Flush(ctx, nodeIn); err != 0 {
+			return
+		}
+	}
 	err = v.writer.Flush(ctx, nodeOut)
 	if err != 0 {
 		return
@@ -851,6 +1017,9 @@ func (v *VFS) SetXattr(ctx Context, ino Ino, name string, value []byte, flags ui
 		err = syscall.EPERM
 		return
 	}
+	if err = v.checkReadOnly(ctx, ino); err != 0 {
+		return
+	}
 	if len(value) > xattrMaxSize {
 		if runtime.GOOS == "darwin" {
 			err = syscall.E2BIG
@@ -871,14 +1040,106 @@ func (v *VFS) SetXattr(ctx Context, ino Ino, name string, value []byte, flags ui
 		err = syscall.EINVAL
 		return
 	}
-	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
-		err = syscall.ENOTSUP
+	if err = v.checkXattr(ctx, name, true, true); err != 0 {
 		return
 	}
+	if aclType := aclTypeOf(name); aclType != 0 {
+		if flags == meta.XattrCreate || flags == meta.XattrReplace {
+			var old meta.ACLRule
+			switch e := v.Meta.GetFacl(ctx, ino, aclType, &old); {
+			case e == 0 && flags == meta.XattrCreate:
+				return syscall.EEXIST
+			case e == meta.ENOATTR && flags == meta.XattrReplace:
+				return meta.ENOATTR
+			case e != 0 && e != meta.ENOATTR:
+				return e
+			}
+		}
+		var rule *meta.ACLRule
+		if rule, err = meta.DecodeXattr(value); err == 0 {
+			err = v.Meta.SetFacl(ctx, ino, aclType, rule)
+		}
+		return
+	}
+	if name == dataKeyXattr {
+		if err = v.setDataKey(ctx, ino, value); err != 0 {
+			return
+		}
+		defer v.dataKeys.forget(ino)
+	}
 	err = v.Meta.SetXattr(ctx, ino, name, value, flags)
 	return
 }
 
+// aclTypeOf returns the type of POSIX ACL kept in the extended attribute, 0 for others.
+func aclTypeOf(name string) uint8 {
+	switch name {
+	case "system.posix_acl_access":
+		return meta.ACLTypeAccess
+	case "system.posix_acl_default":
+		return meta.ACLTypeDefault
+	}
+	return 0
+}
+
+// CheckXattr enforces the semantics of namespaces of extended attributes: user.* is open to
+// everyone, trusted.* is only visible to privileged callers, security.* can be read by everyone
+// but security.capability can only be set by privileged callers. If strict is true, the names
+// in other namespaces (and system.* except POSIX ACLs) can't be set, it should be false for
+// reading and removing, so the existing ones are still accessible.
+func CheckXattr(ctx meta.Context, name string, write, strict bool) syscall.Errno {
+	privileged := ctx.Uid() == 0 || !ctx.CheckPermission()
+	ns, _, _ := strings.Cut(name, ".")
+	switch ns {
+	case "user":
+	case "trusted":
+		if !privileged {
+			if write {
+				return syscall.EPERM
+			}
+			return meta.ENOATTR
+		}
+	case "security":
+		if write && name == "security.capability" && !privileged {
+			return syscall.EPERM
+		}
+	case "system":
+		if strict && aclTypeOf(name) == 0 {
+			return syscall.ENOTSUP
+		}
+	default:
+		if strict {
+			return syscall.ENOTSUP
+		}
+	}
+	return 0
+}
+
+// FilterXattrs removes the names which are not accessible by the caller from the list of xattrs.
+func FilterXattrs(ctx meta.Context, names []byte) []byte {
+	return filterXattrs(names, func(name string) syscall.Errno { return CheckXattr(ctx, name, false, false) })
+}
+
+func filterXattrs(names []byte, check func(name string) syscall.Errno) []byte {
+	var filtered []byte
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name != "" && check(name) == 0 {
+			filtered = append(filtered, name+"\x00"...)
+		}
+	}
+	return filtered
+}
+
+// checkXattr is CheckXattr for FUSE, the names are checked strictly only when they are set with
+// StrictXattrs, and the names without namespace are always allowed on macOS.
+func (v *VFS) checkXattr(ctx Context, name string, write, strict bool) syscall.Errno {
+	err := CheckXattr(ctx, name, write, strict && v.Conf.StrictXattrs)
+	if err == syscall.ENOTSUP && runtime.GOOS == "darwin" && !strings.HasPrefix(name, "system.") {
+		err = 0
+	}
+	return err
+}
+
 func (v *VFS) GetXattr(ctx Context, ino Ino, name string, size uint32) (value []byte, err syscall.Errno) {
 	defer func() { logit(ctx, "getxattr (%d,%s,%d): %s (%d)", ino, name, size, strerr(err), len(value)) }()
 	if IsSpecialNode(ino) {
@@ -897,11 +1158,17 @@ func (v *VFS) GetXattr(ctx Context, ino Ino, name string, size uint32) (value []
 		err = syscall.EINVAL
 		return
 	}
-	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
-		err = syscall.ENOTSUP
+	if err = v.checkXattr(ctx, name, false, false); err != 0 {
 		return
 	}
-	err = v.Meta.GetXattr(ctx, ino, name, &value)
+	if aclType := aclTypeOf(name); aclType != 0 {
+		var rule meta.ACLRule
+		if err = v.Meta.GetFacl(ctx, ino, aclType, &rule); err == 0 {
+			value = rule.EncodeXattr()
+		}
+	} else {
+		err = v.Meta.GetXattr(ctx, ino, name, &value)
+	}
 	if size > 0 && len(value) > int(size) {
 		err = syscall.ERANGE
 	}
@@ -915,6 +1182,20 @@ func (v *VFS) ListXattr(ctx Context, ino Ino, size int) (data []byte, err syscal
 		return
 	}
 	err = v.Meta.ListXattr(ctx, ino, &data)
+	if err == 0 {
+		data = filterXattrs(data, func(name string) syscall.Errno { return v.checkXattr(ctx, name, false, false) })
+	}
+	if err == 0 && v.Conf.Format.EnableACL {
+		var attr Attr
+		if v.Meta.GetAttr(ctx, ino, &attr) == 0 {
+			if attr.AccessACL != 0 {
+				data = append(data, "system.posix_acl_access\x00"...)
+			}
+			if attr.DefaultACL != 0 {
+				data = append(data, "system.posix_acl_default\x00"...)
+			}
+		}
+	}
 	if size > 0 && len(data) > size {
 		err = syscall.ERANGE
 	}
@@ -927,8 +1208,11 @@ func (v *VFS) RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno)
 		err = syscall.EPERM
 		return
 	}
-	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
-		return syscall.ENOTSUP
+	if err = v.checkReadOnly(ctx, ino); err != 0 {
+		return
+	}
+	if aclType := aclTypeOf(name); aclType != 0 {
+		return v.Meta.SetFacl(ctx, ino, aclType, nil)
 	}
 	if len(name) > xattrMaxName {
 		if runtime.GOOS == "darwin" {
@@ -942,6 +1226,12 @@ func (v *VFS) RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno)
 		err = syscall.EINVAL
 		return
 	}
+	if err = v.checkXattr(ctx, name, true, false); err != 0 {
+		return
+	}
+	if name == dataKeyXattr {
+		defer v.dataKeys.forget(ino)
+	}
 	err = v.Meta.RemoveXattr(ctx, ino, name)
 	return
 }
@@ -953,9 +1243,12 @@ type VFS struct {
 	Meta            meta.Meta
 	Store           chunk.ChunkStore
 	InvalidateEntry func(parent meta.Ino, name string) syscall.Errno
+	InvalidateInode func(ino meta.Ino) syscall.Errno
 	UpdateFormat    func(*meta.Format)
 	reader          DataReader
 	writer          DataWriter
+	readOnly        *readOnlyPrefixes
+	dataKeys        *dataKeys
 
 	handles map[Ino][]*handle
 	hanleM  sync.Mutex
@@ -963,6 +1256,7 @@ type VFS struct {
 
 	modM       sync.Mutex
 	modifiedAt map[Ino]time.Time
+	stale      map[Ino]struct{} // opened files changed by other clients in writeback-cache mode
 
 	handlersGause  prometheus.GaugeFunc
 	usedBufferSize prometheus.GaugeFunc
@@ -981,8 +1275,11 @@ func NewVFS(conf *Config, m meta.Meta, store chunk.ChunkStore, registerer promet
 		Store:      store,
 		reader:     reader,
 		writer:     writer,
+		readOnly:   newReadOnlyPrefixes(conf, m),
+		dataKeys:   dataKeysOf(m),
 		handles:    make(map[Ino][]*handle),
 		modifiedAt: make(map[meta.Ino]time.Time),
+		stale:      make(map[meta.Ino]struct{}),
 		nextfh:     1,
 		registry:   registry,
 	}
@@ -1001,6 +1298,19 @@ func NewVFS(conf *Config, m meta.Meta, store chunk.ChunkStore, registerer promet
 		meta.TrashName = ".jfs" + meta.TrashName
 	}
 
+	m.OnMsg(meta.InvalidateInodes, func(args ...interface{}) error {
+		for _, inode := range args[0].([]Ino) {
+			v.invalidateLength(inode)
+			if v.InvalidateInode != nil {
+				if st := v.InvalidateInode(inode); st != 0 && st != syscall.ENOENT {
+					logger.Debugf("invalidate inode %d: %s", inode, st)
+				}
+			}
+			v.writebackChanged(inode)
+		}
+		return nil
+	})
+
 	go v.cleanupModified()
 	initVFSMetrics(v, writer, reader, registerer)
 	return v
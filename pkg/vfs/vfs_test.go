@@ -17,11 +17,15 @@
 package vfs
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
 	"syscall"
 	"testing"
@@ -439,6 +443,72 @@ func TestVFSXattrs(t *testing.T) {
 	}
 }
 
+func TestVFSXattrNamespaces(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, e := v.Mkdir(ctx, 1, "xattrns", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir xattrns: %s", e)
+	}
+	if e := v.SetXattr(ctx, fe.Inode, "trusted.test", []byte("v"), 0); e != 0 {
+		t.Fatalf("setxattr trusted.test: %s", e)
+	}
+	if e := v.SetXattr(ctx, fe.Inode, "security.capability", []byte("v"), 0); e != 0 {
+		t.Fatalf("setxattr security.capability: %s", e)
+	}
+	user := NewLogContext(meta.NewContext(10, 1, []uint32{2}))
+	if _, e := v.GetXattr(user, fe.Inode, "trusted.test", 0); e != meta.ENOATTR {
+		t.Fatalf("getxattr trusted.test by normal user: %s", e)
+	}
+	if e := v.SetXattr(user, fe.Inode, "trusted.test", []byte("v"), 0); e != syscall.EPERM {
+		t.Fatalf("setxattr trusted.test by normal user: %s", e)
+	}
+	if e := v.RemoveXattr(user, fe.Inode, "security.capability"); e != syscall.EPERM {
+		t.Fatalf("removexattr security.capability by normal user: %s", e)
+	}
+	if value, e := v.GetXattr(user, fe.Inode, "security.capability", 0); e != 0 || string(value) != "v" {
+		t.Fatalf("getxattr security.capability by normal user: %s %q", e, value)
+	}
+	if names, e := v.ListXattr(user, fe.Inode, 100); e != 0 || string(names) != "security.capability\x00" {
+		t.Fatalf("listxattr by normal user: %s %q", e, names)
+	}
+}
+
+func TestVFSStrictXattrs(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, e := v.Mkdir(ctx, 1, "xattrstrict", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir xattrstrict: %s", e)
+	}
+	if e := v.SetXattr(ctx, fe.Inode, "test", []byte("v"), 0); e != 0 {
+		t.Fatalf("setxattr without namespace: %s", e)
+	}
+	v.Conf.StrictXattrs = true
+	defer func() { v.Conf.StrictXattrs = false }()
+	if runtime.GOOS == "linux" {
+		if e := v.SetXattr(ctx, fe.Inode, "test2", []byte("v"), 0); e != syscall.ENOTSUP {
+			t.Fatalf("setxattr without namespace: %s", e)
+		}
+	}
+	if e := v.SetXattr(ctx, fe.Inode, "system.test", []byte("v"), 0); e != syscall.ENOTSUP {
+		t.Fatalf("setxattr system.test: %s", e)
+	}
+	if e := v.SetXattr(ctx, fe.Inode, "user.test", []byte("v"), 0); e != 0 {
+		t.Fatalf("setxattr user.test: %s", e)
+	}
+	// the existing ones are still accessible
+	if value, e := v.GetXattr(ctx, fe.Inode, "test", 0); e != 0 || string(value) != "v" {
+		t.Fatalf("getxattr without namespace: %s %q", e, value)
+	}
+	if names, e := v.ListXattr(ctx, fe.Inode, 100); e != 0 || string(names) != "test\x00user.test\x00" && string(names) != "user.test\x00test\x00" {
+		t.Fatalf("listxattr: %s %q", e, names)
+	}
+	if e := v.RemoveXattr(ctx, fe.Inode, "test"); e != 0 {
+		t.Fatalf("removexattr without namespace: %s", e)
+	}
+}
+
 type accessCase struct {
 	uid  uint32
 	gid  uint32
@@ -446,6 +516,171 @@ type accessCase struct {
 	r    syscall.Errno
 }
 
+func TestVFSACLXattrs(t *testing.T) {
+	v, _ := createTestVFS()
+	format := v.Conf.Format
+	format.EnableACL = true
+	if err := v.Meta.Init(&format, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if _, err := v.Meta.Load(true); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	v.Conf.Format.EnableACL = true
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "aclfile", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create aclfile: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+
+	rule := meta.NewACLRule(0640)
+	rule.NamedUsers = []meta.ACLEntry{{Id: 1001, Perm: 6}}
+	rule.UpdateMask()
+	value := rule.EncodeXattr()
+	if e = v.SetXattr(ctx, fe.Inode, "system.posix_acl_access", value, meta.XattrReplace); e != meta.ENOATTR {
+		t.Fatalf("replace not existed acl: %s", e)
+	}
+	if e = v.SetXattr(ctx, fe.Inode, "system.posix_acl_access", value, meta.XattrCreate); e != 0 {
+		t.Fatalf("create acl: %s", e)
+	}
+	if e = v.SetXattr(ctx, fe.Inode, "system.posix_acl_access", value, meta.XattrCreate); e != syscall.EEXIST {
+		t.Fatalf("create existed acl: %s", e)
+	}
+	if e = v.SetXattr(ctx, fe.Inode, "system.posix_acl_access", value, meta.XattrReplace); e != 0 {
+		t.Fatalf("replace acl: %s", e)
+	}
+	if got, e := v.GetXattr(ctx, fe.Inode, "system.posix_acl_access", 0); e != 0 || !bytes.Equal(got, value) {
+		t.Fatalf("getxattr acl: %s %v", e, got)
+	}
+	if names, e := v.ListXattr(ctx, fe.Inode, 0); e != 0 || !strings.Contains(string(names), "system.posix_acl_access") {
+		t.Fatalf("listxattr: %s %q", e, string(names))
+	}
+	user := NewLogContext(meta.NewContext(10, 1001, []uint32{1001}))
+	if e = v.Access(user, fe.Inode, unix.W_OK); e != 0 {
+		t.Fatalf("named user should be able to write: %s", e)
+	}
+	other := NewLogContext(meta.NewContext(10, 1002, []uint32{1002}))
+	if e = v.Access(other, fe.Inode, unix.R_OK); e != syscall.EACCES {
+		t.Fatalf("others should not be able to read: %s", e)
+	}
+	if e = v.RemoveXattr(ctx, fe.Inode, "system.posix_acl_access"); e != 0 {
+		t.Fatalf("remove acl: %s", e)
+	}
+}
+
+func TestVFSLseek(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "sparse", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create file: %s", e)
+	}
+	data := bytes.Repeat([]byte{1}, 4<<10)
+	if e = v.Write(ctx, fe.Inode, data, 4<<10, fh); e != 0 {
+		t.Fatalf("write: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, data, 2*meta.ChunkSize, fh); e != 0 {
+		t.Fatalf("write: %s", e)
+	}
+	if _, e = v.SetAttr(ctx, fe.Inode, meta.SetAttrSize, fh, 0, 0, 0, 0, 0, 0, 0, 3*meta.ChunkSize); e != 0 {
+		t.Fatalf("truncate: %s", e)
+	}
+	cases := []struct {
+		off    int64
+		whence uint32
+		expect int64
+		err    syscall.Errno
+	}{
+		{0, unix.SEEK_DATA, 4 << 10, 0},
+		{0, unix.SEEK_HOLE, 0, 0},
+		{5 << 10, unix.SEEK_DATA, 5 << 10, 0},
+		{5 << 10, unix.SEEK_HOLE, 8 << 10, 0},
+		{8 << 10, unix.SEEK_DATA, 2 * meta.ChunkSize, 0},
+		{meta.ChunkSize, unix.SEEK_HOLE, meta.ChunkSize, 0},
+		{2 * meta.ChunkSize, unix.SEEK_HOLE, 2*meta.ChunkSize + 4<<10, 0},
+		{2*meta.ChunkSize + 4<<10, unix.SEEK_DATA, 0, syscall.ENXIO},
+		{3 * meta.ChunkSize, unix.SEEK_HOLE, 0, syscall.ENXIO},
+		{0, unix.SEEK_END, 0, syscall.EINVAL},
+	}
+	for _, c := range cases {
+		off, e := v.Lseek(ctx, fe.Inode, fh, c.off, c.whence)
+		if e != c.err || e == 0 && off != c.expect {
+			t.Fatalf("lseek(%d, %d): expect %d (%s), got %d (%s)", c.off, c.whence, c.expect, c.err, off, e)
+		}
+	}
+	if _, e = v.Lseek(ctx, fe.Inode, fh+1, 0, unix.SEEK_DATA); e != syscall.EBADF {
+		t.Fatalf("lseek with bad fh: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+}
+
+func TestVFSPunchHole(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "punch", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create file: %s", e)
+	}
+	data := bytes.Repeat([]byte{1}, 8<<10)
+	if e = v.Write(ctx, fe.Inode, data, 0, fh); e != 0 {
+		t.Fatalf("write: %s", e)
+	}
+	// punch hole before the data is flushed
+	if e = v.Fallocate(ctx, fe.Inode, 0x02|0x01, 2<<10, 4<<10, fh); e != 0 {
+		t.Fatalf("punch hole: %s", e)
+	}
+	buf := make([]byte, 8<<10)
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || n != len(buf) {
+		t.Fatalf("read: %s %d", e, n)
+	}
+	expect := append(append(bytes.Repeat([]byte{1}, 2<<10), make([]byte, 4<<10)...), bytes.Repeat([]byte{1}, 2<<10)...)
+	if !bytes.Equal(buf, expect) {
+		t.Fatalf("data in the punched range should be zero")
+	}
+	if off, e := v.Lseek(ctx, fe.Inode, fh, 0, unix.SEEK_HOLE); e != 0 || off != 2<<10 {
+		t.Fatalf("seek hole: %s %d", e, off)
+	}
+	if e = v.Fallocate(ctx, fe.Inode, 0x10, 6<<10, 4<<10, fh); e != 0 {
+		t.Fatalf("zero range: %s", e)
+	}
+	var attr meta.Attr
+	if e = v.Meta.GetAttr(ctx, fe.Inode, &attr); e != 0 || attr.Length != 10<<10 {
+		t.Fatalf("length after zero range: %s %d", e, attr.Length)
+	}
+	buf = make([]byte, 10<<10)
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || n != len(buf) || !bytes.Equal(buf[2<<10:], make([]byte, 8<<10)) {
+		t.Fatalf("read after zero range: %s %d", e, n)
+	}
+	v.Release(ctx, fe.Inode, fh)
+}
+
+func TestVFSCopyFileRangeBuffered(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	src, fhIn, e := v.Create(ctx, 1, "src", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create src: %s", e)
+	}
+	dst, fhOut, e := v.Create(ctx, 1, "dst", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create dst: %s", e)
+	}
+	// the data of source is not flushed yet
+	if e = v.Write(ctx, src.Inode, []byte("hello world"), 0, fhIn); e != 0 {
+		t.Fatalf("write src: %s", e)
+	}
+	if n, e := v.CopyFileRange(ctx, src.Inode, fhIn, 6, dst.Inode, fhOut, 0, 5, 0); e != 0 || n != 5 {
+		t.Fatalf("copyfilerange: %s %d", e, n)
+	}
+	buf := make([]byte, 10)
+	if n, e := v.Read(ctx, dst.Inode, buf, 0, fhOut); e != 0 || string(buf[:n]) != "world" {
+		t.Fatalf("read dst: %s %q", e, buf[:n])
+	}
+	v.Release(ctx, src.Inode, fhIn)
+	v.Release(ctx, dst.Inode, fhOut)
+}
+
 func TestAccessMode(t *testing.T) {
 	var attr = meta.Attr{
 		Uid:  1,
@@ -492,6 +727,256 @@ func TestSetattrStr(t *testing.T) {
 	assertEqual(t, setattrStr(meta.SetAttrUID|meta.SetAttrGID, 0, 1, 2, 0, 0, 0), "uid=1,gid=2")
 }
 
+func TestVFSCachePolicy(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	de, e := v.Mkdir(ctx, 1, "scan", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir scan: %s", e)
+	}
+	if e = v.SetXattr(ctx, de.Inode, cachePolicyXattr, []byte("direct"), 0); e != 0 {
+		t.Fatalf("setxattr scan: %s", e)
+	}
+	sub, e := v.Mkdir(ctx, de.Inode, "sub", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir scan/sub: %s", e)
+	}
+	fe, fh, e := v.Create(ctx, sub.Inode, "f", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create scan/sub/f: %s", e)
+	}
+	if !fe.Attr.DirectIO {
+		t.Fatalf("file under scan/ should bypass the page cache")
+	}
+	if p := v.writer.(*dataWriter).files[fe.Inode].policy; p != chunk.CacheDirect {
+		t.Fatalf("expect cache policy direct for writer, but got %s", p)
+	}
+	v.Release(ctx, fe.Inode, fh)
+
+	if e = v.SetXattr(ctx, sub.Inode, cachePolicyXattr, []byte("pin"), 0); e != 0 {
+		t.Fatalf("setxattr scan/sub: %s", e)
+	}
+	policies := newCachePolicies(v.Conf, v.Meta)
+	if p := policies.get(fe.Inode); p != chunk.CachePin {
+		t.Fatalf("the nearest policy should be used, but got %s", p)
+	}
+	if p := policies.get(de.Inode); p != chunk.CacheDirect {
+		t.Fatalf("expect cache policy direct for scan, but got %s", p)
+	}
+	if p := policies.get(1); p != chunk.CacheNormal {
+		t.Fatalf("expect cache policy normal for root, but got %s", p)
+	}
+
+	fe, fh, e = v.Create(ctx, 1, "f", 0644, 0, syscall.O_RDWR|oDirect)
+	if e != 0 {
+		t.Fatalf("create f: %s", e)
+	}
+	if fe.Attr.DirectIO != (oDirect != 0) {
+		t.Fatalf("file opened with O_DIRECT should bypass the page cache")
+	}
+	v.Release(ctx, fe.Inode, fh)
+}
+
+func TestVFSTmpFile(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.TmpFile(ctx, 1, 0644, 022, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("tmpfile: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh); e != 0 {
+		t.Fatalf("write tmpfile: %s", e)
+	}
+	if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush tmpfile: %s", e)
+	}
+	if _, e = v.Link(ctx, fe.Inode, 1, "published"); e != 0 {
+		t.Fatalf("link tmpfile: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if entry, e := v.Lookup(ctx, 1, "published"); e != 0 || entry.Inode != fe.Inode || entry.Attr.Nlink != 1 || entry.Attr.Length != 5 {
+		t.Fatalf("lookup published: %s %+v", e, entry)
+	}
+}
+
+func TestVFSWritebackCache(t *testing.T) {
+	v, _ := createTestVFS()
+	v.Conf.WritebackCache = true
+	var dropped []string
+	v.InvalidateEntry = func(parent Ino, name string) syscall.Errno {
+		dropped = append(dropped, fmt.Sprintf("%d/%s", parent, name))
+		return 0
+	}
+	ctx := NewLogContext(meta.Background)
+	de, e := v.Mkdir(ctx, 1, "wb", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir wb: %s", e)
+	}
+	fe, fh, e := v.Create(ctx, de.Inode, "f", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create f: %s", e)
+	}
+	v.writebackChanged(fe.Inode)
+	if len(dropped) != 0 {
+		t.Fatalf("opened file should not be dropped: %v", dropped)
+	}
+	v.releaseFileHandle(fe.Inode, fh)
+	if len(dropped) != 1 || dropped[0] != fmt.Sprintf("%d/f", de.Inode) {
+		t.Fatalf("stale file should be dropped after release: %v", dropped)
+	}
+	v.writebackReleased(fe.Inode)
+	if len(dropped) != 1 {
+		t.Fatalf("file should be dropped only once: %v", dropped)
+	}
+	v.writebackChanged(fe.Inode)
+	if len(dropped) != 2 {
+		t.Fatalf("closed file should be dropped: %v", dropped)
+	}
+}
+
+func TestVFSShareMode(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "shared", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create shared: %s", e)
+	}
+	if e = v.SetShareMode(ctx, fe.Inode, fh, ShareRead, ShareWrite); e != 0 {
+		t.Fatalf("set share mode: %s", e)
+	}
+	if e = v.SetShareMode(ctx, fe.Inode, fh, ShareRead, 0); e != syscall.EINVAL {
+		t.Fatalf("set share mode twice: %s", e)
+	}
+	open := func(access, deny uint8) (uint64, syscall.Errno) {
+		_, fh, e := v.Open(ctx, fe.Inode, syscall.O_RDWR)
+		if e != 0 {
+			t.Fatalf("open shared: %s", e)
+		}
+		if e = v.SetShareMode(ctx, fe.Inode, fh, access, deny); e != 0 {
+			v.Release(ctx, fe.Inode, fh)
+		}
+		return fh, e
+	}
+	if _, e = open(ShareWrite, 0); e != syscall.EBUSY {
+		t.Fatalf("write is denied: %s", e)
+	}
+	fh2, e := open(ShareRead, 0)
+	if e != 0 {
+		t.Fatalf("read is shared: %s", e)
+	}
+	if _, e = open(0, ShareRead); e != syscall.EBUSY {
+		t.Fatalf("deny read while it's opened for read: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if _, e = open(ShareWrite, 0); e != 0 {
+		t.Fatalf("write after deny-write is closed: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh2)
+}
+
+func TestVFSDataKey(t *testing.T) {
+	v, blob := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	de, e := v.Mkdir(ctx, 1, "tenant", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir tenant: %s", e)
+	}
+	if e = v.SetXattr(ctx, de.Inode, dataKeyXattr, []byte("tenant"), 0); e != syscall.EACCES {
+		t.Fatalf("bind a key not loaded: %s", e)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tenant"), []byte("secret"), 0600); err != nil {
+		t.Fatalf("write key: %s", err)
+	}
+	conf := *v.Conf.Chunk
+	conf.DataKeyDir = dir
+	v.Store = chunk.NewCachedStore(blob, conf, nil)
+	fe, fh, e := v.Create(ctx, de.Inode, "f", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create tenant/f: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if e = v.SetXattr(ctx, fe.Inode, dataKeyXattr, []byte("tenant"), 0); e != syscall.ENOTDIR {
+		t.Fatalf("bind key to file: %s", e)
+	}
+	if e = v.SetXattr(ctx, de.Inode, dataKeyXattr, []byte("../tenant"), 0); e != syscall.EINVAL {
+		t.Fatalf("bind invalid key: %s", e)
+	}
+	if e = v.SetXattr(ctx, de.Inode, dataKeyXattr, []byte("tenant"), 0); e != 0 {
+		t.Fatalf("bind key: %s", e)
+	}
+	if id := v.dataKeys.get(fe.Inode); id != "tenant" {
+		t.Fatalf("data key of tenant/f: %q", id)
+	}
+	if e = v.Rename(ctx, de.Inode, "f", 1, "f", 0); e != syscall.EXDEV {
+		t.Fatalf("rename across keys: %s", e)
+	}
+	if _, e = v.Link(ctx, fe.Inode, 1, "f"); e != syscall.EXDEV {
+		t.Fatalf("link across keys: %s", e)
+	}
+	if e = v.Rename(ctx, de.Inode, "f", de.Inode, "g", 0); e != 0 {
+		t.Fatalf("rename in tenant: %s", e)
+	}
+	if e = v.RemoveXattr(ctx, de.Inode, dataKeyXattr); e != 0 {
+		t.Fatalf("unbind key: %s", e)
+	}
+	if id := v.dataKeys.get(fe.Inode); id != "" {
+		t.Fatalf("data key of tenant/g: %q", id)
+	}
+}
+
+func TestVFSReadOnlyPrefixes(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	ro, e := v.Mkdir(ctx, 1, "ro", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir ro: %s", e)
+	}
+	fe, fh, e := v.Create(ctx, ro.Inode, "f", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create ro/f: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if _, e = v.Mkdir(ctx, 1, "rw", 0755, 0); e != 0 {
+		t.Fatalf("mkdir rw: %s", e)
+	}
+	v.Conf.ReadOnlyPrefixes = "/ro, /missing"
+	v.readOnly = newReadOnlyPrefixes(v.Conf, v.Meta)
+
+	if _, _, e = v.Create(ctx, ro.Inode, "f2", 0644, 0, syscall.O_RDWR); e != syscall.EROFS {
+		t.Fatalf("create ro/f2: %s", e)
+	}
+	if _, _, e = v.Open(ctx, fe.Inode, syscall.O_WRONLY); e != syscall.EROFS {
+		t.Fatalf("open ro/f for write: %s", e)
+	}
+	if _, fh, e = v.Open(ctx, fe.Inode, syscall.O_RDONLY); e != 0 {
+		t.Fatalf("open ro/f for read: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if _, e = v.SetAttr(ctx, fe.Inode, meta.SetAttrMode, 0, 0600, 0, 0, 0, 0, 0, 0, 0); e != syscall.EROFS {
+		t.Fatalf("chmod ro/f: %s", e)
+	}
+	if e = v.Unlink(ctx, ro.Inode, "f"); e != syscall.EROFS {
+		t.Fatalf("unlink ro/f: %s", e)
+	}
+	if e = v.Rename(ctx, 1, "ro", 1, "ro2", 0); e != syscall.EROFS {
+		t.Fatalf("rename ro: %s", e)
+	}
+	if e = v.Rename(ctx, 1, "rw", 1, "ro", 0); e != syscall.EROFS {
+		t.Fatalf("rename rw to ro: %s", e)
+	}
+	if _, e = v.Link(ctx, fe.Inode, 1, "link"); e != 0 {
+		t.Fatalf("link ro/f into root: %s", e)
+	}
+	if e = v.Access(ctx, fe.Inode, unix.W_OK); e != syscall.EROFS {
+		t.Fatalf("access ro/f for write: %s", e)
+	}
+	if _, e = v.Mkdir(ctx, 1, "missing", 0755, 0); e != 0 {
+		t.Fatalf("mkdir missing: %s", e)
+	}
+}
+
 func TestVFSLocks(t *testing.T) {
 	v, _ := createTestVFS()
 	ctx := NewLogContext(meta.Background)
@@ -608,8 +1093,8 @@ func TestInternalFile(t *testing.T) {
 			internalFiles[string(e.Name)] = true
 		}
 	}
-	if len(internalFiles) != 3 {
-		t.Fatalf("there should be 3 internal files but got %d", len(internalFiles))
+	if len(internalFiles) != 4 {
+		t.Fatalf("there should be 4 internal files but got %d", len(internalFiles))
 	}
 	v.Releasedir(ctx, 1, fh)
 
@@ -699,6 +1184,58 @@ func TestInternalFile(t *testing.T) {
 	_ = v.Flush(ctx, fe.Inode, fh, 0)
 	v.Release(ctx, fe.Inode, fh)
 
+	// events
+	fe, e = v.Lookup(ctx, 1, ".events")
+	if e != 0 {
+		t.Fatalf("lookup .events: %s", e)
+	}
+	if _, _, e = v.Open(ctx, fe.Inode, syscall.O_WRONLY); e != syscall.EACCES {
+		t.Fatalf("write .events: %s", e)
+	}
+	efe, efh, e := v.Open(ctx, fe.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open .events: %s", e)
+	}
+	ffe, ffh, e := v.Create(ctx, 1, "evfile", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create evfile: %s", e)
+	}
+	if e = v.Write(ctx, ffe.Inode, []byte("hello"), 0, ffh); e != 0 {
+		t.Fatalf("write evfile: %s", e)
+	}
+	_ = v.Flush(ctx, ffe.Inode, ffh, 0)
+	v.Release(ctx, ffe.Inode, ffh)
+	if e = v.Unlink(ctx, 1, "evfile"); e != 0 {
+		t.Fatalf("unlink evfile: %s", e)
+	}
+	var events []WatchEvent
+	for len(events) < 3 {
+		n, e := v.Read(ctx, efe.Inode, buf, 0, efh)
+		if e != 0 || n == 0 {
+			t.Fatalf("read .events: %s (%d)", e, n)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(buf[:n])), "\n") {
+			if line == "#" {
+				t.Fatalf("expect 3 events, but got %+v", events)
+			}
+			var ev WatchEvent
+			if err := json.Unmarshal([]byte(line), &ev); err != nil {
+				t.Fatalf("invalid event %q: %s", line, err)
+			}
+			events = append(events, ev)
+		}
+	}
+	for i, typ := range []string{"create", "close_write", "delete"} {
+		if events[i].Type != typ || events[i].Inode != ffe.Inode {
+			t.Fatalf("expect %s of %d, but got %+v", typ, ffe.Inode, events[i])
+		}
+	}
+	if events[0].Path != "/evfile" {
+		t.Fatalf("invalid path of create: %+v", events[0])
+	}
+	_ = v.Flush(ctx, efe.Inode, efh, 0)
+	v.Release(ctx, efe.Inode, efh)
+
 	// control messages
 	fe, e = v.Lookup(ctx, 1, ".control")
 	if e != 0 {
@@ -93,6 +93,11 @@ func (v *VFS) Access(ctx Context, ino Ino, mask int) (err syscall.Errno) {
 			return
 		}
 	}
+	if mmask&MODE_MASK_W != 0 {
+		if err = v.checkReadOnly(ctx, ino); err != 0 {
+			return
+		}
+	}
 
 	err = v.Meta.Access(ctx, ino, uint8(mmask), nil)
 	return
@@ -155,6 +160,9 @@ func (v *VFS) SetAttr(ctx Context, ino Ino, set int, fh uint64, mode, uid, gid u
 		}
 		return
 	}
+	if err = v.checkReadOnly(ctx, ino); err != 0 {
+		return
+	}
 	err = syscall.EINVAL
 	var attr = &Attr{}
 	if set&meta.SetAttrSize != 0 {
@@ -306,6 +314,83 @@ func (v *VFS) Flock(ctx Context, ino Ino, fh uint64, owner uint64, typ uint32, b
 	return
 }
 
+// Lseek finds the next data or hole at or after off for SEEK_DATA and SEEK_HOLE,
+// based on the slice layout of the file; other whences are handled by the kernel.
+func (v *VFS) Lseek(ctx Context, ino Ino, fh uint64, off int64, whence uint32) (newOff int64, err syscall.Errno) {
+	defer func() { logit(ctx, "lseek (%d,%d,%d): %s (%d)", ino, off, whence, strerr(err), newOff) }()
+	if IsSpecialNode(ino) {
+		err = syscall.EINVAL
+		return
+	}
+	if whence != unix.SEEK_DATA && whence != unix.SEEK_HOLE {
+		err = syscall.EINVAL
+		return
+	}
+	if off < 0 {
+		err = syscall.ENXIO
+		return
+	}
+	if h := v.findHandle(ino, fh); h == nil {
+		err = syscall.EBADF
+		return
+	}
+	if err = v.writer.Flush(ctx, ino); err != 0 {
+		return
+	}
+	var attr = &Attr{}
+	if err = v.Meta.GetAttr(ctx, ino, attr); err != 0 {
+		return
+	}
+	v.UpdateLength(ino, attr)
+	length := int64(attr.Length)
+	if off >= length {
+		err = syscall.ENXIO
+		return
+	}
+
+	for indx := off / meta.ChunkSize; indx*meta.ChunkSize < length; indx++ {
+		var slices []meta.Slice
+		if err = v.Meta.Read(ctx, ino, uint32(indx), &slices); err != 0 {
+			return
+		}
+		pos := indx * meta.ChunkSize
+		for _, s := range slices {
+			end := pos + int64(s.Len)
+			if end > off && (s.Id > 0) == (whence == unix.SEEK_DATA) {
+				if pos < off {
+					pos = off
+				}
+				if pos < length {
+					newOff = pos
+				} else if whence == unix.SEEK_HOLE {
+					newOff = length
+				} else {
+					err = syscall.ENXIO
+				}
+				return
+			}
+			pos = end
+		}
+		// the rest of the chunk is a hole
+		if whence == unix.SEEK_HOLE && pos < (indx+1)*meta.ChunkSize {
+			if pos < off {
+				pos = off
+			}
+			if pos > length {
+				pos = length
+			}
+			newOff = pos
+			return
+		}
+	}
+	if whence == unix.SEEK_HOLE {
+		newOff = length // implicit hole at the end of file
+	} else {
+		err = syscall.ENXIO
+	}
+	return
+}
+
 func (v *VFS) Ioctl(ctx Context, ino Ino, cmd uint32, arg uint64, bufIn, bufOut []byte) (err syscall.Errno) {
 	const (
 		FS_IOC_GETFLAGS    = 0x80086601
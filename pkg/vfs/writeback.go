@@ -0,0 +1,89 @@
+/*
+ * JuiceFS, Copyright 2023 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// In writeback-cache mode, the kernel owns the length (and mtime) of cached regular files, and ignores
+// the ones returned by GETATTR, so the changes made by other clients can't be seen by invalidating the
+// attributes only. Instead, the entries of changed files are dropped, then the kernel evicts the inodes
+// and looks them up again with the length from meta. The files opened locally can't be evicted, so they
+// are remembered as stale and dropped after the last handle is released.
+
+func (v *VFS) writebackChanged(inode Ino) {
+	if !v.Conf.WritebackCache || v.InvalidateEntry == nil {
+		return
+	}
+	if len(v.findAllHandles(inode)) > 0 {
+		v.modM.Lock()
+		v.stale[inode] = struct{}{}
+		v.modM.Unlock()
+		return
+	}
+	v.invalidateNames(inode)
+}
+
+// writebackReleased is called after a file handle is released.
+func (v *VFS) writebackReleased(inode Ino) {
+	if !v.Conf.WritebackCache || len(v.findAllHandles(inode)) > 0 {
+		return
+	}
+	v.modM.Lock()
+	_, ok := v.stale[inode]
+	delete(v.stale, inode)
+	v.modM.Unlock()
+	if ok && v.InvalidateEntry != nil {
+		v.invalidateNames(inode)
+	}
+}
+
+// invalidateNames drops all the entries of a regular file from the kernel.
+func (v *VFS) invalidateNames(inode Ino) {
+	ctx := meta.Background
+	var attr Attr
+	if st := v.Meta.GetAttr(ctx, inode, &attr); st != 0 || attr.Typ != meta.TypeFile {
+		return
+	}
+	parents := map[Ino]int{attr.Parent: 1}
+	if attr.Parent == 0 { // hard links
+		parents = v.Meta.GetParents(ctx, inode)
+	}
+	var root Ino // the real inode of mounted root, which is known as rootID by the kernel
+	if st := v.Meta.Lookup(ctx, rootID, ".", &root, &attr, false); st != 0 {
+		root = rootID
+	}
+	for _, p := range v.Meta.GetPaths(ctx, inode) {
+		if !strings.HasPrefix(p, "/") { // outside of the mounted root
+			continue
+		}
+		name := path.Base(p)
+		for parent := range parents {
+			if parent == root {
+				parent = rootID
+			}
+			if st := v.InvalidateEntry(parent, name); st != 0 && st != syscall.ENOENT {
+				logger.Debugf("invalidate entry %d/%s: %s", parent, name, st)
+			}
+		}
+	}
+}
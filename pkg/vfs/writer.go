@@ -43,6 +43,7 @@ type FileWriter interface {
 type DataWriter interface {
 	Open(inode Ino, fleng uint64) FileWriter
 	Flush(ctx meta.Context, inode Ino) syscall.Errno
+	FlushAll(ctx meta.Context) syscall.Errno
 	GetLength(inode Ino) uint64
 	Truncate(inode Ino, length uint64)
 	UpdateMtime(inode Ino, mtime time.Time)
@@ -227,6 +228,8 @@ type fileWriter struct {
 	flushwaiting uint16
 	writewaiting uint16
 	refs         uint16
+	policy       chunk.CachePolicy
+	dataKey      string
 	chunks       map[uint32]*chunkWriter
 
 	flushcond *utils.Cond // wait for chunks==nil (flush)
@@ -263,6 +266,8 @@ func (f *fileWriter) writeChunk(ctx meta.Context, indx uint32, off uint32, data
 			notify:  utils.NewCond(&f.Mutex),
 			started: time.Now(),
 		}
+		s.writer.SetCachePolicy(f.policy)
+		s.writer.SetDataKey(f.dataKey)
 		c.slices = append(c.slices, s)
 		if len(c.slices) == 1 {
 			f.w.Lock()
@@ -429,6 +434,8 @@ type dataWriter struct {
 	bufferSize int64
 	files      map[Ino]*fileWriter
 	maxRetries uint32
+	policies   *cachePolicies
+	keys       *dataKeys
 }
 
 func NewDataWriter(conf *Config, m meta.Meta, store chunk.ChunkStore, reader DataReader) DataWriter {
@@ -441,8 +448,16 @@ func NewDataWriter(conf *Config, m meta.Meta, store chunk.ChunkStore, reader Dat
 		bufferSize: int64(conf.Chunk.BufferSize),
 		files:      make(map[Ino]*fileWriter),
 		maxRetries: uint32(conf.Meta.Retries),
+		policies:   newCachePolicies(conf, m),
+		keys:       dataKeysOf(m),
 	}
 	go w.flushAll()
+	m.OnMsg(meta.FlushWrites, func(args ...interface{}) error {
+		if st := w.FlushAll(meta.Background); st != 0 {
+			return st
+		}
+		return nil
+	})
 	return w
 }
 
@@ -477,15 +492,18 @@ func (w *dataWriter) flushAll() {
 }
 
 func (w *dataWriter) Open(inode Ino, len uint64) FileWriter {
+	policy, key := w.policies.get(inode), w.keys.get(inode)
 	w.Lock()
 	defer w.Unlock()
 	f, ok := w.files[inode]
 	if !ok {
 		f = &fileWriter{
-			w:      w,
-			inode:  inode,
-			length: len,
-			chunks: make(map[uint32]*chunkWriter),
+			w:       w,
+			inode:   inode,
+			length:  len,
+			policy:  policy,
+			dataKey: key,
+			chunks:  make(map[uint32]*chunkWriter),
 		}
 		f.flushcond = utils.NewCond(f)
 		f.writecond = utils.NewCond(f)
@@ -518,6 +536,26 @@ func (w *dataWriter) Flush(ctx meta.Context, inode Ino) syscall.Errno {
 	return 0
 }
 
+// FlushAll flushes the buffered data of all the opened files.
+func (w *dataWriter) FlushAll(ctx meta.Context) syscall.Errno {
+	w.Lock()
+	files := make([]*fileWriter, 0, len(w.files))
+	for _, f := range w.files {
+		f.refs++
+		files = append(files, f)
+	}
+	w.Unlock()
+	var err syscall.Errno
+	for _, f := range files {
+		if st := f.Flush(ctx); st != 0 {
+			logger.Warnf("Flush inode %d: %s", f.inode, st)
+			err = st
+		}
+		w.free(f)
+	}
+	return err
+}
+
 func (w *dataWriter) GetLength(inode Ino) uint64 {
 	f := w.find(inode)
 	if f != nil {
@@ -23,8 +23,6 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"runtime"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -58,6 +56,7 @@ type juice struct {
 
 	asRoot     bool
 	delayClose int
+	shareDeny  uint8 // denied modes of the files opened for writing, enforced across clients
 }
 
 // Init is called when the file system is created.
@@ -187,6 +186,16 @@ func (j *juice) Rename(oldpath string, newpath string) (e int) {
 	return
 }
 
+// Getpath returns the path with the names stored in JuiceFS, which is called only for
+// case-insensitive mounts to report the correct case of a file path.
+func (j *juice) Getpath(p string, fh uint64) (e int, realpath string) {
+	ctx := j.newContext()
+	defer trace(p, fh)(&e, &realpath)
+	realpath, err := j.fs.CanonicalPath(ctx, p)
+	e = errorconv(err)
+	return
+}
+
 // Chmod changes the permission bits of a file.
 func (j *juice) Chmod(path string, mode uint32) (e int) {
 	ctx := j.newContext()
@@ -209,16 +218,35 @@ func (j *juice) Chown(path string, uid uint32, gid uint32) (e int) {
 		e = errorconv(err)
 		return
 	}
-	if runtime.GOOS == "windows" {
-		// FIXME: don't change ownership in windows
-		return 0
-	}
+	// WinFsp maps the owner and group in security descriptors to uid and gid, and calls
+	// chown when they are changed by Windows applications
 	info, _ := f.Stat()
+	oldUid, oldGid := uint32(info.(*fs.FileStat).Uid()), uint32(info.(*fs.FileStat).Gid())
 	if uid == 0xffffffff {
-		uid = uint32(info.(*fs.FileStat).Uid())
+		uid = oldUid
+	} else if uid == systemID {
+		uid = 0
 	}
 	if gid == 0xffffffff {
-		gid = uint32(info.(*fs.FileStat).Gid())
+		gid = oldGid
+	} else if gid == systemID {
+		gid = 0
+	}
+	// the ACEs of Windows are bound to the users rather than the owner, so the named entries of
+	// the access ACL are mapped before the ownership is changed (which may drop the permission)
+	var rule meta.ACLRule
+	if err = j.fs.GetFacl(ctx, path, meta.ACLTypeAccess, &rule); err == 0 {
+		if r := rule.ChangeOwner(oldUid, uid, oldGid, gid); r != nil {
+			if err = j.fs.SetFacl(ctx, path, meta.ACLTypeAccess, r); err != 0 {
+				e = errorconv(err)
+				return
+			}
+			if err = f.Chown(ctx, uid, gid); err != 0 {
+				_ = j.fs.SetFacl(ctx, path, meta.ACLTypeAccess, &rule)
+			}
+			e = errorconv(err)
+			return
+		}
 	}
 	e = errorconv(f.Chown(ctx, uid, gid))
 	return
@@ -248,6 +276,9 @@ func (j *juice) Create(p string, flags int, mode uint32) (e int, fh uint64) {
 		return
 	}
 	entry, fh, errno := j.vfs.Create(ctx, parent.Inode(), path.Base(p), uint16(mode), 0, uint32(flags))
+	if errno == 0 {
+		errno = j.setShareMode(ctx, entry.Inode, fh, flags)
+	}
 	if errno == 0 {
 		j.Lock()
 		j.handlers[fh] = entry.Inode
@@ -278,9 +309,12 @@ func (j *juice) OpenEx(path string, fi *fuse.FileInfo_t) (e int) {
 		return
 	}
 	entry, fh, errno := j.vfs.Open(ctx, f.Inode(), uint32(fi.Flags))
+	if errno == 0 {
+		errno = j.setShareMode(ctx, f.Inode(), fh, fi.Flags)
+	}
 	if errno == 0 {
 		fi.Fh = fh
-		if vfs.IsSpecialNode(f.Inode()) {
+		if vfs.IsSpecialNode(f.Inode()) || entry.Attr.DirectIO {
 			fi.DirectIo = true
 		} else {
 			fi.KeepCache = entry.Attr.KeepCache
@@ -293,19 +327,52 @@ func (j *juice) OpenEx(path string, fi *fuse.FileInfo_t) (e int) {
 	return
 }
 
+// setShareMode sets the share mode of an opened file, which is released together with the file. The
+// share access is not passed to FUSE by WinFsp, so the files opened for writing deny the modes in
+// shareDeny, which is checked by all the opens in all clients. The file is released if it fails.
+func (j *juice) setShareMode(ctx vfs.LogContext, ino meta.Ino, fh uint64, flags int) syscall.Errno {
+	if j.shareDeny == 0 || vfs.IsSpecialNode(ino) {
+		return 0
+	}
+	var access, deny uint8
+	switch flags & fuse.O_ACCMODE {
+	case fuse.O_RDONLY:
+		access = vfs.ShareRead
+	case fuse.O_WRONLY:
+		access, deny = vfs.ShareWrite, j.shareDeny
+	default:
+		access, deny = vfs.ShareRead|vfs.ShareWrite, j.shareDeny
+	}
+	errno := j.vfs.SetShareMode(ctx, ino, fh, access, deny)
+	if errno != 0 {
+		j.vfs.Release(ctx, ino, fh)
+	}
+	return errno
+}
+
+// systemID is mapped to the SID of SYSTEM (S-1-5-18) by WinFsp, which is the counterpart of root.
+const systemID = 18
+
+// attrToStat fills the stat, from which WinFsp builds the security descriptor for Windows, where the
+// owner, group and everyone get the permissions of mode bits (with the mask of POSIX ACLs as group).
 func attrToStat(inode Ino, attr *meta.Attr, stat *fuse.Stat_t) {
 	stat.Ino = uint64(inode)
 	stat.Mode = attr.SMode()
 	stat.Uid = attr.Uid
 	if stat.Uid == 0 {
-		stat.Uid = 18 // System
+		stat.Uid = systemID
 	}
 	stat.Gid = attr.Gid
 	if stat.Gid == 0 {
-		stat.Gid = 18 // System
+		stat.Gid = systemID
+	}
+	if attr.Btime > 0 {
+		stat.Birthtim.Sec = attr.Btime
+		stat.Birthtim.Nsec = int64(attr.Btimensec)
+	} else {
+		stat.Birthtim.Sec = attr.Atime
+		stat.Birthtim.Nsec = int64(attr.Atimensec)
 	}
-	stat.Birthtim.Sec = attr.Atime
-	stat.Birthtim.Nsec = int64(attr.Atimensec)
 	stat.Atim.Sec = attr.Atime
 	stat.Atim.Nsec = int64(attr.Atimensec)
 	stat.Mtim.Sec = attr.Mtime
@@ -519,40 +586,46 @@ func (j *juice) Readdir(path string,
 		return
 	}
 	ctx := j.newContext()
-	entries, readAt, err := j.vfs.Readdir(ctx, ino, 100000, int(ofst), fh, true)
-	if err != 0 {
-		e = -int(err)
-		return
-	}
 	var st fuse.Stat_t
-	var ok bool
-	var full = true
-	// all the entries should have same format
-	for _, e := range entries {
-		if !e.Attr.Full {
-			full = false
-			break
+	// the entries are filled without offset, so all of them should be filled in one call
+	for off := int(ofst); ; {
+		entries, readAt, err := j.vfs.Readdir(ctx, ino, 100000, off, fh, true)
+		if err != 0 {
+			e = -int(err)
+			return
 		}
-	}
-	for _, e := range entries {
-		name := string(e.Name)
-		if full {
-			if j.vfs.ModifiedSince(e.Inode, readAt) {
-				if e2, err := j.vfs.GetAttr(ctx, e.Inode, 0); err == 0 {
-					e.Attr = e2.Attr
-				}
+		if len(entries) == 0 {
+			return
+		}
+		var ok bool
+		var full = true
+		// all the entries should have same format
+		for _, entry := range entries {
+			if !entry.Attr.Full {
+				full = false
+				break
 			}
-			j.vfs.UpdateLength(e.Inode, e.Attr)
-			attrToStat(e.Inode, e.Attr, &st)
-			ok = fill(name, &st, 0)
-		} else {
-			ok = fill(name, nil, 0)
 		}
-		if !ok {
-			break
+		for _, entry := range entries {
+			name := string(entry.Name)
+			if full {
+				if j.vfs.ModifiedSince(entry.Inode, readAt) {
+					if e2, err := j.vfs.GetAttr(ctx, entry.Inode, 0); err == 0 {
+						entry.Attr = e2.Attr
+					}
+				}
+				j.vfs.UpdateLength(entry.Inode, entry.Attr)
+				attrToStat(entry.Inode, entry.Attr, &st)
+				ok = fill(name, &st, 0)
+			} else {
+				ok = fill(name, nil, 0)
+			}
+			if !ok {
+				return
+			}
 		}
+		off += len(entries)
 	}
-	return
 }
 
 // Releasedir closes an open directory.
@@ -570,7 +643,7 @@ func (j *juice) Releasedir(path string, fh uint64) (e int) {
 	return
 }
 
-func Serve(v *vfs.VFS, fuseOpt string, fileCacheTo float64, asRoot bool, delayClose int) {
+func Serve(v *vfs.VFS, fuseOpt string, fileCacheTo float64, asRoot bool, delayClose int, shareDeny uint8) {
 	var jfs juice
 	conf := v.Conf
 	jfs.conf = conf
@@ -582,6 +655,7 @@ func Serve(v *vfs.VFS, fuseOpt string, fileCacheTo float64, asRoot bool, delayCl
 	}
 	jfs.asRoot = asRoot
 	jfs.delayClose = delayClose
+	jfs.shareDeny = shareDeny
 	host := fuse.NewFileSystemHost(&jfs)
 	jfs.host = host
 	var options = "volname=" + conf.Format.Name
@@ -595,7 +669,7 @@ func Serve(v *vfs.VFS, fuseOpt string, fileCacheTo float64, asRoot bool, delayCl
 	if fuseOpt != "" {
 		options += "," + fuseOpt
 	}
-	host.SetCapCaseInsensitive(strings.HasSuffix(conf.Meta.MountPoint, ":"))
+	host.SetCapCaseInsensitive(conf.CaseInsensitive)
 	host.SetCapReaddirPlus(true)
 	logger.Debugf("mount point: %s, options: %s", conf.Meta.MountPoint, options)
 	_ = host.Mount(conf.Meta.MountPoint, []string{"-o", options})
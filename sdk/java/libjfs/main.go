@@ -65,6 +65,10 @@ var (
 	openFiles  = make(map[int]*fwrapper)
 	nextHandle = 1
 
+	watchLock sync.Mutex
+	watchers  = make(map[int]*wwrapper)
+	nextWatch = 1
+
 	fslock   sync.Mutex
 	handlers = make(map[uintptr]*wrapper)
 	activefs = make(map[string][]*wrapper)
@@ -90,6 +94,7 @@ const (
 	ENOTEMPTY = -0x27
 	ENODATA   = -0x3d
 	ENOTSUP   = -0x5f
+	ERANGE    = -0x22
 )
 
 func errno(err error) int {
@@ -133,6 +138,8 @@ func errno(err error) int {
 		return ENODATA
 	case syscall.ENOTSUP:
 		return ENOTSUP
+	case syscall.ERANGE:
+		return ERANGE
 	default:
 		logger.Warnf("unknown errno %d: %s", eno, err)
 		return -int(eno)
@@ -283,6 +290,9 @@ type javaConf struct {
 	FreeSpace         string  `json:"freeSpace"`
 	AutoCreate        bool    `json:"autoCreate"`
 	CacheFullBlock    bool    `json:"cacheFullBlock"`
+	CacheRanges       bool    `json:"cacheRanges"`
+	EncryptCache      bool    `json:"encryptCache"`
+	DataKeyDir        string  `json:"dataKeyDir"`
 	CacheChecksum     string  `json:"cacheChecksum"`
 	CacheEviction     string  `json:"cacheEviction"`
 	CacheScanInterval int     `json:"cacheScanInterval"`
@@ -292,19 +302,26 @@ type javaConf struct {
 	Readahead         int     `json:"readahead"`
 	UploadLimit       int     `json:"uploadLimit"`
 	DownloadLimit     int     `json:"downloadLimit"`
+	UploadSchedule    string  `json:"uploadLimitSchedule"`
+	DownloadSchedule  string  `json:"downloadLimitSchedule"`
 	MaxUploads        int     `json:"maxUploads"`
+	MaxDownloads      int     `json:"maxDownloads"`
 	MaxDeletes        int     `json:"maxDeletes"`
 	SkipDirNlink      int     `json:"skipDirNlink"`
 	IORetries         int     `json:"ioRetries"`
 	GetTimeout        int     `json:"getTimeout"`
 	PutTimeout        int     `json:"putTimeout"`
 	FastResolve       bool    `json:"fastResolve"`
+	StrictXattrs      bool    `json:"strictXattrs"`
 	AttrTimeout       float64 `json:"attrTimeout"`
 	EntryTimeout      float64 `json:"entryTimeout"`
 	DirEntryTimeout   float64 `json:"dirEntryTimeout"`
 	Debug             bool    `json:"debug"`
 	NoUsageReport     bool    `json:"noUsageReport"`
 	AccessLog         string  `json:"accessLog"`
+	AccessLogFormat   string  `json:"accessLogFormat"`
+	AccessLogSample   float64 `json:"accessLogSample"`
+	AccessLogRotate   int64   `json:"accessLogRotate"`
 	PushGateway       string  `json:"pushGateway"`
 	PushInterval      int     `json:"pushInterval"`
 	PushAuth          string  `json:"pushAuth"`
@@ -494,19 +511,26 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 		chunkConf := chunk.Config{
 			BlockSize:         format.BlockSize * 1024,
 			Compress:          format.Compression,
+			CompressLevel:     format.CompressLevel,
+			CompressDict:      format.CompressDict,
 			CacheDir:          jConf.CacheDir,
 			CacheMode:         0644, // all user can read cache
 			CacheSize:         jConf.CacheSize,
 			FreeSpace:         float32(freeSpaceRatio),
 			AutoCreate:        jConf.AutoCreate,
 			CacheFullBlock:    jConf.CacheFullBlock,
+			CacheRanges:       jConf.CacheRanges,
+			DataKeyDir:        jConf.DataKeyDir,
 			CacheChecksum:     jConf.CacheChecksum,
 			CacheEviction:     jConf.CacheEviction,
 			CacheScanInterval: time.Second * time.Duration(jConf.CacheScanInterval),
 			MaxUpload:         jConf.MaxUploads,
+			MaxDownload:       jConf.MaxDownloads,
 			MaxRetries:        jConf.IORetries,
 			UploadLimit:       int64(jConf.UploadLimit) * 1e6 / 8,
 			DownloadLimit:     int64(jConf.DownloadLimit) * 1e6 / 8,
+			UploadSchedule:    jConf.UploadSchedule,
+			DownloadSchedule:  jConf.DownloadSchedule,
 			Prefetch:          jConf.Prefetch,
 			Writeback:         jConf.Writeback,
 			HashPrefix:        format.HashPrefix,
@@ -521,8 +545,24 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 		if chunkConf.DownloadLimit == 0 {
 			chunkConf.DownloadLimit = format.DownloadLimit * 1e6 / 8
 		}
+		if jConf.EncryptCache {
+			if chunkConf.CacheKey, err = cmd.NewCacheKey(format); err != nil {
+				logger.Errorf("encrypt cache: %s", err)
+				return nil
+			}
+		}
 		chunkConf.SelfCheck(format.UUID)
-		store := chunk.NewCachedStore(blob, chunkConf, registerer)
+		var storage = blob
+		if format.PackSize > 0 || format.Packed {
+			storage = chunk.NewPackStorage(storage, m, format.PackSize)
+		}
+		if format.Dedupe {
+			storage = chunk.NewDedupeStorage(storage, m)
+		}
+		if format.InlineSize > 0 || format.Inlined {
+			storage = chunk.NewInlineStorage(storage, m, format.InlineSize)
+		}
+		store := chunk.NewCachedStore(storage, chunkConf, registerer)
 		m.OnMsg(meta.DeleteSlice, func(args ...interface{}) error {
 			id := args[0].(uint64)
 			length := args[1].(uint32)
@@ -531,7 +571,8 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 		m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
 			slices := args[0].([]meta.Slice)
 			id := args[1].(uint64)
-			return vfs.Compact(chunkConf, store, slices, id)
+			inode := args[2].(meta.Ino)
+			return vfs.CompactFile(chunkConf, store, m, inode, slices, id)
 		})
 		err = m.NewSession()
 		if err != nil {
@@ -556,7 +597,11 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			EntryTimeout:    time.Millisecond * time.Duration(jConf.EntryTimeout*1000),
 			DirEntryTimeout: time.Millisecond * time.Duration(jConf.DirEntryTimeout*1000),
 			AccessLog:       jConf.AccessLog,
+			AccessLogFormat: jConf.AccessLogFormat,
+			AccessLogSample: jConf.AccessLogSample,
+			AccessLogRotate: jConf.AccessLogRotate,
 			FastResolve:     jConf.FastResolve,
+			StrictXattrs:    jConf.StrictXattrs,
 			BackupMeta:      time.Second * time.Duration(jConf.BackupMeta),
 		}
 		if !jConf.ReadOnly && !jConf.NoBGJob && conf.BackupMeta > 0 {
@@ -581,6 +626,19 @@ func F(p uintptr) *wrapper {
 	return handlers[p]
 }
 
+//export jfs_update_cache
+func jfs_update_cache(h uintptr, dirs *C.char, size int64) int {
+	w := F(h)
+	if w == nil {
+		return EINVAL
+	}
+	if err := w.UpdateCache(C.GoString(dirs), size); err != nil {
+		logger.Errorf("update cache: %s", err)
+		return EINVAL
+	}
+	return 0
+}
+
 //export jfs_update_uid_grouping
 func jfs_update_uid_grouping(h uintptr, uidstr *C.char, grouping *C.char) {
 	w := F(h)
@@ -781,12 +839,12 @@ func jfs_rmr(pid int, h uintptr, cpath *C.char) int {
 }
 
 //export jfs_rename
-func jfs_rename(pid int, h uintptr, oldpath *C.char, newpath *C.char) int {
+func jfs_rename(pid int, h uintptr, oldpath *C.char, newpath *C.char, flags uint32) int {
 	w := F(h)
 	if w == nil {
 		return EINVAL
 	}
-	return errno(w.Rename(w.withPid(pid), C.GoString(oldpath), C.GoString(newpath), meta.RenameNoReplace))
+	return errno(w.Rename(w.withPid(pid), C.GoString(oldpath), C.GoString(newpath), flags))
 }
 
 //export jfs_truncate
@@ -857,6 +915,122 @@ func jfs_removeXattr(pid int, h uintptr, path *C.char, name *C.char) int {
 	return errno(w.RemoveXattr(w.withPid(pid), C.GoString(path), C.GoString(name)))
 }
 
+func aclPerm(perm uint16) string {
+	b := []byte("---")
+	for i, c := range "rwx" {
+		if perm&(4>>i) != 0 {
+			b[i] = byte(c)
+		}
+	}
+	return string(b)
+}
+
+// aclSpec formats the rule as ACL spec of Hadoop, such as "user::rwx,user:bob:r-x,group::r-x,mask::r-x,other::r--".
+func (w *wrapper) aclSpec(rule *meta.ACLRule, prefix string) string {
+	entries := []string{prefix + "user::" + aclPerm(rule.Owner)}
+	for _, e := range rule.NamedUsers {
+		entries = append(entries, prefix+"user:"+w.uid2name(e.Id)+":"+aclPerm(e.Perm))
+	}
+	entries = append(entries, prefix+"group::"+aclPerm(rule.Group))
+	for _, e := range rule.NamedGroups {
+		entries = append(entries, prefix+"group:"+w.gid2name(e.Id)+":"+aclPerm(e.Perm))
+	}
+	if rule.HasMask() {
+		entries = append(entries, prefix+"mask::"+aclPerm(rule.Mask))
+	}
+	entries = append(entries, prefix+"other::"+aclPerm(rule.Other))
+	return strings.Join(entries, ",")
+}
+
+// parseACLSpec updates the rule with the entries in ACL spec, the named entries are replaced.
+func (w *wrapper) parseACLSpec(spec string, rule *meta.ACLRule) syscall.Errno {
+	rule.NamedUsers, rule.NamedGroups = nil, nil
+	for _, entry := range strings.Split(spec, ",") {
+		ps := strings.Split(strings.TrimPrefix(entry, "default:"), ":")
+		if len(ps) != 3 || len(ps[2]) != 3 {
+			return syscall.EINVAL
+		}
+		var perm uint16
+		for i, c := range ps[2] {
+			if c == rune("rwx"[i]) {
+				perm |= 4 >> i
+			} else if c != '-' {
+				return syscall.EINVAL
+			}
+		}
+		switch {
+		case ps[0] == "user" && ps[1] == "":
+			rule.Owner = perm
+		case ps[0] == "user":
+			rule.NamedUsers = append(rule.NamedUsers, meta.ACLEntry{Id: w.lookupUid(ps[1]), Perm: perm})
+		case ps[0] == "group" && ps[1] == "":
+			rule.Group = perm
+		case ps[0] == "group":
+			rule.NamedGroups = append(rule.NamedGroups, meta.ACLEntry{Id: w.lookupGid(ps[1]), Perm: perm})
+		case ps[0] == "mask" && ps[1] == "":
+			rule.Mask = perm
+		case ps[0] == "other" && ps[1] == "":
+			rule.Other = perm
+		default:
+			return syscall.EINVAL
+		}
+	}
+	rule.UpdateMask()
+	return 0
+}
+
+//export jfs_getfacl
+func jfs_getfacl(pid int, h uintptr, path *C.char, acltype int, buf uintptr, bufsize int) int {
+	w := F(h)
+	if w == nil {
+		return EINVAL
+	}
+	var rule meta.ACLRule
+	err := w.GetFacl(w.withPid(pid), C.GoString(path), uint8(acltype), &rule)
+	if err != 0 {
+		return errno(err)
+	}
+	var prefix string
+	if acltype == meta.ACLTypeDefault {
+		prefix = "default:"
+	}
+	spec := w.aclSpec(&rule, prefix)
+	if len(spec) >= bufsize {
+		return bufsize
+	}
+	copy(toBuf(buf, bufsize), spec)
+	return len(spec)
+}
+
+//export jfs_setfacl
+func jfs_setfacl(pid int, h uintptr, path *C.char, acltype int, spec *C.char) int {
+	w := F(h)
+	if w == nil {
+		return EINVAL
+	}
+	ctx := w.withPid(pid)
+	p := C.GoString(path)
+	s := C.GoString(spec)
+	if s == "" {
+		return errno(w.SetFacl(ctx, p, uint8(acltype), nil))
+	}
+	// the entries missing in spec are kept
+	var rule meta.ACLRule
+	if err := w.GetFacl(ctx, p, uint8(acltype), &rule); err == meta.ENOATTR {
+		fi, err := w.Stat(ctx, p)
+		if err != 0 {
+			return errno(err)
+		}
+		rule = *meta.NewACLRule(uint16(fi.Mode().Perm()))
+	} else if err != 0 {
+		return errno(err)
+	}
+	if err := w.parseACLSpec(s, &rule); err != 0 {
+		return errno(err)
+	}
+	return errno(w.SetFacl(ctx, p, uint8(acltype), &rule))
+}
+
 //export jfs_symlink
 func jfs_symlink(pid int, h uintptr, target *C.char, link *C.char) int {
 	w := F(h)
@@ -885,19 +1059,20 @@ func jfs_readlink(pid int, h uintptr, link *C.char, buf uintptr, bufsize int) in
 	return len(target)
 }
 
-// mode:4 length:8 mtime:8 atime:8 user:50 group:50
+// mode:4 length:8 mtime:8 atime:8 btime:8 user:50 group:50
 func fill_stat(w *wrapper, wb *utils.Buffer, st *fs.FileStat) int {
 	wb.Put32(uint32(st.Mode()))
 	wb.Put64(uint64(st.Size()))
 	wb.Put64(uint64(st.Mtime()))
 	wb.Put64(uint64(st.Atime()))
+	wb.Put64(uint64(st.Btime()))
 	user := w.uid2name(uint32(st.Uid()))
 	wb.Put([]byte(user))
 	wb.Put8(0)
 	group := w.gid2name(uint32(st.Gid()))
 	wb.Put([]byte(group))
 	wb.Put8(0)
-	return 30 + len(user) + len(group)
+	return 38 + len(user) + len(group)
 }
 
 //export jfs_stat1
@@ -910,7 +1085,7 @@ func jfs_stat1(pid int, h uintptr, cpath *C.char, buf uintptr) int {
 	if err != 0 {
 		return errno(err)
 	}
-	return fill_stat(w, utils.NewNativeBuffer(toBuf(buf, 130)), info)
+	return fill_stat(w, utils.NewNativeBuffer(toBuf(buf, 138)), info)
 }
 
 //export jfs_lstat1
@@ -923,7 +1098,7 @@ func jfs_lstat1(pid int, h uintptr, cpath *C.char, buf uintptr) int {
 	if err != 0 {
 		return errno(err)
 	}
-	return fill_stat(w, utils.NewNativeBuffer(toBuf(buf, 130)), fi)
+	return fill_stat(w, utils.NewNativeBuffer(toBuf(buf, 138)), fi)
 }
 
 //export jfs_summary
@@ -1057,7 +1232,7 @@ func jfs_listdir(pid int, h uintptr, cpath *C.char, offset int, buf uintptr, buf
 
 	wb := utils.NewNativeBuffer(toBuf(buf, bufsize))
 	for i, d := range es {
-		if wb.Left() < 1+len(d.Name)+1+130+8 {
+		if wb.Left() < 1+len(d.Name)+1+138+8 {
 			wb.Put32(uint32(len(es) - i))
 			wb.Put32(uint32(nextFileHandle(f, w)))
 			return bufsize - wb.Left() - 8
@@ -1075,6 +1250,124 @@ func toBuf(s uintptr, sz int) []byte {
 	return (*[1 << 30]byte)(unsafe.Pointer(s))[:sz:sz]
 }
 
+type wwrapper struct {
+	*meta.Watcher
+	w       *wrapper
+	dropped uint64
+	pending *meta.Event
+}
+
+//export jfs_watch
+func jfs_watch(pid int, h uintptr, cpath *C.char, size int) int {
+	w := F(h)
+	if w == nil {
+		return EINVAL
+	}
+	ctx := w.withPid(pid)
+	fi, err := w.Stat(ctx, C.GoString(cpath))
+	if err != 0 {
+		return errno(err)
+	}
+	watcher, err := w.Meta().Watch(ctx, fi.Inode(), size)
+	if err != 0 {
+		return errno(err)
+	}
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	for i := nextWatch; ; i++ {
+		if _, ok := watchers[i]; !ok {
+			watchers[i] = &wwrapper{Watcher: watcher, w: w}
+			nextWatch = i + 1
+			return i
+		}
+	}
+}
+
+// jfs_watch_read waits for the events up to timeout (in milliseconds), and fills as many as possible into buf:
+// type (0 for overflow) | time | inode | path length | path | new path length | new path
+//
+//export jfs_watch_read
+func jfs_watch_read(pid int, wid int, timeout int, buf uintptr, bufsize int) int {
+	watchLock.Lock()
+	ww := watchers[wid]
+	watchLock.Unlock()
+	if ww == nil {
+		return EINVAL
+	}
+	ctx := ww.w.withPid(pid)
+	wb := utils.NewNativeBuffer(toBuf(buf, bufsize))
+	put := func(e *meta.Event) bool {
+		var p, np string
+		if e.Type > 0 {
+			p, np = meta.EventPaths(ctx, ww.w.Meta(), e)
+		}
+		if wb.Left() < 1+8+8+2+len(p)+2+len(np) {
+			return false
+		}
+		wb.Put8(uint8(e.Type))
+		wb.Put64(uint64(e.Time))
+		wb.Put64(uint64(e.Inode))
+		wb.Put16(uint16(len(p)))
+		wb.Put([]byte(p))
+		wb.Put16(uint16(len(np)))
+		wb.Put([]byte(np))
+		return true
+	}
+	if d := ww.Dropped(); d > ww.dropped {
+		ww.dropped = d
+		if !put(&meta.Event{Time: time.Now().UnixNano()}) {
+			return ERANGE
+		}
+	}
+	if ww.pending != nil {
+		if !put(ww.pending) {
+			return ERANGE
+		}
+		ww.pending = nil
+	}
+	timer := time.NewTimer(time.Millisecond * time.Duration(timeout))
+	defer timer.Stop()
+	for {
+		var e *meta.Event
+		if wb.Left() == bufsize {
+			select {
+			case e = <-ww.Events():
+			case <-timer.C:
+				return 0
+			}
+		} else {
+			select {
+			case e = <-ww.Events():
+			default:
+				return bufsize - wb.Left()
+			}
+		}
+		if e == nil {
+			return EINVAL // closed
+		}
+		if !put(e) {
+			if wb.Left() == bufsize {
+				return ERANGE
+			}
+			ww.pending = e
+			return bufsize - wb.Left()
+		}
+	}
+}
+
+//export jfs_watch_close
+func jfs_watch_close(wid int) int {
+	watchLock.Lock()
+	ww := watchers[wid]
+	delete(watchers, wid)
+	watchLock.Unlock()
+	if ww == nil {
+		return EINVAL
+	}
+	ww.Close()
+	return 0
+}
+
 //export jfs_concat
 func jfs_concat(pid int, h uintptr, _dst *C.char, buf uintptr, bufsize int) int {
 	w := F(h)
@@ -131,6 +131,14 @@ public class JuiceFileSystem extends FilterFileSystem {
     return fs.getContentSummary(f);
   }
 
+  public JuiceFileSystemImpl.Watcher watch(Path f, int size) throws IOException {
+    return ((JuiceFileSystemImpl) fs).watch(f, size);
+  }
+
+  public void exchange(Path src, Path dst) throws IOException {
+    ((JuiceFileSystemImpl) fs).exchange(src, dst);
+  }
+
   public boolean isFileClosed(final Path src) throws IOException {
     FileStatus st = fs.getFileStatus(src);
     return st.getLen() > 0;
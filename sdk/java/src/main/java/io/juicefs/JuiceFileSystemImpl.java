@@ -34,6 +34,10 @@ import org.apache.hadoop.classification.InterfaceStability;
 import org.apache.hadoop.conf.Configuration;
 import org.apache.hadoop.fs.FileSystem;
 import org.apache.hadoop.fs.*;
+import org.apache.hadoop.fs.permission.AclEntry;
+import org.apache.hadoop.fs.permission.AclEntryScope;
+import org.apache.hadoop.fs.permission.AclEntryType;
+import org.apache.hadoop.fs.permission.AclStatus;
 import org.apache.hadoop.fs.permission.FsAction;
 import org.apache.hadoop.fs.permission.FsPermission;
 import org.apache.hadoop.io.DataOutputBuffer;
@@ -57,6 +61,7 @@ import java.net.*;
 import java.nio.ByteBuffer;
 import java.nio.ByteOrder;
 import java.nio.charset.Charset;
+import java.nio.charset.StandardCharsets;
 import java.nio.file.Files;
 import java.nio.file.Paths;
 import java.nio.file.StandardCopyOption;
@@ -120,6 +125,8 @@ public class JuiceFileSystemImpl extends FileSystem {
 
     void jfs_update_uid_grouping(long h, String uidstr, String grouping);
 
+    int jfs_update_cache(long h, String dirs, long size);
+
     int jfs_term(long pid, long h);
 
     int jfs_open(long pid, long h, String path, @Out ByteBuffer fileLen, int flags);
@@ -148,7 +155,7 @@ public class JuiceFileSystemImpl extends FileSystem {
 
     int jfs_mkdir(long pid, long h, String path, short mode);
 
-    int jfs_rename(long pid, long h, String src, String dst);
+    int jfs_rename(long pid, long h, String src, String dst, int flags);
 
     int jfs_stat1(long pid, long h, String path, Pointer buf);
 
@@ -176,6 +183,16 @@ public class JuiceFileSystemImpl extends FileSystem {
 
     int jfs_removeXattr(long pid, long h, String path, String name);
 
+    int jfs_getfacl(long pid, long h, String path, int acltype, Pointer buf, int size);
+
+    int jfs_setfacl(long pid, long h, String path, int acltype, String spec);
+
+    int jfs_watch(long pid, long h, String path, int size);
+
+    int jfs_watch_read(long pid, int wid, int timeout, Pointer buf, int size);
+
+    int jfs_watch_close(int wid);
+
     void jfs_set_callback(LogCallBack callBack);
 
     interface LogCallBack {
@@ -237,6 +254,13 @@ public class JuiceFileSystemImpl extends FileSystem {
   static int ENODATA = -0x3d;
   static int ENOATTR = -0x5d;
   static int ENOTSUP = -0x5f;
+  static int ERANGE = -0x22;
+
+  static int RENAME_NOREPLACE = 1;
+  static int RENAME_EXCHANGE = 2;
+
+  static int ACL_TYPE_ACCESS = 1;
+  static int ACL_TYPE_DEFAULT = 2;
 
   static int MODE_MASK_R = 4;
   static int MODE_MASK_W = 2;
@@ -379,16 +403,22 @@ public class JuiceFileSystemImpl extends FileSystem {
     obj.put("entryTimeout", Float.valueOf(getConf(conf, "entry-cache", "0.0")));
     obj.put("dirEntryTimeout", Float.valueOf(getConf(conf, "dir-entry-cache", "0.0")));
     obj.put("cacheFullBlock", Boolean.valueOf(getConf(conf, "cache-full-block", "true")));
+    obj.put("cacheRanges", Boolean.valueOf(getConf(conf, "cache-ranges", "false")));
+    obj.put("encryptCache", Boolean.valueOf(getConf(conf, "encrypt-cache", "false")));
+    obj.put("dataKeyDir", getConf(conf, "data-key-dir", ""));
     obj.put("cacheChecksum", getConf(conf, "verify-cache-checksum", "full"));
     obj.put("cacheEviction", getConf(conf, "cache-eviction", "2-random"));
     obj.put("cacheScanInterval", Integer.valueOf(getConf(conf, "cache-scan-interval", "300")));
     obj.put("metacache", Boolean.valueOf(getConf(conf, "metacache", "true")));
     obj.put("autoCreate", Boolean.valueOf(getConf(conf, "auto-create-cache-dir", "true")));
     obj.put("maxUploads", Integer.valueOf(getConf(conf, "max-uploads", "20")));
+    obj.put("maxDownloads", Integer.valueOf(getConf(conf, "max-downloads", "200")));
     obj.put("maxDeletes", Integer.valueOf(getConf(conf, "max-deletes", "10")));
     obj.put("skipDirNlink", Integer.valueOf(getConf(conf, "skip-dir-nlink", "20")));
     obj.put("uploadLimit", Integer.valueOf(getConf(conf, "upload-limit", "0")));
     obj.put("downloadLimit", Integer.valueOf(getConf(conf, "download-limit", "0")));
+    obj.put("uploadLimitSchedule", getConf(conf, "upload-limit-schedule", ""));
+    obj.put("downloadLimitSchedule", getConf(conf, "download-limit-schedule", ""));
     obj.put("ioRetries", Integer.valueOf(getConf(conf, "io-retries", "10")));
     obj.put("getTimeout", Integer.valueOf(getConf(conf, "get-timeout", getConf(conf, "object-timeout", "5"))));
     obj.put("putTimeout", Integer.valueOf(getConf(conf, "put-timeout", getConf(conf, "object-timeout", "60"))));
@@ -400,9 +430,13 @@ public class JuiceFileSystemImpl extends FileSystem {
     obj.put("pushAuth", getConf(conf, "push-auth", ""));
     obj.put("pushGraphite", getConf(conf, "push-graphite", ""));
     obj.put("fastResolve", Boolean.valueOf(getConf(conf, "fast-resolve", "true")));
+    obj.put("strictXattrs", Boolean.valueOf(getConf(conf, "strict-xattrs", "false")));
     obj.put("noUsageReport", Boolean.valueOf(getConf(conf, "no-usage-report", "false")));
     obj.put("freeSpace", getConf(conf, "free-space", "0.1"));
     obj.put("accessLog", getConf(conf, "access-log", ""));
+    obj.put("accessLogFormat", getConf(conf, "access-log-format", "text"));
+    obj.put("accessLogSample", Float.valueOf(getConf(conf, "access-log-sample", "1")));
+    obj.put("accessLogRotate", Integer.valueOf(getConf(conf, "access-log-rotate", "300")));
     String jsonConf = obj.toString(2);
     handle = lib.jfs_init(name, jsonConf, user, group, superuser, supergroup);
     if (handle <= 0) {
@@ -1361,13 +1395,13 @@ public class JuiceFileSystemImpl extends FileSystem {
     if (dstStr.startsWith(srcStr) && (dstStr.charAt(srcStr.length()) == Path.SEPARATOR_CHAR)) {
       return false;
     }
-    int r = lib.jfs_rename(Thread.currentThread().getId(), handle, normalizePath(src), normalizePath(dst));
+    int r = lib.jfs_rename(Thread.currentThread().getId(), handle, normalizePath(src), normalizePath(dst), RENAME_NOREPLACE);
     if (r == EEXIST) {
       try {
         FileStatus st = getFileStatus(dst);
         if (st.isDirectory()) {
           dst = new Path(dst, src.getName());
-          r = lib.jfs_rename(Thread.currentThread().getId(), handle, normalizePath(src), normalizePath(dst));
+          r = lib.jfs_rename(Thread.currentThread().getId(), handle, normalizePath(src), normalizePath(dst), RENAME_NOREPLACE);
         } else {
           return false;
         }
@@ -1381,6 +1415,32 @@ public class JuiceFileSystemImpl extends FileSystem {
     return true;
   }
 
+  @Override
+  protected void rename(Path src, Path dst, Options.Rename... options) throws IOException {
+    statistics.incrementWriteOps(1);
+    int flags = RENAME_NOREPLACE;
+    for (Options.Rename opt : options) {
+      if (opt == Options.Rename.OVERWRITE) {
+        flags = 0;
+      }
+    }
+    int r = lib.jfs_rename(Thread.currentThread().getId(), handle, normalizePath(src), normalizePath(dst), flags);
+    if (r == EEXIST)
+      throw new FileAlreadyExistsException(dst.toString());
+    if (r < 0)
+      throw error(r, src);
+  }
+
+  /**
+   * Atomically exchange two existing files or directories.
+   */
+  public void exchange(Path src, Path dst) throws IOException {
+    statistics.incrementWriteOps(1);
+    int r = lib.jfs_rename(Thread.currentThread().getId(), handle, normalizePath(src), normalizePath(dst), RENAME_EXCHANGE);
+    if (r < 0)
+      throw error(r, src);
+  }
+
   @Override
   public boolean truncate(Path f, long newLength) throws IOException {
     int r = lib.jfs_truncate(Thread.currentThread().getId(), handle, normalizePath(f), newLength);
@@ -1430,6 +1490,121 @@ public class JuiceFileSystemImpl extends FileSystem {
     return new ContentSummary(size, files, dirs);
   }
 
+  /**
+   * Watch the changes of a directory (recursively). The changes made by other clients are received as CHANGE
+   * events (without path for removed inodes), which need them to publish the changed inodes (invalidate-cache).
+   *
+   * @param f    the directory to watch
+   * @param size the number of events buffered in client, the events are dropped when it's full
+   */
+  public Watcher watch(Path f, int size) throws IOException {
+    String path = normalizePath(f);
+    int wid = lib.jfs_watch(Thread.currentThread().getId(), handle, path, size);
+    if (wid < 0) {
+      throw error(wid, f);
+    }
+    return new Watcher(wid, f);
+  }
+
+  public class Watcher implements Closeable {
+    private final int wid;
+    private final Path dir;
+    private int bufsize = 64 << 10;
+    private Pointer buf = Memory.allocate(Runtime.getRuntime(lib), bufsize);
+
+    private Watcher(int wid, Path dir) {
+      this.wid = wid;
+      this.dir = dir;
+    }
+
+    /**
+     * Wait for the events up to timeout (in milliseconds), an empty list is returned if there is no event.
+     */
+    public List<WatchEvent> poll(int timeout) throws IOException {
+      int r = lib.jfs_watch_read(Thread.currentThread().getId(), wid, timeout, buf, bufsize);
+      if (r == ERANGE) {
+        bufsize *= 2;
+        buf = Memory.allocate(Runtime.getRuntime(lib), bufsize);
+        return poll(timeout);
+      }
+      if (r < 0) {
+        throw error(r, dir);
+      }
+      List<WatchEvent> events = new ArrayList<>();
+      for (int off = 0; off < r; ) {
+        int type = buf.getByte(off) & 0xff;
+        long time = buf.getLongLong(off + 1);
+        long inode = buf.getLongLong(off + 9);
+        int plen = buf.getShort(off + 17) & 0xffff;
+        String path = buf.getString(off + 19, plen, StandardCharsets.UTF_8);
+        off += 19 + plen;
+        int nplen = buf.getShort(off) & 0xffff;
+        String newPath = buf.getString(off + 2, nplen, StandardCharsets.UTF_8);
+        off += 2 + nplen;
+        events.add(new WatchEvent(WatchEvent.Type.values()[type], time, inode, path, newPath));
+      }
+      return events;
+    }
+
+    @Override
+    public void close() {
+      lib.jfs_watch_close(wid);
+    }
+  }
+
+  public static class WatchEvent {
+    /**
+     * OVERFLOW means some events are dropped, so the directory should be rescanned.
+     * CHANGE means the inode (or the entries of a directory) is changed by another client.
+     */
+    public enum Type {OVERFLOW, CREATE, DELETE, RENAME, ATTR, CHANGE}
+
+    private final Type type;
+    private final long time;
+    private final long inode;
+    private final String path;
+    private final String newPath;
+
+    WatchEvent(Type type, long time, long inode, String path, String newPath) {
+      this.type = type;
+      this.time = time;
+      this.inode = inode;
+      this.path = path;
+      this.newPath = newPath;
+    }
+
+    public Type getType() {
+      return type;
+    }
+
+    /**
+     * @return the time of event in nanoseconds
+     */
+    public long getTime() {
+      return time;
+    }
+
+    public long getInode() {
+      return inode;
+    }
+
+    public String getPath() {
+      return path;
+    }
+
+    /**
+     * @return the new path for RENAME event
+     */
+    public String getNewPath() {
+      return newPath;
+    }
+
+    @Override
+    public String toString() {
+      return type + " " + path + (newPath.isEmpty() ? "" : " -> " + newPath);
+    }
+  }
+
   private FileStatus newFileStatus(Path p, Pointer buf, int size, boolean readlink) throws IOException {
     int mode = buf.getInt(0);
     boolean isdir = ((mode >>> 31) & 1) == 1; // Go
@@ -1438,9 +1613,10 @@ public class JuiceFileSystemImpl extends FileSystem {
     long length = buf.getLongLong(4);
     long mtime = buf.getLongLong(12);
     long atime = buf.getLongLong(20);
-    String user = buf.getString(28);
-    String group = buf.getString(28 + user.length() + 1);
-    assert (30 + user.length() + group.length() == size);
+    // birth time at 28 is not part of the FileStatus of Hadoop
+    String user = buf.getString(36);
+    String group = buf.getString(36 + user.length() + 1);
+    assert (38 + user.length() + group.length() == size);
     return new FileStatus(length, isdir, 1, blocksize, mtime, atime, perm, user, group, p);
   }
 
@@ -1540,7 +1716,7 @@ public class JuiceFileSystemImpl extends FileSystem {
 
   private FileStatus getFileStatusInternal(final Path f, boolean dereference) throws IOException {
     String path = normalizePath(f);
-    Pointer buf = Memory.allocate(Runtime.getRuntime(lib), 130);
+    Pointer buf = Memory.allocate(Runtime.getRuntime(lib), 138);
     int r;
     if (dereference) {
       r = lib.jfs_stat1(Thread.currentThread().getId(), handle, path, buf);
@@ -1555,7 +1731,7 @@ public class JuiceFileSystemImpl extends FileSystem {
 
   private FileStatus getFileStatusInternalNoException(final Path f) throws IOException {
     String path = normalizePath(f);
-    Pointer buf = Memory.allocate(Runtime.getRuntime(lib), 130);
+    Pointer buf = Memory.allocate(Runtime.getRuntime(lib), 138);
     int r = lib.jfs_lstat1(Thread.currentThread().getId(), handle, path, buf);
     if (r < 0) {
       return null;
@@ -1610,6 +1786,15 @@ public class JuiceFileSystemImpl extends FileSystem {
       throw error(r, p);
   }
 
+  /**
+   * Change the cache dirs and size (in MiB) without re-initializing, empty dirs or zero size means unchanged.
+   */
+  public void updateCache(String dirs, long size) throws IOException {
+    int r = lib.jfs_update_cache(handle, dirs == null ? "" : dirs, size);
+    if (r != 0)
+      throw error(r, null);
+  }
+
   @Override
   public void close() throws IOException {
     super.close();
@@ -1708,4 +1893,126 @@ public class JuiceFileSystemImpl extends FileSystem {
     if (r < 0)
       throw error(r, path);
   }
+
+  private List<AclEntry> getFacl(Path p, int aclType) throws IOException {
+    Pointer buf;
+    int bufsize = 1024;
+    int r;
+    do {
+      bufsize *= 2;
+      buf = Memory.allocate(Runtime.getRuntime(lib), bufsize);
+      r = lib.jfs_getfacl(Thread.currentThread().getId(), handle, normalizePath(p), aclType, buf, bufsize);
+    } while (r == bufsize);
+    if (r == ENOATTR || r == ENODATA)
+      return new ArrayList<AclEntry>(); // no ACL
+    if (r < 0)
+      throw error(r, p);
+    byte[] spec = new byte[r];
+    buf.get(0, spec, 0, r);
+    return AclEntry.parseAclSpec(new String(spec, StandardCharsets.UTF_8), true);
+  }
+
+  private void setFacl(Path p, int aclType, List<AclEntry> entries) throws IOException {
+    StringBuilder spec = new StringBuilder();
+    for (AclEntry e : entries) {
+      if (spec.length() > 0)
+        spec.append(',');
+      spec.append(e.toString());
+    }
+    int r = lib.jfs_setfacl(Thread.currentThread().getId(), handle, normalizePath(p), aclType, spec.toString());
+    if (r != 0)
+      throw error(r, p);
+  }
+
+  private static boolean sameAclEntry(AclEntry a, AclEntry b) {
+    return a.getScope() == b.getScope() && a.getType() == b.getType() && Objects.equals(a.getName(), b.getName());
+  }
+
+  private List<AclEntry> getAclEntries(Path p) throws IOException {
+    List<AclEntry> entries = getFacl(p, ACL_TYPE_ACCESS);
+    if (getFileStatus(p).isDirectory()) {
+      entries.addAll(getFacl(p, ACL_TYPE_DEFAULT));
+    }
+    return entries;
+  }
+
+  @Override
+  public AclStatus getAclStatus(Path p) throws IOException {
+    statistics.incrementReadOps(1);
+    FileStatus st = getFileStatus(p);
+    List<AclEntry> entries = new ArrayList<AclEntry>();
+    for (AclEntry e : getAclEntries(p)) {
+      // the owner, other and mask of access ACL are kept in permission
+      if (e.getScope() == AclEntryScope.DEFAULT || e.getName() != null || e.getType() == AclEntryType.GROUP) {
+        entries.add(e);
+      }
+    }
+    return new AclStatus.Builder().owner(st.getOwner()).group(st.getGroup())
+            .stickyBit(st.getPermission().getStickyBit()).setPermission(st.getPermission())
+            .addEntries(entries).build();
+  }
+
+  @Override
+  public void setAcl(Path p, List<AclEntry> aclSpec) throws IOException {
+    statistics.incrementWriteOps(1);
+    List<AclEntry> access = new ArrayList<AclEntry>();
+    List<AclEntry> defaults = new ArrayList<AclEntry>();
+    for (AclEntry e : aclSpec) {
+      if (e.getScope() == AclEntryScope.DEFAULT) {
+        defaults.add(e);
+      } else {
+        access.add(e);
+      }
+    }
+    if (!access.isEmpty()) {
+      setFacl(p, ACL_TYPE_ACCESS, access);
+    }
+    if (!defaults.isEmpty() || getFileStatus(p).isDirectory()) {
+      setFacl(p, ACL_TYPE_DEFAULT, defaults);
+    }
+  }
+
+  @Override
+  public void modifyAclEntries(Path p, List<AclEntry> aclSpec) throws IOException {
+    List<AclEntry> entries = getAclEntries(p);
+    for (AclEntry e : aclSpec) {
+      Iterator<AclEntry> it = entries.iterator();
+      while (it.hasNext()) {
+        if (sameAclEntry(it.next(), e)) {
+          it.remove();
+        }
+      }
+      entries.add(e);
+    }
+    setAcl(p, entries);
+  }
+
+  @Override
+  public void removeAclEntries(Path p, List<AclEntry> aclSpec) throws IOException {
+    List<AclEntry> entries = getAclEntries(p);
+    for (AclEntry e : aclSpec) {
+      Iterator<AclEntry> it = entries.iterator();
+      while (it.hasNext()) {
+        if (sameAclEntry(it.next(), e)) {
+          it.remove();
+        }
+      }
+    }
+    setAcl(p, entries);
+  }
+
+  @Override
+  public void removeDefaultAcl(Path p) throws IOException {
+    statistics.incrementWriteOps(1);
+    setFacl(p, ACL_TYPE_DEFAULT, new ArrayList<AclEntry>());
+  }
+
+  @Override
+  public void removeAcl(Path p) throws IOException {
+    statistics.incrementWriteOps(1);
+    setFacl(p, ACL_TYPE_ACCESS, new ArrayList<AclEntry>());
+    if (getFileStatus(p).isDirectory()) {
+      setFacl(p, ACL_TYPE_DEFAULT, new ArrayList<AclEntry>());
+    }
+  }
 }